@@ -1,7 +1,9 @@
 import { Check, Copy, Eye, EyeOff, Key } from "lucide-react";
+import Long from "long";
 import React from "react";
 import { User } from "../../../app/auth/auth_service";
 import capabilities from "../../../app/capabilities/capabilities";
+import Banner from "../../../app/components/banner/banner";
 import FilledButton, { OutlinedButton } from "../../../app/components/button/button";
 import Dialog, {
   DialogBody,
@@ -11,6 +13,7 @@ import Dialog, {
   DialogTitle,
 } from "../../../app/components/dialog/dialog";
 import TextInput from "../../../app/components/input/input";
+import Select, { Option } from "../../../app/components/select/select";
 import Spinner from "../../../app/components/spinner/spinner";
 import Modal from "../../../app/components/modal/modal";
 import alert_service from "../../../app/alert/alert_service";
@@ -18,6 +21,7 @@ import { copyToClipboard } from "../../../app/util/clipboard";
 import errorService from "../../../app/errors/error_service";
 import { CancelableRpc } from "../../../app/service/rpc_service";
 import { BuildBuddyError } from "../../../app/util/errors";
+import { formatTimestampUsec } from "../../../app/format/format";
 import { api_key } from "../../../proto/api_key_ts_proto";
 import rpcService from "../../../app/service/rpc_service";
 
@@ -42,6 +46,9 @@ interface State {
 
   updateForm: FormState<api_key.UpdateApiKeyRequest>;
 
+  /** The lifetime selected in the creation form, or 0 for no expiry. */
+  createExpiryDays: number;
+
   keyToDelete: api_key.ApiKey | null;
   isDeleteModalOpen: boolean;
   isDeleteModalSubmitting: boolean;
@@ -55,6 +62,8 @@ const INITIAL_STATE: State = {
 
   updateForm: newFormState(api_key.UpdateApiKeyRequest.create()),
 
+  createExpiryDays: 0,
+
   keyToDelete: null,
   isDeleteModalOpen: false,
   isDeleteModalSubmitting: false,
@@ -117,6 +126,7 @@ export default class ApiKeysComponent extends React.Component<ApiKeysComponentPr
 
   private async onClickCreateNew() {
     this.setState({
+      createExpiryDays: 0,
       createForm: {
         isOpen: true,
         isSubmitting: false,
@@ -173,6 +183,7 @@ export default class ApiKeysComponent extends React.Component<ApiKeysComponentPr
           label: apiKey.label,
           capability: [...apiKey.capability],
           visibleToDevelopers: apiKey.visibleToDevelopers,
+          allowedIpRanges: [...apiKey.allowedIpRanges],
         }),
       },
     });
@@ -200,6 +211,9 @@ export default class ApiKeysComponent extends React.Component<ApiKeysComponentPr
       await this.props.update(
         api_key.UpdateApiKeyRequest.create({
           ...this.state.updateForm.request,
+          // The form always starts from the key's current ranges, so an empty
+          // list means that the user removed them.
+          clearAllowedIpRanges: !this.state.updateForm.request.allowedIpRanges?.length,
         })
       );
     } catch (e) {
@@ -260,10 +274,25 @@ export default class ApiKeysComponent extends React.Component<ApiKeysComponentPr
     ]);
   }
 
+  private onSelectOrgAdmin(onChange: (name: string, value: any) => any) {
+    onChange("capability", [api_key.ApiKey.Capability.ORG_ADMIN_CAPABILITY]);
+  }
+
   private onChangeVisibility(onChange: (name: string, value: any) => any, e: React.ChangeEvent<HTMLInputElement>) {
     onChange("visibleToDevelopers", e.target.checked);
   }
 
+  private onChangeAllowedIpRanges(onChange: (name: string, value: any) => any, e: React.ChangeEvent<HTMLInputElement>) {
+    // Ranges are trimmed by the server, so keep the input as typed.
+    onChange("allowedIpRanges", e.target.value ? e.target.value.split(",") : []);
+  }
+
+  private onChangeExpiry(onChange: (name: string, value: any) => any, e: React.ChangeEvent<HTMLSelectElement>) {
+    const days = Number(e.target.value);
+    this.setState({ createExpiryDays: days });
+    onChange("expiryUsec", days ? Long.fromNumber((Date.now() + days * 24 * 60 * 60 * 1000) * 1000) : Long.ZERO);
+  }
+
   private canChangeCapabilities(): boolean {
     return this.props.user.isGroupAdmin();
   }
@@ -279,6 +308,7 @@ export default class ApiKeysComponent extends React.Component<ApiKeysComponentPr
     onSubmit,
     onChange,
     ref,
+    showExpiry,
     formState: { request, isOpen, isSubmitting },
   }: {
     title: string;
@@ -287,6 +317,8 @@ export default class ApiKeysComponent extends React.Component<ApiKeysComponentPr
     onSubmit: (e: React.FormEvent) => any;
     onChange: (name: string, value: any) => any;
     ref: React.RefObject<HTMLFormElement>;
+    /** Whether to show the expiry field, which can only be set on creation. */
+    showExpiry: boolean;
     formState: FormState<T>;
   }) {
     return (
@@ -364,6 +396,22 @@ export default class ApiKeysComponent extends React.Component<ApiKeysComponentPr
                   </label>
                 </div>
               )}
+              {/* User-owned keys cannot be used to administer the organization. */}
+              {!this.props.userOwnedOnly && (
+                <div className="field-container">
+                  <label className="checkbox-row">
+                    <input
+                      type="radio"
+                      onChange={this.onSelectOrgAdmin.bind(this, onChange)}
+                      checked={isOrgAdminKey(request)}
+                      disabled={!this.canChangeCapabilities()}
+                    />
+                    <span>
+                      Org admin key <span className="field-description">(for provisioning users via SCIM)</span>
+                    </span>
+                  </label>
+                </div>
+              )}
               {/* "Visible to developers" bit does not apply for user-level keys. */}
               {!this.props.userOwnedOnly && (
                 <div className="field-container">
@@ -379,6 +427,34 @@ export default class ApiKeysComponent extends React.Component<ApiKeysComponentPr
                   </label>
                 </div>
               )}
+              <div className="field-container">
+                <label className="note-input-label" htmlFor="allowedIpRanges">
+                  Allowed IP ranges <span className="field-description">(comma-separated CIDRs)</span>
+                </label>
+                <TextInput
+                  name="allowedIpRanges"
+                  placeholder="e.g. 10.0.0.0/8, 203.0.113.7/32"
+                  onChange={this.onChangeAllowedIpRanges.bind(this, onChange)}
+                  value={(request?.allowedIpRanges || []).join(",")}
+                />
+              </div>
+              {showExpiry && (
+                <div className="field-container">
+                  <label className="note-input-label" htmlFor="expiry">
+                    Expires <span className="field-description">(cannot be changed later)</span>
+                  </label>
+                  <Select
+                    name="expiry"
+                    value={this.state.createExpiryDays}
+                    onChange={this.onChangeExpiry.bind(this, onChange)}>
+                    <Option value={0}>Never</Option>
+                    <Option value={7}>In 7 days</Option>
+                    <Option value={30}>In 30 days</Option>
+                    <Option value={90}>In 90 days</Option>
+                    <Option value={365}>In 1 year</Option>
+                  </Select>
+                </div>
+              )}
             </DialogBody>
             <DialogFooter>
               <DialogFooterButtons>
@@ -432,6 +508,7 @@ export default class ApiKeysComponent extends React.Component<ApiKeysComponentPr
           submitLabel: "Create",
           formState: createForm,
           ref: this.createFormRef,
+          showExpiry: true,
           onChange: this.onChangeCreateForm.bind(this),
           onSubmit: this.onSubmitCreateNewForm.bind(this),
           onRequestClose: this.onCloseCreateForm.bind(this),
@@ -441,11 +518,19 @@ export default class ApiKeysComponent extends React.Component<ApiKeysComponentPr
           submitLabel: "Save",
           formState: updateForm,
           ref: this.updateFormRef,
+          showExpiry: false,
           onChange: this.onChangeUpdateForm.bind(this),
           onSubmit: this.onSubmitUpdateForm.bind(this),
           onRequestClose: this.onCloseUpdateForm.bind(this),
         })}
 
+        {getApiKeysResponse.apiKey.some(isExpiringSoon) && (
+          <Banner type="warning" className="api-keys-expiry-warning">
+            Some of these API keys expire within the next {EXPIRY_WARNING_DAYS} days. Replace them before they expire,
+            or requests that use them will fail.
+          </Banner>
+        )}
+
         <div className="api-keys-list">
           {!this.props.userOwnedOnly && getApiKeysResponse.apiKey.length == 0 && !this.canEdit() && (
             <div className="no-api-keys-message">
@@ -462,7 +547,12 @@ export default class ApiKeysComponent extends React.Component<ApiKeysComponentPr
                 )}
               </div>
               <div className="api-key-capabilities">
-                <span>{describeCapabilities(key)}</span>
+                <span title={describeRestrictions(key)}>{describeCapabilities(key)}</span>
+                {isExpiringSoon(key) && (
+                  <span className="api-key-expiring-soon" title={`Expires ${formatTimestampUsec(key.expiryUsec)}`}>
+                    Expiring
+                  </span>
+                )}
               </div>
               <ApiKeyField apiKey={key} />
               {this.props.user.canCall("updateApiKey") && (
@@ -550,6 +640,10 @@ function isExecutorKey<T extends ApiKeyFields>(apiKey: T | null) {
   ]);
 }
 
+function isOrgAdminKey<T extends ApiKeyFields>(apiKey: T | null) {
+  return hasExactCapabilities(apiKey, [api_key.ApiKey.Capability.ORG_ADMIN_CAPABILITY]);
+}
+
 function isReadOnly<T extends ApiKeyFields>(apiKey: T | null) {
   return hasExactCapabilities(apiKey, []);
 }
@@ -562,13 +656,38 @@ function describeCapabilities<T extends ApiKeyFields>(apiKey: T) {
     capabilities = "CAS-only";
   } else if (isExecutorKey(apiKey)) {
     capabilities = "Executor";
+  } else if (isOrgAdminKey(apiKey)) {
+    capabilities = "Org admin";
   }
   if (apiKey.visibleToDevelopers) {
     capabilities += " [D]";
   }
+  if (apiKey.allowedIpRanges?.length) {
+    capabilities += " [IP]";
+  }
   return capabilities;
 }
 
+function describeRestrictions(apiKey: api_key.ApiKey): string | undefined {
+  const restrictions = [];
+  if (apiKey.allowedIpRanges.length) {
+    restrictions.push(`Allowed IP ranges: ${apiKey.allowedIpRanges.join(", ")}`);
+  }
+  if (+apiKey.expiryUsec) {
+    restrictions.push(`Expires ${formatTimestampUsec(apiKey.expiryUsec)}`);
+  }
+  return restrictions.join("\n") || undefined;
+}
+
+// Keys are highlighted when they are this close to expiring. This matches the
+// default period for expiry warnings in the audit log.
+const EXPIRY_WARNING_DAYS = 7;
+
+function isExpiringSoon(apiKey: api_key.ApiKey): boolean {
+  const expiryUsec = +apiKey.expiryUsec;
+  return expiryUsec > 0 && expiryUsec - Date.now() * 1000 < EXPIRY_WARNING_DAYS * 24 * 60 * 60 * 1000 * 1000;
+}
+
 function newFormState<T extends ApiKeyFields>(request: T): FormState<T> {
   return {
     isOpen: false,
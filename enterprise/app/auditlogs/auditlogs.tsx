@@ -107,6 +107,7 @@ export default class AuditLogsComponent extends React.Component<AuditLogsCompone
       <>
         <div>{user}</div>
         <div>IP: {authInfo?.clientIp}</div>
+        {authInfo?.userAgent && <div>User agent: {authInfo.userAgent}</div>}
       </>
     );
   }
@@ -132,6 +133,12 @@ export default class AuditLogsComponent extends React.Component<AuditLogsCompone
       case auditlog.ResourceType.INVOCATION:
         res = "Invocation";
         break;
+      case auditlog.ResourceType.USER:
+        res = "User";
+        break;
+      case auditlog.ResourceType.FILE:
+        res = "File";
+        break;
     }
     return (
       <>
@@ -166,6 +173,18 @@ export default class AuditLogsComponent extends React.Component<AuditLogsCompone
         return "Execute Clean Workflow";
       case Action.CREATE_IMPERSONATION_API_KEY:
         return "Create Impersonation API Key";
+      case Action.LOGIN:
+        return "Login";
+      case Action.LOGIN_FAILED:
+        return "Login Failed";
+      case Action.AUTHENTICATION_FAILED:
+        return "Authentication Failed";
+      case Action.ACCESS_DENIED:
+        return "Access Denied";
+      case Action.EXECUTE_WORKFLOW:
+        return "Execute Workflow";
+      case Action.EXPIRATION_WARNING:
+        return "Expiration Warning";
     }
     return "";
   }
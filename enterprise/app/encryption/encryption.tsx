@@ -41,6 +41,13 @@ interface State {
 
   // AWS KMS form.
   awsKeyARN: string;
+
+  // Vault KMS form.
+  vaultMountPath: string;
+  vaultKeyName: string;
+
+  // Azure KMS form.
+  azureKeyID: string;
 }
 
 export default class EncryptionComponent extends React.Component<{}, State> {
@@ -59,6 +66,9 @@ export default class EncryptionComponent extends React.Component<{}, State> {
     gcpKeyRing: "",
     gcpKey: "",
     awsKeyARN: "",
+    vaultMountPath: "transit",
+    vaultKeyName: "",
+    azureKeyID: "",
   };
 
   componentDidMount() {
@@ -133,6 +143,21 @@ export default class EncryptionComponent extends React.Component<{}, State> {
           }),
         });
         break;
+      case encryption.KMS.VAULT:
+        req.kmsConfig = encryption.KMSConfig.create({
+          vaultKmsConfig: encryption.VaultKMSConfig.create({
+            mountPath: this.state.vaultMountPath,
+            keyName: this.state.vaultKeyName,
+          }),
+        });
+        break;
+      case encryption.KMS.AZURE:
+        req.kmsConfig = encryption.KMSConfig.create({
+          azureKmsConfig: encryption.AzureKMSConfig.create({
+            keyId: this.state.azureKeyID,
+          }),
+        });
+        break;
     }
     try {
       await rpc_service.service.setEncryptionConfig(req);
@@ -157,6 +182,10 @@ export default class EncryptionComponent extends React.Component<{}, State> {
         return "Google Cloud Platform KMS";
       case encryption.KMS.AWS:
         return "Amazon Web Services KMS";
+      case encryption.KMS.VAULT:
+        return "HashiCorp Vault Transit";
+      case encryption.KMS.AZURE:
+        return "Azure Key Vault";
       default:
         return "Unknown KMS";
     }
@@ -186,6 +215,18 @@ export default class EncryptionComponent extends React.Component<{}, State> {
     this.setState({ awsKeyARN: event.target.value });
   }
 
+  private onVaultMountPathChange(event: React.ChangeEvent<HTMLInputElement>) {
+    this.setState({ vaultMountPath: event.target.value });
+  }
+
+  private onVaultKeyNameChange(event: React.ChangeEvent<HTMLInputElement>) {
+    this.setState({ vaultKeyName: event.target.value });
+  }
+
+  private onAzureKeyIDChange(event: React.ChangeEvent<HTMLInputElement>) {
+    this.setState({ azureKeyID: event.target.value });
+  }
+
   private renderKMSFields(kms: encryption.KMS) {
     switch (kms) {
       case encryption.KMS.LOCAL_INSECURE:
@@ -297,6 +338,63 @@ export default class EncryptionComponent extends React.Component<{}, State> {
             </div>
           </>
         );
+      case encryption.KMS.VAULT:
+        return (
+          <>
+            <div className="kms-instructions">
+              The Transit key must be an encryption key (e.g. <code>aes256-gcm96</code>) and the BuildBuddy Vault token
+              must be allowed to use it for encryption and decryption.
+            </div>
+            <div className="field-row">
+              <label htmlFor="vaultMountPath" className="field-label">
+                Mount Path
+              </label>
+              <TextInput
+                autoComplete="off"
+                type="text"
+                name="vaultMountPath"
+                onChange={this.onVaultMountPathChange.bind(this)}
+                value={this.state.vaultMountPath}
+                placeholder="e.g. transit"
+              />
+            </div>
+            <div className="field-row">
+              <label htmlFor="vaultKeyName" className="field-label">
+                Key Name
+              </label>
+              <TextInput
+                autoComplete="off"
+                type="text"
+                name="vaultKeyName"
+                onChange={this.onVaultKeyNameChange.bind(this)}
+                value={this.state.vaultKeyName}
+                placeholder="e.g. buildbuddy"
+              />
+            </div>
+          </>
+        );
+      case encryption.KMS.AZURE:
+        return (
+          <>
+            <div className="kms-instructions">
+              The key must be an RSA key, and the BuildBuddy service principal must be allowed to perform the wrap key and
+              unwrap key operations on it.
+            </div>
+            <div className="field-row">
+              <label htmlFor="azureKeyID" className="field-label">
+                Key Identifier
+              </label>
+              <TextInput
+                autoComplete="off"
+                type="text"
+                name="azureKeyID"
+                onChange={this.onAzureKeyIDChange.bind(this)}
+                value={this.state.azureKeyID}
+                placeholder="e.g. https://my-vault.vault.azure.net/keys/my-key"
+              />
+            </div>
+          </>
+        );
     }
   }
 
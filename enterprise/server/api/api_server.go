@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auditlog"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/prom"
 	"github.com/buildbuddy-io/buildbuddy/proto/workflow"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
@@ -17,12 +18,14 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/target"
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/protobuf/proto"
 
@@ -31,9 +34,12 @@ import (
 
 	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
 	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
 	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
 	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
 )
 
 var (
@@ -252,6 +258,42 @@ func (s *APIServer) GetTarget(ctx context.Context, req *apipb.GetTargetRequest)
 	}, nil
 }
 
+func (s *APIServer) GetFlakyTargets(ctx context.Context, req *apipb.GetFlakyTargetsRequest) (*apipb.GetFlakyTargetsResponse, error) {
+	user, err := s.checkPreconditions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := target.GetFlakyTargets(ctx, s.env, timeutil.NewClock(), &trpb.GetFlakyTargetsRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: user.GetGroupID()},
+		RepoUrl:        req.GetRepoUrl(),
+		StartTimeUsec:  req.GetStartTimeUsec(),
+		EndTimeUsec:    req.GetEndTimeUsec(),
+		Role:           req.GetRole(),
+		MinRuns:        req.GetMinRuns(),
+		PageToken:      req.GetPageToken(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	flakyTargets := make([]*apipb.FlakyTarget, 0, len(rsp.GetFlakyTargets()))
+	for _, t := range rsp.GetFlakyTargets() {
+		flakyTargets = append(flakyTargets, &apipb.FlakyTarget{
+			Label:                  t.GetMetadata().GetLabel(),
+			RuleType:               t.GetMetadata().GetRuleType(),
+			TotalRuns:              t.GetTotalRuns(),
+			FlakyRuns:              t.GetFlakyRuns(),
+			InconsistentFailedRuns: t.GetInconsistentFailedRuns(),
+			FlakyCommits:           t.GetFlakyCommits(),
+			FlakinessScore:         t.GetFlakinessScore(),
+			LastFlakyInvocationId:  t.GetLastFlakyInvocationId(),
+		})
+	}
+	return &apipb.GetFlakyTargetsResponse{
+		FlakyTarget:   flakyTargets,
+		NextPageToken: rsp.GetNextPageToken(),
+	}, nil
+}
+
 func (s *APIServer) redisCachedActions(ctx context.Context, userInfo interfaces.UserInfo, iid, targetLabel string) ([]*apipb.Action, error) {
 	if !s.CacheEnabled() || s.env.GetMetricsCollector() == nil {
 		return nil, nil
@@ -434,6 +476,9 @@ func (s *APIServer) DeleteFile(ctx context.Context, req *apipb.DeleteFileRequest
 	if err != nil && !status.IsNotFoundError(err) {
 		return nil, err
 	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		al.Log(ctx, auditlog.FileResourceID(urlStr), alpb.Action_DELETE, nil)
+	}
 
 	return &apipb.DeleteFileResponse{}, nil
 }
@@ -557,6 +602,13 @@ func (s *APIServer) ExecuteWorkflow(ctx context.Context, req *apipb.ExecuteWorkf
 		}
 		return nil, err
 	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		action := alpb.Action_EXECUTE_WORKFLOW
+		if r.GetClean() {
+			action = alpb.Action_EXECUTE_CLEAN_WORKFLOW
+		}
+		al.Log(ctx, auditlog.GroupResourceID(user.GetGroupID()), action, r)
+	}
 
 	actionStatuses := make([]*apipb.ExecuteWorkflowResponse_ActionStatus, len(rsp.GetActionStatuses()))
 	for i, as := range rsp.GetActionStatuses() {
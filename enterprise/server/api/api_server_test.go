@@ -115,6 +115,22 @@ func TestGetTargetAuth(t *testing.T) {
 	require.Nil(t, resp)
 }
 
+func TestGetFlakyTargetsAuth(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "")
+	s := NewAPIServer(env)
+	resp, err := s.GetFlakyTargets(ctx, &apipb.GetFlakyTargetsRequest{RepoUrl: "https://github.com/buildbuddy-io/buildbuddy"})
+	require.Error(t, err)
+	require.Nil(t, resp)
+}
+
+func TestGetFlakyTargetsRequiresOLAPDB(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	s := NewAPIServer(env)
+	resp, err := s.GetFlakyTargets(ctx, &apipb.GetFlakyTargetsRequest{RepoUrl: "https://github.com/buildbuddy-io/buildbuddy"})
+	require.True(t, status.IsUnimplementedError(err), "expected Unimplemented error, got %v", err)
+	require.Nil(t, resp)
+}
+
 func TestGetTargetByLabel(t *testing.T) {
 	testUUID, err := uuid.NewRandom()
 	require.NoError(t, err)
@@ -0,0 +1,243 @@
+// Package api_key_expiry warns about API keys that are about to expire, so
+// that they can be rotated before builds start failing.
+package api_key_expiry
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/webhookutil"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flagutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
+)
+
+var (
+	warningPeriod = flag.Duration("auth.api_key_expiry_warning.period", 7*24*time.Hour, "How long before an API key expires to warn about it. Warnings are written to the audit log of the key's organization, and POSTed to auth.api_key_expiry_warning.webhook.url if it is set. Set to 0 to disable warnings.")
+
+	webhookURL        = flag.String("auth.api_key_expiry_warning.webhook.url", "", "If set, a JSON description of each API key that is about to expire is POSTed to this HTTPS URL.")
+	webhookHMACSecret = flagutil.New("auth.api_key_expiry_warning.webhook.hmac_secret", "", webhookutil.SecretFlagHelp, flagutil.SecretTag)
+)
+
+const (
+	// How often to check for API keys that are about to expire.
+	checkInterval = 15 * time.Minute
+
+	// The max number of keys to warn about in each check. Any remaining keys
+	// are warned about in the next check.
+	batchSize = 100
+
+	webhookTimeout = 30 * time.Second
+)
+
+// expiringKey is an API key that is about to expire.
+type expiringKey struct {
+	APIKeyID   string
+	GroupID    string
+	UserID     string
+	UserEmail  string
+	Label      string
+	ExpiryUsec int64
+}
+
+// webhookPayload is the JSON body of webhook requests.
+type webhookPayload struct {
+	APIKeyID  string `json:"api_key_id"`
+	Label     string `json:"label"`
+	GroupID   string `json:"group_id"`
+	UserID    string `json:"user_id,omitempty"`
+	UserEmail string `json:"user_email,omitempty"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// notifier periodically warns about API keys that expire within the warning
+// period. Apps coordinate through the DB, so that each key is normally warned
+// about once.
+type notifier struct {
+	env    environment.Env
+	clock  timeutil.Clock
+	period time.Duration
+
+	webhookURL    string
+	webhookSecret string
+	client        *http.Client
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Register starts warning about API keys that are about to expire, unless
+// warnings are disabled. It must be called after the audit logger is
+// registered.
+func Register(env environment.Env) error {
+	if *warningPeriod <= 0 {
+		return nil
+	}
+	if *webhookURL != "" {
+		if err := webhookutil.ValidateURL(*webhookURL); err != nil {
+			return status.WrapError(err, "invalid auth.api_key_expiry_warning.webhook.url")
+		}
+	}
+	n := newNotifier(env, timeutil.NewClock())
+	n.start()
+	env.GetHealthChecker().RegisterShutdownFunction(n.stop)
+	return nil
+}
+
+func newNotifier(env environment.Env, clock timeutil.Clock) *notifier {
+	return &notifier{
+		env:           env,
+		clock:         clock,
+		period:        *warningPeriod,
+		webhookURL:    *webhookURL,
+		webhookSecret: *webhookHMACSecret,
+		client:        &http.Client{Timeout: webhookTimeout},
+		quit:          make(chan struct{}),
+	}
+}
+
+func (n *notifier) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for {
+			if err := n.warnExpiringKeys(ctx); err != nil {
+				log.Warningf("Failed to warn about expiring API keys: %s", err)
+			}
+			select {
+			case <-time.After(checkInterval):
+			case <-n.quit:
+				return
+			}
+		}
+	}()
+	go func() {
+		<-n.quit
+		cancel()
+	}()
+}
+
+func (n *notifier) stop(ctx context.Context) error {
+	close(n.quit)
+	n.wg.Wait()
+	return nil
+}
+
+// warnExpiringKeys warns about the API keys that expire within the warning
+// period and that weren't warned about yet.
+func (n *notifier) warnExpiringKeys(ctx context.Context) error {
+	now := n.clock.Now()
+	rows, err := n.env.GetDBHandle().DB(ctx).Raw(`
+		SELECT
+			ak.api_key_id,
+			ak.group_id,
+			COALESCE(ak.user_id, '') AS user_id,
+			COALESCE(u.email, '') AS user_email,
+			ak.label,
+			ak.expiry_usec
+		FROM "APIKeys" AS ak
+		LEFT JOIN "Users" AS u ON u.user_id = ak.user_id
+		WHERE ak.expiry_usec > ?
+		AND ak.expiry_usec <= ?
+		AND ak.expiry_warning_sent_usec = 0
+		AND ak.impersonation = false
+		ORDER BY ak.expiry_usec ASC
+		LIMIT ?
+	`, now.UnixMicro(), now.Add(n.period).UnixMicro(), batchSize).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var keys []*expiringKey
+	for rows.Next() {
+		k := &expiringKey{}
+		if err := n.env.GetDBHandle().DB(ctx).ScanRows(rows, k); err != nil {
+			return err
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, k := range keys {
+		if err := n.warn(ctx, k); err != nil {
+			log.Warningf("Failed to warn that API key %s is about to expire: %s", k.APIKeyID, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// warn warns about a single key, unless another app already did.
+func (n *notifier) warn(ctx context.Context, k *expiringKey) error {
+	// Claim the key, so that other apps don't warn about it too.
+	res := n.env.GetDBHandle().DB(ctx).Exec(`
+		UPDATE "APIKeys"
+		SET expiry_warning_sent_usec = ?
+		WHERE api_key_id = ?
+		AND expiry_warning_sent_usec = 0
+	`, n.clock.Now().UnixMicro(), k.APIKeyID)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil
+	}
+	if n.webhookURL != "" {
+		if err := n.postWebhook(ctx, k); err != nil {
+			// Release the claim so that the warning is retried.
+			err2 := n.env.GetDBHandle().DB(context.Background()).Exec(
+				`UPDATE "APIKeys" SET expiry_warning_sent_usec = 0 WHERE api_key_id = ?`, k.APIKeyID).Error
+			if err2 != nil {
+				log.Warningf("Failed to release expiry warning claim on API key %s: %s", k.APIKeyID, err2)
+			}
+			return err
+		}
+	}
+	if al := n.env.GetAuditLogger(); al != nil {
+		resourceType := alpb.ResourceType_GROUP_API_KEY
+		if k.UserID != "" {
+			resourceType = alpb.ResourceType_USER_API_KEY
+		}
+		rid := &alpb.ResourceID{
+			Type: resourceType,
+			Id:   k.APIKeyID,
+			Name: k.Label,
+		}
+		// The warning isn't performed by anyone, so only the group is set.
+		al.LogForPrincipal(ctx, &interfaces.AuditLogPrincipal{GroupID: k.GroupID}, rid, alpb.Action_EXPIRATION_WARNING, nil)
+	}
+	log.Infof("Warned that API key %s in group %s expires at %s", k.APIKeyID, k.GroupID, expiresAt(k))
+	return nil
+}
+
+func expiresAt(k *expiringKey) string {
+	return time.UnixMicro(k.ExpiryUsec).UTC().Format(time.RFC3339)
+}
+
+func (n *notifier) postWebhook(ctx context.Context, k *expiringKey) error {
+	body, err := json.Marshal(&webhookPayload{
+		APIKeyID:  k.APIKeyID,
+		Label:     k.Label,
+		GroupID:   k.GroupID,
+		UserID:    k.UserID,
+		UserEmail: k.UserEmail,
+		ExpiresAt: expiresAt(k),
+	})
+	if err != nil {
+		return err
+	}
+	return webhookutil.Post(ctx, n.client, n.webhookURL, n.webhookSecret, "application/json", body)
+}
@@ -0,0 +1,114 @@
+package api_key_expiry
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/webhookutil"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauditlog"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testclock"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
+)
+
+func TestWarnExpiringKeys(t *testing.T) {
+	env := enterprise_testenv.New(t)
+	enterprise_testauth.Configure(t, env)
+	al := testauditlog.New(t)
+	env.SetAuditLogger(al)
+	ctx := context.Background()
+
+	u := enterprise_testauth.CreateRandomUser(t, env, "org1.invalid")
+	groupID := u.Groups[0].Group.GroupID
+	auth := env.GetAuthenticator().(*testauth.TestAuthenticator)
+	authCtx, err := auth.WithAuthenticatedUser(ctx, u.UserID)
+	require.NoError(t, err)
+
+	now := time.Now()
+	soon, err := env.GetAuthDB().CreateAPIKey(authCtx, groupID, "soon", nil /*=capabilities*/, false /*=visibleToDevelopers*/, now.Add(3*24*time.Hour).UnixMicro(), nil /*=allowedIPRanges*/)
+	require.NoError(t, err)
+	later, err := env.GetAuthDB().CreateAPIKey(authCtx, groupID, "later", nil /*=capabilities*/, false /*=visibleToDevelopers*/, now.Add(30*24*time.Hour).UnixMicro(), nil /*=allowedIPRanges*/)
+	require.NoError(t, err)
+	_, err = env.GetAuthDB().CreateAPIKey(authCtx, groupID, "never", nil /*=capabilities*/, false /*=visibleToDevelopers*/, 0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var bodies []string
+	var headers []http.Header
+	statusCode := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		bodies = append(bodies, string(body))
+		headers = append(headers, r.Header.Clone())
+		w.WriteHeader(statusCode)
+	}))
+	t.Cleanup(server.Close)
+
+	flags.Set(t, "auth.api_key_expiry_warning.webhook.url", server.URL)
+	flags.Set(t, "auth.api_key_expiry_warning.webhook.hmac_secret", "secret")
+	clock := testclock.StartingAt(now)
+	n := newNotifier(env, clock)
+
+	// Failed warnings should be retried.
+	require.Error(t, n.warnExpiringKeys(ctx))
+	require.Empty(t, al.GetAllEntries())
+	mu.Lock()
+	statusCode = http.StatusOK
+	mu.Unlock()
+	require.NoError(t, n.warnExpiringKeys(ctx))
+	// Keys should only be warned about once.
+	require.NoError(t, n.warnExpiringKeys(ctx))
+
+	require.Len(t, bodies, 2)
+	payload := &webhookPayload{}
+	require.NoError(t, json.Unmarshal([]byte(bodies[1]), payload))
+	assert.Equal(t, soon.APIKeyID, payload.APIKeyID)
+	assert.Equal(t, "soon", payload.Label)
+	assert.Equal(t, groupID, payload.GroupID)
+	assert.Equal(t, time.UnixMicro(soon.ExpiryUsec).UTC().Format(time.RFC3339), payload.ExpiresAt)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(bodies[1]))
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), headers[1].Get(webhookutil.SignatureHeader))
+
+	require.Len(t, al.GetAllEntries(), 1)
+	e := al.GetAllEntries()[0]
+	assert.Equal(t, alpb.Action_EXPIRATION_WARNING, e.Action)
+	assert.Equal(t, alpb.ResourceType_GROUP_API_KEY, e.Resource.GetType())
+	assert.Equal(t, soon.APIKeyID, e.Resource.GetId())
+	assert.Equal(t, groupID, e.Principal.GroupID)
+
+	// The other key should be warned about once it's within the warning
+	// period.
+	al.Reset()
+	clock.Set(now.Add(25 * 24 * time.Hour))
+	require.NoError(t, n.warnExpiringKeys(ctx))
+	require.Len(t, al.GetAllEntries(), 1)
+	assert.Equal(t, later.APIKeyID, al.GetAllEntries()[0].Resource.GetId())
+	require.Len(t, bodies, 3)
+}
+
+func TestRegister_RequiresHTTPSWebhook(t *testing.T) {
+	env := enterprise_testenv.New(t)
+	flags.Set(t, "auth.api_key_expiry_warning.webhook.url", "http://hooks.acme.corp/buildbuddy/expiry")
+	err := Register(env)
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument; got: %v", err)
+}
@@ -17,6 +17,8 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/random"
 	"github.com/buildbuddy-io/buildbuddy/server/util/role"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/useragent"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -62,6 +64,21 @@ func InvocationResourceID(id string) *alpb.ResourceID {
 	}
 }
 
+func UserResourceID(id, email string) *alpb.ResourceID {
+	return &alpb.ResourceID{
+		Type: alpb.ResourceType_USER,
+		Id:   id,
+		Name: email,
+	}
+}
+
+func FileResourceID(uri string) *alpb.ResourceID {
+	return &alpb.ResourceID{
+		Type: alpb.ResourceType_FILE,
+		Id:   uri,
+	}
+}
+
 func Register(env environment.Env) error {
 	if !*auditLogsEnabled {
 		return nil
@@ -82,6 +99,14 @@ func Register(env environment.Env) error {
 		dbh:          env.GetOLAPDBHandle(),
 		payloadTypes: payloadTypes,
 	}
+	e, err := newExporter(env, timeutil.NewClock())
+	if err != nil {
+		return err
+	}
+	if e != nil {
+		e.start()
+		env.GetHealthChecker().RegisterShutdownFunction(e.shutdown)
+	}
 	env.SetAuditLogger(l)
 	return nil
 }
@@ -99,6 +124,9 @@ func (l *Logger) wrapRequestProto(payload proto.Message) (*alpb.Entry_Request, e
 }
 
 func clearRequestContext(request proto.Message) proto.Message {
+	if request == nil {
+		return nil
+	}
 	fd := request.ProtoReflect().Descriptor().Fields().ByName("request_context")
 	if fd == nil {
 		return request
@@ -108,39 +136,69 @@ func clearRequestContext(request proto.Message) proto.Message {
 	return request
 }
 
-func (l *Logger) insertLog(ctx context.Context, resource *alpb.ResourceID, action alpb.Action, request proto.Message) error {
-	u, err := l.env.GetAuthenticator().AuthenticatedUser(ctx)
-	if err != nil {
-		return status.WrapError(err, "auth failed")
-	}
-
+// newEntry returns an entry for the given event in the given group, without
+// any information about who performed it.
+func (l *Logger) newEntry(ctx context.Context, groupID string, resource *alpb.ResourceID, action alpb.Action, request proto.Message) (*schema.AuditLog, error) {
 	request = clearRequestContext(request)
 
 	var requestBytes []byte
 	if request != nil {
 		rp, err := l.wrapRequestProto(request)
 		if err != nil {
-			return status.WrapErrorf(err, "could not wrap request proto")
+			return nil, status.WrapErrorf(err, "could not wrap request proto")
 		}
 		if err := l.fillIDDescriptors(ctx, rp); err != nil {
 			log.Warningf("could not fill ID descriptors: %s", err)
 		}
 		rpb, err := proto.Marshal(rp)
 		if err != nil {
-			return status.WrapErrorf(err, "could not marshal request proto")
+			return nil, status.WrapErrorf(err, "could not marshal request proto")
 		}
 		requestBytes = rpb
 	}
 
 	entry := &schema.AuditLog{
 		AuditLogID:    fmt.Sprintf("AL%d", random.RandUint64()),
-		GroupID:       u.GetGroupID(),
+		GroupID:       groupID,
 		EventTimeUsec: time.Now().UnixMicro(),
 		ClientIP:      clientip.Get(ctx),
+		UserAgent:     useragent.Get(ctx),
 		Action:        uint8(action),
 		Request:       string(requestBytes),
 	}
 
+	if resource.GetType() == alpb.ResourceType_GROUP {
+		entry.GroupID = resource.GetId()
+	} else {
+		entry.ResourceType = uint8(resource.GetType())
+		entry.ResourceID = resource.GetId()
+		entry.ResourceName = resource.GetName()
+	}
+	return entry, nil
+}
+
+// writeEntry inserts the entry into the database, from where it is exported
+// to the external sinks.
+func (l *Logger) writeEntry(ctx context.Context, entry *schema.AuditLog) error {
+	// Entries that don't belong to a group are inserted too, so that they are
+	// exported, but GetLogs never returns them.
+	if err := l.dbh.InsertAuditLog(ctx, entry); err != nil {
+		return status.WrapError(err, "could not insert audit log")
+	}
+	return nil
+}
+
+func (l *Logger) insertLog(ctx context.Context, resource *alpb.ResourceID, action alpb.Action, request proto.Message) error {
+	u, err := l.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return status.WrapError(err, "auth failed")
+	}
+
+	entry, err := l.newEntry(ctx, u.GetGroupID(), resource, action, request)
+	if err != nil {
+		return err
+	}
+
 	if u.GetUserID() != "" {
 		ui, err := l.env.GetUserDB().GetUser(ctx)
 		if err != nil {
@@ -159,19 +217,7 @@ func (l *Logger) insertLog(ctx context.Context, resource *alpb.ResourceID, actio
 		entry.AuthAPIKeyLabel = ak.Label
 	}
 
-	if resource.GetType() == alpb.ResourceType_GROUP {
-		entry.GroupID = resource.Id
-	} else {
-		entry.ResourceType = uint8(resource.Type)
-		entry.ResourceID = resource.Id
-		entry.ResourceName = resource.Name
-	}
-
-	if err := l.dbh.InsertAuditLog(ctx, entry); err != nil {
-		return status.WrapError(err, "could not insert audit log")
-	}
-
-	return nil
+	return l.writeEntry(ctx, entry)
 }
 
 func (l *Logger) Log(ctx context.Context, resource *alpb.ResourceID, action alpb.Action, request proto.Message) {
@@ -180,6 +226,20 @@ func (l *Logger) Log(ctx context.Context, resource *alpb.ResourceID, action alpb
 	}
 }
 
+func (l *Logger) LogForPrincipal(ctx context.Context, principal *interfaces.AuditLogPrincipal, resource *alpb.ResourceID, action alpb.Action, request proto.Message) {
+	entry, err := l.newEntry(ctx, principal.GroupID, resource, action, request)
+	if err != nil {
+		log.Warningf("could not insert audit log: %s", err)
+		return
+	}
+	entry.AuthUserID = principal.UserID
+	entry.AuthUserEmail = principal.UserEmail
+	entry.AuthAPIKeyID = principal.APIKeyID
+	if err := l.writeEntry(ctx, entry); err != nil {
+		log.Warningf("could not insert audit log: %s", err)
+	}
+}
+
 // cleanRequest clears out redundant noise from the requests.
 // There are two types of IDs we scrub:
 //  1. group ID -- audit logs are already scoped to groups so including this
@@ -188,6 +248,10 @@ func (l *Logger) Log(ctx context.Context, resource *alpb.ResourceID, action alpb
 //     so the ID under the request is redundant.
 func cleanRequest(e *alpb.Entry_Request) *alpb.Entry_Request {
 	e = proto.Clone(e).(*alpb.Entry_Request)
+	// Entries for events that are not API requests have no request.
+	if e.ApiRequest == nil {
+		return e
+	}
 	if r := e.ApiRequest.CreateApiKey; r != nil {
 		r.GroupId = ""
 	}
@@ -252,6 +316,16 @@ func (l *Logger) GetLogs(ctx context.Context, req *alpb.GetAuditLogsRequest) (*a
 	qb.AddWhereClause("group_id = ?", u.GetGroupID())
 	qb.AddWhereClause("event_time_usec >= ?", req.GetTimestampAfter().AsTime().UnixMicro())
 	qb.AddWhereClause("event_time_usec <= ?", req.GetTimestampBefore().AsTime().UnixMicro())
+	if len(req.GetResourceTypes()) > 0 {
+		qb.AddWhereClause("resource_type IN ?", resourceTypeValues(req.GetResourceTypes()))
+	}
+	if len(req.GetActions()) > 0 {
+		actions := make([]uint8, 0, len(req.GetActions()))
+		for _, a := range req.GetActions() {
+			actions = append(actions, uint8(a))
+		}
+		qb.AddWhereClause("action IN ?", actions)
+	}
 	if req.PageToken != "" {
 		ts, err := strconv.ParseInt(req.PageToken, 10, 64)
 		if err != nil {
@@ -295,7 +369,8 @@ func (l *Logger) GetLogs(ctx context.Context, req *alpb.GetAuditLogsRequest) (*a
 		entry := &alpb.Entry{
 			EventTime: timestamppb.New(time.UnixMicro(e.EventTimeUsec)),
 			AuthenticationInfo: &alpb.AuthenticationInfo{
-				ClientIp: e.ClientIP,
+				ClientIp:  e.ClientIP,
+				UserAgent: e.UserAgent,
 			},
 			Resource: &alpb.ResourceID{
 				Type: resourceType,
@@ -323,3 +398,18 @@ func (l *Logger) GetLogs(ctx context.Context, req *alpb.GetAuditLogsRequest) (*a
 
 	return resp, nil
 }
+
+// resourceTypeValues returns the values of the resource_type column that match
+// the given resource types.
+func resourceTypeValues(types []alpb.ResourceType) []uint8 {
+	values := make([]uint8, 0, len(types))
+	for _, t := range types {
+		values = append(values, uint8(t))
+		// Entries for the organization itself are stored without a resource
+		// type.
+		if t == alpb.ResourceType_GROUP {
+			values = append(values, uint8(alpb.ResourceType_UNKNOWN_RESOURCE))
+		}
+	}
+	return values
+}
@@ -0,0 +1,135 @@
+package auditlog
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clientip"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
+)
+
+const (
+	// Events that can be triggered by every request of a misconfigured
+	// client are logged at most once per window for each client and group.
+	eventThrottleWindow = 1 * time.Minute
+	// The max number of clients that throttled events are tracked for.
+	eventThrottleMaxKeys = 100_000
+)
+
+var throttle = &eventThrottle{lastLogged: make(map[string]time.Time)}
+
+// eventThrottle limits how often an event is logged for the same key.
+type eventThrottle struct {
+	mu         sync.Mutex
+	lastLogged map[string]time.Time
+}
+
+// allow returns whether an event with the given key should be logged at the
+// given time.
+func (t *eventThrottle) allow(key string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if last, ok := t.lastLogged[key]; ok && now.Sub(last) < eventThrottleWindow {
+		return false
+	}
+	if len(t.lastLogged) >= eventThrottleMaxKeys {
+		for k, last := range t.lastLogged {
+			if now.Sub(last) >= eventThrottleWindow {
+				delete(t.lastLogged, k)
+			}
+		}
+		if len(t.lastLogged) >= eventThrottleMaxKeys {
+			// Too many clients are triggering events at once, which is
+			// almost certainly abuse, so don't log any more of them.
+			return false
+		}
+	}
+	t.lastLogged[key] = now
+	return true
+}
+
+// LogLogin logs a successful login by the user with the given subject ID. The
+// login is logged in each of the groups that the user is a member of. If the
+// user does not have an account yet, it is only exported.
+func LogLogin(ctx context.Context, env environment.Env, subID, email string) {
+	al := env.GetAuditLogger()
+	if al == nil {
+		return
+	}
+	u, err := env.GetAuthDB().LookupUserFromSubID(ctx, subID)
+	if err != nil {
+		// Accounts are created after the first login.
+		if !db.IsRecordNotFound(err) {
+			log.Warningf("Could not look up user %q for audit log: %s", subID, err)
+		}
+		al.LogForPrincipal(ctx, &interfaces.AuditLogPrincipal{UserEmail: email}, UserResourceID("", email), alpb.Action_LOGIN, nil)
+		return
+	}
+	if u.Email != "" {
+		email = u.Email
+	}
+	if len(u.Groups) == 0 {
+		al.LogForPrincipal(ctx, &interfaces.AuditLogPrincipal{UserID: u.UserID, UserEmail: email}, UserResourceID(u.UserID, email), alpb.Action_LOGIN, nil)
+		return
+	}
+	for _, g := range u.Groups {
+		p := &interfaces.AuditLogPrincipal{
+			GroupID:   g.Group.GroupID,
+			UserID:    u.UserID,
+			UserEmail: email,
+		}
+		al.LogForPrincipal(ctx, p, UserResourceID(u.UserID, email), alpb.Action_LOGIN, nil)
+	}
+}
+
+// LogLoginFailure logs a failed login to the group with the given URL
+// identifier, or to no group if the slug is empty or unknown.
+func LogLoginFailure(ctx context.Context, env environment.Env, slug string) {
+	al := env.GetAuditLogger()
+	if al == nil {
+		return
+	}
+	if !throttle.allow("login/"+slug+"/"+clientip.Get(ctx), time.Now()) {
+		return
+	}
+	p := &interfaces.AuditLogPrincipal{}
+	if slug != "" {
+		if g, err := env.GetUserDB().GetGroupByURLIdentifier(ctx, slug); err == nil {
+			p.GroupID = g.GroupID
+		}
+	}
+	al.LogForPrincipal(ctx, p, nil, alpb.Action_LOGIN_FAILED, nil)
+}
+
+// LogAuthenticationFailure logs a request that presented an invalid API key.
+// The API key isn't associated with a group, so the event is only exported.
+func LogAuthenticationFailure(ctx context.Context, env environment.Env) {
+	al := env.GetAuditLogger()
+	if al == nil {
+		return
+	}
+	if !throttle.allow("authn/"+clientip.Get(ctx), time.Now()) {
+		return
+	}
+	al.LogForPrincipal(ctx, &interfaces.AuditLogPrincipal{}, nil, alpb.Action_AUTHENTICATION_FAILED, nil)
+}
+
+// LogAccessDenied logs a request by the given principal that was denied by the
+// IP rules of the principal's group or by the allowed IP ranges of its API key.
+func LogAccessDenied(ctx context.Context, env environment.Env, principal *interfaces.AuditLogPrincipal) {
+	al := env.GetAuditLogger()
+	if al == nil {
+		return
+	}
+	key := "access/" + principal.GroupID + "/" + principal.UserID + "/" + principal.APIKeyID + "/" + clientip.Get(ctx)
+	if !throttle.allow(key, time.Now()) {
+		return
+	}
+	al.LogForPrincipal(ctx, principal, GroupResourceID(principal.GroupID), alpb.Action_ACCESS_DENIED, nil)
+}
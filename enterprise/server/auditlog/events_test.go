@@ -0,0 +1,36 @@
+package auditlog
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventThrottle(t *testing.T) {
+	th := &eventThrottle{lastLogged: make(map[string]time.Time)}
+	now := time.Now()
+
+	require.True(t, th.allow("a", now))
+	require.False(t, th.allow("a", now.Add(eventThrottleWindow-time.Second)))
+	// Other keys are throttled separately.
+	require.True(t, th.allow("b", now))
+	require.True(t, th.allow("a", now.Add(eventThrottleWindow)))
+}
+
+func TestEventThrottle_ForgetsExpiredKeysWhenFull(t *testing.T) {
+	th := &eventThrottle{lastLogged: make(map[string]time.Time)}
+	now := time.Now()
+	for i := 0; i < eventThrottleMaxKeys; i++ {
+		th.allow(fmt.Sprintf("key%d", i), now)
+	}
+
+	// While all of the tracked keys are within the window, new keys are
+	// throttled.
+	require.False(t, th.allow("new", now))
+
+	later := now.Add(eventThrottleWindow)
+	require.True(t, th.allow("new", later))
+	require.Len(t, th.lastLogged, 1)
+}
@@ -0,0 +1,436 @@
+package auditlog
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/webhookutil"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clickhouse/schema"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
+)
+
+var (
+	exportPollInterval = flag.Duration("app.audit_log_export.poll_interval", 10*time.Second, "How often the audit log is checked for new entries to export.")
+)
+
+const (
+	// Entries are only exported once they are this old, so that the cursors
+	// don't skip past entries that are still being inserted into the OLAP DB.
+	exportSettleDelay = 30 * time.Second
+
+	// How long an app holds the claim on a sink after it last checked for new
+	// entries. If the app goes away, another app takes over once the claim
+	// expires.
+	exportClaimTTL = 2 * time.Minute
+)
+
+// exportedEntry is the JSON representation of an audit log entry that is
+// delivered to the export sinks.
+type exportedEntry struct {
+	ID           string          `json:"id"`
+	GroupID      string          `json:"group_id"`
+	EventTime    string          `json:"event_time"`
+	ClientIP     string          `json:"client_ip,omitempty"`
+	UserAgent    string          `json:"user_agent,omitempty"`
+	UserID       string          `json:"user_id,omitempty"`
+	UserEmail    string          `json:"user_email,omitempty"`
+	APIKeyID     string          `json:"api_key_id,omitempty"`
+	APIKeyLabel  string          `json:"api_key_label,omitempty"`
+	ResourceType string          `json:"resource_type"`
+	ResourceID   string          `json:"resource_id,omitempty"`
+	ResourceName string          `json:"resource_name,omitempty"`
+	Action       string          `json:"action"`
+	Request      json.RawMessage `json:"request,omitempty"`
+}
+
+// marshalExportedEntry returns the JSON representation of the given audit log
+// entry, on a single line.
+func marshalExportedEntry(e *schema.AuditLog, request *alpb.Entry_Request) ([]byte, error) {
+	resourceType := alpb.ResourceType(e.ResourceType)
+	resourceID := e.ResourceID
+	if resourceType == alpb.ResourceType_UNKNOWN_RESOURCE {
+		resourceType = alpb.ResourceType_GROUP
+		resourceID = e.GroupID
+	}
+	ee := &exportedEntry{
+		ID:           e.AuditLogID,
+		GroupID:      e.GroupID,
+		EventTime:    time.UnixMicro(e.EventTimeUsec).UTC().Format(time.RFC3339Nano),
+		ClientIP:     e.ClientIP,
+		UserAgent:    e.UserAgent,
+		UserID:       e.AuthUserID,
+		UserEmail:    e.AuthUserEmail,
+		APIKeyID:     e.AuthAPIKeyID,
+		APIKeyLabel:  e.AuthAPIKeyLabel,
+		ResourceType: resourceType.String(),
+		ResourceID:   resourceID,
+		ResourceName: e.ResourceName,
+		Action:       alpb.Action(e.Action).String(),
+	}
+	if request != nil {
+		b, err := protojson.Marshal(cleanRequest(request))
+		if err != nil {
+			return nil, err
+		}
+		// json.Marshal compacts the request, so the entry fits on a single
+		// line.
+		ee.Request = json.RawMessage(b)
+	}
+	return json.Marshal(ee)
+}
+
+// sink delivers audit log entries to an external system.
+type sink interface {
+	// name identifies the sink in logs and metrics.
+	name() string
+
+	// send delivers the given entries, each of which is a single line of
+	// JSON. If an error is returned, all of the entries are sent again, so
+	// the sink may deliver some entries more than once.
+	send(ctx context.Context, entries [][]byte) error
+}
+
+// exporter delivers the audit log entries in the OLAP DB to the configured
+// sinks. Each sink has a cursor in the DB that records the last entry that was
+// delivered to it, so entries that could not be delivered yet are retried
+// from the OLAP DB, even after a restart, and a sink that is unavailable does
+// not hold up the others. Apps coordinate through the cursors so that only
+// one app delivers entries to each sink at a time.
+type exporter struct {
+	dbh     interfaces.DBHandle
+	olapDBH interfaces.OLAPDBHandle
+	clock   timeutil.Clock
+
+	// Identifies this app in the claims on the cursors.
+	owner        string
+	pollInterval time.Duration
+
+	queues []*sinkQueue
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	// Canceled when in-flight deliveries should be abandoned.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newExporter returns an exporter for the sinks that are configured, or nil if
+// no sinks are configured.
+func newExporter(env environment.Env, clock timeutil.Clock) (*exporter, error) {
+	var queues []*sinkQueue
+	if *syslogAddress != "" {
+		s, err := newSyslogSink(*syslogAddress, *syslogUseTLS, *syslogTLSCACertFile)
+		if err != nil {
+			return nil, err
+		}
+		queues = append(queues, newSinkQueue(s, syslogMaxBatchSize, 0))
+	}
+	if *webhookURL != "" {
+		if err := webhookutil.ValidateURL(*webhookURL); err != nil {
+			return nil, status.WrapError(err, "invalid app.audit_log_export.webhook.url")
+		}
+		s := newWebhookSink(*webhookURL, *webhookHMACSecret)
+		queues = append(queues, newSinkQueue(s, webhookMaxBatchSize, 0))
+	}
+	if *blobstoreExportEnabled {
+		if env.GetBlobstore() == nil {
+			return nil, status.FailedPreconditionError("exporting audit logs to the blobstore requires a blobstore to be configured")
+		}
+		s := newBlobstoreSink(env.GetBlobstore(), *blobstorePathPrefix)
+		queues = append(queues, newSinkQueue(s, blobstoreMaxEntriesPerFile, *blobstoreRotationInterval))
+	}
+	if len(queues) == 0 {
+		return nil, nil
+	}
+	if env.GetDBHandle() == nil {
+		return nil, status.FailedPreconditionError("exporting audit logs requires a database to be configured")
+	}
+	owner, err := random.RandomString(20)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &exporter{
+		dbh:          env.GetDBHandle(),
+		olapDBH:      env.GetOLAPDBHandle(),
+		clock:        clock,
+		owner:        owner,
+		pollInterval: *exportPollInterval,
+		queues:       queues,
+		quit:         make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+	}, nil
+}
+
+// start starts delivering entries to the sinks.
+func (e *exporter) start() {
+	for _, q := range e.queues {
+		q := q
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			e.run(q)
+		}()
+	}
+}
+
+// shutdown stops delivering entries, and releases the claims on the sinks so
+// that another app can take over right away. Entries that haven't been
+// delivered yet are delivered by the next app that claims the sink.
+func (e *exporter) shutdown(ctx context.Context) error {
+	close(e.quit)
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		e.cancel()
+		<-done
+	}
+	e.cancel()
+	for _, q := range e.queues {
+		if err := e.release(ctx, q.sink.name()); err != nil {
+			log.Warningf("Could not release the claim on the %s audit log export sink: %s", q.sink.name(), err)
+		}
+	}
+	return nil
+}
+
+// run delivers batches of entries to the sink until quit is closed. Failed
+// batches are retried with backoff.
+func (e *exporter) run(q *sinkQueue) {
+	r := retry.New(e.ctx, q.retryOptions)
+	for {
+		full, err := e.exportBatch(e.ctx, q)
+		wait := e.pollInterval
+		if err != nil {
+			metrics.AuditLogExportErrors.With(q.labels()).Inc()
+			log.Warningf("Could not export audit log entries to the %s sink (attempt %d): %s", q.sink.name(), r.AttemptNumber(), err)
+			wait, _ = r.NextDelay()
+		} else {
+			r.Reset()
+			if full {
+				wait = 0
+			}
+		}
+		select {
+		case <-e.quit:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// exportBatch delivers the next batch of entries to the sink, if this app
+// holds the claim on the sink, and advances the sink's cursor past them. It
+// returns whether the batch was full, in which case there may be more entries
+// to deliver right away.
+func (e *exporter) exportBatch(ctx context.Context, q *sinkQueue) (bool, error) {
+	cursor, err := e.claim(ctx, q.sink.name())
+	if err != nil {
+		return false, status.WrapError(err, "claim sink")
+	}
+	if cursor == nil {
+		// Another app is delivering entries to the sink.
+		return false, nil
+	}
+	now := e.clock.Now()
+	rows, err := e.readEntries(ctx, cursor, now.Add(-exportSettleDelay), q.maxBatchSize)
+	if err != nil {
+		return false, status.WrapError(err, "read audit logs")
+	}
+	if len(rows) == 0 {
+		metrics.AuditLogExportLagUsec.With(q.labels()).Set(0)
+		return false, nil
+	}
+	oldest := time.UnixMicro(rows[0].EventTimeUsec)
+	metrics.AuditLogExportLagUsec.With(q.labels()).Set(float64(now.Sub(oldest).Microseconds()))
+	if len(rows) < q.maxBatchSize && now.Sub(oldest) < q.maxBatchDelay {
+		// Wait for the batch to fill up.
+		return false, nil
+	}
+
+	entries := make([][]byte, 0, len(rows))
+	for _, row := range rows {
+		b, err := marshalStoredEntry(row)
+		if err != nil {
+			// Retrying won't help, so skip the entry rather than holding up
+			// the ones after it.
+			log.Errorf("Skipping audit log entry %s that could not be marshaled for export: %s", row.AuditLogID, err)
+			continue
+		}
+		entries = append(entries, b)
+	}
+	if len(entries) > 0 {
+		if err := q.sink.send(ctx, entries); err != nil {
+			return false, err
+		}
+		metrics.AuditLogExportedEntries.With(q.labels()).Add(float64(len(entries)))
+	}
+	if err := e.advance(ctx, q.sink.name(), rows[len(rows)-1]); err != nil {
+		// The entries are delivered again by whichever app holds the claim
+		// next.
+		return false, status.WrapError(err, "advance cursor")
+	}
+	return len(rows) == q.maxBatchSize, nil
+}
+
+// claim claims the sink for this app, or extends the claim if this app
+// already holds it, and returns the sink's cursor. It returns nil if another
+// app holds the claim.
+func (e *exporter) claim(ctx context.Context, sinkName string) (*tables.AuditLogExportCursor, error) {
+	now := e.clock.Now()
+	expiresAtUsec := now.Add(exportClaimTTL).UnixMicro()
+	err := e.dbh.DB(ctx).Exec(`
+		UPDATE "AuditLogExportCursors"
+		SET lease_owner = ?, lease_expires_at_usec = ?
+		WHERE sink = ?
+		AND (lease_owner = ? OR lease_expires_at_usec < ?)
+	`, e.owner, expiresAtUsec, sinkName, e.owner, now.UnixMicro()).Error
+	if err != nil {
+		return nil, err
+	}
+	cursor := &tables.AuditLogExportCursor{}
+	err = e.dbh.ReadRow(ctx, cursor, "sink = ?", sinkName)
+	if status.IsNotFoundError(err) {
+		// This is the first time entries are exported to the sink. Start
+		// from the entries that are logged from now on, rather than
+		// exporting all of the entries that are already in the audit log.
+		cursor = &tables.AuditLogExportCursor{
+			Sink:               sinkName,
+			EventTimeUsec:      now.Add(-exportSettleDelay).UnixMicro(),
+			LeaseOwner:         e.owner,
+			LeaseExpiresAtUsec: expiresAtUsec,
+		}
+		if err := e.dbh.DB(ctx).Create(cursor).Error; err != nil {
+			if e.dbh.IsDuplicateKeyError(err) {
+				// Another app created the cursor first.
+				return nil, nil
+			}
+			return nil, err
+		}
+		return cursor, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cursor.LeaseOwner != e.owner {
+		return nil, nil
+	}
+	return cursor, nil
+}
+
+// advance moves the sink's cursor to the given entry, as long as this app
+// still holds the claim on the sink.
+func (e *exporter) advance(ctx context.Context, sinkName string, last *schema.AuditLog) error {
+	res := e.dbh.DB(ctx).Exec(`
+		UPDATE "AuditLogExportCursors"
+		SET event_time_usec = ?, audit_log_id = ?
+		WHERE sink = ? AND lease_owner = ?
+	`, last.EventTimeUsec, last.AuditLogID, sinkName, e.owner)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return status.AbortedErrorf("lost the claim on the %s sink", sinkName)
+	}
+	return nil
+}
+
+// release gives up this app's claim on the sink, if it holds it.
+func (e *exporter) release(ctx context.Context, sinkName string) error {
+	return e.dbh.DB(ctx).Exec(`
+		UPDATE "AuditLogExportCursors"
+		SET lease_expires_at_usec = 0
+		WHERE sink = ? AND lease_owner = ?
+	`, sinkName, e.owner).Error
+}
+
+// readEntries returns up to limit entries that come after the cursor, in
+// cursor order, and that were logged no later than the given time.
+func (e *exporter) readEntries(ctx context.Context, cursor *tables.AuditLogExportCursor, before time.Time, limit int) ([]*schema.AuditLog, error) {
+	q := `
+		SELECT * FROM AuditLogs
+		WHERE (event_time_usec > ? OR (event_time_usec = ? AND audit_log_id > ?))
+		AND event_time_usec <= ?
+		ORDER BY event_time_usec, audit_log_id
+		LIMIT ?
+	`
+	args := []interface{}{cursor.EventTimeUsec, cursor.EventTimeUsec, cursor.AuditLogID, before.UnixMicro(), limit}
+	rows, err := e.olapDBH.DB(ctx).Raw(q, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*schema.AuditLog
+	for rows.Next() {
+		entry := &schema.AuditLog{}
+		if err := e.olapDBH.DB(ctx).ScanRows(rows, entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// marshalStoredEntry returns the JSON representation of an entry that was read
+// back from the OLAP DB.
+func marshalStoredEntry(e *schema.AuditLog) ([]byte, error) {
+	var request *alpb.Entry_Request
+	if e.Request != "" {
+		request = &alpb.Entry_Request{}
+		if err := proto.Unmarshal([]byte(e.Request), request); err != nil {
+			return nil, err
+		}
+	}
+	return marshalExportedEntry(e, request)
+}
+
+// sinkQueue holds the delivery settings for a sink.
+type sinkQueue struct {
+	sink sink
+	// The max number of entries that are sent at once.
+	maxBatchSize int
+	// How long to wait for a batch to fill up before sending it. If zero,
+	// the entries that are pending are sent right away.
+	maxBatchDelay time.Duration
+	retryOptions  *retry.Options
+}
+
+func newSinkQueue(s sink, maxBatchSize int, maxBatchDelay time.Duration) *sinkQueue {
+	return &sinkQueue{
+		sink:          s,
+		maxBatchSize:  maxBatchSize,
+		maxBatchDelay: maxBatchDelay,
+		retryOptions: &retry.Options{
+			InitialBackoff: 1 * time.Second,
+			MaxBackoff:     1 * time.Minute,
+			Multiplier:     2,
+			MaxRetries:     math.MaxInt,
+		},
+	}
+}
+
+func (q *sinkQueue) labels() prometheus.Labels {
+	return prometheus.Labels{metrics.AuditLogSinkLabel: q.sink.name()}
+}
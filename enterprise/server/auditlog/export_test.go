@@ -0,0 +1,236 @@
+package auditlog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/webhookutil"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clickhouse/schema"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
+)
+
+func TestMarshalExportedEntry(t *testing.T) {
+	e := &schema.AuditLog{
+		AuditLogID:      "AL1",
+		GroupID:         "GR1",
+		EventTimeUsec:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).UnixMicro(),
+		ClientIP:        "1.2.3.4",
+		UserAgent:       "bazel/7.0.0",
+		AuthAPIKeyID:    "AK1",
+		AuthAPIKeyLabel: "admin key",
+		Action:          uint8(alpb.Action_CREATE),
+	}
+	request := &alpb.Entry_Request{
+		ApiRequest: &alpb.Entry_APIRequest{
+			CreateApiKey: &akpb.CreateApiKeyRequest{
+				GroupId: "GR1",
+				Label:   "ci\nkey",
+			},
+		},
+	}
+
+	b, err := marshalExportedEntry(e, request)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "\n")
+
+	got := map[string]any{}
+	require.NoError(t, json.Unmarshal(b, &got))
+	expected := map[string]any{
+		"id":            "AL1",
+		"group_id":      "GR1",
+		"event_time":    "2024-01-02T03:04:05Z",
+		"client_ip":     "1.2.3.4",
+		"user_agent":    "bazel/7.0.0",
+		"api_key_id":    "AK1",
+		"api_key_label": "admin key",
+		"resource_type": "GROUP",
+		"resource_id":   "GR1",
+		"action":        "CREATE",
+		"request": map[string]any{
+			"apiRequest": map[string]any{
+				"createApiKey": map[string]any{
+					"label": "ci\nkey",
+				},
+			},
+		},
+	}
+	require.Equal(t, expected, got)
+}
+
+func TestMarshalStoredEntry(t *testing.T) {
+	request := &alpb.Entry_Request{
+		ApiRequest: &alpb.Entry_APIRequest{
+			CreateApiKey: &akpb.CreateApiKeyRequest{Label: "ci key"},
+		},
+	}
+	rb, err := proto.Marshal(request)
+	require.NoError(t, err)
+	e := &schema.AuditLog{
+		AuditLogID:    "AL1",
+		GroupID:       "GR1",
+		EventTimeUsec: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).UnixMicro(),
+		Action:        uint8(alpb.Action_CREATE),
+		Request:       string(rb),
+	}
+
+	b, err := marshalStoredEntry(e)
+	require.NoError(t, err)
+	expected, err := marshalExportedEntry(e, request)
+	require.NoError(t, err)
+	require.Equal(t, string(expected), string(b))
+
+	e.Request = ""
+	b, err = marshalStoredEntry(e)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "request")
+
+	e.Request = "not a proto"
+	_, err = marshalStoredEntry(e)
+	require.Error(t, err)
+}
+
+func TestSyslogSink(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					// Each message is prefixed with its length and a space.
+					length, err := r.ReadString(' ')
+					if err != nil {
+						return
+					}
+					n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+					if err != nil {
+						return
+					}
+					msg := make([]byte, n)
+					if _, err := io.ReadFull(r, msg); err != nil {
+						return
+					}
+					messages <- string(msg)
+				}
+			}()
+		}
+	}()
+
+	s, err := newSyslogSink(lis.Addr().String(), false /*=useTLS*/, "" /*=caCertFile*/)
+	require.NoError(t, err)
+	err = s.send(context.Background(), [][]byte{[]byte(`{"id":"AL1"}`), []byte(`{"id":"AL2 with spaces"}`)})
+	require.NoError(t, err)
+
+	for _, entry := range []string{`{"id":"AL1"}`, `{"id":"AL2 with spaces"}`} {
+		msg := <-messages
+		assert.True(t, strings.HasPrefix(msg, "<110>1 "), "unexpected header: %q", msg)
+		assert.True(t, strings.HasSuffix(msg, " buildbuddy - audit - "+entry), "unexpected message: %q", msg)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	var signatures []string
+	statusCode := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+		signatures = append(signatures, r.Header.Get(webhookutil.SignatureHeader))
+		w.WriteHeader(statusCode)
+	}))
+	t.Cleanup(server.Close)
+
+	s := newWebhookSink(server.URL, "secret")
+	entries := [][]byte{[]byte(`{"id":"AL1"}`), []byte(`{"id":"AL2"}`)}
+
+	// Non-2xx responses should be retried.
+	err := s.send(context.Background(), entries)
+	require.True(t, status.IsUnavailableError(err), "expected unavailable error, got %v", err)
+
+	mu.Lock()
+	statusCode = http.StatusOK
+	mu.Unlock()
+	err = s.send(context.Background(), entries)
+	require.NoError(t, err)
+
+	expectedBody := "{\"id\":\"AL1\"}\n{\"id\":\"AL2\"}\n"
+	require.Equal(t, []string{expectedBody, expectedBody}, bodies)
+	// Verify the signature the way a receiver would.
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(expectedBody))
+	require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signatures[1])
+}
+
+func TestNewExporter_RequiresHTTPSWebhook(t *testing.T) {
+	flags.Set(t, "app.audit_log_export.webhook.url", "http://hooks.acme.corp/buildbuddy/audit")
+	_, err := newExporter(nil /*=env*/, nil /*=clock*/)
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument; got: %v", err)
+}
+
+// fakeBlobstore records the blobs that are written to it.
+type fakeBlobstore struct {
+	interfaces.Blobstore
+	blobs map[string][]byte
+}
+
+func (bs *fakeBlobstore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
+	bs.blobs[blobName] = bytes.Clone(data)
+	return len(data), nil
+}
+
+func TestBlobstoreSink(t *testing.T) {
+	bs := &fakeBlobstore{blobs: map[string][]byte{}}
+	s := newBlobstoreSink(bs, "audit")
+
+	err := s.send(context.Background(), [][]byte{[]byte(`{"id":"AL1"}`), []byte(`{"id":"AL2"}`)})
+	require.NoError(t, err)
+	err = s.send(context.Background(), [][]byte{[]byte(`{"id":"AL3"}`)})
+	require.NoError(t, err)
+
+	require.Len(t, bs.blobs, 2)
+	var contents []string
+	for name, data := range bs.blobs {
+		assert.Regexp(t, `^audit/\d{4}/\d{2}/\d{2}/\d{6}-[0-9a-f]{16}\.ndjson$`, name)
+		contents = append(contents, string(data))
+	}
+	require.ElementsMatch(t, []string{
+		"{\"id\":\"AL1\"}\n{\"id\":\"AL2\"}\n",
+		"{\"id\":\"AL3\"}\n",
+	}, contents)
+}
@@ -0,0 +1,208 @@
+package auditlog
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testclock"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clickhouse/schema"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/require"
+
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
+)
+
+// fakeSink fails the given number of sends, then records the IDs of the
+// entries that are sent successfully.
+type fakeSink struct {
+	mu       sync.Mutex
+	failures int
+	sent     []string
+	batches  int
+}
+
+func (s *fakeSink) name() string {
+	return "fake"
+}
+
+func (s *fakeSink) send(ctx context.Context, entries [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return status.UnavailableError("sink is down")
+	}
+	for _, b := range entries {
+		e := &exportedEntry{}
+		if err := json.Unmarshal(b, e); err != nil {
+			return err
+		}
+		s.sent = append(s.sent, e.ID)
+	}
+	s.batches++
+	return nil
+}
+
+type exporterEnv struct {
+	te    *testenv.TestEnv
+	clock *testclock.TestClock
+	// The time that the test starts at. Each test uses a random time far in
+	// the past, so that entries written by other tests sharing the same
+	// ClickHouse server aren't exported.
+	start time.Time
+}
+
+func newExporterEnv(t *testing.T) *exporterEnv {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(random.RandUint64()%(10*365*24)) * time.Hour)
+	return &exporterEnv{
+		te:    testenv.GetTestEnv(t),
+		clock: testclock.StartingAt(start),
+		start: start,
+	}
+}
+
+func (e *exporterEnv) newExporter(owner string) *exporter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &exporter{
+		dbh:          e.te.GetDBHandle(),
+		olapDBH:      e.te.GetOLAPDBHandle(),
+		clock:        e.clock,
+		owner:        owner,
+		pollInterval: time.Second,
+		quit:         make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// insert inserts entries with the given IDs into the audit log, logged the
+// given duration after the start of the test.
+func (e *exporterEnv) insert(t *testing.T, offset time.Duration, ids ...string) {
+	for _, id := range ids {
+		err := e.te.GetOLAPDBHandle().InsertAuditLog(context.Background(), &schema.AuditLog{
+			AuditLogID:    id,
+			GroupID:       "GR1",
+			EventTimeUsec: e.start.Add(offset).UnixMicro(),
+			Action:        uint8(alpb.Action_CREATE),
+		})
+		require.NoError(t, err)
+	}
+}
+
+func exportBatch(t *testing.T, e *exporter, q *sinkQueue) bool {
+	full, err := e.exportBatch(context.Background(), q)
+	require.NoError(t, err)
+	return full
+}
+
+func TestExporter_DeliversEntriesInOrder(t *testing.T) {
+	env := newExporterEnv(t)
+	e := env.newExporter("app1")
+	s := &fakeSink{}
+	q := newSinkQueue(s, 3, 0)
+
+	// The cursor starts at the time the sink is first used.
+	require.False(t, exportBatch(t, e, q))
+	env.insert(t, -time.Hour, "AL0")
+
+	env.insert(t, 1*time.Second, "AL1")
+	// Entries logged at the same time are ordered by ID.
+	env.insert(t, 2*time.Second, "AL3", "AL2")
+	env.insert(t, 3*time.Second, "AL4", "AL5")
+
+	// Entries aren't exported until they have settled.
+	env.clock.Set(env.start.Add(10 * time.Second))
+	require.False(t, exportBatch(t, e, q))
+	require.Empty(t, s.sent)
+
+	env.clock.Set(env.start.Add(time.Minute))
+	require.True(t, exportBatch(t, e, q))
+	require.False(t, exportBatch(t, e, q))
+	require.Equal(t, []string{"AL1", "AL2", "AL3", "AL4", "AL5"}, s.sent)
+	require.Equal(t, 2, s.batches)
+
+	// Nothing is delivered twice.
+	require.False(t, exportBatch(t, e, q))
+	require.Len(t, s.sent, 5)
+}
+
+func TestExporter_RetriesFailedBatches(t *testing.T) {
+	env := newExporterEnv(t)
+	e := env.newExporter("app1")
+	s := &fakeSink{failures: 2}
+	q := newSinkQueue(s, 10, 0)
+	require.False(t, exportBatch(t, e, q))
+
+	env.insert(t, 1*time.Second, "AL1", "AL2")
+	env.clock.Set(env.start.Add(time.Minute))
+	for i := 0; i < 2; i++ {
+		_, err := e.exportBatch(context.Background(), q)
+		require.True(t, status.IsUnavailableError(err), "expected Unavailable; got: %v", err)
+	}
+	require.False(t, exportBatch(t, e, q))
+	require.Equal(t, []string{"AL1", "AL2"}, s.sent)
+}
+
+func TestExporter_OneAppDeliversAtATime(t *testing.T) {
+	env := newExporterEnv(t)
+	e1 := env.newExporter("app1")
+	e2 := env.newExporter("app2")
+	s1 := &fakeSink{}
+	s2 := &fakeSink{}
+	q1 := newSinkQueue(s1, 10, 0)
+	q2 := newSinkQueue(s2, 10, 0)
+	require.False(t, exportBatch(t, e1, q1))
+
+	env.insert(t, 1*time.Second, "AL1")
+	env.clock.Set(env.start.Add(time.Minute))
+	require.False(t, exportBatch(t, e2, q2))
+	require.False(t, exportBatch(t, e1, q1))
+	require.Equal(t, []string{"AL1"}, s1.sent)
+	require.Empty(t, s2.sent)
+
+	// Once app1 releases its claim, app2 picks up where app1 left off.
+	env.insert(t, 2*time.Second, "AL2")
+	require.NoError(t, e1.release(context.Background(), "fake"))
+	require.False(t, exportBatch(t, e2, q2))
+	require.Equal(t, []string{"AL2"}, s2.sent)
+
+	// app1 takes over again once app2's claim expires.
+	env.insert(t, 3*time.Second, "AL3")
+	require.False(t, exportBatch(t, e1, q1))
+	require.Equal(t, []string{"AL1"}, s1.sent)
+	env.clock.Set(env.start.Add(time.Minute + exportClaimTTL + time.Second))
+	require.False(t, exportBatch(t, e1, q1))
+	require.Equal(t, []string{"AL1", "AL3"}, s1.sent)
+	require.Equal(t, []string{"AL2"}, s2.sent)
+}
+
+func TestExporter_WaitsForBatchToFill(t *testing.T) {
+	env := newExporterEnv(t)
+	e := env.newExporter("app1")
+	s := &fakeSink{}
+	q := newSinkQueue(s, 3, 5*time.Minute)
+	require.False(t, exportBatch(t, e, q))
+
+	env.insert(t, 1*time.Second, "AL1", "AL2")
+	env.clock.Set(env.start.Add(time.Minute))
+	require.False(t, exportBatch(t, e, q))
+	require.Empty(t, s.sent)
+
+	// A full batch is sent right away.
+	env.insert(t, 2*time.Second, "AL3", "AL4")
+	require.True(t, exportBatch(t, e, q))
+	require.Equal(t, []string{"AL1", "AL2", "AL3"}, s.sent)
+
+	// The rest is sent once the oldest entry has waited long enough.
+	require.False(t, exportBatch(t, e, q))
+	require.Len(t, s.sent, 3)
+	env.clock.Set(env.start.Add(6 * time.Minute))
+	require.False(t, exportBatch(t, e, q))
+	require.Equal(t, []string{"AL1", "AL2", "AL3", "AL4"}, s.sent)
+	require.Equal(t, 2, s.batches)
+}
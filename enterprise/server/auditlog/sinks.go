@@ -0,0 +1,183 @@
+package auditlog
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/webhookutil"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flagutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	syslogAddress       = flag.String("app.audit_log_export.syslog.address", "", "If set, audit log entries are sent to the syslog server at this host:port over TCP, using RFC 5424 messages with octet-counting framing.")
+	syslogUseTLS        = flag.Bool("app.audit_log_export.syslog.use_tls", false, "Whether to connect to the syslog server over TLS.")
+	syslogTLSCACertFile = flag.String("app.audit_log_export.syslog.tls_ca_cert_file", "", "Path to a PEM file with the CA certificates that are used to verify the syslog server. If unset, the system CA certificates are used.")
+
+	webhookURL        = flag.String("app.audit_log_export.webhook.url", "", "If set, audit log entries are POSTed to this HTTPS URL as newline-delimited JSON.")
+	webhookHMACSecret = flagutil.New("app.audit_log_export.webhook.hmac_secret", "", webhookutil.SecretFlagHelp, flagutil.SecretTag)
+
+	blobstoreExportEnabled    = flag.Bool("app.audit_log_export.blobstore.enabled", false, "If set, audit log entries are written to the configured blobstore as newline-delimited JSON files.")
+	blobstorePathPrefix       = flag.String("app.audit_log_export.blobstore.path_prefix", "audit_logs", "The path prefix of the audit log files in the blobstore. Files are named <prefix>/YYYY/MM/DD/<time>-<id>.ndjson.")
+	blobstoreRotationInterval = flag.Duration("app.audit_log_export.blobstore.rotation_interval", 5*time.Minute, "How often a new audit log file is started in the blobstore.")
+)
+
+const (
+	syslogMaxBatchSize = 100
+	// The syslog facility for log audit messages, with informational
+	// severity.
+	syslogPriority     = 13*8 + 6
+	syslogDialTimeout  = 10 * time.Second
+	syslogWriteTimeout = 30 * time.Second
+
+	webhookMaxBatchSize   = 100
+	webhookRequestTimeout = 30 * time.Second
+
+	blobstoreMaxEntriesPerFile = 10000
+)
+
+// syslogSink sends entries to a syslog server over TCP, as described by RFC
+// 5424 and RFC 6587.
+type syslogSink struct {
+	address   string
+	tlsConfig *tls.Config
+	hostname  string
+
+	// The current connection, or nil if the sink is not connected. Entries
+	// are only sent by one goroutine at a time, so no lock is needed.
+	conn net.Conn
+}
+
+func newSyslogSink(address string, useTLS bool, caCertFile string) (*syslogSink, error) {
+	s := &syslogSink{address: address, hostname: "-"}
+	if h, err := os.Hostname(); err == nil {
+		s.hostname = h
+	}
+	if useTLS {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid syslog address %q: %s", address, err)
+		}
+		s.tlsConfig = &tls.Config{ServerName: host}
+		if caCertFile != "" {
+			pem, err := os.ReadFile(caCertFile)
+			if err != nil {
+				return nil, status.InvalidArgumentErrorf("could not read syslog CA certificates: %s", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, status.InvalidArgumentErrorf("no certificates found in %q", caCertFile)
+			}
+			s.tlsConfig.RootCAs = pool
+		}
+	}
+	return s, nil
+}
+
+func (s *syslogSink) name() string {
+	return "syslog"
+}
+
+func (s *syslogSink) connect(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	if s.tlsConfig != nil {
+		td := &tls.Dialer{NetDialer: dialer, Config: s.tlsConfig}
+		return td.DialContext(ctx, "tcp", s.address)
+	}
+	return dialer.DialContext(ctx, "tcp", s.address)
+}
+
+func (s *syslogSink) send(ctx context.Context, entries [][]byte) error {
+	if s.conn == nil {
+		conn, err := s.connect(ctx)
+		if err != nil {
+			return status.UnavailableErrorf("could not connect to syslog server: %s", err)
+		}
+		s.conn = conn
+	}
+	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		// HEADER: PRI VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID,
+		// followed by an empty STRUCTURED-DATA and the entry as the MSG.
+		msg := fmt.Sprintf("<%d>1 %s %s buildbuddy - audit - %s", syslogPriority, timestamp, s.hostname, entry)
+		fmt.Fprintf(&buf, "%d %s", len(msg), msg)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return status.UnavailableErrorf("could not write to syslog server: %s", err)
+	}
+	return nil
+}
+
+// webhookSink POSTs entries to an HTTPS endpoint as newline-delimited JSON.
+type webhookSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func newWebhookSink(endpoint, secret string) *webhookSink {
+	return &webhookSink{
+		url:    endpoint,
+		secret: secret,
+		client: &http.Client{Timeout: webhookRequestTimeout},
+	}
+}
+
+func (s *webhookSink) name() string {
+	return "webhook"
+}
+
+func (s *webhookSink) send(ctx context.Context, entries [][]byte) error {
+	return webhookutil.Post(ctx, s.client, s.url, s.secret, "application/x-ndjson", ndjson(entries))
+}
+
+// blobstoreSink writes each batch of entries to a new newline-delimited JSON
+// file in the blobstore.
+type blobstoreSink struct {
+	bs         interfaces.Blobstore
+	pathPrefix string
+}
+
+func newBlobstoreSink(bs interfaces.Blobstore, pathPrefix string) *blobstoreSink {
+	return &blobstoreSink{bs: bs, pathPrefix: pathPrefix}
+}
+
+func (s *blobstoreSink) name() string {
+	return "blobstore"
+}
+
+func (s *blobstoreSink) blobName(now time.Time) string {
+	now = now.UTC()
+	return path.Join(s.pathPrefix, now.Format("2006/01/02"), fmt.Sprintf("%s-%016x.ndjson", now.Format("150405"), random.RandUint64()))
+}
+
+func (s *blobstoreSink) send(ctx context.Context, entries [][]byte) error {
+	if _, err := s.bs.WriteBlob(ctx, s.blobName(time.Now()), ndjson(entries)); err != nil {
+		return status.UnavailableErrorf("could not write audit log file: %s", err)
+	}
+	return nil
+}
+
+func ndjson(entries [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		buf.Write(entry)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
@@ -6,16 +6,19 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"net"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auditlog"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clientip"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flagutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
@@ -43,6 +46,9 @@ const (
 	apiKeyEncryptionBackfillBatchSize = 100
 
 	impersonationAPIKeyDuration = 1 * time.Hour
+
+	// Maximum number of IP ranges that an API key can be restricted to.
+	maxAllowedIPRangesPerAPIKey = 100
 )
 
 const (
@@ -59,7 +65,7 @@ var (
 )
 
 type apiKeyGroupCacheEntry struct {
-	data         interfaces.APIKeyGroup
+	data         *apiKeyGroup
 	expiresAfter time.Time
 }
 
@@ -88,7 +94,7 @@ func newAPIKeyGroupCache() (*apiKeyGroupCache, error) {
 	return &apiKeyGroupCache{lru: lru, ttl: *apiKeyGroupCacheTTL}, nil
 }
 
-func (c *apiKeyGroupCache) Get(apiKey string) (akg interfaces.APIKeyGroup, ok bool) {
+func (c *apiKeyGroupCache) Get(apiKey string) (akg *apiKeyGroup, ok bool) {
 	c.mu.Lock()
 	entry, ok := c.lru.Get(apiKey)
 	c.mu.Unlock()
@@ -101,7 +107,7 @@ func (c *apiKeyGroupCache) Get(apiKey string) (akg interfaces.APIKeyGroup, ok bo
 	return entry.data, true
 }
 
-func (c *apiKeyGroupCache) Add(apiKey string, apiKeyGroup interfaces.APIKeyGroup) {
+func (c *apiKeyGroupCache) Add(apiKey string, apiKeyGroup *apiKeyGroup) {
 	c.mu.Lock()
 	c.lru.Add(apiKey, &apiKeyGroupCacheEntry{data: apiKeyGroup, expiresAfter: time.Now().Add(c.ttl)})
 	c.mu.Unlock()
@@ -204,6 +210,12 @@ type apiKeyGroup struct {
 	UseGroupOwnedExecutors bool
 	CacheEncryptionEnabled bool
 	EnforceIPRules         bool
+	ExpiryUsec             int64
+	AllowedIPRanges        string
+
+	// The parsed AllowedIPRanges, or nil if the key can be used from any IP
+	// address.
+	allowedIPNets []*net.IPNet
 }
 
 func (g *apiKeyGroup) GetAPIKeyID() string {
@@ -354,10 +366,13 @@ func (d *AuthDB) GetAPIKeyGroupFromAPIKey(ctx context.Context, apiKey string) (i
 	}
 
 	if d.apiKeyGroupCache != nil {
-		d, ok := d.apiKeyGroupCache.Get(cacheKey)
+		akg, ok := d.apiKeyGroupCache.Get(cacheKey)
 		if ok {
 			metrics.APIKeyLookupCount.With(prometheus.Labels{metrics.APIKeyLookupStatus: "cache_hit"}).Inc()
-			return d, nil
+			if err := d.checkAPIKeyRestrictions(ctx, akg); err != nil {
+				return nil, err
+			}
+			return akg, nil
 		}
 	}
 
@@ -390,10 +405,16 @@ func (d *AuthDB) GetAPIKeyGroupFromAPIKey(ctx context.Context, apiKey string) (i
 		}
 		return nil, err
 	}
+	if err := parseAPIKeyGroupIPRanges(akg); err != nil {
+		return nil, err
+	}
 	if d.apiKeyGroupCache != nil {
 		metrics.APIKeyLookupCount.With(prometheus.Labels{metrics.APIKeyLookupStatus: "cache_miss"}).Inc()
 		d.apiKeyGroupCache.Add(cacheKey, akg)
 	}
+	if err := d.checkAPIKeyRestrictions(ctx, akg); err != nil {
+		return nil, err
+	}
 	return akg, nil
 }
 
@@ -404,9 +425,12 @@ func (d *AuthDB) GetAPIKeyGroupFromAPIKeyID(ctx context.Context, apiKeyID string
 		cacheKey = sd + "," + apiKeyID
 	}
 	if d.apiKeyGroupCache != nil {
-		d, ok := d.apiKeyGroupCache.Get(cacheKey)
+		akg, ok := d.apiKeyGroupCache.Get(cacheKey)
 		if ok {
-			return d, nil
+			if err := d.checkAPIKeyRestrictions(ctx, akg); err != nil {
+				return nil, err
+			}
+			return akg, nil
 		}
 	}
 	akg := &apiKeyGroup{}
@@ -423,12 +447,122 @@ func (d *AuthDB) GetAPIKeyGroupFromAPIKeyID(ctx context.Context, apiKeyID string
 		}
 		return nil, err
 	}
+	if err := parseAPIKeyGroupIPRanges(akg); err != nil {
+		return nil, err
+	}
 	if d.apiKeyGroupCache != nil {
 		d.apiKeyGroupCache.Add(cacheKey, akg)
 	}
+	if err := d.checkAPIKeyRestrictions(ctx, akg); err != nil {
+		return nil, err
+	}
 	return akg, nil
 }
 
+// parseAPIKeyGroupIPRanges parses the allowed IP ranges of a key that was
+// looked up from the DB.
+func parseAPIKeyGroupIPRanges(akg *apiKeyGroup) error {
+	if akg.AllowedIPRanges == "" {
+		return nil
+	}
+	nets, err := parseIPRanges(strings.Split(akg.AllowedIPRanges, ","))
+	if err != nil {
+		return status.InternalErrorf("API key %s has invalid allowed IP ranges: %s", akg.APIKeyID, err)
+	}
+	akg.allowedIPNets = nets
+	return nil
+}
+
+// checkAPIKeyRestrictions returns an error if the key is expired, or if it
+// can't be used from the IP address of the client in the context. Keys are
+// cached, so these are checked on every lookup rather than in the DB query.
+func (d *AuthDB) checkAPIKeyRestrictions(ctx context.Context, akg *apiKeyGroup) error {
+	if akg.ExpiryUsec != 0 && time.Now().UnixMicro() >= akg.ExpiryUsec {
+		return status.UnauthenticatedErrorf("API key %s expired at %s", akg.APIKeyID, time.UnixMicro(akg.ExpiryUsec).UTC().Format(time.RFC3339))
+	}
+	if len(akg.allowedIPNets) == 0 {
+		return nil
+	}
+	rawIP := clientip.Get(ctx)
+	ip := net.ParseIP(rawIP)
+	if ip != nil {
+		for _, n := range akg.allowedIPNets {
+			if n.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	auditlog.LogAccessDenied(ctx, d.env, &interfaces.AuditLogPrincipal{
+		GroupID:  akg.GroupID,
+		UserID:   akg.UserID,
+		APIKeyID: akg.APIKeyID,
+	})
+	if ip == nil {
+		return status.PermissionDeniedErrorf("API key %s can only be used from allowed IP ranges, but the client IP address is unknown", akg.APIKeyID)
+	}
+	return status.PermissionDeniedErrorf("API key %s is not allowed to be used from IP address %q", akg.APIKeyID, rawIP)
+}
+
+// parseIPRanges parses IP ranges in CIDR notation. Single IP addresses are
+// treated as ranges containing only that address.
+func parseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, r := range ranges {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return nil, status.InvalidArgumentErrorf("invalid IP range %q: expected CIDR notation, e.g. \"10.0.0.0/8\"", r)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid IP range %q: expected CIDR notation, e.g. \"10.0.0.0/8\"", r)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// normalizeIPRanges validates the given IP ranges and returns them in the
+// format in which they are stored in the DB.
+func normalizeIPRanges(ranges []string) (string, error) {
+	nets, err := parseIPRanges(ranges)
+	if err != nil {
+		return "", err
+	}
+	if len(nets) > maxAllowedIPRangesPerAPIKey {
+		return "", status.InvalidArgumentErrorf("API keys can be restricted to at most %d IP ranges", maxAllowedIPRangesPerAPIKey)
+	}
+	normalized := make([]string, 0, len(nets))
+	for _, n := range nets {
+		normalized = append(normalized, n.String())
+	}
+	return strings.Join(normalized, ","), nil
+}
+
+// validateExpiry returns an error if a new key with the given expiry would
+// already be expired.
+func validateExpiry(expiryUsec int64) error {
+	if expiryUsec < 0 {
+		return status.InvalidArgumentError("API key expiry must not be negative")
+	}
+	if expiryUsec != 0 && expiryUsec <= time.Now().UnixMicro() {
+		return status.InvalidArgumentError("API key expiry must be in the future")
+	}
+	return nil
+}
+
 func (d *AuthDB) LookupUserFromSubID(ctx context.Context, subID string) (*tables.User, error) {
 	user := &tables.User{}
 	err := d.h.TransactionWithOptions(ctx, db.Opts().WithStaleReads(), func(tx *db.DB) error {
@@ -500,7 +634,9 @@ func (d *AuthDB) newAPIKeyGroupQuery(subDomain string, allowUserOwnedKeys bool)
 			g.group_id,
 			g.use_group_owned_executors,
 			g.cache_encryption_enabled,
-			g.enforce_ip_rules
+			g.enforce_ip_rules,
+			ak.expiry_usec,
+			ak.allowed_ip_ranges
 		FROM "Groups" AS g,
 		"APIKeys" AS ak
 	`)
@@ -577,8 +713,9 @@ func (d *AuthDB) createAPIKey(db *db.DB, ak tables.APIKey) (*tables.APIKey, erro
 			label,
 			visible_to_developers,
 			impersonation,
-			expiry_usec
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			expiry_usec,
+			allowed_ip_ranges
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		pk,
 		ak.UserID,
 		ak.GroupID,
@@ -591,6 +728,7 @@ func (d *AuthDB) createAPIKey(db *db.DB, ak tables.APIKey) (*tables.APIKey, erro
 		ak.VisibleToDevelopers,
 		ak.Impersonation,
 		ak.ExpiryUsec,
+		ak.AllowedIPRanges,
 	).Error
 	if err != nil {
 		return nil, err
@@ -612,10 +750,17 @@ func (d *AuthDB) authorizeGroupAdminRole(ctx context.Context, groupID string) er
 	return authutil.AuthorizeGroupRole(u, groupID, role.Admin)
 }
 
-func (d *AuthDB) CreateAPIKey(ctx context.Context, groupID string, label string, caps []akpb.ApiKey_Capability, visibleToDevelopers bool) (*tables.APIKey, error) {
+func (d *AuthDB) CreateAPIKey(ctx context.Context, groupID string, label string, caps []akpb.ApiKey_Capability, visibleToDevelopers bool, expiryUsec int64, allowedIPRanges []string) (*tables.APIKey, error) {
 	if groupID == "" {
 		return nil, status.InvalidArgumentError("Group ID cannot be nil.")
 	}
+	if err := validateExpiry(expiryUsec); err != nil {
+		return nil, err
+	}
+	ipRanges, err := normalizeIPRanges(allowedIPRanges)
+	if err != nil {
+		return nil, err
+	}
 
 	// Authorize org-level key creation (authenticated user must be a
 	// group admin).
@@ -628,6 +773,8 @@ func (d *AuthDB) CreateAPIKey(ctx context.Context, groupID string, label string,
 		Label:               label,
 		Capabilities:        capabilities.ToInt(caps),
 		VisibleToDevelopers: visibleToDevelopers,
+		ExpiryUsec:          expiryUsec,
+		AllowedIPRanges:     ipRanges,
 	}
 	return d.createAPIKey(d.h.DB(ctx), ak)
 }
@@ -694,6 +841,9 @@ func (d *AuthDB) authorizeNewAPIKeyCapabilities(ctx context.Context, userID, gro
 		if capabilities.ToInt(caps)&int32(akpb.ApiKey_REGISTER_EXECUTOR_CAPABILITY) > 0 {
 			return status.PermissionDeniedError("user-owned API keys cannot be used to register executors")
 		}
+		if capabilities.ToInt(caps)&int32(akpb.ApiKey_ORG_ADMIN_CAPABILITY) > 0 {
+			return status.PermissionDeniedError("user-owned API keys cannot be used to administer the organization")
+		}
 	}
 
 	if !hasAdminOnlyCapabilities(caps) {
@@ -702,13 +852,20 @@ func (d *AuthDB) authorizeNewAPIKeyCapabilities(ctx context.Context, userID, gro
 	return d.authorizeGroupAdminRole(ctx, groupID)
 }
 
-func (d *AuthDB) CreateUserAPIKey(ctx context.Context, groupID, label string, caps []akpb.ApiKey_Capability) (*tables.APIKey, error) {
+func (d *AuthDB) CreateUserAPIKey(ctx context.Context, groupID, label string, caps []akpb.ApiKey_Capability, expiryUsec int64, allowedIPRanges []string) (*tables.APIKey, error) {
 	if !*userOwnedKeysEnabled {
 		return nil, status.UnimplementedError("not implemented")
 	}
 	if groupID == "" {
 		return nil, status.InvalidArgumentError("Group ID cannot be nil.")
 	}
+	if err := validateExpiry(expiryUsec); err != nil {
+		return nil, err
+	}
+	ipRanges, err := normalizeIPRanges(allowedIPRanges)
+	if err != nil {
+		return nil, err
+	}
 
 	if err := perms.AuthorizeGroupAccess(ctx, d.env, groupID); err != nil {
 		return nil, err
@@ -739,10 +896,12 @@ func (d *AuthDB) CreateUserAPIKey(ctx context.Context, groupID, label string, ca
 		}
 
 		ak := tables.APIKey{
-			UserID:       u.GetUserID(),
-			GroupID:      u.GetGroupID(),
-			Label:        label,
-			Capabilities: capabilities.ToInt(caps),
+			UserID:          u.GetUserID(),
+			GroupID:         u.GetGroupID(),
+			Label:           label,
+			Capabilities:    capabilities.ToInt(caps),
+			ExpiryUsec:      expiryUsec,
+			AllowedIPRanges: ipRanges,
 		}
 		key, err := d.createAPIKey(tx, ak)
 		if err != nil {
@@ -796,7 +955,8 @@ func (d *AuthDB) GetAPIKey(ctx context.Context, apiKeyID string) (*tables.APIKey
 // be used in situations where the user has a pre-authorized grant to access
 // resources on behalf of the org, such as a publicly shared invocation. The
 // returned API key must only be used to access internal resources and must
-// not be returned to the caller.
+// not be returned to the caller. Keys that expire or that are restricted to
+// IP ranges are never returned, since they may stop working.
 func (d *AuthDB) GetAPIKeyForInternalUseOnly(ctx context.Context, groupID string) (*tables.APIKey, error) {
 	if groupID == "" {
 		return nil, status.InvalidArgumentError("Group ID cannot be empty.")
@@ -808,6 +968,7 @@ func (d *AuthDB) GetAPIKeyForInternalUseOnly(ctx context.Context, groupID string
 		AND (user_id IS NULL OR user_id = '')
 		AND impersonation = false
 		AND expiry_usec = 0
+		AND allowed_ip_ranges = ''
 		ORDER BY label ASC LIMIT 1
 	`, groupID)
 	if err := query.Take(key).Error; err != nil {
@@ -909,17 +1070,25 @@ func (d *AuthDB) UpdateAPIKey(ctx context.Context, key *tables.APIKey) error {
 		if err := d.authorizeNewAPIKeyCapabilities(ctx, existingKey.UserID, existingKey.GroupID, capabilities.FromInt(key.Capabilities)); err != nil {
 			return err
 		}
+		ipRanges, err := normalizeIPRanges(strings.Split(key.AllowedIPRanges, ","))
+		if err != nil {
+			return err
+		}
+		// The expiry can only be set when the key is created, so that keys
+		// can't be made longer-lived than originally intended.
 		return tx.Exec(`
 			UPDATE "APIKeys"
 			SET
 				label = ?,
 				capabilities = ?,
-				visible_to_developers = ?
+				visible_to_developers = ?,
+				allowed_ip_ranges = ?
 			WHERE
 				api_key_id = ?`,
 			key.Label,
 			key.Capabilities,
 			key.VisibleToDevelopers,
+			ipRanges,
 			key.APIKeyID,
 		).Error
 	})
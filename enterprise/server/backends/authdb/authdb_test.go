@@ -20,6 +20,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauditlog"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clientip"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/role"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -544,6 +545,158 @@ func TestSubdomainRestrictions(t *testing.T) {
 	}
 }
 
+func createAdminAndGroup(t *testing.T, ctx context.Context, env environment.Env) (context.Context, string) {
+	flags.Set(t, "app.create_group_per_user", true)
+	flags.Set(t, "app.no_default_user_group", true)
+	admin := createUser(t, ctx, env, "US1", "org1.io")
+	auth := env.GetAuthenticator().(*testauth.TestAuthenticator)
+	adminCtx, err := auth.WithAuthenticatedUser(ctx, admin.UserID)
+	require.NoError(t, err)
+	groupID, err := env.GetUserDB().CreateGroup(adminCtx, &tables.Group{})
+	require.NoError(t, err)
+	// Re-authenticate to pick up the new group membership
+	adminCtx, err = auth.WithAuthenticatedUser(ctx, admin.UserID)
+	require.NoError(t, err)
+	return adminCtx, groupID
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	flags.Set(t, "auth.api_key_group_cache_ttl", 0)
+	ctx := context.Background()
+	env := setupEnv(t)
+	adb := env.GetAuthDB()
+	adminCtx, groupID := createAdminAndGroup(t, ctx, env)
+
+	// Keys can't be created already expired.
+	_, err := adb.CreateAPIKey(adminCtx, groupID, "expired", nil /*=capabilities*/, false /*=visibleToDevelopers*/, time.Now().Add(-time.Minute).UnixMicro(), nil /*=allowedIPRanges*/)
+	require.Truef(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error; got: %v", err)
+
+	key, err := adb.CreateAPIKey(adminCtx, groupID, "short-lived", nil /*=capabilities*/, false /*=visibleToDevelopers*/, time.Now().Add(time.Hour).UnixMicro(), nil /*=allowedIPRanges*/)
+	require.NoError(t, err)
+	_, err = adb.GetAPIKeyGroupFromAPIKey(ctx, key.Value)
+	require.NoError(t, err)
+
+	// Updates must not change the expiry.
+	key.Label = "new label"
+	key.ExpiryUsec = 0
+	err = adb.UpdateAPIKey(adminCtx, key)
+	require.NoError(t, err)
+	updated, err := adb.GetAPIKey(adminCtx, key.APIKeyID)
+	require.NoError(t, err)
+	require.Equal(t, "new label", updated.Label)
+	require.NotZero(t, updated.ExpiryUsec)
+
+	// Expire the key.
+	err = env.GetDBHandle().DB(ctx).Exec(
+		`UPDATE "APIKeys" SET expiry_usec = ? WHERE api_key_id = ?`,
+		time.Now().Add(-time.Second).UnixMicro(), key.APIKeyID).Error
+	require.NoError(t, err)
+	_, err = adb.GetAPIKeyGroupFromAPIKey(ctx, key.Value)
+	require.Truef(t, status.IsUnauthenticatedError(err), "expected Unauthenticated error; got: %v", err)
+	require.Contains(t, err.Error(), "expired")
+	_, err = adb.GetAPIKeyGroupFromAPIKeyID(ctx, key.APIKeyID)
+	require.Truef(t, status.IsUnauthenticatedError(err), "expected Unauthenticated error; got: %v", err)
+	require.Contains(t, err.Error(), "expired")
+}
+
+func TestAPIKeyAllowedIPRanges(t *testing.T) {
+	flags.Set(t, "auth.api_key_group_cache_ttl", 0)
+	ctx := context.Background()
+	env := setupEnv(t)
+	al := testauditlog.New(t)
+	env.SetAuditLogger(al)
+	adb := env.GetAuthDB()
+	adminCtx, groupID := createAdminAndGroup(t, ctx, env)
+
+	_, err := adb.CreateAPIKey(adminCtx, groupID, "invalid", nil /*=capabilities*/, false /*=visibleToDevelopers*/, 0 /*=expiryUsec*/, []string{"10.0.0.0/33"})
+	require.Truef(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error; got: %v", err)
+
+	key, err := adb.CreateAPIKey(adminCtx, groupID, "ci", nil /*=capabilities*/, false /*=visibleToDevelopers*/, 0 /*=expiryUsec*/, []string{"10.0.0.0/8", " 192.168.1.1"})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.0/8,192.168.1.1/32", key.AllowedIPRanges)
+
+	for _, ip := range []string{"10.1.2.3", "192.168.1.1"} {
+		ipCtx := context.WithValue(ctx, clientip.ContextKey, ip)
+		_, err := adb.GetAPIKeyGroupFromAPIKey(ipCtx, key.Value)
+		require.NoError(t, err, "IP %s", ip)
+		_, err = adb.GetAPIKeyGroupFromAPIKeyID(ipCtx, key.APIKeyID)
+		require.NoError(t, err, "IP %s", ip)
+	}
+
+	al.Reset()
+	ipCtx := context.WithValue(ctx, clientip.ContextKey, "192.168.1.2")
+	_, err = adb.GetAPIKeyGroupFromAPIKey(ipCtx, key.Value)
+	require.Truef(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error; got: %v", err)
+	require.Contains(t, err.Error(), "192.168.1.2")
+	require.Len(t, al.GetAllEntries(), 1)
+	e := al.GetAllEntries()[0]
+	require.Equal(t, alpb.Action_ACCESS_DENIED, e.Action)
+	require.Equal(t, key.APIKeyID, e.Principal.APIKeyID)
+	require.Equal(t, groupID, e.Principal.GroupID)
+
+	// Keys with allowed IP ranges can't be used if the client IP is unknown.
+	_, err = adb.GetAPIKeyGroupFromAPIKey(ctx, key.Value)
+	require.Truef(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error; got: %v", err)
+
+	// Removing the allowed IP ranges allows the key to be used from
+	// anywhere.
+	key.AllowedIPRanges = ""
+	err = adb.UpdateAPIKey(adminCtx, key)
+	require.NoError(t, err)
+	_, err = adb.GetAPIKeyGroupFromAPIKey(ipCtx, key.Value)
+	require.NoError(t, err)
+
+	key.AllowedIPRanges = "not-an-ip"
+	err = adb.UpdateAPIKey(adminCtx, key)
+	require.Truef(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error; got: %v", err)
+}
+
+func TestUpdateApiKey_AllowedIPRanges(t *testing.T) {
+	flags.Set(t, "auth.api_key_group_cache_ttl", 0)
+	ctx := context.Background()
+	env := setupEnv(t)
+	adb := env.GetAuthDB()
+	adminCtx, groupID := createAdminAndGroup(t, ctx, env)
+
+	key, err := adb.CreateAPIKey(adminCtx, groupID, "ci", nil /*=capabilities*/, false /*=visibleToDevelopers*/, 0 /*=expiryUsec*/, []string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	getAllowedIPRanges := func() string {
+		k, err := adb.GetAPIKey(adminCtx, key.APIKeyID)
+		require.NoError(t, err)
+		return k.AllowedIPRanges
+	}
+
+	// Updates that don't mention the allowed IP ranges keep them.
+	_, err = env.GetBuildBuddyServer().UpdateApiKey(adminCtx, &akpb.UpdateApiKeyRequest{
+		Id:    key.APIKeyID,
+		Label: "new label",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.0/8", getAllowedIPRanges())
+
+	_, err = env.GetBuildBuddyServer().UpdateApiKey(adminCtx, &akpb.UpdateApiKeyRequest{
+		Id:              key.APIKeyID,
+		AllowedIpRanges: []string{"192.168.1.0/24"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.0/24", getAllowedIPRanges())
+
+	_, err = env.GetBuildBuddyServer().UpdateApiKey(adminCtx, &akpb.UpdateApiKeyRequest{
+		Id:                   key.APIKeyID,
+		AllowedIpRanges:      []string{"10.0.0.0/8"},
+		ClearAllowedIpRanges: true,
+	})
+	require.Truef(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error; got: %v", err)
+	require.Equal(t, "192.168.1.0/24", getAllowedIPRanges())
+
+	_, err = env.GetBuildBuddyServer().UpdateApiKey(adminCtx, &akpb.UpdateApiKeyRequest{
+		Id:                   key.APIKeyID,
+		ClearAllowedIpRanges: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "", getAllowedIPRanges())
+}
+
 func TestImpersonationAPIKeys(t *testing.T) {
 	ctx := context.Background()
 	env := setupEnv(t)
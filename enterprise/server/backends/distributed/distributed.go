@@ -40,6 +40,9 @@ var (
 	enableLocalWrites            = flag.Bool("cache.distributed_cache.enable_local_writes", false, "If enabled, shortcuts distributed writes that belong to the local shard to local cache instead of making an RPC.")
 	enableLocalCompressionLookup = flag.Bool("cache.distributed_cache.enable_local_compression_lookup", true, "If enabled, checks the local cache for compression support. If not set, distributed compression defaults to off.")
 	extraNodes                   = flagutil.New("cache.distributed_cache.extra_nodes", []string{}, "The hardcoded list of extra nodes to add data too. Useful for migrations. ** Enterprise only **")
+	enableRebalancing            = flag.Bool("cache.distributed_cache.rebalance.enabled", false, "If enabled, keys are copied in the background to the nodes that newly own them when nodes join or leave the cluster. Requires peer discovery through redis, and a local cache that supports scanning. ** Enterprise only **")
+	rebalanceSettleDuration      = flag.Duration("cache.distributed_cache.rebalance.settle_duration", 1*time.Minute, "How long the set of peers must remain unchanged before keys are rebalanced. ** Enterprise only **")
+	rebalanceMaxBytesPerSecond   = flag.Int64("cache.distributed_cache.rebalance.max_bytes_per_second", 50_000_000, "The max rate at which each node copies data to other nodes while rebalancing. Unlimited if <= 0. ** Enterprise only **")
 )
 
 const (
@@ -61,6 +64,9 @@ type CacheConfig struct {
 	DisableLocalLookup           bool
 	EnableLocalWrites            bool
 	EnableLocalCompressionLookup bool
+	EnableRebalancing            bool
+	RebalanceSettleDuration      time.Duration
+	RebalanceMaxBytesPerSecond   int64
 }
 
 type hintedHandoffOrder struct {
@@ -98,6 +104,7 @@ type Cache struct {
 	finishedShutdown     bool
 	config               CacheConfig
 	zone                 string
+	rebalancer           *rebalancer
 }
 
 func Register(env environment.Env) error {
@@ -116,6 +123,9 @@ func Register(env environment.Env) error {
 		ClusterSize:                  *clusterSize,
 		EnableLocalWrites:            *enableLocalWrites,
 		EnableLocalCompressionLookup: *enableLocalCompressionLookup,
+		EnableRebalancing:            *enableRebalancing,
+		RebalanceSettleDuration:      *rebalanceSettleDuration,
+		RebalanceMaxBytesPerSecond:   *rebalanceMaxBytesPerSecond,
 	}
 	log.Infof("Enabling distributed cache with config: %+v", dcConfig)
 	if len(dcConfig.Nodes) == 0 {
@@ -176,6 +186,15 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 	}
 	dc.cacheProxy.SetHeartbeatCallbackFunc(dc.recvHeartbeatCallback)
 	dc.cacheProxy.SetHintedHandoffCallbackFunc(dc.recvHintedHandoffCallback)
+	if config.EnableRebalancing {
+		if sc, ok := c.(interfaces.ScannableCache); !ok {
+			log.Warningf("Distributed cache rebalancing is enabled, but the local cache does not support scanning: rebalancing will be disabled")
+		} else if len(config.Nodes) > 0 {
+			log.Warningf("Distributed cache rebalancing is enabled, but nodes are hardcoded: rebalancing will be disabled")
+		} else {
+			dc.rebalancer = newRebalancer(env, dc, sc)
+		}
+	}
 	if len(config.Nodes) > 0 {
 		// Nodes are hardcoded. Set them once and be done with it.
 		chash.Set(config.Nodes...)
@@ -194,6 +213,10 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 			UpdateFn: func(peers ...string) {
 				if err := chash.Set(peers...); err != nil {
 					log.Errorf("Error setting peers in consistent hash: %s", err)
+					return
+				}
+				if dc.rebalancer != nil {
+					dc.rebalancer.setPeers(peers)
 				}
 			},
 			EnablePeerExpiry: false,
@@ -324,6 +347,9 @@ func (c *Cache) StartListening() {
 	}
 	c.shutDownChan = make(chan struct{}, 0)
 	go c.heartbeatPeers(c.shutDownChan)
+	if c.rebalancer != nil {
+		go c.rebalancer.run(c.shutDownChan)
+	}
 	go func() {
 		log.Infof("Distributed cache listening on %q", c.config.ListenAddr)
 		if c.heartbeatChannel != nil {
@@ -476,7 +502,11 @@ func (c *Cache) sendFile(ctx context.Context, rn *rspb.ResourceName, dest string
 	if exists, err := c.cacheProxy.RemoteContains(ctx, dest, rn); err == nil && exists {
 		return nil
 	}
+	return c.streamFile(ctx, rn, dest)
+}
 
+// streamFile copies the resource from the local cache to the dest peer.
+func (c *Cache) streamFile(ctx context.Context, rn *rspb.ResourceName, dest string) error {
 	r, err := c.local.Reader(ctx, rn, 0, 0)
 	if err != nil {
 		return err
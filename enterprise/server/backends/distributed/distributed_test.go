@@ -3,6 +3,7 @@ package distributed
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"testing"
@@ -17,8 +18,10 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testport"
 	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
+	"github.com/buildbuddy-io/buildbuddy/server/util/consistent_hash"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
@@ -1388,3 +1391,166 @@ func TestExtraNodes(t *testing.T) {
 	waitForShutdown(dc5)
 	waitForShutdown(dc6)
 }
+
+// scannableCache wraps a cache, and scans the given resources that are
+// present in it. The cursor is the index of the last scanned resource.
+type scannableCache struct {
+	interfaces.Cache
+	ctx       context.Context
+	resources []*rspb.ResourceName
+
+	// The cursors that scans were started from.
+	cursors [][]byte
+	// If non-zero, scans fail after this many resources are scanned.
+	failAfter int
+	// Saved scan states, by name.
+	states map[string][]byte
+}
+
+func (c *scannableCache) ReadScanState(ctx context.Context, name string) ([]byte, error) {
+	state, ok := c.states[name]
+	if !ok {
+		return nil, status.NotFoundErrorf("scan state %q not found", name)
+	}
+	return state, nil
+}
+
+func (c *scannableCache) WriteScanState(ctx context.Context, name string, state []byte) error {
+	if c.states == nil {
+		c.states = map[string][]byte{}
+	}
+	c.states[name] = state
+	return nil
+}
+
+func (c *scannableCache) ScanResources(ctx context.Context, cursor []byte, fn func(sr *interfaces.ScannedResource) error) error {
+	c.cursors = append(c.cursors, cursor)
+	start := 0
+	if cursor != nil {
+		start = int(binary.BigEndian.Uint32(cursor)) + 1
+	}
+	scanned := 0
+	for i := start; i < len(c.resources); i++ {
+		rn := c.resources[i]
+		exists, err := c.Cache.Contains(c.ctx, rn)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if c.failAfter > 0 && scanned == c.failAfter {
+			return status.UnavailableError("scan failed")
+		}
+		scanned++
+		sr := &interfaces.ScannedResource{
+			GroupID:         interfaces.AuthAnonymousUser,
+			Resource:        rn,
+			StoredSizeBytes: rn.GetDigest().GetSizeBytes(),
+			Cursor:          binary.BigEndian.AppendUint32(nil, uint32(i)),
+		}
+		if err := fn(sr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRebalance(t *testing.T) {
+	env, _, ctx := getEnvAuthAndCtx(t)
+	singleCacheSizeBytes := int64(1000000)
+	peer1 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer2 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer3 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer4 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	oldPeers := []string{peer1, peer2, peer3}
+	newPeers := []string{peer1, peer2, peer3, peer4}
+	baseConfig := CacheConfig{
+		ReplicationFactor:  2,
+		DisableLocalLookup: true,
+	}
+
+	// Setup a distributed cache, 3 nodes, R = 2, and a fourth node that
+	// joins the cluster after the keys are written.
+	var dcs []*Cache
+	baseCaches := map[string]*scannableCache{}
+	for _, peer := range newPeers {
+		config := baseConfig
+		config.ListenAddr = peer
+		config.Nodes = oldPeers
+		if peer == peer4 {
+			config.Nodes = newPeers
+		}
+		baseCache := &scannableCache{Cache: newMemoryCache(t, singleCacheSizeBytes), ctx: ctx}
+		baseCaches[peer] = baseCache
+		dcs = append(dcs, startNewDCache(t, env, config, baseCache))
+	}
+	for _, peer := range newPeers {
+		waitForReady(t, peer)
+	}
+
+	resourcesWritten := make([]*rspb.ResourceName, 0)
+	for i := 0; i < 100; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+		if err := dcs[i%len(oldPeers)].Set(ctx, rn, buf); err != nil {
+			t.Fatal(err)
+		}
+		resourcesWritten = append(resourcesWritten, rn)
+	}
+	for _, baseCache := range baseCaches {
+		baseCache.resources = resourcesWritten
+	}
+
+	// Interrupt the rebalance on the first node, and ensure that it is
+	// resumed from where it stopped, even after a restart.
+	r1 := newRebalancer(env, dcs[0], baseCaches[peer1])
+	r1.setPlacedPeers(ctx, oldPeers)
+	baseCaches[peer1].failAfter = 5
+	err := r1.rebalance(context.Background(), oldPeers, newPeers)
+	require.True(t, status.IsUnavailableError(err), "rebalance should fail: %s", err)
+	baseCaches[peer1].failAfter = 0
+	r1 = newRebalancer(env, dcs[0], baseCaches[peer1])
+	require.NoError(t, r1.loadState(ctx))
+	require.Equal(t, oldPeers, r1.placedPeers)
+	err = r1.rebalance(context.Background(), oldPeers, newPeers)
+	require.NoError(t, err)
+	require.Len(t, baseCaches[peer1].cursors, 2)
+	require.Nil(t, baseCaches[peer1].cursors[0])
+	require.NotNil(t, baseCaches[peer1].cursors[1])
+
+	// Once the rebalance finishes, the new peers are saved and the
+	// checkpoint is cleared.
+	r1.setPlacedPeers(ctx, newPeers)
+	r1 = newRebalancer(env, dcs[0], baseCaches[peer1])
+	require.NoError(t, r1.loadState(ctx))
+	require.Equal(t, newPeers, r1.placedPeers)
+	require.Nil(t, r1.checkpoint)
+
+	for _, dc := range dcs[1:len(oldPeers)] {
+		r := newRebalancer(env, dc, dc.local.(*scannableCache))
+		err := r.rebalance(context.Background(), oldPeers, newPeers)
+		require.NoError(t, err)
+	}
+
+	// Ensure that each key is now present on its owners according to the new
+	// set of peers, and that the new node only has the keys it owns.
+	newHash := consistent_hash.NewConsistentHash()
+	require.NoError(t, newHash.Set(newPeers...))
+	for _, rn := range resourcesWritten {
+		owners := newHash.GetAllReplicas(rn.GetDigest().GetHash())[:baseConfig.ReplicationFactor]
+		for _, peer := range newPeers {
+			exists, err := baseCaches[peer].Contains(ctx, rn)
+			require.NoError(t, err)
+			isOwner := false
+			for _, owner := range owners {
+				isOwner = isOwner || owner == peer
+			}
+			if isOwner {
+				assert.True(t, exists, "%q should have %s", peer, rn.GetDigest().GetHash())
+				readAndCompareDigest(t, ctx, baseCaches[peer], rn)
+			} else if peer == peer4 {
+				assert.False(t, exists, "%q should not have %s", peer, rn.GetDigest().GetHash())
+			}
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package distributed
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/claims"
+	"github.com/buildbuddy-io/buildbuddy/server/util/consistent_hash"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/exp/slices"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/proto"
+
+	dcpb "github.com/buildbuddy-io/buildbuddy/proto/distributed_cache"
+)
+
+const (
+	// The name under which the rebalance state is saved in the local cache.
+	rebalanceStateName = "distributed-cache-rebalance"
+
+	// How often the progress of a rebalance is saved while it is running.
+	rebalanceCheckpointInterval = 10 * time.Second
+)
+
+// rebalancer copies keys to the peers that newly own them when the set of
+// peers changes, so that the keys don't have to be backfilled when they are
+// read.
+//
+// Each node only scans its local cache: a key is copied by the first of its
+// previous owners that is still a peer, to each of its current owners that
+// did not previously own it.
+//
+// The peers that the keys were placed on and the progress of an unfinished
+// rebalance are saved in the local cache, so that a node that restarts
+// resumes the rebalance instead of starting over or skipping it.
+type rebalancer struct {
+	env            environment.Env
+	c              *Cache
+	local          interfaces.ScannableCache
+	settleDuration time.Duration
+	// Limits the rate at which data is copied, in bytes per second. Nil if
+	// the rate is unlimited.
+	limiter *rate.Limiter
+
+	// Signaled when the set of peers changes.
+	peersChanged chan struct{}
+
+	mu sync.Mutex
+	// The sorted peers that the keys were last placed on, or nil if the keys
+	// were not placed by a rebalance yet.
+	placedPeers []string
+	// The current sorted peers.
+	peers []string
+	// The progress of the last rebalance, if it did not finish.
+	checkpoint *rebalanceCheckpoint
+}
+
+// rebalanceCheckpoint records the progress of a rebalance, so that it can be
+// resumed if it is interrupted, including by a restart.
+type rebalanceCheckpoint struct {
+	from   []string
+	to     []string
+	cursor []byte
+}
+
+func newRebalancer(env environment.Env, c *Cache, local interfaces.ScannableCache) *rebalancer {
+	r := &rebalancer{
+		env:            env,
+		c:              c,
+		local:          local,
+		settleDuration: c.config.RebalanceSettleDuration,
+		peersChanged:   make(chan struct{}, 1),
+	}
+	if bps := c.config.RebalanceMaxBytesPerSecond; bps > 0 {
+		r.limiter = rate.NewLimiter(rate.Limit(bps), int(bps))
+	}
+	return r
+}
+
+// setPeers records the current set of peers. Once the set of peers has not
+// changed for the settle duration, the keys are rebalanced.
+func (r *rebalancer) setPeers(peers []string) {
+	peers = slices.Clone(peers)
+	sort.Strings(peers)
+	r.mu.Lock()
+	changed := !slices.Equal(r.peers, peers)
+	r.peers = peers
+	r.mu.Unlock()
+	if changed {
+		r.signalPeersChanged()
+	}
+}
+
+func (r *rebalancer) signalPeersChanged() {
+	select {
+	case r.peersChanged <- struct{}{}:
+	default:
+	}
+}
+
+// loadState restores the state saved by saveState, if any.
+func (r *rebalancer) loadState(ctx context.Context) error {
+	buf, err := r.local.ReadScanState(ctx, rebalanceStateName)
+	if status.IsNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := &dcpb.RebalanceState{}
+	if err := proto.Unmarshal(buf, state); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(state.GetPlacedPeers()) > 0 {
+		r.placedPeers = state.GetPlacedPeers()
+	}
+	if len(state.GetCheckpointToPeers()) > 0 {
+		r.checkpoint = &rebalanceCheckpoint{
+			from:   state.GetCheckpointFromPeers(),
+			to:     state.GetCheckpointToPeers(),
+			cursor: state.GetCheckpointCursor(),
+		}
+	}
+	return nil
+}
+
+// saveState saves the peers that the keys were placed on and the progress of
+// the current rebalance in the local cache.
+func (r *rebalancer) saveState(ctx context.Context) error {
+	r.mu.Lock()
+	state := &dcpb.RebalanceState{PlacedPeers: r.placedPeers}
+	if cp := r.checkpoint; cp != nil {
+		state.CheckpointFromPeers = cp.from
+		state.CheckpointToPeers = cp.to
+		state.CheckpointCursor = cp.cursor
+	}
+	buf, err := proto.Marshal(state)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return r.local.WriteScanState(ctx, rebalanceStateName, buf)
+}
+
+// setPlacedPeers records that the keys were placed on the given peers, and
+// clears the checkpoint of any unfinished rebalance.
+func (r *rebalancer) setPlacedPeers(ctx context.Context, peers []string) {
+	r.mu.Lock()
+	r.placedPeers = peers
+	r.checkpoint = nil
+	r.mu.Unlock()
+	if err := r.saveState(ctx); err != nil {
+		log.Warningf("Could not save distributed cache rebalance state: %s", err)
+	}
+}
+
+func (r *rebalancer) run(quit chan struct{}) {
+	ctx := r.env.GetServerContext()
+	if err := r.loadState(ctx); err != nil {
+		log.Warningf("Could not load distributed cache rebalance state, starting over: %s", err)
+	}
+	for {
+		select {
+		case <-quit:
+			return
+		case <-r.peersChanged:
+		}
+		if !r.waitForSettle(quit) {
+			return
+		}
+
+		r.mu.Lock()
+		from, to := r.placedPeers, r.peers
+		r.mu.Unlock()
+		if from == nil {
+			// The first set of peers is the one that the keys this node
+			// already has were written for.
+			r.setPlacedPeers(ctx, to)
+			continue
+		}
+		if slices.Equal(from, to) {
+			continue
+		}
+
+		err := r.rebalanceUntilInterrupted(quit, from, to)
+		if err == nil {
+			r.setPlacedPeers(ctx, to)
+			continue
+		}
+		if status.IsCanceledError(err) || err == context.Canceled {
+			continue
+		}
+		log.Warningf("Distributed cache rebalance from %s to %s failed, will retry: %s", from, to, err)
+		r.signalPeersChanged()
+	}
+}
+
+// waitForSettle waits until the set of peers has not changed for the settle
+// duration. It returns false if quit is closed first.
+func (r *rebalancer) waitForSettle(quit chan struct{}) bool {
+	timer := time.NewTimer(r.settleDuration)
+	defer timer.Stop()
+	for {
+		select {
+		case <-quit:
+			return false
+		case <-r.peersChanged:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(r.settleDuration)
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// rebalanceUntilInterrupted rebalances the keys, but stops early if quit is
+// closed or the set of peers changes again.
+func (r *rebalancer) rebalanceUntilInterrupted(quit chan struct{}, from, to []string) error {
+	ctx, cancel := context.WithCancel(r.env.GetServerContext())
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-quit:
+		case <-r.peersChanged:
+			// Let the run loop handle the change once the rebalance stops.
+			r.signalPeersChanged()
+		case <-done:
+			return
+		}
+		cancel()
+	}()
+	return r.rebalance(ctx, from, to)
+}
+
+// rebalance copies the local keys whose owners changed from the given old
+// peers to the given new peers. If a previous rebalance between the same sets
+// of peers was interrupted, it is resumed.
+func (r *rebalancer) rebalance(ctx context.Context, from, to []string) error {
+	oldHash := consistent_hash.NewConsistentHash()
+	if err := oldHash.Set(slices.Clone(from)...); err != nil {
+		return err
+	}
+	newHash := consistent_hash.NewConsistentHash()
+	if err := newHash.Set(slices.Clone(to)...); err != nil {
+		return err
+	}
+
+	var cursor []byte
+	r.mu.Lock()
+	if cp := r.checkpoint; cp != nil && slices.Equal(cp.from, from) && slices.Equal(cp.to, to) {
+		cursor = cp.cursor
+	} else {
+		r.checkpoint = &rebalanceCheckpoint{from: from, to: to}
+	}
+	checkpoint := r.checkpoint
+	r.mu.Unlock()
+
+	if cursor == nil {
+		log.Infof("Distributed cache rebalance from %s to %s starting", from, to)
+	} else {
+		log.Infof("Distributed cache rebalance from %s to %s resuming", from, to)
+	}
+	metrics.DistributedCacheRebalanceInProgress.Set(1)
+	defer metrics.DistributedCacheRebalanceInProgress.Set(0)
+
+	start := time.Now()
+	lastSaved := start
+	scanned, copied := 0, 0
+	err := r.local.ScanResources(ctx, cursor, func(sr *interfaces.ScannedResource) error {
+		scanned++
+		metrics.DistributedCacheRebalanceScannedKeys.Inc()
+		for _, peer := range r.newOwners(sr.Resource.GetDigest().GetHash(), oldHash, newHash, to) {
+			ok, err := r.copy(ctx, sr, peer)
+			if err != nil {
+				if ctx.Err() != nil || status.IsUnavailableError(err) {
+					// The rebalance will be retried from the last
+					// checkpoint.
+					return err
+				}
+				metrics.DistributedCacheRebalanceCopyErrors.Inc()
+				log.Debugf("Distributed cache rebalance could not copy %s to %q: %s", sr.Resource.GetDigest().GetHash(), peer, err)
+				continue
+			}
+			if ok {
+				copied++
+				metrics.DistributedCacheRebalanceCopiedKeys.Inc()
+				metrics.DistributedCacheRebalanceCopiedBytes.Add(float64(sr.StoredSizeBytes))
+			}
+		}
+		r.mu.Lock()
+		checkpoint.cursor = sr.Cursor
+		r.mu.Unlock()
+		if time.Since(lastSaved) >= rebalanceCheckpointInterval {
+			if err := r.saveState(ctx); err != nil {
+				log.Warningf("Could not save distributed cache rebalance state: %s", err)
+			}
+			lastSaved = time.Now()
+		}
+		return nil
+	})
+	if err != nil {
+		// Save the progress so far, so that the rebalance can be resumed from
+		// here even if this node restarts first. The scan context may have
+		// been canceled, so use the server context.
+		if err := r.saveState(r.env.GetServerContext()); err != nil {
+			log.Warningf("Could not save distributed cache rebalance state: %s", err)
+		}
+		log.Infof("Distributed cache rebalance from %s to %s stopped after scanning %d keys and copying %d keys in %s: %s", from, to, scanned, copied, time.Since(start), err)
+		return err
+	}
+	log.Infof("Distributed cache rebalance from %s to %s finished after scanning %d keys and copying %d keys in %s", from, to, scanned, copied, time.Since(start))
+	return nil
+}
+
+// newOwners returns the peers that this node should copy the key with the
+// given hash to: the current owners of the key that did not previously own
+// it, if this node is the first previous owner of the key that is still a
+// peer.
+func (r *rebalancer) newOwners(hash string, oldHash, newHash *consistent_hash.ConsistentHash, peers []string) []string {
+	oldOwners := r.owners(oldHash, hash)
+	sender := ""
+	for _, owner := range oldOwners {
+		if slices.Contains(peers, owner) {
+			sender = owner
+			break
+		}
+	}
+	if sender != r.c.config.ListenAddr {
+		return nil
+	}
+	var out []string
+	for _, owner := range r.owners(newHash, hash) {
+		if !slices.Contains(oldOwners, owner) {
+			out = append(out, owner)
+		}
+	}
+	return out
+}
+
+func (r *rebalancer) owners(chash *consistent_hash.ConsistentHash, hash string) []string {
+	replicas := chash.GetAllReplicas(hash)
+	if len(replicas) > r.c.config.ReplicationFactor {
+		replicas = replicas[:r.c.config.ReplicationFactor]
+	}
+	return replicas
+}
+
+// copy copies the resource to the peer, unless the peer already has it. It
+// returns whether the resource was copied.
+func (r *rebalancer) copy(ctx context.Context, sr *interfaces.ScannedResource, peer string) (bool, error) {
+	ctx, err := r.authContext(ctx, sr)
+	if err != nil {
+		return false, err
+	}
+	if exists, err := r.c.cacheProxy.RemoteContains(ctx, peer, sr.Resource); err != nil {
+		return false, err
+	} else if exists {
+		return false, nil
+	}
+	if err := r.waitForBytes(ctx, sr.StoredSizeBytes); err != nil {
+		return false, err
+	}
+	if err := r.c.streamFile(ctx, sr.Resource, peer); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// authContext returns a context that is authenticated as the group that owns
+// the resource, so that both this node and the peer look up the resource in
+// the group's partition, with the group's encryption settings.
+func (r *rebalancer) authContext(ctx context.Context, sr *interfaces.ScannedResource) (context.Context, error) {
+	if sr.GroupID != "" && sr.GroupID != interfaces.AuthAnonymousUser {
+		c := &claims.Claims{
+			GroupID:                sr.GroupID,
+			AllowedGroups:          []string{sr.GroupID},
+			CacheEncryptionEnabled: sr.Encrypted,
+		}
+		ctx = claims.AuthContextFromClaims(ctx, c, nil)
+	}
+	return prefix.AttachUserPrefixToContext(ctx, r.env)
+}
+
+func (r *rebalancer) waitForBytes(ctx context.Context, n int64) error {
+	if r.limiter == nil {
+		return nil
+	}
+	for n > 0 {
+		chunk := n
+		if burst := int64(r.limiter.Burst()); chunk > burst {
+			chunk = burst
+		}
+		if err := r.limiter.WaitN(ctx, int(chunk)); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
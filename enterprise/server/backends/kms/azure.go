@@ -0,0 +1,327 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/google/tink/go/tink"
+)
+
+const (
+	azureLoginURL = "https://login.microsoftonline.com"
+
+	// OAuth2 scope used to request tokens for the Key Vault data plane.
+	azureKeyVaultScope = "https://vault.azure.net/.default"
+
+	azureKeyVaultAPIVersion = "7.4"
+
+	// Key URIs may only reference vaults with this host suffix, unless the
+	// host is explicitly allowed with keystore.azure.allowed_vault_hosts.
+	// Access tokens are sent to the vault, so this prevents sending them to
+	// arbitrary hosts.
+	azureKeyVaultHostSuffix = ".vault.azure.net"
+
+	// Key wrapping algorithm used for data encryption keys. Requires an RSA
+	// key in the Key Vault.
+	azureKeyWrapAlgorithm = "RSA-OAEP-256"
+
+	// Access tokens are refreshed this long before they actually expire.
+	azureTokenExpiryMargin = 1 * time.Minute
+
+	azureRequestTimeout     = 10 * time.Second
+	azureMaxResponseBytes   = 4 * 1024 * 1024
+	azureDataKeySizeBytes   = 32
+	azureCiphertextFormatV1 = 1
+)
+
+// parseAzureKeyURI parses a key URI of the form
+// azure-kv://{vault_host}/keys/{key_name}[/{key_version}].
+func parseAzureKeyURI(keyURI string) (host, keyName, keyVersion string, err error) {
+	parts := strings.Split(strings.TrimPrefix(keyURI, azureKMSPrefix), "/")
+	if len(parts) < 3 || len(parts) > 4 || parts[0] == "" || parts[1] != "keys" || parts[2] == "" {
+		return "", "", "", status.InvalidArgumentErrorf("invalid Azure Key Vault key URI %q", keyURI)
+	}
+	if len(parts) == 4 {
+		keyVersion = parts[3]
+	}
+	if err := validateAzureVaultHost(parts[0]); err != nil {
+		return "", "", "", err
+	}
+	return parts[0], parts[2], keyVersion, nil
+}
+
+var azureVaultNameRegexp = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// validateAzureVaultHost returns an error unless the host is an Azure Key
+// Vault host or is explicitly allowed.
+func validateAzureVaultHost(host string) error {
+	for _, h := range *azureAllowedVaultHosts {
+		if host == h {
+			return nil
+		}
+	}
+	name, ok := strings.CutSuffix(strings.ToLower(host), azureKeyVaultHostSuffix)
+	if !ok || !azureVaultNameRegexp.MatchString(name) {
+		return status.InvalidArgumentErrorf("Key Vault host %q is not allowed: must be of the form {vault_name}%s", host, azureKeyVaultHostSuffix)
+	}
+	return nil
+}
+
+// AzureKeyVaultKMS is a KMS client that uses RSA keys stored in Azure Key
+// Vault. Key Vault can only encrypt small payloads directly, so data is
+// encrypted locally with a random AES-256-GCM data key, which is then wrapped
+// by Key Vault and stored alongside the ciphertext.
+type AzureKeyVaultKMS struct {
+	tenantID     string
+	clientID     string
+	clientSecret string
+
+	// Overridable for testing.
+	loginURL       string
+	keyVaultScheme string
+
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	tokenExpiry time.Time
+}
+
+func (a *AzureKeyVaultKMS) Supported(keyURI string) bool {
+	return strings.HasPrefix(keyURI, azureKMSPrefix)
+}
+
+func (a *AzureKeyVaultKMS) GetAEAD(keyURI string) (tink.AEAD, error) {
+	host, keyName, keyVersion, err := parseAzureKeyURI(keyURI)
+	if err != nil {
+		return nil, err
+	}
+	return &azureKeyVaultAEAD{
+		client:     a,
+		host:       host,
+		keyName:    keyName,
+		keyVersion: keyVersion,
+	}, nil
+}
+
+func (a *AzureKeyVaultKMS) do(req *http.Request, rsp any) error {
+	httpRsp, err := a.httpClient.Do(req)
+	if err != nil {
+		return status.UnavailableErrorf("Azure request failed: %s", err)
+	}
+	defer httpRsp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(httpRsp.Body, azureMaxResponseBytes))
+	if err != nil {
+		return status.UnavailableErrorf("could not read Azure response: %s", err)
+	}
+	if httpRsp.StatusCode != http.StatusOK {
+		msg := fmt.Sprintf("Azure request failed with HTTP %d: %s", httpRsp.StatusCode, strings.TrimSpace(string(b)))
+		switch httpRsp.StatusCode {
+		case http.StatusBadRequest:
+			return status.InvalidArgumentError(msg)
+		case http.StatusUnauthorized:
+			return status.UnauthenticatedError(msg)
+		case http.StatusForbidden:
+			return status.PermissionDeniedError(msg)
+		case http.StatusNotFound:
+			return status.NotFoundError(msg)
+		case http.StatusTooManyRequests:
+			return status.ResourceExhaustedError(msg)
+		default:
+			return status.UnavailableError(msg)
+		}
+	}
+	if err := json.Unmarshal(b, rsp); err != nil {
+		return status.UnknownErrorf("could not parse Azure response: %s", err)
+	}
+	return nil
+}
+
+// getAccessToken returns an access token for the Key Vault API, fetching a
+// new one using the client credentials flow if needed.
+func (a *AzureKeyVaultKMS) getAccessToken(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.accessToken != "" && time.Now().Before(a.tokenExpiry) {
+		return a.accessToken, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", a.clientID)
+	form.Set("client_secret", a.clientSecret)
+	form.Set("scope", azureKeyVaultScope)
+	u := fmt.Sprintf("%s/%s/oauth2/v2.0/token", a.loginURL, url.PathEscape(a.tenantID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", status.InternalErrorf("could not create Azure token request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rsp := &struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err := a.do(req, rsp); err != nil {
+		return "", err
+	}
+	if rsp.AccessToken == "" {
+		return "", status.UnauthenticatedError("Azure returned an empty access token")
+	}
+	a.accessToken = rsp.AccessToken
+	a.tokenExpiry = time.Now().Add(time.Duration(rsp.ExpiresIn)*time.Second - azureTokenExpiryMargin)
+	return a.accessToken, nil
+}
+
+type azureKeyOperationResponse struct {
+	KeyID string `json:"kid"`
+	Value string `json:"value"`
+}
+
+// keyOperation performs a wrapkey or unwrapkey operation on the given key.
+func (a *AzureKeyVaultKMS) keyOperation(host, keyName, keyVersion, op string, value []byte) (*azureKeyOperationResponse, error) {
+	if err := validateAzureVaultHost(host); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), azureRequestTimeout)
+	defer cancel()
+	token, err := a.getAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	path := "/keys/" + url.PathEscape(keyName)
+	if keyVersion != "" {
+		path += "/" + url.PathEscape(keyVersion)
+	}
+	u := fmt.Sprintf("%s://%s%s/%s?api-version=%s", a.keyVaultScheme, host, path, op, azureKeyVaultAPIVersion)
+	body, err := json.Marshal(map[string]string{
+		"alg":   azureKeyWrapAlgorithm,
+		"value": base64.RawURLEncoding.EncodeToString(value),
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, status.InternalErrorf("could not create Azure Key Vault request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rsp := &azureKeyOperationResponse{}
+	if err := a.do(req, rsp); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+type azureKeyVaultAEAD struct {
+	client     *AzureKeyVaultKMS
+	host       string
+	keyName    string
+	keyVersion string
+}
+
+func newDataKeyAEAD(key []byte) (cipher.AEAD, error) {
+	bc, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(bc)
+}
+
+// Encrypt encrypts the plaintext with a new data key and returns a
+// ciphertext with the following format:
+//
+//	[1 byte format version]
+//	[1 byte key version length][key version]
+//	[2 byte wrapped key length][wrapped key]
+//	[nonce][AES-GCM ciphertext]
+//
+// The key version is recorded so that the data key can still be unwrapped
+// after the Key Vault key is rotated.
+func (a *azureKeyVaultAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	dataKey := make([]byte, azureDataKeySizeBytes)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	g, err := newDataKeyAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := (&gcmAESAEAD{g}).Encrypt(plaintext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := a.client.keyOperation(a.host, a.keyName, a.keyVersion, "wrapkey", dataKey)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(rsp.Value, "="))
+	if err != nil {
+		return nil, status.UnknownErrorf("could not decode wrapped key: %s", err)
+	}
+	// The returned key ID always includes the version of the key that was
+	// used, even if no version was requested.
+	keyVersion := rsp.KeyID[strings.LastIndex(rsp.KeyID, "/")+1:]
+	if keyVersion == "" || len(keyVersion) > 255 || len(wrappedKey) > 0xFFFF {
+		return nil, status.UnknownErrorf("unexpected Azure Key Vault response for key %q", rsp.KeyID)
+	}
+
+	out := make([]byte, 0, 4+len(keyVersion)+len(wrappedKey)+len(ciphertext))
+	out = append(out, azureCiphertextFormatV1, byte(len(keyVersion)))
+	out = append(out, keyVersion...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(wrappedKey)))
+	out = append(out, wrappedKey...)
+	return append(out, ciphertext...), nil
+}
+
+func (a *azureKeyVaultAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	if len(ciphertext) < 2 || ciphertext[0] != azureCiphertextFormatV1 {
+		return nil, status.InvalidArgumentError("unknown ciphertext format")
+	}
+	b := ciphertext[1:]
+	versionLen := int(b[0])
+	b = b[1:]
+	if len(b) < versionLen+2 {
+		return nil, status.InvalidArgumentError("input ciphertext too short")
+	}
+	keyVersion := string(b[:versionLen])
+	b = b[versionLen:]
+	wrappedLen := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < wrappedLen {
+		return nil, status.InvalidArgumentError("input ciphertext too short")
+	}
+	wrappedKey, b := b[:wrappedLen], b[wrappedLen:]
+
+	// The key is always unwrapped using the configured vault and key name;
+	// only the version is taken from the ciphertext.
+	rsp, err := a.client.keyOperation(a.host, a.keyName, keyVersion, "unwrapkey", wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(rsp.Value, "="))
+	if err != nil {
+		return nil, status.UnknownErrorf("could not decode unwrapped key: %s", err)
+	}
+	g, err := newDataKeyAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return (&gcmAESAEAD{g}).Decrypt(b, associatedData)
+}
@@ -0,0 +1,235 @@
+package kms
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTenantID     = "test-tenant"
+	testClientID     = "test-client"
+	testClientSecret = "test-secret"
+	testAccessToken  = "test-access-token"
+)
+
+// fakeKeyVault implements the subset of the Azure AD and Key Vault APIs used
+// by AzureKeyVaultKMS.
+type fakeKeyVault struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu sync.Mutex
+	// Key versions by key name, oldest first.
+	keys         map[string][]*rsa.PrivateKey
+	tokenFetches int
+}
+
+func newFakeKeyVault(t *testing.T) *fakeKeyVault {
+	f := &fakeKeyVault{t: t, keys: make(map[string][]*rsa.PrivateKey)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+	flags.Set(t, "keystore.azure.allowed_vault_hosts", []string{f.host()})
+	return f
+}
+
+func (f *fakeKeyVault) host() string {
+	return strings.TrimPrefix(f.server.URL, "http://")
+}
+
+func (f *fakeKeyVault) addKeyVersion(name string) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(f.t, err)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[name] = append(f.keys[name], k)
+}
+
+func versionName(i int) string {
+	return fmt.Sprintf("v%d", i)
+}
+
+func (f *fakeKeyVault) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/"+testTenantID+"/oauth2/v2.0/token" {
+		if r.FormValue("client_id") != testClientID || r.FormValue("client_secret") != testClientSecret || r.FormValue("scope") != azureKeyVaultScope {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		f.tokenFetches++
+		json.NewEncoder(w).Encode(map[string]any{"access_token": testAccessToken, "expires_in": 3600})
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+testAccessToken {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// /keys/{name}[/{version}]/{op}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) < 3 || len(parts) > 4 || parts[0] != "keys" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	versions := f.keys[parts[1]]
+	if len(versions) == 0 {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	idx := len(versions) - 1
+	if len(parts) == 4 {
+		idx = -1
+		for i := range versions {
+			if versionName(i) == parts[2] {
+				idx = i
+			}
+		}
+		if idx < 0 {
+			http.Error(w, "key version not found", http.StatusNotFound)
+			return
+		}
+	}
+	key := versions[idx]
+	req := &struct {
+		Alg   string `json:"alg"`
+		Value string `json:"value"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Alg != azureKeyWrapAlgorithm {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	value, err := base64.RawURLEncoding.DecodeString(req.Value)
+	if err != nil {
+		http.Error(w, "bad value", http.StatusBadRequest)
+		return
+	}
+	var out []byte
+	switch parts[len(parts)-1] {
+	case "wrapkey":
+		out, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, &key.PublicKey, value, nil)
+	case "unwrapkey":
+		out, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, key, value, nil)
+	default:
+		http.Error(w, "unknown operation", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"kid":   "https://" + f.host() + "/keys/" + parts[1] + "/" + versionName(idx),
+		"value": base64.RawURLEncoding.EncodeToString(out),
+	})
+}
+
+func newTestAzureClient(f *fakeKeyVault, clientSecret string) *AzureKeyVaultKMS {
+	return &AzureKeyVaultKMS{
+		tenantID:       testTenantID,
+		clientID:       testClientID,
+		clientSecret:   clientSecret,
+		loginURL:       f.server.URL,
+		keyVaultScheme: "http",
+		httpClient:     f.server.Client(),
+	}
+}
+
+func TestAzureKeyVault(t *testing.T) {
+	f := newFakeKeyVault(t)
+	f.addKeyVersion("master")
+	f.addKeyVersion("other")
+	client := newTestAzureClient(f, testClientSecret)
+
+	uri := "azure-kv://" + f.host() + "/keys/master"
+	require.True(t, client.Supported(uri))
+	masterKey, err := client.GetAEAD(uri)
+	require.NoError(t, err)
+	otherKey, err := client.GetAEAD("azure-kv://" + f.host() + "/keys/other")
+	require.NoError(t, err)
+
+	plaintext := []byte("some secret data")
+	ciphertext, err := masterKey.Encrypt(plaintext, []byte("ad"))
+	require.NoError(t, err)
+
+	decrypted, err := masterKey.Decrypt(ciphertext, []byte("ad"))
+	require.NoError(t, err)
+	require.Equal(t, plaintext, decrypted)
+
+	// Decrypting with the wrong associated data or key should fail.
+	_, err = masterKey.Decrypt(ciphertext, []byte("wrong"))
+	require.Error(t, err)
+	_, err = otherKey.Decrypt(ciphertext, []byte("ad"))
+	require.Error(t, err)
+
+	// Truncated ciphertexts should be rejected.
+	_, err = masterKey.Decrypt(ciphertext[:10], []byte("ad"))
+	require.Error(t, err)
+
+	// Data encrypted before a key rotation should still be decryptable.
+	f.addKeyVersion("master")
+	decrypted, err = masterKey.Decrypt(ciphertext, []byte("ad"))
+	require.NoError(t, err)
+	require.Equal(t, plaintext, decrypted)
+
+	// The access token should have been cached.
+	require.Equal(t, 1, f.tokenFetches)
+}
+
+func TestAzureKeyVault_BadCredentials(t *testing.T) {
+	f := newFakeKeyVault(t)
+	f.addKeyVersion("master")
+	client := newTestAzureClient(f, "wrong-secret")
+
+	masterKey, err := client.GetAEAD("azure-kv://" + f.host() + "/keys/master")
+	require.NoError(t, err)
+	_, err = masterKey.Encrypt([]byte("data"), nil)
+	require.True(t, status.IsUnauthenticatedError(err), "expected Unauthenticated, got %v", err)
+}
+
+func TestParseAzureKeyURI(t *testing.T) {
+	host, name, version, err := parseAzureKeyURI("azure-kv://my-vault.vault.azure.net/keys/my-key")
+	require.NoError(t, err)
+	require.Equal(t, "my-vault.vault.azure.net", host)
+	require.Equal(t, "my-key", name)
+	require.Equal(t, "", version)
+
+	_, _, version, err = parseAzureKeyURI("azure-kv://my-vault.vault.azure.net/keys/my-key/abc123")
+	require.NoError(t, err)
+	require.Equal(t, "abc123", version)
+
+	for _, uri := range []string{
+		"azure-kv://my-vault.vault.azure.net",
+		"azure-kv://my-vault.vault.azure.net/secrets/my-key",
+		"azure-kv://my-vault.vault.azure.net/keys/",
+		"azure-kv://my-vault.vault.azure.net/keys/my-key/abc123/extra",
+		// Only Key Vault hosts are allowed by default.
+		"azure-kv://attacker.example.com/keys/my-key",
+		"azure-kv://vault.azure.net.example.com/keys/my-key",
+		"azure-kv://user@my-vault.vault.azure.net/keys/my-key",
+		"azure-kv://my-vault.vault.azure.net:8080/keys/my-key",
+		"azure-kv://.vault.azure.net/keys/my-key",
+	} {
+		_, _, _, err := parseAzureKeyURI(uri)
+		require.Error(t, err, uri)
+	}
+
+	// Other hosts can be explicitly allowed.
+	flags.Set(t, "keystore.azure.allowed_vault_hosts", []string{"my-hsm.managedhsm.azure.net"})
+	host, _, _, err = parseAzureKeyURI("azure-kv://my-hsm.managedhsm.azure.net/keys/my-key")
+	require.NoError(t, err)
+	require.Equal(t, "my-hsm.managedhsm.azure.net", host)
+}
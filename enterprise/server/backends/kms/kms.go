@@ -9,6 +9,7 @@ import (
 	"encoding/csv"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -36,6 +37,8 @@ const (
 	gcpKMSPrefix           = "gcp-kms://"
 	awsKMSPrefix           = "aws-kms://"
 	localInsecureKMSPrefix = "local-insecure-kms://"
+	vaultKMSPrefix         = "vault-transit://"
+	azureKMSPrefix         = "azure-kv://"
 )
 
 var (
@@ -47,6 +50,16 @@ var (
 	awsCredentialsFile        = flag.String("keystore.aws.credentials_file", "", "A path to a AWS CSV credentials file that will be used to authenticate. If not specified, credentials will be retrieved as described by https://docs.aws.amazon.com/sdkref/latest/guide/standardized-credentials.html")
 	awsCredentials            = flagutil.New("keystore.aws.credentials", "", "AWS CSV credentials that will be used to authenticate. If not specified, credentials will be retrieved as described by https://docs.aws.amazon.com/sdkref/latest/guide/standardized-credentials.html", flagutil.SecretTag)
 	localInsecureKMSDirectory = flag.String("keystore.local_insecure_kms_directory", "", "For development only. If set, keys in format local-insecure-kms://[id] are read from this directory.")
+	enableVaultClient         = flag.Bool("keystore.vault.enabled", false, "Whether HashiCorp Vault Transit support should be enabled. Implicitly enabled if the master key URI references a Vault URI.")
+	vaultAddress              = flag.String("keystore.vault.address", "", "Address of the Vault server, e.g. https://vault.example.com:8200")
+	vaultToken                = flagutil.New("keystore.vault.token", "", "Vault token that will be used to authenticate.", flagutil.SecretTag)
+	vaultTokenFile            = flag.String("keystore.vault.token_file", "", "A path to a file containing the Vault token that will be used to authenticate. The file is re-read on every request, so it can be kept up to date by e.g. Vault Agent.")
+	vaultNamespace            = flag.String("keystore.vault.namespace", "", "Vault Enterprise namespace containing the Transit secrets engine, if any.")
+	enableAzureClient         = flag.Bool("keystore.azure.enabled", false, "Whether Azure Key Vault support should be enabled. Implicitly enabled if the master key URI references an Azure Key Vault URI.")
+	azureTenantID             = flag.String("keystore.azure.tenant_id", "", "Azure AD tenant ID of the service principal used to authenticate.")
+	azureClientID             = flag.String("keystore.azure.client_id", "", "Client ID of the service principal used to authenticate.")
+	azureClientSecret         = flagutil.New("keystore.azure.client_secret", "", "Client secret of the service principal used to authenticate.", flagutil.SecretTag)
+	azureAllowedVaultHosts    = flagutil.New("keystore.azure.allowed_vault_hosts", []string{}, "Additional Key Vault hosts that key URIs may reference, besides hosts ending in "+azureKeyVaultHostSuffix+", e.g. for sovereign clouds or managed HSMs.")
 )
 
 type KMS struct {
@@ -60,6 +73,12 @@ type KMS struct {
 
 	// May be nil if local development integration is not enabled.
 	localInsecureKMSClient registry.KMSClient
+
+	// May be nil if Vault integration is not enabled.
+	vaultClient registry.KMSClient
+
+	// May be nil if Azure integration is not enabled.
+	azureClient registry.KMSClient
 }
 
 func New(ctx context.Context) (*KMS, error) {
@@ -73,6 +92,12 @@ func New(ctx context.Context) (*KMS, error) {
 	if err := kms.initLocalInsecureKMSClient(ctx); err != nil {
 		return nil, err
 	}
+	if err := kms.initVaultClient(ctx); err != nil {
+		return nil, err
+	}
+	if err := kms.initAzureClient(ctx); err != nil {
+		return nil, err
+	}
 	_, err := kms.clientForURI(*masterKeyURI)
 	if err != nil {
 		return nil, status.InvalidArgumentErrorf("master key URI not supported")
@@ -174,6 +199,47 @@ func (k *KMS) initLocalInsecureKMSClient(ctx context.Context) error {
 	return nil
 }
 
+func (k *KMS) initVaultClient(ctx context.Context) error {
+	if !*enableVaultClient && !strings.HasPrefix(*masterKeyURI, vaultKMSPrefix) {
+		return nil
+	}
+	if *vaultAddress == "" {
+		return status.FailedPreconditionError("Vault address must be specified")
+	}
+	if (*vaultToken == "") == (*vaultTokenFile == "") {
+		return status.FailedPreconditionError("exactly one of keystore.vault.token and keystore.vault.token_file must be specified")
+	}
+	if *vaultTokenFile != "" {
+		log.Debugf("KMS: using Vault token file: %q", *vaultTokenFile)
+	}
+	k.vaultClient = &VaultTransitKMS{
+		address:    strings.TrimSuffix(*vaultAddress, "/"),
+		namespace:  *vaultNamespace,
+		token:      *vaultToken,
+		tokenFile:  *vaultTokenFile,
+		httpClient: &http.Client{},
+	}
+	return nil
+}
+
+func (k *KMS) initAzureClient(ctx context.Context) error {
+	if !*enableAzureClient && !strings.HasPrefix(*masterKeyURI, azureKMSPrefix) {
+		return nil
+	}
+	if *azureTenantID == "" || *azureClientID == "" || *azureClientSecret == "" {
+		return status.FailedPreconditionError("Azure tenant ID, client ID and client secret must all be specified")
+	}
+	k.azureClient = &AzureKeyVaultKMS{
+		tenantID:       *azureTenantID,
+		clientID:       *azureClientID,
+		clientSecret:   *azureClientSecret,
+		loginURL:       azureLoginURL,
+		keyVaultScheme: "https",
+		httpClient:     &http.Client{},
+	}
+	return nil
+}
+
 func loadAWSCreds() (*awscreds.Value, error) {
 	var credsData []byte
 	if *awsCredentials != "" {
@@ -219,6 +285,22 @@ func createAWSClientWithCreds(arn *awsKMSARN) (registry.KMSClient, error) {
 	return awskms.NewClientWithKMS(arn.uriLocationPrefix, awssdkkms.New(sess))
 }
 
+// ValidateKeyURI returns an error if the key URI can't possibly be used by
+// one of the supported KMS integrations. Only Vault and Azure Key Vault URIs
+// are currently checked, since their hosts and paths are otherwise used as-is
+// in requests made with the server's credentials.
+func ValidateKeyURI(keyURI string) error {
+	switch {
+	case strings.HasPrefix(keyURI, vaultKMSPrefix):
+		_, _, err := parseVaultKeyURI(keyURI)
+		return err
+	case strings.HasPrefix(keyURI, azureKMSPrefix):
+		_, _, _, err := parseAzureKeyURI(keyURI)
+		return err
+	}
+	return nil
+}
+
 func (k *KMS) clientForURI(uri string) (registry.KMSClient, error) {
 	if strings.HasPrefix(uri, gcpKMSPrefix) && k.gcpClient != nil {
 		return k.gcpClient, nil
@@ -246,6 +328,10 @@ func (k *KMS) clientForURI(uri string) (registry.KMSClient, error) {
 		return client, nil
 	} else if strings.HasPrefix(uri, localInsecureKMSPrefix) && k.localInsecureKMSClient != nil {
 		return k.localInsecureKMSClient, nil
+	} else if strings.HasPrefix(uri, vaultKMSPrefix) && k.vaultClient != nil {
+		return k.vaultClient, nil
+	} else if strings.HasPrefix(uri, azureKMSPrefix) && k.azureClient != nil {
+		return k.azureClient, nil
 	}
 	log.Warningf("no matching client for URI %q", uri)
 	return nil, status.InvalidArgumentError("no matching client for key URI")
@@ -274,6 +360,12 @@ func (k *KMS) SupportedTypes() []interfaces.KMSType {
 	if k.awsClients != nil {
 		types = append(types, interfaces.KMSTypeAWS)
 	}
+	if k.vaultClient != nil {
+		types = append(types, interfaces.KMSTypeVault)
+	}
+	if k.azureClient != nil {
+		types = append(types, interfaces.KMSTypeAzure)
+	}
 	return types
 }
 
@@ -0,0 +1,210 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/google/tink/go/tink"
+)
+
+const (
+	// How long to wait for a single request to the Vault server.
+	vaultRequestTimeout = 10 * time.Second
+
+	// Upper bound on the size of responses read from the Vault server.
+	vaultMaxResponseBytes = 4 * 1024 * 1024
+)
+
+var (
+	// Mount paths and key names are used as-is in request paths, so they
+	// are restricted to characters that can't change the meaning of the
+	// path.
+	vaultMountPathRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+(/[A-Za-z0-9_-]+)*$`)
+	vaultKeyNameRegexp   = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+)
+
+// parseVaultKeyURI parses a key URI of the form
+// vault-transit://{mount_path}/keys/{key_name} into its mount path and key
+// name. The mount path may contain slashes.
+func parseVaultKeyURI(keyURI string) (mountPath string, keyName string, err error) {
+	p := strings.TrimPrefix(keyURI, vaultKMSPrefix)
+	i := strings.LastIndex(p, "/keys/")
+	if i <= 0 {
+		return "", "", status.InvalidArgumentErrorf("invalid Vault key URI %q", keyURI)
+	}
+	mountPath, keyName = p[:i], p[i+len("/keys/"):]
+	if !vaultMountPathRegexp.MatchString(mountPath) {
+		return "", "", status.InvalidArgumentErrorf("invalid Vault key URI %q: mount path may only contain letters, digits, '_', '-' and '/'", keyURI)
+	}
+	if !vaultKeyNameRegexp.MatchString(keyName) {
+		return "", "", status.InvalidArgumentErrorf("invalid Vault key URI %q: key name may only contain letters, digits, '_', '-' and '.'", keyURI)
+	}
+	return mountPath, keyName, nil
+}
+
+// VaultTransitKMS is a KMS client that encrypts and decrypts data using keys
+// stored in the HashiCorp Vault Transit secrets engine.
+type VaultTransitKMS struct {
+	address   string
+	namespace string
+
+	// Exactly one of token or tokenFile is set. The token file is read on
+	// every request so that tokens rotated by e.g. Vault Agent are picked up.
+	token     string
+	tokenFile string
+
+	httpClient *http.Client
+}
+
+func (v *VaultTransitKMS) Supported(keyURI string) bool {
+	return strings.HasPrefix(keyURI, vaultKMSPrefix)
+}
+
+func (v *VaultTransitKMS) GetAEAD(keyURI string) (tink.AEAD, error) {
+	mountPath, keyName, err := parseVaultKeyURI(keyURI)
+	if err != nil {
+		return nil, err
+	}
+	return &vaultTransitAEAD{
+		client:    v,
+		mountPath: mountPath,
+		keyName:   keyName,
+	}, nil
+}
+
+func (v *VaultTransitKMS) getToken() (string, error) {
+	if v.tokenFile == "" {
+		return v.token, nil
+	}
+	b, err := os.ReadFile(v.tokenFile)
+	if err != nil {
+		return "", status.UnavailableErrorf("could not read Vault token file: %s", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func vaultError(code int, errs []string) error {
+	msg := fmt.Sprintf("Vault request failed with HTTP %d", code)
+	if len(errs) > 0 {
+		msg += ": " + strings.Join(errs, "; ")
+	}
+	switch code {
+	case http.StatusBadRequest:
+		return status.InvalidArgumentError(msg)
+	case http.StatusForbidden:
+		return status.PermissionDeniedError(msg)
+	case http.StatusNotFound:
+		return status.NotFoundError(msg)
+	case http.StatusTooManyRequests:
+		return status.ResourceExhaustedError(msg)
+	default:
+		return status.UnavailableError(msg)
+	}
+}
+
+// post sends a POST request to the given Vault API path and decodes the JSON
+// response into rsp.
+func (v *VaultTransitKMS) post(path string, req, rsp any) error {
+	token, err := v.getToken()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), vaultRequestTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, v.address+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return status.InternalErrorf("could not create Vault request: %s", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Vault-Token", token)
+	if v.namespace != "" {
+		httpReq.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	httpRsp, err := v.httpClient.Do(httpReq)
+	if err != nil {
+		return status.UnavailableErrorf("Vault request failed: %s", err)
+	}
+	defer httpRsp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(httpRsp.Body, vaultMaxResponseBytes))
+	if err != nil {
+		return status.UnavailableErrorf("could not read Vault response: %s", err)
+	}
+	if httpRsp.StatusCode != http.StatusOK {
+		errRsp := &struct {
+			Errors []string `json:"errors"`
+		}{}
+		_ = json.Unmarshal(b, errRsp)
+		return vaultError(httpRsp.StatusCode, errRsp.Errors)
+	}
+	if err := json.Unmarshal(b, rsp); err != nil {
+		return status.UnknownErrorf("could not parse Vault response: %s", err)
+	}
+	return nil
+}
+
+type vaultTransitAEAD struct {
+	client    *VaultTransitKMS
+	mountPath string
+	keyName   string
+}
+
+func (a *vaultTransitAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	req := &struct {
+		Plaintext      string `json:"plaintext"`
+		AssociatedData string `json:"associated_data,omitempty"`
+	}{
+		Plaintext:      base64.StdEncoding.EncodeToString(plaintext),
+		AssociatedData: base64.StdEncoding.EncodeToString(associatedData),
+	}
+	rsp := &struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}{}
+	if err := a.client.post(a.mountPath+"/encrypt/"+a.keyName, req, rsp); err != nil {
+		return nil, err
+	}
+	if rsp.Data.Ciphertext == "" {
+		return nil, status.UnknownError("Vault returned an empty ciphertext")
+	}
+	// Vault ciphertexts are strings of the form "vault:v{version}:{base64}"
+	// which embed the key version, so they can be stored as-is.
+	return []byte(rsp.Data.Ciphertext), nil
+}
+
+func (a *vaultTransitAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	req := &struct {
+		Ciphertext     string `json:"ciphertext"`
+		AssociatedData string `json:"associated_data,omitempty"`
+	}{
+		Ciphertext:     string(ciphertext),
+		AssociatedData: base64.StdEncoding.EncodeToString(associatedData),
+	}
+	rsp := &struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}{}
+	if err := a.client.post(a.mountPath+"/decrypt/"+a.keyName, req, rsp); err != nil {
+		return nil, err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(rsp.Data.Plaintext)
+	if err != nil {
+		return nil, status.UnknownErrorf("could not decode Vault plaintext: %s", err)
+	}
+	return plaintext, nil
+}
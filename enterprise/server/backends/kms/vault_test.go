@@ -0,0 +1,105 @@
+package kms
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testvault"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultTransit(t *testing.T) {
+	address := testvault.Start(t)
+	testvault.CreateKey(t, address, "master")
+	testvault.CreateKey(t, address, "group")
+
+	flags.Set(t, "keystore.master_key_uri", "vault-transit://transit/keys/master")
+	flags.Set(t, "keystore.vault.address", address)
+	flags.Set(t, "keystore.vault.token", testvault.RootToken)
+
+	kms, err := New(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []interfaces.KMSType{interfaces.KMSTypeVault}, kms.SupportedTypes())
+
+	masterKey, err := kms.FetchMasterKey()
+	require.NoError(t, err)
+	groupKey, err := kms.FetchKey("vault-transit://transit/keys/group")
+	require.NoError(t, err)
+
+	plaintext := []byte("some secret data")
+	ciphertext, err := masterKey.Encrypt(plaintext, []byte("ad"))
+	require.NoError(t, err)
+	require.NotContains(t, string(ciphertext), string(plaintext))
+
+	decrypted, err := masterKey.Decrypt(ciphertext, []byte("ad"))
+	require.NoError(t, err)
+	require.Equal(t, plaintext, decrypted)
+
+	// Decrypting with the wrong associated data or key should fail.
+	_, err = masterKey.Decrypt(ciphertext, []byte("wrong"))
+	require.Error(t, err)
+	_, err = groupKey.Decrypt(ciphertext, []byte("ad"))
+	require.Error(t, err)
+
+	// Data encrypted before a key rotation should still be decryptable.
+	testvault.RotateKey(t, address, "master")
+	decrypted, err = masterKey.Decrypt(ciphertext, []byte("ad"))
+	require.NoError(t, err)
+	require.Equal(t, plaintext, decrypted)
+
+	// Keys that don't exist can't be used.
+	missingKey, err := kms.FetchKey("vault-transit://transit/keys/missing")
+	require.NoError(t, err)
+	_, err = missingKey.Encrypt(plaintext, nil)
+	require.Error(t, err)
+}
+
+func TestVaultTransit_TokenFile(t *testing.T) {
+	address := testvault.Start(t)
+	testvault.CreateKey(t, address, "master")
+
+	tokenFile := filepath.Join(testfs.MakeTempDir(t), "token")
+	err := os.WriteFile(tokenFile, []byte("bad-token\n"), 0600)
+	require.NoError(t, err)
+
+	flags.Set(t, "keystore.master_key_uri", "vault-transit://transit/keys/master")
+	flags.Set(t, "keystore.vault.address", address)
+	flags.Set(t, "keystore.vault.token_file", tokenFile)
+
+	kms, err := New(context.Background())
+	require.NoError(t, err)
+	masterKey, err := kms.FetchMasterKey()
+	require.NoError(t, err)
+
+	_, err = masterKey.Encrypt([]byte("data"), nil)
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+
+	// The token file should be re-read on each request.
+	err = os.WriteFile(tokenFile, []byte(testvault.RootToken+"\n"), 0600)
+	require.NoError(t, err)
+	_, err = masterKey.Encrypt([]byte("data"), nil)
+	require.NoError(t, err)
+}
+
+func TestParseVaultKeyURI(t *testing.T) {
+	mountPath, keyName, err := parseVaultKeyURI("vault-transit://team/transit/keys/my-key")
+	require.NoError(t, err)
+	require.Equal(t, "team/transit", mountPath)
+	require.Equal(t, "my-key", keyName)
+
+	for _, uri := range []string{
+		"vault-transit://transit",
+		"vault-transit://keys/my-key",
+		"vault-transit://transit/keys/",
+		"vault-transit://transit/keys/my-key/extra",
+	} {
+		_, _, err := parseVaultKeyURI(uri)
+		require.Error(t, err, uri)
+	}
+}
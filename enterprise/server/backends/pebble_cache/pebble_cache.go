@@ -1289,6 +1289,115 @@ func (p *PebbleCache) backgroundRepairIteration(quitChan chan struct{}, opts *re
 	return nil
 }
 
+// ScanResources calls fn for each resource stored in the cache, in key order,
+// starting after the given cursor. Chunks of chunked files are not returned
+// individually; they are read as part of the file that they belong to.
+func (p *PebbleCache) ScanResources(ctx context.Context, cursor []byte, fn func(sr *interfaces.ScannedResource) error) error {
+	db, err := p.leaser.DB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	lowerBound := keys.MinByte
+	if len(cursor) > 0 {
+		lowerBound = cursor
+	}
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: lowerBound,
+		UpperBound: keys.MaxByte,
+	})
+	// We update the iter variable later on, so we need to wrap the Close call
+	// in a func to operate on the correct iterator instance.
+	defer func() {
+		iter.Close()
+	}()
+	iterCreated := time.Now()
+
+	fileMetadata := &rfpb.FileMetadata{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// The callback may be slow, so create a new iterator once in a while
+		// to avoid holding on to sstables for too long.
+		if time.Since(iterCreated) > time.Minute {
+			k := make([]byte, len(iter.Key()))
+			copy(k, iter.Key())
+			newIter := db.NewIter(&pebble.IterOptions{
+				LowerBound: k,
+				UpperBound: keys.MaxByte,
+			})
+			iter.Close()
+			iter = newIter
+			iterCreated = time.Now()
+			if !iter.First() {
+				break
+			}
+		}
+
+		if bytes.Equal(iter.Key(), cursor) || bytes.HasPrefix(iter.Key(), SystemKeyPrefix) {
+			continue
+		}
+		if err := proto.Unmarshal(iter.Value(), fileMetadata); err != nil {
+			log.Warningf("Error unmarshaling metadata when scanning resources: %s", err)
+			continue
+		}
+		if fileMetadata.GetFileType() == rfpb.FileMetadata_CHUNK_FILE_TYPE {
+			continue
+		}
+		fileRecord := fileMetadata.GetFileRecord()
+		k := make([]byte, len(iter.Key()))
+		copy(k, iter.Key())
+		sr := &interfaces.ScannedResource{
+			GroupID:   fileRecord.GetIsolation().GetGroupId(),
+			Encrypted: fileRecord.GetEncryption().GetKeyId() != "",
+			Resource: &rspb.ResourceName{
+				Digest:         fileRecord.GetDigest(),
+				DigestFunction: fileRecord.GetDigestFunction(),
+				CacheType:      fileRecord.GetIsolation().GetCacheType(),
+				InstanceName:   fileRecord.GetIsolation().GetRemoteInstanceName(),
+				Compressor:     repb.Compressor_IDENTITY,
+			},
+			StoredSizeBytes: fileMetadata.GetStoredSizeBytes(),
+			Cursor:          k,
+		}
+		if err := fn(sr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanStateKey returns the key bytes of a key where the state of the scan with
+// the given name is stored.
+func scanStateKey(name string) []byte {
+	var key []byte
+	key = append(key, SystemKeyPrefix...)
+	key = append(key, []byte("scan-state/")...)
+	key = append(key, []byte(name)...)
+	return key
+}
+
+func (p *PebbleCache) ReadScanState(ctx context.Context, name string) ([]byte, error) {
+	db, err := p.leaser.DB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return pebble.GetCopy(db, scanStateKey(name))
+}
+
+func (p *PebbleCache) WriteScanState(ctx context.Context, name string, state []byte) error {
+	db, err := p.leaser.DB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Set(scanStateKey(name), state, pebble.Sync)
+}
+
 func (p *PebbleCache) Statusz(ctx context.Context) string {
 	db, err := p.leaser.DB()
 	if err != nil {
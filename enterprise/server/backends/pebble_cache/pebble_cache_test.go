@@ -328,6 +328,54 @@ func TestGetSet(t *testing.T) {
 	}
 }
 
+func TestDigestFunctions(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	ctx := getAnonContext(t, te)
+
+	options := &pebble_cache.Options{
+		RootDirectory:          testfs.MakeTempDir(t),
+		MaxSizeBytes:           int64(1_000_000_000), // 1GB
+		AverageChunkSizeBytes:  averageChunkSizeBytes,
+		MaxInlineFileSizeBytes: 100,
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	err = pc.Start()
+	require.NoError(t, err)
+	defer pc.Stop()
+
+	digestFunctions := []repb.DigestFunction_Value{
+		repb.DigestFunction_SHA256,
+		repb.DigestFunction_SHA384,
+		repb.DigestFunction_SHA512,
+		repb.DigestFunction_VSO,
+		repb.DigestFunction_BLAKE3,
+	}
+	for _, testSize := range []int64{10, 1000, 100_000} {
+		// Store the same contents under each digest function; every copy
+		// should be retrievable independently of the others.
+		_, buf := newCASResourceBuf(t, testSize)
+		var rns []*rspb.ResourceName
+		for _, df := range digestFunctions {
+			d, err := digest.Compute(bytes.NewReader(buf), df)
+			require.NoError(t, err)
+			rn := digest.NewResourceName(d, "" /*instanceName*/, rspb.CacheType_CAS, df).ToProto()
+			err = pc.Set(ctx, rn, buf)
+			require.NoError(t, err, "Error setting %s digest %q in cache", df, d.GetHash())
+			rns = append(rns, rn)
+		}
+		missing, err := pc.FindMissing(ctx, rns)
+		require.NoError(t, err)
+		require.Empty(t, missing)
+		for _, rn := range rns {
+			rbuf, err := pc.Get(ctx, rn)
+			require.NoError(t, err, "Error getting %s digest %q from cache", rn.GetDigestFunction(), rn.GetDigest().GetHash())
+			require.Equal(t, buf, rbuf)
+		}
+	}
+}
+
 func TestDupeWrites(t *testing.T) {
 	te := testenv.GetTestEnv(t)
 	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
@@ -1581,6 +1629,129 @@ func TestFindMissing(t *testing.T) {
 	}
 }
 
+func TestScanResources(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	testAPIKey := "AK2222"
+	testGroup := "GR7890"
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers(testAPIKey, testGroup)))
+	anonCtx := getAnonContext(t, te)
+	groupCtx := te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), testAPIKey)
+
+	options := &pebble_cache.Options{
+		RootDirectory:         testfs.MakeTempDir(t),
+		MaxSizeBytes:          1_000_000_000, // 1GB
+		AverageChunkSizeBytes: 64 * 4,
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	err = pc.Start()
+	require.NoError(t, err)
+	defer pc.Stop()
+
+	type scanned struct {
+		groupID      string
+		cacheType    rspb.CacheType
+		instanceName string
+		hash         string
+	}
+	var expected []scanned
+	for i, size := range []int64{10, 1000, 10000} {
+		for _, tc := range []struct {
+			ctx     context.Context
+			groupID string
+		}{
+			{anonCtx, interfaces.AuthAnonymousUser},
+			{groupCtx, testGroup},
+		} {
+			for _, cacheType := range []rspb.CacheType{rspb.CacheType_CAS, rspb.CacheType_AC} {
+				instanceName := fmt.Sprintf("instance-%d", i)
+				r, buf := newResourceAndBuf(t, size, cacheType, instanceName)
+				err := pc.Set(tc.ctx, r, buf)
+				require.NoError(t, err)
+				expected = append(expected, scanned{tc.groupID, cacheType, instanceName, r.GetDigest().GetHash()})
+			}
+		}
+	}
+
+	var got []scanned
+	var cursors [][]byte
+	err = pc.ScanResources(context.Background(), nil, func(sr *interfaces.ScannedResource) error {
+		r := sr.Resource
+		// Chunks of chunked files should not be returned.
+		require.Contains(t, expected, scanned{sr.GroupID, r.GetCacheType(), r.GetInstanceName(), r.GetDigest().GetHash()})
+		require.Greater(t, sr.StoredSizeBytes, int64(0))
+		require.False(t, sr.Encrypted)
+		got = append(got, scanned{sr.GroupID, r.GetCacheType(), r.GetInstanceName(), r.GetDigest().GetHash()})
+		cursors = append(cursors, sr.Cursor)
+		return nil
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, expected, got)
+
+	// Resuming from a cursor should return the remaining resources.
+	var resumed []scanned
+	err = pc.ScanResources(context.Background(), cursors[4], func(sr *interfaces.ScannedResource) error {
+		r := sr.Resource
+		resumed = append(resumed, scanned{sr.GroupID, r.GetCacheType(), r.GetInstanceName(), r.GetDigest().GetHash()})
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, got[5:], resumed)
+
+	// Errors returned by the callback should stop the scan.
+	n := 0
+	err = pc.ScanResources(context.Background(), nil, func(sr *interfaces.ScannedResource) error {
+		n++
+		return status.CanceledError("stop")
+	})
+	require.True(t, status.IsCanceledError(err))
+	require.Equal(t, 1, n)
+}
+
+func TestScanState(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	ctx := getAnonContext(t, te)
+
+	options := &pebble_cache.Options{
+		RootDirectory: testfs.MakeTempDir(t),
+		MaxSizeBytes:  1_000_000_000, // 1GB
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	err = pc.Start()
+	require.NoError(t, err)
+
+	_, err = pc.ReadScanState(ctx, "scan")
+	require.True(t, status.IsNotFoundError(err), "expected NotFound; got: %v", err)
+	err = pc.WriteScanState(ctx, "scan", []byte("state"))
+	require.NoError(t, err)
+	r, buf := testdigest.RandomCASResourceBuf(t, 100)
+	err = pc.Set(ctx, r, buf)
+	require.NoError(t, err)
+
+	// The state should survive a restart, and shouldn't be returned as a
+	// resource by scans.
+	err = pc.Stop()
+	require.NoError(t, err)
+	pc, err = pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	err = pc.Start()
+	require.NoError(t, err)
+	defer pc.Stop()
+
+	state, err := pc.ReadScanState(ctx, "scan")
+	require.NoError(t, err)
+	require.Equal(t, "state", string(state))
+	var scanned []string
+	err = pc.ScanResources(ctx, nil, func(sr *interfaces.ScannedResource) error {
+		scanned = append(scanned, sr.Resource.GetDigest().GetHash())
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{r.GetDigest().GetHash()}, scanned)
+}
+
 func TestNoEarlyEviction(t *testing.T) {
 	te := testenv.GetTestEnv(t)
 	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/keystore"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/samlutil"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
@@ -752,6 +753,57 @@ func (d *UserDB) InsertUser(ctx context.Context, u *tables.User) error {
 	})
 }
 
+func (d *UserDB) UpdateUser(ctx context.Context, groupID string, u *tables.User) error {
+	if u.UserID == "" {
+		return status.InvalidArgumentError("UserID is required")
+	}
+	if u.Email != "" && len(strings.Split(u.Email, "@")) != 2 {
+		return status.InvalidArgumentErrorf("Invalid email address: %s", u.Email)
+	}
+	authUser, err := perms.AuthenticatedUser(ctx, d.env)
+	if err != nil {
+		return err
+	}
+	if err := authutil.AuthorizeGroupRole(authUser, groupID, role.Admin); err != nil {
+		return err
+	}
+	return d.h.Transaction(ctx, func(tx *db.DB) error {
+		g, err := d.getGroupByID(tx, groupID)
+		if err != nil {
+			return err
+		}
+		existing, err := d.getUser(tx, u.UserID)
+		if err != nil {
+			if db.IsRecordNotFound(err) {
+				return status.NotFoundErrorf("User %q not found", u.UserID)
+			}
+			return err
+		}
+		// User profiles are shared across all of the user's groups, so only
+		// allow the group that provisioned the user via SAML or SCIM to
+		// update them.
+		if g.URLIdentifier == nil || *g.URLIdentifier == "" || !strings.HasPrefix(existing.SubID, samlutil.EntityID(*g.URLIdentifier)+"/") {
+			return status.PermissionDeniedError("You do not have permission to update this user")
+		}
+		isMember := false
+		for _, gr := range existing.Groups {
+			if gr.Group.GroupID == groupID {
+				isMember = true
+				break
+			}
+		}
+		if !isMember {
+			return status.PermissionDeniedError("You do not have permission to update this user")
+		}
+		return tx.Exec(`
+			UPDATE "Users"
+			SET first_name = ?, last_name = ?, email = ?
+			WHERE user_id = ?`,
+			u.FirstName, u.LastName, u.Email, u.UserID,
+		).Error
+	})
+}
+
 func (d *UserDB) GetUserByID(ctx context.Context, id string) (*tables.User, error) {
 	var user *tables.User
 	err := d.h.Transaction(ctx, func(tx *db.DB) error {
@@ -9,6 +9,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/userdb"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/samlutil"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
@@ -615,6 +616,73 @@ func TestUpdateGroupUsers_Role(t *testing.T) {
 		err)
 }
 
+func TestUpdateUser(t *testing.T) {
+	env := newTestEnv(t)
+	flags.Set(t, "app.create_group_per_user", true)
+	flags.Set(t, "app.no_default_user_group", true)
+	udb := env.GetUserDB()
+	ctx := context.Background()
+
+	createUser(t, ctx, env, "US1", "org1.io")
+	ctx1 := authUserCtx(ctx, env, t, "US1")
+	us1Group := getGroup(t, ctx1, env).Group
+	_, err := udb.InsertOrUpdateGroup(ctx1, &tables.Group{GroupID: us1Group.GroupID, URLIdentifier: stringPointer("org1")})
+	require.NoError(t, err)
+	createUser(t, ctx, env, "US2", "org2.io")
+	ctx2 := authUserCtx(ctx, env, t, "US2")
+
+	// US3 was provisioned by US1's group via SAML; US4 has a SAML sub ID
+	// for the same group but isn't a member.
+	us3 := newFakeUser("US3", "org1.io")
+	us3.SubID = samlutil.EntityID("org1") + "/US3"
+	err = udb.InsertUser(ctx, us3)
+	require.NoError(t, err)
+	us4 := newFakeUser("US4", "org1.io")
+	us4.SubID = samlutil.EntityID("org1") + "/US4"
+	err = udb.InsertUser(ctx, us4)
+	require.NoError(t, err)
+
+	// Add US2 and US3 to US1's group as developers.
+	for _, userID := range []string{"US2", "US3"} {
+		err := udb.UpdateGroupUsers(ctx1, us1Group.GroupID, []*grpb.UpdateGroupUsersRequest_Update{{
+			UserId:           &uidpb.UserId{Id: userID},
+			MembershipAction: grpb.UpdateGroupUsersRequest_Update_ADD,
+			Role:             grpb.Group_DEVELOPER_ROLE,
+		}})
+		require.NoError(t, err)
+	}
+
+	// US1 is an admin of the group that provisioned US3, so they can update
+	// US3.
+	err = udb.UpdateUser(ctx1, us1Group.GroupID, &tables.User{UserID: "US3", FirstName: "New", LastName: "Name", Email: "new@org1.io"})
+	require.NoError(t, err)
+	updated, err := udb.GetUserByID(ctx, "US3")
+	require.NoError(t, err)
+	require.Equal(t, "New", updated.FirstName)
+	require.Equal(t, "Name", updated.LastName)
+	require.Equal(t, "new@org1.io", updated.Email)
+	require.Equal(t, us3.SubID, updated.SubID)
+
+	// US2 is a member of US1's group but wasn't provisioned by it, so US1
+	// can't update US2's profile.
+	err = udb.UpdateUser(ctx1, us1Group.GroupID, &tables.User{UserID: "US2", FirstName: "Nope"})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied; got: %v", err)
+
+	// US4 has a matching sub ID but isn't a member of US1's group.
+	err = udb.UpdateUser(ctx1, us1Group.GroupID, &tables.User{UserID: "US4", FirstName: "Nope"})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied; got: %v", err)
+
+	// US2 is only a developer in US1's group, so they can't update US3.
+	err = udb.UpdateUser(ctx2, us1Group.GroupID, &tables.User{UserID: "US3", FirstName: "Nope"})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied; got: %v", err)
+
+	err = udb.UpdateUser(ctx1, us1Group.GroupID, &tables.User{UserID: "US3", Email: "not-an-email"})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument; got: %v", err)
+
+	err = udb.UpdateUser(ctx1, us1Group.GroupID, &tables.User{UserID: "US5"})
+	require.True(t, status.IsNotFoundError(err), "expected NotFound; got: %v", err)
+}
+
 func TestGetAPIKeyForInternalUseOnly(t *testing.T) {
 	ctx := context.Background()
 	env := newTestEnv(t)
@@ -680,6 +748,37 @@ func TestGetAPIKeyForInternalUseOnly_ManyUsers(t *testing.T) {
 	}
 }
 
+func TestGetAPIKeyForInternalUseOnly_SkipsRestrictedKeys(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	adb := env.GetAuthDB()
+
+	createUser(t, ctx, env, "US1", "org1.io")
+	ctx1 := authUserCtx(ctx, env, t, "US1")
+	groupID := getGroup(t, ctx1, env).Group.GroupID
+
+	// Restrict the group's only key to an IP range; it should no longer be
+	// used internally.
+	key, err := adb.GetAPIKeyForInternalUseOnly(ctx, groupID)
+	require.NoError(t, err)
+	key.AllowedIPRanges = "10.0.0.0/8"
+	err = adb.UpdateAPIKey(ctx1, key)
+	require.NoError(t, err)
+	_, err = adb.GetAPIKeyForInternalUseOnly(ctx, groupID)
+	require.Truef(
+		t, status.IsNotFoundError(err),
+		"expected NotFound when all keys have allowed IP ranges, got: %v", err)
+
+	// An unrestricted key should be returned instead.
+	unrestricted, err := adb.CreateAPIKey(
+		ctx1, groupID, "unrestricted", nil, /*=capabilities*/
+		false /*=visibleToDevelopers*/, 0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
+	require.NoError(t, err)
+	key, err = adb.GetAPIKeyForInternalUseOnly(ctx, groupID)
+	require.NoError(t, err)
+	require.Equal(t, unrestricted.APIKeyID, key.APIKeyID)
+}
+
 func TestCreateAndGetAPIKey(t *testing.T) {
 	ctx := context.Background()
 	env := newTestEnv(t)
@@ -697,12 +796,12 @@ func TestCreateAndGetAPIKey(t *testing.T) {
 	adminOnlyKey, err := adb.CreateAPIKey(
 		ctx1, groupID1, "Admin-only key",
 		[]akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY},
-		false /*=visibleToDevelopers*/)
+		false /*=visibleToDevelopers*/, 0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
 	require.NoError(t, err)
 	developerKey, err := adb.CreateAPIKey(
 		ctx1, groupID1, "Developer key",
 		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY},
-		true /*=visibleToDevelopers*/)
+		true /*=visibleToDevelopers*/, 0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
 	require.NoError(t, err)
 
 	// US1 should be able to see the keys they just created.
@@ -748,7 +847,7 @@ func TestCreateAndGetAPIKey(t *testing.T) {
 	_, err = adb.CreateAPIKey(
 		ctx2, groupID1, "test-label-2",
 		[]akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY},
-		false /*=visibleToDevelopers*/)
+		false /*=visibleToDevelopers*/, 0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
 	require.Truef(
 		t, status.IsPermissionDeniedError(err),
 		"expected PermissionDenied, got: %v", err)
@@ -757,7 +856,7 @@ func TestCreateAndGetAPIKey(t *testing.T) {
 	_, err = adb.CreateAPIKey(
 		ctx3, groupID1, "test-label-3",
 		[]akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY},
-		false /*=visibleToDevelopers*/)
+		false /*=visibleToDevelopers*/, 0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
 	require.Truef(
 		t, status.IsPermissionDeniedError(err),
 		"expected PermissionDenied, got: %v", err)
@@ -841,7 +940,8 @@ func TestDeleteAPIKey(t *testing.T) {
 
 	uk3, err := adb.CreateUserAPIKey(
 		ctx3, gr1.Group.GroupID, "US3's Key",
-		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY})
+		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY},
+		0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
 	require.NoError(t, err, "create a US3-owned key in org1")
 
 	err = adb.DeleteAPIKey(ctx1, uk3.APIKeyID)
@@ -901,7 +1001,7 @@ func TestUserOwnedKeys_GetUpdateDeletePermissions(t *testing.T) {
 			ownerKey, err := adb.CreateUserAPIKey(
 				ownerCtx, ownerGroup.GroupID, test.Owner+"'s key",
 				[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY},
-			)
+				0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
 			require.NoError(t, err)
 
 			// Try to list keys for the owner, as the accessor.
@@ -983,7 +1083,8 @@ func TestUserOwnedKeys_RespectsEnabledSetting(t *testing.T) {
 	// Try to create a user-owned key; should fail by default.
 	_, err := adb.CreateUserAPIKey(
 		ctx1, gr1.GroupID, "US1's key",
-		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY})
+		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY},
+		0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
 	require.Truef(
 		t, status.IsPermissionDeniedError(err),
 		"expected PermissionDenied since user-owned keys are not enabled; got: %v",
@@ -994,7 +1095,8 @@ func TestUserOwnedKeys_RespectsEnabledSetting(t *testing.T) {
 
 	key1, err := adb.CreateUserAPIKey(
 		ctx1, gr1.GroupID, "US1's key",
-		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY})
+		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY},
+		0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
 	require.NoError(
 		t, err,
 		"should be able to create a user-owned key after enabling the setting")
@@ -1062,7 +1164,8 @@ func TestUserOwnedKeys_RemoveUserFromGroup_KeyNoLongerWorks(t *testing.T) {
 
 	us2Key, err := adb.CreateUserAPIKey(
 		ctx2, gr1.GroupID, "US2's key",
-		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY})
+		[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY},
+		0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
 	require.NoError(t, err, "US2 should be able to create a user-owned key")
 
 	_, err = env.GetAuthDB().GetAPIKeyGroupFromAPIKey(ctx, us2Key.Value)
@@ -1116,7 +1219,8 @@ func TestUserOwnedKeys_CreateAndUpdateCapabilities(t *testing.T) {
 			// Test create with capabilities
 
 			key, err := adb.CreateUserAPIKey(
-				ctx1, g.GroupID, "US1's key", test.Capabilities)
+				ctx1, g.GroupID, "US1's key", test.Capabilities,
+				0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
 			if test.OK {
 				require.NoError(t, err)
 				// Read back the capabilities, make sure they took effect.
@@ -1134,7 +1238,8 @@ func TestUserOwnedKeys_CreateAndUpdateCapabilities(t *testing.T) {
 
 			key, err = adb.CreateUserAPIKey(
 				ctx1, g.GroupID, "US1's key",
-				[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY})
+				[]akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY},
+				0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
 			require.NoError(t, err)
 			key.Capabilities = capabilities.ToInt(test.Capabilities)
 			err = adb.UpdateAPIKey(ctx1, key)
@@ -1173,7 +1278,7 @@ func TestUserOwnedKeys_NotReturnedByGroupLevelAPIs(t *testing.T) {
 	}
 
 	// Create a user-level key.
-	_, err = adb.CreateUserAPIKey(ctx1, g.GroupID, "test-personal-key", nil /*=capabilities*/)
+	_, err = adb.CreateUserAPIKey(ctx1, g.GroupID, "test-personal-key", nil /*=capabilities*/, 0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
 	require.NoError(t, err)
 
 	// Test all group-level APIs; none should return the user-level key we
@@ -186,6 +186,10 @@ type workspace struct {
 	// reported for all action logs instead of actually executing the action.
 	setupError error
 
+	// The files changed by the pushed branch relative to the target branch,
+	// used to evaluate path filters. nil if unknown.
+	changedFiles []string
+
 	// The start time of the setup phase.
 	startTime time.Time
 
@@ -744,6 +748,17 @@ func (ar *actionRunner) Run(ctx context.Context, ws *workspace) error {
 	if err != nil {
 		return status.WrapError(err, "failed to get action to run")
 	}
+	// Skip the bazel commands if the action filters on paths and none of the
+	// changed files match.
+	skipCommands := false
+	if ws.setupError == nil && config.HasPathFilters(action, *triggerEvent) {
+		ok, err := config.MatchesChangedFiles(action, *triggerEvent, ws.changedFiles)
+		if err != nil {
+			ws.setupError = status.InvalidArgumentErrorf("invalid path filters for action %q: %s", action.Name, err)
+		} else if !ok {
+			skipCommands = true
+		}
+	}
 
 	cic := &bespb.ChildInvocationsConfigured{}
 	cicEvent := &bespb.BuildEvent{
@@ -754,7 +769,7 @@ func (ar *actionRunner) Run(ctx context.Context, ws *workspace) error {
 	// will execute the configured bazel commands. Otherwise, the runner will
 	// exit early without running those commands and does not need to create
 	// invocation streams for them.
-	if ws.setupError == nil {
+	if ws.setupError == nil && !skipCommands {
 		for _, bazelCmd := range action.BazelCommands {
 			iid, err := newUUID()
 			if err != nil {
@@ -810,6 +825,10 @@ func (ar *actionRunner) Run(ctx context.Context, ws *workspace) error {
 	if ws.setupError != nil {
 		return ws.setupError
 	}
+	if skipCommands {
+		ar.reporter.Printf("%sNo changed files match the path filters for this action; skipping.%s\n", ansiGray, ansiReset)
+		return nil
+	}
 
 	for i, bazelCmd := range action.BazelCommands {
 		cmdStartTime := time.Now()
@@ -1474,6 +1493,13 @@ func (ws *workspace) sync(ctx context.Context) error {
 	// workflow can pick up any changes not yet incorporated into the pushed branch.
 	if *pushedRepoURL != "" && (*pushedRepoURL != *targetRepoURL || *pushedBranch != *targetBranch) {
 		targetRef := fmt.Sprintf("%s/%s", gitRemoteName(*targetRepoURL), *targetBranch)
+		// Before merging, record the files changed on the pushed branch since
+		// it diverged from the target branch.
+		if out, err := git(ctx, io.Discard, "diff", "--name-only", targetRef+"...HEAD"); err != nil {
+			log.Warningf("Failed to compute changed files: %s", err)
+		} else {
+			ws.changedFiles = splitLines(out)
+		}
 		if _, err := git(ctx, ws.log, "merge", "--no-edit", targetRef); err != nil && !isAlreadyUpToDate(err) {
 			errMsg := err.Output
 			if _, err := git(ctx, ws.log, "merge", "--abort"); err != nil {
@@ -1607,6 +1633,17 @@ func git(ctx context.Context, out io.Writer, args ...string) (string, *gitError)
 	return strings.TrimSpace(output), nil
 }
 
+// splitLines splits command output into non-empty lines.
+func splitLines(s string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
 func writeCommandSummary(out io.Writer, format string, args ...interface{}) {
 	io.WriteString(out, ansiGray)
 	io.WriteString(out, fmt.Sprintf(format, args...))
@@ -147,6 +147,10 @@ func GetConfiguredEnvironmentOrDie(healthChecker *healthcheck.HealthChecker) env
 }
 
 func main() {
+	// This must run before anything else, since the executor binary is
+	// re-executed to run commands in the linux sandbox.
+	maybeRunSandboxInit()
+
 	setUmask()
 
 	rootContext := context.Background()
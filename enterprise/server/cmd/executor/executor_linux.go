@@ -7,11 +7,18 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/linux_sandbox"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/podman"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/networking"
 )
 
+// maybeRunSandboxInit sets up the sandbox and runs the sandboxed command if the
+// executor binary was started by the linux sandbox.
+func maybeRunSandboxInit() {
+	linux_sandbox.MaybeRunInit()
+}
+
 func setupNetworking(rootContext context.Context) {
 	// Clean up net namespaces in case vestiges remain from a previous executor.
 	if !networking.PreserveExistingNetNamespaces() {
@@ -4,5 +4,8 @@ package main
 
 import "context"
 
+func maybeRunSandboxInit() {
+}
+
 func setupNetworking(rootContext context.Context) {
 }
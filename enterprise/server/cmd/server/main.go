@@ -5,6 +5,7 @@ import (
 	"flag"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/api"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/api_key_expiry"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auditlog"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auth"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/authdb"
@@ -31,10 +32,12 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/invocation_search_service"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/invocation_stat_service"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/iprules"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/log_search"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/quota"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/execution_server"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/scheduler_server"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/task_router"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scim"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/secrets"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/selfauth"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/sociartifactstore"
@@ -46,6 +49,8 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/dsingleflight"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/github"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/janitor"
@@ -113,6 +118,7 @@ func convertToProdOrDie(ctx context.Context, env *real_environment.RealEnv) {
 	env.SetGitProviders([]interfaces.GitProvider{
 		github.NewProvider(),
 		bitbucket.NewProvider(),
+		gitlab.NewProvider(),
 	})
 	if err := githubapp.Register(env); err != nil {
 		log.Fatalf("Failed to register GitHub app: %s", err)
@@ -183,6 +189,9 @@ func main() {
 	if err := usage.RegisterTracker(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := usage_service.RegisterMonthlyReports(realEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
 
 	if err := quota.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
@@ -239,6 +248,9 @@ func main() {
 	if err := suggestion.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := log_search.Register(realEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
 	if err := crypter_service.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -254,6 +266,9 @@ func main() {
 	if err := auditlog.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := api_key_expiry.Register(realEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
 
 	if err := iprules.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
@@ -272,13 +287,17 @@ func main() {
 	telemetryClient.Start()
 	defer telemetryClient.Stop()
 
-	invocationCleanupService := janitor.NewInvocationJanitor(realEnv)
+	invocationCleanupService := janitor.NewInvocationJanitor(realEnv, build_event_handler.DeleteInvocationBlobs)
 	invocationCleanupService.Start()
 	defer invocationCleanupService.Stop()
 	executionCleanupService := janitor.NewExecutionJanitor(realEnv)
 	executionCleanupService.Start()
 	defer executionCleanupService.Stop()
 
+	if err := scim.Register(realEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	if err := selfauth.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -15,6 +15,7 @@ import (
 
 	mrand "math/rand"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/kms"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
@@ -890,6 +891,38 @@ func buildKeyURI(kmsConfig *enpb.KMSConfig) (string, error) {
 		}
 		return fmt.Sprintf("aws-kms://%s", ac.GetKeyArn()), nil
 	}
+	if vc := kmsConfig.GetVaultKmsConfig(); vc != nil {
+		mountPath := strings.Trim(strings.TrimSpace(vc.GetMountPath()), "/")
+		if mountPath == "" {
+			return "", status.InvalidArgumentError("Mount Path is required")
+		}
+		keyName := strings.TrimSpace(vc.GetKeyName())
+		if keyName == "" {
+			return "", status.InvalidArgumentError("Key Name is required")
+		}
+		if strings.Contains(keyName, "/") {
+			return "", status.InvalidArgumentError("Key Name must not contain '/'")
+		}
+		uri := fmt.Sprintf("vault-transit://%s/keys/%s", mountPath, keyName)
+		if err := kms.ValidateKeyURI(uri); err != nil {
+			return "", err
+		}
+		return uri, nil
+	}
+	if azc := kmsConfig.GetAzureKmsConfig(); azc != nil {
+		keyID := strings.TrimSpace(azc.GetKeyId())
+		if keyID == "" {
+			return "", status.InvalidArgumentError("Key ID is required")
+		}
+		if !strings.HasPrefix(keyID, "https://") {
+			return "", status.InvalidArgumentError("Key ID must be an https:// URL")
+		}
+		uri := fmt.Sprintf("azure-kv://%s", strings.TrimSuffix(strings.TrimPrefix(keyID, "https://"), "/"))
+		if err := kms.ValidateKeyURI(uri); err != nil {
+			return "", err
+		}
+		return uri, nil
+	}
 
 	return "", status.FailedPreconditionError("KMS config is empty")
 }
@@ -1060,6 +1093,10 @@ func (c *Crypter) GetEncryptionConfig(ctx context.Context, req *enpb.GetEncrypti
 			rsp.SupportedKms = append(rsp.SupportedKms, enpb.KMS_GCP)
 		case interfaces.KMSTypeAWS:
 			rsp.SupportedKms = append(rsp.SupportedKms, enpb.KMS_AWS)
+		case interfaces.KMSTypeVault:
+			rsp.SupportedKms = append(rsp.SupportedKms, enpb.KMS_VAULT)
+		case interfaces.KMSTypeAzure:
+			rsp.SupportedKms = append(rsp.SupportedKms, enpb.KMS_AZURE)
 		default:
 			log.Warningf("unknown KMS type %q", t)
 		}
@@ -860,3 +860,78 @@ func TestKeyReencryption(t *testing.T) {
 	testDecryption(user1Ctx, t, crypter, user1EncData, user1EncMD, user1Data)
 	testDecryption(user2Ctx, t, crypter, user2EncData, user2EncMD, user2Data)
 }
+
+func TestBuildKeyURI(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  *enpb.KMSConfig
+		wantURI string
+		wantErr bool
+	}{
+		{
+			name:    "local insecure",
+			config:  &enpb.KMSConfig{LocalInsecureKmsConfig: &enpb.LocalInsecureKMSConfig{KeyId: "my-key"}},
+			wantURI: "local-insecure-kms://my-key",
+		},
+		{
+			name:    "vault",
+			config:  &enpb.KMSConfig{VaultKmsConfig: &enpb.VaultKMSConfig{MountPath: "/team/transit/", KeyName: "my-key"}},
+			wantURI: "vault-transit://team/transit/keys/my-key",
+		},
+		{
+			name:    "vault missing key name",
+			config:  &enpb.KMSConfig{VaultKmsConfig: &enpb.VaultKMSConfig{MountPath: "transit"}},
+			wantErr: true,
+		},
+		{
+			name:    "vault key name with slash",
+			config:  &enpb.KMSConfig{VaultKmsConfig: &enpb.VaultKMSConfig{MountPath: "transit", KeyName: "a/b"}},
+			wantErr: true,
+		},
+		{
+			name:    "azure",
+			config:  &enpb.KMSConfig{AzureKmsConfig: &enpb.AzureKMSConfig{KeyId: "https://my-vault.vault.azure.net/keys/my-key/"}},
+			wantURI: "azure-kv://my-vault.vault.azure.net/keys/my-key",
+		},
+		{
+			name:    "vault mount path traversal",
+			config:  &enpb.KMSConfig{VaultKmsConfig: &enpb.VaultKMSConfig{MountPath: "transit/../sys", KeyName: "my-key"}},
+			wantErr: true,
+		},
+		{
+			name:    "vault mount path with query",
+			config:  &enpb.KMSConfig{VaultKmsConfig: &enpb.VaultKMSConfig{MountPath: "transit?x=y", KeyName: "my-key"}},
+			wantErr: true,
+		},
+		{
+			name:    "vault key name traversal",
+			config:  &enpb.KMSConfig{VaultKmsConfig: &enpb.VaultKMSConfig{MountPath: "transit", KeyName: ".."}},
+			wantErr: true,
+		},
+		{
+			name:    "azure non key vault host",
+			config:  &enpb.KMSConfig{AzureKmsConfig: &enpb.AzureKMSConfig{KeyId: "https://attacker.example.com/keys/my-key"}},
+			wantErr: true,
+		},
+		{
+			name:    "azure not https",
+			config:  &enpb.KMSConfig{AzureKmsConfig: &enpb.AzureKMSConfig{KeyId: "http://my-vault.vault.azure.net/keys/my-key"}},
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			config:  &enpb.KMSConfig{},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			uri, err := buildKeyURI(tc.config)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.wantURI, uri)
+		})
+	}
+}
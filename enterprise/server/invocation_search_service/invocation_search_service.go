@@ -188,8 +188,76 @@ func addPermissionsCheckToQuery(u interfaces.UserInfo, q *query_builder.Query) {
 	q.AddWhereClause("("+orQuery+")", orArgs...)
 }
 
+func hasTargetFilters(req *inpb.SearchInvocationRequest) bool {
+	return len(req.GetQuery().GetTargetLabel()) > 0 || len(req.GetQuery().GetTargetStatus()) > 0
+}
+
 func (s *InvocationSearchService) shouldQueryClickhouse(req *inpb.SearchInvocationRequest) bool {
-	return s.olapdbh != nil && *olapInvocationSearchEnabled && (len(req.GetQuery().GetTags()) > 0 || len(req.GetQuery().GetFilter()) > 0)
+	return s.olapdbh != nil && *olapInvocationSearchEnabled && (len(req.GetQuery().GetTags()) > 0 || len(req.GetQuery().GetFilter()) > 0 || hasTargetFilters(req))
+}
+
+// targetLabelClause returns a clause matching the test target labels that
+// match the given label, which may end in a "/..." or ":all" wildcard.
+func targetLabelClause(label string) (string, []interface{}) {
+	if repo, ok := strings.CutSuffix(label, "..."); ok && strings.HasSuffix(repo, "//") {
+		// "//..." matches every target in the repo.
+		return "startsWith(label, ?)", []interface{}{repo}
+	}
+	if pkg, ok := strings.CutSuffix(label, "/..."); ok {
+		// "//foo/..." matches "//foo:bar" as well as "//foo/baz:qux".
+		return "(startsWith(label, ?) OR startsWith(label, ?))", []interface{}{pkg + ":", pkg + "/"}
+	}
+	for _, suffix := range []string{":all", ":*"} {
+		if pkg, ok := strings.CutSuffix(label, suffix); ok {
+			return "startsWith(label, ?)", []interface{}{pkg + ":"}
+		}
+	}
+	return "label = ?", []interface{}{label}
+}
+
+// buildTargetQuery returns a query selecting the UUIDs of invocations with test
+// targets matching the target filters in the request.
+func buildTargetQuery(req *inpb.SearchInvocationRequest) (*query_builder.Query, error) {
+	q := query_builder.NewQuery(`SELECT invocation_uuid FROM "TestTargetStatuses"`)
+	// These are the table's sort keys, so filtering on them when possible
+	// avoids scanning statuses from other groups and repos.
+	if groupID := req.GetQuery().GetGroupId(); groupID != "" {
+		q.AddWhereClause("group_id = ?", groupID)
+	}
+	if url := req.GetQuery().GetRepoUrl(); url != "" {
+		q.AddWhereClause("repo_url = ?", url)
+	}
+	if sha := req.GetQuery().GetCommitSha(); sha != "" {
+		q.AddWhereClause("commit_sha = ?", sha)
+	}
+	// Invocations start before they're last updated, so the outer query's
+	// upper bound on the update time also bounds the invocation start time.
+	// The lower bound doesn't carry over, since an invocation updated within
+	// the range may have started before it.
+	if end := req.GetQuery().GetUpdatedBefore(); end.IsValid() {
+		q.AddWhereClause("invocation_start_time_usec < ?", end.AsTime().UnixMicro())
+	}
+
+	labelClauses := query_builder.OrClauses{}
+	for _, label := range req.GetQuery().GetTargetLabel() {
+		if !strings.HasPrefix(label, "//") && !strings.HasPrefix(label, "@") {
+			return nil, status.InvalidArgumentErrorf("Invalid target label %q: labels must be absolute", label)
+		}
+		clause, args := targetLabelClause(label)
+		labelClauses.AddOr(clause, args...)
+	}
+	if labelQuery, labelArgs := labelClauses.Build(); labelQuery != "" {
+		q.AddWhereClause("("+labelQuery+")", labelArgs...)
+	}
+
+	statusClauses := query_builder.OrClauses{}
+	for _, s := range req.GetQuery().GetTargetStatus() {
+		statusClauses.AddOr("status = ?", int32(s))
+	}
+	if statusQuery, statusArgs := statusClauses.Build(); statusQuery != "" {
+		q.AddWhereClause("("+statusQuery+")", statusArgs...)
+	}
+	return q, nil
 }
 
 func addOrderBy(sort *inpb.InvocationSort, q *query_builder.Query) {
@@ -302,6 +370,18 @@ func (s *InvocationSearchService) buildPrimaryQuery(ctx context.Context, fields
 		}
 	}
 
+	if hasTargetFilters(req) {
+		// Target statuses are only stored in the OLAP DB.
+		if !s.shouldQueryClickhouse(req) {
+			return "", nil, status.UnimplementedError("Searching by target requires OLAP invocation search to be enabled")
+		}
+		targetQuery, err := buildTargetQuery(req)
+		if err != nil {
+			return "", nil, err
+		}
+		q.AddWhereInClause("i.invocation_uuid", targetQuery)
+	}
+
 	statusClauses := query_builder.OrClauses{}
 	for _, status := range req.GetQuery().GetStatus() {
 		switch status {
@@ -0,0 +1,143 @@
+package invocation_search_service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testolapdb"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+func TestTargetLabelClause(t *testing.T) {
+	for _, tc := range []struct {
+		label      string
+		wantClause string
+		wantArgs   []interface{}
+	}{
+		{
+			label:      "//foo:bar",
+			wantClause: "label = ?",
+			wantArgs:   []interface{}{"//foo:bar"},
+		},
+		{
+			label:      "//foo/...",
+			wantClause: "(startsWith(label, ?) OR startsWith(label, ?))",
+			wantArgs:   []interface{}{"//foo:", "//foo/"},
+		},
+		{
+			label:      "//...",
+			wantClause: "startsWith(label, ?)",
+			wantArgs:   []interface{}{"//"},
+		},
+		{
+			label:      "@repo//...",
+			wantClause: "startsWith(label, ?)",
+			wantArgs:   []interface{}{"@repo//"},
+		},
+		{
+			label:      "//foo:all",
+			wantClause: "startsWith(label, ?)",
+			wantArgs:   []interface{}{"//foo:"},
+		},
+		{
+			label:      "@repo//foo:*",
+			wantClause: "startsWith(label, ?)",
+			wantArgs:   []interface{}{"@repo//foo:"},
+		},
+	} {
+		t.Run(tc.label, func(t *testing.T) {
+			clause, args := targetLabelClause(tc.label)
+			require.Equal(t, tc.wantClause, clause)
+			require.Equal(t, tc.wantArgs, args)
+		})
+	}
+}
+
+func TestBuildTargetQuery(t *testing.T) {
+	before := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	q, err := buildTargetQuery(&inpb.SearchInvocationRequest{
+		Query: &inpb.InvocationQuery{
+			GroupId:       "GR1",
+			UpdatedAfter:  timestamppb.New(before.Add(-24 * time.Hour)),
+			UpdatedBefore: timestamppb.New(before),
+			TargetLabel:   []string{"//foo/...", "//bar:all"},
+			TargetStatus:  []bespb.TestStatus{bespb.TestStatus_FAILED, bespb.TestStatus_FLAKY},
+		},
+	})
+	require.NoError(t, err)
+	qStr, args := q.Build()
+	require.Contains(t, qStr, "group_id = ?")
+	require.Contains(t, qStr, "invocation_start_time_usec < ?")
+	require.Contains(t, qStr, "(startsWith(label, ?) OR startsWith(label, ?)) OR startsWith(label, ?)")
+	require.Contains(t, qStr, "status = ? OR status = ?")
+	require.Equal(t, []interface{}{
+		"GR1",
+		before.UnixMicro(),
+		"//foo:", "//foo/", "//bar:",
+		int32(bespb.TestStatus_FAILED), int32(bespb.TestStatus_FLAKY),
+	}, args)
+
+	// Invocations updated after the lower bound may have started before it,
+	// so it isn't applied to the invocation start time.
+	q, err = buildTargetQuery(&inpb.SearchInvocationRequest{
+		Query: &inpb.InvocationQuery{
+			GroupId:      "GR1",
+			UpdatedAfter: timestamppb.New(before),
+			TargetStatus: []bespb.TestStatus{bespb.TestStatus_FAILED},
+		},
+	})
+	require.NoError(t, err)
+	qStr, _ = q.Build()
+	require.NotContains(t, qStr, "invocation_start_time_usec")
+}
+
+func TestBuildTargetQuery_RejectsRelativeLabels(t *testing.T) {
+	for _, label := range []string{":foo", "foo:bar", "foo/...", "...", ""} {
+		_, err := buildTargetQuery(&inpb.SearchInvocationRequest{
+			Query: &inpb.InvocationQuery{
+				GroupId:     "GR1",
+				TargetLabel: []string{"//ok:target", label},
+			},
+		})
+		require.True(t, status.IsInvalidArgumentError(err), "label %q: expected InvalidArgument; got: %v", label, err)
+	}
+}
+
+func TestQueryInvocations_TargetFiltersRequireOLAP(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ta := testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1"))
+	te.SetAuthenticator(ta)
+	ctx, err := ta.WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+
+	for _, query := range []*inpb.InvocationQuery{
+		{GroupId: "GR1", TargetLabel: []string{"//foo:bar"}},
+		{GroupId: "GR1", TargetStatus: []bespb.TestStatus{bespb.TestStatus_FAILED}},
+	} {
+		// Without an OLAP DB.
+		s := NewInvocationSearchService(te, te.GetDBHandle(), nil /*=olapDBHandle*/)
+		_, err := s.QueryInvocations(ctx, &inpb.SearchInvocationRequest{Query: query})
+		require.True(t, status.IsUnimplementedError(err), "expected Unimplemented; got: %v", err)
+
+		// With an OLAP DB, but with OLAP invocation search disabled.
+		flags.Set(t, "app.olap_invocation_search_enabled", false)
+		s = NewInvocationSearchService(te, te.GetDBHandle(), testolapdb.NewHandle())
+		_, err = s.QueryInvocations(ctx, &inpb.SearchInvocationRequest{Query: query})
+		require.True(t, status.IsUnimplementedError(err), "expected Unimplemented; got: %v", err)
+		flags.Set(t, "app.olap_invocation_search_enabled", true)
+	}
+
+	// Other searches still work without an OLAP DB.
+	s := NewInvocationSearchService(te, te.GetDBHandle(), nil /*=olapDBHandle*/)
+	_, err = s.QueryInvocations(ctx, &inpb.SearchInvocationRequest{Query: &inpb.InvocationQuery{GroupId: "GR1"}})
+	require.NoError(t, err)
+}
@@ -0,0 +1,144 @@
+package invocation_search_service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clickhouse/schema"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
+	"github.com/stretchr/testify/require"
+
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+type targetSearchEnv struct {
+	te   *testenv.TestEnv
+	ctx  context.Context
+	repo string
+	s    *InvocationSearchService
+	rows []*schema.TestTargetStatus
+}
+
+func newTargetSearchEnv(t *testing.T) *targetSearchEnv {
+	te := testenv.GetTestEnv(t)
+	ta := testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2"))
+	te.SetAuthenticator(ta)
+	ctx, err := ta.WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	// Use a unique repo so that invocations written by other tests sharing
+	// the same ClickHouse server don't affect the results.
+	repo := "https://github.com/acme/repo-" + strings.ReplaceAll(uuid.New(), "-", "")
+	return &targetSearchEnv{
+		te:   te,
+		ctx:  ctx,
+		repo: repo,
+		s:    NewInvocationSearchService(te, te.GetDBHandle(), te.GetOLAPDBHandle()),
+	}
+}
+
+// addInvocation writes an invocation to both the primary DB and the OLAP DB,
+// along with the statuses of the given test targets, and returns its ID.
+func (e *targetSearchEnv) addInvocation(t *testing.T, groupID string, targets map[string]bespb.TestStatus) string {
+	iid := uuid.New()
+	iidBytes, err := uuid.StringToBytes(iid)
+	require.NoError(t, err)
+	ti := &tables.Invocation{
+		InvocationID:   iid,
+		InvocationUUID: iidBytes,
+		GroupID:        groupID,
+		RepoURL:        e.repo,
+		Perms:          perms.GROUP_READ,
+	}
+	err = e.te.GetDBHandle().DB(e.ctx).Create(ti).Error
+	require.NoError(t, err)
+	err = e.te.GetOLAPDBHandle().FlushInvocationStats(context.Background(), ti)
+	require.NoError(t, err)
+	for label, s := range targets {
+		e.rows = append(e.rows, &schema.TestTargetStatus{
+			GroupID:                 groupID,
+			RepoURL:                 e.repo,
+			Label:                   label,
+			InvocationUUID:          strings.ReplaceAll(iid, "-", ""),
+			RuleType:                "go_test",
+			TargetType:              1,
+			TestSize:                1,
+			Status:                  int32(s),
+			InvocationStartTimeUsec: ti.CreatedAtUsec,
+		})
+	}
+	return iid
+}
+
+func (e *targetSearchEnv) flush(t *testing.T) {
+	err := e.te.GetOLAPDBHandle().FlushTestTargetStatuses(context.Background(), e.rows)
+	require.NoError(t, err)
+	e.rows = nil
+}
+
+func (e *targetSearchEnv) search(t *testing.T, labels []string, statuses []bespb.TestStatus) []string {
+	rsp, err := e.s.QueryInvocations(e.ctx, &inpb.SearchInvocationRequest{
+		Query: &inpb.InvocationQuery{
+			GroupId:      "GR1",
+			RepoUrl:      e.repo,
+			TargetLabel:  labels,
+			TargetStatus: statuses,
+		},
+	})
+	require.NoError(t, err)
+	var ids []string
+	for _, in := range rsp.GetInvocation() {
+		ids = append(ids, in.GetInvocationId())
+	}
+	return ids
+}
+
+func TestQueryInvocations_TargetFilters(t *testing.T) {
+	e := newTargetSearchEnv(t)
+	iid1 := e.addInvocation(t, "GR1", map[string]bespb.TestStatus{
+		"//foo:test":     bespb.TestStatus_PASSED,
+		"//foo/bar:test": bespb.TestStatus_FAILED,
+	})
+	iid2 := e.addInvocation(t, "GR1", map[string]bespb.TestStatus{
+		"//baz:test": bespb.TestStatus_FAILED,
+	})
+	iid3 := e.addInvocation(t, "GR1", map[string]bespb.TestStatus{
+		"//foo:other": bespb.TestStatus_FLAKY,
+	})
+	// Other groups' invocations are never returned.
+	e.addInvocation(t, "GR2", map[string]bespb.TestStatus{
+		"//foo:test": bespb.TestStatus_FAILED,
+	})
+	// Invocations without any test targets are never returned.
+	e.addInvocation(t, "GR1", nil)
+	e.flush(t)
+
+	for _, tc := range []struct {
+		name     string
+		labels   []string
+		statuses []bespb.TestStatus
+		want     []string
+	}{
+		{name: "AllTargets", labels: []string{"//..."}, want: []string{iid1, iid2, iid3}},
+		{name: "Subpackages", labels: []string{"//foo/..."}, want: []string{iid1, iid3}},
+		{name: "Package", labels: []string{"//foo:all"}, want: []string{iid1, iid3}},
+		{name: "Label", labels: []string{"//foo/bar:test"}, want: []string{iid1}},
+		{name: "MultipleLabels", labels: []string{"//foo/bar:test", "//baz:test"}, want: []string{iid1, iid2}},
+		{name: "NoMatch", labels: []string{"//qux/..."}, want: nil},
+		{name: "Status", statuses: []bespb.TestStatus{bespb.TestStatus_FAILED}, want: []string{iid1, iid2}},
+		{name: "MultipleStatuses", statuses: []bespb.TestStatus{bespb.TestStatus_FAILED, bespb.TestStatus_FLAKY}, want: []string{iid1, iid2, iid3}},
+		{name: "LabelAndStatus", labels: []string{"//foo/..."}, statuses: []bespb.TestStatus{bespb.TestStatus_FAILED}, want: []string{iid1}},
+		// The label and status must match the same target: //foo:test passed,
+		// and only //foo/bar:test failed.
+		{name: "LabelAndStatusOfDifferentTargets", labels: []string{"//foo:all"}, statuses: []bespb.TestStatus{bespb.TestStatus_FAILED}, want: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.ElementsMatch(t, tc.want, e.search(t, tc.labels, tc.statuses))
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auditlog"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
@@ -187,9 +188,23 @@ func (s *Service) authorize(ctx context.Context, groupID string) error {
 	metrics.IPRulesCheckLatencyUsec.With(
 		prometheus.Labels{metrics.StatusHumanReadableLabel: status.MetricsLabel(err)},
 	).Observe(float64(time.Since(start).Microseconds()))
+	if status.IsPermissionDeniedError(err) {
+		s.logDenial(ctx, groupID)
+	}
 	return err
 }
 
+// logDenial audit logs a request that was denied by the IP rules of the given
+// group.
+func (s *Service) logDenial(ctx context.Context, groupID string) {
+	p := &interfaces.AuditLogPrincipal{GroupID: groupID}
+	if u, err := perms.AuthenticatedUser(ctx, s.env); err == nil {
+		p.UserID = u.GetUserID()
+		p.APIKeyID = u.GetAPIKeyID()
+	}
+	auditlog.LogAccessDenied(ctx, s.env, p)
+}
+
 func (s *Service) AuthorizeGroup(ctx context.Context, groupID string) error {
 	g, err := s.env.GetUserDB().GetGroupByID(ctx, groupID)
 	if err != nil {
@@ -7,9 +7,11 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/iprules"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
 	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
 	irpb "github.com/buildbuddy-io/buildbuddy/proto/iprules"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauditlog"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/util/clientip"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -143,3 +145,58 @@ func TestEnforcement(t *testing.T) {
 	require.Error(t, err)
 	require.True(t, status.IsPermissionDeniedError(err))
 }
+
+func TestDenialsAreAuditLogged(t *testing.T) {
+	env := enterprise_testenv.New(t)
+	enterprise_testauth.Configure(t, env)
+	al := testauditlog.New(t)
+	env.SetAuditLogger(al)
+	ctx := context.Background()
+
+	u := enterprise_testauth.CreateRandomUser(t, env, "org1.invalid")
+	g := u.Groups[0].Group
+	groupID := g.GroupID
+
+	irs := newIPRulesService(t, env)
+	auther := env.GetAuthenticator().(*testauth.TestAuthenticator)
+	authCtx, err := auther.WithAuthenticatedUser(ctx, u.UserID)
+	require.NoError(t, err)
+
+	_, err = irs.AddRule(authCtx, &irpb.AddRuleRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		Rule:           &irpb.IPRule{Cidr: "1.2.3.0/24", Description: "rule1"},
+	})
+	require.NoError(t, err)
+	g.EnforceIPRules = true
+	urlIdentifier := "foo"
+	g.URLIdentifier = &urlIdentifier
+	_, err = env.GetUserDB().InsertOrUpdateGroup(authCtx, &g)
+	require.NoError(t, err)
+	authCtx, err = auther.WithAuthenticatedUser(ctx, u.UserID)
+	require.NoError(t, err)
+	al.Reset()
+
+	// Allowed requests are not logged.
+	err = irs.Authorize(context.WithValue(authCtx, clientip.ContextKey, "1.2.3.4"))
+	require.NoError(t, err)
+	require.Empty(t, al.GetAllEntries())
+
+	// Repeated denials for the same client are only logged once.
+	deniedCtx := context.WithValue(authCtx, clientip.ContextKey, "5.6.7.8")
+	for i := 0; i < 3; i++ {
+		err = irs.Authorize(deniedCtx)
+		require.True(t, status.IsPermissionDeniedError(err))
+	}
+	require.Len(t, al.GetAllEntries(), 1)
+	e := al.GetAllEntries()[0]
+	require.Equal(t, alpb.Action_ACCESS_DENIED, e.Action)
+	require.Equal(t, alpb.ResourceType_GROUP, e.Resource.GetType())
+	require.Equal(t, groupID, e.Resource.GetId())
+	require.Equal(t, groupID, e.Principal.GroupID)
+	require.Equal(t, u.UserID, e.Principal.UserID)
+
+	// Denials for another client are logged separately.
+	err = irs.Authorize(context.WithValue(authCtx, clientip.ContextKey, "5.6.7.9"))
+	require.True(t, status.IsPermissionDeniedError(err))
+	require.Len(t, al.GetAllEntries(), 2)
+}
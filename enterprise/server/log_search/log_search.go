@@ -0,0 +1,392 @@
+package log_search
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/chunkstore"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/janitor"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clickhouse"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clickhouse/schema"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
+	"github.com/jonboulle/clockwork"
+
+	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
+)
+
+var (
+	enableLogSearch = flag.Bool("app.enable_build_log_search", false, "If true, build logs are indexed in the OLAP DB so that they can be searched. Requires olap_database to be configured. Indexed logs are kept for storage.ttl_seconds, or forever if invocations may be kept forever.")
+)
+
+const (
+	// The number of log chunks that can be waiting to be indexed. Chunks
+	// written while the queue is full are not indexed.
+	indexQueueSize = 1000
+
+	// The number of goroutines writing log lines to the OLAP DB.
+	numIndexWorkers = 4
+
+	// Lines longer than this are truncated before being indexed.
+	maxLineLength = 4096
+
+	// The minimum length of a search query. Shorter queries can't make use of
+	// the n-gram index, so they'd have to scan every log line.
+	minQueryLength = 4
+
+	// The max number of matching lines returned per invocation.
+	maxMatchesPerInvocation = 5
+
+	defaultPageSize      = 20
+	maxPageSize          = 100
+	pageSizeOffsetPrefix = "offset_"
+)
+
+// Matches ANSI escape sequences, such as those used to color build output.
+var ansiEscapeRegexp = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
+type indexTask struct {
+	groupID        string
+	invocationUUID string
+	chunkIndex     uint16
+	eventTimeUsec  int64
+	chunk          []byte
+}
+
+// LogIndexer writes build log lines to the OLAP DB as log chunks are
+// written, and searches them using an n-gram index.
+type LogIndexer struct {
+	env   environment.Env
+	clock clockwork.Clock
+
+	tasks chan *indexTask
+	wg    sync.WaitGroup
+}
+
+func Register(env environment.Env) error {
+	if !*enableLogSearch {
+		return nil
+	}
+	if env.GetOLAPDBHandle() == nil {
+		return status.FailedPreconditionError("Build log search requires olap_database to be configured")
+	}
+	if err := setLogLineTTL(env.GetServerContext(), env.GetOLAPDBHandle(), janitor.MaxInvocationTTL()); err != nil {
+		return status.InternalErrorf("set build log TTL: %s", err)
+	}
+	li := New(env, clockwork.NewRealClock())
+	li.Start()
+	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		li.Stop()
+		return nil
+	})
+	env.SetLogIndexer(li)
+	return nil
+}
+
+// logLineTTLExpr returns the TTL expression that expires log lines ttl after
+// they were indexed, formatted as ClickHouse shows it in the table definition.
+func logLineTTLExpr(ttl time.Duration) string {
+	return fmt.Sprintf("toDateTime(intDiv(event_time_usec, 1000000)) + toIntervalSecond(%d)", int64(ttl.Seconds()))
+}
+
+// setLogLineTTL makes the OLAP DB drop indexed log lines once the invocations
+// that they belong to may have been deleted, so that the index doesn't grow
+// forever. A zero TTL keeps log lines forever, like invocations.
+func setLogLineTTL(ctx context.Context, olapDBH interfaces.OLAPDBHandle, ttl time.Duration) error {
+	table := (&schema.LogLine{}).TableName()
+	var engine string
+	err := olapDBH.DB(ctx).Raw(`SELECT engine_full FROM system.tables WHERE database = currentDatabase() AND name = ?`, table).Scan(&engine).Error
+	if err != nil {
+		return err
+	}
+	// Changing the TTL rewrites the existing data, so only do it if the TTL
+	// has changed.
+	var stmt string
+	if ttl > 0 {
+		expr := logLineTTLExpr(ttl)
+		if strings.Contains(engine, expr) {
+			return nil
+		}
+		stmt = fmt.Sprintf(`ALTER TABLE "%s" MODIFY TTL %s`, table, expr)
+	} else if strings.Contains(engine, " TTL ") {
+		stmt = fmt.Sprintf(`ALTER TABLE "%s" REMOVE TTL`, table)
+	} else {
+		return nil
+	}
+	return olapDBH.DB(ctx).Exec(stmt).Error
+}
+
+func New(env environment.Env, clock clockwork.Clock) *LogIndexer {
+	return &LogIndexer{
+		env:   env,
+		clock: clock,
+		tasks: make(chan *indexTask, indexQueueSize),
+	}
+}
+
+func (li *LogIndexer) Start() {
+	for i := 0; i < numIndexWorkers; i++ {
+		li.wg.Add(1)
+		go func() {
+			defer li.wg.Done()
+			for task := range li.tasks {
+				li.index(task)
+			}
+		}()
+	}
+}
+
+// Stop waits for queued chunks to be indexed. IndexLogChunk must not be
+// called after Stop.
+func (li *LogIndexer) Stop() {
+	close(li.tasks)
+	li.wg.Wait()
+}
+
+func (li *LogIndexer) IndexLogChunk(ctx context.Context, groupID, invocationID string, chunkIndex uint16, chunk []byte) {
+	invocationUUID := strings.ReplaceAll(invocationID, "-", "")
+	task := &indexTask{
+		groupID:        groupID,
+		invocationUUID: invocationUUID,
+		chunkIndex:     chunkIndex,
+		eventTimeUsec:  li.clock.Now().UnixMicro(),
+		// The chunk is owned by the caller, so make a copy for the worker.
+		chunk: bytes.Clone(chunk),
+	}
+	select {
+	case li.tasks <- task:
+	default:
+		log.CtxWarningf(ctx, "Build log index queue is full; not indexing chunk %d of invocation %s", chunkIndex, invocationID)
+	}
+}
+
+func (li *LogIndexer) index(task *indexTask) {
+	ctx := li.env.GetServerContext()
+	lines := logLines(task.chunk)
+	entries := make([]*schema.LogLine, 0, len(lines))
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		entries = append(entries, &schema.LogLine{
+			GroupID:        task.groupID,
+			EventTimeUsec:  task.eventTimeUsec,
+			InvocationUUID: task.invocationUUID,
+			ChunkIndex:     task.chunkIndex,
+			LineNumber:     uint32(i),
+			Line:           line,
+		})
+	}
+	if err := li.env.GetOLAPDBHandle().FlushLogLines(ctx, entries); err != nil {
+		log.CtxWarningf(ctx, "Failed to index build log chunk: %s", err)
+	}
+}
+
+// logLines splits a log chunk into lines, removing ANSI escape sequences and
+// truncating long lines.
+func logLines(chunk []byte) []string {
+	text := strings.TrimSuffix(string(chunk), "\n")
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		line = ansiEscapeRegexp.ReplaceAllString(line, "")
+		line = strings.TrimSuffix(line, "\r")
+		lines[i] = truncate(line, maxLineLength)
+	}
+	return lines
+}
+
+// truncate truncates s to at most n bytes without splitting a UTF-8 encoded
+// character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// likePattern returns a LIKE pattern matching strings that contain s.
+func likePattern(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(s) + "%"
+}
+
+func computeOffsetAndLimit(req *elpb.SearchLogsRequest) (int64, int64, error) {
+	offset := int64(0)
+	if token := req.GetPageToken(); token != "" {
+		s, ok := strings.CutPrefix(token, pageSizeOffsetPrefix)
+		if !ok {
+			return 0, 0, status.InvalidArgumentError("Invalid pagination token")
+		}
+		var err error
+		if offset, err = strconv.ParseInt(s, 10, 64); err != nil || offset < 0 {
+			return 0, 0, status.InvalidArgumentError("Error parsing pagination token")
+		}
+	}
+	limit := int64(defaultPageSize)
+	if req.GetCount() > 0 {
+		limit = min(int64(req.GetCount()), maxPageSize)
+	}
+	return offset, limit, nil
+}
+
+func (li *LogIndexer) SearchLogs(ctx context.Context, req *elpb.SearchLogsRequest) (*elpb.SearchLogsResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, li.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	if utf8.RuneCountInString(req.GetQuery()) < minQueryLength {
+		return nil, status.InvalidArgumentErrorf("Search query must be at least %d characters long", minQueryLength)
+	}
+	offset, limit, err := computeOffsetAndLimit(req)
+	if err != nil {
+		return nil, err
+	}
+	pattern := likePattern(req.GetQuery())
+
+	// Find the invocations with the most recently written matching lines.
+	q := query_builder.NewQuery(`SELECT invocation_uuid, max(event_time_usec) AS latest_event_time_usec FROM "LogLines"`)
+	q.AddWhereClause("group_id = ?", groupID)
+	q.AddWhereClause("line LIKE ?", pattern)
+	if start := req.GetStartTime(); start.IsValid() {
+		q.AddWhereClause("event_time_usec >= ?", start.AsTime().UnixMicro())
+	}
+	if end := req.GetEndTime(); end.IsValid() {
+		q.AddWhereClause("event_time_usec < ?", end.AsTime().UnixMicro())
+	}
+	q.SetGroupBy("invocation_uuid")
+	q.SetOrderBy("latest_event_time_usec DESC, invocation_uuid", true /*=ascending*/)
+	q.SetLimit(limit)
+	q.SetOffset(offset)
+	qStr, qArgs := q.Build()
+	rows, err := li.env.GetOLAPDBHandle().RawWithOptions(ctx, clickhouse.Opts().WithQueryName("search_build_logs"), qStr, qArgs...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var invocationUUIDs []string
+	for rows.Next() {
+		var invocationUUID string
+		var latestEventTimeUsec int64
+		if err := rows.Scan(&invocationUUID, &latestEventTimeUsec); err != nil {
+			return nil, err
+		}
+		invocationUUIDs = append(invocationUUIDs, invocationUUID)
+	}
+
+	rsp := &elpb.SearchLogsResponse{}
+	if int64(len(invocationUUIDs)) == limit {
+		rsp.NextPageToken = pageSizeOffsetPrefix + strconv.FormatInt(offset+limit, 10)
+	}
+	if len(invocationUUIDs) == 0 {
+		return rsp, nil
+	}
+
+	matches, err := li.getMatchingLines(ctx, groupID, invocationUUIDs, pattern)
+	if err != nil {
+		return nil, err
+	}
+	readable, err := li.readableInvocations(ctx, invocationUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, invocationUUID := range invocationUUIDs {
+		invocationID, err := uuid.Base64StringToString(invocationUUID)
+		if err != nil {
+			return nil, err
+		}
+		// Group members may not be able to read some of the group's
+		// invocations, e.g. if they are owned by another user.
+		if !readable[invocationID] {
+			continue
+		}
+		rsp.Result = append(rsp.Result, &elpb.LogSearchResult{
+			InvocationId: invocationID,
+			Match:        matches[invocationUUID],
+		})
+	}
+	return rsp, nil
+}
+
+// getMatchingLines returns the first few matching lines for each invocation.
+func (li *LogIndexer) getMatchingLines(ctx context.Context, groupID string, invocationUUIDs []string, pattern string) (map[string][]*elpb.LogSearchMatch, error) {
+	rows, err := li.env.GetOLAPDBHandle().RawWithOptions(ctx, clickhouse.Opts().WithQueryName("search_build_logs_matches"), `
+		SELECT invocation_uuid, chunk_index, line_number, line
+		FROM "LogLines"
+		WHERE group_id = ? AND invocation_uuid IN ? AND line LIKE ?
+		ORDER BY invocation_uuid, chunk_index, line_number
+		LIMIT ? BY invocation_uuid`,
+		groupID, invocationUUIDs, pattern, maxMatchesPerInvocation,
+	).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	matches := make(map[string][]*elpb.LogSearchMatch, len(invocationUUIDs))
+	for rows.Next() {
+		var invocationUUID, line string
+		var chunkIndex uint16
+		var lineNumber uint32
+		if err := rows.Scan(&invocationUUID, &chunkIndex, &lineNumber, &line); err != nil {
+			return nil, err
+		}
+		matches[invocationUUID] = append(matches[invocationUUID], &elpb.LogSearchMatch{
+			ChunkId:    chunkstore.ChunkIndexAsStringId(chunkIndex),
+			LineNumber: int32(lineNumber),
+			Line:       line,
+		})
+	}
+	return matches, nil
+}
+
+// readableInvocations returns the IDs of the given invocations that the
+// authenticated user is allowed to read.
+func (li *LogIndexer) readableInvocations(ctx context.Context, invocationUUIDs []string) (map[string]bool, error) {
+	invocationIDs := make([]string, 0, len(invocationUUIDs))
+	for _, invocationUUID := range invocationUUIDs {
+		invocationID, err := uuid.Base64StringToString(invocationUUID)
+		if err != nil {
+			return nil, err
+		}
+		invocationIDs = append(invocationIDs, invocationID)
+	}
+	q := query_builder.NewQuery(`SELECT invocation_id FROM "Invocations" AS i`)
+	q.AddWhereClause("i.invocation_id IN ?", invocationIDs)
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, li.env, q, "i"); err != nil {
+		return nil, err
+	}
+	qStr, qArgs := q.Build()
+	rows, err := li.env.GetDBHandle().RawWithOptions(ctx, db.Opts().WithQueryName("search_build_logs_perms"), qStr, qArgs...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	readable := make(map[string]bool, len(invocationIDs))
+	for rows.Next() {
+		var invocationID string
+		if err := rows.Scan(&invocationID); err != nil {
+			return nil, err
+		}
+		readable[invocationID] = true
+	}
+	return readable, nil
+}
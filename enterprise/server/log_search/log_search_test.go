@@ -0,0 +1,64 @@
+package log_search
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
+)
+
+func TestLogLines(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		chunk string
+		want  []string
+	}{
+		{"empty", "", nil},
+		{"single line", "hello", []string{"hello"}},
+		{"trailing newline", "hello\nworld\n", []string{"hello", "world"}},
+		{"blank lines", "a\n\nb", []string{"a", "", "b"}},
+		{"carriage return", "a\r\nb\r\n", []string{"a", "b"}},
+		{"ansi colors", "\x1b[32mINFO:\x1b[0m Build completed\n\x1b[1A\x1b[K", []string{"INFO: Build completed", ""}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, logLines([]byte(tc.chunk)))
+		})
+	}
+}
+
+func TestLogLinesTruncatesLongLines(t *testing.T) {
+	// Each "é" is 2 bytes, so the line can't be truncated at exactly
+	// maxLineLength bytes without splitting a character.
+	line := "x" + strings.Repeat("é", maxLineLength)
+	lines := logLines([]byte(line))
+	require.Len(t, lines, 1)
+	assert.Equal(t, maxLineLength-1, len(lines[0]))
+	assert.True(t, strings.HasPrefix(line, lines[0]))
+}
+
+func TestLikePattern(t *testing.T) {
+	assert.Equal(t, "%error: %", likePattern("error: "))
+	assert.Equal(t, `%100\% done%`, likePattern("100% done"))
+	assert.Equal(t, `%foo\_bar%`, likePattern("foo_bar"))
+	assert.Equal(t, `%C:\\path%`, likePattern(`C:\path`))
+}
+
+func TestComputeOffsetAndLimit(t *testing.T) {
+	offset, limit, err := computeOffsetAndLimit(&elpb.SearchLogsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), offset)
+	assert.Equal(t, int64(defaultPageSize), limit)
+
+	offset, limit, err = computeOffsetAndLimit(&elpb.SearchLogsRequest{PageToken: "offset_40", Count: 1000})
+	require.NoError(t, err)
+	assert.Equal(t, int64(40), offset)
+	assert.Equal(t, int64(maxPageSize), limit)
+
+	for _, token := range []string{"40", "offset_", "offset_-1", "offset_abc"} {
+		_, _, err = computeOffsetAndLimit(&elpb.SearchLogsRequest{PageToken: token})
+		assert.Error(t, err, "token %q", token)
+	}
+}
@@ -0,0 +1,177 @@
+package log_search
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+
+	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
+)
+
+type searchEnv struct {
+	te    *testenv.TestEnv
+	ctx   context.Context
+	clock *clockwork.FakeClock
+	li    *LogIndexer
+	// A string that's unique to the test, so that log lines written by other
+	// tests sharing the same ClickHouse server don't match the searches.
+	needle string
+}
+
+func newSearchEnv(t *testing.T) *searchEnv {
+	te := testenv.GetTestEnv(t)
+	ta := testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR1", "US3", "GR2"))
+	te.SetAuthenticator(ta)
+	ctx, err := ta.WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	clock := clockwork.NewFakeClockAt(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	return &searchEnv{
+		te:     te,
+		ctx:    ctx,
+		clock:  clock,
+		li:     New(te, clock),
+		needle: "needle-" + strings.ReplaceAll(uuid.New(), "-", ""),
+	}
+}
+
+// addInvocation creates an invocation owned by the given user and group,
+// indexes the given log chunks for it, and returns its ID.
+func (e *searchEnv) addInvocation(t *testing.T, userID, groupID string, p int32, chunks ...string) string {
+	iid := uuid.New()
+	err := e.te.GetDBHandle().DB(e.ctx).Create(&tables.Invocation{
+		InvocationID: iid,
+		UserID:       userID,
+		GroupID:      groupID,
+		Perms:        p,
+	}).Error
+	require.NoError(t, err)
+	for i, chunk := range chunks {
+		e.li.index(&indexTask{
+			groupID:        groupID,
+			invocationUUID: strings.ReplaceAll(iid, "-", ""),
+			chunkIndex:     uint16(i),
+			eventTimeUsec:  e.clock.Now().UnixMicro(),
+			chunk:          []byte(chunk),
+		})
+	}
+	e.clock.Advance(time.Minute)
+	return iid
+}
+
+func (e *searchEnv) search(t *testing.T, pageToken string, count int32) *elpb.SearchLogsResponse {
+	rsp, err := e.li.SearchLogs(e.ctx, &elpb.SearchLogsRequest{
+		RequestContext: testauth.RequestContext("US1", "GR1"),
+		Query:          e.needle,
+		PageToken:      pageToken,
+		Count:          count,
+	})
+	require.NoError(t, err)
+	return rsp
+}
+
+func resultIDs(rsp *elpb.SearchLogsResponse) []string {
+	var ids []string
+	for _, r := range rsp.GetResult() {
+		ids = append(ids, r.GetInvocationId())
+	}
+	return ids
+}
+
+func TestSearchLogs(t *testing.T) {
+	e := newSearchEnv(t)
+	iid1 := e.addInvocation(t, "US1", "GR1", perms.GROUP_READ,
+		"INFO: Build started\nERROR: "+e.needle+" failed\n",
+		"no match here\n\x1b[31mERROR:\x1b[0m "+e.needle+" again\n",
+	)
+	iid2 := e.addInvocation(t, "US2", "GR1", perms.GROUP_READ, "WARNING: "+e.needle+"\n")
+	// Doesn't match.
+	e.addInvocation(t, "US1", "GR1", perms.GROUP_READ, "INFO: Build completed successfully\n")
+
+	rsp := e.search(t, "", 0)
+	// The invocation with the most recently indexed match comes first.
+	require.Equal(t, []string{iid2, iid1}, resultIDs(rsp))
+	require.Empty(t, rsp.GetNextPageToken())
+	matches := rsp.GetResult()[1].GetMatch()
+	require.Len(t, matches, 2)
+	require.Equal(t, "0000", matches[0].GetChunkId())
+	require.Equal(t, int32(1), matches[0].GetLineNumber())
+	require.Equal(t, "ERROR: "+e.needle+" failed", matches[0].GetLine())
+	require.Equal(t, "0001", matches[1].GetChunkId())
+	require.Equal(t, int32(1), matches[1].GetLineNumber())
+	require.Equal(t, "ERROR: "+e.needle+" again", matches[1].GetLine())
+}
+
+func TestSearchLogs_ExcludesUnreadableInvocations(t *testing.T) {
+	e := newSearchEnv(t)
+	iid := e.addInvocation(t, "US1", "GR1", perms.GROUP_READ, e.needle+"\n")
+	// Another group's invocation.
+	e.addInvocation(t, "US3", "GR2", perms.GROUP_READ, e.needle+"\n")
+	// A private invocation of another member of the group.
+	e.addInvocation(t, "US2", "GR1", perms.OWNER_READ, e.needle+"\n")
+	// The user's own private invocation.
+	privateIID := e.addInvocation(t, "US1", "GR1", perms.OWNER_READ, e.needle+"\n")
+
+	rsp := e.search(t, "", 0)
+	require.Equal(t, []string{privateIID, iid}, resultIDs(rsp))
+}
+
+func TestSearchLogs_Pagination(t *testing.T) {
+	e := newSearchEnv(t)
+	var iids []string
+	for i := 0; i < 5; i++ {
+		iids = append(iids, e.addInvocation(t, "US1", "GR1", perms.GROUP_READ, e.needle+"\n"))
+	}
+
+	var got []string
+	pageToken := ""
+	for page := 0; ; page++ {
+		require.Less(t, page, 3, "too many pages")
+		rsp := e.search(t, pageToken, 2)
+		got = append(got, resultIDs(rsp)...)
+		pageToken = rsp.GetNextPageToken()
+		if pageToken == "" {
+			break
+		}
+	}
+	require.Equal(t, []string{iids[4], iids[3], iids[2], iids[1], iids[0]}, got)
+
+	_, err := e.li.SearchLogs(e.ctx, &elpb.SearchLogsRequest{
+		RequestContext: testauth.RequestContext("US1", "GR1"),
+		Query:          e.needle,
+		PageToken:      "bogus",
+	})
+	require.Error(t, err)
+}
+
+func TestSetLogLineTTL(t *testing.T) {
+	e := newSearchEnv(t)
+	olapDBH := e.te.GetOLAPDBHandle()
+	engine := func() string {
+		var engine string
+		err := olapDBH.DB(e.ctx).Raw(`SELECT engine_full FROM system.tables WHERE database = currentDatabase() AND name = 'LogLines'`).Scan(&engine).Error
+		require.NoError(t, err)
+		return engine
+	}
+	t.Cleanup(func() {
+		require.NoError(t, setLogLineTTL(context.Background(), olapDBH, 0))
+	})
+
+	ttl := 50 * 365 * 24 * time.Hour
+	require.NoError(t, setLogLineTTL(e.ctx, olapDBH, ttl))
+	require.Contains(t, engine(), "TTL "+logLineTTLExpr(ttl))
+	// Setting the same TTL again is a no-op.
+	require.NoError(t, setLogLineTTL(e.ctx, olapDBH, ttl))
+
+	require.NoError(t, setLogLineTTL(e.ctx, olapDBH, 0))
+	require.NotContains(t, engine(), " TTL ")
+	require.NoError(t, setLogLineTTL(e.ctx, olapDBH, 0))
+}
@@ -11,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auditlog"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/gcplink"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/selfauth"
 	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/build_buddy_url"
@@ -507,6 +508,9 @@ func (a *OpenIDAuthenticator) AuthContextFromTrustedJWT(ctx context.Context, jwt
 func (a *OpenIDAuthenticator) claimsFromAPIKey(ctx context.Context, apiKey string) (*claims.Claims, error) {
 	akg, err := a.lookupAPIKeyGroupFromAPIKey(ctx, apiKey)
 	if err != nil {
+		if apiKey != "" && status.IsUnauthenticatedError(err) {
+			auditlog.LogAuthenticationFailure(ctx, a.env)
+		}
 		return nil, err
 	}
 	return claims.APIKeyGroupClaims(akg), nil
@@ -515,6 +519,9 @@ func (a *OpenIDAuthenticator) claimsFromAPIKey(ctx context.Context, apiKey strin
 func (a *OpenIDAuthenticator) claimsFromAPIKeyID(ctx context.Context, apiKeyID string) (*claims.Claims, error) {
 	akg, err := a.lookupAPIKeyGroupFromAPIKeyID(ctx, apiKeyID)
 	if err != nil {
+		if apiKeyID != "" && status.IsUnauthenticatedError(err) {
+			auditlog.LogAuthenticationFailure(ctx, a.env)
+		}
 		return nil, err
 	}
 	return claims.APIKeyGroupClaims(akg), nil
@@ -825,6 +832,25 @@ func (a *OpenIDAuthenticator) Logout(w http.ResponseWriter, r *http.Request) err
 }
 
 func (a *OpenIDAuthenticator) Auth(w http.ResponseWriter, r *http.Request) error {
+	// Lookup issuer from the cookie we set in /login.
+	issuer := cookie.GetCookie(r, cookie.AuthIssuerCookie)
+	if gcplink.IsLinkRequest(r) {
+		issuer = gcplink.Issuer
+	}
+	auth := a.getAuthConfig(issuer)
+
+	err := a.auth(w, r, issuer, auth)
+	if err != nil && !gcplink.IsLinkRequest(r) {
+		slug := ""
+		if auth != nil {
+			slug = auth.getSlug()
+		}
+		auditlog.LogLoginFailure(r.Context(), a.env, slug)
+	}
+	return err
+}
+
+func (a *OpenIDAuthenticator) auth(w http.ResponseWriter, r *http.Request, issuer string, auth authenticator) error {
 	ctx := r.Context()
 
 	authDB := a.env.GetAuthDB()
@@ -842,12 +868,6 @@ func (a *OpenIDAuthenticator) Auth(w http.ResponseWriter, r *http.Request) error
 		return status.PermissionDeniedErrorf("Authenticator returned error: %s (%s %s)", authError, r.URL.Query().Get("error_desc"), r.URL.Query().Get("error_description"))
 	}
 
-	// Lookup issuer from the cookie we set in /login.
-	issuer := cookie.GetCookie(r, cookie.AuthIssuerCookie)
-	if gcplink.IsLinkRequest(r) {
-		issuer = gcplink.Issuer
-	}
-	auth := a.getAuthConfig(issuer)
 	if auth == nil {
 		return status.PermissionDeniedErrorf("No config found for issuer: %s", issuer)
 	}
@@ -901,6 +921,7 @@ func (a *OpenIDAuthenticator) Auth(w http.ResponseWriter, r *http.Request) error
 	if err := authDB.InsertOrUpdateUserSession(ctx, sessionID, sesh); err != nil {
 		return err
 	}
+	auditlog.LogLogin(ctx, a.env, ut.GetSubID(), ut.Email)
 	redirURL := cookie.GetCookie(r, cookie.RedirCookie)
 	if redirURL == "" {
 		redirURL = "/" // default to redirecting home.
@@ -20,8 +20,10 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/quota"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
 	"github.com/throttled/throttled/v2"
 	"github.com/throttled/throttled/v2/store/goredisstore.v8"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/protobuf/types/known/durationpb"
 
 	qpb "github.com/buildbuddy-io/buildbuddy/proto/quota"
@@ -261,27 +263,36 @@ type QuotaManager struct {
 	namespaces    sync.Map // map of string namespace name -> *namespace
 	bucketCreator bucketCreatorFn
 	ps            interfaces.PubSub
+	clock         timeutil.Clock
+	storageQuotas sync.Map // map of string group ID -> *tables.StorageQuota
+	storageUsage  sync.Map // map of string group ID -> *storageUsage
+	// Deduplicates concurrent storage usage refreshes for the same group.
+	storageUsageRefresh singleflight.Group
 	// Streams an event after each successful reload.
 	// For testing only.
 	reloaded chan struct{}
 }
 
 func NewQuotaManager(env environment.Env, ps interfaces.PubSub) (*QuotaManager, error) {
-	return newQuotaManager(env, ps, createGCRABucket)
+	return newQuotaManager(env, ps, createGCRABucket, timeutil.NewClock())
 }
 
-func newQuotaManager(env environment.Env, ps interfaces.PubSub, bucketCreator bucketCreatorFn) (*QuotaManager, error) {
+func newQuotaManager(env environment.Env, ps interfaces.PubSub, bucketCreator bucketCreatorFn, clock timeutil.Clock) (*QuotaManager, error) {
 	qm := &QuotaManager{
 		env:           env,
 		namespaces:    sync.Map{},
 		bucketCreator: bucketCreator,
 		ps:            ps,
+		clock:         clock,
 		reloaded:      make(chan struct{}, 1),
 	}
 	err := qm.reloadNamespaces()
 	if err != nil {
 		return nil, err
 	}
+	if err := qm.reloadStorageQuotas(); err != nil {
+		return nil, err
+	}
 
 	qm.listenForUpdates(env.GetServerContext())
 
@@ -569,6 +580,10 @@ func (qm *QuotaManager) listenForUpdates(ctx context.Context) {
 				alert.UnexpectedEvent("quota-cannot-reload", " quota manager failed to reload configs: %s", err)
 				continue
 			}
+			if err := qm.reloadStorageQuotas(); err != nil {
+				alert.UnexpectedEvent("quota-cannot-reload", " quota manager failed to reload storage quotas: %s", err)
+				continue
+			}
 			select {
 			case qm.reloaded <- struct{}{}:
 			default:
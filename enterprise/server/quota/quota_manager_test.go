@@ -10,8 +10,12 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/pubsub"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testclock"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/assert"
@@ -119,7 +123,7 @@ func TestQuotaManagerFindBucket(t *testing.T) {
 	result = db.Create(quotaGroup)
 	require.NoError(t, result.Error)
 
-	qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket)
+	qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket, timeutil.NewClock())
 	require.NoError(t, err)
 
 	testCases := []struct {
@@ -183,7 +187,7 @@ func TestGetNamespace(t *testing.T) {
 	result = db.Create(quotaGroup)
 	require.NoError(t, result.Error)
 
-	qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket)
+	qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket, timeutil.NewClock())
 	require.NoError(t, err)
 
 	testCases := []struct {
@@ -332,7 +336,7 @@ func TestModifyNamespace_AddBucket(t *testing.T) {
 		},
 	}
 	for _, tc := range testCases {
-		qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket)
+		qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket, timeutil.NewClock())
 		require.NoError(t, err)
 		t.Run(tc.name, func(t *testing.T) {
 			_, err := qm.ModifyNamespace(ctx, tc.req)
@@ -416,7 +420,7 @@ func TestModifyNamespace_UpdateBucket(t *testing.T) {
 		},
 	}
 	for _, tc := range testCases {
-		qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket)
+		qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket, timeutil.NewClock())
 		require.NoError(t, err)
 		t.Run(tc.name, func(t *testing.T) {
 			_, err := qm.ModifyNamespace(ctx, tc.req)
@@ -525,7 +529,7 @@ func TestModifyNamespace_RemoveBucket(t *testing.T) {
 		},
 	}
 	for _, tc := range testCases {
-		qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket)
+		qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket, timeutil.NewClock())
 		require.NoError(t, err)
 		t.Run(tc.name, func(t *testing.T) {
 			_, err := qm.ModifyNamespace(ctx, tc.req)
@@ -604,7 +608,7 @@ func TestRemoveNamespace(t *testing.T) {
 	result = db.Create(&quotaGroups)
 	require.NoError(t, result.Error)
 
-	qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket)
+	qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket, timeutil.NewClock())
 	require.NoError(t, err)
 
 	_, err = qm.RemoveNamespace(ctx, &qpb.RemoveNamespaceRequest{
@@ -795,7 +799,7 @@ func TestQuotaManagerApplyBucket(t *testing.T) {
 		},
 	}
 	for _, tc := range testCases {
-		qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket)
+		qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket, timeutil.NewClock())
 		require.NoError(t, err)
 		t.Run(tc.name, func(t *testing.T) {
 			_, err := qm.ApplyBucket(ctx, tc.req)
@@ -819,3 +823,128 @@ func TestQuotaManagerApplyBucket(t *testing.T) {
 	}
 
 }
+
+func TestAllowStorage(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	ta := testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2"))
+	env.SetAuthenticator(ta)
+	ctx := context.Background()
+
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	clock := testclock.StartingAt(now)
+
+	db := env.GetDBHandle().DB(ctx)
+	err := db.Create(&tables.StorageQuota{
+		GroupID:              "GR1",
+		MaxUploadBytesPerDay: 1000,
+		MaxRetainedCASBytes:  5000,
+	}).Error
+	require.NoError(t, err)
+	usages := []*tables.Usage{
+		// Uploaded yesterday; only counts towards retained bytes.
+		{
+			GroupID:         "GR1",
+			PeriodStartUsec: now.Add(-24 * time.Hour).UnixMicro(),
+			UsageCounts:     tables.UsageCounts{TotalUploadSizeBytes: 3500, CASStoredSizeBytes: 3500},
+		},
+		// Uploaded today. Only 300 of these bytes were new CAS blobs; the
+		// rest were AC uploads or blobs that already existed, which don't
+		// count towards retained bytes.
+		{
+			GroupID:         "GR1",
+			PeriodStartUsec: now.Add(-1 * time.Hour).UnixMicro(),
+			UsageCounts:     tables.UsageCounts{TotalUploadSizeBytes: 500, CASStoredSizeBytes: 300},
+		},
+		// Uploaded outside of the retention window.
+		{
+			GroupID:         "GR1",
+			PeriodStartUsec: now.Add(-60 * 24 * time.Hour).UnixMicro(),
+			UsageCounts:     tables.UsageCounts{TotalUploadSizeBytes: 1_000_000, CASStoredSizeBytes: 1_000_000},
+		},
+	}
+	err = db.Create(&usages).Error
+	require.NoError(t, err)
+
+	qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket, clock)
+	require.NoError(t, err)
+
+	gr1Ctx, err := ta.WithAuthenticatedUser(ctx, "US1")
+	require.NoError(t, err)
+	gr2Ctx, err := ta.WithAuthenticatedUser(ctx, "US2")
+	require.NoError(t, err)
+
+	// GR1 has 500 bytes left today.
+	err = qm.AllowStorage(gr1Ctx, 400)
+	require.NoError(t, err)
+	err = qm.AllowStorage(gr1Ctx, 200)
+	require.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted, got %v", err)
+	err = qm.AllowStorage(gr1Ctx, 100)
+	require.NoError(t, err)
+
+	// Groups without a storage quota and anonymous users are not limited.
+	require.True(t, qm.HasStorageQuota(gr1Ctx))
+	require.False(t, qm.HasStorageQuota(gr2Ctx))
+	require.False(t, qm.HasStorageQuota(ctx))
+	err = qm.AllowStorage(gr2Ctx, 1_000_000)
+	require.NoError(t, err)
+	err = qm.AllowStorage(ctx, 1_000_000)
+	require.NoError(t, err)
+
+	// The daily quota resets at the start of the next day, but the retained
+	// bytes quota still applies: 3800 bytes were retained, plus the 500 bytes
+	// allowed above, which have since been flushed to the DB.
+	clock.Set(now.Add(12 * time.Hour))
+	err = db.Create(&tables.Usage{
+		GroupID:         "GR1",
+		PeriodStartUsec: now.UnixMicro(),
+		UsageCounts:     tables.UsageCounts{TotalUploadSizeBytes: 500, CASStoredSizeBytes: 500},
+	}).Error
+	require.NoError(t, err)
+	err = qm.AllowStorage(gr1Ctx, 700)
+	require.NoError(t, err)
+	err = qm.AllowStorage(gr1Ctx, 1)
+	require.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted, got %v", err)
+}
+
+func TestSetStorageQuota(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	adb, err := authdb.NewAuthDB(env, env.GetDBHandle())
+	require.NoError(t, err)
+	env.SetAuthDB(adb)
+	udb, err := userdb.NewUserDB(env, env.GetDBHandle())
+	require.NoError(t, err)
+	env.SetUserDB(udb)
+	ctx := context.Background()
+
+	err = env.GetDBHandle().DB(ctx).Create(&tables.Group{GroupID: "GR1"}).Error
+	require.NoError(t, err)
+
+	qm, err := newQuotaManager(env, pubsub.NewTestPubSub(), createTestBucket, timeutil.NewClock())
+	require.NoError(t, err)
+
+	_, err = qm.SetStorageQuota(ctx, &qpb.SetStorageQuotaRequest{
+		GroupId:      "GR2",
+		StorageQuota: &qpb.StorageQuota{MaxUploadBytesPerDay: 100},
+	})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument for unknown group, got %v", err)
+
+	_, err = qm.SetStorageQuota(ctx, &qpb.SetStorageQuotaRequest{
+		GroupId:      "GR1",
+		StorageQuota: &qpb.StorageQuota{MaxUploadBytesPerDay: -1},
+	})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument for negative limit, got %v", err)
+
+	sq := &qpb.StorageQuota{MaxUploadBytesPerDay: 100, MaxRetainedCasBytes: 200}
+	_, err = qm.SetStorageQuota(ctx, &qpb.SetStorageQuotaRequest{GroupId: "GR1", StorageQuota: sq})
+	require.NoError(t, err)
+	rsp, err := qm.GetStorageQuota(ctx, &qpb.GetStorageQuotaRequest{GroupId: "GR1"})
+	require.NoError(t, err)
+	assert.Empty(t, cmp.Diff(sq, rsp.GetStorageQuota(), protocmp.Transform()))
+
+	// Setting an empty quota removes it.
+	_, err = qm.SetStorageQuota(ctx, &qpb.SetStorageQuotaRequest{GroupId: "GR1"})
+	require.NoError(t, err)
+	rsp, err = qm.GetStorageQuota(ctx, &qpb.GetStorageQuotaRequest{GroupId: "GR1"})
+	require.NoError(t, err)
+	assert.Nil(t, rsp.GetStorageQuota())
+}
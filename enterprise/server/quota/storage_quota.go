@@ -0,0 +1,289 @@
+package quota
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	qpb "github.com/buildbuddy-io/buildbuddy/proto/quota"
+)
+
+var (
+	storageQuotaRetentionWindow = flag.Duration("app.storage_quota_retention_window", 30*24*time.Hour, "Uploads within this window are counted towards a group's retained CAS bytes quota. Should roughly match how long data is retained in the cache.")
+)
+
+const (
+	// How long storage usage fetched from the DB is used before it is
+	// fetched again. Usage data is flushed to the DB about once per minute,
+	// so there's no point in fetching it more often than that.
+	storageUsageRefreshInterval = 1 * time.Minute
+)
+
+// storageUsage holds the storage usage counted towards a group's storage
+// quota.
+type storageUsage struct {
+	mu sync.Mutex
+
+	fetchedAt        time.Time
+	uploadBytesToday int64
+	retainedCASBytes int64
+
+	// The number of bytes allowed since usage was last fetched. Usage data
+	// is only periodically flushed to the DB, so these are added to the
+	// fetched counts to avoid letting a group blow through its quota
+	// in between refreshes.
+	pendingBytes int64
+}
+
+func storageQuotaToProto(from *tables.StorageQuota) *qpb.StorageQuota {
+	return &qpb.StorageQuota{
+		MaxUploadBytesPerDay: from.MaxUploadBytesPerDay,
+		MaxRetainedCasBytes:  from.MaxRetainedCASBytes,
+	}
+}
+
+func validateStorageQuota(sq *qpb.StorageQuota) error {
+	if sq.GetMaxUploadBytesPerDay() < 0 {
+		return status.InvalidArgumentErrorf("storage_quota.max_upload_bytes_per_day(%d) must be non-negative", sq.GetMaxUploadBytesPerDay())
+	}
+	if sq.GetMaxRetainedCasBytes() < 0 {
+		return status.InvalidArgumentErrorf("storage_quota.max_retained_cas_bytes(%d) must be non-negative", sq.GetMaxRetainedCasBytes())
+	}
+	return nil
+}
+
+func (qm *QuotaManager) reloadStorageQuotas() error {
+	if qm.env.GetDBHandle() == nil {
+		return status.FailedPreconditionError("quota manager is not configured")
+	}
+	ctx := qm.env.GetServerContext()
+	rows, err := qm.env.GetDBHandle().DB(ctx).Raw(`SELECT * FROM "StorageQuotas"`).Rows()
+	if err != nil {
+		return status.InternalErrorf("failed to read table StorageQuotas: %s", err)
+	}
+	defer rows.Close()
+
+	quotas := make(map[string]*tables.StorageQuota)
+	for rows.Next() {
+		sq := &tables.StorageQuota{}
+		if err := qm.env.GetDBHandle().DB(ctx).ScanRows(rows, sq); err != nil {
+			return status.InternalErrorf("failed to scan StorageQuotas: %s", err)
+		}
+		quotas[sq.GroupID] = sq
+	}
+	for groupID, sq := range quotas {
+		qm.storageQuotas.Store(groupID, sq)
+	}
+	qm.storageQuotas.Range(func(k, v interface{}) bool {
+		groupID := k.(string)
+		if _, ok := quotas[groupID]; !ok {
+			qm.storageQuotas.Delete(groupID)
+			qm.storageUsage.Delete(groupID)
+		}
+		return true
+	})
+	return nil
+}
+
+// fetchStorageUsage returns the number of bytes uploaded by the group since
+// the start of the current UTC day, as well as the size of new CAS blobs stored
+// within the retention window, based on the flushed usage counters.
+func (qm *QuotaManager) fetchStorageUsage(ctx context.Context, groupID string, now time.Time) (uploadBytesToday int64, retainedCASBytes int64, err error) {
+	dayStart := now.UTC().Truncate(24 * time.Hour)
+	retentionStart := now.Add(-*storageQuotaRetentionWindow)
+	earliest := dayStart
+	if retentionStart.Before(earliest) {
+		earliest = retentionStart
+	}
+	row := &struct {
+		UploadBytesToday int64
+		RetainedCASBytes int64
+	}{}
+	err = qm.env.GetDBHandle().DB(ctx).Raw(`
+		SELECT
+			COALESCE(SUM(CASE WHEN period_start_usec >= ? THEN total_upload_size_bytes ELSE 0 END), 0) AS upload_bytes_today,
+			COALESCE(SUM(CASE WHEN period_start_usec >= ? THEN cas_stored_size_bytes ELSE 0 END), 0) AS retained_cas_bytes
+		FROM "Usages"
+		WHERE group_id = ? AND period_start_usec >= ?`,
+		dayStart.UnixMicro(), retentionStart.UnixMicro(), groupID, earliest.UnixMicro(),
+	).Take(row).Error
+	if err != nil {
+		return 0, 0, status.InternalErrorf("failed to read storage usage: %s", err)
+	}
+	return row.UploadBytesToday, row.RetainedCASBytes, nil
+}
+
+// getStorageUsage returns the storage usage for the group, refreshing it from
+// the DB if needed. The returned usage is locked, and must be unlocked by the
+// caller.
+func (qm *QuotaManager) getStorageUsage(ctx context.Context, groupID string) (*storageUsage, error) {
+	v, _ := qm.storageUsage.LoadOrStore(groupID, &storageUsage{})
+	u := v.(*storageUsage)
+	u.mu.Lock()
+	now := qm.clock.Now()
+	dayChanged := !u.fetchedAt.IsZero() && u.fetchedAt.UTC().Truncate(24*time.Hour) != now.UTC().Truncate(24*time.Hour)
+	needsRefresh := u.fetchedAt.IsZero() || dayChanged || now.Sub(u.fetchedAt) >= storageUsageRefreshInterval
+	u.mu.Unlock()
+
+	if needsRefresh {
+		// Don't hold the lock while reading from the DB, so that uploads for
+		// the group aren't all blocked on a slow query, and only let one
+		// caller refresh at a time.
+		_, err, _ := qm.storageUsageRefresh.Do(groupID, func() (interface{}, error) {
+			return nil, qm.refreshStorageUsage(ctx, groupID, u, now)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	u.mu.Lock()
+	return u, nil
+}
+
+// refreshStorageUsage fetches the group's usage from the DB and stores it in
+// u.
+func (qm *QuotaManager) refreshStorageUsage(ctx context.Context, groupID string, u *storageUsage, now time.Time) error {
+	u.mu.Lock()
+	pendingAtStart := u.pendingBytes
+	u.mu.Unlock()
+
+	uploadBytesToday, retainedCASBytes, err := qm.fetchStorageUsage(ctx, groupID, now)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if now.Before(u.fetchedAt) {
+		return nil
+	}
+	u.fetchedAt = now
+	u.uploadBytesToday = uploadBytesToday
+	u.retainedCASBytes = retainedCASBytes
+	// Bytes allowed while the query was running may not be reflected in the
+	// fetched usage yet, so keep counting them.
+	u.pendingBytes -= pendingAtStart
+	return nil
+}
+
+// groupStorageQuota returns the ID and storage quota of the group identified
+// from the ctx, or nil if the group has no storage quota.
+func (qm *QuotaManager) groupStorageQuota(ctx context.Context) (string, *tables.StorageQuota) {
+	auth := qm.env.GetAuthenticator()
+	if auth == nil {
+		return "", nil
+	}
+	user, err := auth.AuthenticatedUser(ctx)
+	if err != nil || user.GetGroupID() == "" {
+		// Storage quotas only apply to groups.
+		return "", nil
+	}
+	v, ok := qm.storageQuotas.Load(user.GetGroupID())
+	if !ok {
+		return "", nil
+	}
+	return user.GetGroupID(), v.(*tables.StorageQuota)
+}
+
+func (qm *QuotaManager) HasStorageQuota(ctx context.Context) bool {
+	_, sq := qm.groupStorageQuota(ctx)
+	return sq != nil
+}
+
+func (qm *QuotaManager) AllowStorage(ctx context.Context, sizeBytes int64) error {
+	groupID, sq := qm.groupStorageQuota(ctx)
+	if sq == nil {
+		return nil
+	}
+
+	u, err := qm.getStorageUsage(ctx, groupID)
+	if err != nil {
+		// Like rate limits, fail open if usage can't be determined.
+		log.CtxWarningf(ctx, "Failed to get storage usage for group %q: %s", groupID, err)
+		return nil
+	}
+	defer u.mu.Unlock()
+
+	if limit := sq.MaxUploadBytesPerDay; limit > 0 {
+		if used := u.uploadBytesToday + u.pendingBytes; used+sizeBytes > limit {
+			return status.ResourceExhaustedErrorf("Daily cache upload quota exceeded for group %s: %d of %d bytes used today", groupID, used, limit)
+		}
+	}
+	if limit := sq.MaxRetainedCASBytes; limit > 0 {
+		if used := u.retainedCASBytes + u.pendingBytes; used+sizeBytes > limit {
+			return status.ResourceExhaustedErrorf("Retained CAS bytes quota exceeded for group %s: %d of %d bytes used", groupID, used, limit)
+		}
+	}
+	u.pendingBytes += sizeBytes
+	return nil
+}
+
+func (qm *QuotaManager) GetStorageQuota(ctx context.Context, req *qpb.GetStorageQuotaRequest) (*qpb.GetStorageQuotaResponse, error) {
+	if qm.env.GetDBHandle() == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	if req.GetGroupId() == "" {
+		return nil, status.InvalidArgumentError("group_id cannot be empty")
+	}
+	res := &qpb.GetStorageQuotaResponse{}
+	sq := &tables.StorageQuota{}
+	err := qm.env.GetDBHandle().DB(ctx).Raw(`SELECT * FROM "StorageQuotas" WHERE group_id = ?`, req.GetGroupId()).Take(sq).Error
+	if err != nil && !db.IsRecordNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		res.StorageQuota = storageQuotaToProto(sq)
+	}
+	uploadBytesToday, retainedCASBytes, err := qm.fetchStorageUsage(ctx, req.GetGroupId(), qm.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	res.Usage = &qpb.StorageQuotaUsage{
+		UploadBytesToday: uploadBytesToday,
+		RetainedCasBytes: retainedCASBytes,
+	}
+	return res, nil
+}
+
+func (qm *QuotaManager) SetStorageQuota(ctx context.Context, req *qpb.SetStorageQuotaRequest) (*qpb.SetStorageQuotaResponse, error) {
+	if qm.env.GetDBHandle() == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	if req.GetGroupId() == "" {
+		return nil, status.InvalidArgumentError("group_id cannot be empty")
+	}
+	if err := validateStorageQuota(req.GetStorageQuota()); err != nil {
+		return nil, err
+	}
+	if _, err := qm.env.GetUserDB().GetGroupByID(ctx, req.GetGroupId()); err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid group id: %s", err)
+	}
+
+	sq := req.GetStorageQuota()
+	err := qm.env.GetDBHandle().TransactionWithOptions(ctx, db.Opts().WithQueryName("set_storage_quota"), func(tx *db.DB) error {
+		if err := tx.Exec(`DELETE FROM "StorageQuotas" WHERE group_id = ?`, req.GetGroupId()).Error; err != nil {
+			return err
+		}
+		if sq.GetMaxUploadBytesPerDay() == 0 && sq.GetMaxRetainedCasBytes() == 0 {
+			return nil
+		}
+		return tx.Create(&tables.StorageQuota{
+			GroupID:              req.GetGroupId(),
+			MaxUploadBytesPerDay: sq.GetMaxUploadBytesPerDay(),
+			MaxRetainedCASBytes:  sq.GetMaxRetainedCasBytes(),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	qm.notifyListeners()
+
+	return &qpb.SetStorageQuotaResponse{}, nil
+}
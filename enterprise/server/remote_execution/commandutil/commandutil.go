@@ -47,7 +47,7 @@ var (
 	allDigits = regexp.MustCompile(`^\d+$`)
 )
 
-func constructExecCommand(command *repb.Command, workDir string, stdio *container.Stdio) (*exec.Cmd, *bytes.Buffer, *bytes.Buffer, error) {
+func constructExecCommand(command *repb.Command, workDir string, stdio *container.Stdio, sysProcAttr *syscall.SysProcAttr) (*exec.Cmd, *bytes.Buffer, *bytes.Buffer, error) {
 	if stdio == nil {
 		stdio = &container.Stdio{}
 	}
@@ -88,7 +88,12 @@ func constructExecCommand(command *repb.Command, workDir string, stdio *containe
 		cmd.Stdout = io.MultiWriter(cmd.Stdout, logWriter)
 		cmd.Stderr = io.MultiWriter(cmd.Stderr, logWriter)
 	}
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	attr := syscall.SysProcAttr{}
+	if sysProcAttr != nil {
+		attr = *sysProcAttr
+	}
+	attr.Setpgid = true
+	cmd.SysProcAttr = &attr
 	for _, envVar := range command.GetEnvironmentVariables() {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", envVar.GetName(), envVar.GetValue()))
 	}
@@ -118,6 +123,13 @@ func RetryIfTextFileBusy(fn func() error) error {
 // will be returned in CommandResult.Stats. Note that enabling stats incurs some
 // overhead, so a nil callback should be used if stats aren't needed.
 func Run(ctx context.Context, command *repb.Command, workDir string, statsListener procstats.Listener, stdio *container.Stdio) *interfaces.CommandResult {
+	return RunWithSysProcAttr(ctx, command, workDir, statsListener, stdio, nil /*=sysProcAttr*/)
+}
+
+// RunWithSysProcAttr is like Run, but starts the command with the given OS
+// process attributes. The process is always started in its own process
+// group, so that its process tree can be killed.
+func RunWithSysProcAttr(ctx context.Context, command *repb.Command, workDir string, statsListener procstats.Listener, stdio *container.Stdio, sysProcAttr *syscall.SysProcAttr) *interfaces.CommandResult {
 	var cmd *exec.Cmd
 	var stdoutBuf, stderrBuf *bytes.Buffer
 	var stats *repb.UsageStats
@@ -125,7 +137,7 @@ func Run(ctx context.Context, command *repb.Command, workDir string, statsListen
 	err := RetryIfTextFileBusy(func() error {
 		// Create a new command on each attempt since commands can only be run once.
 		var err error
-		cmd, stdoutBuf, stderrBuf, err = constructExecCommand(command, workDir, stdio)
+		cmd, stdoutBuf, stderrBuf, err = constructExecCommand(command, workDir, stdio, sysProcAttr)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,505 @@
+//go:build linux && !android
+
+package linux_sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rnpb "github.com/buildbuddy-io/buildbuddy/proto/runner"
+)
+
+// This functionality was inspired by linux-sandbox.cc (in bazel).
+//
+// Commands are run by re-executing the current binary inside new user, mount,
+// PID, IPC, UTS and (optionally) network namespaces. The re-executed binary
+// sets up the sandbox filesystem and then execs the command:
+//
+//   - The root filesystem is an empty tmpfs. Only the host's system
+//     directories (see systemPaths) are mounted into it, read-only, so the
+//     executor's own files, such as its filecache, its configuration and the
+//     working directories of other actions, are not visible.
+//   - The working directory, which contains the action's inputs, is mounted
+//     read-only at the same path as on the host. Only the directories that
+//     the command writes its outputs to are writable.
+//   - /dev only contains a few standard devices, /tmp and /dev/shm are
+//     private tmpfs mounts, and /proc only shows the processes in the
+//     sandbox.
+//
+// The command runs as root inside the user namespace, which maps to the
+// executor's user outside of it, but without any capabilities, so that it
+// can't undo the mounts above.
+
+const (
+	// initArg is the first argument passed to the re-executed binary, which
+	// tells it to set up the sandbox instead of running normally.
+	initArg = "__linux_sandbox_init__"
+
+	// Exit code returned by the sandbox init process if the sandbox could not
+	// be set up or the command could not be started.
+	initFailedExitCode = 127
+)
+
+var (
+	// systemPaths are the host paths that are mounted read-only into the
+	// sandbox. Paths that don't exist on the host are skipped.
+	systemPaths = []string{
+		"/bin",
+		"/lib",
+		"/lib32",
+		"/lib64",
+		"/libx32",
+		"/sbin",
+		"/usr",
+		// Only the parts of /etc that are needed to resolve users, hosts
+		// and shared libraries, and to verify TLS certificates.
+		"/etc/alternatives",
+		"/etc/ca-certificates",
+		"/etc/group",
+		"/etc/host.conf",
+		"/etc/hosts",
+		"/etc/ld.so.cache",
+		"/etc/ld.so.conf",
+		"/etc/ld.so.conf.d",
+		"/etc/localtime",
+		"/etc/nsswitch.conf",
+		"/etc/passwd",
+		"/etc/pki",
+		"/etc/resolv.conf",
+		"/etc/ssl",
+	}
+
+	// devices are the host devices that are mounted into the sandbox's /dev.
+	devices = []string{"full", "null", "random", "tty", "urandom", "zero"}
+)
+
+// initConfig is passed from the executor to the sandbox init process.
+type initConfig struct {
+	// WorkDir is the working directory of the command.
+	WorkDir string
+
+	// RootDir is an empty directory on which the sandbox root filesystem is
+	// mounted.
+	RootDir string
+
+	// WritableDirs are the directories that the command can write to. They
+	// are either the working directory itself or directories under it.
+	WritableDirs []string
+
+	// IsolateNetwork specifies whether the command should run in its own
+	// network namespace, in which only the loopback interface is available.
+	IsolateNetwork bool
+}
+
+// Options contains configuration options for the linux sandbox.
+type Options struct {
+	Network string
+
+	// WritableWorkDir makes the whole working directory writable, instead of
+	// only the directories that the command's outputs are written to.
+	WritableWorkDir bool
+}
+
+type Provider struct{}
+
+func (p *Provider) New(ctx context.Context, props *platform.Properties, _ *repb.ScheduledTask, _ *rnpb.RunnerState, _ string) (container.CommandContainer, error) {
+	opts := &Options{
+		Network: props.DockerNetwork,
+		// Persistent workers are started with the command of the first work
+		// request, but write the outputs of all later requests too.
+		WritableWorkDir: props.PersistentWorker || props.PersistentWorkerKey != "",
+	}
+	return New(opts), nil
+}
+
+// linuxSandbox executes commands inside of Linux namespaces.
+type linuxSandbox struct {
+	WorkDir         string
+	isolateNetwork  bool
+	writableWorkDir bool
+}
+
+func New(options *Options) container.CommandContainer {
+	return &linuxSandbox{
+		isolateNetwork:  strings.ToLower(options.Network) == "off",
+		writableWorkDir: options.WritableWorkDir,
+	}
+}
+
+// MaybeRunInit runs the sandbox init process and does not return if the
+// current process was started by the linux sandbox. Binaries that run commands
+// in the linux sandbox must call this at the start of main().
+func MaybeRunInit() {
+	if len(os.Args) < 3 || os.Args[1] != initArg {
+		return
+	}
+	cfg := &initConfig{}
+	if err := json.Unmarshal([]byte(os.Args[2]), cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "linux-sandbox: invalid config: %s\n", err)
+		os.Exit(initFailedExitCode)
+	}
+	// Only returns if setup or exec failed.
+	err := runInit(cfg, os.Args[3:])
+	fmt.Fprintf(os.Stderr, "linux-sandbox: %s\n", err)
+	os.Exit(initFailedExitCode)
+}
+
+func (c *linuxSandbox) runCmdInSandbox(ctx context.Context, command *repb.Command, workDir string, stdio *container.Stdio) *interfaces.CommandResult {
+	result := &interfaces.CommandResult{
+		CommandDebugString: fmt.Sprintf("(linux-sandbox) %s", command.GetArguments()),
+		ExitCode:           commandutil.NoExitCode,
+	}
+	if len(command.GetArguments()) == 0 {
+		result.Error = status.InvalidArgumentError("command has no arguments")
+		return result
+	}
+
+	rootDir, err := os.MkdirTemp("", "linux-sandbox-root-*")
+	if err != nil {
+		result.Error = status.InternalErrorf("failed to create sandbox root dir: %s", err)
+		return result
+	}
+	defer os.Remove(rootDir)
+
+	absWorkDir, err := filepath.Abs(workDir)
+	if err != nil {
+		result.Error = status.InternalErrorf("failed to resolve working directory: %s", err)
+		return result
+	}
+	writable := []string{absWorkDir}
+	if !c.writableWorkDir {
+		writable, err = outputDirs(command, absWorkDir)
+		if err != nil {
+			result.Error = err
+			return result
+		}
+	}
+	cfg, err := json.Marshal(&initConfig{
+		WorkDir:        absWorkDir,
+		RootDir:        rootDir,
+		WritableDirs:   writable,
+		IsolateNetwork: c.isolateNetwork,
+	})
+	if err != nil {
+		result.Error = status.InternalErrorf("failed to marshal sandbox config: %s", err)
+		return result
+	}
+
+	sandboxCmd := proto.Clone(command).(*repb.Command)
+	sandboxCmd.Arguments = append([]string{"/proc/self/exe", initArg, string(cfg)}, command.GetArguments()...)
+	cloneFlags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	if c.isolateNetwork {
+		cloneFlags |= syscall.CLONE_NEWNET
+	}
+	attr := &syscall.SysProcAttr{
+		Cloneflags: uintptr(cloneFlags),
+		// Map root in the sandbox to the executor's user, so that the init
+		// process can set up mounts.
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	result = commandutil.RunWithSysProcAttr(ctx, sandboxCmd, workDir, nil /*=statsListener*/, stdio, attr)
+	result.CommandDebugString = fmt.Sprintf("(linux-sandbox) %s", command.GetArguments())
+	return result
+}
+
+// outputDirs returns the directories that the command writes its outputs to,
+// creating them if they don't exist yet. Like the executor, it treats the
+// parents of the output paths (or, for older clients, of the output files
+// and directories) and the output directories as directories that the
+// command can write to.
+func outputDirs(command *repb.Command, workDir string) ([]string, error) {
+	var dirs []string
+	outputPaths := command.GetOutputPaths()
+	if len(outputPaths) == 0 {
+		outputPaths = append([]string{}, command.GetOutputFiles()...)
+		outputPaths = append(outputPaths, command.GetOutputDirectories()...)
+		for _, d := range command.GetOutputDirectories() {
+			dirs = append(dirs, filepath.Join(workDir, d))
+		}
+	}
+	for _, p := range outputPaths {
+		dirs = append(dirs, filepath.Dir(filepath.Join(workDir, p)))
+	}
+	// Sort the directories so that parents are mounted before their
+	// children.
+	sort.Strings(dirs)
+	var out []string
+	for _, d := range dirs {
+		if len(out) > 0 && out[len(out)-1] == d {
+			continue
+		}
+		if d != workDir && !strings.HasPrefix(d, workDir+string(filepath.Separator)) {
+			return nil, status.InvalidArgumentErrorf("output directory %q is outside of the working directory", d)
+		}
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, status.InternalErrorf("failed to create output directory: %s", err)
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// runInit sets up the sandbox filesystem and then replaces the current
+// process with the command. It only returns if there was an error.
+func runInit(cfg *initConfig, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command")
+	}
+	// Capabilities are per-thread, so make sure that the command is exec'd
+	// from the thread that drops them.
+	runtime.LockOSThread()
+	// Make sure none of the mounts below propagate back to the host.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+
+	root := cfg.RootDir
+	if err := unix.Mount("tmpfs", root, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mount sandbox root: %w", err)
+	}
+	for _, p := range systemPaths {
+		if err := bindReadOnly(p, filepath.Join(root, p)); err != nil {
+			return err
+		}
+	}
+
+	dev := filepath.Join(root, "dev")
+	if err := os.Mkdir(dev, 0755); err != nil {
+		return fmt.Errorf("create /dev: %w", err)
+	}
+	for _, d := range devices {
+		if _, err := os.Stat(filepath.Join("/dev", d)); os.IsNotExist(err) {
+			continue
+		}
+		if err := bind(filepath.Join("/dev", d), filepath.Join(dev, d)); err != nil {
+			return err
+		}
+	}
+	for name, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return fmt.Errorf("create /dev/%s: %w", name, err)
+		}
+	}
+	for _, dir := range []string{"/tmp", "/dev/shm"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return fmt.Errorf("create %s: %w", dir, err)
+		}
+		if err := unix.Mount("tmpfs", filepath.Join(root, dir), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("mount %s: %w", dir, err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "proc"), 0555); err != nil {
+		return fmt.Errorf("create /proc: %w", err)
+	}
+	if err := unix.Mount("proc", filepath.Join(root, "proc"), "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount /proc: %w", err)
+	}
+
+	// Mount the working directory last, since it may be under one of the
+	// directories mounted above (such as /tmp). It's made read-only once
+	// the writable directories under it have been mounted.
+	workDir := filepath.Join(root, cfg.WorkDir)
+	if err := bind(cfg.WorkDir, workDir); err != nil {
+		return err
+	}
+	writableWorkDir := false
+	for _, d := range cfg.WritableDirs {
+		if d == cfg.WorkDir {
+			writableWorkDir = true
+			continue
+		}
+		if err := bind(d, filepath.Join(root, d)); err != nil {
+			return err
+		}
+	}
+	rdonly := &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}
+	if !writableWorkDir {
+		if err := unix.MountSetattr(unix.AT_FDCWD, workDir, 0, rdonly); err != nil {
+			return fmt.Errorf("make working directory read-only: %w", err)
+		}
+	}
+	// Now that all mount points exist, make the root itself read-only.
+	if err := unix.MountSetattr(unix.AT_FDCWD, root, 0, rdonly); err != nil {
+		return fmt.Errorf("make sandbox root read-only (requires Linux 5.12 or later): %w", err)
+	}
+
+	// Switch to the sandbox root. Pivoting the root onto itself stacks the
+	// old root under the new one, so it can be detached right away.
+	if err := unix.Chdir(root); err != nil {
+		return fmt.Errorf("chdir to sandbox root: %w", err)
+	}
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot root: %w", err)
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("detach old root: %w", err)
+	}
+	if err := unix.Chdir(cfg.WorkDir); err != nil {
+		return fmt.Errorf("chdir to working directory: %w", err)
+	}
+
+	if err := unix.Sethostname([]byte("localhost")); err != nil {
+		return fmt.Errorf("set hostname: %w", err)
+	}
+	if cfg.IsolateNetwork {
+		if err := bringUpLoopback(); err != nil {
+			return fmt.Errorf("bring up loopback interface: %w", err)
+		}
+	}
+
+	// The environment of this process is the command's environment, so this
+	// resolves the executable using the command's PATH.
+	executable, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	if err := dropPrivileges(); err != nil {
+		return fmt.Errorf("drop privileges: %w", err)
+	}
+	return unix.Exec(executable, args, os.Environ())
+}
+
+// dropPrivileges drops all capabilities of the current thread, so that the
+// command can't remount or unmount anything in the sandbox, and makes sure
+// that the command can't regain them, for example by executing a setuid
+// binary.
+func dropPrivileges() error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("set no_new_privs: %w", err)
+	}
+	// Root regains the capabilities in the bounding set when it execs a
+	// binary, so clear it. Dropping a capability past the last one that the
+	// kernel supports fails with EINVAL.
+	for c := 0; ; c++ {
+		err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0)
+		if err == unix.EINVAL {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("drop capability %d from bounding set: %w", c, err)
+		}
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("clear ambient capabilities: %w", err)
+	}
+	hdr := &unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capset(hdr, &data[0]); err != nil {
+		return fmt.Errorf("clear capabilities: %w", err)
+	}
+	return nil
+}
+
+// bind bind-mounts the host path src at dst, creating the mount point first.
+// If src is a symlink, its target is mounted.
+func bind(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", src, err)
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(dst, 0755)
+	} else {
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err == nil {
+			var f *os.File
+			f, err = os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0644)
+			if err == nil {
+				err = f.Close()
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("create mount point for %s: %w", src, err)
+	}
+	if err := unix.Mount(src, dst, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s: %w", src, err)
+	}
+	return nil
+}
+
+// bindReadOnly bind-mounts the host path src at dst and makes the mount
+// read-only. It does nothing if src doesn't exist.
+func bindReadOnly(src, dst string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+	if err := bind(src, dst); err != nil {
+		return err
+	}
+	rdonly := &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}
+	if err := unix.MountSetattr(unix.AT_FDCWD, dst, unix.AT_RECURSIVE, rdonly); err != nil {
+		return fmt.Errorf("make %s read-only (requires Linux 5.12 or later): %w", src, err)
+	}
+	return nil
+}
+
+// bringUpLoopback brings up the loopback interface in a new network
+// namespace, where it starts out down.
+func bringUpLoopback() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
+
+func (c *linuxSandbox) Run(ctx context.Context, command *repb.Command, workDir string, _ container.PullCredentials) *interfaces.CommandResult {
+	return c.runCmdInSandbox(ctx, command, workDir, &container.Stdio{})
+}
+
+func (c *linuxSandbox) Create(ctx context.Context, workDir string) error {
+	c.WorkDir = workDir
+	return nil
+}
+
+func (c *linuxSandbox) Exec(ctx context.Context, cmd *repb.Command, stdio *container.Stdio) *interfaces.CommandResult {
+	return c.runCmdInSandbox(ctx, cmd, c.WorkDir, stdio)
+}
+
+func (c *linuxSandbox) IsImageCached(ctx context.Context) (bool, error) { return false, nil }
+func (c *linuxSandbox) PullImage(ctx context.Context, creds container.PullCredentials) error {
+	return nil
+}
+func (c *linuxSandbox) Start(ctx context.Context) error   { return nil }
+func (c *linuxSandbox) Remove(ctx context.Context) error  { return nil }
+func (c *linuxSandbox) Pause(ctx context.Context) error   { return nil }
+func (c *linuxSandbox) Unpause(ctx context.Context) error { return nil }
+func (c *linuxSandbox) Stats(ctx context.Context) (*repb.UsageStats, error) {
+	return nil, nil
+}
+func (c *linuxSandbox) State(ctx context.Context) (*rnpb.ContainerState, error) {
+	return nil, status.UnimplementedError("not implemented")
+}
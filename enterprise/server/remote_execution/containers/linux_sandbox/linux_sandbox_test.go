@@ -0,0 +1,150 @@
+//go:build linux && !android
+
+package linux_sandbox_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/linux_sandbox"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func TestMain(m *testing.M) {
+	// The test binary is re-executed to run commands in the sandbox.
+	linux_sandbox.MaybeRunInit()
+	os.Exit(m.Run())
+}
+
+func TestSandboxedHelloWorld(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	workDir := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, workDir, map[string]string{"world.txt": "world"})
+	cmd := &repb.Command{
+		EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+			{Name: "GREETING", Value: "Hello"},
+			{Name: "PATH", Value: os.Getenv("PATH")},
+		},
+		Arguments:   []string{"sh", "-c", `printf "$GREETING $(cat world.txt)!" && echo out > out/out.txt`},
+		OutputPaths: []string{"out/out.txt"},
+	}
+
+	c := linux_sandbox.New(&linux_sandbox.Options{})
+	result := c.Run(ctx, cmd, workDir, container.PullCredentials{})
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, "Hello world!", string(result.Stdout))
+	assert.Empty(t, string(result.Stderr))
+	assert.Equal(t, 0, result.ExitCode)
+	assert.Equal(t, "out\n", testfs.ReadFileAsString(t, workDir, "out/out.txt"))
+}
+
+func TestSandboxedPersistentWorkerCanWriteWorkDir(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	workDir := testfs.MakeTempDir(t)
+	cmd := &repb.Command{
+		EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+			{Name: "PATH", Value: os.Getenv("PATH")},
+		},
+		Arguments: []string{"sh", "-c", "echo out > out.txt"},
+	}
+
+	c := linux_sandbox.New(&linux_sandbox.Options{WritableWorkDir: true})
+	result := c.Run(ctx, cmd, workDir, container.PullCredentials{})
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, 0, result.ExitCode, "stderr: %s", string(result.Stderr))
+	assert.Equal(t, "out\n", testfs.ReadFileAsString(t, workDir, "out.txt"))
+}
+
+func TestSandboxRejectsOutputsOutsideWorkDir(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	workDir := testfs.MakeTempDir(t)
+	cmd := &repb.Command{
+		Arguments:   []string{"true"},
+		OutputPaths: []string{"../escape/out.txt"},
+	}
+
+	c := linux_sandbox.New(&linux_sandbox.Options{})
+	result := c.Run(ctx, cmd, workDir, container.PullCredentials{})
+
+	require.True(t, status.IsInvalidArgumentError(result.Error), "expected InvalidArgument; got: %v", result.Error)
+}
+
+func TestSandboxIsolation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rootDir := testfs.MakeTempDir(t)
+	workDir := testfs.MakeDirAll(t, rootDir, "action-1")
+	testfs.WriteAllFileContents(t, workDir, map[string]string{"input.txt": "input"})
+	otherWorkDir := testfs.MakeDirAll(t, rootDir, "action-2")
+	testfs.WriteAllFileContents(t, otherWorkDir, map[string]string{"secret.txt": "secret"})
+	hostFile := filepath.Join(testfs.MakeTempDir(t), "host.txt")
+	// Files that the executor keeps outside of action working directories,
+	// such as its filecache and config, shouldn't be visible either.
+	executorDir := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, executorDir, map[string]string{
+		"filecache/blob": "cached",
+		"config.yaml":    "api_key: secret",
+	})
+	executable, err := os.Executable()
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name          string
+		script        string
+		expectSuccess bool
+	}{
+		{"cannot read other action's files", "cat " + filepath.Join(otherWorkDir, "secret.txt"), false},
+		{"cannot write outside of working directory", "touch " + hostFile, false},
+		{"cannot read executor filecache", "cat " + filepath.Join(executorDir, "filecache/blob"), false},
+		{"cannot read executor config", "cat " + filepath.Join(executorDir, "config.yaml"), false},
+		{"cannot read executor binary", "cat " + executable + " > /dev/null", false},
+		{"cannot write to root", "touch /foo", false},
+		{"cannot write to system dirs", "touch /usr/foo", false},
+		{"can read inputs", "test $(cat input.txt) = input", true},
+		{"cannot modify inputs", "echo foo >> input.txt", false},
+		{"cannot write to input root", "touch new.txt", false},
+		{"can write to output dirs", "echo foo > out/new.txt", true},
+		{"cannot remount system dirs", "mount -o remount,rw,bind /usr; touch /usr/foo", false},
+		{"cannot remount input root", "mount -o remount,rw,bind " + workDir + "; touch new.txt", false},
+		{"cannot unmount", "umount /usr", false},
+		{"has no capabilities", "grep -q '^CapEff:\\s*0*$' /proc/self/status && grep -q '^CapBnd:\\s*0*$' /proc/self/status", true},
+		{"cannot gain privileges", "grep -q '^NoNewPrivs:\\s*1$' /proc/self/status", true},
+		{"only has minimal /etc", "test ! -e /etc/shadow && test -e /etc/passwd", true},
+		{"only has standard devices", "echo foo > /dev/null && test $(ls /dev | grep -c '^sd') -eq 0", true},
+		// Only the processes in the sandbox should be visible.
+		{"has private process tree", "test $(ls /proc | grep -c '^[0-9]') -lt 5", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := &repb.Command{
+				EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+					{Name: "PATH", Value: os.Getenv("PATH")},
+				},
+				Arguments:   []string{"sh", "-c", tc.script},
+				OutputPaths: []string{"out/new.txt"},
+			}
+			c := linux_sandbox.New(&linux_sandbox.Options{Network: "off"})
+			result := c.Run(ctx, cmd, workDir, container.PullCredentials{})
+			require.NoError(t, result.Error)
+			if tc.expectSuccess {
+				assert.Equal(t, 0, result.ExitCode, "stderr: %s", string(result.Stderr))
+			} else {
+				assert.NotEqual(t, 0, result.ExitCode)
+			}
+		})
+	}
+	assert.NoFileExists(t, hostFile)
+}
@@ -525,6 +525,11 @@ func (s *ExecutionServer) Dispatch(ctx context.Context, req *repb.ExecuteRequest
 		return "", err
 	}
 
+	priorityClass, err := taskPriorityClass(props)
+	if err != nil {
+		return "", err
+	}
+
 	metrics.RemoteExecutionRequests.With(prometheus.Labels{metrics.GroupID: taskGroupID, metrics.OS: props.OS, metrics.Arch: props.Arch}).Inc()
 
 	if s.enableRedisAvailabilityMonitoring {
@@ -542,6 +547,7 @@ func (s *ExecutionServer) Dispatch(ctx context.Context, req *repb.ExecuteRequest
 		PredictedTaskSize: predictedSize,
 		ExecutorGroupId:   pool.GroupID,
 		TaskGroupId:       taskGroupID,
+		PriorityClass:     priorityClass,
 	}
 	scheduleReq := &scpb.ScheduleTaskRequest{
 		TaskId:         executionID,
@@ -563,6 +569,28 @@ func (s *ExecutionServer) Dispatch(ctx context.Context, req *repb.ExecuteRequest
 	return executionID, nil
 }
 
+// taskPriorityClass returns the priority class requested by the task's
+// platform properties. If no class is requested, workflow tasks are treated
+// as CI tasks and all other tasks as interactive tasks, so that only tasks
+// that opt in are treated as batch tasks.
+func taskPriorityClass(props *platform.Properties) (scpb.PriorityClass, error) {
+	switch props.PriorityClass {
+	case "interactive":
+		return scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, nil
+	case "ci":
+		return scpb.PriorityClass_CI_PRIORITY_CLASS, nil
+	case "batch":
+		return scpb.PriorityClass_BATCH_PRIORITY_CLASS, nil
+	case "":
+		if props.WorkflowID != "" {
+			return scpb.PriorityClass_CI_PRIORITY_CLASS, nil
+		}
+		return scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, nil
+	default:
+		return scpb.PriorityClass_UNKNOWN_PRIORITY_CLASS, status.InvalidArgumentErrorf("invalid priority-class %q: must be one of interactive, ci, or batch", props.PriorityClass)
+	}
+}
+
 // findExistingExecution looks for an identical action that is already pending
 // execution.
 func (s *ExecutionServer) findPendingExecution(ctx context.Context, adResource *digest.ResourceName) (string, error) {
@@ -978,7 +1006,7 @@ func (s *ExecutionServer) markTaskComplete(ctx context.Context, taskID string, e
 	if err != nil {
 		return err
 	}
-	cmd, err := s.fetchCommandForTask(ctx, actionResourceName)
+	action, cmd, err := s.fetchActionAndCommandForTask(ctx, actionResourceName)
 	if err != nil {
 		return err
 	}
@@ -987,7 +1015,7 @@ func (s *ExecutionServer) markTaskComplete(ctx context.Context, taskID string, e
 	// Only update the router if a task was actually executed
 	if router != nil && !executeResponse.GetCachedResult() {
 		nodeID := executeResponse.GetResult().GetExecutionMetadata().GetExecutorId()
-		router.MarkComplete(ctx, cmd, actionResourceName.GetInstanceName(), nodeID)
+		router.MarkComplete(ctx, action, cmd, actionResourceName.GetInstanceName(), nodeID)
 	}
 
 	if sizer := s.env.GetTaskSizer(); sizer != nil {
@@ -1060,18 +1088,18 @@ func (s *ExecutionServer) updateUsage(ctx context.Context, cmd *repb.Command, ex
 	return ut.Increment(ctx, labels, counts)
 }
 
-func (s *ExecutionServer) fetchCommandForTask(ctx context.Context, actionResourceName *digest.ResourceName) (*repb.Command, error) {
+func (s *ExecutionServer) fetchActionAndCommandForTask(ctx context.Context, actionResourceName *digest.ResourceName) (*repb.Action, *repb.Command, error) {
 	action := &repb.Action{}
 	if err := cachetools.ReadProtoFromCAS(ctx, s.cache, actionResourceName, action); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	cmdDigest := action.GetCommandDigest()
 	cmdInstanceNameDigest := digest.NewResourceName(cmdDigest, actionResourceName.GetInstanceName(), rspb.CacheType_CAS, actionResourceName.GetDigestFunction())
 	cmd := &repb.Command{}
 	if err := cachetools.ReadProtoFromCAS(ctx, s.cache, cmdInstanceNameDigest, cmd); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return cmd, nil
+	return action, cmd, nil
 }
 
 func executionDuration(md *repb.ExecutedActionMetadata) (time.Duration, error) {
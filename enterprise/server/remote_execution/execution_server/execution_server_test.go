@@ -18,6 +18,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -137,6 +138,72 @@ func TestDispatch(t *testing.T) {
 	require.NoError(t, err)
 	assert.Nil(t, task.GetRequestMetadata().GetToolDetails(), "ToolDetails should be nil")
 	assert.Equal(t, iid, task.GetRequestMetadata().GetToolInvocationId(), "invocation ID should be passed along")
+	assert.Equal(t, scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, sched.scheduleReqs[0].GetMetadata().GetPriorityClass())
+}
+
+func TestDispatch_PriorityClass(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		properties    []*repb.Platform_Property
+		expectedClass scpb.PriorityClass
+		expectErr     bool
+	}{
+		{
+			name:          "default",
+			expectedClass: scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS,
+		},
+		{
+			name:          "workflow default",
+			properties:    []*repb.Platform_Property{{Name: "workflow-id", Value: "WF1"}},
+			expectedClass: scpb.PriorityClass_CI_PRIORITY_CLASS,
+		},
+		{
+			name:          "explicit batch",
+			properties:    []*repb.Platform_Property{{Name: "priority-class", Value: "Batch"}},
+			expectedClass: scpb.PriorityClass_BATCH_PRIORITY_CLASS,
+		},
+		{
+			name:          "explicit interactive workflow",
+			properties:    []*repb.Platform_Property{{Name: "workflow-id", Value: "WF1"}, {Name: "priority-class", Value: "interactive"}},
+			expectedClass: scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS,
+		},
+		{
+			name:       "invalid",
+			properties: []*repb.Platform_Property{{Name: "priority-class", Value: "urgent"}},
+			expectErr:  true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			env := setupEnv(t)
+			ctx := context.Background()
+			s := env.GetRemoteExecutionService()
+			ctx, err := env.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(ctx, "US1")
+			require.NoError(t, err)
+
+			cmd := &repb.Command{
+				Arguments: []string{"test"},
+				Platform:  &repb.Platform{Properties: test.properties},
+			}
+			cd, err := cachetools.UploadProto(ctx, env.GetByteStreamClient(), "", repb.DigestFunction_SHA256, cmd)
+			require.NoError(t, err)
+			action := &repb.Action{CommandDigest: cd}
+			ad, err := cachetools.UploadProto(ctx, env.GetByteStreamClient(), "", repb.DigestFunction_SHA256, action)
+			require.NoError(t, err)
+
+			ctx, err = prefix.AttachUserPrefixToContext(ctx, env)
+			require.NoError(t, err)
+			_, err = s.Dispatch(ctx, &repb.ExecuteRequest{ActionDigest: ad})
+			sched := env.GetSchedulerService().(*schedulerServerMock)
+			if test.expectErr {
+				require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+				require.Empty(t, sched.scheduleReqs)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, 1, len(sched.scheduleReqs))
+			assert.Equal(t, test.expectedClass, sched.scheduleReqs[0].GetMetadata().GetPriorityClass())
+		})
+	}
 }
 
 func TestCancel(t *testing.T) {
@@ -49,6 +49,11 @@ const (
 	uploadDeadlineExtension = time.Minute * 1
 )
 
+// ErrPreempted is the cause of the cancellation of a task's context when the
+// task is preempted to make room for a higher priority task. Preempted tasks
+// are re-enqueued without publishing a result.
+var ErrPreempted = status.UnavailableError("task was preempted by a higher priority task")
+
 type Executor struct {
 	env        environment.Env
 	runnerPool interfaces.RunnerPool
@@ -170,8 +175,14 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 	task.ExecuteRequest.DigestFunction = digestFunction
 	acClient := s.env.GetActionCacheClient()
 
+	// Keep a reference to the task context, since ctx is later replaced with
+	// contexts that outlive it.
+	taskCtx := ctx
 	stateChangeFn := operation.GetStateChangeFunc(stream, taskID, adInstanceDigest)
 	finishWithErrFn := func(finalErr error) (retry bool, err error) {
+		if context.Cause(taskCtx) == ErrPreempted {
+			return true, ErrPreempted
+		}
 		if shouldRetry(task, finalErr) {
 			return true, finalErr
 		}
@@ -274,6 +285,13 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 		}
 	}
 
+	// If the task was preempted, the command was most likely killed, so
+	// there is nothing worth uploading.
+	if context.Cause(taskCtx) == ErrPreempted {
+		log.CtxInfof(ctx, "Task %q was preempted.", taskID)
+		return true, ErrPreempted
+	}
+
 	if cmdResult.ExitCode != 0 {
 		log.CtxDebugf(ctx, "%q finished with non-zero exit code (%d). Err: %s, Stdout: %s, Stderr: %s", taskID, cmdResult.ExitCode, cmdResult.Error, cmdResult.Stdout, cmdResult.Stderr)
 	}
@@ -27,6 +27,7 @@ var (
 	enableBareRunner           = flag.Bool("executor.enable_bare_runner", false, "Enables running execution commands directly on the host without isolation.")
 	enablePodman               = flag.Bool("executor.enable_podman", false, "Enables running execution commands inside podman container.")
 	enableSandbox              = flag.Bool("executor.enable_sandbox", false, "Enables running execution commands inside of sandbox-exec.")
+	enableLinuxSandbox         = flag.Bool("executor.enable_linux_sandbox", false, "Enables running execution commands inside of Linux namespaces, with a read-only view of the host filesystem.")
 	enableFirecracker          = flag.Bool("executor.enable_firecracker", false, "Enables running execution commands inside of firecracker VMs")
 	forcedNetworkIsolationType = flag.String("executor.forced_network_isolation_type", "", "If set, run all commands that require networking with this isolation")
 	defaultImage               = flag.String("executor.default_image", Ubuntu16_04Image, "The default docker image to use to warm up executors or if no platform property is set. Ex: gcr.io/flame-public/executor-docker-default:enterprise-v1.5.4")
@@ -64,26 +65,29 @@ const (
 	// empty or unset.
 	unsetContainerImageVal = "none"
 
-	RecycleRunnerPropertyName            = "recycle-runner"
-	preserveWorkspacePropertyName        = "preserve-workspace"
-	nonrootWorkspacePropertyName         = "nonroot-workspace"
-	cleanWorkspaceInputsPropertyName     = "clean-workspace-inputs"
-	persistentWorkerPropertyName         = "persistent-workers"
-	persistentWorkerKeyPropertyName      = "persistentWorkerKey"
-	persistentWorkerProtocolPropertyName = "persistentWorkerProtocol"
-	WorkflowIDPropertyName               = "workflow-id"
-	workloadIsolationPropertyName        = "workload-isolation-type"
-	initDockerdPropertyName              = "init-dockerd"
-	enableDockerdTCPPropertyName         = "enable-dockerd-tcp"
-	enableVFSPropertyName                = "enable-vfs"
-	HostedBazelAffinityKeyPropertyName   = "hosted-bazel-affinity-key"
-	useSelfHostedExecutorsPropertyName   = "use-self-hosted-executors"
-	disableMeasuredTaskSizePropertyName  = "debug-disable-measured-task-size"
-	disablePredictedTaskSizePropertyName = "debug-disable-predicted-task-size"
-	extraArgsPropertyName                = "extra-args"
-	EnvOverridesPropertyName             = "env-overrides"
-	EnvOverridesBase64PropertyName       = "env-overrides-base64"
-	IncludeSecretsPropertyName           = "include-secrets"
+	RecycleRunnerPropertyName                = "recycle-runner"
+	preserveWorkspacePropertyName            = "preserve-workspace"
+	nonrootWorkspacePropertyName             = "nonroot-workspace"
+	cleanWorkspaceInputsPropertyName         = "clean-workspace-inputs"
+	persistentWorkerPropertyName             = "persistent-workers"
+	persistentWorkerKeyPropertyName          = "persistentWorkerKey"
+	persistentWorkerProtocolPropertyName     = "persistentWorkerProtocol"
+	persistentWorkerMultiplexPropertyName    = "persistentWorkerMultiplex"
+	persistentWorkerCancellationPropertyName = "persistentWorkerCancellation"
+	WorkflowIDPropertyName                   = "workflow-id"
+	workloadIsolationPropertyName            = "workload-isolation-type"
+	initDockerdPropertyName                  = "init-dockerd"
+	enableDockerdTCPPropertyName             = "enable-dockerd-tcp"
+	enableVFSPropertyName                    = "enable-vfs"
+	HostedBazelAffinityKeyPropertyName       = "hosted-bazel-affinity-key"
+	useSelfHostedExecutorsPropertyName       = "use-self-hosted-executors"
+	disableMeasuredTaskSizePropertyName      = "debug-disable-measured-task-size"
+	disablePredictedTaskSizePropertyName     = "debug-disable-predicted-task-size"
+	extraArgsPropertyName                    = "extra-args"
+	EnvOverridesPropertyName                 = "env-overrides"
+	EnvOverridesBase64PropertyName           = "env-overrides-base64"
+	IncludeSecretsPropertyName               = "include-secrets"
+	priorityClassPropertyName                = "priority-class"
 
 	OperatingSystemPropertyName = "OSFamily"
 	LinuxOperatingSystemName    = "linux"
@@ -113,11 +117,12 @@ const (
 	EstimatedCPUPropertyName    = "EstimatedCPU"
 	EstimatedMemoryPropertyName = "EstimatedMemory"
 
-	BareContainerType        ContainerType = "none"
-	PodmanContainerType      ContainerType = "podman"
-	DockerContainerType      ContainerType = "docker"
-	FirecrackerContainerType ContainerType = "firecracker"
-	SandboxContainerType     ContainerType = "sandbox"
+	BareContainerType         ContainerType = "none"
+	PodmanContainerType       ContainerType = "podman"
+	DockerContainerType       ContainerType = "docker"
+	FirecrackerContainerType  ContainerType = "firecracker"
+	SandboxContainerType      ContainerType = "sandbox"
+	LinuxSandboxContainerType ContainerType = "linux-sandbox"
 )
 
 // Properties represents the platform properties parsed from a command.
@@ -169,9 +174,17 @@ type Properties struct {
 	PersistentWorker         bool
 	PersistentWorkerKey      string
 	PersistentWorkerProtocol string
-	WorkflowID               string
-	HostedBazelAffinityKey   string
-	UseSelfHostedExecutors   bool
+	// PersistentWorkerMultiplex indicates that the persistent worker supports
+	// the multiplex protocol, allowing concurrent tasks to share a single
+	// worker process. Multiplex workers must resolve inputs and outputs
+	// relative to the sandbox_dir of each WorkRequest.
+	PersistentWorkerMultiplex bool
+	// PersistentWorkerCancellation indicates that the persistent worker
+	// supports cancel requests.
+	PersistentWorkerCancellation bool
+	WorkflowID                   string
+	HostedBazelAffinityKey       string
+	UseSelfHostedExecutors       bool
 
 	// DisableMeasuredTaskSize disables measurement-based task sizing, even if
 	// it is enabled via flag, and instead uses the default / platform based
@@ -186,6 +199,10 @@ type Properties struct {
 	// sizing.
 	DisablePredictedTaskSize bool
 
+	// PriorityClass is the priority class of the task: "interactive", "ci",
+	// or "batch". If empty, the class is inferred from the task.
+	PriorityClass string
+
 	// ExtraArgs contains arguments to append to the action.
 	ExtraArgs []string
 
@@ -235,39 +252,42 @@ func ParseProperties(task *repb.ExecutionTask) (*Properties, error) {
 	}
 
 	return &Properties{
-		OS:                        strings.ToLower(stringProp(m, OperatingSystemPropertyName, defaultOperatingSystemName)),
-		Arch:                      strings.ToLower(stringProp(m, CPUArchitecturePropertyName, defaultCPUArchitecture)),
-		Pool:                      strings.ToLower(pool),
-		EstimatedComputeUnits:     int64Prop(m, EstimatedComputeUnitsPropertyName, 0),
-		EstimatedMemoryBytes:      iecBytesProp(m, EstimatedMemoryPropertyName, 0),
-		EstimatedMilliCPU:         milliCPUProp(m, EstimatedCPUPropertyName, 0),
-		EstimatedFreeDiskBytes:    iecBytesProp(m, EstimatedFreeDiskPropertyName, 0),
-		ContainerImage:            stringProp(m, containerImagePropertyName, ""),
-		ContainerRegistryUsername: stringProp(m, containerRegistryUsernamePropertyName, ""),
-		ContainerRegistryPassword: stringProp(m, containerRegistryPasswordPropertyName, ""),
-		WorkloadIsolationType:     stringProp(m, workloadIsolationPropertyName, ""),
-		InitDockerd:               boolProp(m, initDockerdPropertyName, false),
-		EnableDockerdTCP:          boolProp(m, enableDockerdTCPPropertyName, false),
-		DockerForceRoot:           boolProp(m, dockerRunAsRootPropertyName, false),
-		DockerInit:                boolProp(m, DockerInitPropertyName, false),
-		DockerUser:                stringProp(m, DockerUserPropertyName, ""),
-		DockerNetwork:             stringProp(m, dockerNetworkPropertyName, ""),
-		RecycleRunner:             boolProp(m, RecycleRunnerPropertyName, false),
-		EnableVFS:                 vfsEnabled,
-		IncludeSecrets:            boolProp(m, IncludeSecretsPropertyName, false),
-		PreserveWorkspace:         boolProp(m, preserveWorkspacePropertyName, false),
-		NonrootWorkspace:          boolProp(m, nonrootWorkspacePropertyName, false),
-		CleanWorkspaceInputs:      stringProp(m, cleanWorkspaceInputsPropertyName, ""),
-		PersistentWorker:          boolProp(m, persistentWorkerPropertyName, false),
-		PersistentWorkerKey:       stringProp(m, persistentWorkerKeyPropertyName, ""),
-		PersistentWorkerProtocol:  stringProp(m, persistentWorkerProtocolPropertyName, ""),
-		WorkflowID:                stringProp(m, WorkflowIDPropertyName, ""),
-		HostedBazelAffinityKey:    stringProp(m, HostedBazelAffinityKeyPropertyName, ""),
-		UseSelfHostedExecutors:    boolProp(m, useSelfHostedExecutorsPropertyName, false),
-		DisableMeasuredTaskSize:   boolProp(m, disableMeasuredTaskSizePropertyName, false),
-		DisablePredictedTaskSize:  boolProp(m, disablePredictedTaskSizePropertyName, false),
-		ExtraArgs:                 stringListProp(m, extraArgsPropertyName),
-		EnvOverrides:              envOverrides,
+		OS:                           strings.ToLower(stringProp(m, OperatingSystemPropertyName, defaultOperatingSystemName)),
+		Arch:                         strings.ToLower(stringProp(m, CPUArchitecturePropertyName, defaultCPUArchitecture)),
+		Pool:                         strings.ToLower(pool),
+		EstimatedComputeUnits:        int64Prop(m, EstimatedComputeUnitsPropertyName, 0),
+		EstimatedMemoryBytes:         iecBytesProp(m, EstimatedMemoryPropertyName, 0),
+		EstimatedMilliCPU:            milliCPUProp(m, EstimatedCPUPropertyName, 0),
+		EstimatedFreeDiskBytes:       iecBytesProp(m, EstimatedFreeDiskPropertyName, 0),
+		ContainerImage:               stringProp(m, containerImagePropertyName, ""),
+		ContainerRegistryUsername:    stringProp(m, containerRegistryUsernamePropertyName, ""),
+		ContainerRegistryPassword:    stringProp(m, containerRegistryPasswordPropertyName, ""),
+		WorkloadIsolationType:        stringProp(m, workloadIsolationPropertyName, ""),
+		InitDockerd:                  boolProp(m, initDockerdPropertyName, false),
+		EnableDockerdTCP:             boolProp(m, enableDockerdTCPPropertyName, false),
+		DockerForceRoot:              boolProp(m, dockerRunAsRootPropertyName, false),
+		DockerInit:                   boolProp(m, DockerInitPropertyName, false),
+		DockerUser:                   stringProp(m, DockerUserPropertyName, ""),
+		DockerNetwork:                stringProp(m, dockerNetworkPropertyName, ""),
+		RecycleRunner:                boolProp(m, RecycleRunnerPropertyName, false),
+		EnableVFS:                    vfsEnabled,
+		IncludeSecrets:               boolProp(m, IncludeSecretsPropertyName, false),
+		PreserveWorkspace:            boolProp(m, preserveWorkspacePropertyName, false),
+		NonrootWorkspace:             boolProp(m, nonrootWorkspacePropertyName, false),
+		CleanWorkspaceInputs:         stringProp(m, cleanWorkspaceInputsPropertyName, ""),
+		PersistentWorker:             boolProp(m, persistentWorkerPropertyName, false),
+		PersistentWorkerKey:          stringProp(m, persistentWorkerKeyPropertyName, ""),
+		PersistentWorkerProtocol:     stringProp(m, persistentWorkerProtocolPropertyName, ""),
+		PersistentWorkerMultiplex:    boolProp(m, persistentWorkerMultiplexPropertyName, false),
+		PersistentWorkerCancellation: boolProp(m, persistentWorkerCancellationPropertyName, false),
+		WorkflowID:                   stringProp(m, WorkflowIDPropertyName, ""),
+		HostedBazelAffinityKey:       stringProp(m, HostedBazelAffinityKeyPropertyName, ""),
+		UseSelfHostedExecutors:       boolProp(m, useSelfHostedExecutorsPropertyName, false),
+		DisableMeasuredTaskSize:      boolProp(m, disableMeasuredTaskSizePropertyName, false),
+		DisablePredictedTaskSize:     boolProp(m, disablePredictedTaskSizePropertyName, false),
+		ExtraArgs:                    stringListProp(m, extraArgsPropertyName),
+		EnvOverrides:                 envOverrides,
+		PriorityClass:                strings.ToLower(stringProp(m, priorityClassPropertyName, "")),
 	}, nil
 }
 
@@ -345,6 +365,14 @@ func GetExecutorProperties() *ExecutorProperties {
 		}
 	}
 
+	if *enableLinuxSandbox {
+		if runtime.GOOS == "linux" {
+			p.SupportedIsolationTypes = append(p.SupportedIsolationTypes, LinuxSandboxContainerType)
+		} else {
+			log.Warning("Linux sandbox was enabled, but is unsupported outside of linux. Ignoring.")
+		}
+	}
+
 	// Special case: for backwards compatibility, support bare-runners when docker
 	// is not enabled. Typically, this happens for macs.
 	if *enableBareRunner || len(p.SupportedIsolationTypes) == 0 {
@@ -0,0 +1,531 @@
+package runner
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/background"
+	"github.com/buildbuddy-io/buildbuddy/server/util/fastcopy"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lockingbuffer"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/proto"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	wkpb "github.com/buildbuddy-io/buildbuddy/proto/worker"
+)
+
+// multiplexWorker is a persistent worker process that speaks the multiplex
+// worker protocol, which allows it to handle several WorkRequests
+// concurrently. Responses are routed back to the waiting request by
+// request_id.
+//
+// The worker is owned by the pool rather than by any one runner, and serves
+// requests from every runner in the pool with the same runner key. It runs in
+// its own working directory, which starts out as a copy of the workspace of
+// the runner that started it (so that it contains the worker's tools). Each
+// request gets its own sandbox directory inside of the worker's working
+// directory, which links to the requesting runner's workspace.
+type multiplexWorker struct {
+	// key is the pool's key for this worker.
+	key string
+	// protocol is the serialization protocol ("json" or "proto").
+	protocol string
+	// supportsCancellation is whether the worker accepts cancel requests.
+	supportsCancellation bool
+	// workDir is the working directory of the worker process. It is removed
+	// when the worker is stopped.
+	workDir string
+	// onIdle is called once the worker has had no active requests for
+	// multiplexWorkerIdleTimeout.
+	onIdle func()
+
+	stdin  io.Writer
+	stderr lockingbuffer.LockingBuffer
+
+	// writeMu serializes writes to stdin, so that concurrent requests are not
+	// interleaved.
+	writeMu sync.Mutex
+
+	mu sync.Mutex // protects all fields below
+	// nextRequestID is the request_id assigned to the next request. IDs start
+	// at 1, since 0 is reserved for singleplex requests.
+	nextRequestID int32
+	// pending holds the channels on which responses are delivered, keyed by
+	// request_id.
+	pending map[int32]chan *wkpb.WorkResponse
+	// activeRequests is the number of tasks currently attached to the worker.
+	activeRequests int
+	// draining is set once the worker has been asked to stop; no new requests
+	// are accepted after this point.
+	draining bool
+	// drained is closed once draining is set and there are no active
+	// requests.
+	drained chan struct{}
+	// idleTimer calls onIdle once the worker has been idle for long enough.
+	// It is only set while there are no active requests.
+	idleTimer *time.Timer
+	// err is the error that caused the worker to exit, if any.
+	err error
+
+	// exited is closed when the worker's stdout is closed, either because the
+	// worker process exited or because its output could not be parsed.
+	exited chan struct{}
+	// terminated is closed when the worker process has terminated.
+	terminated chan struct{}
+	cancel     context.CancelFunc
+}
+
+// startMultiplexWorker starts a multiplex worker process in a new working
+// directory under the pool's build root, which is populated with the contents
+// of the given runner's workspace.
+func (p *pool) startMultiplexWorker(ctx context.Context, r *commandRunner, key string, command *repb.Command, workerArgs []string) (*multiplexWorker, error) {
+	workDir, err := os.MkdirTemp(p.buildRoot, "multiplex-worker-*")
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to create multiplex worker directory: %s", err)
+	}
+	if err := copyDir(r.Workspace.Path(), workDir); err != nil {
+		os.RemoveAll(workDir)
+		return nil, status.UnavailableErrorf("failed to populate multiplex worker directory: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Join(workDir, multiplexSandboxDirName), 0755); err != nil {
+		os.RemoveAll(workDir)
+		return nil, status.UnavailableErrorf("failed to create multiplex worker sandbox directory: %s", err)
+	}
+	c, err := p.newContainer(ctx, r.PlatformProperties, nil /*=task*/, nil /*=state*/, workDir)
+	if err != nil {
+		os.RemoveAll(workDir)
+		return nil, err
+	}
+	if err := c.Create(ctx, workDir); err != nil {
+		os.RemoveAll(workDir)
+		return nil, err
+	}
+
+	// Note: Using the server context since this worker will stick around for
+	// other tasks.
+	workerCtx, cancel := context.WithCancel(r.env.GetServerContext())
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	w := &multiplexWorker{
+		key:                  key,
+		protocol:             r.PlatformProperties.PersistentWorkerProtocol,
+		supportsCancellation: r.PlatformProperties.PersistentWorkerCancellation,
+		workDir:              workDir,
+		stdin:                stdinWriter,
+		nextRequestID:        1,
+		pending:              map[int32]chan *wkpb.WorkResponse{},
+		drained:              make(chan struct{}),
+		exited:               make(chan struct{}),
+		terminated:           make(chan struct{}),
+		cancel:               cancel,
+	}
+	w.onIdle = func() { p.retireMultiplexWorker(w) }
+
+	command = proto.Clone(command).(*repb.Command)
+	command.Arguments = append(workerArgs, "--persistent_worker")
+
+	go func() {
+		defer close(w.terminated)
+		defer stdinReader.Close()
+		defer stdoutWriter.Close()
+
+		stdio := &container.Stdio{
+			Stdin:  stdinReader,
+			Stdout: stdoutWriter,
+			Stderr: &w.stderr,
+		}
+		res := c.Exec(workerCtx, command, stdio)
+		log.Debugf("Multiplex persistent worker exited with response: %+v, workerArgs: %+v", res, workerArgs)
+	}()
+	go w.readResponses(stdoutReader)
+	return w, nil
+}
+
+// copyDir copies the contents of src into the existing directory dst, using
+// hard links for regular files.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return os.Mkdir(target, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return fastcopy.FastCopy(path, target)
+		default:
+			return nil
+		}
+	})
+}
+
+// readResponses reads WorkResponses from the worker's stdout and delivers each
+// one to the request with the matching request_id, until stdout is closed.
+func (w *multiplexWorker) readResponses(stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	jsonDecoder := json.NewDecoder(reader)
+	for {
+		responseProto := &wkpb.WorkResponse{}
+		if err := unmarshalWorkResponse(w.protocol, responseProto, reader, jsonDecoder); err != nil {
+			w.mu.Lock()
+			w.err = err
+			w.mu.Unlock()
+			close(w.exited)
+			// Unblock the worker process if it is still trying to write.
+			io.Copy(io.Discard, stdout)
+			return
+		}
+		w.mu.Lock()
+		ch, ok := w.pending[responseProto.GetRequestId()]
+		delete(w.pending, responseProto.GetRequestId())
+		w.mu.Unlock()
+		if !ok {
+			// The request was abandoned (e.g. its task was canceled).
+			log.Debugf("Dropping multiplex worker response for unknown request ID %d", responseProto.GetRequestId())
+			continue
+		}
+		ch <- responseProto
+	}
+}
+
+// alive returns whether the worker can accept new requests.
+func (w *multiplexWorker) alive() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.exited:
+		return false
+	default:
+		return !w.draining
+	}
+}
+
+// multiplexRequest is a request that is attached to a multiplex worker.
+type multiplexRequest struct {
+	id int32
+	// responses receives the worker's response to the request.
+	responses chan *wkpb.WorkResponse
+}
+
+// attach registers a new request with the worker. The caller must call
+// detach when done with the request.
+func (w *multiplexWorker) attach() (*multiplexRequest, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.draining {
+		return nil, status.UnavailableError("multiplex persistent worker is shutting down")
+	}
+	req := &multiplexRequest{
+		id:        w.nextRequestID,
+		responses: make(chan *wkpb.WorkResponse, 1),
+	}
+	w.nextRequestID++
+	w.pending[req.id] = req.responses
+	w.activeRequests++
+	if w.idleTimer != nil {
+		w.idleTimer.Stop()
+		w.idleTimer = nil
+	}
+	return req, nil
+}
+
+// detach unregisters the given request. A response that arrives for the
+// request after this point is dropped.
+func (w *multiplexWorker) detach(req *multiplexRequest) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.pending, req.id)
+	w.activeRequests--
+	if w.activeRequests > 0 {
+		return
+	}
+	if w.draining {
+		close(w.drained)
+	} else {
+		w.idleTimer = time.AfterFunc(multiplexWorkerIdleTimeout, w.onIdle)
+	}
+}
+
+// idle returns whether the worker has no active requests.
+func (w *multiplexWorker) idle() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.activeRequests == 0
+}
+
+func (w *multiplexWorker) write(requestProto *wkpb.WorkRequest) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return marshalWorkRequest(w.protocol, requestProto, w.stdin)
+}
+
+// exitError returns the error to report to requests that were in flight when
+// the worker exited.
+func (w *multiplexWorker) exitError() error {
+	w.mu.Lock()
+	err := w.err
+	w.mu.Unlock()
+	return status.UnavailableErrorf(
+		"failed to read persistent work response: %s\npersistent worker stderr:\n%s",
+		err, w.stderrDebugString())
+}
+
+func (w *multiplexWorker) stderrDebugString() string {
+	stderr, _ := w.stderr.ReadAll()
+	str := string(stderr)
+	if str == "" {
+		return "<empty>"
+	}
+	return str
+}
+
+// Do sends the attached request to the worker and waits for the response,
+// then detaches the request. The request's sandbox directory links to
+// workspaceDir, which must contain the request's inputs. If ctx is canceled
+// first, the request is canceled (if the worker supports cancellation) and
+// abandoned.
+func (w *multiplexWorker) Do(ctx context.Context, req *multiplexRequest, requestProto *wkpb.WorkRequest, workspaceDir string) (*wkpb.WorkResponse, error) {
+	defer w.detach(req)
+	id, ch := req.id, req.responses
+
+	// Request IDs are unique for the lifetime of the worker, so each request
+	// gets its own sandbox directory.
+	sandboxDir := filepath.Join(multiplexSandboxDirName, strconv.Itoa(int(id)))
+	sandboxPath := filepath.Join(w.workDir, sandboxDir)
+	if err := os.Symlink(workspaceDir, sandboxPath); err != nil {
+		return nil, status.UnavailableErrorf("failed to create multiplex worker sandbox directory: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(sandboxPath); err != nil {
+			log.CtxWarningf(ctx, "Failed to remove multiplex worker sandbox directory: %s", err)
+		}
+	}()
+
+	requestProto.RequestId = id
+	requestProto.SandboxDir = sandboxDir
+	if err := w.write(requestProto); err != nil {
+		return nil, status.UnavailableErrorf(
+			"failed to send persistent work request: %s\npersistent worker stderr:\n%s",
+			err, w.stderrDebugString())
+	}
+
+	select {
+	case responseProto := <-ch:
+		return responseProto, nil
+	case <-w.exited:
+		return nil, w.exitError()
+	case <-ctx.Done():
+	}
+
+	if w.supportsCancellation {
+		if err := w.write(&wkpb.WorkRequest{RequestId: id, Cancel: true}); err != nil {
+			log.CtxWarningf(ctx, "Failed to cancel multiplex work request %d: %s", id, err)
+		} else {
+			// Wait for the worker to stop working on the request, so that it
+			// doesn't keep writing to the workspace after the task is done.
+			select {
+			case <-ch:
+			case <-w.exited:
+			case <-time.After(multiplexWorkerCancelTimeout):
+				log.CtxWarningf(ctx, "Timed out waiting for multiplex worker to cancel request %d", id)
+			}
+		}
+	}
+	return nil, status.FromContextError(ctx)
+}
+
+// stop stops accepting new requests, waits for in-flight requests to finish
+// (up to multiplexWorkerDrainTimeout), then terminates the worker process and
+// removes its working directory.
+func (w *multiplexWorker) stop() error {
+	w.mu.Lock()
+	if !w.draining {
+		w.draining = true
+		if w.activeRequests == 0 {
+			close(w.drained)
+		}
+	}
+	if w.idleTimer != nil {
+		w.idleTimer.Stop()
+		w.idleTimer = nil
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.drained:
+	case <-w.exited:
+	case <-time.After(multiplexWorkerDrainTimeout):
+		log.Warningf("Timed out waiting for in-flight multiplex work requests to finish; terminating worker.")
+	}
+
+	// Canceling the worker context should terminate the worker process.
+	w.cancel()
+	ctx, cancel := background.ExtendContextForFinalization(context.Background(), persistentWorkerShutdownTimeout)
+	defer cancel()
+	select {
+	case <-w.terminated:
+	case <-ctx.Done():
+		return status.DeadlineExceededError("Timed out waiting for persistent worker to shut down.")
+	}
+	if err := os.RemoveAll(w.workDir); err != nil {
+		return status.UnavailableErrorf("failed to remove multiplex worker directory: %s", err)
+	}
+	return nil
+}
+
+// multiplexWorkerKey returns the key identifying the multiplex worker that
+// can serve the given runner's tasks.
+func multiplexWorkerKey(r *commandRunner) (string, error) {
+	b, err := proto.Marshal(r.key)
+	if err != nil {
+		return "", status.InternalErrorf("failed to marshal runner key: %s", err)
+	}
+	return string(b), nil
+}
+
+// getMultiplexWorker returns a live multiplex worker that can serve the given
+// runner's task, starting one if needed, along with a request attached to the
+// worker. Attaching while holding multiplexMu ensures that the worker isn't
+// retired for being idle before the request is sent.
+func (p *pool) getMultiplexWorker(ctx context.Context, r *commandRunner, command *repb.Command) (*multiplexWorker, *multiplexRequest, error) {
+	key, err := multiplexWorkerKey(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.multiplexMu.Lock()
+	defer p.multiplexMu.Unlock()
+
+	if w := p.multiplexWorkers[key]; w != nil {
+		if w.alive() {
+			req, err := w.attach()
+			return w, req, err
+		}
+		// The worker exited; clean it up and start a new one.
+		delete(p.multiplexWorkers, key)
+		go stopMultiplexWorker(w)
+	}
+	if p.multiplexShutdown {
+		return nil, nil, status.UnavailableError("Could not start a multiplex persistent worker because the executor is shutting down.")
+	}
+
+	workerArgs, _ := SplitArgsIntoWorkerArgsAndFlagFiles(command.GetArguments())
+	w, err := p.startMultiplexWorker(ctx, r, key, command, workerArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.multiplexWorkers[key] = w
+	log.CtxInfof(ctx, "Started multiplex persistent worker in %s", w.workDir)
+	req, err := w.attach()
+	return w, req, err
+}
+
+// retireMultiplexWorker unregisters the given worker and stops it, unless it
+// became busy again in the meantime.
+func (p *pool) retireMultiplexWorker(w *multiplexWorker) {
+	p.multiplexMu.Lock()
+	if p.multiplexWorkers[w.key] != w || !w.idle() {
+		p.multiplexMu.Unlock()
+		return
+	}
+	delete(p.multiplexWorkers, w.key)
+	p.multiplexMu.Unlock()
+	log.Infof("Stopping idle multiplex persistent worker in %s", w.workDir)
+	stopMultiplexWorker(w)
+}
+
+func stopMultiplexWorker(w *multiplexWorker) {
+	if err := w.stop(); err != nil {
+		log.Warningf("Failed to stop multiplex persistent worker: %s", err)
+	}
+}
+
+// stopMultiplexWorkers stops all multiplex workers and prevents new ones from
+// being started.
+func (p *pool) stopMultiplexWorkers() error {
+	p.multiplexMu.Lock()
+	p.multiplexShutdown = true
+	workers := p.multiplexWorkers
+	p.multiplexWorkers = map[string]*multiplexWorker{}
+	p.multiplexMu.Unlock()
+
+	var eg errgroup.Group
+	for _, w := range workers {
+		w := w
+		eg.Go(w.stop)
+	}
+	return eg.Wait()
+}
+
+// MultiplexWorkerCount returns the number of live multiplex persistent
+// workers.
+func (p *pool) MultiplexWorkerCount() int {
+	p.multiplexMu.Lock()
+	defer p.multiplexMu.Unlock()
+	return len(p.multiplexWorkers)
+}
+
+// sendMultiplexWorkRequest sends the runner's current task to a multiplex
+// worker, which may be shared with other runners.
+func (r *commandRunner) sendMultiplexWorkRequest(ctx context.Context, command *repb.Command) *interfaces.CommandResult {
+	result := &interfaces.CommandResult{
+		CommandDebugString: fmt.Sprintf("(persistentworker) %s", command.GetArguments()),
+		ExitCode:           commandutil.NoExitCode,
+	}
+
+	w, req, err := r.p.getMultiplexWorker(ctx, r, command)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	r.doNotReuse = true
+
+	_, flagFiles := SplitArgsIntoWorkerArgsAndFlagFiles(command.GetArguments())
+	requestProto, err := r.newWorkRequest(flagFiles)
+	if err != nil {
+		w.detach(req)
+		result.Error = err
+		return result
+	}
+
+	responseProto, err := w.Do(ctx, req, requestProto, r.Workspace.Path())
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	// Populate the result from the response proto.
+	result.Stderr = []byte(responseProto.Output)
+	result.ExitCode = int(responseProto.ExitCode)
+	r.doNotReuse = false
+	return result
+}
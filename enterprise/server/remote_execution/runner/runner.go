@@ -91,6 +91,18 @@ const (
 	// How long to spend waiting for a persistent worker process to terminate
 	// after we send the shutdown signal before giving up.
 	persistentWorkerShutdownTimeout = 10 * time.Second
+	// How long to wait for in-flight requests to a multiplex worker to finish
+	// before terminating the worker.
+	multiplexWorkerDrainTimeout = 1 * time.Minute
+	// How long to wait for a multiplex worker to acknowledge a cancel request
+	// before abandoning the request.
+	multiplexWorkerCancelTimeout = 5 * time.Second
+	// How long a multiplex worker can go without any requests before it is
+	// stopped.
+	multiplexWorkerIdleTimeout = 10 * time.Minute
+	// The directory inside of a multiplex worker's working directory that
+	// holds the sandbox directories of its requests.
+	multiplexSandboxDirName = "__sandbox"
 
 	// Memory usage estimate multiplier for pooled runners, relative to the
 	// default memory estimate for execution tasks.
@@ -519,6 +531,15 @@ type pool struct {
 	isShuttingDown bool
 	// runners holds all runners managed by the pool.
 	runners []*commandRunner
+
+	multiplexMu sync.Mutex // protects(multiplexWorkers, multiplexShutdown)
+	// multiplexWorkers holds the live multiplex persistent workers, keyed by
+	// runner key. Workers are owned by the pool rather than by any runner, and
+	// serve requests from every runner with the same key.
+	multiplexWorkers map[string]*multiplexWorker
+	// multiplexShutdown is set once the pool is shutting down, after which no
+	// new multiplex workers are started.
+	multiplexShutdown bool
 }
 
 func NewPool(env environment.Env, opts *PoolOptions) (*pool, error) {
@@ -539,6 +560,8 @@ func NewPool(env environment.Env, opts *PoolOptions) (*pool, error) {
 		buildRoot:      *rootDirectory,
 		imageCacheAuth: imageCacheAuth,
 		runners:        []*commandRunner{},
+
+		multiplexWorkers: map[string]*multiplexWorker{},
 	}
 	if err := p.initContainerProviders(); err != nil {
 		return nil, err
@@ -894,6 +917,15 @@ func (p *pool) Get(ctx context.Context, st *repb.ScheduledTask) (interfaces.Runn
 	if props.RecycleRunner && props.EnableVFS {
 		return nil, status.InvalidArgumentError("VFS is not yet supported for recycled runners")
 	}
+	if props.PersistentWorkerMultiplex && props.WorkloadIsolationType != string(platform.BareContainerType) {
+		// Multiplex workers read each task's inputs from the task's own
+		// workspace, which is only visible to the worker if it runs directly
+		// on the host.
+		return nil, status.InvalidArgumentErrorf("multiplex persistent workers are not supported for %q isolation", props.WorkloadIsolationType)
+	}
+	if props.PersistentWorkerMultiplex && props.EnableVFS {
+		return nil, status.InvalidArgumentError("multiplex persistent workers are not yet supported with VFS")
+	}
 
 	key := &rnpb.RunnerKey{
 		GroupId:             groupID,
@@ -1279,6 +1311,9 @@ func (p *pool) Shutdown(ctx context.Context) error {
 			errs = append(errs, err)
 		}
 	}
+	if err := p.stopMultiplexWorkers(); err != nil {
+		errs = append(errs, err)
+	}
 	if len(errs) > 0 {
 		return status.InternalErrorf("failed to shut down runner pool: %s", errSlice(errs))
 	}
@@ -1509,6 +1544,10 @@ func (r *commandRunner) startPersistentWorker(command *repb.Command, workerArgs,
 }
 
 func (r *commandRunner) sendPersistentWorkRequest(ctx context.Context, command *repb.Command) *interfaces.CommandResult {
+	if r.PlatformProperties.PersistentWorkerMultiplex {
+		return r.sendMultiplexWorkRequest(ctx, command)
+	}
+
 	// Clear any stderr that might be associated with a previous request.
 	r.stderr.Reset()
 
@@ -1527,32 +1566,14 @@ func (r *commandRunner) sendPersistentWorkRequest(ctx context.Context, command *
 	r.doNotReuse = true
 
 	// We've got a worker - now let's build a work request.
-	requestProto := &wkpb.WorkRequest{
-		Inputs: make([]*wkpb.Input, 0, len(r.Workspace.Inputs)),
-	}
-
-	expandedArguments, err := r.expandArguments(flagFiles)
+	requestProto, err := r.newWorkRequest(flagFiles)
 	if err != nil {
-		result.Error = status.WrapError(err, "expanding arguments")
+		result.Error = err
 		return result
 	}
-	requestProto.Arguments = expandedArguments
-
-	// Collect all of the input digests
-	for path, digest := range r.Workspace.Inputs {
-		digestBytes, err := proto.Marshal(digest)
-		if err != nil {
-			result.Error = status.WrapError(err, "marshalling input digest")
-			return result
-		}
-		requestProto.Inputs = append(requestProto.Inputs, &wkpb.Input{
-			Digest: digestBytes,
-			Path:   path,
-		})
-	}
 
 	// Encode the work requests
-	err = r.marshalWorkRequest(requestProto, r.stdinWriter)
+	err = marshalWorkRequest(r.PlatformProperties.PersistentWorkerProtocol, requestProto, r.stdinWriter)
 	if err != nil {
 		result.Error = status.UnavailableErrorf(
 			"failed to send persistent work request: %s\npersistent worker stderr:\n%s",
@@ -1562,7 +1583,7 @@ func (r *commandRunner) sendPersistentWorkRequest(ctx context.Context, command *
 
 	// Now we've sent a work request, let's collect our response.
 	responseProto := &wkpb.WorkResponse{}
-	err = r.unmarshalWorkResponse(responseProto, r.stdoutReader)
+	err = unmarshalWorkResponse(r.PlatformProperties.PersistentWorkerProtocol, responseProto, r.stdoutReader, r.jsonDecoder)
 	if err != nil {
 		result.Error = status.UnavailableErrorf(
 			"failed to read persistent work response: %s\npersistent worker stderr:\n%s",
@@ -1577,6 +1598,33 @@ func (r *commandRunner) sendPersistentWorkRequest(ctx context.Context, command *
 	return result
 }
 
+// newWorkRequest returns a WorkRequest for the runner's current task, with
+// arguments expanded from the given flag files.
+func (r *commandRunner) newWorkRequest(flagFiles []string) (*wkpb.WorkRequest, error) {
+	requestProto := &wkpb.WorkRequest{
+		Inputs: make([]*wkpb.Input, 0, len(r.Workspace.Inputs)),
+	}
+
+	expandedArguments, err := r.expandArguments(flagFiles)
+	if err != nil {
+		return nil, status.WrapError(err, "expanding arguments")
+	}
+	requestProto.Arguments = expandedArguments
+
+	// Collect all of the input digests
+	for path, digest := range r.Workspace.Inputs {
+		digestBytes, err := proto.Marshal(digest)
+		if err != nil {
+			return nil, status.WrapError(err, "marshalling input digest")
+		}
+		requestProto.Inputs = append(requestProto.Inputs, &wkpb.Input{
+			Digest: digestBytes,
+			Path:   path,
+		})
+	}
+	return requestProto, nil
+}
+
 func (r *commandRunner) workerStderrDebugString() string {
 	stderr, _ := r.stderr.ReadAll()
 	str := string(stderr)
@@ -1586,8 +1634,7 @@ func (r *commandRunner) workerStderrDebugString() string {
 	return str
 }
 
-func (r *commandRunner) marshalWorkRequest(requestProto *wkpb.WorkRequest, writer io.Writer) error {
-	protocol := r.PlatformProperties.PersistentWorkerProtocol
+func marshalWorkRequest(protocol string, requestProto *wkpb.WorkRequest, writer io.Writer) error {
 	if protocol == workerProtocolJSONValue {
 		marshaler := &protojson.MarshalOptions{EmitUnpopulated: true}
 		out, err := marshaler.Marshal(requestProto)
@@ -1611,11 +1658,10 @@ func (r *commandRunner) marshalWorkRequest(requestProto *wkpb.WorkRequest, write
 	return err
 }
 
-func (r *commandRunner) unmarshalWorkResponse(responseProto *wkpb.WorkResponse, reader io.Reader) error {
-	protocol := r.PlatformProperties.PersistentWorkerProtocol
+func unmarshalWorkResponse(protocol string, responseProto *wkpb.WorkResponse, reader *bufio.Reader, jsonDecoder *json.Decoder) error {
 	if protocol == workerProtocolJSONValue {
 		raw := json.RawMessage{}
-		if err := r.jsonDecoder.Decode(&raw); err != nil {
+		if err := jsonDecoder.Decode(&raw); err != nil {
 			return err
 		}
 		return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(raw, responseProto)
@@ -1624,13 +1670,13 @@ func (r *commandRunner) unmarshalWorkResponse(responseProto *wkpb.WorkResponse,
 		return status.FailedPreconditionErrorf("unsupported persistent worker type %s", protocol)
 	}
 	// Read the response size from stdout as a unsigned varint.
-	size, err := binary.ReadUvarint(r.stdoutReader)
+	size, err := binary.ReadUvarint(reader)
 	if err != nil {
 		return err
 	}
 	data := make([]byte, size)
 	// Read the response proto from stdout.
-	if _, err := io.ReadFull(r.stdoutReader, data); err != nil {
+	if _, err := io.ReadFull(reader, data); err != nil {
 		return err
 	}
 	if err := proto.Unmarshal(data, responseProto); err != nil {
@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"testing"
@@ -765,3 +766,134 @@ func TestRunnerPool_PersistentWorker_Crash_ShowsWorkerStderrInOutput(t *testing.
 	pool.TryRecycle(ctx, r, true)
 	assert.Equal(t, 0, pool.PausedRunnerCount())
 }
+
+func newMultiplexRunnerTask(t *testing.T, protocol string, batchSize int, cancellation bool, resp *wkpb.WorkResponse) *repb.ScheduledTask {
+	st := newPersistentRunnerTask(t, "abc", fmt.Sprintf("--batch_size=%d", batchSize), protocol, resp)
+	cmd := st.ExecutionTask.Command
+	cmd.Arguments = append(cmd.Arguments, "--multiplex")
+	cmd.Platform.Properties = append(
+		cmd.Platform.Properties,
+		&repb.Platform_Property{Name: "persistentWorkerMultiplex", Value: "true"},
+		&repb.Platform_Property{Name: "persistentWorkerCancellation", Value: fmt.Sprintf("%t", cancellation)},
+	)
+	return st
+}
+
+func TestRunnerPool_MultiplexWorker_ConcurrentTasksShareWorker(t *testing.T) {
+	for _, protocol := range []string{"proto", "json"} {
+		resp := &wkpb.WorkResponse{
+			ExitCode: 0,
+			Output:   "Test output!",
+		}
+		env := newTestEnv(t)
+		pool := newRunnerPool(t, env, noLimitsCfg)
+		ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+
+		// The worker only responds once it has received both requests, so
+		// both tasks must be attached to the same worker at the same time.
+		r1, err := get(ctx, pool, newMultiplexRunnerTask(t, protocol, 2, false, resp))
+		require.NoError(t, err)
+		r2, err := get(ctx, pool, newMultiplexRunnerTask(t, protocol, 2, false, resp))
+		require.NoError(t, err)
+		require.NotSame(t, r1, r2)
+
+		var wg sync.WaitGroup
+		for _, r := range []*commandRunner{r1, r2} {
+			r := r
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res := r.Run(ctx)
+				assert.NoError(t, res.Error)
+				assert.Equal(t, 0, res.ExitCode)
+				assert.Equal(t, []byte(resp.Output), res.Stderr)
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 1, pool.MultiplexWorkerCount())
+
+		pool.TryRecycle(ctx, r1, true)
+		pool.TryRecycle(ctx, r2, true)
+		assert.Equal(t, 2, pool.PausedRunnerCount())
+		assert.Equal(t, 1, pool.MultiplexWorkerCount())
+	}
+}
+
+func TestRunnerPool_MultiplexWorker_CanceledTaskDoesNotStopWorker(t *testing.T) {
+	resp := &wkpb.WorkResponse{
+		ExitCode: 0,
+		Output:   "Test output!",
+	}
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg)
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+
+	r, err := pool.Get(ctx, newMultiplexRunnerTask(t, "proto", 2, true /*=cancellation*/, resp))
+	require.NoError(t, err)
+
+	// The worker waits for a second request that never comes, so the task
+	// only finishes once it is canceled.
+	runCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	res := r.Run(runCtx)
+	require.Error(t, res.Error)
+	assert.True(t, status.IsDeadlineExceededError(res.Error), "unexpected error: %s", res.Error)
+
+	// The worker isn't tied to the runner, so it should still be able to
+	// serve other tasks once the runner is removed.
+	pool.TryRecycle(ctx, r, false)
+	assert.Equal(t, 0, pool.RunnerCount())
+	assert.Equal(t, 1, pool.MultiplexWorkerCount())
+}
+
+func TestRunnerPool_MultiplexWorker_RequestsUseOwnSandboxDir(t *testing.T) {
+	resp := &wkpb.WorkResponse{ExitCode: 0}
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg)
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+
+	var runners []*commandRunner
+	for i := 0; i < 2; i++ {
+		st := newMultiplexRunnerTask(t, "proto", 2, false, resp)
+		st.ExecutionTask.Command.Arguments = append(st.ExecutionTask.Command.Arguments, "--sandbox_file=input.txt")
+		r, err := get(ctx, pool, st)
+		require.NoError(t, err)
+		testfs.WriteAllFileContents(t, r.Workspace.Path(), map[string]string{"input.txt": fmt.Sprintf("input %d", i)})
+		runners = append(runners, r)
+	}
+
+	// Each request should see the inputs of its own runner's workspace
+	// through its sandbox_dir, which is relative to the worker's working
+	// directory.
+	var wg sync.WaitGroup
+	for i, r := range runners {
+		i, r := i, r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := r.Run(ctx)
+			assert.NoError(t, res.Error)
+			assert.Equal(t, fmt.Sprintf("input %d", i), string(res.Stderr))
+		}()
+	}
+	wg.Wait()
+
+	// The sandbox directories should be cleaned up once the requests are
+	// done, and the worker directory once the pool is shut down.
+	require.Equal(t, 1, pool.MultiplexWorkerCount())
+	var workDir string
+	pool.multiplexMu.Lock()
+	for _, w := range pool.multiplexWorkers {
+		workDir = w.workDir
+	}
+	pool.multiplexMu.Unlock()
+	entries, err := os.ReadDir(filepath.Join(workDir, multiplexSandboxDirName))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	for _, r := range runners {
+		pool.TryRecycle(ctx, r, true)
+	}
+	require.NoError(t, pool.Shutdown(ctx))
+	assert.Equal(t, 0, pool.MultiplexWorkerCount())
+	assert.NoDirExists(t, workDir)
+}
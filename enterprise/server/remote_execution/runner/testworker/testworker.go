@@ -4,14 +4,22 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	wkpb "github.com/buildbuddy-io/buildbuddy/proto/worker"
 )
 
 var (
@@ -20,6 +28,9 @@ var (
 	protocol       = flag.String("protocol", "proto", "Serialization protocol: 'json' or 'proto'.")
 	responseBase64 = flag.String("response_base64", "", "Base64-encoded response to return for every request. Includes varint length prefix (for proto responses).")
 	failWithStderr = flag.String("fail_with_stderr", "", "If non-empty, the worker will crash upon receiving the first request, printing the given message to stderr.")
+	multiplex      = flag.Bool("multiplex", false, "If set, the worker speaks the multiplex protocol: each response has the request ID of the corresponding request, and cancel requests are acknowledged.")
+	batchSize      = flag.Int("batch_size", 1, "Multiplex only: the number of requests to wait for before responding to them, in reverse order.")
+	sandboxFile    = flag.String("sandbox_file", "", "Multiplex only: if set, the output of each response is the contents of this file in the request's sandbox directory.")
 )
 
 func main() {
@@ -34,7 +45,7 @@ func main() {
 		panic(err)
 	}
 
-	var br io.ByteReader
+	var br *bufio.Reader
 	var dec *json.Decoder
 	if *protocol == "json" {
 		dec = json.NewDecoder(os.Stdin)
@@ -42,18 +53,17 @@ func main() {
 		br = bufio.NewReader(os.Stdin)
 	}
 
+	if *multiplex {
+		serveMultiplex(resBytes, br, dec)
+		return
+	}
+
 	for {
 		// Note: Logging goes to stderr, so it doesn't mess with the persistent
 		// worker's output.
 		log.Info("[worker] Waiting for request...")
-		if *protocol == "json" {
-			if err := readJSONRequest(dec); err != nil {
-				panic(err)
-			}
-		} else {
-			if err := readProtoRequest(br); err != nil {
-				panic(err)
-			}
+		if _, err := readRequest(br, dec); err != nil {
+			panic(err)
 		}
 
 		if *failWithStderr != "" {
@@ -73,22 +83,113 @@ func main() {
 	}
 }
 
-func readProtoRequest(r io.ByteReader) error {
-	reqSizeBytes, err := binary.ReadUvarint(r)
+func serveMultiplex(resBytes []byte, br *bufio.Reader, dec *json.Decoder) {
+	template, err := parseResponse(resBytes)
 	if err != nil {
-		return err
+		panic(err)
 	}
-	reqBytes := make([]byte, reqSizeBytes)
-	for i := 0; i < int(reqSizeBytes); i++ {
-		reqBytes[i], err = r.ReadByte()
+	var batch []*wkpb.WorkRequest
+	for {
+		log.Info("[worker] Waiting for request...")
+		req, err := readRequest(br, dec)
 		if err != nil {
-			return err
+			panic(err)
+		}
+		if req.GetCancel() {
+			log.Infof("[worker] Canceling request %d", req.GetRequestId())
+			for i, r := range batch {
+				if r.GetRequestId() == req.GetRequestId() {
+					batch = append(batch[:i], batch[i+1:]...)
+					break
+				}
+			}
+			writeResponse(&wkpb.WorkResponse{RequestId: req.GetRequestId(), WasCancelled: true})
+			continue
+		}
+		log.Infof("[worker] Got request %d", req.GetRequestId())
+		batch = append(batch, req)
+		if len(batch) < *batchSize {
+			continue
+		}
+		for i := len(batch) - 1; i >= 0; i-- {
+			res := proto.Clone(template).(*wkpb.WorkResponse)
+			res.RequestId = batch[i].GetRequestId()
+			if *sandboxFile != "" {
+				res.Output = readSandboxFile(batch[i])
+			}
+			writeResponse(res)
+		}
+		batch = nil
+	}
+}
+
+// readSandboxFile returns the contents of --sandbox_file in the request's
+// sandbox directory, or an error message if the sandbox directory is invalid.
+func readSandboxFile(req *wkpb.WorkRequest) string {
+	dir := req.GetSandboxDir()
+	if dir == "" || filepath.IsAbs(dir) || strings.HasPrefix(filepath.Clean(dir), "..") {
+		return fmt.Sprintf("invalid sandbox_dir %q", dir)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, *sandboxFile))
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+func readRequest(br *bufio.Reader, dec *json.Decoder) (*wkpb.WorkRequest, error) {
+	req := &wkpb.WorkRequest{}
+	if *protocol == "json" {
+		raw := json.RawMessage{}
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
 		}
+		return req, protojson.Unmarshal(raw, req)
+	}
+	reqSizeBytes, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	reqBytes := make([]byte, reqSizeBytes)
+	if _, err := io.ReadFull(br, reqBytes); err != nil {
+		return nil, err
+	}
+	return req, proto.Unmarshal(reqBytes, req)
+}
+
+func parseResponse(b []byte) (*wkpb.WorkResponse, error) {
+	res := &wkpb.WorkResponse{}
+	if *protocol == "json" {
+		return res, protojson.Unmarshal(b, res)
+	}
+	r := bytes.NewReader(b)
+	if _, err := binary.ReadUvarint(r); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return res, proto.Unmarshal(data, res)
 }
 
-func readJSONRequest(decoder *json.Decoder) error {
-	raw := json.RawMessage{}
-	return decoder.Decode(&raw)
+func writeResponse(res *wkpb.WorkResponse) {
+	var buf []byte
+	if *protocol == "json" {
+		out, err := protojson.Marshal(res)
+		if err != nil {
+			panic(err)
+		}
+		buf = append(out, '\n')
+	} else {
+		out, err := proto.Marshal(res)
+		if err != nil {
+			panic(err)
+		}
+		buf = binary.AppendUvarint(nil, uint64(len(out)))
+		buf = append(buf, out...)
+	}
+	if _, err := os.Stdout.Write(buf); err != nil {
+		panic(err)
+	}
 }
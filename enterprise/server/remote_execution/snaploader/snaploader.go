@@ -3,6 +3,8 @@ package snaploader
 import (
 	"bufio"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"os"
@@ -13,8 +15,10 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/filecacheutil"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flagutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/hash"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
@@ -22,16 +26,27 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 
 	fcpb "github.com/buildbuddy-io/buildbuddy/proto/firecracker"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 )
 
-var EnableLocalSnapshotSharing = flag.Bool("executor.enable_local_snapshot_sharing", false, "Enables local snapshot sharing for firecracker VMs. Also requires that executor.firecracker_enable_nbd is true.")
+var (
+	EnableLocalSnapshotSharing  = flag.Bool("executor.enable_local_snapshot_sharing", false, "Enables local snapshot sharing for firecracker VMs. Also requires that executor.firecracker_enable_nbd is true.")
+	EnableRemoteSnapshotSharing = flag.Bool("executor.enable_remote_snapshot_sharing", false, "Enables remote snapshot sharing for firecracker VMs, which stores snapshots in the remote cache so that they can be resumed on other executors. Also requires that executor.enable_local_snapshot_sharing is true and that executor.remote_snapshot_signing_key is set.")
+
+	remoteSnapshotSigningKey = flagutil.New("executor.remote_snapshot_signing_key", "", "Key used to sign snapshot manifests stored in the remote cache. Executors only resume remote snapshots signed with this key, so it must be shared by all executors that share snapshots, and must not be known to clients.", flagutil.SecretTag)
+)
 
 const (
 	// File name used for the rootfs snapshot artifact.
 	rootfsFileName = "rootfs.ext4"
+
+	// The digest function used for snapshot artifacts. Artifact digests are
+	// only valid CAS digests if local snapshot sharing is enabled.
+	artifactDigestFunction = repb.DigestFunction_BLAKE3
 )
 
 // NewKey returns the cache key for a snapshot.
@@ -64,6 +79,20 @@ func manifestFileCacheKey(ctx context.Context, env environment.Env, s *fcpb.Snap
 	return key
 }
 
+// manifestACKey returns the action cache key for the snapshot manifest.
+//
+// Like the filecache manifest key, this key is overwritten whenever a newer
+// snapshot is saved, so that runners always resume from the newest snapshot.
+// The action cache is already partitioned by group, so the group ID doesn't
+// need to be part of the key.
+func manifestACKey(key *fcpb.SnapshotKey) (*digest.ResourceName, error) {
+	d, err := digest.ComputeForMessage(key, repb.DigestFunction_SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return digest.NewResourceName(d, key.GetInstanceName(), rspb.CacheType_AC, repb.DigestFunction_SHA256), nil
+}
+
 // artifactFileCacheKey returns the cache key for a snapshot artifact.
 // It reads the artifact using fileReader in order to compute a digest
 // of its contents
@@ -186,6 +215,10 @@ type Loader interface {
 	DeleteSnapshot(ctx context.Context, snapshot *Snapshot) error
 }
 
+// FileCacheLoader stores snapshots in the local executor filecache. If remote
+// snapshot sharing is enabled, it also stores snapshot manifests in the
+// action cache and snapshot artifacts in the CAS, and fetches them from there
+// when they are missing from the filecache.
 type FileCacheLoader struct {
 	env environment.Env
 }
@@ -194,10 +227,51 @@ func New(env environment.Env) (*FileCacheLoader, error) {
 	if env.GetFileCache() == nil {
 		return nil, status.InvalidArgumentError("missing FileCache in env")
 	}
+	if *EnableRemoteSnapshotSharing {
+		if !*EnableLocalSnapshotSharing {
+			return nil, status.FailedPreconditionError("remote snapshot sharing requires local snapshot sharing to be enabled")
+		}
+		if env.GetActionCacheClient() == nil || env.GetByteStreamClient() == nil || env.GetContentAddressableStorageClient() == nil {
+			return nil, status.FailedPreconditionError("remote snapshot sharing requires a remote cache")
+		}
+		if *remoteSnapshotSigningKey == "" {
+			return nil, status.FailedPreconditionError("remote snapshot sharing requires executor.remote_snapshot_signing_key to be set")
+		}
+	}
 	return &FileCacheLoader{env: env}, nil
 }
 
 func (l *FileCacheLoader) GetSnapshot(ctx context.Context, key *fcpb.SnapshotKey) (*Snapshot, error) {
+	// Prefer the local snapshot, so that resuming a snapshot that is fully
+	// available on this executor doesn't require a round trip to the remote
+	// cache. The remote snapshot is only used if the local one is missing or
+	// incomplete.
+	//
+	// Checking whether all artifacts in the manifest are available helps make
+	// sure that the snapshot we return can actually be loaded. This also
+	// updates the last access time of all the artifacts, which helps prevent
+	// the snapshot artifacts from expiring just after we've returned it.
+	manifest, err := l.readLocalManifest(ctx, key)
+	if err == nil {
+		err = l.checkAllArtifactsExist(ctx, key, manifest, false /*=allowRemote*/)
+	}
+	if err == nil {
+		return &Snapshot{key: key, manifest: manifest}, nil
+	}
+	if !*EnableRemoteSnapshotSharing {
+		return nil, err
+	}
+	manifest, err = l.fetchRemoteManifest(ctx, key)
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to fetch remote snapshot manifest: %s", status.Message(err))
+	}
+	if err := l.checkAllArtifactsExist(ctx, key, manifest, true /*=allowRemote*/); err != nil {
+		return nil, err
+	}
+	return &Snapshot{key: key, manifest: manifest}, nil
+}
+
+func (l *FileCacheLoader) readLocalManifest(ctx context.Context, key *fcpb.SnapshotKey) (*fcpb.SnapshotManifest, error) {
 	manifestNode := manifestFileCacheKey(ctx, l.env, key)
 	buf, err := filecacheutil.Read(l.env.GetFileCache(), manifestNode)
 	if err != nil {
@@ -207,16 +281,171 @@ func (l *FileCacheLoader) GetSnapshot(ctx context.Context, key *fcpb.SnapshotKey
 	if err := proto.Unmarshal(buf, manifest); err != nil {
 		return nil, status.UnavailableErrorf("failed to unmarshal snapshot manifest: %s", status.Message(err))
 	}
+	return manifest, nil
+}
 
-	// Check whether all artifacts in the manifest are available. This helps
-	// make sure that the snapshot we return can actually be loaded. This also
-	// updates the last access time of all the artifacts, which helps prevent
-	// the snapshot artifacts from expiring just after we've returned it.
-	if err := l.checkAllArtifactsExist(ctx, manifest); err != nil {
+// manifestSignature returns the signature of a serialized snapshot manifest
+// that is stored in the remote cache under the given action cache key. The
+// group ID and key are signed along with the manifest so that a manifest
+// can't be replayed under a different key.
+func manifestSignature(groupID string, acKey *digest.ResourceName, manifest []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(*remoteSnapshotSigningKey))
+	for _, b := range [][]byte{[]byte(groupID), []byte(acKey.GetInstanceName()), []byte(acKey.GetDigest().GetHash()), manifest} {
+		// Length-prefix each field so that field boundaries are unambiguous.
+		mac.Write([]byte(fmt.Sprintf("%d:", len(b))))
+		mac.Write(b)
+	}
+	return mac.Sum(nil)
+}
+
+// fetchRemoteManifest reads the snapshot manifest from the action cache,
+// where it is stored as auxiliary metadata of an otherwise empty action
+// result. Clients can write to the action cache, so the manifest is only
+// returned if it was signed by an executor.
+func (l *FileCacheLoader) fetchRemoteManifest(ctx context.Context, key *fcpb.SnapshotKey) (*fcpb.SnapshotManifest, error) {
+	acKey, err := manifestACKey(key)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := groupID(ctx, l.env)
+	if err != nil {
 		return nil, err
 	}
+	ar, err := cachetools.GetActionResult(ctx, l.env.GetActionCacheClient(), acKey)
+	if err != nil {
+		return nil, err
+	}
+	signed := &fcpb.SignedSnapshotManifest{}
+	for _, m := range ar.GetExecutionMetadata().GetAuxiliaryMetadata() {
+		if !m.MessageIs(signed) {
+			continue
+		}
+		if err := m.UnmarshalTo(signed); err != nil {
+			return nil, status.WrapError(err, "unmarshal signed snapshot manifest")
+		}
+		if !hmac.Equal(signed.GetSignature(), manifestSignature(gid, acKey, signed.GetManifest())) {
+			return nil, status.PermissionDeniedError("snapshot manifest signature is invalid")
+		}
+		manifest := &fcpb.SnapshotManifest{}
+		if err := proto.Unmarshal(signed.GetManifest(), manifest); err != nil {
+			return nil, status.WrapError(err, "unmarshal snapshot manifest")
+		}
+		return manifest, nil
+	}
+	return nil, status.NotFoundError("action result is missing the snapshot manifest")
+}
 
-	return &Snapshot{key: key, manifest: manifest}, nil
+func (l *FileCacheLoader) uploadRemoteManifest(ctx context.Context, key *fcpb.SnapshotKey, manifest *fcpb.SnapshotManifest) error {
+	acKey, err := manifestACKey(key)
+	if err != nil {
+		return err
+	}
+	gid, err := groupID(ctx, l.env)
+	if err != nil {
+		return err
+	}
+	b, err := proto.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	m, err := anypb.New(&fcpb.SignedSnapshotManifest{
+		Manifest:  b,
+		Signature: manifestSignature(gid, acKey, b),
+	})
+	if err != nil {
+		return err
+	}
+	ar := &repb.ActionResult{
+		ExecutionMetadata: &repb.ExecutedActionMetadata{
+			AuxiliaryMetadata: []*anypb.Any{m},
+		},
+	}
+	return cachetools.UploadActionResult(ctx, l.env.GetActionCacheClient(), acKey, ar)
+}
+
+// findMissingRemoteArtifacts returns the digests that are missing from the
+// remote CAS.
+func (l *FileCacheLoader) findMissingRemoteArtifacts(ctx context.Context, instanceName string, digests []*repb.Digest) ([]*repb.Digest, error) {
+	if len(digests) == 0 {
+		return nil, nil
+	}
+	rsp, err := l.env.GetContentAddressableStorageClient().FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+		InstanceName:   instanceName,
+		BlobDigests:    digests,
+		DigestFunction: artifactDigestFunction,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rsp.GetMissingBlobDigests(), nil
+}
+
+// uploadArtifacts uploads the snapshot artifacts at the given paths to the
+// remote CAS, skipping any artifacts that are already stored there. This
+// avoids re-uploading chunks that didn't change since the snapshot was
+// last unpacked.
+func (l *FileCacheLoader) uploadArtifacts(ctx context.Context, instanceName string, paths map[string]string, digests map[string]*repb.Digest) error {
+	all := make([]*repb.Digest, 0, len(digests))
+	for _, d := range digests {
+		all = append(all, d)
+	}
+	missing, err := l.findMissingRemoteArtifacts(ctx, instanceName, all)
+	if err != nil {
+		return status.WrapError(err, "find missing snapshot artifacts")
+	}
+	for _, d := range missing {
+		if err := l.uploadArtifact(ctx, instanceName, d, paths[d.GetHash()]); err != nil {
+			return status.WrapErrorf(err, "upload snapshot artifact %q", digest.String(d))
+		}
+	}
+	return nil
+}
+
+func (l *FileCacheLoader) uploadArtifact(ctx context.Context, instanceName string, d *repb.Digest, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rn := digest.NewResourceName(d, instanceName, rspb.CacheType_CAS, artifactDigestFunction)
+	_, err = cachetools.UploadFromReader(ctx, l.env.GetByteStreamClient(), rn, f)
+	return err
+}
+
+// fetchArtifact downloads a snapshot artifact from the remote CAS to path and
+// adds it to the filecache.
+func (l *FileCacheLoader) fetchArtifact(ctx context.Context, instanceName string, node *repb.FileNode, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	rn := digest.NewResourceName(node.GetDigest(), instanceName, rspb.CacheType_CAS, artifactDigestFunction)
+	if err := cachetools.GetBlob(ctx, l.env.GetByteStreamClient(), rn, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	l.env.GetFileCache().AddFile(node, path)
+	return nil
+}
+
+// linkOrFetchArtifact links a snapshot artifact from the filecache to path,
+// falling back to fetching it from the remote CAS if remote snapshot sharing
+// is enabled.
+func (l *FileCacheLoader) linkOrFetchArtifact(ctx context.Context, instanceName string, node *repb.FileNode, path string) bool {
+	if l.env.GetFileCache().FastLinkFile(node, path) {
+		return true
+	}
+	if !*EnableRemoteSnapshotSharing {
+		return false
+	}
+	if err := l.fetchArtifact(ctx, instanceName, node, path); err != nil {
+		log.CtxWarningf(ctx, "Failed to fetch snapshot artifact %q from remote cache: %s", digest.String(node.GetDigest()), err)
+		return false
+	}
+	return true
 }
 
 func (l *FileCacheLoader) UnpackSnapshot(ctx context.Context, snapshot *Snapshot, outputDirectory string) (*UnpackedSnapshot, error) {
@@ -225,8 +454,8 @@ func (l *FileCacheLoader) UnpackSnapshot(ctx context.Context, snapshot *Snapshot
 	}
 
 	for _, fileNode := range snapshot.manifest.Files {
-		if !l.env.GetFileCache().FastLinkFile(fileNode, filepath.Join(outputDirectory, fileNode.GetName())) {
-			return nil, status.UnavailableErrorf("snapshot artifact %q not found in local cache", fileNode.GetName())
+		if !l.linkOrFetchArtifact(ctx, snapshot.key.GetInstanceName(), fileNode, filepath.Join(outputDirectory, fileNode.GetName())) {
+			return nil, status.UnavailableErrorf("snapshot artifact %q not found in cache", fileNode.GetName())
 		}
 	}
 
@@ -235,7 +464,7 @@ func (l *FileCacheLoader) UnpackSnapshot(ctx context.Context, snapshot *Snapshot
 	}
 	// Construct COWs from chunks.
 	for _, cf := range snapshot.manifest.ChunkedFiles {
-		cow, err := l.unpackCOW(ctx, cf, outputDirectory)
+		cow, err := l.unpackCOW(ctx, snapshot.key.GetInstanceName(), cf, outputDirectory)
 		if err != nil {
 			return nil, status.WrapError(err, "unpack COW")
 		}
@@ -246,7 +475,9 @@ func (l *FileCacheLoader) UnpackSnapshot(ctx context.Context, snapshot *Snapshot
 }
 
 func (l *FileCacheLoader) DeleteSnapshot(ctx context.Context, snapshot *Snapshot) error {
-	// Manually evict the manifest as well as all referenced files.
+	// Manually evict the manifest as well as all referenced files. Remote
+	// snapshots are left to expire from the remote cache, since they may be
+	// in use by other executors.
 	l.env.GetFileCache().DeleteFile(manifestFileCacheKey(ctx, l.env, snapshot.key))
 	for _, fileNode := range snapshot.manifest.Files {
 		l.env.GetFileCache().DeleteFile(fileNode)
@@ -258,6 +489,10 @@ func (l *FileCacheLoader) CacheSnapshot(ctx context.Context, key *fcpb.SnapshotK
 	manifest := &fcpb.SnapshotManifest{
 		VmConfiguration: opts.VMConfiguration,
 	}
+	// Paths and digests of the artifacts to upload to the remote cache, keyed
+	// by digest hash.
+	remotePaths := map[string]string{}
+	remoteDigests := map[string]*repb.Digest{}
 	// Put the files from the snapshot into the filecache and record their
 	// names and digests in the manifest so they can be unpacked later.
 	for _, f := range enumerateFiles(opts) {
@@ -275,6 +510,8 @@ func (l *FileCacheLoader) CacheSnapshot(ctx context.Context, key *fcpb.SnapshotK
 		}
 		fileNode.Name = filepath.Base(f)
 		manifest.Files = append(manifest.Files, fileNode)
+		remotePaths[fileNode.GetDigest().GetHash()] = f
+		remoteDigests[fileNode.GetDigest().GetHash()] = fileNode.GetDigest()
 
 		// If EnableLocalSnapshotSharing=true and we're computing real digests,
 		// the files will be immutable. We won't need to re-save them to file cache
@@ -288,6 +525,11 @@ func (l *FileCacheLoader) CacheSnapshot(ctx context.Context, key *fcpb.SnapshotK
 			return nil, status.WrapErrorf(err, "cache %q COW", name)
 		}
 		manifest.ChunkedFiles = append(manifest.ChunkedFiles, cf)
+		for _, c := range cf.GetChunks() {
+			d := &repb.Digest{Hash: c.GetDigestHash(), SizeBytes: chunkDigestSize(cf, c)}
+			remotePaths[d.GetHash()] = filepath.Join(cow.DataDir(), cow.ChunkName(c.GetOffset()))
+			remoteDigests[d.GetHash()] = d
+		}
 	}
 	// Write the manifest file and put it in the filecache too. We'll
 	// retrieve this later in order to unpack the snapshot.
@@ -299,13 +541,43 @@ func (l *FileCacheLoader) CacheSnapshot(ctx context.Context, key *fcpb.SnapshotK
 	if _, err := filecacheutil.Write(l.env.GetFileCache(), manifestNode, b); err != nil {
 		return nil, err
 	}
+	if *EnableRemoteSnapshotSharing {
+		// The snapshot can be resumed locally even if it can't be shared, so
+		// don't fail the task if the remote cache is unavailable.
+		if err := l.cacheRemoteSnapshot(ctx, key, manifest, remotePaths, remoteDigests); err != nil {
+			log.CtxWarningf(ctx, "Failed to cache snapshot in remote cache: %s", err)
+			metrics.RemoteSnapshotUploadFailures.Inc()
+		}
+	}
 	return &Snapshot{key: key, manifest: manifest}, nil
 }
 
-func (l *FileCacheLoader) checkAllArtifactsExist(ctx context.Context, manifest *fcpb.SnapshotManifest) error {
+// cacheRemoteSnapshot uploads the snapshot artifacts and manifest to the
+// remote cache.
+func (l *FileCacheLoader) cacheRemoteSnapshot(ctx context.Context, key *fcpb.SnapshotKey, manifest *fcpb.SnapshotManifest, paths map[string]string, digests map[string]*repb.Digest) error {
+	// Upload the artifacts before the manifest, so that the remote manifest
+	// never references artifacts that don't exist.
+	if err := l.uploadArtifacts(ctx, key.GetInstanceName(), paths, digests); err != nil {
+		return err
+	}
+	if err := l.uploadRemoteManifest(ctx, key, manifest); err != nil {
+		return status.WrapError(err, "upload snapshot manifest")
+	}
+	return nil
+}
+
+// checkAllArtifactsExist checks that all artifacts in the manifest exist in
+// the filecache. If allowRemote is true, artifacts that are missing locally
+// may instead exist in the remote CAS, from where they are fetched lazily
+// when the snapshot is unpacked.
+func (l *FileCacheLoader) checkAllArtifactsExist(ctx context.Context, key *fcpb.SnapshotKey, manifest *fcpb.SnapshotManifest, allowRemote bool) error {
+	var missingLocally []*repb.Digest
 	for _, f := range manifest.GetFiles() {
 		if !l.env.GetFileCache().ContainsFile(f) {
-			return status.NotFoundErrorf("file %q not found (digest %q)", f.GetName(), digest.String(f.GetDigest()))
+			if !allowRemote {
+				return status.NotFoundErrorf("file %q not found (digest %q)", f.GetName(), digest.String(f.GetDigest()))
+			}
+			missingLocally = append(missingLocally, f.GetDigest())
 		}
 	}
 	for _, cf := range manifest.GetChunkedFiles() {
@@ -317,14 +589,24 @@ func (l *FileCacheLoader) checkAllArtifactsExist(ctx context.Context, manifest *
 				},
 			}
 			if !l.env.GetFileCache().ContainsFile(node) {
-				return status.NotFoundErrorf("chunked file %q missing chunk at offset 0x%x (digest %q)", cf.GetName(), c.GetOffset(), digest.String(node.Digest))
+				if !allowRemote {
+					return status.NotFoundErrorf("chunked file %q missing chunk at offset 0x%x (digest %q)", cf.GetName(), c.GetOffset(), digest.String(node.Digest))
+				}
+				missingLocally = append(missingLocally, node.GetDigest())
 			}
 		}
 	}
+	missing, err := l.findMissingRemoteArtifacts(ctx, key.GetInstanceName(), missingLocally)
+	if err != nil {
+		return status.UnavailableErrorf("failed to check for remote snapshot artifacts: %s", status.Message(err))
+	}
+	if len(missing) > 0 {
+		return status.NotFoundErrorf("%d snapshot artifacts not found (digest %q)", len(missing), digest.String(missing[0]))
+	}
 	return nil
 }
 
-func (l *FileCacheLoader) unpackCOW(ctx context.Context, file *fcpb.ChunkedFile, outputDirectory string) (cf *copy_on_write.COWStore, err error) {
+func (l *FileCacheLoader) unpackCOW(ctx context.Context, instanceName string, file *fcpb.ChunkedFile, outputDirectory string) (cf *copy_on_write.COWStore, err error) {
 	dataDir := filepath.Join(outputDirectory, file.GetName())
 	if err := os.Mkdir(dataDir, 0755); err != nil {
 		return nil, status.InternalErrorf("failed to create COW data dir %q: %s", dataDir, err)
@@ -347,8 +629,8 @@ func (l *FileCacheLoader) unpackCOW(ctx context.Context, file *fcpb.ChunkedFile,
 		d := &repb.Digest{Hash: chunk.GetDigestHash(), SizeBytes: size}
 		node := &repb.FileNode{Digest: d}
 		path := filepath.Join(dataDir, fmt.Sprintf("%d", chunk.GetOffset()))
-		if !l.env.GetFileCache().FastLinkFile(node, path) {
-			return nil, status.UnavailableErrorf("snapshot chunk %s/%d not found in local cache", file.GetName(), chunk.GetOffset())
+		if !l.linkOrFetchArtifact(ctx, instanceName, node, path) {
+			return nil, status.UnavailableErrorf("snapshot chunk %s/%d not found in cache", file.GetName(), chunk.GetOffset())
 		}
 		c, err := copy_on_write.NewLazyMmap(path, chunk.GetOffset())
 		if err != nil {
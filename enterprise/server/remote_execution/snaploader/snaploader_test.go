@@ -14,10 +14,14 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/filecache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/snaploader"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testcache"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
 	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
@@ -139,6 +143,154 @@ func TestPackAndUnpackChunkedFiles(t *testing.T) {
 	}
 }
 
+func TestRemoteSnapshotSharing(t *testing.T) {
+	flags.Set(t, "executor.enable_local_snapshot_sharing", true)
+	flags.Set(t, "executor.enable_remote_snapshot_sharing", true)
+	flags.Set(t, "executor.remote_snapshot_signing_key", "executor-secret")
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+	testcache.Setup(t, env)
+	workDir := testfs.MakeTempDir(t)
+
+	// Cache a snapshot on executor A.
+	fcA := newFileCache(t)
+	env.SetFileCache(fcA)
+	loaderA, err := snaploader.New(env)
+	require.NoError(t, err)
+	workDirA := testfs.MakeDirAll(t, workDir, "VM-A")
+	const chunkSize = 512 * 1024
+	const fileSize = 13 + (chunkSize * 10) // ~5 MB total, with uneven size
+	originalImagePath := makeRandomFile(t, workDirA, "scratchfs.ext4", fileSize)
+	chunkDirA := testfs.MakeDirAll(t, workDirA, "scratchfs_chunks")
+	cowA, err := copy_on_write.ConvertFileToCOW(originalImagePath, chunkSize, chunkDirA)
+	require.NoError(t, err)
+	key, err := snaploader.NewKey(&repb.ExecutionTask{}, "config-hash", "")
+	require.NoError(t, err)
+	optsA := makeFakeSnapshot(t, workDirA)
+	optsA.ChunkedFiles = map[string]*copy_on_write.COWStore{
+		"scratchfs": cowA,
+	}
+	_, err = loaderA.CacheSnapshot(ctx, key, optsA)
+	require.NoError(t, err)
+
+	// Executor B has an empty filecache, so it should fetch the snapshot
+	// from the remote cache.
+	env.SetFileCache(newFileCache(t))
+	loaderB, err := snaploader.New(env)
+	require.NoError(t, err)
+	snapB, err := loaderB.GetSnapshot(ctx, key)
+	require.NoError(t, err)
+	workDirB := testfs.MakeDirAll(t, workDir, "VM-B")
+	unpackedB := mustUnpack(t, ctx, loaderB, snapB, workDirB, optsA)
+
+	// Modify the snapshot on executor B and cache it again.
+	cowB := unpackedB.ChunkedFiles["scratchfs"]
+	writeRandomRange(t, cowB)
+	optsB := makeFakeSnapshot(t, workDirB)
+	optsB.ChunkedFiles = map[string]*copy_on_write.COWStore{
+		"scratchfs": cowB,
+	}
+	_, err = loaderB.CacheSnapshot(ctx, key, optsB)
+	require.NoError(t, err)
+
+	// Executor A still has its own snapshot locally, so it should resume
+	// from that without going to the remote cache.
+	env.SetFileCache(fcA)
+	snapA, err := loaderA.GetSnapshot(ctx, key)
+	require.NoError(t, err)
+	mustUnpack(t, ctx, loaderA, snapA, testfs.MakeDirAll(t, workDir, "VM-A-2"), optsA)
+
+	// Executor C has an empty filecache, so it should resume from executor
+	// B's snapshot, which is the newest one in the remote cache.
+	env.SetFileCache(newFileCache(t))
+	loaderC, err := snaploader.New(env)
+	require.NoError(t, err)
+	snapC, err := loaderC.GetSnapshot(ctx, key)
+	require.NoError(t, err)
+	mustUnpack(t, ctx, loaderC, snapC, testfs.MakeDirAll(t, workDir, "VM-C"), optsB)
+}
+
+func TestRemoteSnapshotSharing_RejectsUnsignedManifests(t *testing.T) {
+	flags.Set(t, "executor.enable_local_snapshot_sharing", true)
+	flags.Set(t, "executor.enable_remote_snapshot_sharing", true)
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+	testcache.Setup(t, env)
+	workDir := testfs.MakeTempDir(t)
+
+	// Remote snapshot sharing can't be enabled without a signing key.
+	env.SetFileCache(newFileCache(t))
+	_, err := snaploader.New(env)
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition; got: %v", err)
+
+	// Cache a snapshot using a signing key that isn't the executors' key,
+	// as a client that writes to the action cache directly could.
+	flags.Set(t, "executor.remote_snapshot_signing_key", "client-secret")
+	loader, err := snaploader.New(env)
+	require.NoError(t, err)
+	key, err := snaploader.NewKey(&repb.ExecutionTask{}, "config-hash", "")
+	require.NoError(t, err)
+	_, err = loader.CacheSnapshot(ctx, key, makeFakeSnapshot(t, workDir))
+	require.NoError(t, err)
+
+	// An executor with an empty filecache shouldn't resume the snapshot.
+	flags.Set(t, "executor.remote_snapshot_signing_key", "executor-secret")
+	env.SetFileCache(newFileCache(t))
+	loader, err = snaploader.New(env)
+	require.NoError(t, err)
+	_, err = loader.GetSnapshot(ctx, key)
+	require.True(t, status.IsUnavailableError(err), "expected Unavailable; got: %v", err)
+}
+
+// unavailableActionCache is an action cache client that fails all writes.
+type unavailableActionCache struct {
+	repb.ActionCacheClient
+}
+
+func (*unavailableActionCache) UpdateActionResult(ctx context.Context, req *repb.UpdateActionResultRequest, opts ...grpc.CallOption) (*repb.ActionResult, error) {
+	return nil, status.UnavailableError("action cache is down")
+}
+
+func TestRemoteSnapshotSharing_CachesLocallyIfRemoteCacheIsUnavailable(t *testing.T) {
+	flags.Set(t, "executor.enable_local_snapshot_sharing", true)
+	flags.Set(t, "executor.enable_remote_snapshot_sharing", true)
+	flags.Set(t, "executor.remote_snapshot_signing_key", "executor-secret")
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+	testcache.Setup(t, env)
+	env.SetActionCacheClient(&unavailableActionCache{env.GetActionCacheClient()})
+	workDir := testfs.MakeTempDir(t)
+
+	env.SetFileCache(newFileCache(t))
+	loader, err := snaploader.New(env)
+	require.NoError(t, err)
+	key, err := snaploader.NewKey(&repb.ExecutionTask{}, "config-hash", "")
+	require.NoError(t, err)
+	opts := makeFakeSnapshot(t, workDir)
+	_, err = loader.CacheSnapshot(ctx, key, opts)
+	require.NoError(t, err)
+
+	// The snapshot can still be resumed on the same executor.
+	snap, err := loader.GetSnapshot(ctx, key)
+	require.NoError(t, err)
+	mustUnpack(t, ctx, loader, snap, testfs.MakeDirAll(t, workDir, "VM-A"), opts)
+
+	// But it isn't shared with other executors.
+	env.SetFileCache(newFileCache(t))
+	loader, err = snaploader.New(env)
+	require.NoError(t, err)
+	_, err = loader.GetSnapshot(ctx, key)
+	require.True(t, status.IsUnavailableError(err), "expected Unavailable; got: %v", err)
+}
+
+func newFileCache(t *testing.T) interfaces.FileCache {
+	const maxFilecacheSizeBytes = 20_000_000 // 20 MB
+	fc, err := filecache.NewFileCache(testfs.MakeTempDir(t), maxFilecacheSizeBytes, false)
+	require.NoError(t, err)
+	fc.WaitForDirectoryScanToComplete()
+	return fc
+}
+
 func makeFakeSnapshot(t *testing.T, workDir string) *snaploader.CacheSnapshotOptions {
 	return &snaploader.CacheSnapshotOptions{
 		MemSnapshotPath:     makeRandomFile(t, workDir, "mem", 100_000),
@@ -16,6 +16,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auditlog"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/samlutil"
 	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/build_buddy_url"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
@@ -24,6 +26,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/claims"
 	"github.com/buildbuddy-io/buildbuddy/server/util/cookie"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flagutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlsp"
@@ -39,7 +42,6 @@ var (
 
 const (
 	authRedirectParam      = "redirect_url"
-	slugParam              = "slug"
 	slugCookie             = "Slug"
 	cookieDuration         = 365 * 24 * time.Hour
 	sessionDuration        = 12 * time.Hour
@@ -167,6 +169,8 @@ func (t CookieRequestTracker) GetTrackedRequest(r *http.Request, index string) (
 // wrapper around samlsp.CookieSesionProvider that allows a seamless migration
 // of cookies to a different domain value.
 type cookieSessionProvider struct {
+	env       environment.Env
+	slug      string
 	oldDomain string
 	d         samlsp.CookieSessionProvider
 }
@@ -179,7 +183,26 @@ func (p cookieSessionProvider) CreateSession(w http.ResponseWriter, r *http.Requ
 			return err
 		}
 	}
-	return p.d.CreateSession(w, r, assertion)
+	if err := p.d.CreateSession(w, r, assertion); err != nil {
+		return err
+	}
+	p.logLogin(r, assertion)
+	return nil
+}
+
+// logLogin audit logs a successful login by the subject of the assertion.
+func (p cookieSessionProvider) logLogin(r *http.Request, assertion *saml.Assertion) {
+	session, err := p.d.Codec.New(assertion)
+	if err != nil {
+		log.Warningf("Could not read SAML assertion for audit log: %s", err)
+		return
+	}
+	sa, ok := session.(samlsp.SessionWithAttributes)
+	if !ok {
+		return
+	}
+	subID := fmt.Sprintf("%s/%s", samlutil.EntityID(p.slug), firstSet(sa.GetAttributes(), samlSubjectAttributes))
+	auditlog.LogLogin(r.Context(), p.env, subID, firstSet(sa.GetAttributes(), samlEmailAttributes))
 }
 
 func (p cookieSessionProvider) DeleteSession(w http.ResponseWriter, r *http.Request) error {
@@ -318,7 +341,7 @@ func (a *SAMLAuthenticator) Auth(w http.ResponseWriter, r *http.Request) error {
 		return status.NotFoundErrorf("SAML Auth Failed: %s", err)
 	}
 	// Store slug as a cookie to enable logins directly from the /acs page.
-	slug := r.URL.Query().Get(slugParam)
+	slug := r.URL.Query().Get(samlutil.SlugParam)
 	cookie.SetCookie(w, slugCookie, slug, time.Now().Add(cookieDuration), true /* httpOnly= */)
 
 	sp.ServeHTTP(w, r)
@@ -382,11 +405,9 @@ func (a *SAMLAuthenticator) serviceProviderFromRequest(r *http.Request) (*samlsp
 	if err != nil {
 		return nil, err
 	}
-	entityURL := build_buddy_url.WithPath("saml/metadata")
-	query := fmt.Sprintf("%s=%s", slugParam, slug)
-	entityURL.RawQuery = query
+	query := fmt.Sprintf("%s=%s", samlutil.SlugParam, slug)
 	opts := samlsp.Options{
-		EntityID:          entityURL.String(),
+		EntityID:          samlutil.EntityID(slug),
 		URL:               *build_buddy_url.WithPath("/auth/"),
 		Key:               keyPair.PrivateKey.(*rsa.PrivateKey),
 		Certificate:       keyPair.Leaf,
@@ -394,6 +415,11 @@ func (a *SAMLAuthenticator) serviceProviderFromRequest(r *http.Request) (*samlsp
 		AllowIDPInitiated: true,
 	}
 	samlSP, _ := samlsp.New(opts)
+	onError := samlSP.OnError
+	samlSP.OnError = func(w http.ResponseWriter, r *http.Request, err error) {
+		auditlog.LogLoginFailure(r.Context(), a.env, slug)
+		onError(w, r, err)
+	}
 	samlSP.ServiceProvider.MetadataURL.RawQuery = query
 	samlSP.ServiceProvider.AcsURL.RawQuery = query
 	samlSP.ServiceProvider.SloURL.RawQuery = query
@@ -416,7 +442,7 @@ func (a *SAMLAuthenticator) serviceProviderFromRequest(r *http.Request) (*samlsp
 	if cookie.Domain() != "" {
 		sessionDomain = cookie.Domain()
 	}
-	csp := &cookieSessionProvider{d: samlsp.CookieSessionProvider{
+	csp := &cookieSessionProvider{env: a.env, slug: slug, d: samlsp.CookieSessionProvider{
 		Name:     sessionCookieName,
 		Domain:   sessionDomain,
 		MaxAge:   sessionDuration,
@@ -436,7 +462,7 @@ func (a *SAMLAuthenticator) serviceProviderFromRequest(r *http.Request) (*samlsp
 }
 
 func (a *SAMLAuthenticator) getSlugFromRequest(r *http.Request) string {
-	slug := r.URL.Query().Get(slugParam)
+	slug := r.URL.Query().Get(samlutil.SlugParam)
 	if slug == "" {
 		slug = cookie.GetCookie(r, slugCookie)
 	}
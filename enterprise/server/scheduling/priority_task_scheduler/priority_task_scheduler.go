@@ -4,6 +4,8 @@ import (
 	"container/list"
 	"context"
 	"flag"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -32,10 +34,19 @@ import (
 )
 
 var (
-	exclusiveTaskScheduling = flag.Bool("executor.exclusive_task_scheduling", false, "If true, only one task will be scheduled at a time. Default is false")
-	shutdownCleanupDuration = flag.Duration("executor.shutdown_cleanup_duration", 15*time.Second, "The minimum duration during the shutdown window to allocate for cleaning up containers. This is capped to the value of `max_shutdown_duration`.")
+	exclusiveTaskScheduling        = flag.Bool("executor.exclusive_task_scheduling", false, "If true, only one task will be scheduled at a time. Default is false")
+	shutdownCleanupDuration        = flag.Duration("executor.shutdown_cleanup_duration", 15*time.Second, "The minimum duration during the shutdown window to allocate for cleaning up containers. This is capped to the value of `max_shutdown_duration`.")
+	enableTaskPreemption           = flag.Bool("executor.enable_task_preemption", false, "If true, running tasks are preempted (stopped and re-enqueued) when a task of a higher priority class from the same group does not fit on the executor otherwise.")
+	enableCrossGroupTaskPreemption = flag.Bool("executor.enable_cross_group_task_preemption", false, "If true, tasks may also preempt running tasks of other groups. Only enable this on executors that are not shared between untrusted groups, since any group can request a higher priority class for its tasks.")
 )
 
+// The task priority classes, in decreasing order of precedence.
+var priorityClasses = []scpb.PriorityClass{
+	scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS,
+	scpb.PriorityClass_CI_PRIORITY_CLASS,
+	scpb.PriorityClass_BATCH_PRIORITY_CLASS,
+}
+
 var shuttingDownLogOnce sync.Once
 
 type groupPriorityQueue struct {
@@ -43,7 +54,109 @@ type groupPriorityQueue struct {
 	groupID string
 }
 
+// taskPriorityClass returns the priority class of the task reservation.
+// Reservations without a priority class (for example, from older schedulers)
+// are treated as CI tasks.
+func taskPriorityClass(req *scpb.EnqueueTaskReservationRequest) scpb.PriorityClass {
+	c := req.GetSchedulingMetadata().GetPriorityClass()
+	if c == scpb.PriorityClass_UNKNOWN_PRIORITY_CLASS {
+		return scpb.PriorityClass_CI_PRIORITY_CLASS
+	}
+	return c
+}
+
+// priorityClassName returns the name of the priority class as used in
+// platform properties and metric labels, e.g. "interactive".
+func priorityClassName(c scpb.PriorityClass) string {
+	return strings.ToLower(strings.TrimSuffix(c.String(), "_PRIORITY_CLASS"))
+}
+
+// taskQueue holds the queued task reservations. Reservations are dequeued in
+// decreasing order of priority class, and round-robin across task groups
+// within the same priority class.
 type taskQueue struct {
+	queues map[scpb.PriorityClass]*roundRobinQueue
+	// Number of tasks in each task group, across all priority classes.
+	numTasksByGroupID map[string]int
+	// Number of tasks across all queues.
+	numTasks int
+}
+
+func newTaskQueue() *taskQueue {
+	queues := make(map[scpb.PriorityClass]*roundRobinQueue, len(priorityClasses))
+	for _, c := range priorityClasses {
+		queues[c] = newRoundRobinQueue()
+	}
+	return &taskQueue{
+		queues:            queues,
+		numTasksByGroupID: make(map[string]int),
+	}
+}
+
+func (t *taskQueue) GetAll() []*scpb.EnqueueTaskReservationRequest {
+	var reservations []*scpb.EnqueueTaskReservationRequest
+	for _, c := range priorityClasses {
+		reservations = append(reservations, t.queues[c].GetAll()...)
+	}
+	return reservations
+}
+
+func (t *taskQueue) Enqueue(req *scpb.EnqueueTaskReservationRequest) {
+	t.queues[taskPriorityClass(req)].Enqueue(req)
+	t.numTasks++
+	t.updateGroupTaskCount(req.GetSchedulingMetadata().GetTaskGroupId(), 1)
+}
+
+func (t *taskQueue) Dequeue() *scpb.EnqueueTaskReservationRequest {
+	q := t.nextQueue()
+	if q == nil {
+		return nil
+	}
+	req := q.Dequeue()
+	if req == nil {
+		return nil
+	}
+	t.numTasks--
+	t.updateGroupTaskCount(req.GetSchedulingMetadata().GetTaskGroupId(), -1)
+	return req
+}
+
+func (t *taskQueue) Peek() *scpb.EnqueueTaskReservationRequest {
+	q := t.nextQueue()
+	if q == nil {
+		return nil
+	}
+	return q.Peek()
+}
+
+func (t *taskQueue) Len() int {
+	return t.numTasks
+}
+
+// nextQueue returns the queue of the highest priority class that has tasks
+// remaining, or nil if all queues are empty.
+func (t *taskQueue) nextQueue() *roundRobinQueue {
+	for _, c := range priorityClasses {
+		if q := t.queues[c]; q.Len() > 0 {
+			return q
+		}
+	}
+	return nil
+}
+
+func (t *taskQueue) updateGroupTaskCount(taskGroupID string, delta int) {
+	n := t.numTasksByGroupID[taskGroupID] + delta
+	if n == 0 {
+		delete(t.numTasksByGroupID, taskGroupID)
+	} else {
+		t.numTasksByGroupID[taskGroupID] = n
+	}
+	metrics.RemoteExecutionQueueLength.With(prometheus.Labels{metrics.GroupID: taskGroupID}).Set(float64(n))
+}
+
+// roundRobinQueue holds the task reservations of a single priority class.
+// Reservations are dequeued round-robin across task groups.
+type roundRobinQueue struct {
 	// List of *groupPriorityQueue items.
 	pqs *list.List
 	// Map to allow quick lookup of a specific *groupPriorityQueue element in the pqs list.
@@ -55,15 +168,15 @@ type taskQueue struct {
 	numTasks int
 }
 
-func newTaskQueue() *taskQueue {
-	return &taskQueue{
+func newRoundRobinQueue() *roundRobinQueue {
+	return &roundRobinQueue{
 		pqs:         list.New(),
 		pqByGroupID: make(map[string]*list.Element),
 		currentPQ:   nil,
 	}
 }
 
-func (t *taskQueue) GetAll() []*scpb.EnqueueTaskReservationRequest {
+func (t *roundRobinQueue) GetAll() []*scpb.EnqueueTaskReservationRequest {
 	var reservations []*scpb.EnqueueTaskReservationRequest
 
 	for e := t.pqs.Front(); e != nil; e = e.Next() {
@@ -79,7 +192,7 @@ func (t *taskQueue) GetAll() []*scpb.EnqueueTaskReservationRequest {
 	return reservations
 }
 
-func (t *taskQueue) Enqueue(req *scpb.EnqueueTaskReservationRequest) {
+func (t *roundRobinQueue) Enqueue(req *scpb.EnqueueTaskReservationRequest) {
 	taskGroupID := req.GetSchedulingMetadata().GetTaskGroupId()
 	var pq *groupPriorityQueue
 	if el, ok := t.pqByGroupID[taskGroupID]; ok {
@@ -102,10 +215,9 @@ func (t *taskQueue) Enqueue(req *scpb.EnqueueTaskReservationRequest) {
 	}
 	pq.Push(req)
 	t.numTasks++
-	metrics.RemoteExecutionQueueLength.With(prometheus.Labels{metrics.GroupID: taskGroupID}).Set(float64(pq.Len()))
 }
 
-func (t *taskQueue) Dequeue() *scpb.EnqueueTaskReservationRequest {
+func (t *roundRobinQueue) Dequeue() *scpb.EnqueueTaskReservationRequest {
 	if t.currentPQ == nil {
 		return nil
 	}
@@ -127,11 +239,10 @@ func (t *taskQueue) Dequeue() *scpb.EnqueueTaskReservationRequest {
 		t.currentPQ = t.pqs.Front()
 	}
 	t.numTasks--
-	metrics.RemoteExecutionQueueLength.With(prometheus.Labels{metrics.GroupID: req.GetSchedulingMetadata().GetTaskGroupId()}).Set(float64(pq.Len()))
 	return req
 }
 
-func (t *taskQueue) Peek() *scpb.EnqueueTaskReservationRequest {
+func (t *roundRobinQueue) Peek() *scpb.EnqueueTaskReservationRequest {
 	if t.currentPQ == nil {
 		return nil
 	}
@@ -144,10 +255,21 @@ func (t *taskQueue) Peek() *scpb.EnqueueTaskReservationRequest {
 	return pq.Peek()
 }
 
-func (t *taskQueue) Len() int {
+func (t *roundRobinQueue) Len() int {
 	return t.numTasks
 }
 
+// activeTask is a task that has been dequeued and is being run by the
+// executor.
+type activeTask struct {
+	reservation *scpb.EnqueueTaskReservationRequest
+	cancel      context.CancelCauseFunc
+	startTime   time.Time
+	// Whether the task was canceled to make room for a task of a higher
+	// priority class.
+	preempted bool
+}
+
 type Options struct {
 	RAMBytesCapacityOverride  int64
 	CPUMillisCapacityOverride int64
@@ -165,7 +287,7 @@ type PriorityTaskScheduler struct {
 
 	mu                      sync.Mutex
 	q                       *taskQueue
-	activeTaskCancelFuncs   map[*context.CancelFunc]struct{}
+	activeTasks             map[*activeTask]struct{}
 	ramBytesCapacity        int64
 	ramBytesUsed            int64
 	cpuMillisCapacity       int64
@@ -192,7 +314,7 @@ func NewPriorityTaskScheduler(env environment.Env, exec *executor.Executor, runn
 		checkQueueSignal:        make(chan struct{}, 64),
 		rootContext:             rootContext,
 		rootCancel:              rootCancel,
-		activeTaskCancelFuncs:   make(map[*context.CancelFunc]struct{}, 0),
+		activeTasks:             make(map[*activeTask]struct{}, 0),
 		shuttingDown:            false,
 		ramBytesCapacity:        ramBytesCapacity,
 		cpuMillisCapacity:       cpuMillisCapacity,
@@ -254,7 +376,7 @@ func (q *PriorityTaskScheduler) Shutdown(ctx context.Context) error {
 	// Wait for all active tasks to finish.
 	for {
 		q.mu.Lock()
-		activeTasks := len(q.activeTaskCancelFuncs)
+		activeTasks := len(q.activeTasks)
 		q.mu.Unlock()
 		if activeTasks == 0 {
 			break
@@ -343,9 +465,9 @@ func (q *PriorityTaskScheduler) runTask(ctx context.Context, st *repb.ScheduledT
 	return false, nil
 }
 
-func (q *PriorityTaskScheduler) trackTask(res *scpb.EnqueueTaskReservationRequest, cancel *context.CancelFunc) {
-	q.activeTaskCancelFuncs[cancel] = struct{}{}
-	if size := res.GetTaskSize(); size != nil {
+func (q *PriorityTaskScheduler) trackTask(task *activeTask) {
+	q.activeTasks[task] = struct{}{}
+	if size := task.reservation.GetTaskSize(); size != nil {
 		q.ramBytesUsed += size.GetEstimatedMemoryBytes()
 		q.cpuMillisUsed += size.GetEstimatedMilliCpu()
 		metrics.RemoteExecutionAssignedRAMBytes.Set(float64(q.ramBytesUsed))
@@ -354,9 +476,9 @@ func (q *PriorityTaskScheduler) trackTask(res *scpb.EnqueueTaskReservationReques
 	}
 }
 
-func (q *PriorityTaskScheduler) untrackTask(res *scpb.EnqueueTaskReservationRequest, cancel *context.CancelFunc) {
-	delete(q.activeTaskCancelFuncs, cancel)
-	if size := res.GetTaskSize(); size != nil {
+func (q *PriorityTaskScheduler) untrackTask(task *activeTask) {
+	delete(q.activeTasks, task)
+	if size := task.reservation.GetTaskSize(); size != nil {
 		q.ramBytesUsed -= size.GetEstimatedMemoryBytes()
 		q.cpuMillisUsed -= size.GetEstimatedMilliCpu()
 		metrics.RemoteExecutionAssignedRAMBytes.Set(float64(q.ramBytesUsed))
@@ -372,21 +494,24 @@ func (q *PriorityTaskScheduler) stats() string {
 		"Mem: %d of %d bytes allocated (%d remaining), CPU: %d of %d milliCPU allocated (%d remaining), Tasks: %d active, %d queued",
 		q.ramBytesUsed, q.ramBytesCapacity, ramBytesRemaining,
 		q.cpuMillisUsed, q.cpuMillisCapacity, cpuMillisRemaining,
-		len(q.activeTaskCancelFuncs), q.q.Len())
+		len(q.activeTasks), q.q.Len())
 }
 
-func (q *PriorityTaskScheduler) canFitAnotherTask(res *scpb.EnqueueTaskReservationRequest) bool {
+// wouldFit returns whether the task would fit on the executor if the given
+// amount of resources were unallocated and the given number of other tasks
+// were running.
+func (q *PriorityTaskScheduler) wouldFit(res *scpb.EnqueueTaskReservationRequest, ramBytesRemaining, cpuMillisRemaining int64, numActiveTasks int) bool {
 	// Only ever run as many sized tasks as we have memory for.
-	knownRAMremaining := q.ramBytesCapacity - q.ramBytesUsed
-	knownCPUremaining := q.cpuMillisCapacity - q.cpuMillisUsed
-	willFit := knownRAMremaining >= res.GetTaskSize().GetEstimatedMemoryBytes() && knownCPUremaining >= res.GetTaskSize().GetEstimatedMilliCpu()
-
-	// If we're running in exclusiveTaskScheduling mode, only ever allow one task to run at
-	// a time. Otherwise fall through to the logic below.
-	if willFit && q.exclusiveTaskScheduling && len(q.activeTaskCancelFuncs) >= 1 {
+	if ramBytesRemaining < res.GetTaskSize().GetEstimatedMemoryBytes() || cpuMillisRemaining < res.GetTaskSize().GetEstimatedMilliCpu() {
 		return false
 	}
+	// If we're running in exclusiveTaskScheduling mode, only ever allow one
+	// task to run at a time.
+	return !q.exclusiveTaskScheduling || numActiveTasks == 0
+}
 
+func (q *PriorityTaskScheduler) canFitAnotherTask(res *scpb.EnqueueTaskReservationRequest) bool {
+	willFit := q.wouldFit(res, q.ramBytesCapacity-q.ramBytesUsed, q.cpuMillisCapacity-q.cpuMillisUsed, len(q.activeTasks))
 	if willFit {
 		if res.GetTaskSize().GetEstimatedMemoryBytes() == 0 {
 			log.CtxWarningf(q.rootContext, "Scheduling another unknown size task. THIS SHOULD NOT HAPPEN! res: %+v", res)
@@ -397,6 +522,74 @@ func (q *PriorityTaskScheduler) canFitAnotherTask(res *scpb.EnqueueTaskReservati
 	return willFit
 }
 
+// preemptTasks cancels running tasks of lower priority classes than the given
+// task, if that frees up enough resources for the task to fit. Only tasks of
+// the same task group are preempted, unless cross-group preemption is enabled,
+// since groups choose the priority classes of their own tasks. Tasks of the
+// lowest priority class are preempted first, and within a priority class the
+// most recently started tasks are preempted first, since they lose the least
+// progress. Nothing is preempted if the task would not fit even after
+// preempting all tasks of lower priority classes.
+func (q *PriorityTaskScheduler) preemptTasks(res *scpb.EnqueueTaskReservationRequest) {
+	priorityClass := taskPriorityClass(res)
+	ramBytesRemaining := q.ramBytesCapacity - q.ramBytesUsed
+	cpuMillisRemaining := q.cpuMillisCapacity - q.cpuMillisUsed
+	numActiveTasks := len(q.activeTasks)
+	free := func(task *activeTask) {
+		ramBytesRemaining += task.reservation.GetTaskSize().GetEstimatedMemoryBytes()
+		cpuMillisRemaining += task.reservation.GetTaskSize().GetEstimatedMilliCpu()
+		numActiveTasks--
+	}
+
+	var candidates []*activeTask
+	for task := range q.activeTasks {
+		if task.preempted {
+			// Tasks that were already preempted will free up their resources
+			// once they exit, so don't preempt more tasks than needed while
+			// waiting for them.
+			free(task)
+			continue
+		}
+		if taskPriorityClass(task.reservation) >= priorityClass {
+			continue
+		}
+		if !*enableCrossGroupTaskPreemption && task.reservation.GetSchedulingMetadata().GetTaskGroupId() != res.GetSchedulingMetadata().GetTaskGroupId() {
+			continue
+		}
+		candidates = append(candidates, task)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		ci, cj := taskPriorityClass(candidates[i].reservation), taskPriorityClass(candidates[j].reservation)
+		if ci != cj {
+			return ci < cj
+		}
+		return candidates[i].startTime.After(candidates[j].startTime)
+	})
+
+	var preempted []*activeTask
+	for _, task := range candidates {
+		if q.wouldFit(res, ramBytesRemaining, cpuMillisRemaining, numActiveTasks) {
+			break
+		}
+		preempted = append(preempted, task)
+		free(task)
+	}
+	if !q.wouldFit(res, ramBytesRemaining, cpuMillisRemaining, numActiveTasks) {
+		return
+	}
+	for _, task := range preempted {
+		log.CtxInfof(q.rootContext, "Preempting task %q (priority class %s) to make room for task %q (priority class %s)",
+			task.reservation.GetTaskId(), priorityClassName(taskPriorityClass(task.reservation)),
+			res.GetTaskId(), priorityClassName(priorityClass))
+		task.preempted = true
+		task.cancel(executor.ErrPreempted)
+		metrics.RemoteExecutionPreemptedTaskCount.With(prometheus.Labels{
+			metrics.PriorityClassLabel:           priorityClassName(taskPriorityClass(task.reservation)),
+			metrics.PreemptingPriorityClassLabel: priorityClassName(priorityClass),
+		}).Inc()
+	}
+}
+
 func (q *PriorityTaskScheduler) handleTask() {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -414,7 +607,13 @@ func (q *PriorityTaskScheduler) handleTask() {
 		return
 	}
 	nextTask := q.q.Peek()
-	if nextTask == nil || !q.canFitAnotherTask(nextTask) {
+	if nextTask == nil {
+		return
+	}
+	if !q.canFitAnotherTask(nextTask) {
+		if *enableTaskPreemption {
+			q.preemptTasks(nextTask)
+		}
 		return
 	}
 	reservation := q.q.Dequeue()
@@ -423,16 +622,21 @@ func (q *PriorityTaskScheduler) handleTask() {
 		return
 	}
 	ctx := log.EnrichContext(q.rootContext, log.ExecutionIDKey, reservation.GetTaskId())
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancelCause(ctx)
 	ctx = tracing.ExtractProtoTraceMetadata(ctx, reservation.GetTraceMetadata())
 
-	q.trackTask(reservation, &cancel)
+	task := &activeTask{
+		reservation: reservation,
+		cancel:      cancel,
+		startTime:   time.Now(),
+	}
+	q.trackTask(task)
 
 	go func() {
-		defer cancel()
+		defer cancel(nil)
 		defer func() {
 			q.mu.Lock()
-			q.untrackTask(reservation, &cancel)
+			q.untrackTask(task)
 			q.mu.Unlock()
 			// Wake up the scheduling loop since the resources we just freed up
 			// may allow another task to become runnable.
@@ -463,6 +667,14 @@ func (q *PriorityTaskScheduler) handleTask() {
 			SchedulingMetadata: reservation.GetSchedulingMetadata(),
 		}
 		retry, err := q.runTask(ctx, scheduledTask)
+		q.mu.Lock()
+		preempted := task.preempted
+		q.mu.Unlock()
+		if err != nil && preempted {
+			log.CtxInfof(ctx, "Task %q was preempted, re-enqueueing: %s", reservation.GetTaskId(), err)
+			taskLease.ClosePreempted(ctx, err)
+			return
+		}
 		if err != nil {
 			log.CtxErrorf(ctx, "Error running task %q (re-enqueue for retry: %t): %s", reservation.GetTaskId(), retry, err)
 		}
@@ -483,6 +695,14 @@ func (q *PriorityTaskScheduler) Stop() error {
 	return nil
 }
 
+// GetTaskCounts returns the number of task reservations waiting in the queue
+// and the number of tasks that are currently running.
+func (q *PriorityTaskScheduler) GetTaskCounts() (queued, active int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.q.Len(), len(q.activeTasks)
+}
+
 func (q *PriorityTaskScheduler) GetQueuedTaskReservations() []*scpb.EnqueueTaskReservationRequest {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -1,10 +1,15 @@
 package priority_task_scheduler
 
 import (
+	"context"
 	"testing"
+	"time"
 
-	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/executor"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/require"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 )
 
 const (
@@ -69,3 +74,194 @@ func TestTaskQueue_MultipleGroups(t *testing.T) {
 	require.Equal(t, "group1Task3", q.Dequeue().GetTaskId())
 	require.Nil(t, q.Dequeue())
 }
+
+func newPriorityTaskReservationRequest(taskID, taskGroupID string, priorityClass scpb.PriorityClass) *scpb.EnqueueTaskReservationRequest {
+	req := newTaskReservationRequest(taskID, taskGroupID)
+	req.SchedulingMetadata.PriorityClass = priorityClass
+	return req
+}
+
+func TestTaskQueue_PriorityClasses(t *testing.T) {
+	q := newTaskQueue()
+
+	q.Enqueue(newPriorityTaskReservationRequest("group1Batch1", testGroupID1, scpb.PriorityClass_BATCH_PRIORITY_CLASS))
+	q.Enqueue(newPriorityTaskReservationRequest("group1CI1", testGroupID1, scpb.PriorityClass_CI_PRIORITY_CLASS))
+	// Tasks without a priority class are treated as CI tasks.
+	q.Enqueue(newTaskReservationRequest("group2Unknown1", testGroupID2))
+	q.Enqueue(newPriorityTaskReservationRequest("group2Interactive1", testGroupID2, scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS))
+	q.Enqueue(newPriorityTaskReservationRequest("group1Interactive1", testGroupID1, scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS))
+	q.Enqueue(newPriorityTaskReservationRequest("group2Interactive2", testGroupID2, scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS))
+	require.Equal(t, 6, q.Len())
+
+	require.Equal(t, "group2Interactive1", q.Peek().GetTaskId())
+	require.Equal(t, "group2Interactive1", q.Dequeue().GetTaskId())
+	require.Equal(t, "group1Interactive1", q.Dequeue().GetTaskId())
+	require.Equal(t, "group2Interactive2", q.Dequeue().GetTaskId())
+
+	// Enqueueing a higher priority task moves it ahead of the remaining
+	// lower priority tasks.
+	q.Enqueue(newPriorityTaskReservationRequest("group3Interactive1", testGroupID3, scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS))
+	require.Equal(t, "group3Interactive1", q.Dequeue().GetTaskId())
+
+	require.Equal(t, "group1CI1", q.Dequeue().GetTaskId())
+	require.Equal(t, "group2Unknown1", q.Dequeue().GetTaskId())
+	require.Equal(t, "group1Batch1", q.Dequeue().GetTaskId())
+	require.Equal(t, 0, q.Len())
+	require.Nil(t, q.Dequeue())
+}
+
+func TestPreemptTasks(t *testing.T) {
+	for _, test := range []struct {
+		name               string
+		activeTasks        []*activeTask
+		exclusive          bool
+		crossGroup         bool
+		task               *scpb.EnqueueTaskReservationRequest
+		expectedPreempted  []string
+		alreadyPreemptedID string
+	}{
+		{
+			name: "preempts most recent batch task first",
+			activeTasks: []*activeTask{
+				newActiveTask("batch-old", scpb.PriorityClass_BATCH_PRIORITY_CLASS, 1000, 1*time.Minute),
+				newActiveTask("batch-new", scpb.PriorityClass_BATCH_PRIORITY_CLASS, 1000, 2*time.Minute),
+				newActiveTask("ci", scpb.PriorityClass_CI_PRIORITY_CLASS, 1000, 3*time.Minute),
+			},
+			task:              newSizedTaskReservationRequest("interactive", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 1000),
+			expectedPreempted: []string{"batch-new"},
+		},
+		{
+			name: "preempts lower classes before more recent tasks",
+			activeTasks: []*activeTask{
+				newActiveTask("batch", scpb.PriorityClass_BATCH_PRIORITY_CLASS, 1000, 1*time.Minute),
+				newActiveTask("ci-1", scpb.PriorityClass_CI_PRIORITY_CLASS, 1000, 2*time.Minute),
+				newActiveTask("ci-2", scpb.PriorityClass_CI_PRIORITY_CLASS, 1000, 3*time.Minute),
+			},
+			task:              newSizedTaskReservationRequest("interactive", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 2000),
+			expectedPreempted: []string{"batch", "ci-2"},
+		},
+		{
+			name: "does not preempt tasks of the same class",
+			activeTasks: []*activeTask{
+				newActiveTask("ci-1", scpb.PriorityClass_CI_PRIORITY_CLASS, 1000, 1*time.Minute),
+				newActiveTask("ci-2", scpb.PriorityClass_UNKNOWN_PRIORITY_CLASS, 1000, 2*time.Minute),
+				newActiveTask("interactive", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 1000, 3*time.Minute),
+			},
+			task: newSizedTaskReservationRequest("ci-3", scpb.PriorityClass_CI_PRIORITY_CLASS, 1000),
+		},
+		{
+			name: "does not preempt if the task would not fit anyway",
+			activeTasks: []*activeTask{
+				newActiveTask("batch", scpb.PriorityClass_BATCH_PRIORITY_CLASS, 1000, 1*time.Minute),
+				newActiveTask("interactive-1", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 1000, 2*time.Minute),
+				newActiveTask("interactive-2", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 1000, 3*time.Minute),
+			},
+			task: newSizedTaskReservationRequest("interactive-3", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 2000),
+		},
+		{
+			name: "waits for already preempted tasks to exit",
+			activeTasks: []*activeTask{
+				newActiveTask("batch-1", scpb.PriorityClass_BATCH_PRIORITY_CLASS, 1000, 1*time.Minute),
+				newActiveTask("batch-2", scpb.PriorityClass_BATCH_PRIORITY_CLASS, 1000, 2*time.Minute),
+				newActiveTask("ci", scpb.PriorityClass_CI_PRIORITY_CLASS, 1000, 3*time.Minute),
+			},
+			alreadyPreemptedID: "batch-2",
+			task:               newSizedTaskReservationRequest("interactive", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 1000),
+		},
+		{
+			name: "does not preempt tasks of other groups",
+			activeTasks: []*activeTask{
+				inTaskGroup(testGroupID2, newActiveTask("group2-batch", scpb.PriorityClass_BATCH_PRIORITY_CLASS, 1000, 1*time.Minute)),
+				newActiveTask("ci", scpb.PriorityClass_CI_PRIORITY_CLASS, 1000, 2*time.Minute),
+				newActiveTask("interactive", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 1000, 3*time.Minute),
+			},
+			task:              newSizedTaskReservationRequest("interactive-2", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 1000),
+			expectedPreempted: []string{"ci"},
+		},
+		{
+			name: "cross-group preemption preempts tasks of other groups",
+			activeTasks: []*activeTask{
+				inTaskGroup(testGroupID2, newActiveTask("group2-batch", scpb.PriorityClass_BATCH_PRIORITY_CLASS, 1000, 1*time.Minute)),
+				newActiveTask("ci", scpb.PriorityClass_CI_PRIORITY_CLASS, 1000, 2*time.Minute),
+				newActiveTask("interactive", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 1000, 3*time.Minute),
+			},
+			crossGroup:        true,
+			task:              newSizedTaskReservationRequest("interactive-2", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 1000),
+			expectedPreempted: []string{"group2-batch"},
+		},
+		{
+			name: "does not preempt if only tasks of other groups would make room",
+			activeTasks: []*activeTask{
+				inTaskGroup(testGroupID2, newActiveTask("group2-batch", scpb.PriorityClass_BATCH_PRIORITY_CLASS, 1000, 1*time.Minute)),
+				inTaskGroup(testGroupID2, newActiveTask("group2-ci", scpb.PriorityClass_CI_PRIORITY_CLASS, 1000, 2*time.Minute)),
+				newActiveTask("interactive", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 1000, 3*time.Minute),
+			},
+			task: newSizedTaskReservationRequest("interactive-2", scpb.PriorityClass_INTERACTIVE_PRIORITY_CLASS, 1000),
+		},
+		{
+			name: "exclusive scheduling preempts all running tasks",
+			activeTasks: []*activeTask{
+				newActiveTask("batch", scpb.PriorityClass_BATCH_PRIORITY_CLASS, 1000, 1*time.Minute),
+			},
+			exclusive:         true,
+			task:              newSizedTaskReservationRequest("ci", scpb.PriorityClass_CI_PRIORITY_CLASS, 1000),
+			expectedPreempted: []string{"batch"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			flags.Set(t, "executor.enable_cross_group_task_preemption", test.crossGroup)
+			q := &PriorityTaskScheduler{
+				rootContext:             context.Background(),
+				q:                       newTaskQueue(),
+				activeTasks:             map[*activeTask]struct{}{},
+				ramBytesCapacity:        3000,
+				cpuMillisCapacity:       3000,
+				exclusiveTaskScheduling: test.exclusive,
+			}
+			contexts := map[string]context.Context{}
+			for _, task := range test.activeTasks {
+				ctx, cancel := context.WithCancelCause(context.Background())
+				t.Cleanup(func() { cancel(nil) })
+				task.cancel = cancel
+				task.preempted = task.reservation.GetTaskId() == test.alreadyPreemptedID
+				contexts[task.reservation.GetTaskId()] = ctx
+				q.trackTask(task)
+			}
+
+			q.preemptTasks(test.task)
+
+			var preempted []string
+			for _, task := range test.activeTasks {
+				id := task.reservation.GetTaskId()
+				if id == test.alreadyPreemptedID {
+					continue
+				}
+				if task.preempted {
+					preempted = append(preempted, id)
+					require.Equal(t, executor.ErrPreempted, context.Cause(contexts[id]))
+				} else {
+					require.NoError(t, contexts[id].Err())
+				}
+			}
+			require.ElementsMatch(t, test.expectedPreempted, preempted)
+		})
+	}
+}
+
+func newSizedTaskReservationRequest(taskID string, priorityClass scpb.PriorityClass, milliCPU int64) *scpb.EnqueueTaskReservationRequest {
+	req := newPriorityTaskReservationRequest(taskID, testGroupID1, priorityClass)
+	req.TaskSize = &scpb.TaskSize{EstimatedMilliCpu: milliCPU, EstimatedMemoryBytes: milliCPU}
+	return req
+}
+
+func inTaskGroup(taskGroupID string, task *activeTask) *activeTask {
+	task.reservation.SchedulingMetadata.TaskGroupId = taskGroupID
+	return task
+}
+
+func newActiveTask(taskID string, priorityClass scpb.PriorityClass, milliCPU int64, startOffset time.Duration) *activeTask {
+	return &activeTask{
+		reservation: newSizedTaskReservationRequest(taskID, priorityClass, milliCPU),
+		startTime:   time.Unix(0, 0).Add(startOffset),
+	}
+}
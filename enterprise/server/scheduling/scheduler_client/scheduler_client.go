@@ -18,6 +18,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/version"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
 
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 )
@@ -100,11 +101,20 @@ func (r *Registration) Check(ctx context.Context) error {
 	return errors.New("not registered to scheduler yet")
 }
 
-func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Scheduler_RegisterAndStreamWorkClient, schedulerMsgs chan *scpb.RegisterAndStreamWorkResponse, registrationTicker *time.Ticker) (bool, error) {
-	registrationMsg := &scpb.RegisterAndStreamWorkRequest{
-		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: r.node},
+// registrationMsg returns a registration message reporting the executor's
+// current task counts, which the scheduler may use to route tasks to less
+// loaded executors.
+func (r *Registration) registrationMsg() *scpb.RegisterAndStreamWorkRequest {
+	node := proto.Clone(r.node).(*scpb.ExecutionNode)
+	queued, active := r.taskScheduler.GetTaskCounts()
+	node.QueuedTaskCount = int64(queued)
+	node.ActiveTaskCount = int64(active)
+	return &scpb.RegisterAndStreamWorkRequest{
+		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: node},
 	}
+}
 
+func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Scheduler_RegisterAndStreamWorkClient, schedulerMsgs chan *scpb.RegisterAndStreamWorkResponse, registrationTicker *time.Ticker) (bool, error) {
 	select {
 	case <-ctx.Done():
 		log.Debugf("Context cancelled, cancelling node registration.")
@@ -146,7 +156,7 @@ func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Schedu
 			return false, status.UnavailableErrorf("could not send task reservation response: %s", err)
 		}
 	case <-registrationTicker.C:
-		if err := stream.Send(registrationMsg); err != nil {
+		if err := stream.Send(r.registrationMsg()); err != nil {
 			return false, status.UnavailableErrorf("could not send registration message: %s", err)
 		}
 	}
@@ -156,10 +166,6 @@ func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Schedu
 // maintainRegistrationAndStreamWork maintains registration with a scheduler server using the newer
 // RegisterAndStreamWork API which supports both registration and task reservations.
 func (r *Registration) maintainRegistrationAndStreamWork(ctx context.Context) {
-	registrationMsg := &scpb.RegisterAndStreamWorkRequest{
-		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: r.node},
-	}
-
 	defer r.setConnected(false)
 
 	registrationTicker := time.NewTicker(schedulerCheckInInterval)
@@ -174,7 +180,7 @@ func (r *Registration) maintainRegistrationAndStreamWork(ctx context.Context) {
 			}
 			continue
 		}
-		if err := stream.Send(registrationMsg); err != nil {
+		if err := stream.Send(r.registrationMsg()); err != nil {
 			log.Errorf("error registering node with scheduler: %s, will retry...", err)
 			continue
 		}
@@ -69,6 +69,11 @@ const (
 	// The maximum number of times a task may be re-enqueued.
 	maxTaskAttemptCount = 5
 
+	// The maximum number of times a task may be preempted without the
+	// attempt counting towards maxTaskAttemptCount. This keeps tasks from
+	// being preempted forever.
+	maxTaskPreemptionCount = 3
+
 	// Number of unclaimed tasks to try to assign to a node that newly joined.
 	tasksToEnqueueOnJoin = 20
 
@@ -141,6 +146,26 @@ var (
 		else 
 			return 0 
 		end`)
+	// Preemption count is incremented, and attempt count is decremented only
+	// if the task exists, has been attempted, and has not been preempted more
+	// than the max number of times (ARGV[1]).
+	// Return values:
+	//  - 0 attempt not refunded
+	//  - 1 attempt refunded
+	redisRefundPreemptedAttempt = redis.NewScript(`
+		if redis.call("exists", KEYS[1]) == 0 then
+			return 0
+		end
+
+		if redis.call("hincrby", KEYS[1], "preemptionCount", 1) > tonumber(ARGV[1]) then
+			return 0
+		end
+
+		if tonumber(redis.call("hget", KEYS[1], "attemptCount") or "0") > 0 then
+			redis.call("hincrby", KEYS[1], "attemptCount", -1)
+			return 1
+		end
+		return 0`)
 	// Task deleted if claim field is present.
 	redisDeleteClaimedTask = redis.NewScript(`
 		if redis.call("hget", KEYS[1], "claimed") == "1" then 
@@ -289,7 +314,7 @@ func (h *executorHandle) Serve(ctx context.Context) error {
 				// Remove the executor first so that we don't try to send any work its way.
 				removeConnectedExecutor()
 				for _, taskID := range req.GetShuttingDownRequest().GetTaskId() {
-					if err := h.scheduler.reEnqueueTask(ctx, taskID, 1 /*=numReplicas*/, "executor shutting down"); err != nil {
+					if err := h.scheduler.reEnqueueTask(ctx, taskID, 1 /*=numReplicas*/, "executor shutting down", false /*=preempted*/); err != nil {
 						log.CtxWarningf(ctx, "Could not re-enqueue task reservation for executor %q going down: %s", executorID, err)
 					}
 				}
@@ -428,6 +453,10 @@ type executionNode struct {
 	executorID            string
 	assignableMemoryBytes int64
 	assignableMilliCpu    int64
+	// Number of queued and running tasks reported in the executor's most
+	// recent registration. Only used for nodes that are not locally
+	// connected, since the handle always has the latest registration.
+	queueLength int64
 	// Optional host:port of the scheduler to which the executor is connected. Only set for executors connecting using
 	// the "task streaming" API.
 	schedulerHostPort string
@@ -451,6 +480,17 @@ func (en *executionNode) GetExecutorID() string {
 	return en.executorID
 }
 
+func (en *executionNode) GetQueueLength() int64 {
+	if en.handle != nil {
+		return queueLength(en.handle.getRegistration())
+	}
+	return en.queueLength
+}
+
+func queueLength(registration *scpb.ExecutionNode) int64 {
+	return registration.GetQueuedTaskCount() + registration.GetActiveTaskCount()
+}
+
 func nodesThatFit(nodes []*executionNode, taskSize *scpb.TaskSize) []*executionNode {
 	var out []*executionNode
 	for _, node := range nodes {
@@ -553,6 +593,7 @@ func (np *nodePool) fetchExecutionNodes(ctx context.Context) ([]*executionNode,
 			schedulerHostPort:     node.GetSchedulerHostPort(),
 			assignableMemoryBytes: node.GetRegistration().GetAssignableMemoryBytes(),
 			assignableMilliCpu:    node.GetRegistration().GetAssignableMilliCpu(),
+			queueLength:           queueLength(node.GetRegistration()),
 		})
 	}
 
@@ -1434,7 +1475,7 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 			}
 
 			if req.GetReEnqueue() {
-				if _, err := s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: taskID, Reason: req.GetReEnqueueReason().GetMessage()}); err != nil {
+				if _, err := s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: taskID, Reason: req.GetReEnqueueReason().GetMessage(), Preempted: req.GetPreempted()}); err != nil {
 					log.CtxErrorf(ctx, "LeaseTask %q tried to re-enqueue task requested by executor but failed with err: %s", taskID, err)
 				}
 			}
@@ -1504,7 +1545,7 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 			enqueueRequest.GetTaskId(), time.Since(startTime), strings.Join(successfulReservations, ", "))
 	}()
 
-	cmd, remoteInstanceName, err := extractRoutingProps(serializedTask)
+	task, err := extractRoutingProps(serializedTask)
 	if err != nil {
 		return err
 	}
@@ -1549,7 +1590,7 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 						enqueueRequest.GetTaskSize().GetEstimatedMilliCpu(),
 						enqueueRequest.GetTaskSize().GetEstimatedMemoryBytes())
 				}
-				rankedNodes := s.taskRouter.RankNodes(ctx, cmd, remoteInstanceName, toNodeInterfaces(nodes))
+				rankedNodes := s.taskRouter.RankNodes(ctx, pool, task.GetAction(), task.GetCommand(), task.GetExecuteRequest().GetInstanceName(), toNodeInterfaces(nodes))
 				nodes, err = fromNodeInterfaces(rankedNodes)
 				if err != nil {
 					return err
@@ -1659,10 +1700,21 @@ func (s *SchedulerServer) EnqueueTaskReservation(ctx context.Context, req *scpb.
 	return &scpb.EnqueueTaskReservationResponse{}, nil
 }
 
-func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID string, numReplicas int, reason string) error {
+func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID string, numReplicas int, reason string, preempted bool) error {
 	if taskID == "" {
 		return status.FailedPreconditionError("A task_id is required")
 	}
+	if preempted {
+		// Preemption isn't the task's fault, so don't count the attempt
+		// against the task's max attempts, unless the task has already been
+		// preempted too many times.
+		refunded, err := redisRefundPreemptedAttempt.Run(ctx, s.rdb, []string{s.redisKeyForTask(taskID)}, maxTaskPreemptionCount).Int()
+		if err != nil {
+			log.CtxWarningf(ctx, "Could not refund attempt for preempted task %q: %s", taskID, err)
+		} else if refunded == 0 {
+			log.CtxInfof(ctx, "Preempted task %q was not refunded an attempt (max %d preemptions)", taskID, maxTaskPreemptionCount)
+		}
+	}
 	task, err := s.readTask(ctx, taskID)
 	if err != nil {
 		return err
@@ -1706,7 +1758,7 @@ func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID string, numR
 
 func (s *SchedulerServer) ReEnqueueTask(ctx context.Context, req *scpb.ReEnqueueTaskRequest) (*scpb.ReEnqueueTaskResponse, error) {
 	ctx = log.EnrichContext(ctx, log.ExecutionIDKey, req.GetTaskId())
-	if err := s.reEnqueueTask(ctx, req.GetTaskId(), probesPerTask, req.GetReason()); err != nil {
+	if err := s.reEnqueueTask(ctx, req.GetTaskId(), probesPerTask, req.GetReason(), req.GetPreempted()); err != nil {
 		log.CtxErrorf(ctx, "ReEnqueueTask failed for task %q: %s", req.GetTaskId(), err)
 		return nil, err
 	}
@@ -1796,15 +1848,16 @@ func (s *SchedulerServer) GetExecutionNodes(ctx context.Context, req *scpb.GetEx
 	}, nil
 }
 
-// extractRoutingProps deserializes the given task and returns the properties
-// needed to route the task (command and remote instance name).
-func extractRoutingProps(serializedTask []byte) (*repb.Command, string, error) {
+// extractRoutingProps deserializes the given task, which contains the
+// properties needed to route the task (action, command and remote instance
+// name). It returns nil if the task is not available.
+func extractRoutingProps(serializedTask []byte) (*repb.ExecutionTask, error) {
 	if serializedTask == nil {
-		return nil, "", nil
+		return nil, nil
 	}
 	task := &repb.ExecutionTask{}
 	if err := proto.Unmarshal(serializedTask, task); err != nil {
-		return nil, "", status.InternalErrorf("failed to unmarshal ExecutionTask: %s", err)
+		return nil, status.InternalErrorf("failed to unmarshal ExecutionTask: %s", err)
 	}
-	return task.GetCommand(), task.GetExecuteRequest().GetInstanceName(), nil
+	return task, nil
 }
@@ -5,9 +5,12 @@ import (
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/go-redis/redis/v8"
 
 	"github.com/stretchr/testify/require"
 )
@@ -158,3 +161,38 @@ func TestSchedulerServerGetPoolInfoSelfHostedByDefault(t *testing.T) {
 	require.Equal(t, "group1", p.GroupID)
 	require.Equal(t, "workflows", p.Name)
 }
+
+func TestRefundPreemptedAttempt(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	key := "task/1"
+	refund := func() int {
+		n, err := redisRefundPreemptedAttempt.Run(ctx, rdb, []string{key}, maxTaskPreemptionCount).Int()
+		require.NoError(t, err)
+		return n
+	}
+	attemptCount := func() int {
+		n, err := rdb.HGet(ctx, key, redisTaskAttempCountField).Int()
+		require.NoError(t, err)
+		return n
+	}
+
+	// Refunding a task that doesn't exist shouldn't create it.
+	require.Equal(t, 0, refund())
+	n, err := rdb.Exists(ctx, key).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), n)
+
+	// The first few preemptions are refunded.
+	require.NoError(t, rdb.HSet(ctx, key, redisTaskAttempCountField, 1).Err())
+	for i := 0; i < maxTaskPreemptionCount; i++ {
+		require.Equal(t, 1, refund())
+		require.Equal(t, 0, attemptCount())
+		// Claim the task again.
+		require.NoError(t, rdb.HIncrBy(ctx, key, redisTaskAttempCountField, 1).Err())
+	}
+
+	// Further preemptions count towards the max attempts.
+	require.Equal(t, 0, refund())
+	require.Equal(t, 1, attemptCount())
+}
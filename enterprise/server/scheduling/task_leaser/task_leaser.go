@@ -60,10 +60,11 @@ func (t *TaskLeaser) pingServer() ([]byte, error) {
 	return rsp.GetSerializedTask(), nil
 }
 
-func (t *TaskLeaser) reEnqueueTask(ctx context.Context, reason string) error {
+func (t *TaskLeaser) reEnqueueTask(ctx context.Context, reason string, preempted bool) error {
 	req := &scpb.ReEnqueueTaskRequest{
-		TaskId: t.taskID,
-		Reason: reason,
+		TaskId:    t.taskID,
+		Reason:    reason,
+		Preempted: preempted,
 	}
 	if *apiKey != "" {
 		ctx = metadata.AppendToOutgoingContext(ctx, authutil.APIKeyHeader, *apiKey)
@@ -114,6 +115,18 @@ func (t *TaskLeaser) Claim(ctx context.Context) (context.Context, []byte, error)
 }
 
 func (t *TaskLeaser) Close(ctx context.Context, taskErr error, retry bool) {
+	t.close(ctx, taskErr, retry, false /*=preempted*/)
+}
+
+// ClosePreempted closes the lease and re-enqueues the task, which was stopped
+// to make room for a task of a higher priority class. Unlike other retries,
+// the attempt is not counted against the task's max attempts, unless the task
+// has already been preempted several times.
+func (t *TaskLeaser) ClosePreempted(ctx context.Context, taskErr error) {
+	t.close(ctx, taskErr, true /*=retry*/, true /*=preempted*/)
+}
+
+func (t *TaskLeaser) close(ctx context.Context, taskErr error, retry, preempted bool) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	log.CtxInfof(ctx, "TaskLeaser %q Close() called with err: %v", t.taskID, taskErr)
@@ -135,6 +148,7 @@ func (t *TaskLeaser) Close(ctx context.Context, taskErr error, retry bool) {
 		req.Finalize = true
 	} else {
 		req.ReEnqueue = true
+		req.Preempted = preempted
 		if taskErr != nil {
 			s, _ := gstatus.FromError(taskErr)
 			req.ReEnqueueReason = s.Proto()
@@ -162,7 +176,7 @@ func (t *TaskLeaser) Close(ctx context.Context, taskErr error, retry bool) {
 		if taskErr != nil {
 			reason = taskErr.Error()
 		}
-		if err := t.reEnqueueTask(context.Background(), reason); err != nil {
+		if err := t.reEnqueueTask(context.Background(), reason, preempted); err != nil {
 			log.CtxWarningf(ctx, "TaskLeaser %q: error re-enqueueing task: %s", t.taskID, err.Error())
 		} else {
 			log.CtxInfof(ctx, "TaskLeaser %q: Successfully re-enqueued.", t.taskID)
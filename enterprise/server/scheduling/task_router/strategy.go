@@ -0,0 +1,242 @@
+package task_router
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/go-redis/redis/v8"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// Routes tasks that use recycled runners to the nodes that most recently
+	// executed tasks with the same platform properties, so that the tasks are
+	// likely to get a warm runner.
+	runnerRecyclingStrategy = "runner_recycling"
+	// Routes actions to the nodes that most recently executed actions with
+	// overlapping inputs, so that the inputs are likely to already be in the
+	// node's file cache.
+	inputAffinityStrategy = "input_affinity"
+	// Routes tasks to the nodes with the fewest queued and running tasks.
+	leastLoadedStrategy = "least_loaded"
+
+	// The default max number of preferred nodes that are returned by the task
+	// router for routable tasks. This is intentionally less than the number of
+	// probes per task (for load balancing purposes).
+	defaultPreferredNodeLimit = 1
+	// The preferred node limit for workflows.
+	// This is set higher than the default limit since we strongly prefer
+	// workflow tasks to hit a node with a warm bazel workspace, but it is
+	// set less than the number of probes so that we can autoscale the workflow
+	// executor pool effectively.
+	workflowsPreferredNodeLimit = 2
+	// The preferred node limit for each input affinity routing key.
+	inputAffinityPreferredNodeLimit = 1
+)
+
+var (
+	// All strategy names, in the order that the strategies are notified of
+	// completed tasks.
+	strategyNames = []string{runnerRecyclingStrategy, inputAffinityStrategy, leastLoadedStrategy}
+
+	strategyConstructors = map[string]func(rdb redis.UniversalClient) strategy{
+		runnerRecyclingStrategy: func(rdb redis.UniversalClient) strategy {
+			return &affinityStrategy{rdb: rdb, routingKeys: runnerRecyclingRoutingKeys}
+		},
+		inputAffinityStrategy: func(rdb redis.UniversalClient) strategy {
+			return &affinityStrategy{rdb: rdb, routingKeys: inputAffinityRoutingKeys}
+		},
+		leastLoadedStrategy: func(rdb redis.UniversalClient) strategy {
+			return &leastLoaded{}
+		},
+	}
+)
+
+// strategy decides which execution nodes are preferred for a task.
+type strategy interface {
+	// rankNodes returns the given nodes reordered by the strategy's
+	// preference. Nodes that the strategy has no preference between must keep
+	// their relative order, so that strategies can be chained.
+	rankNodes(ctx context.Context, params *routingParams, nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode
+
+	// markComplete notifies the strategy that the task was completed by the
+	// given executor.
+	markComplete(ctx context.Context, params *routingParams, executorID string)
+}
+
+// affinityStrategy prefers the nodes that most recently completed tasks
+// which share a routing key with the task. The nodes are stored in Redis
+// lists, with the most recent node at the head of the list.
+type affinityStrategy struct {
+	rdb redis.UniversalClient
+
+	// routingKeys returns the routing table keys for the task in decreasing
+	// order of preference, as well as the max number of nodes that are stored
+	// under each key. No keys are returned if the strategy does not apply to
+	// the task.
+	routingKeys func(params *routingParams) (keys []string, nodeLimit int, err error)
+}
+
+func (s *affinityStrategy) rankNodes(ctx context.Context, params *routingParams, nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
+	keys, nodeLimit, err := s.routingKeys(params)
+	if err != nil {
+		log.Errorf("Failed to compute routing key: %s", err)
+		return nodes
+	}
+	if len(keys) == 0 {
+		return nodes
+	}
+
+	pipe := s.rdb.Pipeline()
+	results := make([]*redis.StringSliceCmd, 0, len(keys))
+	for _, key := range keys {
+		results = append(results, pipe.LRange(ctx, key, 0, int64(nodeLimit)-1))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Errorf("Failed to rank nodes: redis LRANGE failed: %s", err)
+		return nodes
+	}
+	var preferredNodeIDs []string
+	for _, r := range results {
+		preferredNodeIDs = append(preferredNodeIDs, r.Val()...)
+	}
+
+	log.Debugf("Preferred executor IDs for %q: %v", keys, preferredNodeIDs)
+
+	return preferNodes(nodes, preferredNodeIDs)
+}
+
+func (s *affinityStrategy) markComplete(ctx context.Context, params *routingParams, executorID string) {
+	keys, nodeLimit, err := s.routingKeys(params)
+	if err != nil {
+		log.Errorf("Failed to compute routing key: %s", err)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	pipe := s.rdb.TxPipeline()
+	for _, key := range keys {
+		// Push the node to the head of the list (but first remove it if
+		// already present to avoid dupes), trim to max length to prevent it
+		// from growing too large, and renew the TTL.
+		pipe.LRem(ctx, key, 1, executorID)
+		pipe.LPush(ctx, key, executorID)
+		pipe.LTrim(ctx, key, 0, int64(nodeLimit)-1)
+		pipe.Expire(ctx, key, routingPropsKeyTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Errorf("Failed to mark task complete: redis pipeline failed: %s", err)
+		return
+	}
+
+	log.Debugf("Preferred executor %q added to %q", executorID, keys)
+}
+
+// preferNodes places the nodes with the given IDs first (in the given
+// order), followed by the remaining nodes in their original order.
+func preferNodes(nodes []interfaces.ExecutionNode, preferredNodeIDs []string) []interfaces.ExecutionNode {
+	nodeByID := map[string]interfaces.ExecutionNode{}
+	for _, node := range nodes {
+		nodeByID[node.GetExecutorID()] = node
+	}
+	preferredSet := map[string]struct{}{}
+	ranked := make([]interfaces.ExecutionNode, 0, len(nodes))
+	for _, id := range preferredNodeIDs {
+		node := nodeByID[id]
+		if node == nil {
+			continue
+		}
+		if _, ok := preferredSet[id]; ok {
+			continue
+		}
+		preferredSet[id] = struct{}{}
+		ranked = append(ranked, node)
+	}
+	for _, node := range nodes {
+		if _, ok := preferredSet[node.GetExecutorID()]; ok {
+			continue
+		}
+		ranked = append(ranked, node)
+	}
+	return ranked
+}
+
+// runnerRecyclingRoutingKeys returns the routing key for tasks that use
+// recycled runners, which is derived from the task's platform properties.
+func runnerRecyclingRoutingKeys(params *routingParams) ([]string, int, error) {
+	nodeLimit := getPreferredNodeLimit(params.cmd)
+	if nodeLimit == 0 {
+		return nil, 0, nil
+	}
+	platformHash, err := params.platformHash()
+	if err != nil {
+		return nil, 0, err
+	}
+	return []string{params.routingKey(platformHash)}, nodeLimit, nil
+}
+
+// getPreferredNodeLimit returns the max number of nodes that should be stored
+// in the preferred executors list for each task key, as well as the max number
+// of preferred nodes that should be returned by RankNodes.
+func getPreferredNodeLimit(cmd *repb.Command) int {
+	isRunnerRecyclingEnabled := platform.IsTrue(platform.FindValue(cmd.GetPlatform(), platform.RecycleRunnerPropertyName))
+	if !isRunnerRecyclingEnabled {
+		return 0
+	}
+	workflowID := platform.FindValue(cmd.GetPlatform(), platform.WorkflowIDPropertyName)
+	if workflowID != "" {
+		return workflowsPreferredNodeLimit
+	}
+	return defaultPreferredNodeLimit
+}
+
+// inputAffinityRoutingKeys returns the routing keys for actions with
+// overlapping inputs. Actions with an identical input root are preferred,
+// followed by actions that produce the same output. The latter are usually
+// other versions of the same action (for example, compiling the same source
+// file at an earlier commit), which share most of their inputs.
+func inputAffinityRoutingKeys(params *routingParams) ([]string, int, error) {
+	inputRootHash := params.action.GetInputRootDigest().GetHash()
+	if inputRootHash == "" {
+		return nil, 0, nil
+	}
+	keys := []string{params.routingKey("input_root", inputRootHash)}
+	if outputPath := firstOutputPath(params.cmd); outputPath != "" {
+		platformHash, err := params.platformHash()
+		if err != nil {
+			return nil, 0, err
+		}
+		keys = append(keys, params.routingKey("output", platformHash, fmt.Sprintf("%x", sha256.Sum256([]byte(outputPath)))))
+	}
+	return keys, inputAffinityPreferredNodeLimit, nil
+}
+
+func firstOutputPath(cmd *repb.Command) string {
+	for _, paths := range [][]string{cmd.GetOutputPaths(), cmd.GetOutputFiles(), cmd.GetOutputDirectories()} {
+		if len(paths) > 0 {
+			return paths[0]
+		}
+	}
+	return ""
+}
+
+// leastLoaded prefers the nodes with the fewest queued and running tasks, as
+// reported in their most recent registration.
+type leastLoaded struct{}
+
+func (s *leastLoaded) rankNodes(ctx context.Context, params *routingParams, nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].GetQueueLength() < nodes[j].GetQueueLength()
+	})
+	return nodes
+}
+
+func (s *leastLoaded) markComplete(ctx context.Context, params *routingParams, executorID string) {}
@@ -8,39 +8,44 @@ import (
 	"strings"
 	"time"
 
-	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
-	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flagutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
-	"github.com/go-redis/redis/v8"
 	"google.golang.org/protobuf/proto"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
 
+var (
+	defaultStrategies = flagutil.New("remote_execution.task_router.default_strategies", []string{runnerRecyclingStrategy}, "The routing strategies used for executor pools that are not configured in remote_execution.task_router.pool_strategies, in decreasing order of precedence. Valid strategies are: "+strings.Join(strategyNames, ", "))
+	poolStrategies    = flagutil.New("remote_execution.task_router.pool_strategies", []PoolStrategies{}, "Per-pool overrides for remote_execution.task_router.default_strategies.")
+)
+
 const (
 	day = 24 * time.Hour
 
 	// The TTL for each node list in the routing table.
 	routingPropsKeyTTL = 7 * day
-
-	// The default max number of preferred nodes that are returned by the task
-	// router for routable tasks. This is intentionally less than the number of
-	// probes per task (for load balancing purposes).
-	defaultPreferredNodeLimit = 1
-	// The preferred node limit for workflows.
-	// This is set higher than the default limit since we strongly prefer
-	// workflow tasks to hit a node with a warm bazel workspace, but it is
-	// set less than the number of probes so that we can autoscale the workflow
-	// executor pool effectively.
-	workflowsPreferredNodeLimit = 2
 )
 
+// PoolStrategies configures the routing strategies used for an executor pool.
+type PoolStrategies struct {
+	Pool       string   `yaml:"pool" json:"pool" usage:"The name of the executor pool."`
+	Strategies []string `yaml:"strategies" json:"strategies" usage:"The routing strategies used for tasks in the pool, in decreasing order of precedence."`
+}
+
 type taskRouter struct {
 	env environment.Env
-	rdb redis.UniversalClient
+
+	// The strategies used for pools without a pool-specific configuration.
+	defaultStrategies []strategy
+	// The strategies used for each configured pool.
+	poolStrategies map[string][]strategy
+	// All strategies that are used by any pool. These are notified of every
+	// completed task, since the pool isn't known when a task completes.
+	allStrategies []strategy
 }
 
 func Register(env environment.Env) error {
@@ -61,128 +66,118 @@ func New(env environment.Env) (interfaces.TaskRouter, error) {
 	if rdb == nil {
 		return nil, status.FailedPreconditionError("Redis is required for task router")
 	}
-	return &taskRouter{
-		env: env,
-		rdb: rdb,
-	}, nil
-}
-
-// RankNodes returns the input nodes ordered by their affinity to the given
-// routing properties.
-func (tr *taskRouter) RankNodes(ctx context.Context, cmd *repb.Command, remoteInstanceName string, nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
-	nodes = copyNodes(nodes)
-
-	rand.Shuffle(len(nodes), func(i, j int) {
-		nodes[i], nodes[j] = nodes[j], nodes[i]
-	})
+	strategiesByName := map[string]strategy{}
+	getStrategies := func(names []string) ([]strategy, error) {
+		var out []strategy
+		for _, name := range names {
+			s := strategiesByName[name]
+			if s == nil {
+				newStrategy, ok := strategyConstructors[name]
+				if !ok {
+					return nil, status.InvalidArgumentErrorf("unknown task routing strategy %q (valid strategies are: %s)", name, strings.Join(strategyNames, ", "))
+				}
+				s = newStrategy(rdb)
+				strategiesByName[name] = s
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
 
-	if cmd == nil {
-		return nodes
+	tr := &taskRouter{
+		env:            env,
+		poolStrategies: map[string][]strategy{},
 	}
-	preferredNodeLimit := getPreferredNodeLimit(cmd)
-	if preferredNodeLimit == 0 {
-		return nodes
+	var err error
+	if tr.defaultStrategies, err = getStrategies(*defaultStrategies); err != nil {
+		return nil, err
 	}
-
-	key, err := tr.routingKey(ctx, cmd, remoteInstanceName)
-	if err != nil {
-		log.Errorf("Failed to compute routing key: %s", err)
-		return nodes
+	for _, ps := range *poolStrategies {
+		if _, ok := tr.poolStrategies[ps.Pool]; ok {
+			return nil, status.InvalidArgumentErrorf("task routing strategies are configured more than once for pool %q", ps.Pool)
+		}
+		if tr.poolStrategies[ps.Pool], err = getStrategies(ps.Strategies); err != nil {
+			return nil, err
+		}
 	}
-	preferredNodeIDs, err := tr.rdb.LRange(ctx, key, 0, -1).Result()
-	if err != nil {
-		log.Errorf("Failed to rank nodes: redis LRANGE failed: %s", err)
-		return nodes
+	// Iterate in a fixed order so that MarkComplete is deterministic.
+	for _, name := range strategyNames {
+		if s := strategiesByName[name]; s != nil {
+			tr.allStrategies = append(tr.allStrategies, s)
+		}
 	}
+	return tr, nil
+}
 
-	nodeByID := map[string]interfaces.ExecutionNode{}
-	for _, node := range nodes {
-		nodeByID[node.GetExecutorID()] = node
-	}
-	preferredSet := map[string]struct{}{}
-	ranked := make([]interfaces.ExecutionNode, 0, len(nodes))
+// RankNodes returns the input nodes ordered by the routing strategies
+// configured for the given pool.
+func (tr *taskRouter) RankNodes(ctx context.Context, pool string, action *repb.Action, cmd *repb.Command, remoteInstanceName string, nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
+	nodes = copyNodes(nodes)
 
-	log.Debugf("Preferred executor IDs for %q: %v", key, preferredNodeIDs)
+	rand.Shuffle(len(nodes), func(i, j int) {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	})
 
-	// Place all preferred nodes first (in the order that they appear in the Redis
-	// list), then the remaining ones in shuffled order.
-	for _, id := range preferredNodeIDs[:minInt(preferredNodeLimit, len(preferredNodeIDs))] {
-		node := nodeByID[id]
-		if node == nil {
-			continue
-		}
-		preferredSet[id] = struct{}{}
-		ranked = append(ranked, node)
+	params := tr.routingParams(ctx, action, cmd, remoteInstanceName)
+	strategies, ok := tr.poolStrategies[pool]
+	if !ok {
+		strategies = tr.defaultStrategies
 	}
-	for _, node := range nodes {
-		if _, ok := preferredSet[node.GetExecutorID()]; ok {
-			continue
-		}
-		ranked = append(ranked, node)
+	// Each strategy only reorders the nodes that it has a preference between,
+	// so applying the strategies in increasing order of precedence lets the
+	// strategies with higher precedence override the ones with lower
+	// precedence, while the latter still break ties for the former.
+	for i := len(strategies) - 1; i >= 0; i-- {
+		nodes = strategies[i].rankNodes(ctx, params, nodes)
 	}
-
-	return ranked
+	return nodes
 }
 
 // MarkComplete updates the routing table after a task is completed, so that
-// future tasks with those properties are more likely to be fulfilled by the
+// future tasks with similar properties are more likely to be fulfilled by the
 // given node.
-func (tr *taskRouter) MarkComplete(ctx context.Context, cmd *repb.Command, remoteInstanceName, executorID string) {
-	nodeListMaxLength := getPreferredNodeLimit(cmd)
-	if nodeListMaxLength == 0 {
-		return
-	}
-	key, err := tr.routingKey(ctx, cmd, remoteInstanceName)
-	if err != nil {
-		log.Errorf("Failed to compute routing key: %s", err)
-		return
-	}
-
-	pipe := tr.rdb.TxPipeline()
-	// Push the node to the head of the list (but first remove it if already
-	// present to avoid dupes), trim to max length to prevent it from growing
-	// too large, and renew the TTL.
-	pipe.LRem(ctx, key, 1, executorID)
-	pipe.LPush(ctx, key, executorID)
-	pipe.LTrim(ctx, key, 0, int64(nodeListMaxLength)-1)
-	pipe.Expire(ctx, key, routingPropsKeyTTL)
-	if _, err := pipe.Exec(ctx); err != nil {
-		log.Errorf("Failed to mark task complete: redis pipeline failed: %s", err)
-		return
+func (tr *taskRouter) MarkComplete(ctx context.Context, action *repb.Action, cmd *repb.Command, remoteInstanceName, executorID string) {
+	params := tr.routingParams(ctx, action, cmd, remoteInstanceName)
+	for _, s := range tr.allStrategies {
+		s.markComplete(ctx, params, executorID)
 	}
-
-	log.Debugf("Preferred executor %q added to %q", executorID, key)
 }
 
-// getPreferredNodeLimit returns the max number of nodes that should be stored
-// in the preferred executors list for each task key, as well as the max number
-// of preferred nodes that should be returned by RankNodes.
-func getPreferredNodeLimit(cmd *repb.Command) int {
-	isRunnerRecyclingEnabled := platform.IsTrue(platform.FindValue(cmd.GetPlatform(), platform.RecycleRunnerPropertyName))
-	if !isRunnerRecyclingEnabled {
-		return 0
+func (tr *taskRouter) routingParams(ctx context.Context, action *repb.Action, cmd *repb.Command, remoteInstanceName string) *routingParams {
+	groupID := interfaces.AuthAnonymousUser
+	if u, err := perms.AuthenticatedUser(ctx, tr.env); err == nil {
+		groupID = u.GetGroupID()
 	}
-	workflowID := platform.FindValue(cmd.GetPlatform(), platform.WorkflowIDPropertyName)
-	if workflowID != "" {
-		return workflowsPreferredNodeLimit
+	return &routingParams{
+		action:             action,
+		cmd:                cmd,
+		remoteInstanceName: remoteInstanceName,
+		groupID:            groupID,
 	}
-	return defaultPreferredNodeLimit
 }
 
-func (tr *taskRouter) routingKey(ctx context.Context, cmd *repb.Command, remoteInstanceName string) (string, error) {
-	parts := []string{"task_route"}
-
-	if u, err := perms.AuthenticatedUser(ctx, tr.env); err == nil {
-		parts = append(parts, u.GetGroupID())
-	} else {
-		parts = append(parts, interfaces.AuthAnonymousUser)
-	}
+// routingParams contains the properties of a task that are used to route it.
+type routingParams struct {
+	action             *repb.Action
+	cmd                *repb.Command
+	remoteInstanceName string
+	groupID            string
+}
 
-	if remoteInstanceName != "" {
-		parts = append(parts, remoteInstanceName)
+// routingKey returns a Redis key for the routing table entry identified by
+// the given parts, namespaced by group ID and remote instance name.
+func (p *routingParams) routingKey(parts ...string) string {
+	keyParts := []string{"task_route", p.groupID}
+	if p.remoteInstanceName != "" {
+		keyParts = append(keyParts, p.remoteInstanceName)
 	}
+	keyParts = append(keyParts, parts...)
+	return strings.Join(keyParts, "/")
+}
 
-	platform := cmd.GetPlatform()
+// platformHash returns a hash of the command's platform properties.
+func (p *routingParams) platformHash() (string, error) {
+	platform := p.cmd.GetPlatform()
 	if platform == nil {
 		platform = &repb.Platform{}
 	}
@@ -190,9 +185,7 @@ func (tr *taskRouter) routingKey(ctx context.Context, cmd *repb.Command, remoteI
 	if err != nil {
 		return "", status.InternalErrorf("failed to marshal Command: %s", err)
 	}
-	parts = append(parts, fmt.Sprintf("%x", sha256.Sum256(b)))
-
-	return strings.Join(parts, "/"), nil
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
 }
 
 func copyNodes(nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
@@ -200,10 +193,3 @@ func copyNodes(nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
 	copy(out, nodes)
 	return out
 }
-
-func minInt(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
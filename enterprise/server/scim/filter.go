@@ -0,0 +1,274 @@
+package scim
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// attributes maps lowercased SCIM attribute paths (e.g. "name.givenname") to
+// the values of a resource that filters are evaluated against.
+type attributes map[string][]string
+
+// filter is a parsed SCIM filter expression (RFC 7644 section 3.4.2.2).
+//
+// Only the subset of the filter grammar that identity providers use in
+// practice is supported: attribute comparisons with the eq, ne, co, sw, ew
+// and pr operators, combined with and, or, not and parentheses. Comparisons
+// are case-insensitive.
+type filter interface {
+	matches(attrs attributes) bool
+}
+
+type andFilter struct{ left, right filter }
+
+func (f *andFilter) matches(attrs attributes) bool {
+	return f.left.matches(attrs) && f.right.matches(attrs)
+}
+
+type orFilter struct{ left, right filter }
+
+func (f *orFilter) matches(attrs attributes) bool {
+	return f.left.matches(attrs) || f.right.matches(attrs)
+}
+
+type notFilter struct{ f filter }
+
+func (f *notFilter) matches(attrs attributes) bool {
+	return !f.f.matches(attrs)
+}
+
+type compareFilter struct {
+	attr  string
+	op    string
+	value string
+}
+
+func (f *compareFilter) matches(attrs attributes) bool {
+	values := attrs[f.attr]
+	if f.op == "pr" {
+		for _, v := range values {
+			if v != "" {
+				return true
+			}
+		}
+		return false
+	}
+	if f.op == "ne" {
+		for _, v := range values {
+			if strings.EqualFold(v, f.value) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		v, want := strings.ToLower(v), strings.ToLower(f.value)
+		switch f.op {
+		case "eq":
+			if v == want {
+				return true
+			}
+		case "co":
+			if strings.Contains(v, want) {
+				return true
+			}
+		case "sw":
+			if strings.HasPrefix(v, want) {
+				return true
+			}
+		case "ew":
+			if strings.HasSuffix(v, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func tokenizeFilter(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			// Quoted strings are kept quoted so that they can be told apart
+			// from keywords.
+			j := i + 1
+			var sb strings.Builder
+			sb.WriteByte('"')
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				sb.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, status.InvalidArgumentError("unterminated string in filter")
+			}
+			tokens = append(tokens, sb.String())
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && s[j] != ' ' && s[j] != '(' && s[j] != ')' && s[j] != '"' {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseFilter parses a SCIM filter expression.
+func parseFilter(s string) (filter, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, status.InvalidArgumentErrorf("unexpected token %q in filter", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", status.InvalidArgumentError("unexpected end of filter")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *filterParser) parseOr() (filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orFilter{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filter, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &andFilter{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseFactor() (filter, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(t, "not") {
+		if t, err := p.next(); err != nil || t != "(" {
+			return nil, status.InvalidArgumentError("expected '(' after 'not' in filter")
+		}
+		f, err := p.parseGroup()
+		if err != nil {
+			return nil, err
+		}
+		return &notFilter{f}, nil
+	}
+	if t == "(" {
+		return p.parseGroup()
+	}
+	if !isAttributePath(t) {
+		return nil, status.InvalidArgumentErrorf("invalid attribute %q in filter", t)
+	}
+	attr := strings.ToLower(t)
+	for _, schema := range []string{userSchema, groupSchema} {
+		attr = strings.TrimPrefix(attr, strings.ToLower(schema)+":")
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op = strings.ToLower(op)
+	switch op {
+	case "pr":
+		return &compareFilter{attr: attr, op: op}, nil
+	case "eq", "ne", "co", "sw", "ew":
+	default:
+		return nil, status.InvalidArgumentErrorf("unsupported filter operator %q", op)
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(value, `"`) {
+		value = value[1:]
+	} else if value == "(" || value == ")" {
+		return nil, status.InvalidArgumentErrorf("invalid value %q in filter", value)
+	} else {
+		// Unquoted values are booleans, numbers or null.
+		value = strings.ToLower(value)
+	}
+	return &compareFilter{attr: attr, op: op, value: value}, nil
+}
+
+// parseGroup parses the rest of a parenthesized expression, after the opening
+// parenthesis.
+func (p *filterParser) parseGroup() (filter, error) {
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t, err := p.next(); err != nil || t != ")" {
+		return nil, status.InvalidArgumentError("expected ')' in filter")
+	}
+	return f, nil
+}
+
+func isAttributePath(s string) bool {
+	if s == "" || strings.HasPrefix(s, `"`) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.' && r != '_' && r != '-' && r != ':' && r != '$' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,1149 @@
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/samlutil"
+	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/build_buddy_url"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/http/interceptors"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/claims"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/role"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/grpc/codes"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+	uidpb "github.com/buildbuddy-io/buildbuddy/proto/user_id"
+	gstatus "google.golang.org/grpc/status"
+)
+
+var (
+	enableSCIM = flag.Bool("auth.enable_scim", false, "Whether to enable the SCIM 2.0 API for provisioning users from an identity provider.")
+)
+
+const (
+	userSchema                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	groupSchema                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	listResponseSchema          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	patchOpSchema               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	errorSchema                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	serviceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+
+	basePath   = "/scim/"
+	usersPath  = "Users"
+	groupsPath = "Groups"
+
+	contentType = "application/scim+json"
+
+	defaultPageSize = 100
+	maxPageSize     = 1000
+
+	maxRequestBodyBytes = 1024 * 1024
+)
+
+// roleGroup is a SCIM group that corresponds to a BuildBuddy role. SCIM
+// groups can't be created or deleted; instead, IdP groups are mapped to
+// roles by pushing them to the role groups. Adding a user to a role group
+// grants them the role, and removing them from the group that matches their
+// current role resets them to the default role.
+type roleGroup struct {
+	id          string
+	displayName string
+	role        role.Role
+}
+
+var roleGroups = []*roleGroup{
+	{id: "admin", displayName: "Admin", role: role.Admin},
+	{id: "developer", displayName: "Developer", role: role.Developer},
+}
+
+func roleGroupByID(id string) *roleGroup {
+	for _, rg := range roleGroups {
+		if rg.id == id {
+			return rg
+		}
+	}
+	return nil
+}
+
+func roleGroupForRole(r role.Role) *roleGroup {
+	if r&role.Admin == role.Admin {
+		return roleGroupByID("admin")
+	}
+	return roleGroupByID("developer")
+}
+
+type name struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// reference refers to another resource, e.g. a group that a user is a member
+// of or a member of a group.
+type reference struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+type meta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Location     string `json:"location"`
+}
+
+type userResource struct {
+	Schemas  []string    `json:"schemas"`
+	ID       string      `json:"id,omitempty"`
+	UserName string      `json:"userName"`
+	Name     name        `json:"name"`
+	Emails   []email     `json:"emails,omitempty"`
+	Active   *bool       `json:"active,omitempty"`
+	Groups   []reference `json:"groups,omitempty"`
+	Meta     *meta       `json:"meta,omitempty"`
+}
+
+// isActive returns whether the user should be a member of the organization.
+// Users are active unless explicitly deactivated.
+func (u *userResource) isActive() bool {
+	return u.Active == nil || *u.Active
+}
+
+func (u *userResource) primaryEmail() string {
+	for _, e := range u.Emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	if strings.Contains(u.UserName, "@") {
+		return u.UserName
+	}
+	return ""
+}
+
+type groupResource struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	DisplayName string      `json:"displayName"`
+	Members     []reference `json:"members"`
+	Meta        *meta       `json:"meta,omitempty"`
+}
+
+type listResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []any    `json:"Resources"`
+}
+
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type patchRequest struct {
+	Schemas    []string          `json:"schemas"`
+	Operations []*patchOperation `json:"Operations"`
+}
+
+type errorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+// orgUser is a user that is managed by an organization via SCIM.
+type orgUser struct {
+	user *tables.User
+	// Whether the user is currently a member of the organization.
+	active bool
+	role   role.Role
+}
+
+// SCIMServer implements the SCIM 2.0 protocol (RFC 7644) for the Users and
+// Groups resources, allowing identity providers to provision users and
+// assign roles within the organization that owns the API key used to
+// authenticate.
+//
+// SCIM users are BuildBuddy users that either are members of the
+// organization, or were provisioned for it via SAML or SCIM. Deactivating a
+// user removes them from the organization, but they can be re-activated
+// later.
+type SCIMServer struct {
+	env environment.Env
+}
+
+func Register(env environment.Env) error {
+	if !*enableSCIM {
+		return nil
+	}
+	if env.GetUserDB() == nil || env.GetAuthDB() == nil {
+		return status.FailedPreconditionError("SCIM requires UserDB and AuthDB to be configured")
+	}
+	s := NewSCIMServer(env)
+	env.GetMux().Handle(basePath, apiKeyFromBearerToken(interceptors.WrapAuthenticatedExternalHandler(env, s)))
+	return nil
+}
+
+func NewSCIMServer(env environment.Env) *SCIMServer {
+	return &SCIMServer{env: env}
+}
+
+// apiKeyFromBearerToken allows passing the API key as a bearer token, since
+// that is the only form of token authentication that most identity
+// providers support.
+func apiKeyFromBearerToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(authutil.APIKeyHeader) == "" {
+			if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+				r.Header.Set(authutil.APIKeyHeader, strings.TrimSpace(token))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *SCIMServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, g, err := s.authorize(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, basePath), "/"), "/")
+	var res any
+	code := http.StatusOK
+	switch {
+	case len(parts) == 1 && parts[0] == "ServiceProviderConfig" && r.Method == http.MethodGet:
+		res = serviceProviderConfig()
+	case len(parts) == 1 && parts[0] == usersPath && r.Method == http.MethodGet:
+		res, err = s.listUsers(ctx, g, r.URL.Query())
+	case len(parts) == 1 && parts[0] == usersPath && r.Method == http.MethodPost:
+		res, err = s.createUser(ctx, g, r)
+		code = http.StatusCreated
+	case len(parts) == 2 && parts[0] == usersPath && r.Method == http.MethodGet:
+		res, err = s.getUser(ctx, g, parts[1])
+	case len(parts) == 2 && parts[0] == usersPath && r.Method == http.MethodPut:
+		res, err = s.replaceUser(ctx, g, parts[1], r)
+	case len(parts) == 2 && parts[0] == usersPath && r.Method == http.MethodPatch:
+		res, err = s.patchUser(ctx, g, parts[1], r)
+	case len(parts) == 2 && parts[0] == usersPath && r.Method == http.MethodDelete:
+		err = s.deleteUser(ctx, g, parts[1])
+		code = http.StatusNoContent
+	case len(parts) == 1 && parts[0] == groupsPath && r.Method == http.MethodGet:
+		res, err = s.listGroups(ctx, g, r.URL.Query())
+	case len(parts) == 1 && parts[0] == groupsPath && r.Method == http.MethodPost:
+		res, err = s.createGroup(ctx, g, r)
+		code = http.StatusCreated
+	case len(parts) == 2 && parts[0] == groupsPath && r.Method == http.MethodGet:
+		res, err = s.getGroup(ctx, g, parts[1])
+	case len(parts) == 2 && parts[0] == groupsPath && r.Method == http.MethodPut:
+		res, err = s.replaceGroup(ctx, g, parts[1], r)
+	case len(parts) == 2 && parts[0] == groupsPath && r.Method == http.MethodPatch:
+		res, err = s.patchGroup(ctx, g, parts[1], r)
+	case len(parts) == 2 && parts[0] == groupsPath && r.Method == http.MethodDelete:
+		err = status.InvalidArgumentError("Role groups cannot be deleted")
+	default:
+		err = status.NotFoundErrorf("Unknown SCIM endpoint %s %s", r.Method, r.URL.Path)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, code, res)
+}
+
+// authorize returns the group that the request is authorized to manage, along
+// with a context that is authorized to administer the group's users.
+//
+// API keys are only ever given the default role, so that the org admin
+// capability can't be used to administer the org outside of SCIM. Instead,
+// SCIM requests are granted the admin role here, after checking for the
+// capability.
+func (s *SCIMServer) authorize(ctx context.Context) (context.Context, *tables.Group, error) {
+	u, err := perms.AuthenticatedUser(ctx, s.env)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.GetAPIKeyID() == "" || !u.HasCapability(akpb.ApiKey_ORG_ADMIN_CAPABILITY) {
+		return nil, nil, status.PermissionDeniedError("SCIM requires an API key with the org admin capability")
+	}
+	g, err := s.env.GetUserDB().GetGroupByID(ctx, u.GetGroupID())
+	if err != nil {
+		return nil, nil, err
+	}
+	if g.URLIdentifier == nil || *g.URLIdentifier == "" {
+		return nil, nil, status.FailedPreconditionError("The organization must have a URL identifier to use SCIM")
+	}
+	adminClaims := &claims.Claims{
+		APIKeyID:      u.GetAPIKeyID(),
+		UserID:        u.GetUserID(),
+		GroupID:       g.GroupID,
+		AllowedGroups: []string{g.GroupID},
+		GroupMemberships: []*interfaces.GroupMembership{
+			{GroupID: g.GroupID, Role: role.Admin},
+		},
+		Capabilities:   u.GetCapabilities(),
+		EnforceIPRules: u.GetEnforceIPRules(),
+	}
+	return claims.AuthContextFromClaims(ctx, adminClaims, nil), g, nil
+}
+
+func writeResponse(w http.ResponseWriter, code int, res any) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	if res == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Warningf("Failed to write SCIM response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	scimType := ""
+	switch gstatus.Code(err) {
+	case codes.InvalidArgument:
+		code = http.StatusBadRequest
+		scimType = "invalidValue"
+	case codes.FailedPrecondition:
+		code = http.StatusBadRequest
+	case codes.AlreadyExists:
+		code = http.StatusConflict
+		scimType = "uniqueness"
+	case codes.NotFound:
+		code = http.StatusNotFound
+	case codes.Unauthenticated:
+		code = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		code = http.StatusForbidden
+	case codes.Unimplemented:
+		code = http.StatusNotImplemented
+	}
+	writeResponse(w, code, &errorResponse{
+		Schemas:  []string{errorSchema},
+		Status:   strconv.Itoa(code),
+		ScimType: scimType,
+		Detail:   status.Message(err),
+	})
+}
+
+func serviceProviderConfig() any {
+	supported := func(b bool) map[string]any { return map[string]any{"supported": b} }
+	return map[string]any{
+		"schemas": []string{serviceProviderConfigSchema},
+		"patch":   supported(true),
+		"bulk": map[string]any{
+			"supported":      false,
+			"maxOperations":  0,
+			"maxPayloadSize": 0,
+		},
+		"filter": map[string]any{
+			"supported":  true,
+			"maxResults": maxPageSize,
+		},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "Authentication using an organization API key with the org admin capability.",
+		}},
+	}
+}
+
+func decodeBody(r *http.Request, v any) error {
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodyBytes))
+	if err != nil {
+		return status.InvalidArgumentErrorf("Failed to read request body: %s", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return status.InvalidArgumentErrorf("Invalid request body: %s", err)
+	}
+	return nil
+}
+
+func formatUsec(usec int64) string {
+	if usec == 0 {
+		return ""
+	}
+	return time.UnixMicro(usec).UTC().Format(time.RFC3339)
+}
+
+func location(resourceType, id string) string {
+	return build_buddy_url.WithPath("scim/" + resourceType + "/" + id).String()
+}
+
+// subIDPrefix returns the prefix of the subject IDs of users provisioned for
+// the group. It matches the subject IDs of users that log in via SAML, so
+// that users provisioned via SCIM can later log in via SAML and vice versa.
+func subIDPrefix(g *tables.Group) string {
+	return samlutil.EntityID(*g.URLIdentifier) + "/"
+}
+
+func (s *SCIMServer) userNameFor(g *tables.Group, u *tables.User) string {
+	if userName, ok := strings.CutPrefix(u.SubID, subIDPrefix(g)); ok {
+		return userName
+	}
+	// Users that joined the organization some other way don't have a
+	// username that was assigned by the IdP.
+	return u.Email
+}
+
+func (s *SCIMServer) toUserResource(g *tables.Group, ou *orgUser) *userResource {
+	active := ou.active
+	res := &userResource{
+		Schemas:  []string{userSchema},
+		ID:       ou.user.UserID,
+		UserName: s.userNameFor(g, ou.user),
+		Name: name{
+			GivenName:  ou.user.FirstName,
+			FamilyName: ou.user.LastName,
+		},
+		Active: &active,
+		Meta: &meta{
+			ResourceType: "User",
+			Created:      formatUsec(ou.user.CreatedAtUsec),
+			LastModified: formatUsec(ou.user.UpdatedAtUsec),
+			Location:     location(usersPath, ou.user.UserID),
+		},
+	}
+	if ou.user.Email != "" {
+		res.Emails = []email{{Value: ou.user.Email, Type: "work", Primary: true}}
+	}
+	if ou.active {
+		rg := roleGroupForRole(ou.role)
+		res.Groups = []reference{{Value: rg.id, Display: rg.displayName}}
+	}
+	return res
+}
+
+func userAttributes(res *userResource) attributes {
+	attrs := attributes{
+		"id":              {res.ID},
+		"username":        {res.UserName},
+		"name.givenname":  {res.Name.GivenName},
+		"name.familyname": {res.Name.FamilyName},
+		"active":          {strconv.FormatBool(res.isActive())},
+	}
+	for _, e := range res.Emails {
+		attrs["emails"] = append(attrs["emails"], e.Value)
+		attrs["emails.value"] = append(attrs["emails.value"], e.Value)
+	}
+	for _, g := range res.Groups {
+		attrs["groups"] = append(attrs["groups"], g.Value)
+		attrs["groups.value"] = append(attrs["groups.value"], g.Value)
+		attrs["groups.display"] = append(attrs["groups.display"], g.Display)
+	}
+	return attrs
+}
+
+// getOrgUsers returns the users managed by the group, ordered by user ID. If
+// userID is set, only that user is returned.
+func (s *SCIMServer) getOrgUsers(ctx context.Context, g *tables.Group, userID string) ([]*orgUser, error) {
+	prefix := subIDPrefix(g)
+	q := `
+		SELECT u.user_id, u.sub_id, u.first_name, u.last_name, u.email,
+			u.created_at_usec, u.updated_at_usec, ug.membership_status, ug.role
+		FROM "Users" AS u
+		LEFT JOIN "UserGroups" AS ug
+		ON ug.user_user_id = u.user_id AND ug.group_group_id = ?
+		WHERE (ug.membership_status = ? OR SUBSTR(u.sub_id, 1, ?) = ?)`
+	args := []any{g.GroupID, int32(grpb.GroupMembershipStatus_MEMBER), len(prefix), prefix}
+	if userID != "" {
+		q += ` AND u.user_id = ?`
+		args = append(args, userID)
+	}
+	q += ` ORDER BY u.user_id`
+	rows, err := s.env.GetDBHandle().DB(ctx).Raw(q, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*orgUser
+	for rows.Next() {
+		u := &tables.User{}
+		var membershipStatus *int32
+		var userRole *uint32
+		err := rows.Scan(
+			&u.UserID, &u.SubID, &u.FirstName, &u.LastName, &u.Email,
+			&u.CreatedAtUsec, &u.UpdatedAtUsec, &membershipStatus, &userRole,
+		)
+		if err != nil {
+			return nil, err
+		}
+		ou := &orgUser{
+			user:   u,
+			active: membershipStatus != nil && *membershipStatus == int32(grpb.GroupMembershipStatus_MEMBER),
+		}
+		if userRole != nil {
+			ou.role = role.Role(*userRole)
+		}
+		users = append(users, ou)
+	}
+	return users, nil
+}
+
+func (s *SCIMServer) getOrgUser(ctx context.Context, g *tables.Group, userID string) (*orgUser, error) {
+	users, err := s.getOrgUsers(ctx, g, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, status.NotFoundErrorf("User %q not found", userID)
+	}
+	return users[0], nil
+}
+
+// paginate returns the page of results requested by the startIndex and count
+// query parameters.
+func paginate(resources []any, query map[string][]string) (*listResponse, error) {
+	startIndex := 1
+	if v := firstValue(query, "startIndex"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("Invalid startIndex %q", v)
+		}
+		// Per the spec, values less than 1 are interpreted as 1.
+		startIndex = max(i, 1)
+	}
+	count := defaultPageSize
+	if v := firstValue(query, "count"); v != "" {
+		c, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("Invalid count %q", v)
+		}
+		count = min(max(c, 0), maxPageSize)
+	}
+	page := []any{}
+	if startIndex <= len(resources) {
+		page = resources[startIndex-1 : min(startIndex-1+count, len(resources))]
+	}
+	return &listResponse{
+		Schemas:      []string{listResponseSchema},
+		TotalResults: len(resources),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	}, nil
+}
+
+func firstValue(query map[string][]string, key string) string {
+	if v := query[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (s *SCIMServer) listUsers(ctx context.Context, g *tables.Group, query map[string][]string) (*listResponse, error) {
+	var f filter
+	if v := firstValue(query, "filter"); v != "" {
+		var err error
+		if f, err = parseFilter(v); err != nil {
+			return nil, err
+		}
+	}
+	users, err := s.getOrgUsers(ctx, g, "")
+	if err != nil {
+		return nil, err
+	}
+	var resources []any
+	for _, ou := range users {
+		res := s.toUserResource(g, ou)
+		if f != nil && !f.matches(userAttributes(res)) {
+			continue
+		}
+		resources = append(resources, res)
+	}
+	return paginate(resources, query)
+}
+
+func (s *SCIMServer) getUser(ctx context.Context, g *tables.Group, userID string) (*userResource, error) {
+	ou, err := s.getOrgUser(ctx, g, userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.toUserResource(g, ou), nil
+}
+
+func (s *SCIMServer) createUser(ctx context.Context, g *tables.Group, r *http.Request) (*userResource, error) {
+	req := &userResource{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(req.UserName) == "" {
+		return nil, status.InvalidArgumentError("userName is required")
+	}
+	subID := subIDPrefix(g) + req.UserName
+
+	existing, err := s.env.GetAuthDB().LookupUserFromSubID(ctx, subID)
+	if err != nil && !db.IsRecordNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		// The user was provisioned before, so re-activate them rather than
+		// creating a new user.
+		ou, err := s.getOrgUser(ctx, g, existing.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if ou.active {
+			return nil, status.AlreadyExistsErrorf("User %q already exists", req.UserName)
+		}
+		req.ID = ou.user.UserID
+		return s.updateUser(ctx, g, ou, req)
+	}
+
+	pk, err := tables.PrimaryKeyForTable("Users")
+	if err != nil {
+		return nil, err
+	}
+	u := &tables.User{
+		UserID:    pk,
+		SubID:     subID,
+		FirstName: req.Name.GivenName,
+		LastName:  req.Name.FamilyName,
+		Email:     req.primaryEmail(),
+		Groups: []*tables.GroupRole{
+			{Group: tables.Group{URLIdentifier: g.URLIdentifier}},
+		},
+	}
+	if err := s.env.GetUserDB().InsertUser(ctx, u); err != nil {
+		return nil, err
+	}
+	if !req.isActive() {
+		if err := s.removeFromGroup(ctx, g, u.UserID); err != nil {
+			return nil, err
+		}
+	}
+	return s.getUser(ctx, g, u.UserID)
+}
+
+func (s *SCIMServer) replaceUser(ctx context.Context, g *tables.Group, userID string, r *http.Request) (*userResource, error) {
+	ou, err := s.getOrgUser(ctx, g, userID)
+	if err != nil {
+		return nil, err
+	}
+	req := &userResource{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+	return s.updateUser(ctx, g, ou, req)
+}
+
+func (s *SCIMServer) patchUser(ctx context.Context, g *tables.Group, userID string, r *http.Request) (*userResource, error) {
+	ou, err := s.getOrgUser(ctx, g, userID)
+	if err != nil {
+		return nil, err
+	}
+	req := &patchRequest{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+	res := s.toUserResource(g, ou)
+	for _, op := range req.Operations {
+		if err := applyUserPatch(res, op); err != nil {
+			return nil, err
+		}
+	}
+	return s.updateUser(ctx, g, ou, res)
+}
+
+// updateUser updates the user to match the requested resource.
+func (s *SCIMServer) updateUser(ctx context.Context, g *tables.Group, ou *orgUser, req *userResource) (*userResource, error) {
+	if req.UserName != "" && req.UserName != s.userNameFor(g, ou.user) {
+		return nil, status.InvalidArgumentError("userName cannot be changed")
+	}
+	updated := &tables.User{
+		UserID:    ou.user.UserID,
+		FirstName: req.Name.GivenName,
+		LastName:  req.Name.FamilyName,
+		Email:     req.primaryEmail(),
+	}
+	if updated.Email == "" {
+		updated.Email = ou.user.Email
+	}
+	profileChanged := updated.FirstName != ou.user.FirstName || updated.LastName != ou.user.LastName || updated.Email != ou.user.Email
+
+	// Only the group that provisioned the user can update them, and only
+	// while they're a member, so the profile must be updated while the user
+	// is still part of the group.
+	if req.isActive() && !ou.active {
+		if err := s.addToGroup(ctx, g, ou.user.UserID); err != nil {
+			return nil, err
+		}
+	}
+	if profileChanged && (req.isActive() || ou.active) {
+		if err := s.env.GetUserDB().UpdateUser(ctx, g.GroupID, updated); err != nil {
+			return nil, err
+		}
+	}
+	if !req.isActive() && ou.active {
+		if err := s.removeFromGroup(ctx, g, ou.user.UserID); err != nil {
+			return nil, err
+		}
+	}
+	return s.getUser(ctx, g, ou.user.UserID)
+}
+
+func (s *SCIMServer) deleteUser(ctx context.Context, g *tables.Group, userID string) error {
+	ou, err := s.getOrgUser(ctx, g, userID)
+	if err != nil {
+		return err
+	}
+	if !ou.active {
+		return nil
+	}
+	return s.removeFromGroup(ctx, g, userID)
+}
+
+func (s *SCIMServer) addToGroup(ctx context.Context, g *tables.Group, userID string) error {
+	return s.env.GetUserDB().UpdateGroupUsers(ctx, g.GroupID, []*grpb.UpdateGroupUsersRequest_Update{{
+		UserId:           &uidpb.UserId{Id: userID},
+		MembershipAction: grpb.UpdateGroupUsersRequest_Update_ADD,
+		Role:             role.ToProto(role.Default),
+	}})
+}
+
+func (s *SCIMServer) removeFromGroup(ctx context.Context, g *tables.Group, userID string) error {
+	return s.env.GetUserDB().UpdateGroupUsers(ctx, g.GroupID, []*grpb.UpdateGroupUsersRequest_Update{{
+		UserId:           &uidpb.UserId{Id: userID},
+		MembershipAction: grpb.UpdateGroupUsersRequest_Update_REMOVE,
+	}})
+}
+
+// parseBool parses a boolean patch value. Some identity providers send
+// booleans as strings, e.g. "False".
+func parseBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+	var str string
+	if err := json.Unmarshal(value, &str); err == nil {
+		if b, err := strconv.ParseBool(strings.ToLower(str)); err == nil {
+			return b, nil
+		}
+	}
+	return false, status.InvalidArgumentErrorf("Invalid boolean value %s", string(value))
+}
+
+func parseString(value json.RawMessage) (string, error) {
+	var str string
+	if err := json.Unmarshal(value, &str); err != nil {
+		return "", status.InvalidArgumentErrorf("Invalid string value %s", string(value))
+	}
+	return str, nil
+}
+
+func applyUserPatch(res *userResource, op *patchOperation) error {
+	opName := strings.ToLower(op.Op)
+	if opName != "add" && opName != "replace" && opName != "remove" {
+		return status.InvalidArgumentErrorf("Unsupported patch operation %q", op.Op)
+	}
+	remove := opName == "remove"
+	if op.Path == "" {
+		if remove {
+			return status.InvalidArgumentError("A path is required for remove operations")
+		}
+		values := map[string]json.RawMessage{}
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return status.InvalidArgumentErrorf("Invalid patch value: %s", err)
+		}
+		// Sort the attributes to apply them in a deterministic order.
+		paths := make([]string, 0, len(values))
+		for path := range values {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			if err := applyUserAttribute(res, path, values[path], false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return applyUserAttribute(res, op.Path, op.Value, remove)
+}
+
+func applyUserAttribute(res *userResource, path string, value json.RawMessage, remove bool) error {
+	path = strings.TrimPrefix(strings.ToLower(path), strings.ToLower(userSchema)+":")
+	if strings.HasPrefix(path, "emails") {
+		// Paths like emails[type eq "work"].value are treated as updating
+		// the primary email, since only one email is stored per user.
+		if remove {
+			res.Emails = nil
+			return nil
+		}
+		if path == "emails" {
+			var emails []email
+			if err := json.Unmarshal(value, &emails); err != nil {
+				return status.InvalidArgumentErrorf("Invalid emails value: %s", err)
+			}
+			res.Emails = emails
+			return nil
+		}
+		str, err := parseString(value)
+		if err != nil {
+			return err
+		}
+		res.Emails = []email{{Value: str, Type: "work", Primary: true}}
+		return nil
+	}
+	switch path {
+	case "active":
+		if remove {
+			return status.InvalidArgumentError("active cannot be removed")
+		}
+		active, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		res.Active = &active
+	case "username":
+		if remove {
+			return status.InvalidArgumentError("userName cannot be removed")
+		}
+		str, err := parseString(value)
+		if err != nil {
+			return err
+		}
+		res.UserName = str
+	case "name":
+		if remove {
+			res.Name = name{}
+			return nil
+		}
+		n := name{}
+		if err := json.Unmarshal(value, &n); err != nil {
+			return status.InvalidArgumentErrorf("Invalid name value: %s", err)
+		}
+		res.Name = n
+	case "name.givenname", "name.familyname":
+		str := ""
+		if !remove {
+			var err error
+			if str, err = parseString(value); err != nil {
+				return err
+			}
+		}
+		if path == "name.givenname" {
+			res.Name.GivenName = str
+		} else {
+			res.Name.FamilyName = str
+		}
+	default:
+		// Identity providers commonly send attributes that BuildBuddy doesn't
+		// store (e.g. title or locale), so just ignore those.
+		log.Debugf("SCIM: ignoring patch for unsupported user attribute %q", path)
+	}
+	return nil
+}
+
+func (s *SCIMServer) toGroupResource(rg *roleGroup, users []*orgUser) *groupResource {
+	res := &groupResource{
+		Schemas:     []string{groupSchema},
+		ID:          rg.id,
+		DisplayName: rg.displayName,
+		Members:     []reference{},
+		Meta: &meta{
+			ResourceType: "Group",
+			Location:     location(groupsPath, rg.id),
+		},
+	}
+	for _, ou := range users {
+		if ou.active && roleGroupForRole(ou.role) == rg {
+			res.Members = append(res.Members, reference{Value: ou.user.UserID, Display: ou.user.Email})
+		}
+	}
+	return res
+}
+
+func groupAttributes(res *groupResource) attributes {
+	attrs := attributes{
+		"id":          {res.ID},
+		"displayname": {res.DisplayName},
+	}
+	for _, m := range res.Members {
+		attrs["members"] = append(attrs["members"], m.Value)
+		attrs["members.value"] = append(attrs["members.value"], m.Value)
+	}
+	return attrs
+}
+
+func (s *SCIMServer) listGroups(ctx context.Context, g *tables.Group, query map[string][]string) (*listResponse, error) {
+	var f filter
+	if v := firstValue(query, "filter"); v != "" {
+		var err error
+		if f, err = parseFilter(v); err != nil {
+			return nil, err
+		}
+	}
+	users, err := s.getOrgUsers(ctx, g, "")
+	if err != nil {
+		return nil, err
+	}
+	var resources []any
+	for _, rg := range roleGroups {
+		res := s.toGroupResource(rg, users)
+		if f != nil && !f.matches(groupAttributes(res)) {
+			continue
+		}
+		// Identity providers often exclude members when listing groups,
+		// since groups can be very large.
+		if strings.EqualFold(firstValue(query, "excludedAttributes"), "members") {
+			res.Members = nil
+		}
+		resources = append(resources, res)
+	}
+	return paginate(resources, query)
+}
+
+func (s *SCIMServer) getGroup(ctx context.Context, g *tables.Group, id string) (*groupResource, error) {
+	rg := roleGroupByID(id)
+	if rg == nil {
+		return nil, status.NotFoundErrorf("Group %q not found", id)
+	}
+	users, err := s.getOrgUsers(ctx, g, "")
+	if err != nil {
+		return nil, err
+	}
+	return s.toGroupResource(rg, users), nil
+}
+
+// createGroup maps an IdP group to a role group with the same name, adding
+// any members in the request to the role group.
+func (s *SCIMServer) createGroup(ctx context.Context, g *tables.Group, r *http.Request) (*groupResource, error) {
+	req := &groupResource{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+	var rg *roleGroup
+	for _, candidate := range roleGroups {
+		if strings.EqualFold(req.DisplayName, candidate.displayName) {
+			rg = candidate
+		}
+	}
+	if rg == nil {
+		return nil, status.InvalidArgumentErrorf("Unknown group %q: only the role groups Admin and Developer are supported", req.DisplayName)
+	}
+	if err := s.updateGroupMembers(ctx, g, rg, memberIDs(req.Members), nil); err != nil {
+		return nil, err
+	}
+	return s.getGroup(ctx, g, rg.id)
+}
+
+func (s *SCIMServer) replaceGroup(ctx context.Context, g *tables.Group, id string, r *http.Request) (*groupResource, error) {
+	rg := roleGroupByID(id)
+	if rg == nil {
+		return nil, status.NotFoundErrorf("Group %q not found", id)
+	}
+	req := &groupResource{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+	current, err := s.getGroup(ctx, g, id)
+	if err != nil {
+		return nil, err
+	}
+	add := memberIDs(req.Members)
+	var remove []string
+	for _, m := range current.Members {
+		if !contains(add, m.Value) {
+			remove = append(remove, m.Value)
+		}
+	}
+	if err := s.updateGroupMembers(ctx, g, rg, add, remove); err != nil {
+		return nil, err
+	}
+	return s.getGroup(ctx, g, id)
+}
+
+func (s *SCIMServer) patchGroup(ctx context.Context, g *tables.Group, id string, r *http.Request) (*groupResource, error) {
+	rg := roleGroupByID(id)
+	if rg == nil {
+		return nil, status.NotFoundErrorf("Group %q not found", id)
+	}
+	req := &patchRequest{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+	current, err := s.getGroup(ctx, g, id)
+	if err != nil {
+		return nil, err
+	}
+	var add, remove []string
+	for _, op := range req.Operations {
+		opAdd, opRemove, err := groupPatchMembers(op, memberIDs(current.Members))
+		if err != nil {
+			return nil, err
+		}
+		add = append(add, opAdd...)
+		remove = append(remove, opRemove...)
+	}
+	if err := s.updateGroupMembers(ctx, g, rg, add, remove); err != nil {
+		return nil, err
+	}
+	return s.getGroup(ctx, g, id)
+}
+
+// groupPatchMembers returns the members added and removed by a group patch
+// operation.
+func groupPatchMembers(op *patchOperation, current []string) (add, remove []string, err error) {
+	opName := strings.ToLower(op.Op)
+	path := strings.ToLower(op.Path)
+	if op.Path == "" {
+		values := map[string]json.RawMessage{}
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return nil, nil, status.InvalidArgumentErrorf("Invalid patch value: %s", err)
+		}
+		for k, v := range values {
+			switch strings.ToLower(k) {
+			case "members":
+				sub := &patchOperation{Op: op.Op, Path: "members", Value: v}
+				a, r, err := groupPatchMembers(sub, current)
+				if err != nil {
+					return nil, nil, err
+				}
+				add, remove = append(add, a...), append(remove, r...)
+			case "displayname", "id", "externalid":
+				// Role groups can't be renamed, and IDs are ignored.
+			default:
+				return nil, nil, status.InvalidArgumentErrorf("Unsupported group attribute %q", k)
+			}
+		}
+		return add, remove, nil
+	}
+	if path == "displayname" || path == "externalid" {
+		return nil, nil, nil
+	}
+	if opName == "remove" && strings.HasPrefix(path, "members[") {
+		// e.g. members[value eq "US123"]
+		f, err := parseFilter(strings.TrimSuffix(op.Path[len("members["):], "]"))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, id := range current {
+			if f.matches(attributes{"value": {id}}) {
+				remove = append(remove, id)
+			}
+		}
+		return nil, remove, nil
+	}
+	if path != "members" {
+		return nil, nil, status.InvalidArgumentErrorf("Unsupported group patch path %q", op.Path)
+	}
+	var members []reference
+	if len(op.Value) > 0 {
+		if err := json.Unmarshal(op.Value, &members); err != nil {
+			return nil, nil, status.InvalidArgumentErrorf("Invalid members value: %s", err)
+		}
+	}
+	switch opName {
+	case "add":
+		return memberIDs(members), nil, nil
+	case "remove":
+		if len(members) == 0 {
+			// Removing the members attribute removes all members.
+			return nil, current, nil
+		}
+		return nil, memberIDs(members), nil
+	case "replace":
+		add = memberIDs(members)
+		for _, id := range current {
+			if !contains(add, id) {
+				remove = append(remove, id)
+			}
+		}
+		return add, remove, nil
+	default:
+		return nil, nil, status.InvalidArgumentErrorf("Unsupported patch operation %q", op.Op)
+	}
+}
+
+// updateGroupMembers grants the group's role to the added users, and resets
+// the removed users to the default role if they currently have the group's
+// role.
+func (s *SCIMServer) updateGroupMembers(ctx context.Context, g *tables.Group, rg *roleGroup, add, remove []string) error {
+	users, err := s.getOrgUsers(ctx, g, "")
+	if err != nil {
+		return err
+	}
+	activeUsers := make(map[string]*orgUser, len(users))
+	for _, ou := range users {
+		if ou.active {
+			activeUsers[ou.user.UserID] = ou
+		}
+	}
+	var updates []*grpb.UpdateGroupUsersRequest_Update
+	for _, id := range remove {
+		ou, ok := activeUsers[id]
+		if !ok || roleGroupForRole(ou.role) != rg || contains(add, id) {
+			continue
+		}
+		updates = append(updates, &grpb.UpdateGroupUsersRequest_Update{
+			UserId: &uidpb.UserId{Id: id},
+			Role:   role.ToProto(role.Default),
+		})
+	}
+	for _, id := range add {
+		if _, ok := activeUsers[id]; !ok {
+			return status.InvalidArgumentErrorf("User %q is not an active member of the organization", id)
+		}
+		updates = append(updates, &grpb.UpdateGroupUsersRequest_Update{
+			UserId: &uidpb.UserId{Id: id},
+			Role:   role.ToProto(rg.role),
+		})
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	return s.env.GetUserDB().UpdateGroupUsers(ctx, g.GroupID, updates)
+}
+
+func memberIDs(members []reference) []string {
+	ids := make([]string, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.Value)
+	}
+	return ids
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
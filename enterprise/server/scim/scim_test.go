@@ -0,0 +1,342 @@
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/samlutil"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/claims"
+	"github.com/buildbuddy-io/buildbuddy/server/util/role"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/require"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+	uidpb "github.com/buildbuddy-io/buildbuddy/proto/user_id"
+)
+
+func TestParseFilter(t *testing.T) {
+	attrs := attributes{
+		"username":       {"alice@example.com"},
+		"name.givenname": {"Alice"},
+		"emails.value":   {"alice@example.com", "alice@other.com"},
+		"active":         {"true"},
+	}
+	for _, tc := range []struct {
+		filter string
+		want   bool
+	}{
+		{`userName eq "alice@example.com"`, true},
+		{`USERNAME EQ "ALICE@example.com"`, true},
+		{`userName eq "bob@example.com"`, false},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "alice@example.com"`, true},
+		{`userName ne "bob@example.com"`, true},
+		{`name.givenName sw "al"`, true},
+		{`emails.value ew "other.com"`, true},
+		{`emails.value co "@"`, true},
+		{`title pr`, false},
+		{`userName pr and active eq true`, true},
+		{`active eq false or name.givenName eq "Alice"`, true},
+		{`not (active eq true)`, false},
+		{`(userName eq "x" or userName eq "alice@example.com") and active eq true`, true},
+		{`userName eq "escaped \"quote\""`, false},
+	} {
+		f, err := parseFilter(tc.filter)
+		require.NoError(t, err, tc.filter)
+		require.Equal(t, tc.want, f.matches(attrs), tc.filter)
+	}
+
+	for _, invalid := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName gt "a"`,
+		`userName eq "unterminated`,
+		`(userName eq "a"`,
+		`userName eq "a" extra`,
+		`"userName" eq "a"`,
+		`not userName eq "a"`,
+	} {
+		_, err := parseFilter(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+// claimsAuthenticator mirrors the production authenticator by honoring
+// claims that were attached to the context with claims.AuthContextFromClaims.
+type claimsAuthenticator struct {
+	*testauth.TestAuthenticator
+}
+
+func (a *claimsAuthenticator) AuthenticatedUser(ctx context.Context) (interfaces.UserInfo, error) {
+	if c, err := claims.ClaimsFromContext(ctx); err == nil {
+		return c, nil
+	}
+	return a.TestAuthenticator.AuthenticatedUser(ctx)
+}
+
+type testOrg struct {
+	env     *testenv.TestEnv
+	auth    *testauth.TestAuthenticator
+	server  *SCIMServer
+	adminID string
+	groupID string
+	slug    string
+	apiKey  string
+}
+
+func setupOrg(t *testing.T) *testOrg {
+	env := enterprise_testenv.New(t)
+	auth := enterprise_testauth.Configure(t, env)
+	ctx := context.Background()
+
+	admin := enterprise_testauth.CreateRandomUser(t, env, "org.io")
+	adminCtx, err := auth.WithAuthenticatedUser(ctx, admin.UserID)
+	require.NoError(t, err)
+	u, err := env.GetUserDB().GetUser(adminCtx)
+	require.NoError(t, err)
+	require.Len(t, u.Groups, 1)
+	g := u.Groups[0].Group
+	slug := "scim-test-org"
+	g.URLIdentifier = &slug
+	_, err = env.GetUserDB().InsertOrUpdateGroup(adminCtx, &g)
+	require.NoError(t, err)
+
+	key, err := env.GetAuthDB().CreateAPIKey(adminCtx, g.GroupID, "scim", []akpb.ApiKey_Capability{akpb.ApiKey_ORG_ADMIN_CAPABILITY}, false /*=visibleToDevelopers*/, 0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
+	require.NoError(t, err)
+
+	env.SetAuthenticator(&claimsAuthenticator{auth})
+	return &testOrg{
+		env:     env,
+		auth:    auth,
+		server:  NewSCIMServer(env),
+		adminID: admin.UserID,
+		groupID: g.GroupID,
+		slug:    slug,
+		apiKey:  key.Value,
+	}
+}
+
+// do sends a request to the SCIM server authenticated with the given API
+// key and decodes the JSON response into rsp, if non-nil.
+func (o *testOrg) do(t *testing.T, apiKey, method, path, body string, rsp any) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	ctx := o.env.GetAuthenticator().AuthContextFromAPIKey(req.Context(), apiKey)
+	req = req.WithContext(ctx)
+	rec := httptest.NewRecorder()
+	o.server.ServeHTTP(rec, req)
+	if rsp != nil && rec.Code < 300 {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), rsp), rec.Body.String())
+	}
+	return rec.Code
+}
+
+func (o *testOrg) userRole(t *testing.T, userID string) (role.Role, bool) {
+	rows, err := o.env.GetDBHandle().DB(context.Background()).Raw(
+		`SELECT role FROM "UserGroups" WHERE user_user_id = ? AND group_group_id = ? AND membership_status = 1`,
+		userID, o.groupID,
+	).Rows()
+	require.NoError(t, err)
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, false
+	}
+	var r uint32
+	require.NoError(t, rows.Scan(&r))
+	return role.Role(r), true
+}
+
+func TestRequiresOrgAdminKey(t *testing.T) {
+	o := setupOrg(t)
+	adminCtx, err := o.auth.WithAuthenticatedUser(context.Background(), o.adminID)
+	require.NoError(t, err)
+	key, err := o.env.GetAuthDB().CreateAPIKey(adminCtx, o.groupID, "cas only", []akpb.ApiKey_Capability{akpb.ApiKey_CAS_WRITE_CAPABILITY}, false /*=visibleToDevelopers*/, 0 /*=expiryUsec*/, nil /*=allowedIPRanges*/)
+	require.NoError(t, err)
+
+	code := o.do(t, key.Value, http.MethodGet, "/scim/Users", "", nil)
+	require.Equal(t, http.StatusForbidden, code)
+
+	code = o.do(t, o.apiKey, http.MethodGet, "/scim/Users", "", nil)
+	require.Equal(t, http.StatusOK, code)
+}
+
+func TestOrgAdminKeyIsOnlyAdminWithinSCIM(t *testing.T) {
+	o := setupOrg(t)
+
+	// The org admin capability doesn't grant the admin role outside of SCIM.
+	ctx := o.env.GetAuthenticator().AuthContextFromAPIKey(context.Background(), o.apiKey)
+	err := o.env.GetUserDB().UpdateGroupUsers(ctx, o.groupID, []*grpb.UpdateGroupUsersRequest_Update{{
+		UserId:           &uidpb.UserId{Id: o.adminID},
+		MembershipAction: grpb.UpdateGroupUsersRequest_Update_REMOVE,
+	}})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied; got: %v", err)
+	r, ok := o.userRole(t, o.adminID)
+	require.True(t, ok)
+	require.Equal(t, role.Admin, r)
+
+	// SCIM can only update the profiles of users that it provisioned.
+	code := o.do(t, o.apiKey, http.MethodPatch, "/scim/Users/"+o.adminID, `{
+		"Operations": [{"op": "replace", "path": "name.givenName", "value": "Mallory"}]
+	}`, nil)
+	require.Equal(t, http.StatusForbidden, code)
+	u, err := o.env.GetUserDB().GetUserByID(context.Background(), o.adminID)
+	require.NoError(t, err)
+	require.NotEqual(t, "Mallory", u.FirstName)
+}
+
+func TestUserLifecycle(t *testing.T) {
+	o := setupOrg(t)
+
+	// Provision a new user.
+	created := &userResource{}
+	code := o.do(t, o.apiKey, http.MethodPost, "/scim/Users", `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "bob@org.io",
+		"name": {"givenName": "Bob", "familyName": "Smith"},
+		"emails": [{"value": "bob@org.io", "primary": true}],
+		"active": true
+	}`, created)
+	require.Equal(t, http.StatusCreated, code)
+	require.NotEmpty(t, created.ID)
+	require.Equal(t, "bob@org.io", created.UserName)
+	require.True(t, created.isActive())
+	require.Equal(t, []reference{{Value: "developer", Display: "Developer"}}, created.Groups)
+
+	u, err := o.env.GetUserDB().GetUserByID(context.Background(), created.ID)
+	require.NoError(t, err)
+	require.Equal(t, samlutil.EntityID(o.slug)+"/bob@org.io", u.SubID)
+	r, ok := o.userRole(t, created.ID)
+	require.True(t, ok)
+	require.Equal(t, role.Default, r)
+
+	// Creating the same user again fails.
+	code = o.do(t, o.apiKey, http.MethodPost, "/scim/Users", `{"userName": "bob@org.io"}`, nil)
+	require.Equal(t, http.StatusConflict, code)
+
+	// Look the user up by username, as identity providers do before
+	// provisioning.
+	list := &struct {
+		TotalResults int
+		Resources    []*userResource
+	}{}
+	code = o.do(t, o.apiKey, http.MethodGet, `/scim/Users?filter=userName+eq+%22bob@org.io%22`, "", list)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 1, list.TotalResults)
+	require.Equal(t, created.ID, list.Resources[0].ID)
+
+	// The org admin is listed too, since they're a member of the org.
+	code = o.do(t, o.apiKey, http.MethodGet, "/scim/Users?count=1", "", list)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 2, list.TotalResults)
+	require.Len(t, list.Resources, 1)
+
+	// Update the user's name.
+	patched := &userResource{}
+	code = o.do(t, o.apiKey, http.MethodPatch, "/scim/Users/"+created.ID, `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "Replace", "path": "name.givenName", "value": "Robert"}]
+	}`, patched)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "Robert", patched.Name.GivenName)
+	require.Equal(t, "Smith", patched.Name.FamilyName)
+
+	// The username can't be changed.
+	code = o.do(t, o.apiKey, http.MethodPatch, "/scim/Users/"+created.ID, `{
+		"Operations": [{"op": "replace", "path": "userName", "value": "rob@org.io"}]
+	}`, nil)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// Deactivate the user; this removes them from the org.
+	code = o.do(t, o.apiKey, http.MethodPatch, "/scim/Users/"+created.ID, `{
+		"Operations": [{"op": "replace", "value": {"active": "False"}}]
+	}`, patched)
+	require.Equal(t, http.StatusOK, code)
+	require.False(t, patched.isActive())
+	require.Empty(t, patched.Groups)
+	_, ok = o.userRole(t, created.ID)
+	require.False(t, ok)
+
+	// Deactivated users are still returned.
+	fetched := &userResource{}
+	code = o.do(t, o.apiKey, http.MethodGet, "/scim/Users/"+created.ID, "", fetched)
+	require.Equal(t, http.StatusOK, code)
+	require.False(t, fetched.isActive())
+
+	// Provisioning the user again re-activates them.
+	recreated := &userResource{}
+	code = o.do(t, o.apiKey, http.MethodPost, "/scim/Users", `{"userName": "bob@org.io", "name": {"givenName": "Bobby"}}`, recreated)
+	require.Equal(t, http.StatusCreated, code)
+	require.Equal(t, created.ID, recreated.ID)
+	require.True(t, recreated.isActive())
+	require.Equal(t, "Bobby", recreated.Name.GivenName)
+
+	// Delete the user.
+	code = o.do(t, o.apiKey, http.MethodDelete, "/scim/Users/"+created.ID, "", nil)
+	require.Equal(t, http.StatusNoContent, code)
+	_, ok = o.userRole(t, created.ID)
+	require.False(t, ok)
+
+	code = o.do(t, o.apiKey, http.MethodGet, "/scim/Users/US-does-not-exist", "", nil)
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestRoleGroups(t *testing.T) {
+	o := setupOrg(t)
+
+	bob := &userResource{}
+	code := o.do(t, o.apiKey, http.MethodPost, "/scim/Users", `{"userName": "bob@org.io"}`, bob)
+	require.Equal(t, http.StatusCreated, code)
+
+	groups := &struct {
+		TotalResults int
+		Resources    []*groupResource
+	}{}
+	code = o.do(t, o.apiKey, http.MethodGet, "/scim/Groups", "", groups)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 2, groups.TotalResults)
+	require.Equal(t, "admin", groups.Resources[0].ID)
+	require.Equal(t, []string{o.adminID}, memberIDs(groups.Resources[0].Members))
+	require.Equal(t, []string{bob.ID}, memberIDs(groups.Resources[1].Members))
+
+	// Grant bob the admin role.
+	admins := &groupResource{}
+	code = o.do(t, o.apiKey, http.MethodPatch, "/scim/Groups/admin", `{
+		"Operations": [{"op": "add", "path": "members", "value": [{"value": "`+bob.ID+`"}]}]
+	}`, admins)
+	require.Equal(t, http.StatusOK, code)
+	require.ElementsMatch(t, []string{o.adminID, bob.ID}, memberIDs(admins.Members))
+	r, _ := o.userRole(t, bob.ID)
+	require.Equal(t, role.Admin, r)
+
+	// Removing bob from the admin group resets them to the default role.
+	code = o.do(t, o.apiKey, http.MethodPatch, "/scim/Groups/admin", `{
+		"Operations": [{"op": "remove", "path": "members[value eq \"`+bob.ID+`\"]"}]
+	}`, admins)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{o.adminID}, memberIDs(admins.Members))
+	r, _ = o.userRole(t, bob.ID)
+	require.Equal(t, role.Default, r)
+
+	// Unknown users can't be added to role groups.
+	code = o.do(t, o.apiKey, http.MethodPatch, "/scim/Groups/admin", `{
+		"Operations": [{"op": "add", "path": "members", "value": [{"value": "US-does-not-exist"}]}]
+	}`, nil)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// Role groups can't be created or deleted.
+	code = o.do(t, o.apiKey, http.MethodPost, "/scim/Groups", `{"displayName": "Engineering"}`, nil)
+	require.Equal(t, http.StatusBadRequest, code)
+	code = o.do(t, o.apiKey, http.MethodDelete, "/scim/Groups/admin", "", nil)
+	require.Equal(t, http.StatusBadRequest, code)
+	code = o.do(t, o.apiKey, http.MethodGet, "/scim/Groups/engineering", "", nil)
+	require.Equal(t, http.StatusNotFound, code)
+}
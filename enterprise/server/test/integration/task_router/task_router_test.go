@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/require"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -40,26 +42,26 @@ func TestTaskRouter_RankNodes_Workflows_ReturnsMultipleRunnersThatExecutedWorkfl
 	}
 	instanceName := "test-instance"
 
-	router.MarkComplete(ctx, cmd, instanceName, executorID1)
+	router.MarkComplete(ctx, nil /*=action*/, cmd, instanceName, executorID1)
 
 	nodes := sequentiallyNumberedNodes(100)
 
 	// Task should now be routed to executor 1.
 
-	ranked := router.RankNodes(ctx, cmd, instanceName, nodes)
+	ranked := router.RankNodes(ctx, "" /*=pool*/, nil /*=action*/, cmd, instanceName, nodes)
 
 	require.ElementsMatch(t, nodes, ranked)
 	require.Equal(t, executorID1, ranked[0].GetExecutorID())
 
 	// Mark the same task complete by executor 2 as well.
 
-	router.MarkComplete(ctx, cmd, instanceName, executorID2)
+	router.MarkComplete(ctx, nil /*=action*/, cmd, instanceName, executorID2)
 
 	// Task should now be routed to executor 2 then 1 in order, since executor 2
 	// ran the task more recently, and we memorize several recent executors for
 	// workflow tasks.
 
-	ranked = router.RankNodes(ctx, cmd, instanceName, nodes)
+	ranked = router.RankNodes(ctx, "" /*=pool*/, nil /*=action*/, cmd, instanceName, nodes)
 
 	require.ElementsMatch(t, nodes, ranked)
 	require.Equal(t, executorID2, ranked[0].GetExecutorID())
@@ -81,22 +83,22 @@ func TestTaskRouter_RankNodes_DefaultNodeLimit_ReturnsOnlyLatestNodeMarkedComple
 	}
 	instanceName := "test-instance"
 
-	router.MarkComplete(ctx, cmd, instanceName, executorID1)
+	router.MarkComplete(ctx, nil /*=action*/, cmd, instanceName, executorID1)
 
 	nodes := sequentiallyNumberedNodes(100)
 
 	// Task should now be routed to executor 1.
 
-	ranked := router.RankNodes(ctx, cmd, instanceName, nodes)
+	ranked := router.RankNodes(ctx, "" /*=pool*/, nil /*=action*/, cmd, instanceName, nodes)
 
 	require.ElementsMatch(t, nodes, ranked)
 	require.Equal(t, executorID1, ranked[0].GetExecutorID())
 
 	// Mark the same task complete by executor 2 as well.
 
-	router.MarkComplete(ctx, cmd, instanceName, executorID2)
+	router.MarkComplete(ctx, nil /*=action*/, cmd, instanceName, executorID2)
 
-	ranked = router.RankNodes(ctx, cmd, instanceName, nodes)
+	ranked = router.RankNodes(ctx, "" /*=pool*/, nil /*=action*/, cmd, instanceName, nodes)
 
 	// Task should now be routed to executor 2, but executor 1 should be ranked
 	// randomly, since we only store up to 1 recent executor for non-workflow
@@ -115,7 +117,7 @@ func TestTaskRouter_RankNodes_JustShufflesIfCommandIsNotAvailable(t *testing.T)
 	ctx := withAuthUser(t, context.Background(), env, "US1")
 	instanceName := ""
 
-	ranked := router.RankNodes(ctx, nil /*=cmd*/, instanceName, nodes)
+	ranked := router.RankNodes(ctx, "" /*=pool*/, nil /*=action*/, nil /*=cmd*/, instanceName, nodes)
 
 	requireReordered(t, nodes, ranked)
 }
@@ -127,7 +129,7 @@ func TestTaskRouter_MarkComplete_DoesNotAffectNonRecyclableTasks(t *testing.T) {
 	cmd := &repb.Command{}
 	instanceName := "test-instance"
 
-	router.MarkComplete(ctx, cmd, instanceName, executorID1)
+	router.MarkComplete(ctx, nil /*=action*/, cmd, instanceName, executorID1)
 
 	requireNotAlwaysRanked(0, executorID1, t, router, ctx, cmd, instanceName)
 }
@@ -145,7 +147,7 @@ func TestTaskRouter_MarkComplete_DoesNotAffectOtherGroups(t *testing.T) {
 	}
 	instanceName := "test-instance"
 
-	router.MarkComplete(ctx1, cmd, instanceName, executorID1)
+	router.MarkComplete(ctx1, nil /*=action*/, cmd, instanceName, executorID1)
 
 	ctx2 := withAuthUser(t, context.Background(), env, "US2")
 
@@ -165,20 +167,151 @@ func TestTaskRouter_MarkComplete_DoesNotAffectOtherRemoteInstances(t *testing.T)
 	}
 	instanceName1 := "test-instance"
 
-	router.MarkComplete(ctx, cmd, instanceName1, executorID1)
+	router.MarkComplete(ctx, nil /*=action*/, cmd, instanceName1, executorID1)
 
 	instanceName2 := "another-test-instance"
 
 	requireNotAlwaysRanked(0, executorID1, t, router, ctx, cmd, instanceName2)
 }
 
+func TestTaskRouter_InputAffinity_PrefersNodesThatExecutedOverlappingActions(t *testing.T) {
+	flags.Set(t, "remote_execution.task_router.default_strategies", []string{"input_affinity"})
+	env := newTestEnv(t)
+	router := newTaskRouter(t, env)
+	ctx := withAuthUser(t, context.Background(), env, "US1")
+	instanceName := "test-instance"
+	cmd := &repb.Command{OutputPaths: []string{"bazel-out/k8-fastbuild/bin/foo.o"}}
+	action := &repb.Action{InputRootDigest: &repb.Digest{Hash: strings.Repeat("a", 64), SizeBytes: 1000}}
+
+	router.MarkComplete(ctx, action, cmd, instanceName, executorID1)
+
+	nodes := sequentiallyNumberedNodes(100)
+
+	// An action with the same inputs should be routed to executor 1.
+
+	ranked := router.RankNodes(ctx, "" /*=pool*/, action, cmd, instanceName, nodes)
+
+	require.ElementsMatch(t, nodes, ranked)
+	require.Equal(t, executorID1, ranked[0].GetExecutorID())
+
+	// Another version of the same action (with different inputs but the same
+	// output) should be routed to executor 1 as well.
+
+	otherAction := &repb.Action{InputRootDigest: &repb.Digest{Hash: strings.Repeat("b", 64), SizeBytes: 1000}}
+	ranked = router.RankNodes(ctx, "" /*=pool*/, otherAction, cmd, instanceName, nodes)
+
+	require.ElementsMatch(t, nodes, ranked)
+	require.Equal(t, executorID1, ranked[0].GetExecutorID())
+
+	// Once executor 2 runs the other version, identical inputs should take
+	// precedence over identical outputs.
+
+	router.MarkComplete(ctx, otherAction, cmd, instanceName, executorID2)
+
+	ranked = router.RankNodes(ctx, "" /*=pool*/, action, cmd, instanceName, nodes)
+
+	require.Equal(t, executorID1, ranked[0].GetExecutorID())
+
+	ranked = router.RankNodes(ctx, "" /*=pool*/, otherAction, cmd, instanceName, nodes)
+
+	require.Equal(t, executorID2, ranked[0].GetExecutorID())
+
+	// Unrelated actions should not be affected.
+
+	unrelatedAction := &repb.Action{InputRootDigest: &repb.Digest{Hash: strings.Repeat("c", 64), SizeBytes: 1000}}
+	unrelatedCmd := &repb.Command{OutputPaths: []string{"bazel-out/k8-fastbuild/bin/bar.o"}}
+	ranked = router.RankNodes(ctx, "" /*=pool*/, unrelatedAction, unrelatedCmd, instanceName, nodes)
+
+	requireReordered(t, nodes, ranked)
+}
+
+func TestTaskRouter_LeastLoaded_PrefersNodesWithShorterQueues(t *testing.T) {
+	flags.Set(t, "remote_execution.task_router.default_strategies", []string{"least_loaded"})
+	env := newTestEnv(t)
+	router := newTaskRouter(t, env)
+	ctx := withAuthUser(t, context.Background(), env, "US1")
+	nodes := []interfaces.ExecutionNode{
+		&testNode{id: 1, queueLength: 5},
+		&testNode{id: 2, queueLength: 0},
+		&testNode{id: 3, queueLength: 12},
+		&testNode{id: 4, queueLength: 1},
+	}
+
+	ranked := router.RankNodes(ctx, "" /*=pool*/, &repb.Action{}, &repb.Command{}, "" /*=instanceName*/, nodes)
+
+	require.Equal(t, []interfaces.ExecutionNode{nodes[1], nodes[3], nodes[0], nodes[2]}, ranked)
+}
+
+func TestTaskRouter_StrategiesAreChainedInOrderOfPrecedence(t *testing.T) {
+	flags.Set(t, "remote_execution.task_router.default_strategies", []string{"runner_recycling", "least_loaded"})
+	env := newTestEnv(t)
+	router := newTaskRouter(t, env)
+	ctx := withAuthUser(t, context.Background(), env, "US1")
+	cmd := &repb.Command{
+		Platform: &repb.Platform{
+			Properties: []*repb.Platform_Property{
+				{Name: "recycle-runner", Value: "true"},
+			},
+		},
+	}
+	nodes := []interfaces.ExecutionNode{
+		&testNode{id: 1, queueLength: 5},
+		&testNode{id: 2, queueLength: 0},
+		&testNode{id: 3, queueLength: 12},
+	}
+
+	router.MarkComplete(ctx, nil /*=action*/, cmd, "" /*=instanceName*/, "3")
+
+	// The node with a warm runner should be ranked first, followed by the
+	// remaining nodes ordered by load.
+
+	ranked := router.RankNodes(ctx, "" /*=pool*/, nil /*=action*/, cmd, "" /*=instanceName*/, nodes)
+
+	require.Equal(t, []interfaces.ExecutionNode{nodes[2], nodes[1], nodes[0]}, ranked)
+}
+
+func TestTaskRouter_PoolStrategies_OverrideDefaultStrategies(t *testing.T) {
+	flags.Set(t, "remote_execution.task_router.default_strategies", []string{"runner_recycling"})
+	flags.Set(t, "remote_execution.task_router.pool_strategies", []task_router.PoolStrategies{
+		{Pool: "least-loaded-pool", Strategies: []string{"least_loaded"}},
+	})
+	env := newTestEnv(t)
+	router := newTaskRouter(t, env)
+	ctx := withAuthUser(t, context.Background(), env, "US1")
+	nodes := sequentiallyNumberedNodes(100)
+	for i, n := range nodes {
+		n.(*testNode).queueLength = int64(len(nodes) - i)
+	}
+
+	ranked := router.RankNodes(ctx, "least-loaded-pool", &repb.Action{}, &repb.Command{}, "" /*=instanceName*/, nodes)
+
+	require.Equal(t, "99", ranked[0].GetExecutorID())
+	require.Equal(t, "0", ranked[len(ranked)-1].GetExecutorID())
+
+	// Other pools should use the default strategies, which don't look at the
+	// queue length.
+
+	ranked = router.RankNodes(ctx, "other-pool", &repb.Action{}, &repb.Command{}, "" /*=instanceName*/, nodes)
+
+	requireReordered(t, nodes, ranked)
+}
+
+func TestTaskRouter_New_RejectsUnknownStrategies(t *testing.T) {
+	flags.Set(t, "remote_execution.task_router.default_strategies", []string{"fastest_executor"})
+	env := newTestEnv(t)
+
+	_, err := task_router.New(env)
+
+	require.Error(t, err)
+}
+
 // requireNotAlwaysRanked requires that the task router does not
 // deterministically assign the given rank to the given executor ID.
 func requireNotAlwaysRanked(rank int, executorID string, t *testing.T, router interfaces.TaskRouter, ctx context.Context, cmd *repb.Command, instanceName string) {
 	nodes := sequentiallyNumberedNodes(100)
 	nTrials := 10
 	for i := 0; i < nTrials; i++ {
-		ranked := router.RankNodes(ctx, cmd, instanceName, nodes)
+		ranked := router.RankNodes(ctx, "" /*=pool*/, nil /*=action*/, cmd, instanceName, nodes)
 
 		require.Equal(t, len(nodes), len(ranked))
 		if ranked[rank].GetExecutorID() != executorID {
@@ -233,11 +366,15 @@ func withAuthUser(t *testing.T, ctx context.Context, env environment.Env, userID
 func sequentiallyNumberedNodes(n int) []interfaces.ExecutionNode {
 	nodes := make([]interfaces.ExecutionNode, 0, n)
 	for i := 0; i < n; i++ {
-		nodes = append(nodes, &testNode{i})
+		nodes = append(nodes, &testNode{id: i})
 	}
 	return nodes
 }
 
-type testNode struct{ id int }
+type testNode struct {
+	id          int
+	queueLength int64
+}
 
 func (n *testNode) GetExecutorID() string { return fmt.Sprintf("%d", n.id) }
+func (n *testNode) GetQueueLength() int64 { return n.queueLength }
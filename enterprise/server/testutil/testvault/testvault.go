@@ -0,0 +1,112 @@
+package testvault
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testport"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	containerNamePrefix = "buildbuddy-test-vault-"
+
+	// RootToken is the root token of the dev server.
+	RootToken = "root"
+
+	// TransitMountPath is the path at which the Transit secrets engine is
+	// mounted.
+	TransitMountPath = "transit"
+
+	startupTimeout = 30 * time.Second
+)
+
+// Start starts a test-scoped Vault dev server with the Transit secrets engine
+// enabled, and returns its address.
+//
+// Currently requires Docker to be available in the test execution environment.
+func Start(t testing.TB) string {
+	port := testport.FindFree(t)
+	containerName := fmt.Sprintf("%s%d", containerNamePrefix, port)
+
+	log.Debug("Starting Vault dev server...")
+
+	cmd := exec.Command(
+		"docker", "run", "--rm", "--detach",
+		"--cap-add=IPC_LOCK",
+		"--env", "VAULT_DEV_ROOT_TOKEN_ID="+RootToken,
+		"--publish", fmt.Sprintf("%d:8200", port),
+		"--name", containerName,
+		"hashicorp/vault:1.15",
+	)
+	cmd.Stderr = &logWriter{"docker run vault"}
+	err := cmd.Run()
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		cmd := exec.Command("docker", "kill", containerName)
+		cmd.Stderr = &logWriter{"docker kill " + containerName}
+		err := cmd.Run()
+		require.NoError(t, err)
+	})
+
+	address := fmt.Sprintf("http://127.0.0.1:%d", port)
+	deadline := time.Now().Add(startupTimeout)
+	for {
+		rsp, err := http.Get(address + "/v1/sys/health")
+		if err == nil {
+			rsp.Body.Close()
+			if rsp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			require.FailNow(t, "timed out waiting for Vault to start", "last error: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	post(t, address, "sys/mounts/"+TransitMountPath, `{"type": "transit"}`)
+	return address
+}
+
+// CreateKey creates a new AES-256-GCM Transit key with the given name.
+func CreateKey(t testing.TB, address, name string) {
+	post(t, address, TransitMountPath+"/keys/"+name, `{"type": "aes256-gcm96"}`)
+}
+
+// RotateKey creates a new version of the given Transit key.
+func RotateKey(t testing.TB, address, name string) {
+	post(t, address, TransitMountPath+"/keys/"+name+"/rotate", `{}`)
+}
+
+func post(t testing.TB, address, path, body string) {
+	req, err := http.NewRequest(http.MethodPost, address+"/v1/"+path, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	req.Header.Set("X-Vault-Token", RootToken)
+	rsp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+	require.Less(t, rsp.StatusCode, 300, "POST %s failed with HTTP %d", path, rsp.StatusCode)
+}
+
+type logWriter struct {
+	tag string
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	lines := strings.Split(string(b), "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		log.Infof("[%s] %s", w.tag, line)
+	}
+	return len(b), nil
+}
@@ -528,6 +528,9 @@ func countsToMap(tu *tables.UsageCounts) (map[string]int64, error) {
 	if tu.CPUNanos > 0 {
 		counts["cpu_nanos"] = tu.CPUNanos
 	}
+	if tu.CASStoredSizeBytes > 0 {
+		counts["cas_stored_size_bytes"] = tu.CASStoredSizeBytes
+	}
 	return counts, nil
 }
 
@@ -552,5 +555,6 @@ func stringMapToCounts(h map[string]string) (*tables.UsageCounts, error) {
 		TotalUploadSizeBytes:       hInt64["total_upload_size_bytes"],
 		TotalCachedActionExecUsec:  hInt64["total_cached_action_exec_usec"],
 		CPUNanos:                   hInt64["cpu_nanos"],
+		CASStoredSizeBytes:         hInt64["cas_stored_size_bytes"],
 	}, nil
 }
@@ -0,0 +1,224 @@
+package usage_service
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/webhookutil"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flagutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/go-redis/redis/v8"
+
+	usage_config "github.com/buildbuddy-io/buildbuddy/enterprise/server/usage/config"
+)
+
+var (
+	monthlyReportFormat = flag.String("app.usage_report.format", "csv", "The format of the monthly usage reports: csv or json.")
+	monthlyReportDelay  = flag.Duration("app.usage_report.delay", 6*time.Hour, "How long to wait after the end of each month (in UTC) before pushing its usage report, so that all of the month's usage has been written to the DB.")
+
+	monthlyReportBlobstoreEnabled    = flag.Bool("app.usage_report.blobstore.enabled", false, "If set, a usage report covering all groups is written to the configured blobstore after the end of each month.")
+	monthlyReportBlobstorePathPrefix = flag.String("app.usage_report.blobstore.path_prefix", "usage_reports", "The path prefix of the monthly usage reports in the blobstore. Reports are named <prefix>/YYYY-MM.<format>.")
+
+	monthlyReportWebhookURL        = flag.String("app.usage_report.webhook.url", "", "If set, a usage report covering all groups is POSTed to this HTTPS URL after the end of each month.")
+	monthlyReportWebhookHMACSecret = flagutil.New("app.usage_report.webhook.hmac_secret", "", webhookutil.SecretFlagHelp, flagutil.SecretTag)
+)
+
+const (
+	// How often to check whether the report for the last month needs to be
+	// pushed.
+	monthlyReportCheckInterval = 10 * time.Minute
+
+	// How long an app holds the claim on a report while pushing it. If the
+	// app goes away before the push completes, another app retries the push
+	// once the claim expires.
+	monthlyReportClaimTTL = 1 * time.Hour
+
+	// How long to remember that the report for a month was pushed.
+	monthlyReportDoneTTL = 90 * 24 * time.Hour
+
+	monthlyReportRedisKeyPrefix = "usageReport/"
+
+	monthlyReportWebhookTimeout = 5 * time.Minute
+	// Identifies the month that a webhook request reports on, in "YYYY-MM"
+	// format.
+	webhookPeriodHeader = "X-BuildBuddy-Usage-Period"
+)
+
+// monthlyReporter pushes a usage report covering all groups to the configured
+// destinations after the end of each month. Apps coordinate through Redis so
+// that each report is normally pushed once, but a report may be pushed again
+// if a push fails partway through.
+type monthlyReporter struct {
+	env   environment.Env
+	rdb   redis.UniversalClient
+	clock timeutil.Clock
+
+	format string
+	delay  time.Duration
+
+	// The blobstore that reports are written to, or nil if reports aren't
+	// written to the blobstore.
+	bs         interfaces.Blobstore
+	pathPrefix string
+
+	webhookURL    string
+	webhookSecret string
+	client        *http.Client
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// RegisterMonthlyReports starts pushing monthly usage reports if a destination
+// is configured. It must be called after the default Redis client is
+// registered.
+func RegisterMonthlyReports(env environment.Env) error {
+	if !*monthlyReportBlobstoreEnabled && *monthlyReportWebhookURL == "" {
+		return nil
+	}
+	if !usage_config.UsageTrackingEnabled() {
+		return status.FailedPreconditionError("Monthly usage reports require usage tracking to be enabled.")
+	}
+	if *monthlyReportWebhookURL != "" {
+		if err := webhookutil.ValidateURL(*monthlyReportWebhookURL); err != nil {
+			return status.WrapError(err, "invalid app.usage_report.webhook.url")
+		}
+	}
+	r, err := newMonthlyReporter(env, timeutil.NewClock())
+	if err != nil {
+		return err
+	}
+	r.start()
+	env.GetHealthChecker().RegisterShutdownFunction(r.stop)
+	return nil
+}
+
+func newMonthlyReporter(env environment.Env, clock timeutil.Clock) (*monthlyReporter, error) {
+	if env.GetDefaultRedisClient() == nil {
+		return nil, status.FailedPreconditionError("Monthly usage reports require Redis to be configured.")
+	}
+	if *monthlyReportFormat != reportFormatCSV && *monthlyReportFormat != reportFormatJSON {
+		return nil, status.InvalidArgumentErrorf("Invalid app.usage_report.format %q: expected %q or %q", *monthlyReportFormat, reportFormatCSV, reportFormatJSON)
+	}
+	r := &monthlyReporter{
+		env:           env,
+		rdb:           env.GetDefaultRedisClient(),
+		clock:         clock,
+		format:        *monthlyReportFormat,
+		delay:         *monthlyReportDelay,
+		pathPrefix:    *monthlyReportBlobstorePathPrefix,
+		webhookURL:    *monthlyReportWebhookURL,
+		webhookSecret: *monthlyReportWebhookHMACSecret,
+		client:        &http.Client{Timeout: monthlyReportWebhookTimeout},
+		quit:          make(chan struct{}),
+	}
+	if *monthlyReportBlobstoreEnabled {
+		if env.GetBlobstore() == nil {
+			return nil, status.FailedPreconditionError("Writing monthly usage reports to the blobstore requires a blobstore to be configured.")
+		}
+		r.bs = env.GetBlobstore()
+	}
+	return r, nil
+}
+
+func (r *monthlyReporter) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			if err := r.pushLastMonth(ctx); err != nil {
+				log.Warningf("Failed to push monthly usage report: %s", err)
+			}
+			select {
+			case <-time.After(monthlyReportCheckInterval):
+			case <-r.quit:
+				return
+			}
+		}
+	}()
+	go func() {
+		// Abandon any push that is in progress when shutting down, so that
+		// another app can retry it.
+		<-r.quit
+		cancel()
+	}()
+}
+
+func (r *monthlyReporter) stop(ctx context.Context) error {
+	close(r.quit)
+	r.wg.Wait()
+	return nil
+}
+
+// lastMonth returns the start of the most recent month whose report is due.
+func (r *monthlyReporter) lastMonth() time.Time {
+	now := r.clock.Now().UTC()
+	return addCalendarMonths(startOfMonth(now.Add(-r.delay)), -1)
+}
+
+// pushLastMonth pushes the report for the most recent month whose report is
+// due, unless it was already pushed by this or another app.
+func (r *monthlyReporter) pushLastMonth(ctx context.Context) error {
+	month := r.lastMonth()
+	key := monthlyReportRedisKeyPrefix + month.Format("2006-01")
+	claimed, err := r.rdb.SetNX(ctx, key, "pending", monthlyReportClaimTTL).Result()
+	if err != nil {
+		return status.UnavailableErrorf("claim usage report: %s", err)
+	}
+	if !claimed {
+		return nil
+	}
+	if err := r.push(ctx, month); err != nil {
+		// Release the claim so that the push is retried.
+		if err := r.rdb.Del(context.Background(), key).Err(); err != nil {
+			log.Warningf("Failed to release claim on usage report %q: %s", key, err)
+		}
+		return err
+	}
+	return r.rdb.Set(ctx, key, "done", monthlyReportDoneTTL).Err()
+}
+
+// push generates the report for the month starting at the given time and
+// pushes it to all of the configured destinations.
+func (r *monthlyReporter) push(ctx context.Context, month time.Time) error {
+	rows, err := scanReportRows(ctx, r.env.GetDBHandle(), "" /*=groupID*/, month, addCalendarMonths(month, 1))
+	if err != nil {
+		return status.WrapError(err, "query usage")
+	}
+	var buf bytes.Buffer
+	if err := writeReport(&buf, r.format, rows); err != nil {
+		return err
+	}
+	period := month.Format("2006-01")
+	if r.bs != nil {
+		// The blob name only depends on the month, so a report that is pushed
+		// again overwrites the previous one.
+		blobName := path.Join(r.pathPrefix, period+"."+r.format)
+		if _, err := r.bs.WriteBlob(ctx, blobName, buf.Bytes()); err != nil {
+			return status.UnavailableErrorf("write usage report to blobstore: %s", err)
+		}
+	}
+	if r.webhookURL != "" {
+		if err := r.postWebhook(ctx, period, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	log.Infof("Pushed usage report for %s (%d rows)", period, len(rows))
+	return nil
+}
+
+func (r *monthlyReporter) postWebhook(ctx context.Context, period string, body []byte) error {
+	header := http.Header{}
+	header.Set(webhookPeriodHeader, period)
+	return webhookutil.PostWithHeader(ctx, r.client, r.webhookURL, r.webhookSecret, reportContentType(r.format), body, header)
+}
@@ -0,0 +1,311 @@
+package usage_service
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/role_filter"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	usagepb "github.com/buildbuddy-io/buildbuddy/proto/usage"
+)
+
+const (
+	// The max number of days that a single usage report can cover.
+	maxReportDays = 366
+
+	reportDateLayout = "2006-01-02"
+
+	// The path of the HTTP endpoint that serves usage reports, for scripts
+	// that authenticate with an API key.
+	reportHTTPPath = "/api/v1/usage/report"
+
+	reportFormatCSV  = "csv"
+	reportFormatJSON = "json"
+)
+
+func (s *usageService) GetUsageReport(ctx context.Context, req *usagepb.GetUsageReportRequest) (*usagepb.GetUsageReportResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := perms.AuthorizeGroupAccess(ctx, s.env, groupID); err != nil {
+		return nil, err
+	}
+	start, end, err := parseReportDates(req.GetStartDate(), req.GetEndDate(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	// Don't return usage from before we began collecting it.
+	start = maxTime(start, s.start.Truncate(24*time.Hour))
+	rows, err := scanReportRows(ctx, s.env.GetDBHandle(), groupID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &usagepb.GetUsageReportResponse{Rows: rows}, nil
+}
+
+// parseReportDates returns the start (inclusive) and end (exclusive) of a
+// report covering the given range of UTC days.
+func parseReportDates(startDate, endDate string, now time.Time) (time.Time, time.Time, error) {
+	now = now.UTC()
+	start := startOfMonth(now)
+	if startDate != "" {
+		t, err := time.Parse(reportDateLayout, startDate)
+		if err != nil {
+			return time.Time{}, time.Time{}, status.InvalidArgumentErrorf("invalid start date %q: expected YYYY-MM-DD", startDate)
+		}
+		start = t
+	}
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if endDate != "" {
+		t, err := time.Parse(reportDateLayout, endDate)
+		if err != nil {
+			return time.Time{}, time.Time{}, status.InvalidArgumentErrorf("invalid end date %q: expected YYYY-MM-DD", endDate)
+		}
+		end = t
+	}
+	end = end.AddDate(0, 0, 1)
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, status.InvalidArgumentError("the start date must not be after the end date")
+	}
+	if start.AddDate(0, 0, maxReportDays).Before(end) {
+		return time.Time{}, time.Time{}, status.InvalidArgumentErrorf("usage reports can cover at most %d days", maxReportDays)
+	}
+	return start, end, nil
+}
+
+// scanReportRows returns the usage for each day, group, and set of usage
+// labels in the given period. If groupID is empty, the usage of all groups is
+// returned.
+func scanReportRows(ctx context.Context, dbh interfaces.DBHandle, groupID string, start, end time.Time) ([]*usagepb.UsageReportRow, error) {
+	q := `
+		SELECT ` + dbh.DateFromUsecTimestamp("period_start_usec", 0) + ` AS date,
+		group_id,
+		origin,
+		client,
+		SUM(invocations) AS invocations,
+		SUM(action_cache_hits) AS action_cache_hits,
+		SUM(cas_cache_hits) AS cas_cache_hits,
+		SUM(total_download_size_bytes) AS total_download_size_bytes,
+		SUM(total_upload_size_bytes) AS total_upload_size_bytes,
+		SUM(linux_execution_duration_usec) AS linux_execution_duration_usec,
+		SUM(mac_execution_duration_usec) AS mac_execution_duration_usec,
+		SUM(total_cached_action_exec_usec) AS total_cached_action_exec_usec,
+		SUM(cpu_nanos) AS cpu_nanos
+		FROM "Usages"
+		WHERE period_start_usec >= ? AND period_start_usec < ?
+	`
+	args := []any{start.UnixMicro(), end.UnixMicro()}
+	if groupID != "" {
+		q += ` AND group_id = ?`
+		args = append(args, groupID)
+	}
+	q += `
+		GROUP BY date, group_id, origin, client
+		ORDER BY date, group_id, origin, client ASC
+	`
+	rows, err := dbh.DB(ctx).Raw(q, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reportRows := []*usagepb.UsageReportRow{}
+	for rows.Next() {
+		row := &usagepb.UsageReportRow{}
+		if err := dbh.DB(ctx).ScanRows(rows, row); err != nil {
+			return nil, err
+		}
+		// Some drivers return dates as timestamps; keep only the date part.
+		if len(row.Date) > len(reportDateLayout) {
+			row.Date = row.Date[:len(reportDateLayout)]
+		}
+		reportRows = append(reportRows, row)
+	}
+	return reportRows, nil
+}
+
+// reportFields returns the fields of a report row, which are the columns of
+// the report, in order.
+func reportFields() protoreflect.FieldDescriptors {
+	return (&usagepb.UsageReportRow{}).ProtoReflect().Descriptor().Fields()
+}
+
+// writeReport writes the rows in the given format, which is either "csv" or
+// "json".
+func writeReport(w io.Writer, format string, rows []*usagepb.UsageReportRow) error {
+	switch format {
+	case reportFormatCSV:
+		return writeReportCSV(w, rows)
+	case reportFormatJSON:
+		return writeReportJSON(w, rows)
+	default:
+		return status.InvalidArgumentErrorf("unsupported report format %q: expected %q or %q", format, reportFormatCSV, reportFormatJSON)
+	}
+}
+
+// writeReportCSV writes the rows as CSV, with a header row containing the
+// field names.
+func writeReportCSV(w io.Writer, rows []*usagepb.UsageReportRow) error {
+	fields := reportFields()
+	cw := csv.NewWriter(w)
+	record := make([]string, fields.Len())
+	for i := 0; i < fields.Len(); i++ {
+		record[i] = string(fields.Get(i).Name())
+	}
+	if err := cw.Write(record); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		m := row.ProtoReflect()
+		for i := 0; i < fields.Len(); i++ {
+			f := fields.Get(i)
+			if f.Kind() == protoreflect.StringKind {
+				record[i] = m.Get(f).String()
+			} else {
+				record[i] = strconv.FormatInt(m.Get(f).Int(), 10)
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeReportJSON writes the rows as a JSON array of objects, with the fields
+// in the same order as the CSV columns. Unlike protojson, counts are written
+// as numbers rather than strings, so that they can be summed directly by tools
+// like jq.
+func writeReportJSON(w io.Writer, rows []*usagepb.UsageReportRow) error {
+	fields := reportFields()
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for r, row := range rows {
+		if r > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('{')
+		m := row.ProtoReflect()
+		for i := 0; i < fields.Len(); i++ {
+			f := fields.Get(i)
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := json.Marshal(string(f.Name()))
+			if err != nil {
+				return err
+			}
+			var value []byte
+			if f.Kind() == protoreflect.StringKind {
+				value, err = json.Marshal(m.Get(f).String())
+			} else {
+				value, err = json.Marshal(m.Get(f).Int())
+			}
+			if err != nil {
+				return err
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(value)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteString("]\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func reportContentType(format string) string {
+	if format == reportFormatJSON {
+		return "application/json"
+	}
+	return "text/csv"
+}
+
+// serveReport serves the usage report of the authenticated group. The report
+// covers the days between the "start" and "end" query parameters
+// (YYYY-MM-DD, inclusive), in the format given by the "format" query
+// parameter ("csv" or "json", defaulting to "csv").
+func (s *usageService) serveReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.authorizeReport(ctx); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	groupID, err := perms.AuthenticatedGroupID(ctx, s.env)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = reportFormatCSV
+	}
+	if format != reportFormatCSV && format != reportFormatJSON {
+		writeHTTPError(w, status.InvalidArgumentErrorf("unsupported report format %q: expected %q or %q", format, reportFormatCSV, reportFormatJSON))
+		return
+	}
+	rsp, err := s.GetUsageReport(ctx, &usagepb.GetUsageReportRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		StartDate:      q.Get("start"),
+		EndDate:        q.Get("end"),
+	})
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeReport(&buf, format, rsp.GetRows()); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", reportContentType(format))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Warningf("Failed to write usage report: %s", err)
+	}
+}
+
+// authorizeReport checks that the authenticated user can download usage
+// reports. Reports are only available to org admins, as in the UI, and to API
+// keys with the org admin capability. API keys are never granted the admin
+// role, so they're checked by capability instead.
+func (s *usageService) authorizeReport(ctx context.Context) error {
+	u, err := perms.AuthenticatedUser(ctx, s.env)
+	if err != nil {
+		return err
+	}
+	if u.HasCapability(akpb.ApiKey_ORG_ADMIN_CAPABILITY) {
+		return nil
+	}
+	return role_filter.AuthorizeRPC(ctx, s.env, "GetUsageReport")
+}
+
+func writeHTTPError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case status.IsInvalidArgumentError(err):
+		code = http.StatusBadRequest
+	case status.IsUnauthenticatedError(err):
+		code = http.StatusUnauthorized
+	case status.IsPermissionDeniedError(err):
+		code = http.StatusForbidden
+	}
+	http.Error(w, status.Message(err), code)
+}
@@ -0,0 +1,308 @@
+package usage_service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/webhookutil"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testclock"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/role"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	usagepb "github.com/buildbuddy-io/buildbuddy/proto/usage"
+)
+
+func TestParseReportDates(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name          string
+		startDate     string
+		endDate       string
+		expectedStart time.Time
+		expectedEnd   time.Time
+		expectedErr   bool
+	}{
+		{
+			name:          "defaults to the current month",
+			expectedStart: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			expectedEnd:   time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:          "end date is inclusive",
+			startDate:     "2024-01-01",
+			endDate:       "2024-01-31",
+			expectedStart: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			expectedEnd:   time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:          "single day",
+			startDate:     "2024-02-29",
+			endDate:       "2024-02-29",
+			expectedStart: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+			expectedEnd:   time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:        "invalid start date",
+			startDate:   "2024-1-1",
+			expectedErr: true,
+		},
+		{
+			name:        "start after end",
+			startDate:   "2024-02-02",
+			endDate:     "2024-02-01",
+			expectedErr: true,
+		},
+		{
+			name:        "too many days",
+			startDate:   "2022-01-01",
+			endDate:     "2023-12-31",
+			expectedErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			start, end, err := parseReportDates(tc.startDate, tc.endDate, now)
+			if tc.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedStart, start)
+			require.Equal(t, tc.expectedEnd, end)
+		})
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	rows := []*usagepb.UsageReportRow{
+		{Date: "2024-01-01", GroupId: "GR1", Origin: "internal", Client: "bazel", Invocations: 2, CasCacheHits: 10, CpuNanos: 5},
+		{Date: "2024-01-02", GroupId: "GR1", Client: "executor", LinuxExecutionDurationUsec: 1000},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, writeReport(&buf, "csv", rows))
+	expectedCSV := "date,group_id,origin,client,invocations,action_cache_hits,cas_cache_hits,total_download_size_bytes,total_upload_size_bytes,linux_execution_duration_usec,mac_execution_duration_usec,total_cached_action_exec_usec,cpu_nanos\n" +
+		"2024-01-01,GR1,internal,bazel,2,0,10,0,0,0,0,0,5\n" +
+		"2024-01-02,GR1,,executor,0,0,0,0,0,1000,0,0,0\n"
+	require.Equal(t, expectedCSV, buf.String())
+
+	buf.Reset()
+	require.NoError(t, writeReport(&buf, "json", rows))
+	got := []map[string]any{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	require.Len(t, got, 2)
+	assert.Equal(t, "GR1", got[0]["group_id"])
+	assert.Equal(t, float64(10), got[0]["cas_cache_hits"])
+	assert.Equal(t, float64(1000), got[1]["linux_execution_duration_usec"])
+	assert.Equal(t, "", got[1]["origin"])
+
+	require.Error(t, writeReport(&buf, "xml", rows))
+}
+
+func setupEnv(t *testing.T) *testenv.TestEnv {
+	te := testenv.GetTestEnv(t)
+	redisTarget := testredis.Start(t).Target
+	te.SetDefaultRedisClient(redis.NewClient(redisutil.TargetToOptions(redisTarget)))
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers(
+		"US1", "GR1",
+		"US2", "GR2",
+	)))
+	flags.Set(t, "app.usage_tracking_enabled", true)
+
+	ctx := context.Background()
+	for _, u := range []*tables.Usage{
+		{
+			GroupID:         "GR1",
+			PeriodStartUsec: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMicro(),
+			UsageCounts:     tables.UsageCounts{Invocations: 1, CASCacheHits: 10},
+			UsageLabels:     tables.UsageLabels{Client: "bazel"},
+		},
+		{
+			GroupID:         "GR1",
+			PeriodStartUsec: time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC).UnixMicro(),
+			Region:          "us-east1",
+			UsageCounts:     tables.UsageCounts{Invocations: 2, CASCacheHits: 5},
+			UsageLabels:     tables.UsageLabels{Client: "bazel"},
+		},
+		{
+			GroupID:         "GR1",
+			PeriodStartUsec: time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC).UnixMicro(),
+			UsageCounts:     tables.UsageCounts{LinuxExecutionDurationUsec: 1000},
+			UsageLabels:     tables.UsageLabels{Client: "executor", Origin: "internal"},
+		},
+		{
+			GroupID:         "GR2",
+			PeriodStartUsec: time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC).UnixMicro(),
+			UsageCounts:     tables.UsageCounts{Invocations: 3},
+			UsageLabels:     tables.UsageLabels{Client: "bazel"},
+		},
+		{
+			GroupID:         "GR1",
+			PeriodStartUsec: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC).UnixMicro(),
+			UsageCounts:     tables.UsageCounts{Invocations: 100},
+			UsageLabels:     tables.UsageLabels{Client: "bazel"},
+		},
+	} {
+		require.NoError(t, te.GetDBHandle().DB(ctx).Create(u).Error)
+	}
+	return te
+}
+
+func TestGetUsageReport(t *testing.T) {
+	te := setupEnv(t)
+	ctx := te.GetAuthenticator().(*testauth.TestAuthenticator).AuthContextFromAPIKey(context.Background(), "US1")
+	s := New(te)
+
+	rsp, err := s.GetUsageReport(ctx, &usagepb.GetUsageReportRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR1"},
+		StartDate:      "2024-01-01",
+		EndDate:        "2024-01-31",
+	})
+	require.NoError(t, err)
+	expected := []*usagepb.UsageReportRow{
+		{Date: "2024-01-01", GroupId: "GR1", Client: "bazel", Invocations: 3, CasCacheHits: 15},
+		{Date: "2024-01-01", GroupId: "GR1", Origin: "internal", Client: "executor", LinuxExecutionDurationUsec: 1000},
+	}
+	require.Len(t, rsp.GetRows(), len(expected))
+	for i := range expected {
+		assert.Equal(t, expected[i].String(), rsp.GetRows()[i].String())
+	}
+
+	_, err = s.GetUsageReport(ctx, &usagepb.GetUsageReportRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR2"},
+	})
+	require.Error(t, err)
+}
+
+func TestServeReport_Authorization(t *testing.T) {
+	te := setupEnv(t)
+	users := testauth.TestUsers("US1", "GR1", "US2", "GR1", "US3", "GR1")
+	// US2 is a developer, and US3 is an API key with the org admin capability
+	// and the default role that API keys are granted.
+	users["US2"].(*testauth.TestUser).GroupMemberships[0].Role = role.Developer
+	users["US3"].(*testauth.TestUser).GroupMemberships[0].Role = role.Default
+	users["US3"].(*testauth.TestUser).Capabilities = []akpb.ApiKey_Capability{akpb.ApiKey_ORG_ADMIN_CAPABILITY}
+	ta := testauth.NewTestAuthenticator(users)
+	te.SetAuthenticator(ta)
+	s := New(te)
+
+	for _, tc := range []struct {
+		userID   string
+		wantCode int
+	}{
+		{userID: "US1", wantCode: http.StatusOK},
+		{userID: "US2", wantCode: http.StatusForbidden},
+		{userID: "US3", wantCode: http.StatusOK},
+	} {
+		t.Run(tc.userID, func(t *testing.T) {
+			ctx, err := ta.WithAuthenticatedUser(context.Background(), tc.userID)
+			require.NoError(t, err)
+			req := httptest.NewRequest(http.MethodGet, reportHTTPPath+"?start=2024-01-01&end=2024-01-31", nil).WithContext(ctx)
+			rec := httptest.NewRecorder()
+			s.serveReport(rec, req)
+			require.Equal(t, tc.wantCode, rec.Code, rec.Body.String())
+		})
+	}
+}
+
+// fakeBlobstore records the blobs that are written to it.
+type fakeBlobstore struct {
+	interfaces.Blobstore
+	mu     sync.Mutex
+	blobs  map[string][]byte
+	writes int
+}
+
+func (bs *fakeBlobstore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.blobs[blobName] = bytes.Clone(data)
+	bs.writes++
+	return len(data), nil
+}
+
+func TestMonthlyReporter(t *testing.T) {
+	te := setupEnv(t)
+	bs := &fakeBlobstore{blobs: map[string][]byte{}}
+	te.SetBlobstore(bs)
+
+	var mu sync.Mutex
+	var bodies []string
+	var headers []http.Header
+	statusCode := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		bodies = append(bodies, string(body))
+		headers = append(headers, r.Header.Clone())
+		w.WriteHeader(statusCode)
+	}))
+	t.Cleanup(server.Close)
+
+	flags.Set(t, "app.usage_report.blobstore.enabled", true)
+	flags.Set(t, "app.usage_report.webhook.url", server.URL)
+	flags.Set(t, "app.usage_report.webhook.hmac_secret", "secret")
+	clock := testclock.StartingAt(time.Date(2024, 2, 1, 5, 0, 0, 0, time.UTC))
+	r, err := newMonthlyReporter(te, clock)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// The January report isn't due until 6 hours into February.
+	require.Equal(t, time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC), r.lastMonth())
+	clock.Set(time.Date(2024, 2, 1, 7, 0, 0, 0, time.UTC))
+	require.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), r.lastMonth())
+
+	expectedReport := "date,group_id,origin,client,invocations,action_cache_hits,cas_cache_hits,total_download_size_bytes,total_upload_size_bytes,linux_execution_duration_usec,mac_execution_duration_usec,total_cached_action_exec_usec,cpu_nanos\n" +
+		"2024-01-01,GR1,,bazel,3,0,15,0,0,0,0,0,0\n" +
+		"2024-01-01,GR1,internal,executor,0,0,0,0,0,1000,0,0,0\n" +
+		"2024-01-31,GR2,,bazel,3,0,0,0,0,0,0,0,0\n"
+
+	// Failed pushes should be retried.
+	require.Error(t, r.pushLastMonth(ctx))
+	mu.Lock()
+	statusCode = http.StatusOK
+	mu.Unlock()
+	require.NoError(t, r.pushLastMonth(ctx))
+	// The report should only be pushed once it succeeds.
+	require.NoError(t, r.pushLastMonth(ctx))
+
+	// The blob written by the failed push is overwritten by the retry.
+	require.Equal(t, map[string][]byte{"usage_reports/2024-01.csv": []byte(expectedReport)}, bs.blobs)
+	require.Equal(t, 2, bs.writes)
+	require.Equal(t, []string{expectedReport, expectedReport}, bodies)
+	assert.Equal(t, "text/csv", headers[1].Get("Content-Type"))
+	assert.Equal(t, "2024-01", headers[1].Get(webhookPeriodHeader))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(expectedReport))
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), headers[1].Get(webhookutil.SignatureHeader))
+}
+
+func TestRegisterMonthlyReports_RequiresHTTPSWebhook(t *testing.T) {
+	te := setupEnv(t)
+	flags.Set(t, "app.usage_report.webhook.url", "http://hooks.acme.corp/buildbuddy/usage")
+	err := RegisterMonthlyReports(te)
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument; got: %v", err)
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/http/interceptors"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 
@@ -33,7 +35,9 @@ type usageService struct {
 // Registers the usage service if usage tracking is enabled
 func Register(env environment.Env) error {
 	if usage_config.UsageTrackingEnabled() {
-		env.SetUsageService(New(env))
+		s := New(env)
+		env.SetUsageService(s)
+		env.GetMux().Handle(reportHTTPPath, interceptors.WrapAuthenticatedExternalHandler(env, http.HandlerFunc(s.serveReport)))
 	}
 	return nil
 }
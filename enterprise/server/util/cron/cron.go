@@ -0,0 +1,173 @@
+// Package cron parses and evaluates standard 5-field cron expressions.
+package cron
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// Day of week allows 7 as an alias for Sunday.
+	dowField = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+
+	macros = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// Schedule is a parsed cron expression. Schedules have minute granularity.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day-of-month / day-of-week fields were unrestricted ("*").
+	// Following standard cron semantics, if both fields are restricted then a
+	// time matches if either field matches.
+	domStar, dowStar bool
+}
+
+// Parse parses a cron expression consisting of five space-separated fields:
+// minute, hour, day of month, month, and day of week. Each field may be "*",
+// a value, a range ("1-5"), or a comma-separated list of these, optionally
+// with a step ("*/15", "0-30/10"). Month and day-of-week fields also accept
+// three-letter English names. The macros "@yearly", "@annually", "@monthly",
+// "@weekly", "@daily", "@midnight" and "@hourly" are also supported.
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if m, ok := macros[strings.ToLower(expr)]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, status.InvalidArgumentErrorf("invalid cron expression %q: expected 5 fields, got %d", expr, len(fields))
+	}
+	s := &Schedule{}
+	var err error
+	if s.minute, err = parseField(fields[0], minuteField); err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid cron expression %q: %s", expr, err)
+	}
+	if s.hour, err = parseField(fields[1], hourField); err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid cron expression %q: %s", expr, err)
+	}
+	if s.dom, err = parseField(fields[2], domField); err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid cron expression %q: %s", expr, err)
+	}
+	if s.month, err = parseField(fields[3], monthField); err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid cron expression %q: %s", expr, err)
+	}
+	if s.dow, err = parseField(fields[4], dowField); err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid cron expression %q: %s", expr, err)
+	}
+	// Normalize Sunday=7 to Sunday=0.
+	if s.dow&(1<<7) != 0 {
+		s.dow = (s.dow | 1) &^ (1 << 7)
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// Matches returns whether the schedule fires during the minute containing t.
+// The time is evaluated in its own location; callers should normally pass UTC
+// times.
+func (s *Schedule) Matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 ||
+		s.hour&(1<<uint(t.Hour())) == 0 ||
+		s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func parseField(expr string, f field) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		b, err := parseRange(part, f)
+		if err != nil {
+			return 0, err
+		}
+		bits |= b
+	}
+	return bits, nil
+}
+
+func parseRange(expr string, f field) (uint64, error) {
+	rangeExpr, stepExpr, hasStep := strings.Cut(expr, "/")
+	step := 1
+	if hasStep {
+		n, err := strconv.Atoi(stepExpr)
+		if err != nil || n <= 0 {
+			return 0, status.InvalidArgumentErrorf("invalid step %q in %s field", stepExpr, f.name)
+		}
+		step = n
+	}
+	var lo, hi int
+	if rangeExpr == "*" {
+		lo, hi = f.min, f.max
+	} else {
+		loExpr, hiExpr, isRange := strings.Cut(rangeExpr, "-")
+		var err error
+		if lo, err = parseValue(loExpr, f); err != nil {
+			return 0, err
+		}
+		hi = lo
+		if isRange {
+			if hi, err = parseValue(hiExpr, f); err != nil {
+				return 0, err
+			}
+		} else if hasStep {
+			// "N/step" means "N-max/step".
+			hi = f.max
+		}
+		if hi < lo {
+			return 0, status.InvalidArgumentErrorf("invalid range %q in %s field", rangeExpr, f.name)
+		}
+	}
+	var bits uint64
+	for i := lo; i <= hi; i += step {
+		bits |= 1 << uint(i)
+	}
+	return bits, nil
+}
+
+func parseValue(expr string, f field) (int, error) {
+	if v, ok := f.names[strings.ToLower(expr)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(expr)
+	if err != nil {
+		return 0, status.InvalidArgumentErrorf("invalid value %q in %s field", expr, f.name)
+	}
+	if v < f.min || v > f.max {
+		return 0, status.InvalidArgumentErrorf("value %d out of range [%d, %d] in %s field", v, f.min, f.max, f.name)
+	}
+	return v, nil
+}
@@ -0,0 +1,75 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cron"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse_Invalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@every 5m",
+	} {
+		_, err := cron.Parse(expr)
+		assert.Error(t, err, "expression %q", expr)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	// 2023-03-15 is a Wednesday.
+	wed := func(hour, minute int) time.Time {
+		return time.Date(2023, time.March, 15, hour, minute, 30, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		expr        string
+		t           time.Time
+		shouldMatch bool
+	}{
+		{"* * * * *", wed(12, 34), true},
+		{"34 12 * * *", wed(12, 34), true},
+		{"34 12 * * *", wed(12, 35), false},
+		{"*/15 * * * *", wed(3, 45), true},
+		{"*/15 * * * *", wed(3, 46), false},
+		{"5/20 * * * *", wed(3, 25), true},
+		{"5/20 * * * *", wed(3, 20), false},
+		{"0-30/10 * * * *", wed(3, 30), true},
+		{"0-30/10 * * * *", wed(3, 40), false},
+		{"0 1,3,5 * * *", wed(3, 0), true},
+		{"0 1,3,5 * * *", wed(4, 0), false},
+		{"0 0 * * wed", wed(0, 0), true},
+		{"0 0 * * MON-FRI", wed(0, 0), true},
+		{"0 0 * * sat,sun", wed(0, 0), false},
+		{"0 0 * mar *", wed(0, 0), true},
+		{"0 0 15 * *", wed(0, 0), true},
+		// When both day-of-month and day-of-week are restricted, either may
+		// match.
+		{"0 0 1 * 3", wed(0, 0), true},
+		{"0 0 15 * 0", wed(0, 0), true},
+		{"0 0 1 * 0", wed(0, 0), false},
+		{"@daily", wed(0, 0), true},
+		{"@daily", wed(1, 0), false},
+		{"@hourly", wed(7, 0), true},
+		{"@weekly", time.Date(2023, time.March, 19, 0, 0, 0, 0, time.UTC), true},
+		// 7 is an alias for Sunday.
+		{"0 0 * * 7", time.Date(2023, time.March, 19, 0, 0, 0, 0, time.UTC), true},
+		{"@yearly", time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), true},
+	} {
+		s, err := cron.Parse(tc.expr)
+		require.NoError(t, err, "expression %q", tc.expr)
+		assert.Equal(t, tc.shouldMatch, s.Matches(tc.t), "expected Matches(%q, %s) => %v", tc.expr, tc.t, tc.shouldMatch)
+	}
+}
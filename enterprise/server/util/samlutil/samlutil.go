@@ -0,0 +1,20 @@
+package samlutil
+
+import (
+	"fmt"
+
+	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/build_buddy_url"
+)
+
+// SlugParam is the URL query parameter that identifies the organization that
+// a SAML request is for.
+const SlugParam = "slug"
+
+// EntityID returns the SAML service provider entity ID for the organization
+// with the given slug. Subject IDs of users that log in via SAML are prefixed
+// with the entity ID.
+func EntityID(slug string) string {
+	entityURL := build_buddy_url.WithPath("saml/metadata")
+	entityURL.RawQuery = fmt.Sprintf("%s=%s", SlugParam, slug)
+	return entityURL.String()
+}
@@ -0,0 +1,83 @@
+// Package webhookutil contains helpers for the webhooks that BuildBuddy sends
+// to customer endpoints.
+package webhookutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	// SignatureHeader is the request header that holds the signature of a
+	// webhook request.
+	SignatureHeader = "X-BuildBuddy-Signature"
+
+	// SecretFlagHelp is the help text of the flags that configure the secret
+	// that webhook requests are signed with.
+	SecretFlagHelp = "If set, webhook requests are signed with this secret. The hex-encoded HMAC-SHA256 of the request body is sent in the " + SignatureHeader + " header, prefixed with \"sha256=\"."
+)
+
+// Signature returns the signature of a webhook request with the given body:
+// "sha256=" followed by the hex-encoded HMAC-SHA256 of the body.
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign sets the signature header of the request, which must have the given
+// body. Requests are left unsigned if the secret is empty.
+func Sign(req *http.Request, secret string, body []byte) {
+	if secret == "" {
+		return
+	}
+	req.Header.Set(SignatureHeader, Signature(secret, body))
+}
+
+// ValidateURL returns an error unless the URL is an HTTPS URL, so that webhook
+// requests are never sent in plain text.
+func ValidateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return status.InvalidArgumentErrorf("webhook URL must be an https:// URL, got %q", rawURL)
+	}
+	return nil
+}
+
+// Post POSTs the body to the webhook URL, signed with the secret. It returns
+// an Unavailable error if the request fails or the endpoint doesn't respond
+// with a 2xx status, so that the caller can retry.
+func Post(ctx context.Context, client *http.Client, url, secret, contentType string, body []byte) error {
+	return PostWithHeader(ctx, client, url, secret, contentType, body, nil)
+}
+
+// PostWithHeader is like Post, but also sets the given request headers.
+func PostWithHeader(ctx context.Context, client *http.Client, url, secret, contentType string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return status.InvalidArgumentErrorf("could not create webhook request: %s", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	Sign(req, secret, body)
+	rsp, err := client.Do(req)
+	if err != nil {
+		return status.UnavailableErrorf("webhook request failed: %s", err)
+	}
+	defer rsp.Body.Close()
+	io.Copy(io.Discard, rsp.Body)
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return status.UnavailableErrorf("webhook request failed: HTTP %d", rsp.StatusCode)
+	}
+	return nil
+}
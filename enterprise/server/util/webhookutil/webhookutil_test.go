@@ -0,0 +1,62 @@
+package webhookutil_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/webhookutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte("The quick brown fox jumps over the lazy dog")
+	req, err := http.NewRequest(http.MethodPost, "https://hooks.acme.corp", nil)
+	require.NoError(t, err)
+
+	webhookutil.Sign(req, "key", body)
+	require.Equal(t, "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8", req.Header.Get(webhookutil.SignatureHeader))
+
+	req.Header.Del(webhookutil.SignatureHeader)
+	webhookutil.Sign(req, "", body)
+	require.Empty(t, req.Header.Get(webhookutil.SignatureHeader))
+}
+
+func TestValidateURL(t *testing.T) {
+	require.NoError(t, webhookutil.ValidateURL("https://hooks.acme.corp/buildbuddy"))
+	for _, u := range []string{"http://hooks.acme.corp/buildbuddy", "hooks.acme.corp", "https://", "://bad"} {
+		err := webhookutil.ValidateURL(u)
+		require.True(t, status.IsInvalidArgumentError(err), "url %q: expected InvalidArgument; got: %v", u, err)
+	}
+}
+
+func TestPost(t *testing.T) {
+	var req *http.Request
+	var body []byte
+	statusCode := http.StatusServiceUnavailable
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req, body = r, b
+		w.WriteHeader(statusCode)
+	}))
+	t.Cleanup(server.Close)
+	ctx := context.Background()
+
+	// Non-2xx responses should be retried.
+	err := webhookutil.Post(ctx, server.Client(), server.URL, "key", "text/plain", []byte("hello"))
+	require.True(t, status.IsUnavailableError(err), "expected Unavailable; got: %v", err)
+
+	statusCode = http.StatusOK
+	header := http.Header{"X-Custom": {"value"}}
+	err = webhookutil.PostWithHeader(ctx, server.Client(), server.URL, "key", "text/plain", []byte("hello"), header)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPost, req.Method)
+	require.Equal(t, "hello", string(body))
+	require.Equal(t, "text/plain", req.Header.Get("Content-Type"))
+	require.Equal(t, "value", req.Header.Get("X-Custom"))
+	require.Equal(t, webhookutil.Signature("key", body), req.Header.Get(webhookutil.SignatureHeader))
+}
@@ -25,6 +25,11 @@ var (
 	eventsToReceive = []string{"push", "pull_request", "pull_request_review"}
 )
 
+const (
+	// Max number of commits included in push event payloads.
+	maxPushEventCommits = 20
+)
+
 type githubGitProvider struct{}
 
 func NewProvider() interfaces.GitProvider {
@@ -139,6 +144,7 @@ func ParseWebhookData(event interface{}) (*interfaces.WebhookData, error) {
 			TargetRepoDefaultBranch: v["Repo.DefaultBranch"],
 			TargetBranch:            branch,
 			IsTargetRepoPublic:      v["Repo.Private"] == "false",
+			ChangedFiles:            pushEventChangedFiles(event),
 		}, nil
 
 	case *gh.PullRequestEvent:
@@ -176,6 +182,22 @@ func ParseWebhookData(event interface{}) (*interfaces.WebhookData, error) {
 	}
 }
 
+// pushEventChangedFiles returns the files changed by the pushed commits, or
+// nil if they can't be determined from the payload.
+func pushEventChangedFiles(event *gh.PushEvent) []string {
+	// Payloads for new branches and force pushes don't describe the changes
+	// relative to the previous branch state, and payloads are truncated to a
+	// max number of commits.
+	if event.GetCreated() || event.GetForced() || len(event.Commits) >= maxPushEventCommits {
+		return nil
+	}
+	commits := make([]webhook_data.CommitFiles, 0, len(event.Commits))
+	for _, c := range event.Commits {
+		commits = append(commits, webhook_data.CommitFiles{Added: c.Added, Modified: c.Modified, Removed: c.Removed})
+	}
+	return webhook_data.ChangedFiles(commits)
+}
+
 // parsePullRequestOrReview extracts WebhookData from a pull_request or
 // pull_request_review event.
 func parsePullRequestOrReview(event interface{}) (*interfaces.WebhookData, error) {
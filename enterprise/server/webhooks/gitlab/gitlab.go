@@ -0,0 +1,353 @@
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gl "github.com/buildbuddy-io/buildbuddy/server/backends/gitlab"
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+)
+
+const (
+	eventHeader = "X-Gitlab-Event"
+
+	pushHookEvent         = "Push Hook"
+	mergeRequestHookEvent = "Merge Request Hook"
+
+	// GitLab's visibility level for public projects.
+	publicVisibilityLevel = 20
+
+	// Minimum project access level (Developer) required for a user to be
+	// considered trusted.
+	// See https://docs.gitlab.com/ee/api/members.html#roles
+	developerAccessLevel = 30
+
+	// All-zero SHA sent as the "after" commit when a branch is deleted.
+	zeroSHA = "0000000000000000000000000000000000000000"
+)
+
+type gitlabGitProvider struct {
+	client *http.Client
+}
+
+func NewProvider() interfaces.GitProvider {
+	return &gitlabGitProvider{client: &http.Client{}}
+}
+
+func (*gitlabGitProvider) MatchRepoURL(u *url.URL) bool {
+	return u.Host == "gitlab.com" || gl.IsGitLabURL(u)
+}
+
+func (*gitlabGitProvider) MatchWebhookRequest(r *http.Request) bool {
+	return r.Header.Get(eventHeader) != ""
+}
+
+func (*gitlabGitProvider) ParseWebhookData(r *http.Request) (*interfaces.WebhookData, error) {
+	switch eventName := r.Header.Get(eventHeader); eventName {
+	case pushHookEvent:
+		payload := &PushEventPayload{}
+		if err := unmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal push event payload: %s", err)
+		}
+		// Ignore branch deletion and tag push events.
+		if payload.After == zeroSHA || !strings.HasPrefix(payload.Ref, "refs/heads/") {
+			return nil, nil
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"After",
+			"Ref",
+			"Project.WebURL",
+			"Project.DefaultBranch",
+		)
+		if err != nil {
+			return nil, err
+		}
+		branch := strings.TrimPrefix(v["Ref"], "refs/heads/")
+		return &interfaces.WebhookData{
+			EventName:               webhook_data.EventName.Push,
+			PushedRepoURL:           v["Project.WebURL"],
+			PushedBranch:            branch,
+			SHA:                     v["After"],
+			TargetRepoURL:           v["Project.WebURL"],
+			TargetRepoDefaultBranch: v["Project.DefaultBranch"],
+			TargetBranch:            branch,
+			IsTargetRepoPublic:      payload.Project.VisibilityLevel == publicVisibilityLevel,
+			ChangedFiles:            pushEventChangedFiles(payload),
+		}, nil
+	case mergeRequestHookEvent:
+		payload := &MergeRequestEventPayload{}
+		if err := unmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", eventName, err)
+		}
+		attrs := payload.ObjectAttributes
+		if attrs == nil {
+			return nil, status.InvalidArgumentError("merge request event is missing object_attributes")
+		}
+		// Run workflows when the MR is opened, pushed to, or reopened, or when
+		// the target branch changes, to match the GitHub provider. Also
+		// record approvals.
+		newCommitsPushed := attrs.Action == "update" && attrs.OldRev != ""
+		targetBranchChanged := attrs.Action == "update" && payload.Changes != nil && payload.Changes.TargetBranch != nil
+		approved := attrs.Action == "approved"
+		if !(attrs.Action == "open" || attrs.Action == "reopen" || newCommitsPushed || targetBranchChanged || approved) {
+			return nil, nil
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"ObjectAttributes.Source.WebURL",
+			"ObjectAttributes.SourceBranch",
+			"ObjectAttributes.LastCommit.ID",
+			"ObjectAttributes.Target.WebURL",
+			"ObjectAttributes.Target.DefaultBranch",
+			"ObjectAttributes.TargetBranch",
+			"User.Username",
+		)
+		if err != nil {
+			return nil, err
+		}
+		wd := &interfaces.WebhookData{
+			EventName:               webhook_data.EventName.PullRequest,
+			PushedRepoURL:           v["ObjectAttributes.Source.WebURL"],
+			PushedBranch:            v["ObjectAttributes.SourceBranch"],
+			SHA:                     v["ObjectAttributes.LastCommit.ID"],
+			TargetRepoURL:           v["ObjectAttributes.Target.WebURL"],
+			TargetRepoDefaultBranch: v["ObjectAttributes.Target.DefaultBranch"],
+			TargetBranch:            v["ObjectAttributes.TargetBranch"],
+			IsTargetRepoPublic:      attrs.Target.VisibilityLevel == publicVisibilityLevel,
+			PullRequestNumber:       attrs.IID,
+		}
+		// The merge request author isn't included in the payload by
+		// username; the user who triggered the event is. For approval
+		// events that's the approver, otherwise it's the user who opened or
+		// pushed to the MR.
+		if approved {
+			wd.PullRequestApprover = v["User.Username"]
+		} else {
+			wd.PullRequestAuthor = v["User.Username"]
+		}
+		return wd, nil
+	default:
+		log.Debugf("Ignoring GitLab webhook event: %s", eventName)
+		return nil, nil
+	}
+}
+
+// pushEventChangedFiles returns the files changed by the pushed commits, or
+// nil if they can't be determined from the payload.
+func pushEventChangedFiles(payload *PushEventPayload) []string {
+	// Payloads for new branches don't describe the changes relative to an
+	// existing branch, and payloads are truncated to a max number of commits.
+	if payload.Before == zeroSHA || payload.TotalCommitsCount > len(payload.Commits) {
+		return nil
+	}
+	commits := make([]webhook_data.CommitFiles, 0, len(payload.Commits))
+	for _, c := range payload.Commits {
+		commits = append(commits, webhook_data.CommitFiles{Added: c.Added, Modified: c.Modified, Removed: c.Removed})
+	}
+	return webhook_data.ChangedFiles(commits)
+}
+
+// RegisterWebhook registers the given webhook to the project and returns the
+// ID of the registered webhook.
+func (p *gitlabGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
+	body := map[string]interface{}{
+		"url":                   webhookURL,
+		"push_events":           true,
+		"merge_requests_events": true,
+	}
+	hook := &struct {
+		ID int64 `json:"id"`
+	}{}
+	if err := p.do(ctx, accessToken, repoURL, "POST", "/hooks", body, hook); err != nil {
+		return "", err
+	}
+	if hook.ID == 0 {
+		return "", status.UnknownError("GitLab returned invalid response from hooks API (missing ID field).")
+	}
+	return fmt.Sprintf("%d", hook.ID), nil
+}
+
+// UnregisterWebhook removes the webhook from the project.
+func (p *gitlabGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
+	return p.do(ctx, accessToken, repoURL, "DELETE", "/hooks/"+url.PathEscape(webhookID), nil, nil)
+}
+
+func (p *gitlabGitProvider) GetFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
+	path := "/repository/files/" + url.PathEscape(filePath) + "/raw?ref=" + url.QueryEscape(ref)
+	buf := &bytes.Buffer{}
+	if err := p.do(ctx, accessToken, repoURL, "GET", path, nil, buf); err != nil {
+		if status.IsNotFoundError(err) {
+			return nil, status.NotFoundErrorf("%s: not found in %s", filePath, repoURL)
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (p *gitlabGitProvider) IsTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
+	// Note: "members/all" includes members inherited from parent groups.
+	var members []*Member
+	if err := p.do(ctx, accessToken, repoURL, "GET", "/members/all?query="+url.QueryEscape(user), nil, &members); err != nil {
+		return false, status.InternalErrorf("failed to determine whether %s is a member of %s: %s", user, repoURL, err)
+	}
+	for _, m := range members {
+		if m.Username == user {
+			return m.AccessLevel >= developerAccessLevel, nil
+		}
+	}
+	return false, nil
+}
+
+// do sends a GitLab API request for the project at repoURL. The path is
+// relative to the project's API URL. If out is a *bytes.Buffer, the raw
+// response body is written to it; otherwise the response is JSON-decoded into
+// out (if non-nil).
+func (p *gitlabGitProvider) do(ctx context.Context, accessToken, repoURL, method, path string, body, out interface{}) error {
+	projectURL, err := projectAPIURL(repoURL)
+	if err != nil {
+		return err
+	}
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return status.InternalErrorf("failed to encode request: %s", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, projectURL+path, reqBody)
+	if err != nil {
+		return status.InternalErrorf("failed to create request: %s", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	rsp, err := p.client.Do(req)
+	if err != nil {
+		return status.UnavailableErrorf("failed to send request: %s", err)
+	}
+	defer rsp.Body.Close()
+	b, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return status.UnavailableErrorf("failed to read response: %s", err)
+	}
+	switch {
+	case rsp.StatusCode == http.StatusNotFound:
+		return status.NotFoundErrorf("HTTP %s: %q", rsp.Status, string(b))
+	case rsp.StatusCode == http.StatusUnauthorized || rsp.StatusCode == http.StatusForbidden:
+		return status.PermissionDeniedErrorf("HTTP %s: %q", rsp.Status, string(b))
+	case rsp.StatusCode >= 400:
+		return status.UnknownErrorf("HTTP %s: %q", rsp.Status, string(b))
+	}
+	if out == nil {
+		return nil
+	}
+	if buf, ok := out.(*bytes.Buffer); ok {
+		_, err := buf.Write(b)
+		return err
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return status.UnknownErrorf("failed to decode GitLab response: %s", err)
+	}
+	return nil
+}
+
+// projectAPIURL returns the API URL for the project at the given repo URL,
+// e.g. "https://gitlab.com/api/v4/projects/group%2Frepo" for
+// "https://gitlab.com/group/repo.git".
+func projectAPIURL(repoURL string) (string, error) {
+	u, err := gitutil.NormalizeRepoURL(repoURL)
+	if err != nil {
+		return "", status.WrapError(err, "failed to parse GitLab repo URL")
+	}
+	projectPath := strings.TrimPrefix(u.Path, "/")
+	if !strings.Contains(projectPath, "/") {
+		return "", status.InvalidArgumentErrorf("invalid GitLab project path %q", projectPath)
+	}
+	return fmt.Sprintf("%s://%s/api/v4/projects/%s", u.Scheme, u.Host, url.PathEscape(projectPath)), nil
+}
+
+func unmarshalBody(r *http.Request, payload interface{}) error {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, payload)
+}
+
+// PushEventPayload represents a subset of GitLab's push event schema.
+// See https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#push-events
+type PushEventPayload struct {
+	Ref               string    `json:"ref"`
+	Before            string    `json:"before"`
+	After             string    `json:"after"`
+	Project           *Project  `json:"project"`
+	Commits           []*Commit `json:"commits"`
+	TotalCommitsCount int       `json:"total_commits_count"`
+}
+
+// MergeRequestEventPayload represents a subset of GitLab's merge request
+// event schema.
+// See https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#merge-request-events
+type MergeRequestEventPayload struct {
+	User             *User                   `json:"user"`
+	Project          *Project                `json:"project"`
+	ObjectAttributes *MergeRequestAttributes `json:"object_attributes"`
+	Changes          *MergeRequestChanges    `json:"changes"`
+}
+type MergeRequestAttributes struct {
+	IID          int64    `json:"iid"`
+	Action       string   `json:"action"`
+	SourceBranch string   `json:"source_branch"`
+	TargetBranch string   `json:"target_branch"`
+	Source       *Project `json:"source"`
+	Target       *Project `json:"target"`
+	LastCommit   *Commit  `json:"last_commit"`
+	// OldRev is only set for "update" actions where new commits were pushed.
+	OldRev string `json:"oldrev"`
+}
+type MergeRequestChanges struct {
+	TargetBranch *struct {
+		Previous string `json:"previous"`
+		Current  string `json:"current"`
+	} `json:"target_branch"`
+}
+
+// Project represents a subset of GitLab's project schema, which is a common
+// entity used in multiple webhook events.
+type Project struct {
+	WebURL            string `json:"web_url"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	DefaultBranch     string `json:"default_branch"`
+	VisibilityLevel   int    `json:"visibility_level"`
+}
+type Commit struct {
+	ID       string   `json:"id"`
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+type User struct {
+	Username string `json:"username"`
+}
+
+// Member represents a subset of GitLab's project member schema.
+// See https://docs.gitlab.com/ee/api/members.html
+type Member struct {
+	Username    string `json:"username"`
+	AccessLevel int    `json:"access_level"`
+}
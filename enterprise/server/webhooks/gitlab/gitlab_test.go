@@ -0,0 +1,69 @@
+package gitlab_test
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab/test_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/stretchr/testify/assert"
+)
+
+func webhookRequest(t *testing.T, eventType string, payload []byte) *http.Request {
+	req, err := http.NewRequest("POST", "https://buildbuddy.io/webhooks/foo", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Gitlab-Event", eventType)
+	req.Header.Add("Content-Type", "application/json")
+	return req
+}
+
+func TestParseRequest_ValidPushEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "Push Hook", test_data.PushEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:               "push",
+		PushedRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground",
+		PushedBranch:            "main",
+		SHA:                     "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+		TargetRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground",
+		TargetRepoDefaultBranch: "main",
+		TargetBranch:            "main",
+		ChangedFiles:            []string{"BUILD"},
+	}, data)
+}
+
+func TestParseRequest_ValidMergeRequestEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "Merge Request Hook", test_data.MergeRequestEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:               "pull_request",
+		PushedRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground",
+		PushedBranch:            "test-1614594102",
+		SHA:                     "b5f2c1b9e6a1a4b1d1c2f0d3e8a7c6b5a4f3e2d1",
+		TargetRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground",
+		TargetRepoDefaultBranch: "main",
+		TargetBranch:            "main",
+		IsTargetRepoPublic:      true,
+		PullRequestNumber:       3,
+		PullRequestAuthor:       "test",
+	}, data)
+}
+
+func TestParseRequest_UnknownEvent_Ignored(t *testing.T) {
+	req := webhookRequest(t, "Note Hook", []byte("{}"))
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
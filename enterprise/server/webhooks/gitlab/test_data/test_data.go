@@ -0,0 +1,9 @@
+package test_data
+
+import _ "embed"
+
+//go:embed push_event.json
+var PushEvent []byte
+
+//go:embed merge_request_event.json
+var MergeRequestEvent []byte
@@ -11,12 +11,42 @@ var (
 	EventName struct {
 		Push        string
 		PullRequest string
+		// Schedule is not a webhook event, but is used for actions triggered
+		// by a schedule trigger.
+		Schedule string
 	}
 )
 
 func init() {
 	EventName.Push = "push"
 	EventName.PullRequest = "pull_request"
+	EventName.Schedule = "schedule"
+}
+
+// CommitFiles lists the paths that a pushed commit added, modified and
+// removed.
+type CommitFiles struct {
+	Added    []string
+	Modified []string
+	Removed  []string
+}
+
+// ChangedFiles returns the paths changed by the given commits, without
+// duplicates, in the order they first appear.
+func ChangedFiles(commits []CommitFiles) []string {
+	changedFiles := []string{}
+	seen := map[string]bool{}
+	for _, c := range commits {
+		for _, paths := range [][]string{c.Added, c.Modified, c.Removed} {
+			for _, p := range paths {
+				if !seen[p] {
+					seen[p] = true
+					changedFiles = append(changedFiles, p)
+				}
+			}
+		}
+	}
+	return changedFiles
 }
 
 func DebugString(wd *interfaces.WebhookData) string {
@@ -0,0 +1,16 @@
+package webhook_data_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangedFiles(t *testing.T) {
+	require.Equal(t, []string{}, webhook_data.ChangedFiles(nil))
+	require.Equal(t, []string{"a.go", "b.go", "c.go", "d.go"}, webhook_data.ChangedFiles([]webhook_data.CommitFiles{
+		{Added: []string{"a.go"}, Modified: []string{"b.go"}},
+		{Modified: []string{"a.go", "c.go"}, Removed: []string{"b.go", "d.go"}},
+	}))
+}
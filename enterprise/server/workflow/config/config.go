@@ -1,11 +1,16 @@
 package config
 
 import (
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cron"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/gobwas/glob"
 	"gopkg.in/yaml.v2"
 )
 
@@ -42,14 +47,36 @@ type Action struct {
 type Triggers struct {
 	Push        *PushTrigger        `yaml:"push"`
 	PullRequest *PullRequestTrigger `yaml:"pull_request"`
+	Schedule    []*ScheduleTrigger  `yaml:"schedule"`
 }
 
 type PushTrigger struct {
-	Branches []string `yaml:"branches"`
+	Branches    []string `yaml:"branches"`
+	Paths       []string `yaml:"paths"`
+	PathsIgnore []string `yaml:"paths_ignore"`
 }
 
 type PullRequestTrigger struct {
-	Branches []string `yaml:"branches"`
+	Branches    []string `yaml:"branches"`
+	Paths       []string `yaml:"paths"`
+	PathsIgnore []string `yaml:"paths_ignore"`
+}
+
+// ScheduleTrigger runs an action periodically on a branch.
+type ScheduleTrigger struct {
+	// Cron is a 5-field cron expression, evaluated in UTC.
+	Cron string `yaml:"cron"`
+	// Branch is the branch to check out when running the action.
+	Branch string `yaml:"branch"`
+}
+
+// Matches returns whether the trigger fires during the minute containing t.
+func (s *ScheduleTrigger) Matches(t time.Time) (bool, error) {
+	sched, err := cron.Parse(s.Cron)
+	if err != nil {
+		return false, err
+	}
+	return sched.Matches(t.UTC()), nil
 }
 
 type ResourceRequests struct {
@@ -149,6 +176,112 @@ func MatchesAnyTrigger(action *Action, event, branch string) bool {
 	return false
 }
 
+// HasPathFilters returns whether the action's trigger for the given event
+// filters on the changed paths.
+func HasPathFilters(action *Action, event string) bool {
+	paths, pathsIgnore := pathFilters(action, event)
+	return len(paths) > 0 || len(pathsIgnore) > 0
+}
+
+// MatchesChangedFiles returns whether the changed files satisfy the path
+// filters of the action's trigger for the given event. An action is matched
+// if any changed file matches one of the "paths" patterns (or "paths" is
+// empty) and does not match any of the "paths_ignore" patterns.
+//
+// If changedFiles is nil, the changed files are unknown and the action is
+// always matched.
+func MatchesChangedFiles(action *Action, event string, changedFiles []string) (bool, error) {
+	paths, pathsIgnore := pathFilters(action, event)
+	if changedFiles == nil || (len(paths) == 0 && len(pathsIgnore) == 0) {
+		return true, nil
+	}
+	include, err := compilePathPatterns(paths)
+	if err != nil {
+		return false, err
+	}
+	exclude, err := compilePathPatterns(pathsIgnore)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range changedFiles {
+		if len(include) > 0 && !matchesAnyPattern(include, f) {
+			continue
+		}
+		if matchesAnyPattern(exclude, f) {
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func pathFilters(action *Action, event string) (paths, pathsIgnore []string) {
+	if action.Triggers == nil {
+		return nil, nil
+	}
+	if pushCfg := action.Triggers.Push; pushCfg != nil && event == webhook_data.EventName.Push {
+		return pushCfg.Paths, pushCfg.PathsIgnore
+	}
+	if prCfg := action.Triggers.PullRequest; prCfg != nil && event == webhook_data.EventName.PullRequest {
+		return prCfg.Paths, prCfg.PathsIgnore
+	}
+	return nil, nil
+}
+
+// compilePathPatterns compiles glob patterns matched against slash-separated
+// paths. "*" does not match across directories, while "**" does.
+func compilePathPatterns(patterns []string) ([]glob.Glob, error) {
+	globs := make([]glob.Glob, 0, len(patterns))
+	for _, p := range patterns {
+		// Allow "**/" to match zero directories, so that "**/*.md" matches
+		// "README.md".
+		expr := p
+		if rest, ok := strings.CutPrefix(p, "**/"); ok {
+			expr = fmt.Sprintf("{%s,%s}", p, rest)
+		}
+		g, err := glob.Compile(expr, '/')
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid path pattern %q: %s", p, err)
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+func matchesAnyPattern(globs []glob.Glob, path string) bool {
+	for _, g := range globs {
+		if g.Match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchingScheduledBranches returns the branches on which the action should be
+// run for the schedule triggers that fire during the minute containing t. An
+// error is returned if any of the action's schedule triggers are invalid.
+func MatchingScheduledBranches(action *Action, t time.Time) ([]string, error) {
+	if action.Triggers == nil {
+		return nil, nil
+	}
+	var branches []string
+	seen := map[string]bool{}
+	for _, s := range action.Triggers.Schedule {
+		if s.Branch == "" {
+			return nil, status.InvalidArgumentErrorf("schedule trigger %q is missing a branch", s.Cron)
+		}
+		ok, err := s.Matches(t)
+		if err != nil {
+			return nil, err
+		}
+		if ok && !seen[s.Branch] {
+			seen[s.Branch] = true
+			branches = append(branches, s.Branch)
+		}
+	}
+	return branches, nil
+}
+
 func matchesAnyBranch(branches []string, branch string) bool {
 	for _, b := range branches {
 		if b == "*" {
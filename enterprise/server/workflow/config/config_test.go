@@ -3,6 +3,7 @@ package config_test
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/config"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/config/test_data"
@@ -65,3 +66,107 @@ func TestMatchesAnyTrigger_SupportsBasicWildcard(t *testing.T) {
 		assert.Equal(t, testCase.shouldMatch, match, "expected match(%q, %q) => %v", testCase.branchName, testCase.pattern, testCase.shouldMatch)
 	}
 }
+
+func TestWorkflowConf_Parse_ScheduleTrigger(t *testing.T) {
+	conf, err := config.NewConfig(bytes.NewReader([]byte(`
+actions:
+  - name: "Nightly"
+    triggers:
+      schedule:
+        - cron: "0 3 * * *"
+          branch: "main"
+        - cron: "0 3 * * *"
+          branch: "release"
+`)))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []*config.ScheduleTrigger{
+		{Cron: "0 3 * * *", Branch: "main"},
+		{Cron: "0 3 * * *", Branch: "release"},
+	}, conf.Actions[0].Triggers.Schedule)
+}
+
+func TestMatchingScheduledBranches(t *testing.T) {
+	action := &config.Action{
+		Triggers: &config.Triggers{
+			Schedule: []*config.ScheduleTrigger{
+				{Cron: "0 3 * * *", Branch: "main"},
+				{Cron: "0 * * * *", Branch: "main"},
+				{Cron: "30 3 * * *", Branch: "release"},
+			},
+		},
+	}
+
+	branches, err := config.MatchingScheduledBranches(action, time.Date(2023, time.March, 15, 3, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"main"}, branches)
+
+	branches, err = config.MatchingScheduledBranches(action, time.Date(2023, time.March, 15, 3, 30, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"release"}, branches)
+
+	branches, err = config.MatchingScheduledBranches(action, time.Date(2023, time.March, 15, 3, 15, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Empty(t, branches)
+
+	// Schedules don't affect push/pull_request matching.
+	assert.False(t, config.MatchesAnyTrigger(action, "push", "main"))
+
+	action.Triggers.Schedule = append(action.Triggers.Schedule, &config.ScheduleTrigger{Cron: "not a cron"})
+	_, err = config.MatchingScheduledBranches(action, time.Now())
+	assert.Error(t, err)
+}
+
+func TestMatchesChangedFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		paths        []string
+		pathsIgnore  []string
+		changedFiles []string
+		shouldMatch  bool
+	}{
+		{"no filters", nil, nil, []string{"docs/index.md"}, true},
+		{"unknown changed files", []string{"server/**"}, nil, nil, true},
+		{"paths match", []string{"server/**"}, nil, []string{"docs/index.md", "server/util/log.go"}, true},
+		{"paths no match", []string{"server/**"}, nil, []string{"docs/index.md"}, false},
+		{"single star does not cross directories", []string{"server/*"}, nil, []string{"server/util/log.go"}, false},
+		{"leading double star matches root", []string{"**/*.go"}, nil, []string{"main.go"}, true},
+		{"brace list", []string{"*.{yaml,bazelrc}"}, nil, []string{"buildbuddy.yaml"}, true},
+		{"all ignored", nil, []string{"docs/**", "**/*.md"}, []string{"docs/index.md", "README.md"}, false},
+		{"some not ignored", nil, []string{"docs/**"}, []string{"docs/index.md", "BUILD"}, true},
+		{"paths and paths_ignore", []string{"ios/**"}, []string{"ios/docs/**"}, []string{"ios/docs/setup.md"}, false},
+		{"no changed files", []string{"**"}, nil, []string{}, false},
+	} {
+		action := &config.Action{
+			Triggers: &config.Triggers{
+				Push: &config.PushTrigger{
+					Branches:    []string{"main"},
+					Paths:       tc.paths,
+					PathsIgnore: tc.pathsIgnore,
+				},
+			},
+		}
+
+		match, err := config.MatchesChangedFiles(action, "push", tc.changedFiles)
+
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.shouldMatch, match, tc.name)
+		// Path filters only apply to the trigger they're configured on.
+		match, err = config.MatchesChangedFiles(action, "pull_request", tc.changedFiles)
+		assert.NoError(t, err, tc.name)
+		assert.True(t, match, tc.name)
+	}
+}
+
+func TestMatchesChangedFiles_InvalidPattern(t *testing.T) {
+	action := &config.Action{
+		Triggers: &config.Triggers{
+			PullRequest: &config.PullRequestTrigger{Paths: []string{"server/{"}},
+		},
+	}
+
+	assert.True(t, config.HasPathFilters(action, "pull_request"))
+	assert.False(t, config.HasPathFilters(action, "push"))
+	_, err := config.MatchesChangedFiles(action, "pull_request", []string{"server/main.go"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,307 @@
+package service
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sync/errgroup"
+
+	guuid "github.com/google/uuid"
+)
+
+const (
+	// The ID of the row in the WorkflowSchedulers table that apps claim each
+	// minute through.
+	workflowSchedulerID = "default"
+
+	// How long to cache a repo's workflow config (and credentials) between
+	// schedule evaluations, to avoid fetching buildbuddy.yaml from every
+	// linked repo every minute.
+	scheduleConfigTTL = 10 * time.Minute
+
+	// Max number of repos to evaluate schedules for concurrently.
+	scheduleConcurrency = 16
+)
+
+// scheduleTarget is a linked repo whose schedule triggers should be evaluated.
+type scheduleTarget struct {
+	// workflowID identifies the workflow (or GitRepository-backed workflow).
+	workflowID string
+	groupID    string
+
+	// workflow returns the workflow with credentials populated. It is called
+	// with a context authenticated as the workflow's group.
+	workflow func(ctx context.Context) (*tables.Workflow, error)
+}
+
+// scheduledWorkflow holds the state needed to start scheduled actions for a
+// repo, cached across schedule evaluations.
+type scheduledWorkflow struct {
+	workflow  *tables.Workflow
+	apiKey    *tables.APIKey
+	config    *config.BuildBuddyConfig
+	fetchedAt time.Time
+}
+
+// startScheduler evaluates schedule triggers at the start of every minute
+// until the server shuts down.
+func (ws *workflowService) startScheduler() {
+	stop := make(chan struct{})
+	go func() {
+		for {
+			now := time.Now()
+			next := now.Truncate(time.Minute).Add(time.Minute)
+			select {
+			case <-time.After(next.Sub(now)):
+				if err := ws.RunScheduledWorkflows(context.Background(), next); err != nil {
+					log.Warningf("Failed to run scheduled workflows: %s", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	ws.env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		close(stop)
+		return nil
+	})
+}
+
+// RunScheduledWorkflows starts the workflow actions of all linked repos whose
+// schedule triggers fire during the minute containing t. Each minute is
+// evaluated by at most one app, and minutes before the last evaluated minute
+// are skipped.
+//
+// Public for testing only; the server calls this every minute when scheduled
+// triggers are enabled.
+func (ws *workflowService) RunScheduledWorkflows(ctx context.Context, t time.Time) error {
+	if err := ws.checkStartWorkflowPreconditions(ctx); err != nil {
+		return err
+	}
+	t = t.UTC().Truncate(time.Minute)
+	claimed, err := ws.claimScheduleMinute(ctx, t)
+	if err != nil {
+		return status.WrapError(err, "claim schedule minute")
+	}
+	if !claimed {
+		// Another app is handling this minute.
+		return nil
+	}
+
+	targets, err := ws.listScheduleTargets(ctx)
+	if err != nil {
+		return err
+	}
+	ws.pruneScheduledWorkflows(targets)
+
+	eg := &errgroup.Group{}
+	eg.SetLimit(scheduleConcurrency)
+	for _, target := range targets {
+		target := target
+		eg.Go(func() error {
+			if err := ws.runScheduledActions(ctx, target, t); err != nil {
+				log.CtxWarningf(ctx, "Failed to run scheduled actions for workflow %q: %s", target.workflowID, err)
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// claimScheduleMinute claims the minute starting at t for this app, by
+// advancing the last evaluated minute in the DB. It returns false if the
+// minute was already claimed.
+func (ws *workflowService) claimScheduleMinute(ctx context.Context, t time.Time) (bool, error) {
+	dbh := ws.env.GetDBHandle()
+	res := dbh.DB(ctx).Exec(`
+		UPDATE "WorkflowSchedulers"
+		SET last_evaluated_usec = ?
+		WHERE scheduler_id = ?
+		AND last_evaluated_usec < ?
+	`, t.UnixMicro(), workflowSchedulerID, t.UnixMicro())
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected > 0 {
+		return true, nil
+	}
+	row := &tables.WorkflowScheduler{}
+	err := dbh.ReadRow(ctx, row, "scheduler_id = ?", workflowSchedulerID)
+	if err == nil {
+		return false, nil
+	}
+	if !status.IsNotFoundError(err) {
+		return false, err
+	}
+	// This is the first minute that is evaluated.
+	err = dbh.DB(ctx).Create(&tables.WorkflowScheduler{
+		SchedulerID:       workflowSchedulerID,
+		LastEvaluatedUsec: t.UnixMicro(),
+	}).Error
+	if err != nil {
+		if err := dbh.ReadRow(ctx, row, "scheduler_id = ?", workflowSchedulerID); err == nil {
+			// Another app created the row first.
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// listScheduleTargets returns all linked repos, both legacy workflows and
+// repos linked via the GitHub App.
+func (ws *workflowService) listScheduleTargets(ctx context.Context) ([]*scheduleTarget, error) {
+	var targets []*scheduleTarget
+
+	var workflows []*tables.Workflow
+	err := ws.env.GetDBHandle().DB(ctx).Raw(`SELECT * FROM "Workflows"`).Find(&workflows).Error
+	if err != nil {
+		return nil, status.InternalErrorf("failed to list workflows: %s", err)
+	}
+	for _, wf := range workflows {
+		wf := wf
+		targets = append(targets, &scheduleTarget{
+			workflowID: wf.WorkflowID,
+			groupID:    wf.GroupID,
+			workflow: func(ctx context.Context) (*tables.Workflow, error) {
+				return wf, nil
+			},
+		})
+	}
+
+	app := ws.env.GetGitHubApp()
+	if app == nil {
+		return targets, nil
+	}
+	var repos []*tables.GitRepository
+	err = ws.env.GetDBHandle().DB(ctx).Raw(`SELECT * FROM "GitRepositories"`).Find(&repos).Error
+	if err != nil {
+		return nil, status.InternalErrorf("failed to list git repositories: %s", err)
+	}
+	for _, repo := range repos {
+		repo := repo
+		targets = append(targets, &scheduleTarget{
+			workflowID: ws.GetLegacyWorkflowIDForGitRepository(repo.GroupID, repo.RepoURL),
+			groupID:    repo.GroupID,
+			workflow: func(ctx context.Context) (*tables.Workflow, error) {
+				token, err := app.GetRepositoryInstallationToken(ctx, repo)
+				if err != nil {
+					return nil, err
+				}
+				return ws.gitRepositoryWorkflow(repo, token).Workflow, nil
+			},
+		})
+	}
+	return targets, nil
+}
+
+// pruneScheduledWorkflows removes cached state for repos that are no longer
+// linked.
+func (ws *workflowService) pruneScheduledWorkflows(targets []*scheduleTarget) {
+	ids := make(map[string]struct{}, len(targets))
+	for _, target := range targets {
+		ids[target.workflowID] = struct{}{}
+	}
+	ws.scheduledMu.Lock()
+	defer ws.scheduledMu.Unlock()
+	for id := range ws.scheduled {
+		if _, ok := ids[id]; !ok {
+			delete(ws.scheduled, id)
+		}
+	}
+}
+
+// getScheduledWorkflow returns the workflow, API key and config for the given
+// target, fetching them if they are not cached or are stale.
+func (ws *workflowService) getScheduledWorkflow(ctx context.Context, target *scheduleTarget) (*scheduledWorkflow, error) {
+	ws.scheduledMu.Lock()
+	sw, ok := ws.scheduled[target.workflowID]
+	ws.scheduledMu.Unlock()
+	if ok && time.Since(sw.fetchedAt) < scheduleConfigTTL {
+		return sw, nil
+	}
+
+	apiKey, err := ws.env.GetAuthDB().GetAPIKeyForInternalUseOnly(ctx, target.groupID)
+	if err != nil {
+		return nil, status.WrapErrorf(err, "failed to get API key for workflow")
+	}
+	ctx = ws.env.GetAuthenticator().AuthContextFromAPIKey(ctx, apiKey.Value)
+	wf, err := target.workflow(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(wf.RepoURL)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("failed to parse repo URL %q: %s", wf.RepoURL, err)
+	}
+	gitProvider, err := ws.providerForRepo(u)
+	if err != nil {
+		return nil, err
+	}
+	// Schedules are read from the config on the repo's default branch.
+	cfg, err := ws.fetchWorkflowConfig(ctx, gitProvider, wf, &interfaces.WebhookData{PushedRepoURL: wf.RepoURL})
+	if err != nil {
+		return nil, err
+	}
+	sw = &scheduledWorkflow{
+		workflow:  wf,
+		apiKey:    apiKey,
+		config:    cfg,
+		fetchedAt: time.Now(),
+	}
+	ws.scheduledMu.Lock()
+	ws.scheduled[target.workflowID] = sw
+	ws.scheduledMu.Unlock()
+	return sw, nil
+}
+
+// runScheduledActions starts each of the target's actions that have a
+// schedule trigger firing during the minute containing t.
+func (ws *workflowService) runScheduledActions(ctx context.Context, target *scheduleTarget, t time.Time) error {
+	sw, err := ws.getScheduledWorkflow(ctx, target)
+	if err != nil {
+		return err
+	}
+	wf := sw.workflow
+	eg := &errgroup.Group{}
+	for _, action := range sw.config.Actions {
+		action := action
+		branches, err := config.MatchingScheduledBranches(action, t)
+		if err != nil {
+			log.CtxWarningf(ctx, "Invalid schedule for workflow %s (%s) action %q: %s", wf.WorkflowID, wf.RepoURL, action.Name, err)
+			continue
+		}
+		for _, branch := range branches {
+			wd := &interfaces.WebhookData{
+				EventName:     webhook_data.EventName.Schedule,
+				PushedRepoURL: wf.RepoURL,
+				PushedBranch:  branch,
+				TargetRepoURL: wf.RepoURL,
+				TargetBranch:  branch,
+			}
+			invocationUUID, err := guuid.NewRandom()
+			if err != nil {
+				return err
+			}
+			invocationID := invocationUUID.String()
+			eg.Go(func() error {
+				log.CtxInfof(ctx, "Starting scheduled workflow %s (%s) action %q on branch %q", wf.WorkflowID, wf.RepoURL, action.Name, wd.PushedBranch)
+				// Scheduled actions run on branches of the target repo, so
+				// they are trusted.
+				isTrusted := true
+				if _, err := ws.executeWorkflowAction(ctx, sw.apiKey, wf, wd, isTrusted, action, invocationID, nil /*=extraCIRunnerArgs*/); err != nil {
+					log.CtxErrorf(ctx, "Failed to execute scheduled workflow %s (%s) action %q: %s", wf.WorkflowID, wf.RepoURL, action.Name, err)
+				}
+				return nil
+			})
+		}
+	}
+	return eg.Wait()
+}
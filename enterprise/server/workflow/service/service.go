@@ -73,6 +73,7 @@ var (
 	workflowsCIRunnerBazelCommand = flag.String("remote_execution.workflows_ci_runner_bazel_command", "", "Bazel command to be used by the CI runner.")
 	workflowsLinuxComputeUnits    = flag.Int("remote_execution.workflows_linux_compute_units", 3, "Number of BuildBuddy compute units (BCU) to reserve for Linux workflow actions.")
 	workflowsMacComputeUnits      = flag.Int("remote_execution.workflows_mac_compute_units", 3, "Number of BuildBuddy compute units (BCU) to reserve for Mac workflow actions.")
+	enableScheduledTriggers       = flag.Bool("remote_execution.workflows_enable_scheduled_triggers", false, "Whether to run workflow actions on the schedules configured in buildbuddy.yaml. Requires polling the config of every linked repo.")
 
 	workflowURLMatcher = regexp.MustCompile(`^.*/webhooks/workflow/(?P<instance_name>.*)$`)
 
@@ -149,6 +150,10 @@ type workflowService struct {
 	wg    sync.WaitGroup
 	tasks chan *startWorkflowTask
 	bbUrl *url.URL
+
+	scheduledMu sync.Mutex // protects scheduled
+	// Cached state for evaluating schedule triggers, keyed by workflow ID.
+	scheduled map[string]*scheduledWorkflow
 }
 
 func NewWorkflowService(env environment.Env) *workflowService {
@@ -156,8 +161,13 @@ func NewWorkflowService(env environment.Env) *workflowService {
 		env:   env,
 		tasks: make(chan *startWorkflowTask, webhookWorkerTaskQueueSize),
 		bbUrl: build_buddy_url.WithPath(""),
+
+		scheduled: make(map[string]*scheduledWorkflow),
 	}
 	ws.startBackgroundWorkers()
+	if *enableScheduledTriggers {
+		ws.startScheduler()
+	}
 	return ws
 }
 
@@ -1411,6 +1421,13 @@ func (ws *workflowService) startWorkflow(ctx context.Context, gitProvider interf
 			log.CtxDebugf(ctx, "Action %s not matched, triggers=%s", action.Name, string(jt))
 			continue
 		}
+		if ok, err := config.MatchesChangedFiles(action, wd.EventName, wd.ChangedFiles); err != nil {
+			// Run the action rather than silently skipping it.
+			log.CtxWarningf(ctx, "Failed to evaluate path filters for action %q: %s", action.Name, err)
+		} else if !ok {
+			log.CtxDebugf(ctx, "Action %s not matched, no changed files match path filters", action.Name)
+			continue
+		}
 		invocationUUID, err := guuid.NewRandom()
 		if err != nil {
 			return err
@@ -1523,6 +1540,11 @@ func (ws *workflowService) createApprovalRequiredStatus(ctx context.Context, wf
 }
 
 func (ws *workflowService) createQueuedStatus(ctx context.Context, wf *tables.Workflow, wd *interfaces.WebhookData, actionName, invocationID string) error {
+	if wd.SHA == "" {
+		// Scheduled actions aren't associated with a commit until the CI
+		// runner checks out the branch.
+		return nil
+	}
 	invocationURL := ws.bbUrl.ResolveReference(&url.URL{Path: "/invocation/" + invocationID})
 	invocationURL.RawQuery = "queued=true"
 	status := github.NewGithubStatusPayload(actionName, invocationURL.String(), "Queued...", github.PendingState)
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
@@ -688,3 +689,65 @@ func TestWebhook_TrustedPush_StartsTrustedWorkflow(t *testing.T) {
 		execReq.Metadata["x-buildbuddy-platform.env-overrides"],
 		"API key should be set via env-overrides")
 }
+
+func TestRunScheduledWorkflows_StartsMatchingActions(t *testing.T) {
+	ctx := context.Background()
+	flags.Set(t, "remote_execution.enable_remote_exec", true)
+	te := newTestEnv(t)
+	ctx, uid, gid := authenticate(t, ctx, te)
+	execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+	provider := setupFakeGitProvider(t, te)
+	repoURL := makeTempRepo(t)
+	clientConn := runBBServer(ctx, te, t)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+	req := &wfpb.CreateWorkflowRequest{
+		RequestContext: testauth.RequestContext(uid, gid),
+		GitRepo:        &wfpb.CreateWorkflowRequest_GitRepo{RepoUrl: repoURL},
+	}
+	_, err := bbClient.CreateWorkflow(ctx, req)
+	require.NoError(t, err)
+	provider.FileContents = map[string]string{"buildbuddy.yaml": `
+actions:
+  - name: "Nightly"
+    triggers:
+      push: { branches: [ "main" ] }
+      schedule:
+        - cron: "0 3 * * *"
+          branch: "main"
+    bazel_commands: [ "test //..." ]
+`}
+	scheduler, ok := te.GetWorkflowService().(interface {
+		RunScheduledWorkflows(ctx context.Context, t time.Time) error
+	})
+	require.True(t, ok)
+
+	// No schedule matches 02:00.
+	err = scheduler.RunScheduledWorkflows(context.Background(), time.Date(2023, time.March, 15, 2, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	err = scheduler.RunScheduledWorkflows(context.Background(), time.Date(2023, time.March, 15, 3, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	execReq := execClient.NextExecuteRequest()
+	exec := getExecution(t, ctx, te, execReq.Payload)
+	assert.Contains(t, exec.Command.GetArguments(), "--trigger_event=schedule")
+	assert.Contains(t, exec.Command.GetArguments(), "--pushed_branch=main")
+	assert.Contains(t, exec.Command.GetArguments(), "--pushed_repo_url="+repoURL)
+	assert.Contains(t, exec.Command.GetArguments(), "--commit_sha=")
+	assert.Regexp(t,
+		`BUILDBUDDY_API_KEY=[\w]+,REPO_USER=,REPO_TOKEN=`,
+		execReq.Metadata["x-buildbuddy-platform.env-overrides"],
+		"scheduled actions should be trusted")
+
+	// Each minute is evaluated only once, even if another app evaluates it
+	// too, and minutes before the last evaluated minute are skipped.
+	err = scheduler.RunScheduledWorkflows(context.Background(), time.Date(2023, time.March, 15, 3, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	err = scheduler.RunScheduledWorkflows(context.Background(), time.Date(2023, time.March, 14, 3, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Len(t, execClient.executeRequests, 0)
+
+	err = scheduler.RunScheduledWorkflows(context.Background(), time.Date(2023, time.March, 16, 3, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	execClient.NextExecuteRequest()
+}
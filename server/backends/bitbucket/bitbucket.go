@@ -0,0 +1,142 @@
+package bitbucket
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/flagutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	username    = flag.String("bitbucket.username", "", "The Bitbucket username used to post Bitbucket build statuses. ** Enterprise only **")
+	appPassword = flagutil.New("bitbucket.app_password", "", "The Bitbucket app password (with repository:write scope) used to post Bitbucket build statuses. ** Enterprise only **", flagutil.SecretTag)
+)
+
+const (
+	apiBaseURL = "https://api.bitbucket.org/2.0"
+	host       = "bitbucket.org"
+
+	// Bitbucket imposes a max length on build status keys.
+	maxKeyLength = 40
+
+	// Bitbucket build status states.
+
+	InProgressState State = "INPROGRESS"
+	SuccessfulState State = "SUCCESSFUL"
+	FailedState     State = "FAILED"
+	StoppedState    State = "STOPPED"
+)
+
+// State represents a status value that Bitbucket's build status API
+// understands.
+type State string
+
+type BuildStatusPayload struct {
+	// Key uniquely identifies the build status for the commit. Posting a
+	// status with an existing key updates that status.
+	Key         string `json:"key"`
+	State       State  `json:"state"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+}
+
+func NewBuildStatusPayload(name, URL, description string, state State) *BuildStatusPayload {
+	return &BuildStatusPayload{
+		Key:         statusKey(name),
+		Name:        name,
+		URL:         URL,
+		Description: description,
+		State:       state,
+	}
+}
+
+// statusKey returns a key for the given status name that fits within
+// Bitbucket's key length limit.
+func statusKey(name string) string {
+	if len(name) <= maxKeyLength {
+		return name
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:maxKeyLength]
+}
+
+// IsBitbucketURL returns whether the given (normalized) repo URL is hosted on
+// Bitbucket Cloud.
+func IsBitbucketURL(repoURL *url.URL) bool {
+	return repoURL.Host == host
+}
+
+type BitbucketClient struct {
+	client   *http.Client
+	username string
+	password string
+}
+
+// NewBitbucketClient returns a client that authenticates with the given
+// username and app password, falling back to the configured credentials if
+// the password is empty.
+func NewBitbucketClient(user, password string) *BitbucketClient {
+	if password == "" {
+		user = *username
+		password = *appPassword
+	}
+	return &BitbucketClient{
+		client:   &http.Client{},
+		username: user,
+		password: password,
+	}
+}
+
+// CreateStatus posts a build status for the given "workspace/repo_slug".
+func (c *BitbucketClient) CreateStatus(ctx context.Context, workspaceRepo, commitSHA string, payload *BuildStatusPayload) error {
+	if workspaceRepo == "" {
+		return status.InvalidArgumentError("failed to create Bitbucket status: workspaceRepo argument is empty")
+	}
+	if commitSHA == "" {
+		return status.InvalidArgumentError("failed to create Bitbucket status: commitSHA argument is empty")
+	}
+	if c.password == "" {
+		return status.FailedPreconditionError("failed to create Bitbucket status: no Bitbucket credentials configured")
+	}
+
+	u := fmt.Sprintf("%s/repositories/%s/commit/%s/statuses/build", apiBaseURL, workspaceRepo, commitSHA)
+	body := new(bytes.Buffer)
+	if err := json.NewEncoder(body).Encode(payload); err != nil {
+		return status.UnknownErrorf("failed to encode payload: %s", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, body)
+	if err != nil {
+		return status.InternalErrorf("failed to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	} else {
+		// Repository and workspace access tokens don't have an associated
+		// username and are sent as bearer tokens.
+		req.Header.Set("Authorization", "Bearer "+c.password)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return status.UnavailableErrorf("failed to send request: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return status.UnknownErrorf("HTTP %s: <failed to read response body>", res.Status)
+		}
+		return status.UnknownErrorf("HTTP %s: %q", res.Status, string(b))
+	}
+	log.CtxInfof(ctx, "Successfully posted Bitbucket status for %q @ commit %q: %q (%s): %q", workspaceRepo, commitSHA, payload.Name, payload.State, payload.Description)
+	return nil
+}
@@ -388,6 +388,11 @@ type ChunkstoreWriterOptions struct {
 	WriteBlockSize       int
 	WriteTimeoutDuration time.Duration
 	NoSplitWrite         bool
+
+	// ChunkWrittenHook, if set, is called with the contents of each chunk
+	// after it has been written to the blobstore. The chunk must not be
+	// modified or retained by the hook.
+	ChunkWrittenHook func(ctx context.Context, chunkIndex uint16, chunk []byte)
 }
 
 type ChunkstoreWriter struct {
@@ -464,6 +469,7 @@ type writeLoop struct {
 	writeChannel         chan *WriteRequest
 	chunkstore           *Chunkstore
 	writeHook            func(context.Context, *WriteRequest, *WriteResult, []byte, []byte)
+	chunkWrittenHook     func(context.Context, uint16, []byte)
 	blobName             string
 	writeBlockSize       int
 	writeTimeoutDuration time.Duration
@@ -480,6 +486,9 @@ func (l *writeLoop) write(ctx context.Context, chunk []byte, chunkIndex uint16,
 	if _, err := l.chunkstore.writeChunk(ctx, l.blobName, chunkIndex, chunk[:size]); err != nil {
 		return 0, err
 	}
+	if l.chunkWrittenHook != nil {
+		l.chunkWrittenHook(ctx, chunkIndex, chunk[:size])
+	}
 	return size, nil
 }
 
@@ -614,8 +623,10 @@ func (c *Chunkstore) Writer(ctx context.Context, blobName string, co *Chunkstore
 		writeTimeoutDuration = co.WriteTimeoutDuration
 	}
 	var writeHook func(context.Context, *WriteRequest, *WriteResult, []byte, []byte)
+	var chunkWrittenHook func(context.Context, uint16, []byte)
 	if co != nil {
 		writeHook = co.WriteHook
+		chunkWrittenHook = co.ChunkWrittenHook
 	}
 	noSplitWrite := false
 	if co != nil {
@@ -637,6 +648,7 @@ func (c *Chunkstore) Writer(ctx context.Context, blobName string, co *Chunkstore
 		writeChannel:         writer.writeChannel,
 		writeResultChannel:   writer.writeResultChannel,
 		writeHook:            writeHook,
+		chunkWrittenHook:     chunkWrittenHook,
 		writeBlockSize:       writeBlockSize,
 		writeTimeoutDuration: writeTimeoutDuration,
 		noSplitWrite:         noSplitWrite,
@@ -2,6 +2,7 @@ package chunkstore
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"testing"
 	"time"
@@ -449,3 +450,22 @@ func TestWriter(t *testing.T) {
 		t.Fatalf("Map contents are incorrect for multi-chunk file after close, which should flush the tail:\n\n%v\n\nshould be:\n\n%v", m.GetBlobMap(), test_map)
 	}
 }
+
+func TestWriterChunkWrittenHook(t *testing.T) {
+	m := mockstore.New()
+	c := New(m, &ChunkstoreOptions{WriteBlockSize: 5})
+	mtx := &mockstore.Context{}
+
+	written := map[uint16]string{}
+	hook := func(ctx context.Context, chunkIndex uint16, chunk []byte) {
+		written[chunkIndex] = string(chunk)
+	}
+	w := c.Writer(mtx, "foo", &ChunkstoreWriterOptions{WriteTimeoutDuration: time.Hour, ChunkWrittenHook: hook})
+	w.Write(mtx, []byte("asdfjkl;"))
+	w.Close(mtx)
+
+	expected := map[uint16]string{0: "asdfj", 1: "kl;"}
+	if !cmp.Equal(written, expected) {
+		t.Fatalf("Written chunks are incorrect:\n\n%v\n\nshould be:\n\n%v", written, expected)
+	}
+}
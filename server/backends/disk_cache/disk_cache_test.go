@@ -87,6 +87,47 @@ func TestGetSet(t *testing.T) {
 	}
 }
 
+func TestDigestFunctions(t *testing.T) {
+	maxSizeBytes := int64(1_000_000_000) // 1GB
+	rootDir := testfs.MakeTempDir(t)
+	te := getTestEnv(t, emptyUserMap)
+	ctx := getAnonContext(t, te)
+
+	dc, err := disk_cache.NewDiskCache(te, &disk_cache.Options{RootDirectory: rootDir}, maxSizeBytes)
+	require.NoError(t, err)
+
+	// Store the same contents under each digest function.
+	_, buf := testdigest.RandomCASResourceBuf(t, 1000)
+	var rns []*rspb.ResourceName
+	for _, df := range []repb.DigestFunction_Value{
+		repb.DigestFunction_SHA256,
+		repb.DigestFunction_SHA384,
+		repb.DigestFunction_SHA512,
+		repb.DigestFunction_VSO,
+	} {
+		d, err := digest.Compute(bytes.NewReader(buf), df)
+		require.NoError(t, err)
+		rn := digest.NewResourceName(d, "remoteInstanceName", rspb.CacheType_CAS, df).ToProto()
+		err = dc.Set(ctx, rn, buf)
+		require.NoError(t, err)
+		rns = append(rns, rn)
+	}
+	for _, rn := range rns {
+		rbuf, err := dc.Get(ctx, rn)
+		require.NoError(t, err)
+		require.Equal(t, buf, rbuf)
+	}
+
+	// All of the entries should still be found after the cache reloads its
+	// contents from disk.
+	dc2, err := disk_cache.NewDiskCache(te, &disk_cache.Options{RootDirectory: rootDir}, maxSizeBytes)
+	require.NoError(t, err)
+	dc2.WaitUntilMapped()
+	missing, err := dc2.FindMissing(ctx, rns)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+}
+
 func TestMetadata(t *testing.T) {
 	maxSizeBytes := int64(1_000_000_000) // 1GB
 	rootDir := testfs.MakeTempDir(t)
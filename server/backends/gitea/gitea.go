@@ -0,0 +1,117 @@
+package gitea
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/flagutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	baseURL     = flag.String("gitea.url", "", "The base URL of the Gitea instance to report commit statuses to, e.g. 'https://gitea.example.com'. ** Enterprise only **")
+	accessToken = flagutil.New("gitea.access_token", "", "The Gitea access token used to post Gitea commit statuses. ** Enterprise only **", flagutil.SecretTag)
+)
+
+const (
+	// Gitea commit status states.
+
+	PendingState State = "pending"
+	SuccessState State = "success"
+	ErrorState   State = "error"
+	FailureState State = "failure"
+	WarningState State = "warning"
+)
+
+// State represents a status value that Gitea's commit status API
+// understands.
+type State string
+
+type CommitStatusPayload struct {
+	State       State  `json:"state"`
+	TargetURL   string `json:"target_url"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+// BaseURL returns the configured Gitea base URL, without a trailing slash.
+func BaseURL() string {
+	return strings.TrimSuffix(*baseURL, "/")
+}
+
+// IsGiteaURL returns whether the given (normalized) repo URL is hosted on the
+// configured Gitea instance.
+func IsGiteaURL(repoURL *url.URL) bool {
+	if BaseURL() == "" {
+		return false
+	}
+	u, err := url.Parse(BaseURL())
+	if err != nil {
+		return false
+	}
+	return repoURL.Host == u.Host
+}
+
+type GiteaClient struct {
+	client *http.Client
+	token  string
+}
+
+// NewGiteaClient returns a client that authenticates with the given token,
+// falling back to the configured access token if empty.
+func NewGiteaClient(token string) *GiteaClient {
+	if token == "" {
+		token = *accessToken
+	}
+	return &GiteaClient{
+		client: &http.Client{},
+		token:  token,
+	}
+}
+
+// CreateStatus posts a commit status for the given "owner/repo".
+func (c *GiteaClient) CreateStatus(ctx context.Context, ownerRepo, commitSHA string, payload *CommitStatusPayload) error {
+	if ownerRepo == "" {
+		return status.InvalidArgumentError("failed to create Gitea status: ownerRepo argument is empty")
+	}
+	if commitSHA == "" {
+		return status.InvalidArgumentError("failed to create Gitea status: commitSHA argument is empty")
+	}
+	if c.token == "" {
+		return status.FailedPreconditionError("failed to create Gitea status: no Gitea access token configured")
+	}
+
+	u := fmt.Sprintf("%s/api/v1/repos/%s/statuses/%s", BaseURL(), ownerRepo, commitSHA)
+	body := new(bytes.Buffer)
+	if err := json.NewEncoder(body).Encode(payload); err != nil {
+		return status.UnknownErrorf("failed to encode payload: %s", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, body)
+	if err != nil {
+		return status.InternalErrorf("failed to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "token "+c.token)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return status.UnavailableErrorf("failed to send request: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return status.UnknownErrorf("HTTP %s: <failed to read response body>", res.Status)
+		}
+		return status.UnknownErrorf("HTTP %s: %q", res.Status, string(b))
+	}
+	log.CtxInfof(ctx, "Successfully posted Gitea status for %q @ commit %q: %q (%s): %q", ownerRepo, commitSHA, payload.Context, payload.State, payload.Description)
+	return nil
+}
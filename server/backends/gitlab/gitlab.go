@@ -0,0 +1,140 @@
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/flagutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	baseURL     = flag.String("gitlab.url", "https://gitlab.com", "The base URL of the GitLab instance to report commit statuses to. Set this when using a self-hosted GitLab. Statuses for repos on gitlab.com are always reported to gitlab.com. ** Enterprise only **")
+	accessToken = flagutil.New("gitlab.access_token", "", "The GitLab access token (with api scope) used to post GitLab commit statuses. ** Enterprise only **", flagutil.SecretTag)
+)
+
+const (
+	// The base URL of gitlab.com, whose repos are always reported to
+	// gitlab.com, even if a self-hosted instance is configured.
+	publicBaseURL = "https://gitlab.com"
+
+	// GitLab commit status states.
+
+	PendingState  State = "pending"
+	RunningState  State = "running"
+	SuccessState  State = "success"
+	FailedState   State = "failed"
+	CanceledState State = "canceled"
+)
+
+// State represents a status value that GitLab's commit status API
+// understands.
+type State string
+
+type CommitStatusPayload struct {
+	State       State  `json:"state"`
+	Name        string `json:"name"`
+	TargetURL   string `json:"target_url"`
+	Description string `json:"description"`
+}
+
+// BaseURL returns the configured GitLab base URL, without a trailing slash.
+func BaseURL() string {
+	return strings.TrimSuffix(*baseURL, "/")
+}
+
+// BaseURLForRepo returns the base URL of the GitLab instance that hosts the
+// given (normalized) repo URL: either the configured instance or gitlab.com.
+// It returns "" if the repo is not hosted on either.
+func BaseURLForRepo(repoURL *url.URL) string {
+	for _, base := range []string{BaseURL(), publicBaseURL} {
+		u, err := url.Parse(base)
+		if err != nil {
+			continue
+		}
+		if repoURL.Host == u.Host {
+			return base
+		}
+	}
+	return ""
+}
+
+// IsGitLabURL returns whether the given (normalized) repo URL is hosted on
+// the configured GitLab instance or on gitlab.com.
+func IsGitLabURL(repoURL *url.URL) bool {
+	return BaseURLForRepo(repoURL) != ""
+}
+
+type GitLabClient struct {
+	client  *http.Client
+	baseURL string
+	token   string
+}
+
+// NewGitLabClient returns a client for the GitLab instance at the given base
+// URL that authenticates with the given token. If the token is empty, the
+// configured access token is used, but only for the configured instance.
+func NewGitLabClient(instanceURL, token string) *GitLabClient {
+	if token == "" && instanceURL == BaseURL() {
+		token = *accessToken
+	}
+	return &GitLabClient{
+		client:  &http.Client{},
+		baseURL: instanceURL,
+		token:   token,
+	}
+}
+
+// BaseURL returns the base URL of the GitLab instance that the client posts
+// to.
+func (c *GitLabClient) BaseURL() string {
+	return c.baseURL
+}
+
+// CreateStatus posts a commit status for the given project, where
+// projectPath is the full path of the project (e.g. "group/subgroup/repo").
+func (c *GitLabClient) CreateStatus(ctx context.Context, projectPath, commitSHA string, payload *CommitStatusPayload) error {
+	if projectPath == "" {
+		return status.InvalidArgumentError("failed to create GitLab status: projectPath argument is empty")
+	}
+	if commitSHA == "" {
+		return status.InvalidArgumentError("failed to create GitLab status: commitSHA argument is empty")
+	}
+	if c.token == "" {
+		return status.FailedPreconditionError("failed to create GitLab status: no GitLab access token configured")
+	}
+
+	u := fmt.Sprintf("%s/api/v4/projects/%s/statuses/%s", c.baseURL, url.PathEscape(projectPath), commitSHA)
+	body := new(bytes.Buffer)
+	if err := json.NewEncoder(body).Encode(payload); err != nil {
+		return status.UnknownErrorf("failed to encode payload: %s", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, body)
+	if err != nil {
+		return status.InternalErrorf("failed to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("PRIVATE-TOKEN", c.token)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return status.UnavailableErrorf("failed to send request: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return status.UnknownErrorf("HTTP %s: <failed to read response body>", res.Status)
+		}
+		return status.UnknownErrorf("HTTP %s: %q", res.Status, string(b))
+	}
+	log.CtxInfof(ctx, "Successfully posted GitLab status for %q @ commit %q: %q (%s): %q", projectPath, commitSHA, payload.Name, payload.State, payload.Description)
+	return nil
+}
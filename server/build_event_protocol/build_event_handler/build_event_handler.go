@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/chunkstore"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_status_reporter"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_format"
@@ -1056,12 +1058,22 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 				// 0 indicates that curses is not being used.
 				numLinesToRetain += 3
 			}
+			var onChunkWritten func(context.Context, uint16, []byte)
+			if li := e.env.GetLogIndexer(); li != nil && ti.GroupID != "" {
+				// Only index logs for authenticated builds, since log search
+				// is scoped to a group.
+				groupID := ti.GroupID
+				onChunkWritten = func(ctx context.Context, chunkIndex uint16, chunk []byte) {
+					li.IndexLogChunk(ctx, groupID, iid, chunkIndex, chunk)
+				}
+			}
 			e.logWriter = eventlog.NewEventLogWriter(
 				e.ctx,
 				e.env.GetBlobstore(),
 				e.env.GetKeyValStore(),
 				eventlog.GetEventLogPathFromInvocationIdAndAttempt(iid, e.attempt),
 				numLinesToRetain,
+				onChunkWritten,
 			)
 		}
 		// Since this is the first event with options and we just parsed the API key,
@@ -1590,6 +1602,54 @@ func TableInvocationToProto(i *tables.Invocation) *inpb.Invocation {
 	return out
 }
 
+// DeleteInvocationBlobs deletes the data stored in the blobstore for an
+// attempt of an invocation: its build events, event log, cache scorecard, and
+// any cache artifacts that were persisted when the attempt was finalized.
+//
+// Each kind of data is deleted independently, so that a failure to delete one
+// doesn't leave the others behind. Data that doesn't exist (e.g. for attempt
+// 0 of invocations that were started after attempts were tracked) is skipped.
+func DeleteInvocationBlobs(ctx context.Context, env environment.Env, iid string, attempt uint64) error {
+	bs := env.GetBlobstore()
+	streamID := GetStreamIdFromInvocationIdAndAttempt(iid, attempt)
+	var errs []error
+	addErr := func(err error) {
+		if err != nil && !status.IsNotFoundError(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	// Persisted artifacts can only be found by looking at the build events,
+	// so the events are only deleted once the artifacts have been.
+	beValues := accumulator.NewBEValues(&inpb.Invocation{InvocationId: iid})
+	err := streamRawInvocationEvents(env, ctx, streamID, func(event *inpb.InvocationEvent) error {
+		return beValues.AddEvent(event.GetBuildEvent())
+	})
+	if err != nil && !status.IsNotFoundError(err) {
+		errs = append(errs, status.WrapErrorf(err, "failed to read events for invocation %s attempt %d", iid, attempt))
+	} else {
+		uris := beValues.TestOutputURIs()
+		if uri := beValues.BytestreamProfileURI(); uri != nil {
+			uris = append(uris, uri)
+		}
+		numErrs := len(errs)
+		for _, uri := range uris {
+			if rn, err := digest.ParseDownloadResourceName(uri.Path); err != nil || rn.IsEmpty() {
+				continue
+			}
+			addErr(bs.DeleteBlob(ctx, path.Join(iid, cacheArtifactsBlobstorePath, uri.Path)))
+		}
+		if len(errs) == numErrs {
+			addErr(protofile.DeleteExistingChunks(ctx, bs, streamID))
+		}
+	}
+
+	addErr(scorecard.Delete(ctx, env, iid, attempt))
+	eventLogPath := eventlog.GetEventLogPathFromInvocationIdAndAttempt(iid, attempt)
+	addErr(chunkstore.New(bs, &chunkstore.ChunkstoreOptions{}).DeleteBlob(ctx, eventLogPath))
+	return errors.Join(errs...)
+}
+
 func GetStreamIdFromInvocationIdAndAttempt(iid string, attempt uint64) string {
 	if attempt == 0 {
 		// This invocation predates the attempt-tracking functionality, so its
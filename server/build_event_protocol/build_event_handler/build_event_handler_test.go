@@ -10,11 +10,13 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/backends/chunkstore"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
 	"github.com/buildbuddy-io/buildbuddy/server/eventlog"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testclock"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -1238,3 +1240,64 @@ func TestTruncateStringSlice(t *testing.T) {
 		})
 	}
 }
+
+// failingDeleteBlobstore fails to delete the blobs with the given name.
+type failingDeleteBlobstore struct {
+	interfaces.Blobstore
+	name string
+}
+
+func (bs *failingDeleteBlobstore) DeleteBlob(ctx context.Context, blobName string) error {
+	if blobName == bs.name {
+		return status.InternalError("injected failure")
+	}
+	return bs.Blobstore.DeleteBlob(ctx, blobName)
+}
+
+func TestDeleteInvocationBlobs(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx := context.Background()
+	cs := chunkstore.New(te.GetBlobstore(), &chunkstore.ChunkstoreOptions{})
+	iid := uuid.New().String()
+	streamID := build_event_handler.GetStreamIdFromInvocationIdAndAttempt(iid, 1)
+	eventLogPath := eventlog.GetEventLogPathFromInvocationIdAndAttempt(iid, 1)
+	scorecardPath := iid + "/1/scorecard.pb"
+
+	writeBlobs := func() {
+		w := protofile.NewBufferedProtoWriter(te.GetBlobstore(), streamID, 1)
+		err := w.WriteProtoToStream(ctx, &inpb.InvocationEvent{BuildEvent: &bspb.BuildEvent{}})
+		require.NoError(t, err)
+		require.NoError(t, w.Flush(ctx))
+		_, err = cs.WriteBlob(ctx, eventLogPath, []byte("log"))
+		require.NoError(t, err)
+		_, err = te.GetBlobstore().WriteBlob(ctx, scorecardPath, []byte("scorecard"))
+		require.NoError(t, err)
+	}
+	assertDeleted := func(wantDeleted bool) {
+		exists, err := te.GetBlobstore().BlobExists(ctx, protofile.ChunkName(streamID, 0))
+		require.NoError(t, err)
+		assert.Equal(t, !wantDeleted, exists, "events exist")
+		exists, err = cs.BlobExists(ctx, eventLogPath)
+		require.NoError(t, err)
+		assert.Equal(t, !wantDeleted, exists, "event log exists")
+	}
+
+	// Invocations started after attempts were tracked don't have an attempt
+	// 0, and deleting nonexistent data isn't an error.
+	writeBlobs()
+	err := build_event_handler.DeleteInvocationBlobs(ctx, te, iid, 0)
+	require.NoError(t, err)
+	assertDeleted(false)
+
+	err = build_event_handler.DeleteInvocationBlobs(ctx, te, iid, 1)
+	require.NoError(t, err)
+	assertDeleted(true)
+
+	// A failure to delete one kind of data doesn't prevent the others from
+	// being deleted.
+	writeBlobs()
+	te.SetBlobstore(&failingDeleteBlobstore{Blobstore: te.GetBlobstore(), name: scorecardPath})
+	err = build_event_handler.DeleteInvocationBlobs(ctx, te, iid, 1)
+	require.Error(t, err)
+	assertDeleted(true)
+}
@@ -24,7 +24,7 @@ var (
 
 type BuildStatusReporter struct {
 	env                       environment.Env
-	githubClient              *github.GithubClient
+	statusSink                statusSink
 	buildEventAccumulator     *accumulator.BEValues
 	groups                    map[string]*GroupStatus
 	inFlight                  map[string]bool
@@ -50,16 +50,17 @@ func NewBuildStatusReporter(env environment.Env, buildEventAccumulator *accumula
 	}
 }
 
-func (r *BuildStatusReporter) initGHClient(ctx context.Context) *github.GithubClient {
+func (r *BuildStatusReporter) initStatusSink(ctx context.Context) statusSink {
+	repoURL := r.buildEventAccumulator.Invocation().GetRepoUrl()
 	if workflowID := r.buildEventAccumulator.WorkflowID(); workflowID != "" {
 		if dbh := r.env.GetDBHandle(); dbh != nil {
 			workflow := &tables.Workflow{}
 			if err := dbh.DB(ctx).Raw(`SELECT * from "Workflows" WHERE workflow_id = ?`, workflowID).Take(workflow).Error; err == nil {
-				return github.NewGithubClient(r.env, workflow.AccessToken)
+				return newStatusSink(r.env, repoURL, workflow)
 			}
 		}
 	}
-	return github.NewGithubClient(r.env, "")
+	return newStatusSink(r.env, repoURL, nil)
 }
 
 func (r *BuildStatusReporter) ReportStatusForEvent(ctx context.Context, event *build_event_stream.BuildEvent) {
@@ -67,7 +68,8 @@ func (r *BuildStatusReporter) ReportStatusForEvent(ctx context.Context, event *b
 		return
 	}
 
-	// TODO: support other providers than just GitHub
+	// Note: payloads are expressed in terms of GitHub statuses, and are
+	// translated by the status sink for other providers.
 	var githubPayload *github.GithubStatusPayload
 
 	switch event.Payload.(type) {
@@ -111,8 +113,8 @@ func (r *BuildStatusReporter) flushPayloadsIfWorkspaceLoaded(ctx context.Context
 	if !r.buildEventAccumulator.BuildMetadataIsLoaded() || r.buildEventAccumulator.DisableCommitStatusReporting() {
 		return
 	}
-	if r.githubClient == nil {
-		r.githubClient = r.initGHClient(ctx)
+	if r.statusSink == nil {
+		r.statusSink = r.initStatusSink(ctx)
 	}
 
 	for _, payload := range r.payloads {
@@ -126,21 +128,21 @@ func (r *BuildStatusReporter) flushPayloadsIfWorkspaceLoaded(ctx context.Context
 		repoURL := r.buildEventAccumulator.Invocation().GetRepoUrl()
 		ownerRepo, err := gitutil.OwnerRepoFromRepoURL(repoURL)
 		if err != nil {
-			log.CtxWarningf(ctx, "Failed to report GitHub status: %s", err)
+			log.CtxWarningf(ctx, "Failed to report %s status: %s", r.statusSink.Name(), err)
 			break
 		}
 		commitSHA := r.buildEventAccumulator.Invocation().GetCommitSha()
 		if ownerRepo != "" && commitSHA != "" {
-			err = r.githubClient.CreateStatus(ctx, ownerRepo, commitSHA, payload)
+			err = r.statusSink.CreateStatus(ctx, ownerRepo, commitSHA, payload)
 			if err != nil {
 				// Note: using info-level log since this is often due to client
 				// misconfiguration (e.g. user doesn't have BB GitHub app
 				// installed).
-				log.CtxInfof(ctx, "Failed to report GitHub status for %q @ %q: %s", ownerRepo, commitSHA, err)
+				log.CtxInfof(ctx, "Failed to report %s status for %q @ %q: %s", r.statusSink.Name(), ownerRepo, commitSHA, err)
 				continue
 			}
 		} else {
-			log.CtxDebugf(ctx, "Not reporting GitHub status (missing REPO_URL or COMMIT_SHA metadata)")
+			log.CtxDebugf(ctx, "Not reporting %s status (missing REPO_URL or COMMIT_SHA metadata)", r.statusSink.Name())
 		}
 	}
 
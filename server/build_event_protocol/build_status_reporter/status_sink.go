@@ -0,0 +1,124 @@
+package build_status_reporter
+
+import (
+	"context"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/bitbucket"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/gitea"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/github"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/gitlab"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+)
+
+// statusSink posts commit statuses to a Git provider.
+//
+// Payloads are expressed using GitHub's status model; each sink maps them
+// onto the equivalent concept for its provider.
+type statusSink interface {
+	// Name returns the provider name, for logging.
+	Name() string
+
+	// CreateStatus posts a status for the given commit in the repo
+	// identified by ownerRepo (the path of the normalized repo URL).
+	CreateStatus(ctx context.Context, ownerRepo, commitSHA string, payload *github.GithubStatusPayload) error
+}
+
+// newStatusSink returns the sink for the Git provider hosting the given repo
+// URL, by matching the repo's host against each configured provider. If the
+// invocation is associated with a workflow, the workflow's credentials are
+// used; otherwise the provider's configured credentials are used. Repos not
+// hosted on a known provider are reported to GitHub.
+func newStatusSink(env environment.Env, repoURL string, workflow *tables.Workflow) statusSink {
+	var username, token string
+	if workflow != nil {
+		username, token = workflow.Username, workflow.AccessToken
+	}
+	if u, err := gitutil.NormalizeRepoURL(repoURL); err == nil {
+		switch {
+		case gitlab.IsGitLabURL(u):
+			return &gitlabSink{gitlab.NewGitLabClient(gitlab.BaseURLForRepo(u), token)}
+		case bitbucket.IsBitbucketURL(u):
+			return &bitbucketSink{bitbucket.NewBitbucketClient(username, token)}
+		case gitea.IsGiteaURL(u):
+			return &giteaSink{gitea.NewGiteaClient(token)}
+		}
+	}
+	return &githubSink{github.NewGithubClient(env, token)}
+}
+
+type githubSink struct {
+	client *github.GithubClient
+}
+
+func (s *githubSink) Name() string { return "GitHub" }
+
+func (s *githubSink) CreateStatus(ctx context.Context, ownerRepo, commitSHA string, payload *github.GithubStatusPayload) error {
+	return s.client.CreateStatus(ctx, ownerRepo, commitSHA, payload)
+}
+
+type gitlabSink struct {
+	client *gitlab.GitLabClient
+}
+
+func (s *gitlabSink) Name() string { return "GitLab" }
+
+func (s *gitlabSink) CreateStatus(ctx context.Context, ownerRepo, commitSHA string, payload *github.GithubStatusPayload) error {
+	var state gitlab.State
+	switch payload.State {
+	case github.PendingState:
+		state = gitlab.RunningState
+	case github.SuccessState:
+		state = gitlab.SuccessState
+	case github.FailureState:
+		state = gitlab.FailedState
+	default:
+		// GitHub "error" is used for cancellations and disconnects.
+		state = gitlab.CanceledState
+	}
+	return s.client.CreateStatus(ctx, ownerRepo, commitSHA, &gitlab.CommitStatusPayload{
+		State:       state,
+		Name:        payload.Context,
+		TargetURL:   payload.TargetURL,
+		Description: payload.Description,
+	})
+}
+
+type bitbucketSink struct {
+	client *bitbucket.BitbucketClient
+}
+
+func (s *bitbucketSink) Name() string { return "Bitbucket" }
+
+func (s *bitbucketSink) CreateStatus(ctx context.Context, ownerRepo, commitSHA string, payload *github.GithubStatusPayload) error {
+	var state bitbucket.State
+	switch payload.State {
+	case github.PendingState:
+		state = bitbucket.InProgressState
+	case github.SuccessState:
+		state = bitbucket.SuccessfulState
+	case github.FailureState:
+		state = bitbucket.FailedState
+	default:
+		state = bitbucket.StoppedState
+	}
+	return s.client.CreateStatus(ctx, ownerRepo, commitSHA, bitbucket.NewBuildStatusPayload(payload.Context, payload.TargetURL, payload.Description, state))
+}
+
+type giteaSink struct {
+	client *gitea.GiteaClient
+}
+
+func (s *giteaSink) Name() string { return "Gitea" }
+
+func (s *giteaSink) CreateStatus(ctx context.Context, ownerRepo, commitSHA string, payload *github.GithubStatusPayload) error {
+	// Gitea's states are a superset of GitHub's.
+	return s.client.CreateStatus(ctx, ownerRepo, commitSHA, &gitea.CommitStatusPayload{
+		State:       gitea.State(payload.State),
+		TargetURL:   payload.TargetURL,
+		Description: payload.Description,
+		Context:     payload.Context,
+	})
+}
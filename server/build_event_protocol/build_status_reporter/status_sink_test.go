@@ -0,0 +1,51 @@
+package build_status_reporter
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStatusSink(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	flags.Set(t, "gitlab.url", "https://gitlab.example.com/")
+	flags.Set(t, "gitea.url", "https://gitea.example.com")
+
+	for _, tc := range []struct {
+		repoURL  string
+		expected string
+	}{
+		{"https://github.com/buildbuddy-io/buildbuddy", "GitHub"},
+		{"git@github.com:buildbuddy-io/buildbuddy.git", "GitHub"},
+		{"https://gitlab.example.com/group/subgroup/repo.git", "GitLab"},
+		{"https://gitlab.com/group/repo", "GitLab"},
+		{"https://bitbucket.org/workspace/repo", "Bitbucket"},
+		{"git@gitea.example.com:owner/repo.git", "Gitea"},
+		{"", "GitHub"},
+	} {
+		sink := newStatusSink(te, tc.repoURL, &tables.Workflow{AccessToken: "token"})
+		assert.Equal(t, tc.expected, sink.Name(), "repo URL %q", tc.repoURL)
+	}
+}
+
+func TestNewStatusSink_GitLabComWithSelfHostedGitLab(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	flags.Set(t, "gitlab.url", "https://gitlab.example.com/")
+
+	for _, tc := range []struct {
+		repoURL string
+		baseURL string
+	}{
+		{"https://gitlab.example.com/group/repo", "https://gitlab.example.com"},
+		{"https://gitlab.com/group/repo", "https://gitlab.com"},
+		{"git@gitlab.com:group/repo.git", "https://gitlab.com"},
+	} {
+		sink := newStatusSink(te, tc.repoURL, nil /*=workflow*/)
+		require.IsType(t, &gitlabSink{}, sink, "repo URL %q", tc.repoURL)
+		assert.Equal(t, tc.baseURL, sink.(*gitlabSink).client.BaseURL(), "repo URL %q", tc.repoURL)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/directory_size"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/scorecard"
+	"github.com/buildbuddy-io/buildbuddy/server/retention"
 	"github.com/buildbuddy-io/buildbuddy/server/role_filter"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/target"
@@ -38,6 +39,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/role"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/subdomain"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/urlutil"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
@@ -55,6 +57,7 @@ import (
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	qpb "github.com/buildbuddy-io/buildbuddy/proto/quota"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/repo"
+	rtpb "github.com/buildbuddy-io/buildbuddy/proto/retention"
 	rnpb "github.com/buildbuddy-io/buildbuddy/proto/runner"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 	skpb "github.com/buildbuddy-io/buildbuddy/proto/secrets"
@@ -568,6 +571,8 @@ func (s *BuildBuddyServer) GetApiKeys(ctx context.Context, req *akpb.GetApiKeysR
 			Label:               k.Label,
 			Capability:          capabilities.FromInt(k.Capabilities),
 			VisibleToDevelopers: k.VisibleToDevelopers,
+			ExpiryUsec:          k.ExpiryUsec,
+			AllowedIpRanges:     splitIPRanges(k.AllowedIPRanges),
 		})
 	}
 	return rsp, nil
@@ -597,6 +602,8 @@ func (s *BuildBuddyServer) GetApiKey(ctx context.Context, req *akpb.GetApiKeyReq
 			Label:               key.Label,
 			Capability:          capabilities.FromInt(key.Capabilities),
 			VisibleToDevelopers: key.VisibleToDevelopers,
+			ExpiryUsec:          key.ExpiryUsec,
+			AllowedIpRanges:     splitIPRanges(key.AllowedIPRanges),
 		},
 	}, nil
 }
@@ -608,7 +615,7 @@ func (s *BuildBuddyServer) CreateApiKey(ctx context.Context, req *akpb.CreateApi
 	}
 	k, err := authDB.CreateAPIKey(
 		ctx, req.GetRequestContext().GetGroupId(), req.GetLabel(), req.GetCapability(),
-		req.GetVisibleToDevelopers())
+		req.GetVisibleToDevelopers(), req.GetExpiryUsec(), req.GetAllowedIpRanges())
 	if err != nil {
 		return nil, err
 	}
@@ -627,10 +634,21 @@ func (s *BuildBuddyServer) CreateApiKey(ctx context.Context, req *akpb.CreateApi
 			Label:               k.Label,
 			Capability:          capabilities.FromInt(k.Capabilities),
 			VisibleToDevelopers: k.VisibleToDevelopers,
+			ExpiryUsec:          k.ExpiryUsec,
+			AllowedIpRanges:     splitIPRanges(k.AllowedIPRanges),
 		},
 	}, nil
 }
 
+// splitIPRanges returns the IP ranges that are stored comma-separated in the
+// given API key column.
+func splitIPRanges(ipRanges string) []string {
+	if ipRanges == "" {
+		return nil
+	}
+	return strings.Split(ipRanges, ",")
+}
+
 func (s *BuildBuddyServer) authorizeInvocationWrite(ctx context.Context, invocationID string) error {
 	auth := s.env.GetAuthenticator()
 	if auth == nil {
@@ -659,11 +677,16 @@ func (s *BuildBuddyServer) UpdateApiKey(ctx context.Context, req *akpb.UpdateApi
 	if err != nil {
 		return nil, err
 	}
+	allowedIPRanges, err := allowedIPRangesForUpdate(existingKey, req)
+	if err != nil {
+		return nil, err
+	}
 	tk := &tables.APIKey{
 		APIKeyID:            req.GetId(),
 		Label:               req.GetLabel(),
 		Capabilities:        capabilities.ToInt(req.GetCapability()),
 		VisibleToDevelopers: req.GetVisibleToDevelopers(),
+		AllowedIPRanges:     allowedIPRanges,
 	}
 	if err := authDB.UpdateAPIKey(ctx, tk); err != nil {
 		return nil, err
@@ -679,6 +702,22 @@ func (s *BuildBuddyServer) UpdateApiKey(ctx context.Context, req *akpb.UpdateApi
 	return &akpb.UpdateApiKeyResponse{}, nil
 }
 
+// allowedIPRangesForUpdate returns the allowed IP ranges that the key should
+// have after the given update. The key's existing ranges are kept unless the
+// request sets new ranges or explicitly clears them.
+func allowedIPRangesForUpdate(existingKey *tables.APIKey, req *akpb.UpdateApiKeyRequest) (string, error) {
+	if req.GetClearAllowedIpRanges() {
+		if len(req.GetAllowedIpRanges()) > 0 {
+			return "", status.InvalidArgumentError("allowed_ip_ranges cannot be set together with clear_allowed_ip_ranges")
+		}
+		return "", nil
+	}
+	if len(req.GetAllowedIpRanges()) == 0 {
+		return existingKey.AllowedIPRanges, nil
+	}
+	return strings.Join(req.GetAllowedIpRanges(), ","), nil
+}
+
 func (s *BuildBuddyServer) DeleteApiKey(ctx context.Context, req *akpb.DeleteApiKeyRequest) (*akpb.DeleteApiKeyResponse, error) {
 	authDB := s.env.GetAuthDB()
 	if authDB == nil {
@@ -746,6 +785,8 @@ func (s *BuildBuddyServer) GetUserApiKeys(ctx context.Context, req *akpb.GetApiK
 			Label:               k.Label,
 			Capability:          capabilities.FromInt(k.Capabilities),
 			VisibleToDevelopers: k.VisibleToDevelopers,
+			ExpiryUsec:          k.ExpiryUsec,
+			AllowedIpRanges:     splitIPRanges(k.AllowedIPRanges),
 		})
 	}
 	return rsp, nil
@@ -775,6 +816,8 @@ func (s *BuildBuddyServer) GetUserApiKey(ctx context.Context, req *akpb.GetApiKe
 			Label:               key.Label,
 			Capability:          capabilities.FromInt(key.Capabilities),
 			VisibleToDevelopers: key.VisibleToDevelopers,
+			ExpiryUsec:          key.ExpiryUsec,
+			AllowedIpRanges:     splitIPRanges(key.AllowedIPRanges),
 		},
 	}, nil
 }
@@ -784,7 +827,9 @@ func (s *BuildBuddyServer) CreateUserApiKey(ctx context.Context, req *akpb.Creat
 	if authDB == nil || !authDB.GetUserOwnedKeysEnabled() {
 		return nil, status.UnimplementedError("Not Implemented")
 	}
-	k, err := authDB.CreateUserAPIKey(ctx, req.GetRequestContext().GetGroupId(), req.GetLabel(), req.GetCapability())
+	k, err := authDB.CreateUserAPIKey(
+		ctx, req.GetRequestContext().GetGroupId(), req.GetLabel(), req.GetCapability(),
+		req.GetExpiryUsec(), req.GetAllowedIpRanges())
 	if err != nil {
 		return nil, err
 	}
@@ -803,6 +848,8 @@ func (s *BuildBuddyServer) CreateUserApiKey(ctx context.Context, req *akpb.Creat
 			Label:               k.Label,
 			Capability:          capabilities.FromInt(k.Capabilities),
 			VisibleToDevelopers: k.VisibleToDevelopers,
+			ExpiryUsec:          k.ExpiryUsec,
+			AllowedIpRanges:     splitIPRanges(k.AllowedIPRanges),
 		},
 	}, nil
 
@@ -817,11 +864,16 @@ func (s *BuildBuddyServer) UpdateUserApiKey(ctx context.Context, req *akpb.Updat
 	if err != nil {
 		return nil, err
 	}
+	allowedIPRanges, err := allowedIPRangesForUpdate(existingKey, req)
+	if err != nil {
+		return nil, err
+	}
 	updates := &tables.APIKey{
 		APIKeyID:            req.GetId(),
 		Label:               req.GetLabel(),
 		Capabilities:        capabilities.ToInt(req.GetCapability()),
 		VisibleToDevelopers: req.GetVisibleToDevelopers(),
+		AllowedIPRanges:     allowedIPRanges,
 	}
 	if err := authDB.UpdateAPIKey(ctx, updates); err != nil {
 		return nil, err
@@ -1161,6 +1213,10 @@ func (s *BuildBuddyServer) GetTargetHistory(ctx context.Context, req *trpb.GetTa
 	return target.GetTargetHistory(ctx, s.env, req)
 }
 
+func (s *BuildBuddyServer) GetFlakyTargets(ctx context.Context, req *trpb.GetFlakyTargetsRequest) (*trpb.GetFlakyTargetsResponse, error) {
+	return target.GetFlakyTargets(ctx, s.env, timeutil.NewClock(), req)
+}
+
 func (s *BuildBuddyServer) GetEventLogChunk(ctx context.Context, req *elpb.GetEventLogChunkRequest) (*elpb.GetEventLogChunkResponse, error) {
 	resp, err := eventlog.GetEventLogChunk(ctx, s.env, req)
 	if err != nil {
@@ -1169,6 +1225,13 @@ func (s *BuildBuddyServer) GetEventLogChunk(ctx context.Context, req *elpb.GetEv
 	return resp, err
 }
 
+func (s *BuildBuddyServer) SearchLogs(ctx context.Context, req *elpb.SearchLogsRequest) (*elpb.SearchLogsResponse, error) {
+	if li := s.env.GetLogIndexer(); li != nil {
+		return li.SearchLogs(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) CreateWorkflow(ctx context.Context, req *wfpb.CreateWorkflowRequest) (*wfpb.CreateWorkflowResponse, error) {
 	if wfs := s.env.GetWorkflowService(); wfs != nil {
 		return wfs.CreateWorkflow(ctx, req)
@@ -1212,10 +1275,18 @@ func (s *BuildBuddyServer) ExecuteWorkflow(ctx context.Context, req *wfpb.Execut
 
 			req.WorkflowId = wfs.GetLegacyWorkflowIDForGitRepository(authenticatedUser.GetGroupID(), req.GetTargetRepoUrl())
 		}
-		if al := s.env.GetAuditLogger(); al != nil && req.GetClean() {
-			al.Log(ctx, auditlog.GroupResourceID(req.GetRequestContext().GetGroupId()), alpb.Action_EXECUTE_CLEAN_WORKFLOW, req)
+		rsp, err := wfs.ExecuteWorkflow(ctx, req)
+		if err != nil {
+			return nil, err
 		}
-		return wfs.ExecuteWorkflow(ctx, req)
+		if al := s.env.GetAuditLogger(); al != nil {
+			action := alpb.Action_EXECUTE_WORKFLOW
+			if req.GetClean() {
+				action = alpb.Action_EXECUTE_CLEAN_WORKFLOW
+			}
+			al.Log(ctx, auditlog.GroupResourceID(req.GetRequestContext().GetGroupId()), action, req)
+		}
+		return rsp, nil
 	}
 	return nil, status.UnimplementedError("Not implemented")
 }
@@ -1355,6 +1426,13 @@ func (s *BuildBuddyServer) GetUsage(ctx context.Context, req *usagepb.GetUsageRe
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) GetUsageReport(ctx context.Context, req *usagepb.GetUsageReportRequest) (*usagepb.GetUsageReportResponse, error) {
+	if us := s.env.GetUsageService(); us != nil {
+		return us.GetUsageReport(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) GetSuggestion(ctx context.Context, req *supb.GetSuggestionRequest) (*supb.GetSuggestionResponse, error) {
 	if us := s.env.GetSuggestionService(); us != nil {
 		return us.GetSuggestion(ctx, req)
@@ -1414,6 +1492,20 @@ func (s *BuildBuddyServer) ApplyBucket(ctx context.Context, req *qpb.ApplyBucket
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) GetStorageQuota(ctx context.Context, req *qpb.GetStorageQuotaRequest) (*qpb.GetStorageQuotaResponse, error) {
+	if qm := s.env.GetQuotaManager(); qm != nil {
+		return qm.GetStorageQuota(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) SetStorageQuota(ctx context.Context, req *qpb.SetStorageQuotaRequest) (*qpb.SetStorageQuotaResponse, error) {
+	if qm := s.env.GetQuotaManager(); qm != nil {
+		return qm.SetStorageQuota(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) GetPublicKey(ctx context.Context, req *skpb.GetPublicKeyRequest) (*skpb.GetPublicKeyResponse, error) {
 	if secretService := s.env.GetSecretService(); secretService != nil {
 		return secretService.GetPublicKey(ctx, req)
@@ -1735,6 +1827,14 @@ func (s *BuildBuddyServer) GetAuditLogs(ctx context.Context, request *alpb.GetAu
 	return al.GetLogs(ctx, request)
 }
 
+func (s *BuildBuddyServer) GetRetentionPolicy(ctx context.Context, req *rtpb.GetRetentionPolicyRequest) (*rtpb.GetRetentionPolicyResponse, error) {
+	return retention.GetRetentionPolicy(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) UpdateRetentionPolicy(ctx context.Context, req *rtpb.UpdateRetentionPolicyRequest) (*rtpb.UpdateRetentionPolicyResponse, error) {
+	return retention.UpdateRetentionPolicy(ctx, s.env, req)
+}
+
 func (s *BuildBuddyServer) CreateRepo(ctx context.Context, request *repb.CreateRepoRequest) (*repb.CreateRepoResponse, error) {
 	gh := s.env.GetGitHubApp()
 	if gh == nil {
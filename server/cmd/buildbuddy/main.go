@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/janitor"
 	"github.com/buildbuddy-io/buildbuddy/server/libmain"
@@ -44,7 +45,7 @@ func main() {
 	telemetryClient.Start()
 	defer telemetryClient.Stop()
 
-	cleanupService := janitor.NewInvocationJanitor(env)
+	cleanupService := janitor.NewInvocationJanitor(env, build_event_handler.DeleteInvocationBlobs)
 	cleanupService.Start()
 	defer cleanupService.Stop()
 
@@ -149,6 +149,8 @@ type Env interface {
 	SetExecutionCollector(c interfaces.ExecutionCollector)
 	GetSuggestionService() interfaces.SuggestionService
 	SetSuggestionService(s interfaces.SuggestionService)
+	GetLogIndexer() interfaces.LogIndexer
+	SetLogIndexer(li interfaces.LogIndexer)
 	GetCrypter() interfaces.Crypter
 	SetCrypter(crypter interfaces.Crypter)
 	GetSociArtifactStoreServer() socipb.SociArtifactStoreServer
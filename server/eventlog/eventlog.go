@@ -276,7 +276,10 @@ func (q *chunkQueue) pop(ctx context.Context) ([]byte, error) {
 	return result.data, nil
 }
 
-func NewEventLogWriter(ctx context.Context, b interfaces.Blobstore, c interfaces.KeyValStore, eventLogPath string, numLinesToRetain int) *EventLogWriter {
+// NewEventLogWriter returns a writer for the event log at the given path. If
+// onChunkWritten is non-nil, it is called with the contents of each log chunk
+// after the chunk is written to the blobstore.
+func NewEventLogWriter(ctx context.Context, b interfaces.Blobstore, c interfaces.KeyValStore, eventLogPath string, numLinesToRetain int, onChunkWritten func(ctx context.Context, chunkIndex uint16, chunk []byte)) *EventLogWriter {
 	chunkstoreOptions := &chunkstore.ChunkstoreOptions{
 		WriteBlockSize: defaultLogChunkSize,
 	}
@@ -292,6 +295,7 @@ func NewEventLogWriter(ctx context.Context, b interfaces.Blobstore, c interfaces
 		WriteTimeoutDuration: defaultChunkTimeout,
 		NoSplitWrite:         true,
 		WriteHook:            writeHook,
+		ChunkWrittenHook:     onChunkWritten,
 	}
 	cw := chunkstore.New(b, chunkstoreOptions).Writer(ctx, eventLogPath, chunkstoreWriterOptions)
 	eventLogWriter.WriteCloserWithContext = &ANSICursorBufferWriter{
@@ -25,6 +25,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/clientip"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/subdomain"
+	"github.com/buildbuddy-io/buildbuddy/server/util/useragent"
 	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/protobuf/proto"
@@ -153,6 +154,12 @@ func ClientIP(next http.Handler) http.Handler {
 	})
 }
 
+func UserAgent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), useragent.ContextKey, r.UserAgent())))
+	})
+}
+
 func Subdomain(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		next.ServeHTTP(w, r.WithContext(subdomain.SetHost(r.Context(), r.Host)))
@@ -329,6 +336,7 @@ func WrapAuthenticatedExternalProtoletHandler(env environment.Env, httpPrefix st
 		LogRequest,
 		RequestID,
 		ClientIP,
+		UserAgent,
 		Subdomain,
 		RecoverAndAlert,
 	})
@@ -343,6 +351,7 @@ func WrapExternalHandler(env environment.Env, next http.Handler) http.Handler {
 		LogRequest,
 		RequestID,
 		ClientIP,
+		UserAgent,
 		Subdomain,
 		RecoverAndAlert,
 	})
@@ -360,6 +369,7 @@ func WrapAuthenticatedExternalHandler(env environment.Env, next http.Handler) ht
 		LogRequest,
 		RequestID,
 		ClientIP,
+		UserAgent,
 		Subdomain,
 		RecoverAndAlert,
 	})
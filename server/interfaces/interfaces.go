@@ -22,6 +22,7 @@ import (
 	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
 	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
 	enpb "github.com/buildbuddy-io/buildbuddy/proto/encryption"
+	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
 	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	ghpb "github.com/buildbuddy-io/buildbuddy/proto/github"
 	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
@@ -278,6 +279,38 @@ type StoppableCache interface {
 	Stop() error
 }
 
+// ScannedResource is a resource that was found by ScannableCache.ScanResources.
+type ScannedResource struct {
+	// The group that owns the resource.
+	GroupID string
+	// Whether the resource is stored encrypted with the group's key.
+	Encrypted bool
+	Resource  *rspb.ResourceName
+	// Size of the stored data. If the data was compressed, this is the
+	// compressed size.
+	StoredSizeBytes int64
+	// Cursor that resumes a scan after this resource.
+	Cursor []byte
+}
+
+// ScannableCache is a cache that can enumerate the resources that it stores.
+type ScannableCache interface {
+	Cache
+
+	// ScanResources calls fn for each resource stored in the cache, starting
+	// after the given cursor, or from the beginning if the cursor is empty.
+	// Scanning stops at the first error returned by fn, which is returned.
+	ScanResources(ctx context.Context, cursor []byte, fn func(sr *ScannedResource) error) error
+
+	// ReadScanState returns the state that was last saved under the given
+	// name with WriteScanState, or a NotFound error if there is none.
+	ReadScanState(ctx context.Context, name string) ([]byte, error)
+
+	// WriteScanState durably saves the state of a scan under the given name,
+	// so that the scan can be resumed after a restart.
+	WriteScanState(ctx context.Context, name string, state []byte) error
+}
+
 type TxRunner func(tx *gorm.DB) error
 
 type DBOptions interface {
@@ -315,6 +348,7 @@ type OLAPDBHandle interface {
 	FlushInvocationStats(ctx context.Context, ti *tables.Invocation) error
 	FlushExecutionStats(ctx context.Context, inv *sipb.StoredInvocation, executions []*repb.StoredExecution) error
 	FlushTestTargetStatuses(ctx context.Context, entries []*schema.TestTargetStatus) error
+	FlushLogLines(ctx context.Context, entries []*schema.LogLine) error
 	InsertAuditLog(ctx context.Context, entry *schema.AuditLog) error
 	BucketFromUsecTimestamp(fieldName string, loc *time.Location, interval string) (string, []interface{})
 }
@@ -372,8 +406,10 @@ type AuthDB interface {
 	// access.
 	GetAPIKeys(ctx context.Context, groupID string) ([]*tables.APIKey, error)
 
-	// CreateAPIKey creates a group-level API key.
-	CreateAPIKey(ctx context.Context, groupID string, label string, capabilities []akpb.ApiKey_Capability, visibleToDevelopers bool) (*tables.APIKey, error)
+	// CreateAPIKey creates a group-level API key. If expiryUsec is non-zero,
+	// the key is not valid after that time. If allowedIPRanges is non-empty,
+	// the key can only be used from IP addresses within those ranges.
+	CreateAPIKey(ctx context.Context, groupID string, label string, capabilities []akpb.ApiKey_Capability, visibleToDevelopers bool, expiryUsec int64, allowedIPRanges []string) (*tables.APIKey, error)
 
 	// CreateAPIKeyWithoutAuthCheck creates a group-level API key without
 	// checking that the user has admin rights on the group. This should only
@@ -390,15 +426,16 @@ type AuthDB interface {
 	// GetUserAPIKeys returns all user-owned API keys within a group.
 	GetUserAPIKeys(ctx context.Context, groupID string) ([]*tables.APIKey, error)
 
-	// CreateUserAPIKey creates a user-owned API key within the group.
-	CreateUserAPIKey(ctx context.Context, groupID, label string, capabilities []akpb.ApiKey_Capability) (*tables.APIKey, error)
+	// CreateUserAPIKey creates a user-owned API key within the group. The
+	// expiry and allowed IP ranges are interpreted as in CreateAPIKey.
+	CreateUserAPIKey(ctx context.Context, groupID, label string, capabilities []akpb.ApiKey_Capability, expiryUsec int64, allowedIPRanges []string) (*tables.APIKey, error)
 
 	// GetAPIKey returns an API key by ID. The key may be user-owned or
 	// group-owned.
 	GetAPIKey(ctx context.Context, apiKeyID string) (*tables.APIKey, error)
 
 	// UpdateAPIKey updates an API key by ID. The key may be user-owned or
-	// group-owned.
+	// group-owned. The key's expiry can't be updated.
 	UpdateAPIKey(ctx context.Context, key *tables.APIKey) error
 
 	// DeleteAPIKey deletes an API key by ID. The key may be user-owned or
@@ -415,6 +452,10 @@ type UserDB interface {
 	// a UserToken given the provided context.
 	GetUser(ctx context.Context) (*tables.User, error)
 	GetUserByID(ctx context.Context, id string) (*tables.User, error)
+	// UpdateUser updates the name and email of the given user. The user must
+	// be a member of the group and have been provisioned by it via SAML or
+	// SCIM, and the authenticated user must be an admin of the group.
+	UpdateUser(ctx context.Context, groupID string, u *tables.User) error
 	// GetImpersonatedUser will return the authenticated user's information
 	// with a single group membership corresponding to the group they are trying
 	// to impersonate. It requires that the authenticated user has impersonation
@@ -475,6 +516,7 @@ type InvocationSearchService interface {
 
 type UsageService interface {
 	GetUsage(ctx context.Context, req *usagepb.GetUsageRequest) (*usagepb.GetUsageResponse, error)
+	GetUsageReport(ctx context.Context, req *usagepb.GetUsageReportRequest) (*usagepb.GetUsageReportResponse, error)
 }
 
 type UsageTracker interface {
@@ -663,6 +705,12 @@ type WebhookData struct {
 	// request, if applicable.
 	// Ex: "acmedev123"
 	PullRequestApprover string
+
+	// ChangedFiles lists the paths of the files changed by the event, relative
+	// to the repo root, if they are known from the webhook payload. It is nil
+	// if the changed files are not known.
+	// Ex: ["docs/index.md", "server/main.go"]
+	ChangedFiles []string
 }
 
 type SplashPrinter interface {
@@ -725,6 +773,10 @@ type ExecutionNode interface {
 	// GetExecutorID returns the ID for this execution node that uniquely identifies
 	// it within a node pool.
 	GetExecutorID() string
+
+	// GetQueueLength returns the number of tasks that were queued or running
+	// on this execution node when it last registered with the scheduler.
+	GetQueueLength() int64
 }
 
 type ExecutionSearchService interface {
@@ -740,16 +792,18 @@ type ExecutionSearchService interface {
 // passed via parameters are accessible by the authenticated group in the context.
 type TaskRouter interface {
 	// RankNodes returns a slice of the given nodes sorted in decreasing order of
-	// their suitability for executing the given command. Nodes with equal
+	// their suitability for executing the given action. Nodes with equal
 	// suitability are returned in random order (for load balancing purposes).
+	// The pool is the name of the executor pool that the nodes belong to,
+	// which determines the routing strategies that are used.
 	//
 	// If an error occurs, the input nodes should be returned in random order.
-	RankNodes(ctx context.Context, cmd *repb.Command, remoteInstanceName string, nodes []ExecutionNode) []ExecutionNode
+	RankNodes(ctx context.Context, pool string, action *repb.Action, cmd *repb.Command, remoteInstanceName string, nodes []ExecutionNode) []ExecutionNode
 
-	// MarkComplete notifies the router that the command has been completed by the
+	// MarkComplete notifies the router that the action has been completed by the
 	// given executor instance. Subsequent calls to RankNodes may assign a higher
-	// rank to nodes with the given instance ID, given similar commands.
-	MarkComplete(ctx context.Context, cmd *repb.Command, remoteInstanceName, executorInstanceID string)
+	// rank to nodes with the given instance ID, given similar actions.
+	MarkComplete(ctx context.Context, action *repb.Action, cmd *repb.Command, remoteInstanceName, executorInstanceID string)
 }
 
 // TaskSizer allows storing, retrieving, and predicting task size measurements for a task.
@@ -1063,6 +1117,19 @@ type QuotaManager interface {
 	RemoveNamespace(ctx context.Context, req *qpb.RemoveNamespaceRequest) (*qpb.RemoveNamespaceResponse, error)
 	ApplyBucket(ctx context.Context, req *qpb.ApplyBucketRequest) (*qpb.ApplyBucketResponse, error)
 	ModifyNamespace(ctx context.Context, req *qpb.ModifyNamespaceRequest) (*qpb.ModifyNamespaceResponse, error)
+
+	// AllowStorage checks whether the group identified from the ctx may store
+	// sizeBytes more bytes in the cache without exceeding its storage quota.
+	// Returns a ResourceExhausted error if the quota would be exceeded.
+	AllowStorage(ctx context.Context, sizeBytes int64) error
+
+	// HasStorageQuota returns whether the group identified from the ctx has a
+	// storage quota, i.e. whether its uploads need to be checked with
+	// AllowStorage.
+	HasStorageQuota(ctx context.Context) bool
+
+	GetStorageQuota(ctx context.Context, req *qpb.GetStorageQuotaRequest) (*qpb.GetStorageQuotaResponse, error)
+	SetStorageQuota(ctx context.Context, req *qpb.SetStorageQuotaRequest) (*qpb.SetStorageQuotaResponse, error)
 }
 
 // A Metadater implements the Metadata() method and returns a StorageMetadata
@@ -1121,6 +1188,8 @@ const (
 	KMSTypeLocalInsecure KMSType = iota
 	KMSTypeGCP
 	KMSTypeAWS
+	KMSTypeVault
+	KMSTypeAzure
 )
 
 // A KMS is a Key Managment Service (typically a cloud provider or external
@@ -1166,6 +1235,18 @@ type SuggestionService interface {
 	MultipleProvidersConfigured() bool
 }
 
+// LogIndexer indexes build logs so that they can be searched.
+type LogIndexer interface {
+	// IndexLogChunk indexes a chunk of an invocation's build log after it has
+	// been written to the blobstore. Indexing happens asynchronously, so the
+	// chunk may not be searchable right away.
+	IndexLogChunk(ctx context.Context, groupID, invocationID string, chunkIndex uint16, chunk []byte)
+
+	// SearchLogs returns the invocations in the selected group whose build
+	// logs contain the query, along with the matching lines.
+	SearchLogs(ctx context.Context, req *elpb.SearchLogsRequest) (*elpb.SearchLogsResponse, error)
+}
+
 type Encryptor interface {
 	CommittedWriteCloser
 	Metadata() *rfpb.EncryptionMetadata
@@ -1200,8 +1281,23 @@ type ConfigSecretProvider interface {
 	GetSecret(ctx context.Context, name string) ([]byte, error)
 }
 
+// AuditLogPrincipal identifies who performed an audit logged action, for
+// actions that are not performed by the user or API key that is authenticated
+// in the context, such as failed logins.
+type AuditLogPrincipal struct {
+	// The group whose audit log the entry is written to. If empty, the entry
+	// is only delivered to the audit log export sinks.
+	GroupID   string
+	UserID    string
+	UserEmail string
+	APIKeyID  string
+}
+
 type AuditLogger interface {
 	Log(ctx context.Context, resource *alpb.ResourceID, action alpb.Action, request proto.Message)
+	// LogForPrincipal logs an action on behalf of the given principal rather
+	// than the one authenticated in the context. The request may be nil.
+	LogForPrincipal(ctx context.Context, principal *AuditLogPrincipal, resource *alpb.ResourceID, action alpb.Action, request proto.Message)
 	GetLogs(ctx context.Context, req *alpb.GetAuditLogsRequest) (*alpb.GetAuditLogsResponse, error)
 }
 
@@ -0,0 +1,6 @@
+package janitor
+
+// DeleteExpired runs the janitor's cleanup task once.
+func (j *Janitor) DeleteExpired() {
+	j.deleteFn(j.config)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 )
 
 var (
@@ -29,13 +30,60 @@ var (
 	executionCleanupBatchSize = flag.Int("storage.execution.cleanup_batch_size", 200, "How many invocations to delete in each janitor cleanup task")
 	executionCleanupInterval  = flag.Duration("storage.execution.cleanup_interval", 5*time.Minute, "How often the janitor cleanup tasks will run")
 	executionCleanupWorkers   = flag.Int("storage.execution.cleanup_workers", 1, "How many cleanup tasks to run")
+
+	enableRetentionPolicies = flag.Bool("storage.enable_retention_policies", false, "If true, groups can configure retention policies that override the invocation and execution TTLs for their data.")
+	maxRetentionRuleTTL     = flag.Duration("storage.retention_policy_max_ttl", 0, "The longest time that a group's retention policy can keep invocations and executions. Rules without a TTL keep data for this long. 0 allows rules to keep data forever.")
 )
 
+// InvocationTTL returns the default time to keep invocations before deletion,
+// or 0 if invocations are kept forever.
+func InvocationTTL() time.Duration {
+	return time.Duration(*invocationTTLSeconds) * time.Second
+}
+
+// MaxInvocationTTL returns the longest time that any invocation may be kept
+// before deletion, or 0 if some invocations may be kept forever.
+func MaxInvocationTTL() time.Duration {
+	if !*enableRetentionPolicies || InvocationTTL() == 0 {
+		return InvocationTTL()
+	}
+	if *maxRetentionRuleTTL == 0 {
+		// Retention rules may keep a group's invocations forever.
+		return 0
+	}
+	return max(InvocationTTL(), *maxRetentionRuleTTL)
+}
+
+// ExecutionTTL returns the default time to keep executions before deletion,
+// or 0 if executions are kept forever.
+func ExecutionTTL() time.Duration {
+	return *executionTTL
+}
+
+// RetentionPoliciesEnabled returns whether the janitors honor group
+// retention policies.
+func RetentionPoliciesEnabled() bool {
+	return *enableRetentionPolicies
+}
+
+// MaxRetentionRuleTTL returns the longest time that a retention rule can keep
+// data, or 0 if rules can keep data forever.
+func MaxRetentionRuleTTL() time.Duration {
+	return *maxRetentionRuleTTL
+}
+
+// InvocationBlobDeleter deletes all of the blobs that were written for an
+// attempt of an invocation.
+type InvocationBlobDeleter func(ctx context.Context, env environment.Env, iid string, attempt uint64) error
+
 type JanitorConfig struct {
-	env                 environment.Env
-	ttl                 time.Duration
-	batchSize           int
-	errorLoggingEnabled bool
+	env                      environment.Env
+	ttl                      time.Duration
+	batchSize                int
+	errorLoggingEnabled      bool
+	retentionPoliciesEnabled bool
+	maxRuleTTL               time.Duration
+	deleteInvocationBlobs    InvocationBlobDeleter
 }
 
 type Janitor struct {
@@ -53,7 +101,18 @@ type Janitor struct {
 
 func deleteInvocation(c *JanitorConfig, invocation *tables.Invocation) {
 	ctx := c.env.GetServerContext()
-	if err := c.env.GetBlobstore().DeleteBlob(ctx, invocation.BlobID); err != nil && c.errorLoggingEnabled {
+	// Groups that configure a retention policy expect all of an invocation's
+	// data to be gone once it expires. Finding all of the blobs means reading
+	// the invocation's build events, so this is only done when retention
+	// policies are enabled.
+	if c.retentionPoliciesEnabled {
+		for attempt := uint64(0); attempt <= invocation.Attempt; attempt++ {
+			if err := c.deleteInvocationBlobs(ctx, c.env, invocation.InvocationID, attempt); err != nil && c.errorLoggingEnabled {
+				log.Warningf("Error deleting blobs for invocation (%s) attempt %d: %s", invocation.InvocationID, attempt, err)
+			}
+		}
+	}
+	if err := c.env.GetBlobstore().DeleteBlob(ctx, invocation.BlobID); err != nil && !status.IsNotFoundError(err) && c.errorLoggingEnabled {
 		log.Warningf("Error deleting blob (%s): %s", invocation.BlobID, err)
 	}
 
@@ -63,10 +122,52 @@ func deleteInvocation(c *JanitorConfig, invocation *tables.Invocation) {
 	}
 }
 
+func lookupExpiredInvocations(ctx context.Context, c *JanitorConfig) ([]*tables.Invocation, error) {
+	policies, err := loadRetentionPolicies(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if len(policies) == 0 {
+		if c.ttl == 0 {
+			return nil, nil
+		}
+		cutoff := time.Now().Add(-1 * c.ttl)
+		return c.env.GetInvocationDB().LookupExpiredInvocations(ctx, cutoff, c.batchSize)
+	}
+
+	dbh := c.env.GetDBHandle()
+	dialect := dbh.DB(ctx).Dialector.Name()
+	expired := make([]*tables.Invocation, 0)
+	for _, q := range expiredInvocationQueries(dialect, time.Now(), c.ttl, c.maxRuleTTL, policies) {
+		if len(expired) >= c.batchSize {
+			break
+		}
+		q.SetLimit(int64(c.batchSize - len(expired)))
+		qStr, qArgs := q.Build()
+		rows, err := dbh.RawWithOptions(ctx, db.Opts().WithQueryName("lookup_expired_invocations"), qStr, qArgs...).Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			ti := &tables.Invocation{}
+			if err := dbh.DB(ctx).ScanRows(rows, ti); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			expired = append(expired, ti)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expired, nil
+}
+
 func deleteExpiredInvocations(c *JanitorConfig) {
 	ctx := c.env.GetServerContext()
-	cutoff := time.Now().Add(-1 * c.ttl)
-	expired, err := c.env.GetInvocationDB().LookupExpiredInvocations(ctx, cutoff, c.batchSize)
+	expired, err := lookupExpiredInvocations(ctx, c)
 	if err != nil && c.errorLoggingEnabled {
 		log.Warningf("Error finding expired deletions: %s", err)
 		return
@@ -77,12 +178,18 @@ func deleteExpiredInvocations(c *JanitorConfig) {
 	}
 }
 
-func NewInvocationJanitor(env environment.Env) *Janitor {
+// NewInvocationJanitor returns a janitor that deletes expired invocations.
+// If retention policies are enabled, deleteBlobs is used to delete all of the
+// blobs written for each expired invocation.
+func NewInvocationJanitor(env environment.Env, deleteBlobs InvocationBlobDeleter) *Janitor {
 	c := &JanitorConfig{
-		env:                 env,
-		ttl:                 time.Duration(*invocationTTLSeconds) * time.Second,
-		batchSize:           *invocationCleanupBatchSize,
-		errorLoggingEnabled: *logDeletionErrors,
+		env:                      env,
+		ttl:                      time.Duration(*invocationTTLSeconds) * time.Second,
+		batchSize:                *invocationCleanupBatchSize,
+		errorLoggingEnabled:      *logDeletionErrors,
+		retentionPoliciesEnabled: *enableRetentionPolicies,
+		maxRuleTTL:               *maxRetentionRuleTTL,
+		deleteInvocationBlobs:    deleteBlobs,
 	}
 	return &Janitor{
 		name:       "invocation janitor",
@@ -95,25 +202,37 @@ func NewInvocationJanitor(env environment.Env) *Janitor {
 
 func lookupExpiredExecutionIDs(ctx context.Context, c *JanitorConfig) ([]interface{}, error) {
 	dbh := c.env.GetDBHandle()
-	cutoff := time.Now().Add(-1 * c.ttl)
-
-	dbOpts := db.Opts().WithQueryName("lookup_expired_executions")
-	stmt := `SELECT execution_id FROM "Executions" WHERE created_at_usec < ? LIMIT ?`
-	rows, err := dbh.RawWithOptions(ctx, dbOpts, stmt, cutoff.UnixMicro(), c.batchSize).Rows()
+	policies, err := loadRetentionPolicies(ctx, c)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+
+	dbOpts := db.Opts().WithQueryName("lookup_expired_executions")
+	dialect := dbh.DB(ctx).Dialector.Name()
 	executionIDs := make([]interface{}, 0, c.batchSize)
-	for rows.Next() {
-		var executionID *string
-		if err := rows.Scan(&executionID); err != nil {
+	for _, q := range expiredExecutionQueries(dialect, time.Now(), c.ttl, c.maxRuleTTL, policies) {
+		if len(executionIDs) >= c.batchSize {
+			break
+		}
+		q.SetLimit(int64(c.batchSize - len(executionIDs)))
+		qStr, qArgs := q.Build()
+		rows, err := dbh.RawWithOptions(ctx, dbOpts, qStr, qArgs...).Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var executionID *string
+			if err := rows.Scan(&executionID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			executionIDs = append(executionIDs, *executionID)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
 			return nil, err
 		}
-		executionIDs = append(executionIDs, *executionID)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, err
 	}
 	return executionIDs, nil
 }
@@ -146,10 +265,12 @@ func deleteExpiredExecutions(c *JanitorConfig) {
 
 func NewExecutionJanitor(env environment.Env) *Janitor {
 	c := &JanitorConfig{
-		env:                 env,
-		ttl:                 *executionTTL,
-		batchSize:           *executionCleanupBatchSize,
-		errorLoggingEnabled: *logDeletionErrors,
+		env:                      env,
+		ttl:                      *executionTTL,
+		batchSize:                *executionCleanupBatchSize,
+		errorLoggingEnabled:      *logDeletionErrors,
+		retentionPoliciesEnabled: *enableRetentionPolicies,
+		maxRuleTTL:               *maxRetentionRuleTTL,
 	}
 	return &Janitor{
 		name:       "execution janitor",
@@ -164,7 +285,7 @@ func (j *Janitor) Start() {
 	j.ticker = time.NewTicker(j.interval)
 	j.quit = make(chan struct{})
 
-	if j.config.ttl == 0 {
+	if j.config.ttl == 0 && !j.config.retentionPoliciesEnabled {
 		log.Infof("Configured TTL was 0; disabling %s", j.name)
 		return
 	}
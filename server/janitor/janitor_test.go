@@ -0,0 +1,161 @@
+package janitor_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/janitor"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/require"
+)
+
+const day = 24 * time.Hour
+
+// fakeBlobDeleter records the invocations whose blobs were deleted.
+type fakeBlobDeleter struct {
+	mu          sync.Mutex
+	invocations []string
+}
+
+func (d *fakeBlobDeleter) delete(ctx context.Context, env environment.Env, iid string, attempt uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.invocations = append(d.invocations, iid)
+	return nil
+}
+
+// createInvocation creates an invocation that was created the given
+// duration ago.
+func createInvocation(t *testing.T, te *testenv.TestEnv, inv *tables.Invocation, age time.Duration) {
+	ctx := context.Background()
+	dbh := te.GetDBHandle()
+	dbh.SetNowFunc(func() time.Time { return time.Now().Add(-age) })
+	defer dbh.SetNowFunc(time.Now)
+	inv.BlobID = inv.InvocationID
+	require.NoError(t, dbh.DB(ctx).Create(inv).Error)
+}
+
+func createExecution(t *testing.T, te *testenv.TestEnv, ex *tables.Execution, age time.Duration) {
+	ctx := context.Background()
+	dbh := te.GetDBHandle()
+	dbh.SetNowFunc(func() time.Time { return time.Now().Add(-age) })
+	defer dbh.SetNowFunc(time.Now)
+	require.NoError(t, dbh.DB(ctx).Create(ex).Error)
+}
+
+func createRules(t *testing.T, te *testenv.TestEnv, groupID string, rules ...*tables.RetentionRule) {
+	for i, r := range rules {
+		r.RetentionRuleID = fmt.Sprintf("%s-%d", groupID, i)
+		r.GroupID = groupID
+		r.Position = int32(i)
+		require.NoError(t, te.GetDBHandle().DB(context.Background()).Create(r).Error)
+	}
+}
+
+func invocationIDs(t *testing.T, te *testenv.TestEnv) []string {
+	var ids []string
+	err := te.GetDBHandle().DB(context.Background()).Raw(`SELECT invocation_id FROM "Invocations"`).Scan(&ids).Error
+	require.NoError(t, err)
+	sort.Strings(ids)
+	return ids
+}
+
+func executionIDs(t *testing.T, te *testenv.TestEnv) []string {
+	var ids []string
+	err := te.GetDBHandle().DB(context.Background()).Raw(`SELECT execution_id FROM "Executions"`).Scan(&ids).Error
+	require.NoError(t, err)
+	sort.Strings(ids)
+	return ids
+}
+
+func TestInvocationJanitor_DefaultTTL(t *testing.T) {
+	flags.Set(t, "storage.ttl_seconds", int((30 * day).Seconds()))
+	te := testenv.GetTestEnv(t)
+	createInvocation(t, te, &tables.Invocation{InvocationID: "old", GroupID: "GR1"}, 40*day)
+	createInvocation(t, te, &tables.Invocation{InvocationID: "new", GroupID: "GR1"}, 20*day)
+
+	d := &fakeBlobDeleter{}
+	janitor.NewInvocationJanitor(te, d.delete).DeleteExpired()
+
+	require.Equal(t, []string{"new"}, invocationIDs(t, te))
+	// Without retention policies, only the invocation's own blob is deleted.
+	require.Empty(t, d.invocations)
+}
+
+func TestInvocationJanitor_RetentionPolicies(t *testing.T) {
+	flags.Set(t, "storage.ttl_seconds", int((30 * day).Seconds()))
+	flags.Set(t, "storage.enable_retention_policies", true)
+	flags.Set(t, "storage.retention_policy_max_ttl", 365*day)
+	te := testenv.GetTestEnv(t)
+	createRules(t, te, "GR1",
+		// Keep CI invocations on main for as long as possible.
+		&tables.RetentionRule{Role: "CI", BranchPattern: "main"},
+		&tables.RetentionRule{Role: "CI", TTLUsec: (7 * day).Microseconds()},
+	)
+	for _, tc := range []struct {
+		inv *tables.Invocation
+		age time.Duration
+	}{
+		{&tables.Invocation{InvocationID: "gr1-main-kept", GroupID: "GR1", Role: "CI", BranchName: "main"}, 100 * day},
+		{&tables.Invocation{InvocationID: "gr1-main-expired", GroupID: "GR1", Role: "CI", BranchName: "main"}, 400 * day},
+		{&tables.Invocation{InvocationID: "gr1-pr-kept", GroupID: "GR1", Role: "CI", BranchName: "pr"}, 3 * day},
+		{&tables.Invocation{InvocationID: "gr1-pr-expired", GroupID: "GR1", Role: "CI", BranchName: "pr", Attempt: 1}, 10 * day},
+		{&tables.Invocation{InvocationID: "gr1-local-kept", GroupID: "GR1"}, 20 * day},
+		{&tables.Invocation{InvocationID: "gr1-local-expired", GroupID: "GR1"}, 40 * day},
+		{&tables.Invocation{InvocationID: "gr2-kept", GroupID: "GR2", Role: "CI", BranchName: "main"}, 20 * day},
+		{&tables.Invocation{InvocationID: "gr2-expired", GroupID: "GR2", Role: "CI", BranchName: "main"}, 40 * day},
+	} {
+		createInvocation(t, te, tc.inv, tc.age)
+	}
+
+	d := &fakeBlobDeleter{}
+	janitor.NewInvocationJanitor(te, d.delete).DeleteExpired()
+
+	require.Equal(t, []string{"gr1-local-kept", "gr1-main-kept", "gr1-pr-kept", "gr2-kept"}, invocationIDs(t, te))
+	// All of the blobs of each attempt of the expired invocations are
+	// deleted.
+	sort.Strings(d.invocations)
+	require.Equal(t, []string{"gr1-local-expired", "gr1-main-expired", "gr1-pr-expired", "gr1-pr-expired", "gr2-expired"}, d.invocations)
+}
+
+func TestExecutionJanitor_RetentionPolicies(t *testing.T) {
+	flags.Set(t, "storage.execution.ttl", 30*day)
+	flags.Set(t, "storage.enable_retention_policies", true)
+	te := testenv.GetTestEnv(t)
+	createRules(t, te, "GR1",
+		&tables.RetentionRule{Role: "CI", BranchPattern: "main"},
+		&tables.RetentionRule{Role: "CI", TTLUsec: (7 * day).Microseconds()},
+	)
+	createInvocation(t, te, &tables.Invocation{InvocationID: "main", GroupID: "GR1", Role: "CI", BranchName: "main"}, 100*day)
+	createInvocation(t, te, &tables.Invocation{InvocationID: "pr", GroupID: "GR1", Role: "CI", BranchName: "pr"}, 10*day)
+	createInvocation(t, te, &tables.Invocation{InvocationID: "local", GroupID: "GR1"}, 40*day)
+	createExecution(t, te, &tables.Execution{ExecutionID: "main-exec", GroupID: "GR1", InvocationID: "main"}, 100*day)
+	createExecution(t, te, &tables.Execution{ExecutionID: "pr-exec", GroupID: "GR1", InvocationID: "pr"}, 10*day)
+	createExecution(t, te, &tables.Execution{ExecutionID: "local-exec-kept", GroupID: "GR1", InvocationID: "local"}, 20*day)
+	createExecution(t, te, &tables.Execution{ExecutionID: "local-exec-expired", GroupID: "GR1", InvocationID: "local"}, 40*day)
+	createExecution(t, te, &tables.Execution{ExecutionID: "gr2-exec-expired", GroupID: "GR2"}, 40*day)
+
+	janitor.NewExecutionJanitor(te).DeleteExpired()
+
+	require.Equal(t, []string{"local-exec-kept", "main-exec"}, executionIDs(t, te))
+}
+
+func TestMaxInvocationTTL(t *testing.T) {
+	flags.Set(t, "storage.ttl_seconds", int((30 * day).Seconds()))
+	require.Equal(t, 30*day, janitor.MaxInvocationTTL())
+
+	// Retention rules may keep invocations forever unless there's a max TTL.
+	flags.Set(t, "storage.enable_retention_policies", true)
+	require.Equal(t, time.Duration(0), janitor.MaxInvocationTTL())
+	flags.Set(t, "storage.retention_policy_max_ttl", 365*day)
+	require.Equal(t, 365*day, janitor.MaxInvocationTTL())
+	flags.Set(t, "storage.retention_policy_max_ttl", 7*day)
+	require.Equal(t, 30*day, janitor.MaxInvocationTTL())
+}
@@ -0,0 +1,244 @@
+package janitor
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+
+	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
+	rtpb "github.com/buildbuddy-io/buildbuddy/proto/retention"
+)
+
+const (
+	mysqlDialect  = "mysql"
+	sqliteDialect = "sqlite"
+)
+
+// retentionPolicy is the ordered list of retention rules configured for a
+// group. An invocation is governed by the first rule that matches it; group
+// invocations that match no rule use the default TTL.
+type retentionPolicy struct {
+	groupID string
+	rules   []*tables.RetentionRule
+}
+
+// loadRetentionPolicies returns the retention policies of all groups that
+// have configured one, or nil if retention policies are disabled.
+func loadRetentionPolicies(ctx context.Context, c *JanitorConfig) ([]*retentionPolicy, error) {
+	if !c.retentionPoliciesEnabled {
+		return nil, nil
+	}
+	dbh := c.env.GetDBHandle()
+	rows, err := dbh.RawWithOptions(ctx, db.Opts().WithQueryName("janitor_load_retention_rules"), `
+		SELECT * FROM "RetentionRules" ORDER BY group_id, position`).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies []*retentionPolicy
+	for rows.Next() {
+		rule := &tables.RetentionRule{}
+		if err := dbh.DB(ctx).ScanRows(rows, rule); err != nil {
+			return nil, err
+		}
+		if len(policies) == 0 || policies[len(policies)-1].groupID != rule.GroupID {
+			policies = append(policies, &retentionPolicy{groupID: rule.GroupID})
+		}
+		p := policies[len(policies)-1]
+		p.rules = append(p.rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func policyGroupIDs(policies []*retentionPolicy) []string {
+	groupIDs := make([]string, 0, len(policies))
+	for _, p := range policies {
+		groupIDs = append(groupIDs, p.groupID)
+	}
+	return groupIDs
+}
+
+// escapeLike escapes the LIKE wildcard characters in s.
+func escapeLike(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "%", `\%`)
+	return strings.ReplaceAll(s, "_", `\_`)
+}
+
+// likeClause returns a LIKE clause that uses backslash as the escape
+// character. MySQL and Postgres do this by default, but SQLite needs it to
+// be specified explicitly.
+func likeClause(dialect, expr string) string {
+	if dialect == sqliteDialect {
+		return expr + ` LIKE ? ESCAPE '\'`
+	}
+	return expr + " LIKE ?"
+}
+
+// ruleMatchClause returns a SQL condition that is true for the invocations
+// (in the table aliased as "i") that the rule applies to.
+func ruleMatchClause(dialect string, rule *tables.RetentionRule) (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+	if rule.Role != "" {
+		clauses = append(clauses, "i.role = ?")
+		args = append(args, rule.Role)
+	}
+	if rule.BranchPattern != "" {
+		if strings.Contains(rule.BranchPattern, "*") {
+			parts := strings.Split(rule.BranchPattern, "*")
+			for i, part := range parts {
+				parts[i] = escapeLike(part)
+			}
+			clauses = append(clauses, likeClause(dialect, "COALESCE(i.branch_name, '')"))
+			args = append(args, strings.Join(parts, "%"))
+		} else {
+			clauses = append(clauses, "i.branch_name = ?")
+			args = append(args, rule.BranchPattern)
+		}
+	}
+	if rule.Tag != "" {
+		// Tags are stored as a comma-separated list.
+		if dialect == mysqlDialect {
+			clauses = append(clauses, "FIND_IN_SET(?, COALESCE(i.tags, '')) > 0")
+			args = append(args, rule.Tag)
+		} else {
+			clauses = append(clauses, likeClause(dialect, "(',' || COALESCE(i.tags, '') || ',')"))
+			args = append(args, "%,"+escapeLike(rule.Tag)+",%")
+		}
+	}
+	switch rtpb.RetentionRule_Status(rule.Status) {
+	case rtpb.RetentionRule_SUCCESS:
+		clauses = append(clauses, "i.invocation_status = ? AND i.success = ?")
+		args = append(args, int64(inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS), true)
+	case rtpb.RetentionRule_FAILURE:
+		clauses = append(clauses, "i.invocation_status != ? AND i.success = ?")
+		args = append(args, int64(inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS), false)
+	}
+	if len(clauses) == 0 {
+		return "1 = 1", nil
+	}
+	return "(" + strings.Join(clauses, " AND ") + ")", args
+}
+
+// anyRuleMatchClause returns a SQL condition that is true for the
+// invocations that any of the rules apply to.
+func anyRuleMatchClause(dialect string, rules []*tables.RetentionRule) (string, []interface{}) {
+	o := &query_builder.OrClauses{}
+	for _, rule := range rules {
+		clause, args := ruleMatchClause(dialect, rule)
+		o.AddOr(clause, args...)
+	}
+	clause, args := o.Build()
+	return "(" + clause + ")", args
+}
+
+// ruleTTLUsec returns how long the rule keeps data, capped at maxRuleTTL, or
+// 0 if the rule keeps data forever.
+func ruleTTLUsec(rule *tables.RetentionRule, maxRuleTTL time.Duration) int64 {
+	if maxRuleTTL != 0 && (rule.TTLUsec == 0 || rule.TTLUsec > maxRuleTTL.Microseconds()) {
+		return maxRuleTTL.Microseconds()
+	}
+	return rule.TTLUsec
+}
+
+// expiredInvocationQueries returns the queries that find the invocations
+// that have outlived their retention period. The first query covers the
+// groups without a retention policy and is only returned if ttl is non-zero.
+// Rule TTLs are capped at maxRuleTTL if it's non-zero.
+func expiredInvocationQueries(dialect string, now time.Time, ttl, maxRuleTTL time.Duration, policies []*retentionPolicy) []*query_builder.Query {
+	var queries []*query_builder.Query
+	newQuery := func(groupID string) *query_builder.Query {
+		q := query_builder.NewQuery(`SELECT * FROM "Invocations" AS i`)
+		q.AddWhereClause("i.group_id = ?", groupID)
+		return q
+	}
+	if ttl != 0 {
+		q := query_builder.NewQuery(`SELECT * FROM "Invocations" AS i`)
+		q.AddWhereClause("i.created_at_usec < ?", now.Add(-ttl).UnixMicro())
+		if len(policies) > 0 {
+			q.AddWhereClause("(i.group_id IS NULL OR i.group_id NOT IN ?)", policyGroupIDs(policies))
+		}
+		queries = append(queries, q)
+	}
+	for _, p := range policies {
+		for k, rule := range p.rules {
+			ttlUsec := ruleTTLUsec(rule, maxRuleTTL)
+			if ttlUsec == 0 {
+				continue
+			}
+			q := newQuery(p.groupID)
+			q.AddWhereClause("i.created_at_usec < ?", now.UnixMicro()-ttlUsec)
+			clause, args := ruleMatchClause(dialect, rule)
+			q.AddWhereClause(clause, args...)
+			if k > 0 {
+				clause, args := anyRuleMatchClause(dialect, p.rules[:k])
+				q.AddWhereClause("NOT "+clause, args...)
+			}
+			queries = append(queries, q)
+		}
+		if ttl != 0 {
+			q := newQuery(p.groupID)
+			q.AddWhereClause("i.created_at_usec < ?", now.Add(-ttl).UnixMicro())
+			clause, args := anyRuleMatchClause(dialect, p.rules)
+			q.AddWhereClause("NOT "+clause, args...)
+			queries = append(queries, q)
+		}
+	}
+	return queries
+}
+
+// expiredExecutionQueries returns the queries that find the executions that
+// have outlived their retention period. Executions of an invocation that is
+// governed by a retention rule are kept for as long as the rule keeps the
+// invocation; other executions use the default TTL, which is only applied if
+// it's non-zero. Rule TTLs are capped at maxRuleTTL if it's non-zero.
+func expiredExecutionQueries(dialect string, now time.Time, ttl, maxRuleTTL time.Duration, policies []*retentionPolicy) []*query_builder.Query {
+	var queries []*query_builder.Query
+	newQuery := func(cutoffUsec int64) *query_builder.Query {
+		q := query_builder.NewQuery(`SELECT execution_id FROM "Executions" AS e`)
+		q.AddWhereClause("e.created_at_usec < ?", cutoffUsec)
+		return q
+	}
+	if ttl != 0 {
+		q := newQuery(now.Add(-ttl).UnixMicro())
+		if len(policies) > 0 {
+			q.AddWhereClause("(e.group_id IS NULL OR e.group_id NOT IN ?)", policyGroupIDs(policies))
+		}
+		queries = append(queries, q)
+	}
+	for _, p := range policies {
+		for k, rule := range p.rules {
+			ttlUsec := ruleTTLUsec(rule, maxRuleTTL)
+			if ttlUsec == 0 {
+				continue
+			}
+			q := newQuery(now.UnixMicro() - ttlUsec)
+			q.AddWhereClause("e.group_id = ?", p.groupID)
+			clause, args := ruleMatchClause(dialect, rule)
+			if k > 0 {
+				prevClause, prevArgs := anyRuleMatchClause(dialect, p.rules[:k])
+				clause += " AND NOT " + prevClause
+				args = append(args, prevArgs...)
+			}
+			q.AddWhereClause(`EXISTS (SELECT 1 FROM "Invocations" AS i WHERE i.invocation_id = e.invocation_id AND `+clause+`)`, args...)
+			queries = append(queries, q)
+		}
+		if ttl != 0 {
+			q := newQuery(now.Add(-ttl).UnixMicro())
+			q.AddWhereClause("e.group_id = ?", p.groupID)
+			clause, args := anyRuleMatchClause(dialect, p.rules)
+			q.AddWhereClause(`NOT EXISTS (SELECT 1 FROM "Invocations" AS i WHERE i.invocation_id = e.invocation_id AND `+clause+`)`, args...)
+			queries = append(queries, q)
+		}
+	}
+	return queries
+}
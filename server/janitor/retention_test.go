@@ -0,0 +1,131 @@
+package janitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/stretchr/testify/assert"
+
+	rtpb "github.com/buildbuddy-io/buildbuddy/proto/retention"
+)
+
+func TestRuleMatchClause(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		dialect    string
+		rule       *tables.RetentionRule
+		wantClause string
+		wantArgs   []interface{}
+	}{
+		{
+			name:       "empty rule",
+			dialect:    mysqlDialect,
+			rule:       &tables.RetentionRule{},
+			wantClause: "1 = 1",
+		},
+		{
+			name:       "exact branch",
+			dialect:    mysqlDialect,
+			rule:       &tables.RetentionRule{Role: "CI", BranchPattern: "main"},
+			wantClause: "(i.role = ? AND i.branch_name = ?)",
+			wantArgs:   []interface{}{"CI", "main"},
+		},
+		{
+			name:       "branch pattern",
+			dialect:    sqliteDialect,
+			rule:       &tables.RetentionRule{BranchPattern: "release_*"},
+			wantClause: `(COALESCE(i.branch_name, '') LIKE ? ESCAPE '\')`,
+			wantArgs:   []interface{}{`release\_%`},
+		},
+		{
+			name:       "tag mysql",
+			dialect:    mysqlDialect,
+			rule:       &tables.RetentionRule{Tag: "nightly"},
+			wantClause: "(FIND_IN_SET(?, COALESCE(i.tags, '')) > 0)",
+			wantArgs:   []interface{}{"nightly"},
+		},
+		{
+			name:       "tag postgres",
+			dialect:    "postgres",
+			rule:       &tables.RetentionRule{Tag: "100%"},
+			wantClause: "((',' || COALESCE(i.tags, '') || ',') LIKE ?)",
+			wantArgs:   []interface{}{`%,100\%,%`},
+		},
+		{
+			name:       "failure status",
+			dialect:    mysqlDialect,
+			rule:       &tables.RetentionRule{Status: int32(rtpb.RetentionRule_FAILURE)},
+			wantClause: "(i.invocation_status != ? AND i.success = ?)",
+			wantArgs:   []interface{}{int64(2), false},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clause, args := ruleMatchClause(tc.dialect, tc.rule)
+			assert.Equal(t, tc.wantClause, clause)
+			assert.Equal(t, tc.wantArgs, args)
+		})
+	}
+}
+
+func TestExpiredInvocationQueries(t *testing.T) {
+	policies := []*retentionPolicy{{
+		groupID: "GR1",
+		rules: []*tables.RetentionRule{
+			{Role: "CI", BranchPattern: "main"},
+			{Role: "CI", TTLUsec: 10},
+		},
+	}}
+
+	// Without a default TTL, only the rules with a TTL expire invocations.
+	queries := expiredInvocationQueries(mysqlDialect, time.UnixMicro(100), 0, 0, policies)
+	assert.Len(t, queries, 1)
+	_, args := queries[0].Build()
+	assert.Equal(t, []interface{}{"GR1", int64(90), "CI", "CI", "main"}, args)
+
+	// With a default TTL, groups without a policy and group invocations
+	// that don't match any rule are expired too.
+	queries = expiredInvocationQueries(mysqlDialect, time.UnixMicro(100), 50*time.Microsecond, 0, policies)
+	assert.Len(t, queries, 3)
+	_, args = queries[0].Build()
+	assert.Equal(t, []interface{}{int64(50), []string{"GR1"}}, args)
+	_, args = queries[2].Build()
+	assert.Equal(t, []interface{}{"GR1", int64(50), "CI", "main", "CI"}, args)
+
+	// With a max TTL, rules can't keep invocations for longer than it.
+	queries = expiredInvocationQueries(mysqlDialect, time.UnixMicro(100), 0, 5*time.Microsecond, policies)
+	assert.Len(t, queries, 2)
+	_, args = queries[0].Build()
+	assert.Equal(t, []interface{}{"GR1", int64(95), "CI", "main"}, args)
+	_, args = queries[1].Build()
+	assert.Equal(t, []interface{}{"GR1", int64(95), "CI", "CI", "main"}, args)
+}
+
+func TestExpiredExecutionQueries(t *testing.T) {
+	policies := []*retentionPolicy{{
+		groupID: "GR1",
+		rules: []*tables.RetentionRule{
+			{Role: "CI", BranchPattern: "main"},
+			{Role: "CI", TTLUsec: 10},
+		},
+	}}
+
+	// Without a default TTL, only executions of invocations governed by a
+	// rule with a TTL expire.
+	queries := expiredExecutionQueries(mysqlDialect, time.UnixMicro(100), 0, 0, policies)
+	assert.Len(t, queries, 1)
+	qStr, args := queries[0].Build()
+	assert.Contains(t, qStr, `EXISTS (SELECT 1 FROM "Invocations" AS i WHERE i.invocation_id = e.invocation_id AND (i.role = ?) AND NOT (`)
+	assert.Equal(t, []interface{}{int64(90), "GR1", "CI", "CI", "main"}, args)
+
+	// Rule TTLs apply even if they're shorter than the default TTL.
+	queries = expiredExecutionQueries(mysqlDialect, time.UnixMicro(100), 50*time.Microsecond, 0, policies)
+	assert.Len(t, queries, 3)
+	_, args = queries[0].Build()
+	assert.Equal(t, []interface{}{int64(50), []string{"GR1"}}, args)
+	_, args = queries[1].Build()
+	assert.Equal(t, []interface{}{int64(90), "GR1", "CI", "CI", "main"}, args)
+	qStr, args = queries[2].Build()
+	assert.Contains(t, qStr, "NOT EXISTS")
+	assert.Equal(t, []interface{}{int64(50), "GR1", "CI", "main", "CI"}, args)
+}
@@ -360,7 +360,8 @@ func StartAndRunServices(env environment.Env) {
 
 	if auth := env.GetAuthenticator(); auth != nil {
 		mux.Handle("/login/", interceptors.SetSecurityHeaders(interceptors.RedirectOnError(auth.Login)))
-		mux.Handle("/auth/", interceptors.SetSecurityHeaders(interceptors.RedirectOnError(auth.Auth)))
+		// Logins are audit logged with the client IP and user agent.
+		mux.Handle("/auth/", interceptors.SetSecurityHeaders(interceptors.ClientIP(interceptors.UserAgent(interceptors.RedirectOnError(auth.Auth)))))
 		mux.Handle("/logout/", interceptors.SetSecurityHeaders(interceptors.RedirectOnError(auth.Logout)))
 	}
 
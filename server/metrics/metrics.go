@@ -208,6 +208,17 @@ const (
 
 	// Name of a file.
 	FileName = "file_name"
+
+	// Priority class of a remote execution task: `interactive`, `ci`, or
+	// `batch`.
+	PriorityClassLabel = "priority_class"
+
+	// Priority class of the remote execution task that caused another task to
+	// be preempted: `interactive`, `ci`, or `batch`.
+	PreemptingPriorityClassLabel = "preempting_priority_class"
+
+	// Audit log export sink: `syslog`, `webhook`, or `blobstore`.
+	AuditLogSinkLabel = "sink"
 )
 
 // Other constants
@@ -813,6 +824,16 @@ var (
 	// count(buildbuddy_remote_execution_tasks_executing)
 	// ```
 
+	RemoteExecutionPreemptedTaskCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "preempted_task_count",
+		Help:      "Number of running tasks that were stopped and re-enqueued to make room for a task of a higher priority class.",
+	}, []string{
+		PriorityClassLabel,
+		PreemptingPriorityClassLabel,
+	})
+
 	RemoteExecutionAssignedRAMBytes = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
@@ -993,6 +1014,13 @@ var (
 		FileName,
 	})
 
+	RemoteSnapshotUploadFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "firecracker",
+		Name:      "remote_snapshot_upload_failures",
+		Help:      "Number of snapshots that were cached locally but could not be uploaded to the remote cache.",
+	})
+
 	RecycleRunnerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
@@ -1636,6 +1664,89 @@ var (
 		CacheBackendLabel,
 	})
 
+	// #### Distributed cache rebalancing metrics
+	//
+	// When nodes join or leave a distributed cache cluster, each node copies
+	// the keys that it stores to the nodes that now own them.
+
+	DistributedCacheRebalanceInProgress = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "cache",
+		Name:      "distributed_rebalance_in_progress",
+		Help:      "Whether a distributed cache rebalance is currently in progress on this node (1) or not (0).",
+	})
+
+	DistributedCacheRebalanceScannedKeys = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "cache",
+		Name:      "distributed_rebalance_scanned_keys",
+		Help:      "Number of local keys scanned by distributed cache rebalances.",
+	})
+
+	DistributedCacheRebalanceCopiedKeys = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "cache",
+		Name:      "distributed_rebalance_copied_keys",
+		Help:      "Number of keys copied to their new owners by distributed cache rebalances.",
+	})
+
+	DistributedCacheRebalanceCopiedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "cache",
+		Name:      "distributed_rebalance_copied_bytes",
+		Help:      "Number of stored bytes copied to their new owners by distributed cache rebalances.",
+	})
+
+	DistributedCacheRebalanceCopyErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "cache",
+		Name:      "distributed_rebalance_copy_errors",
+		Help:      "Number of keys that distributed cache rebalances failed to copy to their new owners.",
+	})
+
+	// #### Examples
+	//
+	// ```promql
+	// # Rate of bytes copied by rebalancing, summed across all nodes
+	// sum(rate(buildbuddy_cache_distributed_rebalance_copied_bytes[5m]))
+	// ```
+
+	// ### Audit log export
+
+	AuditLogExportedEntries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "audit_log",
+		Name:      "exported_entries",
+		Help:      "Number of audit log entries delivered to an export sink.",
+	}, []string{
+		AuditLogSinkLabel,
+	})
+
+	AuditLogExportErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "audit_log",
+		Name:      "export_errors",
+		Help:      "Number of failed attempts to deliver a batch of audit log entries to an export sink. Failed batches are retried.",
+	}, []string{
+		AuditLogSinkLabel,
+	})
+
+	AuditLogExportLagUsec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "audit_log",
+		Name:      "export_lag_usec",
+		Help:      "Age of the oldest audit log entry that has not been delivered to an export sink yet, in **microseconds**, or zero if all entries have been delivered. Only reported by the app that is delivering entries to the sink.",
+	}, []string{
+		AuditLogSinkLabel,
+	})
+
+	// #### Examples
+	//
+	// ```promql
+	// # How far behind each sink is, in seconds
+	// max by (sink) (buildbuddy_audit_log_export_lag_usec) / 1e6
+	// ```
+
 	// ### Misc metrics
 
 	Version = promauto.NewGaugeVec(prometheus.GaugeOpts{
@@ -104,6 +104,7 @@ type RealEnv struct {
 	secretService                    interfaces.SecretService
 	executionCollector               interfaces.ExecutionCollector
 	suggestionService                interfaces.SuggestionService
+	logIndexer                       interfaces.LogIndexer
 	crypterService                   interfaces.Crypter
 	sociArtifactStoreServer          socipb.SociArtifactStoreServer
 	sociArtifactStoreClient          socipb.SociArtifactStoreClient
@@ -592,6 +593,13 @@ func (r *RealEnv) SetSuggestionService(s interfaces.SuggestionService) {
 	r.suggestionService = s
 }
 
+func (r *RealEnv) GetLogIndexer() interfaces.LogIndexer {
+	return r.logIndexer
+}
+func (r *RealEnv) SetLogIndexer(li interfaces.LogIndexer) {
+	r.logIndexer = li
+}
+
 func (r *RealEnv) GetCrypter() interfaces.Crypter {
 	return r.crypterService
 }
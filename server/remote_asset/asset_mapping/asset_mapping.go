@@ -0,0 +1,122 @@
+// Package asset_mapping stores and looks up associations between remote
+// assets (a URI plus qualifiers) and content that is already in the CAS.
+//
+// Mappings are written by the remote asset Push API and are read by the Fetch
+// API, so that a fetch for a pushed URI can be served entirely from the cache
+// without making any outbound requests.
+package asset_mapping
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/protobuf/proto"
+
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
+	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+	tspb "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// AssetType distinguishes blob mappings from directory mappings, so that a
+// pushed directory is never returned from FetchBlob and vice versa.
+type AssetType string
+
+const (
+	Blob      AssetType = "blob"
+	Directory AssetType = "directory"
+
+	// Bump this to invalidate all existing mappings.
+	keyVersion = "v1"
+)
+
+// key returns the AC digest under which the mapping for the given asset is
+// stored. Qualifiers are sorted so that the key does not depend on the order
+// in which the client sent them.
+func key(assetType AssetType, uri string, qualifiers []*rapb.Qualifier) (*repb.Digest, error) {
+	sorted := make([]*rapb.Qualifier, len(qualifiers))
+	copy(sorted, qualifiers)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].GetName() != sorted[j].GetName() {
+			return sorted[i].GetName() < sorted[j].GetName()
+		}
+		return sorted[i].GetValue() < sorted[j].GetValue()
+	})
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("remote_asset_mapping/" + keyVersion + "/" + string(assetType))
+	buf.WriteByte(0)
+	buf.WriteString(uri)
+	for _, q := range sorted {
+		buf.WriteByte(0)
+		buf.WriteString(q.GetName())
+		buf.WriteByte('=')
+		buf.WriteString(q.GetValue())
+	}
+	return digest.Compute(buf, repb.DigestFunction_SHA256)
+}
+
+func resourceName(instanceName string, assetType AssetType, uri string, qualifiers []*rapb.Qualifier) (*rspb.ResourceName, error) {
+	d, err := key(assetType, uri, qualifiers)
+	if err != nil {
+		return nil, err
+	}
+	return digest.NewResourceName(d, instanceName, rspb.CacheType_AC, repb.DigestFunction_SHA256).ToProto(), nil
+}
+
+// Store writes a mapping from each of the given URIs (combined with the given
+// qualifiers) to the given mapping contents. The URI field of the mapping is
+// filled in per-URI.
+func Store(ctx context.Context, cache interfaces.Cache, instanceName string, assetType AssetType, uris []string, qualifiers []*rapb.Qualifier, mapping *capb.RemoteAssetMapping) error {
+	for _, uri := range uris {
+		m := proto.Clone(mapping).(*capb.RemoteAssetMapping)
+		m.Uri = uri
+		buf, err := proto.Marshal(m)
+		if err != nil {
+			return err
+		}
+		rn, err := resourceName(instanceName, assetType, uri, qualifiers)
+		if err != nil {
+			return err
+		}
+		if err := cache.Set(ctx, rn, buf); err != nil {
+			return status.WrapErrorf(err, "store mapping for %q", uri)
+		}
+	}
+	return nil
+}
+
+// Lookup returns the mapping stored for the given URI and qualifiers.
+//
+// A NotFound error is returned if there is no mapping, if the mapping has
+// expired, or if the mapping was created before oldestContentAccepted.
+func Lookup(ctx context.Context, cache interfaces.Cache, instanceName string, assetType AssetType, uri string, qualifiers []*rapb.Qualifier, oldestContentAccepted *tspb.Timestamp) (*capb.RemoteAssetMapping, error) {
+	rn, err := resourceName(instanceName, assetType, uri, qualifiers)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := cache.Get(ctx, rn)
+	if err != nil {
+		if status.IsNotFoundError(err) {
+			return nil, status.NotFoundErrorf("no %s mapping for %q", assetType, uri)
+		}
+		return nil, err
+	}
+	m := &capb.RemoteAssetMapping{}
+	if err := proto.Unmarshal(buf, m); err != nil {
+		return nil, status.InternalErrorf("unmarshal mapping for %q: %s", uri, err)
+	}
+	if m.GetExpireAt() != nil && !m.GetExpireAt().AsTime().After(time.Now()) {
+		return nil, status.NotFoundErrorf("%s mapping for %q expired at %s", assetType, uri, m.GetExpireAt().AsTime())
+	}
+	if oldestContentAccepted != nil && m.GetCreatedAt().AsTime().Before(oldestContentAccepted.AsTime()) {
+		return nil, status.NotFoundErrorf("%s mapping for %q is older than the oldest accepted content", assetType, uri)
+	}
+	return m, nil
+}
@@ -0,0 +1,495 @@
+package fetch_server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"flag"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	maxExtractedSizeBytes = flag.Int64("remote_asset.max_extracted_size_bytes", 10_000_000_000 /* 10 GB */, "The max total size of the files extracted from an archive by FetchDirectory.")
+)
+
+const (
+	// The max length of a zip symlink target. Tar symlink targets are already
+	// limited by the tar format.
+	maxSymlinkTargetLength = 4096
+)
+
+var commitSHARegexp = regexp.MustCompile("^[0-9a-fA-F]{7,64}$")
+
+type archiveFormat string
+
+const (
+	formatTar    archiveFormat = "tar"
+	formatTarGz  archiveFormat = "tar.gz"
+	formatTarZst archiveFormat = "tar.zst"
+	formatZip    archiveFormat = "zip"
+	formatGit    archiveFormat = "git"
+)
+
+// resourceTypeFormats maps values of the "resource_type" qualifier to the
+// archive format that should be used to unpack the fetched resource.
+var resourceTypeFormats = map[string]archiveFormat{
+	"application/x-tar":            formatTar,
+	"application/gzip":             formatTarGz,
+	"application/x-gzip":           formatTarGz,
+	"application/x-compressed-tar": formatTarGz,
+	"application/zstd":             formatTarZst,
+	"application/x-zstd":           formatTarZst,
+	"application/zip":              formatZip,
+	"application/x-git":            formatGit,
+}
+
+// detectArchiveFormat returns the archive format to use for the given URI,
+// preferring the explicit resource_type qualifier (if any) over the URI's file
+// extension.
+func detectArchiveFormat(uri, resourceType, commit string) (archiveFormat, error) {
+	if resourceType != "" {
+		f, ok := resourceTypeFormats[resourceType]
+		if !ok {
+			return "", status.InvalidArgumentErrorf("unsupported resource_type %q", resourceType)
+		}
+		return f, nil
+	}
+	if commit != "" {
+		return formatGit, nil
+	}
+	path := strings.ToLower(uri)
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	switch {
+	case strings.HasSuffix(path, ".tar"):
+		return formatTar, nil
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return formatTarGz, nil
+	case strings.HasSuffix(path, ".tar.zst"), strings.HasSuffix(path, ".tzst"):
+		return formatTarZst, nil
+	case strings.HasSuffix(path, ".zip"), strings.HasSuffix(path, ".jar"):
+		return formatZip, nil
+	case strings.HasSuffix(path, ".git"):
+		return formatGit, nil
+	}
+	return "", status.InvalidArgumentErrorf("could not determine archive type of %q; set the resource_type qualifier", uri)
+}
+
+// extractArchive extracts the archive at archivePath into destDir.
+func extractArchive(format archiveFormat, archivePath, destDir string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	e := &extractor{destDir: destDir, remainingBytes: *maxExtractedSizeBytes}
+	if err := e.extract(format, f); err != nil {
+		return err
+	}
+	// Symlinks are checked once everything is extracted, since a symlink
+	// that is safe when it is created can be redirected by a symlink that
+	// is created later.
+	return checkSymlinks(destDir)
+}
+
+// isInside returns whether the clean path p is destDir or is inside of it.
+func isInside(destDir, p string) bool {
+	return p == destDir || strings.HasPrefix(p, destDir+string(filepath.Separator))
+}
+
+// safeJoin joins name onto destDir, returning an error if the result would
+// escape destDir (e.g. via ".." components).
+func safeJoin(destDir, name string) (string, error) {
+	p := filepath.Join(destDir, name)
+	if !isInside(destDir, p) {
+		return "", status.InvalidArgumentErrorf("archive entry %q is outside of the extraction directory", name)
+	}
+	return p, nil
+}
+
+// checkNoSymlinks returns an error if any existing component of path below
+// destDir is a symlink, so that nothing is ever written through (or read
+// through) a symlink that an archive created.
+func checkNoSymlinks(destDir, path string) error {
+	rel, err := filepath.Rel(destDir, path)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	p := destDir
+	for _, c := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, c)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return status.InvalidArgumentErrorf("path %q goes through a symlink", rel)
+		}
+	}
+	return nil
+}
+
+// checkSymlinkTarget returns an error if the symlink at path would obviously
+// point outside of destDir. checkSymlinks performs the full check once the
+// archive is extracted.
+func checkSymlinkTarget(destDir, path, target string) error {
+	rel, err := filepath.Rel(destDir, path)
+	if err != nil {
+		return err
+	}
+	if filepath.IsAbs(target) {
+		return status.InvalidArgumentErrorf("symlink %q has absolute target %q", rel, target)
+	}
+	if !isInside(destDir, filepath.Join(filepath.Dir(path), target)) {
+		return status.InvalidArgumentErrorf("symlink %q points outside of the extraction directory", rel)
+	}
+	return nil
+}
+
+// checkSymlinks returns an error if any symlink under destDir resolves to a
+// path outside of destDir.
+func checkSymlinks(destDir string) error {
+	return filepath.WalkDir(destDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(destDir, path)
+		if err != nil {
+			return err
+		}
+		if !resolvesInside(destDir, rel) {
+			return status.InvalidArgumentErrorf("symlink %q points outside of the extraction directory", rel)
+		}
+		return nil
+	})
+}
+
+// resolvesInside returns whether the path rel, relative to root, resolves to
+// a path inside of root when following any symlinks along the way.
+func resolvesInside(root, rel string) bool {
+	// The max number of symlinks to follow, matching Linux's limit.
+	const maxSymlinks = 40
+	var cur []string
+	pending := splitPath(rel)
+	followed := 0
+	for len(pending) > 0 {
+		c := pending[0]
+		pending = pending[1:]
+		if c == "." {
+			continue
+		}
+		if c == ".." {
+			if len(cur) == 0 {
+				return false
+			}
+			cur = cur[:len(cur)-1]
+			continue
+		}
+		next := append(cur[:len(cur):len(cur)], c)
+		info, err := os.Lstat(filepath.Join(root, filepath.Join(next...)))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+		followed++
+		if followed > maxSymlinks {
+			return false
+		}
+		target, err := os.Readlink(filepath.Join(root, filepath.Join(next...)))
+		if err != nil || filepath.IsAbs(target) {
+			return false
+		}
+		// The target is relative to the directory containing the symlink.
+		pending = append(splitPath(target), pending...)
+	}
+	return true
+}
+
+func splitPath(p string) []string {
+	var parts []string
+	for _, c := range strings.Split(filepath.ToSlash(p), "/") {
+		if c != "" {
+			parts = append(parts, c)
+		}
+	}
+	return parts
+}
+
+// extractor extracts archive entries into destDir, making sure that nothing
+// is written outside of destDir and that the extracted contents don't exceed
+// the configured size limit.
+type extractor struct {
+	destDir        string
+	remainingBytes int64
+}
+
+// entryPath returns the path that the archive entry with the given name
+// should be extracted to.
+func (e *extractor) entryPath(name string) (string, error) {
+	path, err := safeJoin(e.destDir, name)
+	if err != nil {
+		return "", err
+	}
+	if err := checkNoSymlinks(e.destDir, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (e *extractor) extract(format archiveFormat, f *os.File) error {
+	switch format {
+	case formatTar:
+		return e.extractTar(f)
+	case formatTarGz:
+		gzr, err := gzip.NewReader(f)
+		if err != nil {
+			return status.InvalidArgumentErrorf("invalid gzip archive: %s", err)
+		}
+		defer gzr.Close()
+		return e.extractTar(gzr)
+	case formatTarZst:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return status.InvalidArgumentErrorf("invalid zstd archive: %s", err)
+		}
+		defer zr.Close()
+		return e.extractTar(zr)
+	case formatZip:
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return e.extractZip(f, info.Size())
+	default:
+		return status.InvalidArgumentErrorf("unsupported archive format %q", format)
+	}
+}
+
+func (e *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.InvalidArgumentErrorf("invalid tar archive: %s", err)
+		}
+		path, err := e.entryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := e.writeFile(path, tr, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := e.symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := e.entryPath(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.Link(target, path); err != nil {
+				return err
+			}
+		default:
+			log.Debugf("Skipping tar entry %q with unsupported type %d", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
+
+func (e *extractor) extractZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid zip archive: %s", err)
+	}
+	for _, zf := range zr.File {
+		path, err := e.entryPath(zf.Name)
+		if err != nil {
+			return err
+		}
+		mode := zf.Mode()
+		if mode.IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return status.InvalidArgumentErrorf("invalid zip entry %q: %s", zf.Name, err)
+		}
+		if mode&os.ModeSymlink != 0 {
+			target, err := io.ReadAll(io.LimitReader(rc, maxSymlinkTargetLength+1))
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if len(target) > maxSymlinkTargetLength {
+				return status.InvalidArgumentErrorf("symlink %q has a target that is too long", zf.Name)
+			}
+			if err := e.symlink(string(target), path); err != nil {
+				return err
+			}
+			continue
+		}
+		err = e.writeFile(path, rc, mode)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *extractor) symlink(target, path string) error {
+	if err := checkSymlinkTarget(e.destDir, path, target); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(target, path)
+}
+
+func (e *extractor) writeFile(path string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Only preserve the executable bit; everything else is normalized so
+	// that the uploaded tree doesn't depend on the archive's permissions.
+	perm := os.FileMode(0644)
+	if mode&0100 != 0 {
+		perm = 0755
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, e.remainingBytes+1))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if n > e.remainingBytes {
+		f.Close()
+		return status.ResourceExhaustedErrorf("archive contents exceed the maximum extracted size of %d bytes", *maxExtractedSizeBytes)
+	}
+	e.remainingBytes -= n
+	return f.Close()
+}
+
+// validateGitURI returns an error if uri is not an HTTP(S) URL. Other
+// transports would allow clients to read repositories from the server's
+// local filesystem or to run arbitrary commands (e.g. "ext::").
+func validateGitURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return status.InvalidArgumentErrorf("unparsable URI: %q", uri)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return status.InvalidArgumentErrorf("unsupported git repository URI %q: only http and https URIs are supported", uri)
+	}
+	return nil
+}
+
+// cloneGitRepo checks out the given commit (or branch, if commit is empty) of
+// the repository at uri into destDir. The .git directory is removed after
+// checkout so that it does not become part of the uploaded tree.
+func cloneGitRepo(ctx context.Context, uri, commit, branch, destDir string) error {
+	if err := validateGitURI(uri); err != nil {
+		return err
+	}
+	if commit != "" && !commitSHARegexp.MatchString(commit) {
+		return status.InvalidArgumentErrorf("invalid %s qualifier %q: expected a commit SHA", vcsCommitQualifier, commit)
+	}
+	if strings.HasPrefix(branch, "-") {
+		return status.InvalidArgumentErrorf("invalid %s qualifier %q", vcsBranchQualifier, branch)
+	}
+	ref := commit
+	if ref == "" {
+		ref = branch
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if err := runGit(ctx, destDir, "init", "--quiet"); err != nil {
+		return err
+	}
+	// Try a shallow fetch of just the requested ref first. Fetching a commit
+	// by SHA requires server support, so fall back to a full fetch if needed.
+	// The URI and ref always come after "--" so that they can't be parsed as
+	// options.
+	if err := runGit(ctx, destDir, "fetch", "--quiet", "--depth=1", "--", uri, ref); err != nil {
+		if commit == "" {
+			return err
+		}
+		log.CtxInfof(ctx, "Shallow fetch of %s at %s failed, falling back to full fetch: %s", uri, commit, err)
+		if err := runGit(ctx, destDir, "fetch", "--quiet", "--", uri); err != nil {
+			return err
+		}
+		ref = commit
+	} else {
+		ref = "FETCH_HEAD"
+	}
+	if err := runGit(ctx, destDir, "-c", "advice.detachedHead=false", "checkout", "--quiet", ref, "--"); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(destDir, ".git"))
+}
+
+func runGit(ctx context.Context, dir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(
+		os.Environ(),
+		// Never prompt for credentials; fail instead.
+		"GIT_TERMINAL_PROMPT=0",
+		// Only allow the transports that validateGitURI allows, including
+		// for submodules and redirects.
+		"GIT_ALLOW_PROTOCOL=http:https",
+		// Ignore any system-wide config on the server.
+		"GIT_CONFIG_NOSYSTEM=1",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return status.DeadlineExceededErrorf("git %s: %s", args[0], ctxErr)
+		}
+		return status.UnavailableErrorf("git %s failed: %s: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
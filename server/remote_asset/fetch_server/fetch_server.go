@@ -9,10 +9,12 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/asset_mapping"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
@@ -20,6 +22,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/scratchspace"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
 	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
@@ -27,12 +30,17 @@ import (
 	statuspb "google.golang.org/genproto/googleapis/rpc/status"
 	gcodes "google.golang.org/grpc/codes"
 	"google.golang.org/protobuf/types/known/durationpb"
+	tspb "google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const (
-	checksumQualifier = "checksum.sri"
-	sha256Prefix      = "sha256-"
-	maxHTTPTimeout    = 60 * time.Minute
+	checksumQualifier     = "checksum.sri"
+	resourceTypeQualifier = "resource_type"
+	directoryQualifier    = "directory"
+	vcsCommitQualifier    = "vcs.commit"
+	vcsBranchQualifier    = "vcs.branch"
+	sha256Prefix          = "sha256-"
+	maxHTTPTimeout        = 60 * time.Minute
 )
 
 type FetchServer struct {
@@ -77,7 +85,9 @@ func timeoutFromContext(ctx context.Context) (time.Duration, bool) {
 	return deadline.Sub(time.Now()), true
 }
 
-func timeoutHTTPClient(ctx context.Context, protoTimeout *durationpb.Duration) *http.Client {
+// fetchTimeout returns the timeout to use for a fetch, taking into account
+// the request timeout, the context deadline, and the maximum allowed timeout.
+func fetchTimeout(ctx context.Context, protoTimeout *durationpb.Duration) time.Duration {
 	timeout := time.Duration(0)
 	if ctxDuration, ok := timeoutFromContext(ctx); ok {
 		timeout = ctxDuration
@@ -88,6 +98,11 @@ func timeoutHTTPClient(ctx context.Context, protoTimeout *durationpb.Duration) *
 	if timeout == 0 || timeout > maxHTTPTimeout {
 		timeout = maxHTTPTimeout
 	}
+	return timeout
+}
+
+func timeoutHTTPClient(ctx context.Context, protoTimeout *durationpb.Duration) *http.Client {
+	timeout := fetchTimeout(ctx, protoTimeout)
 
 	tp := &http.Transport{
 		Dial: (&net.Dialer{
@@ -108,17 +123,20 @@ func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest)
 		return nil, err
 	}
 
+	if rsp := p.findPushedBlob(ctx, req); rsp != nil {
+		return rsp, nil
+	}
+
 	var expectedSHA256 string
 
 	for _, qualifier := range req.GetQualifiers() {
 		if qualifier.GetName() == checksumQualifier && strings.HasPrefix(qualifier.GetValue(), sha256Prefix) {
-			b64sha256 := strings.TrimPrefix(qualifier.GetValue(), sha256Prefix)
-			sha256, err := base64.StdEncoding.DecodeString(b64sha256)
+			sha256, err := sha256FromSRI(qualifier.GetValue())
 			if err != nil {
-				return nil, status.FailedPreconditionErrorf("Error decoding qualifier %q: %s", qualifier.GetName(), err.Error())
+				return nil, err
 			}
 			blobDigest := &repb.Digest{
-				Hash: fmt.Sprintf("%x", sha256),
+				Hash: sha256,
 				// The digest size is unknown since the client only sends up
 				// the hash. We can look up the size using the Metadata API,
 				// which looks up only using the hash, so the size we pass here
@@ -199,7 +217,262 @@ func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest)
 }
 
 func (p *FetchServer) FetchDirectory(ctx context.Context, req *rapb.FetchDirectoryRequest) (*rapb.FetchDirectoryResponse, error) {
-	return nil, status.UnimplementedError("FetchDirectory is not yet implemented")
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, p.env)
+	if err != nil {
+		return nil, err
+	}
+	if rsp := p.findPushedDirectory(ctx, req); rsp != nil {
+		return rsp, nil
+	}
+	if p.env.GetContentAddressableStorageClient() == nil {
+		return nil, status.FailedPreconditionError("FetchDirectory requires a ContentAddressableStorageClient")
+	}
+
+	opts := &directoryFetchOptions{}
+	for _, qualifier := range req.GetQualifiers() {
+		switch qualifier.GetName() {
+		case checksumQualifier:
+			if !strings.HasPrefix(qualifier.GetValue(), sha256Prefix) {
+				return nil, status.InvalidArgumentErrorf("unsupported %s qualifier %q: only sha256 is supported", checksumQualifier, qualifier.GetValue())
+			}
+			opts.expectedSHA256, err = sha256FromSRI(qualifier.GetValue())
+			if err != nil {
+				return nil, err
+			}
+		case resourceTypeQualifier:
+			opts.resourceType = qualifier.GetValue()
+		case directoryQualifier:
+			opts.subdirectory = qualifier.GetValue()
+		case vcsCommitQualifier:
+			opts.commit = qualifier.GetValue()
+		case vcsBranchQualifier:
+			opts.branch = qualifier.GetValue()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout(ctx, req.GetTimeout()))
+	defer cancel()
+	httpClient := timeoutHTTPClient(ctx, req.GetTimeout())
+
+	// Keep track of the last fetch error so that if we fail to fetch, we at
+	// least have something we can return to the client.
+	var lastFetchErr error
+
+	for _, uri := range req.GetUris() {
+		if _, err := url.Parse(uri); err != nil {
+			return nil, status.InvalidArgumentErrorf("unparsable URI: %q", uri)
+		}
+		rootDigest, err := p.fetchDirectory(ctx, httpClient, req.GetInstanceName(), uri, opts)
+		if err != nil {
+			lastFetchErr = err
+			log.CtxWarningf(ctx, "Failed to fetch directory %q: %s", uri, err)
+			continue
+		}
+		// If the contents are pinned by a checksum or commit, remember the
+		// result so that subsequent fetches don't need to download and
+		// extract it again.
+		if opts.expectedSHA256 != "" || opts.commit != "" {
+			mapping := &capb.RemoteAssetMapping{
+				RootDirectoryDigest: rootDigest,
+				DigestFunction:      repb.DigestFunction_SHA256,
+				CreatedAt:           tspb.Now(),
+			}
+			if err := asset_mapping.Store(ctx, p.env.GetCache(), req.GetInstanceName(), asset_mapping.Directory, []string{uri}, req.GetQualifiers(), mapping); err != nil {
+				log.CtxWarningf(ctx, "Failed to store directory mapping for %q: %s", uri, err)
+			}
+		}
+		return &rapb.FetchDirectoryResponse{
+			Uri:                 uri,
+			Qualifiers:          req.GetQualifiers(),
+			Status:              &statuspb.Status{Code: int32(gcodes.OK)},
+			RootDirectoryDigest: rootDigest,
+		}, nil
+	}
+
+	log.CtxInfof(ctx, "FetchDirectory: returning NotFound for %s", req.GetUris())
+	return &rapb.FetchDirectoryResponse{
+		Status: &statuspb.Status{
+			Code:    int32(gcodes.NotFound),
+			Message: status.Message(lastFetchErr),
+		},
+	}, nil
+}
+
+type directoryFetchOptions struct {
+	expectedSHA256 string
+	resourceType   string
+	subdirectory   string
+	commit         string
+	branch         string
+}
+
+// fetchDirectory downloads and unpacks the archive or git repository at the
+// given URI, uploads the resulting tree to the CAS, and returns the digest of
+// the root Directory.
+func (p *FetchServer) fetchDirectory(ctx context.Context, httpClient *http.Client, remoteInstanceName, uri string, opts *directoryFetchOptions) (*repb.Digest, error) {
+	format, err := detectArchiveFormat(uri, opts.resourceType, opts.commit)
+	if err != nil {
+		return nil, err
+	}
+	tmpDir, err := scratchspace.MkdirTemp("remote-asset-fetch-dir-*")
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to create temp dir for download: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.Errorf("Failed to remove temp dir: %s", err)
+		}
+	}()
+
+	contentsDir := filepath.Join(tmpDir, "contents")
+	if err := os.Mkdir(contentsDir, 0755); err != nil {
+		return nil, err
+	}
+	if format == formatGit {
+		log.CtxInfof(ctx, "Cloning %s", uri)
+		if err := cloneGitRepo(ctx, uri, opts.commit, opts.branch, contentsDir); err != nil {
+			return nil, err
+		}
+	} else {
+		log.CtxInfof(ctx, "Fetching %s", uri)
+		rsp, err := httpClient.Get(uri)
+		if err != nil {
+			return nil, status.UnavailableErrorf("failed to fetch %q: HTTP GET failed: %s", uri, err)
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode < 200 || rsp.StatusCode >= 400 {
+			return nil, status.UnavailableErrorf("failed to fetch %q: HTTP %s", uri, rsp.Status)
+		}
+		archivePath, err := tempCopy(rsp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := os.Remove(archivePath); err != nil {
+				log.Errorf("Failed to remove temp file: %s", err)
+			}
+		}()
+		if opts.expectedSHA256 != "" {
+			f, err := os.Open(archivePath)
+			if err != nil {
+				return nil, err
+			}
+			d, err := digest.Compute(f, repb.DigestFunction_SHA256)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			if d.GetHash() != opts.expectedSHA256 {
+				return nil, status.InvalidArgumentErrorf("response body checksum for %q was %q but wanted %q", uri, d.GetHash(), opts.expectedSHA256)
+			}
+		}
+		if err := extractArchive(format, archivePath, contentsDir); err != nil {
+			return nil, err
+		}
+	}
+
+	root := contentsDir
+	if opts.subdirectory != "" {
+		root, err = safeJoin(contentsDir, opts.subdirectory)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkNoSymlinks(contentsDir, root); err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			return nil, status.NotFoundErrorf("directory %q not found in %q", opts.subdirectory, uri)
+		}
+	}
+	rootDigest, _, err := cachetools.UploadDirectoryToCAS(ctx, p.env, remoteInstanceName, repb.DigestFunction_SHA256, root)
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to upload directory to cache: %s", err)
+	}
+	log.CtxInfof(ctx, "Mirrored %s to cache (root directory digest: %s)", uri, digest.String(rootDigest))
+	return rootDigest, nil
+}
+
+// sha256FromSRI decodes a "sha256-<base64>" subresource integrity string into
+// a hex-encoded SHA256 hash.
+func sha256FromSRI(sri string) (string, error) {
+	b64sha256 := strings.TrimPrefix(sri, sha256Prefix)
+	sha256, err := base64.StdEncoding.DecodeString(b64sha256)
+	if err != nil {
+		return "", status.FailedPreconditionErrorf("Error decoding qualifier %q: %s", checksumQualifier, err.Error())
+	}
+	return fmt.Sprintf("%x", sha256), nil
+}
+
+// findPushedBlob returns a response for the first URI in the request which
+// has a blob mapping registered via the Push API, or nil if there is none.
+func (p *FetchServer) findPushedBlob(ctx context.Context, req *rapb.FetchBlobRequest) *rapb.FetchBlobResponse {
+	for _, uri := range req.GetUris() {
+		m, err := asset_mapping.Lookup(ctx, p.env.GetCache(), req.GetInstanceName(), asset_mapping.Blob, uri, req.GetQualifiers(), req.GetOldestContentAccepted())
+		if err != nil {
+			if !status.IsNotFoundError(err) {
+				log.CtxWarningf(ctx, "Failed to look up pushed blob for %q: %s", uri, err)
+			}
+			continue
+		}
+		if !p.casContains(ctx, req.GetInstanceName(), m.GetBlobDigest(), m.GetDigestFunction()) {
+			continue
+		}
+		log.CtxInfof(ctx, "FetchServer found pushed blob %s for %q", digest.String(m.GetBlobDigest()), uri)
+		return &rapb.FetchBlobResponse{
+			Uri:        uri,
+			Qualifiers: req.GetQualifiers(),
+			ExpiresAt:  m.GetExpireAt(),
+			Status:     &statuspb.Status{Code: int32(gcodes.OK)},
+			BlobDigest: m.GetBlobDigest(),
+		}
+	}
+	return nil
+}
+
+// findPushedDirectory returns a response for the first URI in the request
+// which has a directory mapping registered via the Push API, or nil if there
+// is none.
+func (p *FetchServer) findPushedDirectory(ctx context.Context, req *rapb.FetchDirectoryRequest) *rapb.FetchDirectoryResponse {
+	for _, uri := range req.GetUris() {
+		m, err := asset_mapping.Lookup(ctx, p.env.GetCache(), req.GetInstanceName(), asset_mapping.Directory, uri, req.GetQualifiers(), req.GetOldestContentAccepted())
+		if err != nil {
+			if !status.IsNotFoundError(err) {
+				log.CtxWarningf(ctx, "Failed to look up pushed directory for %q: %s", uri, err)
+			}
+			continue
+		}
+		if !p.casContains(ctx, req.GetInstanceName(), m.GetRootDirectoryDigest(), m.GetDigestFunction()) {
+			continue
+		}
+		log.CtxInfof(ctx, "FetchServer found pushed directory %s for %q", digest.String(m.GetRootDirectoryDigest()), uri)
+		return &rapb.FetchDirectoryResponse{
+			Uri:                 uri,
+			Qualifiers:          req.GetQualifiers(),
+			ExpiresAt:           m.GetExpireAt(),
+			Status:              &statuspb.Status{Code: int32(gcodes.OK)},
+			RootDirectoryDigest: m.GetRootDirectoryDigest(),
+		}
+	}
+	return nil
+}
+
+// casContains returns whether the given digest is still present in the CAS,
+// renewing it in the process so that it doesn't expire before the client
+// requests it.
+func (p *FetchServer) casContains(ctx context.Context, instanceName string, d *repb.Digest, digestFunction repb.DigestFunction_Value) bool {
+	rn := digest.NewResourceName(d, instanceName, rspb.CacheType_CAS, digestFunction)
+	if rn.IsEmpty() {
+		return true
+	}
+	exists, err := p.env.GetCache().Contains(ctx, rn.ToProto())
+	if err != nil {
+		log.CtxErrorf(ctx, "Failed to renew %s: %s", digest.String(d), err)
+		return false
+	}
+	if !exists {
+		log.CtxInfof(ctx, "Pushed asset %s is no longer in the CAS", digest.String(d))
+	}
+	return exists
 }
 
 // mirrorToCache uploads the contents at the given URI to the given cache,
@@ -0,0 +1,374 @@
+package fetch_server_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/fetch_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testcache"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testgit"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testhttp"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testshell"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/require"
+
+	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+	gcodes "google.golang.org/grpc/codes"
+)
+
+func setup(t *testing.T) (context.Context, *testenv.TestEnv, *fetch_server.FetchServer) {
+	te := testenv.GetTestEnv(t)
+	testcache.Setup(t, te)
+	fs, err := fetch_server.NewFetchServer(te)
+	require.NoError(t, err)
+	return context.Background(), te, fs
+}
+
+// serveArchive creates an archive containing the given files by running
+// `<cmd> <archive> <files...>` and serves it over HTTP. It returns the archive URL, its checksum.sri qualifier value, and the
+// path of the archive on disk.
+func serveArchive(t *testing.T, contents map[string]string, archiveName, cmd string) (string, string, string) {
+	ws := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, filepath.Join(ws, "src"), contents)
+	testshell.Run(t, filepath.Join(ws, "src"), cmd+" ../"+archiveName+" *")
+	b, err := os.ReadFile(filepath.Join(ws, archiveName))
+	require.NoError(t, err)
+	sum := sha256.Sum256(b)
+	u := testhttp.StartServer(t, http.FileServer(http.Dir(ws)))
+	u.Path = "/" + archiveName
+	return u.String(), "sha256-" + base64.StdEncoding.EncodeToString(sum[:]), filepath.Join(ws, archiveName)
+}
+
+func getDirectory(t *testing.T, ctx context.Context, te *testenv.TestEnv, d *repb.Digest) *repb.Directory {
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+	dir := &repb.Directory{}
+	rn := digest.NewResourceName(d, "", rspb.CacheType_CAS, repb.DigestFunction_SHA256)
+	require.NoError(t, cachetools.ReadProtoFromCAS(ctx, te.GetCache(), rn, dir))
+	return dir
+}
+
+func fileNames(dir *repb.Directory) []string {
+	var names []string
+	for _, f := range dir.GetFiles() {
+		names = append(names, f.GetName())
+	}
+	for _, d := range dir.GetDirectories() {
+		names = append(names, d.GetName()+"/")
+	}
+	return names
+}
+
+func TestFetchDirectory_TarGz(t *testing.T) {
+	ctx, te, fs := setup(t)
+	uri, sri, _ := serveArchive(t, map[string]string{
+		"BUILD":       "",
+		"lib/foo.txt": "foo",
+	}, "archive.tar.gz", "tar czf")
+
+	rsp, err := fs.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris:       []string{uri},
+		Qualifiers: []*rapb.Qualifier{{Name: "checksum.sri", Value: sri}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), rsp.GetStatus().GetCode(), rsp.GetStatus().GetMessage())
+
+	root := getDirectory(t, ctx, te, rsp.GetRootDirectoryDigest())
+	require.ElementsMatch(t, []string{"BUILD", "lib/"}, fileNames(root))
+}
+
+func TestFetchDirectory_ZipWithSubdirectory(t *testing.T) {
+	ctx, te, fs := setup(t)
+	uri, _, _ := serveArchive(t, map[string]string{
+		"repo-1.0/BUILD":   "",
+		"repo-1.0/foo.txt": "foo",
+	}, "archive.zip", "zip -qr")
+
+	rsp, err := fs.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris:       []string{uri},
+		Qualifiers: []*rapb.Qualifier{{Name: "directory", Value: "repo-1.0"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), rsp.GetStatus().GetCode(), rsp.GetStatus().GetMessage())
+
+	root := getDirectory(t, ctx, te, rsp.GetRootDirectoryDigest())
+	require.ElementsMatch(t, []string{"BUILD", "foo.txt"}, fileNames(root))
+}
+
+func TestFetchDirectory_ChecksumMismatch_NotFound(t *testing.T) {
+	ctx, _, fs := setup(t)
+	uri, _, _ := serveArchive(t, map[string]string{"BUILD": ""}, "archive.tar", "tar cf")
+	_, wrongSRI, _ := serveArchive(t, map[string]string{"OTHER": ""}, "archive.tar", "tar cf")
+
+	rsp, err := fs.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris:       []string{uri},
+		Qualifiers: []*rapb.Qualifier{{Name: "checksum.sri", Value: wrongSRI}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.NotFound), rsp.GetStatus().GetCode())
+	require.Contains(t, rsp.GetStatus().GetMessage(), "checksum")
+}
+
+func TestFetchDirectory_PinnedResultIsReused(t *testing.T) {
+	ctx, _, fs := setup(t)
+	uri, sri, archivePath := serveArchive(t, map[string]string{"BUILD": ""}, "archive.tar.gz", "tar czf")
+	req := &rapb.FetchDirectoryRequest{
+		Uris:       []string{uri},
+		Qualifiers: []*rapb.Qualifier{{Name: "checksum.sri", Value: sri}},
+	}
+
+	rsp, err := fs.FetchDirectory(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), rsp.GetStatus().GetCode(), rsp.GetStatus().GetMessage())
+
+	// Once the archive is no longer served, a second fetch should still be
+	// served from the cache since the contents are pinned by checksum.
+	require.NoError(t, os.Remove(archivePath))
+
+	rsp2, err := fs.FetchDirectory(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), rsp2.GetStatus().GetCode(), rsp2.GetStatus().GetMessage())
+	require.Equal(t, rsp.GetRootDirectoryDigest().GetHash(), rsp2.GetRootDirectoryDigest().GetHash())
+}
+
+type tarEntry struct {
+	name     string
+	linkname string
+	contents string
+}
+
+// serveTar serves a tar archive containing the given entries over HTTP and
+// returns its URL. Entries with a linkname are symlinks.
+func serveTar(t *testing.T, entries []tarEntry) string {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.contents))}
+		if e.linkname != "" {
+			hdr = &tar.Header{Name: e.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: e.linkname}
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(e.contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	u := testhttp.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	}))
+	u.Path = "/archive.tar"
+	return u.String()
+}
+
+func TestFetchDirectory_Symlinks(t *testing.T) {
+	outsideDir := testfs.MakeTempDir(t)
+	for _, tc := range []struct {
+		name        string
+		entries     []tarEntry
+		expectedErr string
+	}{
+		{
+			name: "relative symlink inside of the archive",
+			entries: []tarEntry{
+				{name: "BUILD"},
+				{name: "lib/BUILD", linkname: "../BUILD"},
+			},
+		},
+		{
+			name: "write through absolute symlink",
+			entries: []tarEntry{
+				{name: "a", linkname: outsideDir},
+				{name: "a/passwd", contents: "pwned"},
+			},
+			expectedErr: "absolute target",
+		},
+		{
+			name: "relative symlink outside of the archive",
+			entries: []tarEntry{
+				{name: "a", linkname: "../../.."},
+			},
+			expectedErr: "outside of the extraction directory",
+		},
+		{
+			name: "symlink redirected by another symlink",
+			entries: []tarEntry{
+				{name: "l", linkname: "s/.."},
+				{name: "s", linkname: "."},
+			},
+			expectedErr: "outside of the extraction directory",
+		},
+		{
+			name: "write through symlink inside of the archive",
+			entries: []tarEntry{
+				{name: "dir/BUILD"},
+				{name: "a", linkname: "dir"},
+				{name: "a/BUILD", contents: "overwritten"},
+			},
+			expectedErr: "goes through a symlink",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, te, fs := setup(t)
+			uri := serveTar(t, tc.entries)
+
+			rsp, err := fs.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{Uris: []string{uri}})
+			require.NoError(t, err)
+			if tc.expectedErr != "" {
+				require.Equal(t, int32(gcodes.NotFound), rsp.GetStatus().GetCode())
+				require.Contains(t, rsp.GetStatus().GetMessage(), tc.expectedErr)
+				require.NoFileExists(t, filepath.Join(outsideDir, "passwd"))
+				return
+			}
+			require.Equal(t, int32(gcodes.OK), rsp.GetStatus().GetCode(), rsp.GetStatus().GetMessage())
+			root := getDirectory(t, ctx, te, rsp.GetRootDirectoryDigest())
+			require.ElementsMatch(t, []string{"BUILD", "lib/"}, fileNames(root))
+		})
+	}
+}
+
+func TestFetchDirectory_SubdirectoryThroughSymlink(t *testing.T) {
+	ctx, _, fs := setup(t)
+	uri := serveTar(t, []tarEntry{
+		{name: "dir/BUILD"},
+		{name: "link", linkname: "dir"},
+	})
+
+	rsp, err := fs.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris:       []string{uri},
+		Qualifiers: []*rapb.Qualifier{{Name: "directory", Value: "link"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.NotFound), rsp.GetStatus().GetCode())
+	require.Contains(t, rsp.GetStatus().GetMessage(), "goes through a symlink")
+}
+
+func TestFetchDirectory_MaxExtractedSize(t *testing.T) {
+	ctx, _, fs := setup(t)
+	flags.Set(t, "remote_asset.max_extracted_size_bytes", int64(10))
+	uri := serveTar(t, []tarEntry{
+		{name: "a", contents: "12345"},
+		{name: "b", contents: "123456"},
+	})
+
+	rsp, err := fs.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{Uris: []string{uri}})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.NotFound), rsp.GetStatus().GetCode())
+	require.Contains(t, rsp.GetStatus().GetMessage(), "maximum extracted size")
+}
+
+// serveGitRepo serves the git repository at repoPath over git's smart HTTP
+// protocol and returns its URL.
+func serveGitRepo(t *testing.T, repoPath string) string {
+	gitPath, err := exec.LookPath("git")
+	require.NoError(t, err)
+	u := testhttp.StartServer(t, &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + filepath.Dir(repoPath),
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+	})
+	u.Path = "/" + filepath.Base(repoPath)
+	return u.String()
+}
+
+func TestFetchDirectory_Git(t *testing.T) {
+	ctx, te, fs := setup(t)
+	repoPath, commitSHA := testgit.MakeTempRepo(t, map[string]string{
+		"BUILD":       "",
+		"lib/foo.txt": "foo",
+	})
+	testgit.CommitFiles(t, repoPath, map[string]string{"NEW": ""})
+	uri := serveGitRepo(t, repoPath)
+
+	// Fetching the initial commit should not include files from later
+	// commits, or the .git directory.
+	rsp, err := fs.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris:       []string{uri},
+		Qualifiers: []*rapb.Qualifier{{Name: "vcs.commit", Value: commitSHA}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), rsp.GetStatus().GetCode(), rsp.GetStatus().GetMessage())
+	root := getDirectory(t, ctx, te, rsp.GetRootDirectoryDigest())
+	require.ElementsMatch(t, []string{"BUILD", "lib/"}, fileNames(root))
+
+	rsp, err = fs.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris:       []string{uri},
+		Qualifiers: []*rapb.Qualifier{{Name: "vcs.branch", Value: "master"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), rsp.GetStatus().GetCode(), rsp.GetStatus().GetMessage())
+	root = getDirectory(t, ctx, te, rsp.GetRootDirectoryDigest())
+	require.ElementsMatch(t, []string{"BUILD", "NEW", "lib/"}, fileNames(root))
+}
+
+func TestFetchDirectory_GitRejectsUnsafeRequests(t *testing.T) {
+	repoPath, commitSHA := testgit.MakeTempRepo(t, map[string]string{"BUILD": ""})
+	marker := filepath.Join(testfs.MakeTempDir(t), "marker")
+	for _, tc := range []struct {
+		name        string
+		uri         string
+		commit      string
+		expectedErr string
+	}{
+		{
+			name:        "local file",
+			uri:         "file://" + repoPath,
+			commit:      commitSHA,
+			expectedErr: "only http and https",
+		},
+		{
+			name:        "option injection",
+			uri:         "--upload-pack=touch " + marker,
+			commit:      commitSHA,
+			expectedErr: "only http and https",
+		},
+		{
+			name:        "ext transport",
+			uri:         "ext::sh -c touch% " + marker,
+			commit:      commitSHA,
+			expectedErr: "only http and https",
+		},
+		{
+			name:        "option injection in commit",
+			uri:         serveGitRepo(t, repoPath),
+			commit:      "--upload-pack=touch " + marker,
+			expectedErr: "expected a commit SHA",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, _, fs := setup(t)
+			rsp, err := fs.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+				Uris: []string{tc.uri},
+				Qualifiers: []*rapb.Qualifier{
+					{Name: "resource_type", Value: "application/x-git"},
+					{Name: "vcs.commit", Value: tc.commit},
+				},
+			})
+			if err != nil {
+				// Some URIs are rejected before they are fetched.
+				require.Contains(t, err.Error(), "unparsable URI")
+			} else {
+				require.Equal(t, int32(gcodes.NotFound), rsp.GetStatus().GetCode())
+				require.Contains(t, rsp.GetStatus().GetMessage(), tc.expectedErr)
+			}
+			require.NoFileExists(t, marker)
+		})
+	}
+}
@@ -2,11 +2,20 @@ package push_server
 
 import (
 	"context"
+	"net/url"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/asset_mapping"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
 	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+	tspb "google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type PushServer struct {
@@ -29,9 +38,90 @@ func NewPushServer(env environment.Env) *PushServer {
 }
 
 func (p *PushServer) PushBlob(ctx context.Context, req *rapb.PushBlobRequest) (*rapb.PushBlobResponse, error) {
-	return nil, status.UnimplementedError("PushBlob is not yet implemented")
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, p.env)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateURIs(req.GetUris()); err != nil {
+		return nil, err
+	}
+	if req.GetBlobDigest() == nil {
+		return nil, status.InvalidArgumentError("blob_digest is required")
+	}
+	digestFunction := digest.InferOldStyleDigestFunctionInDesperation(req.GetBlobDigest())
+	if err := p.checkExists(ctx, req.GetInstanceName(), req.GetBlobDigest(), digestFunction); err != nil {
+		return nil, err
+	}
+	mapping := &capb.RemoteAssetMapping{
+		BlobDigest:     req.GetBlobDigest(),
+		DigestFunction: digestFunction,
+		CreatedAt:      tspb.Now(),
+		ExpireAt:       req.GetExpireAt(),
+	}
+	if err := asset_mapping.Store(ctx, p.env.GetCache(), req.GetInstanceName(), asset_mapping.Blob, req.GetUris(), req.GetQualifiers(), mapping); err != nil {
+		return nil, err
+	}
+	log.CtxInfof(ctx, "Pushed blob %s for %s", digest.String(req.GetBlobDigest()), req.GetUris())
+	return &rapb.PushBlobResponse{}, nil
 }
 
 func (p *PushServer) PushDirectory(ctx context.Context, req *rapb.PushDirectoryRequest) (*rapb.PushDirectoryResponse, error) {
-	return nil, status.UnimplementedError("PushDirectory is not yet implemented")
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, p.env)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateURIs(req.GetUris()); err != nil {
+		return nil, err
+	}
+	if req.GetRootDirectoryDigest() == nil {
+		return nil, status.InvalidArgumentError("root_directory_digest is required")
+	}
+	digestFunction := digest.InferOldStyleDigestFunctionInDesperation(req.GetRootDirectoryDigest())
+	if err := p.checkExists(ctx, req.GetInstanceName(), req.GetRootDirectoryDigest(), digestFunction); err != nil {
+		return nil, err
+	}
+	mapping := &capb.RemoteAssetMapping{
+		RootDirectoryDigest: req.GetRootDirectoryDigest(),
+		DigestFunction:      digestFunction,
+		CreatedAt:           tspb.Now(),
+		ExpireAt:            req.GetExpireAt(),
+	}
+	if err := asset_mapping.Store(ctx, p.env.GetCache(), req.GetInstanceName(), asset_mapping.Directory, req.GetUris(), req.GetQualifiers(), mapping); err != nil {
+		return nil, err
+	}
+	log.CtxInfof(ctx, "Pushed directory %s for %s", digest.String(req.GetRootDirectoryDigest()), req.GetUris())
+	return &rapb.PushDirectoryResponse{}, nil
+}
+
+// checkExists returns a FailedPrecondition error if the given digest is not
+// present in the CAS. Pushing a mapping to content that doesn't exist would
+// cause later fetches to return a digest that can't be downloaded.
+func (p *PushServer) checkExists(ctx context.Context, instanceName string, d *repb.Digest, digestFunction repb.DigestFunction_Value) error {
+	rn := digest.NewResourceName(d, instanceName, rspb.CacheType_CAS, digestFunction)
+	if err := rn.Validate(); err != nil {
+		return err
+	}
+	if rn.IsEmpty() {
+		return nil
+	}
+	exists, err := p.env.GetCache().Contains(ctx, rn.ToProto())
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return status.FailedPreconditionErrorf("%s is not present in the CAS", digest.String(d))
+	}
+	return nil
+}
+
+func validateURIs(uris []string) error {
+	if len(uris) == 0 {
+		return status.InvalidArgumentError("at least one URI is required")
+	}
+	for _, uri := range uris {
+		if _, err := url.Parse(uri); err != nil {
+			return status.InvalidArgumentErrorf("unparsable URI: %q", uri)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,151 @@
+package push_server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/fetch_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/push_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	gcodes "google.golang.org/grpc/codes"
+	tspb "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Unreachable, so that any fetch that isn't served from a pushed mapping
+// fails.
+const testURI = "https://0.0.0.0/archive.tar.gz"
+
+func setup(t *testing.T) (context.Context, *testenv.TestEnv) {
+	te := testenv.GetTestEnv(t)
+	ctx := context.Background()
+
+	byteStreamServer, err := byte_stream_server.NewByteStreamServer(te)
+	require.NoError(t, err)
+	grpcServer, runFunc := te.LocalGRPCServer()
+	bspb.RegisterByteStreamServer(grpcServer, byteStreamServer)
+	go runFunc()
+	conn, err := te.LocalGRPCConn(ctx)
+	require.NoError(t, err)
+	te.SetByteStreamClient(bspb.NewByteStreamClient(conn))
+	return ctx, te
+}
+
+func uploadBlob(t *testing.T, ctx context.Context, te *testenv.TestEnv, blob string) *repb.Digest {
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+	d, err := cachetools.UploadBlobToCAS(ctx, te.GetCache(), "", repb.DigestFunction_SHA256, []byte(blob))
+	require.NoError(t, err)
+	return d
+}
+
+func TestPushBlob_ThenFetch_ServedFromCache(t *testing.T) {
+	ctx, te := setup(t)
+	d := uploadBlob(t, ctx, te, "hello")
+	qualifiers := []*rapb.Qualifier{
+		{Name: "resource_type", Value: "application/x-tar"},
+		{Name: "bazel.canonical_id", Value: "foo"},
+	}
+
+	pushServer := push_server.NewPushServer(te)
+	_, err := pushServer.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris:       []string{testURI},
+		Qualifiers: qualifiers,
+		BlobDigest: d,
+	})
+	require.NoError(t, err)
+
+	fetchServer, err := fetch_server.NewFetchServer(te)
+	require.NoError(t, err)
+	// Qualifiers should match regardless of order.
+	rsp, err := fetchServer.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris:       []string{testURI},
+		Qualifiers: []*rapb.Qualifier{qualifiers[1], qualifiers[0]},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), rsp.GetStatus().GetCode())
+	require.Equal(t, testURI, rsp.GetUri())
+	require.Empty(t, cmp.Diff(d, rsp.GetBlobDigest(), protocmp.Transform()))
+
+	// Different qualifiers should not match the pushed mapping.
+	rsp, err = fetchServer.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris:       []string{testURI},
+		Qualifiers: qualifiers[:1],
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.NotFound), rsp.GetStatus().GetCode())
+}
+
+func TestPushBlob_Expired_NotServed(t *testing.T) {
+	ctx, te := setup(t)
+	d := uploadBlob(t, ctx, te, "hello")
+
+	pushServer := push_server.NewPushServer(te)
+	_, err := pushServer.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris:       []string{testURI},
+		BlobDigest: d,
+		ExpireAt:   tspb.New(time.Now().Add(-1 * time.Minute)),
+	})
+	require.NoError(t, err)
+
+	fetchServer, err := fetch_server.NewFetchServer(te)
+	require.NoError(t, err)
+	rsp, err := fetchServer.FetchBlob(ctx, &rapb.FetchBlobRequest{Uris: []string{testURI}})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.NotFound), rsp.GetStatus().GetCode())
+}
+
+func TestPushBlob_MissingFromCAS_FailedPrecondition(t *testing.T) {
+	ctx, te := setup(t)
+
+	pushServer := push_server.NewPushServer(te)
+	_, err := pushServer.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris: []string{testURI},
+		BlobDigest: &repb.Digest{
+			Hash:      "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			SizeBytes: 5,
+		},
+	})
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+}
+
+func TestPushDirectory_ThenFetch_ServedFromCache(t *testing.T) {
+	ctx, te := setup(t)
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+	fileDigest := uploadBlob(t, ctx, te, "hello")
+	dirDigest, err := cachetools.UploadProtoToCAS(ctx, te.GetCache(), "", repb.DigestFunction_SHA256, &repb.Directory{
+		Files: []*repb.FileNode{{Name: "hello.txt", Digest: fileDigest}},
+	})
+	require.NoError(t, err)
+
+	pushServer := push_server.NewPushServer(te)
+	_, err = pushServer.PushDirectory(ctx, &rapb.PushDirectoryRequest{
+		Uris:                []string{testURI},
+		RootDirectoryDigest: dirDigest,
+	})
+	require.NoError(t, err)
+
+	fetchServer, err := fetch_server.NewFetchServer(te)
+	require.NoError(t, err)
+	rsp, err := fetchServer.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{Uris: []string{testURI}})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), rsp.GetStatus().GetCode())
+	require.Empty(t, cmp.Diff(dirDigest, rsp.GetRootDirectoryDigest(), protocmp.Transform()))
+
+	// A pushed directory should not be returned by FetchBlob.
+	blobRsp, err := fetchServer.FetchBlob(ctx, &rapb.FetchBlobRequest{Uris: []string{testURI}})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.NotFound), blobRsp.GetStatus().GetCode())
+}
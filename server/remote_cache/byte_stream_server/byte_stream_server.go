@@ -132,7 +132,7 @@ func (s *ByteStreamServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_Re
 	// If the cache doesn't support the requested compression, it will cache decompressed bytes and the server
 	// is in charge of compressing it
 	var counter *ioutil.Counter
-	if r.GetCompressor() == repb.Compressor_ZSTD && !passthroughCompressionEnabled {
+	if r.GetCompressor() != repb.Compressor_IDENTITY && !passthroughCompressionEnabled {
 		rbuf := s.bufferPool.Get(bufSize)
 		defer s.bufferPool.Put(rbuf)
 		cbuf := s.bufferPool.Get(bufSize)
@@ -140,10 +140,12 @@ func (s *ByteStreamServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_Re
 
 		// Counter for the number of bytes from the original reader containing decompressed bytes
 		counter = &ioutil.Counter{}
-		reader, err = compression.NewZstdCompressingReader(io.NopCloser(io.TeeReader(reader, counter)), rbuf[:bufSize], cbuf[:bufSize])
+		reader, err = compression.NewCompressingReader(r.GetCompressor(), io.NopCloser(io.TeeReader(reader, counter)), rbuf[:bufSize], cbuf[:bufSize])
 		if err != nil {
 			return status.InternalErrorf("Failed to compress blob: %s", err)
 		}
+		// Close waits for the compression goroutine to stop using rbuf and
+		// cbuf, so this must run before they are returned to the pool.
 		defer reader.Close()
 	}
 
@@ -216,6 +218,10 @@ type writeState struct {
 	resourceName       *digest.ResourceName
 	resourceNameString string
 	offset             int64
+
+	// Whether the blob counts towards the group's storage quota once it is
+	// committed.
+	countsTowardsQuota bool
 }
 
 func checkInitialPreconditions(req *bspb.WriteRequest) error {
@@ -277,6 +283,12 @@ func (s *ByteStreamServer) initStreamState(ctx context.Context, req *bspb.WriteR
 	if exists {
 		return nil, status.AlreadyExistsError("Already exists")
 	}
+	if qm := s.env.GetQuotaManager(); qm != nil && !r.IsEmpty() && qm.HasStorageQuota(ctx) {
+		if err := qm.AllowStorage(ctx, r.GetDigest().GetSizeBytes()); err != nil {
+			return nil, err
+		}
+		ws.countsTowardsQuota = true
+	}
 
 	var committedWriteCloser interfaces.CommittedWriteCloser
 	if r.IsEmpty() {
@@ -298,11 +310,11 @@ func (s *ByteStreamServer) initStreamState(ctx context.Context, req *bspb.WriteR
 	ws.checksum = NewChecksum(hasher, r.GetDigestFunction())
 	ws.writer = io.MultiWriter(ws.checksum, committedWriteCloser)
 
-	if r.GetCompressor() == repb.Compressor_ZSTD {
+	if r.GetCompressor() != repb.Compressor_IDENTITY {
 		if s.cache.SupportsCompressor(r.GetCompressor()) {
 			// If the cache supports compression, write compressed bytes to the cache with committedWriteCloser
 			// but wrap the checksum in a decompressor to validate the decompressed data
-			decompressingChecksum, err := compression.NewZstdDecompressor(ws.checksum)
+			decompressingChecksum, err := compression.NewDecompressor(r.GetCompressor(), ws.checksum, r.GetDigest().GetSizeBytes())
 			if err != nil {
 				return nil, err
 			}
@@ -310,7 +322,7 @@ func (s *ByteStreamServer) initStreamState(ctx context.Context, req *bspb.WriteR
 			ws.decompressorCloser = decompressingChecksum
 		} else {
 			// If the cache doesn't support compression, wrap both the checksum and cache writer in a decompressor
-			decompressor, err := compression.NewZstdDecompressor(ws.writer)
+			decompressor, err := compression.NewDecompressor(r.GetCompressor(), ws.writer, r.GetDigest().GetSizeBytes())
 			if err != nil {
 				return nil, err
 			}
@@ -369,6 +381,7 @@ func (s *ByteStreamServer) Write(stream bspb.ByteStream_WriteServer) error {
 	}
 
 	var streamState *writeState
+	var ht *hit_tracker.HitTracker
 	bytesUploadedFromClient := 0
 	for {
 		req, err := stream.Recv()
@@ -385,7 +398,7 @@ func (s *ByteStreamServer) Write(stream bspb.ByteStream_WriteServer) error {
 				return err
 			}
 
-			ht := hit_tracker.NewHitTracker(ctx, s.env, false)
+			ht = hit_tracker.NewHitTracker(ctx, s.env, false)
 
 			// If the API key is read-only, pretend the object already exists.
 			if !canWrite {
@@ -427,6 +440,11 @@ func (s *ByteStreamServer) Write(stream bspb.ByteStream_WriteServer) error {
 			if err := streamState.Commit(); err != nil {
 				return err
 			}
+			if streamState.countsTowardsQuota {
+				if err := ht.RecordCASStored(streamState.resourceName.GetDigest()); err != nil {
+					log.CtxWarningf(ctx, "Failed to record stored CAS bytes: %s", err)
+				}
+			}
 			return stream.SendAndClose(&bspb.WriteResponse{
 				CommittedSize: streamState.offset,
 			})
@@ -436,8 +454,7 @@ func (s *ByteStreamServer) Write(stream bspb.ByteStream_WriteServer) error {
 }
 
 func (s *ByteStreamServer) supportsCompressor(compression repb.Compressor_Value) bool {
-	return compression == repb.Compressor_IDENTITY ||
-		compression == repb.Compressor_ZSTD && remote_cache_config.ZstdTranscodingEnabled()
+	return remote_cache_config.SupportsCompressor(compression)
 }
 
 // `QueryWriteStatus()` is used to find the `committed_size` for a resource
@@ -331,6 +331,106 @@ func TestRPCWriteAndReadCompressed(t *testing.T) {
 	}
 }
 
+func TestRPCWriteAndReadTranscodedCompressors(t *testing.T) {
+	for _, compressor := range []repb.Compressor_Value{repb.Compressor_DEFLATE, repb.Compressor_BROTLI} {
+		t.Run(compressor.String(), func(t *testing.T) {
+			ctx := context.Background()
+			te := testenv.GetTestEnv(t)
+			flags.Set(t, "cache.deflate_transcoding_enabled", true)
+			flags.Set(t, "cache.brotli_transcoding_enabled", true)
+
+			clientConn := runByteStreamServer(ctx, te, t)
+			bsClient := bspb.NewByteStreamClient(clientConn)
+
+			blob := compressibleBlobOfSize(1e5)
+			compressedBlob, err := compression.Compress(compressor, nil, blob)
+			require.NoError(t, err)
+			d, err := digest.Compute(bytes.NewReader(blob), repb.DigestFunction_SHA256)
+			require.NoError(t, err)
+			segment := strings.ToLower(compressor.String())
+
+			uploadResourceName := fmt.Sprintf("uploads/%s/compressed-blobs/%s/%s/%d", newUUID(t), segment, d.Hash, d.SizeBytes)
+			mustUploadChunked(t, ctx, bsClient, defaultBazelVersion, uploadResourceName, compressedBlob, true)
+
+			// Read back compressed.
+			downloadStream, err := bsClient.Read(ctx, &bspb.ReadRequest{
+				ResourceName: fmt.Sprintf("compressed-blobs/%s/%s/%d", segment, d.Hash, d.SizeBytes),
+			})
+			require.NoError(t, err)
+			downloadBuf := []byte{}
+			for {
+				res, err := downloadStream.Recv()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				downloadBuf = append(downloadBuf, res.Data...)
+			}
+			decompressedBlob, err := compression.Decompress(compressor, nil, downloadBuf, int64(len(blob)))
+			require.NoError(t, err)
+			require.Equal(t, blob, decompressedBlob)
+
+			// Read back uncompressed.
+			var buf bytes.Buffer
+			err = readBlob(ctx, bsClient, digest.NewResourceName(d, "", rspb.CacheType_CAS, repb.DigestFunction_SHA256), &buf, 0)
+			require.NoError(t, err)
+			require.Equal(t, blob, buf.Bytes())
+		})
+	}
+}
+
+func TestRPCWriteRejectsBlobsThatDecompressPastDigestSize(t *testing.T) {
+	for _, compressor := range []repb.Compressor_Value{repb.Compressor_ZSTD, repb.Compressor_DEFLATE, repb.Compressor_BROTLI} {
+		t.Run(compressor.String(), func(t *testing.T) {
+			ctx := context.Background()
+			te := testenv.GetTestEnv(t)
+			flags.Set(t, "cache.zstd_transcoding_enabled", true)
+			flags.Set(t, "cache.deflate_transcoding_enabled", true)
+			flags.Set(t, "cache.brotli_transcoding_enabled", true)
+			clientConn := runByteStreamServer(ctx, te, t)
+			bsClient := bspb.NewByteStreamClient(clientConn)
+
+			// A small digest whose compressed payload expands to 1MB.
+			blob := []byte("AAAAAAAAAAAAAAAAAAAAAAAAA")
+			d, err := digest.Compute(bytes.NewReader(blob), repb.DigestFunction_SHA256)
+			require.NoError(t, err)
+			bomb, err := compression.Compress(compressor, nil, bytes.Repeat([]byte{'A'}, 1<<20))
+			require.NoError(t, err)
+
+			segment := strings.ToLower(compressor.String())
+			uploadStream, err := bsClient.Write(withBazelVersion(t, ctx, defaultBazelVersion))
+			require.NoError(t, err)
+			err = uploadStream.Send(&bspb.WriteRequest{
+				ResourceName: fmt.Sprintf("uploads/%s/compressed-blobs/%s/%s/%d", newUUID(t), segment, d.Hash, d.SizeBytes),
+				Data:         bomb,
+				FinishWrite:  true,
+			})
+			if err != io.EOF {
+				require.NoError(t, err)
+			}
+			_, err = uploadStream.CloseAndRecv()
+			require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument; got: %v", err)
+		})
+	}
+}
+
+func TestRPCReadTranscodedCompressorDisabled(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	flags.Set(t, "cache.deflate_transcoding_enabled", false)
+
+	clientConn := runByteStreamServer(ctx, te, t)
+	bsClient := bspb.NewByteStreamClient(clientConn)
+
+	rn, _ := testdigest.RandomCASResourceBuf(t, 100)
+	readStream, err := bsClient.Read(ctx, &bspb.ReadRequest{
+		ResourceName: fmt.Sprintf("compressed-blobs/deflate/%s/%d", rn.GetDigest().GetHash(), rn.GetDigest().GetSizeBytes()),
+	})
+	require.NoError(t, err)
+	_, err = readStream.Recv()
+	require.True(t, status.IsUnimplementedError(err), "expected Unimplemented, got %v", err)
+}
+
 func TestRPCWriteCompressedReadUncompressed(t *testing.T) {
 	ctx := context.Background()
 	te := testenv.GetTestEnv(t)
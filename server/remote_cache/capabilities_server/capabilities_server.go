@@ -56,7 +56,16 @@ func (s *CapabilitiesServer) GetCapabilities(ctx context.Context, req *repb.GetC
 	}
 	var compressors []repb.Compressor_Value
 	if s.supportZstd {
-		compressors = []repb.Compressor_Value{repb.Compressor_IDENTITY, repb.Compressor_ZSTD}
+		compressors = append(compressors, repb.Compressor_ZSTD)
+	}
+	if remote_cache_config.DeflateTranscodingEnabled() {
+		compressors = append(compressors, repb.Compressor_DEFLATE)
+	}
+	if remote_cache_config.BrotliTranscodingEnabled() {
+		compressors = append(compressors, repb.Compressor_BROTLI)
+	}
+	if len(compressors) > 0 {
+		compressors = append([]repb.Compressor_Value{repb.Compressor_IDENTITY}, compressors...)
 	}
 	if s.supportCAS {
 		c.CacheCapabilities = &repb.CacheCapabilities{
@@ -1,9 +1,42 @@
 package config
 
-import "flag"
+import (
+	"flag"
 
-var zstdTranscodingEnabled = flag.Bool("cache.zstd_transcoding_enabled", true, "Whether to accept requests to read/write zstd-compressed blobs, compressing/decompressing outgoing/incoming blobs on the fly.")
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+var (
+	zstdTranscodingEnabled    = flag.Bool("cache.zstd_transcoding_enabled", true, "Whether to accept requests to read/write zstd-compressed blobs, compressing/decompressing outgoing/incoming blobs on the fly.")
+	deflateTranscodingEnabled = flag.Bool("cache.deflate_transcoding_enabled", false, "Whether to accept requests to read/write deflate-compressed blobs, compressing/decompressing outgoing/incoming blobs on the fly.")
+	brotliTranscodingEnabled  = flag.Bool("cache.brotli_transcoding_enabled", false, "Whether to accept requests to read/write brotli-compressed blobs, compressing/decompressing outgoing/incoming blobs on the fly.")
+)
 
 func ZstdTranscodingEnabled() bool {
 	return *zstdTranscodingEnabled
 }
+
+func DeflateTranscodingEnabled() bool {
+	return *deflateTranscodingEnabled
+}
+
+func BrotliTranscodingEnabled() bool {
+	return *brotliTranscodingEnabled
+}
+
+// SupportsCompressor returns whether clients may read and write blobs using
+// the given compressor.
+func SupportsCompressor(compressor repb.Compressor_Value) bool {
+	switch compressor {
+	case repb.Compressor_IDENTITY:
+		return true
+	case repb.Compressor_ZSTD:
+		return ZstdTranscodingEnabled()
+	case repb.Compressor_DEFLATE:
+		return DeflateTranscodingEnabled()
+	case repb.Compressor_BROTLI:
+		return BrotliTranscodingEnabled()
+	default:
+		return false
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -162,6 +163,26 @@ func (s *ContentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 
 	rsp.Responses = make([]*repb.BatchUpdateBlobsResponse_Response, 0, len(req.Requests))
 
+	// Like ByteStream writes, only blobs that don't already exist count
+	// towards the group's storage quota. The new blobs are checked against
+	// the quota together, and are all rejected if the batch as a whole would
+	// exceed it.
+	var missing map[digest.Key]bool
+	var quotaErr error
+	if qm := s.env.GetQuotaManager(); qm != nil && qm.HasStorageQuota(ctx) {
+		missing, err = s.findMissingForUpload(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		newBytes := int64(0)
+		for k := range missing {
+			newBytes += k.SizeBytes
+		}
+		if newBytes > 0 {
+			quotaErr = qm.AllowStorage(ctx, newBytes)
+		}
+	}
+
 	ht := hit_tracker.NewHitTracker(ctx, s.env, false)
 	kvs := make(map[*rspb.ResourceName][]byte, len(req.Requests))
 	for _, uploadRequest := range req.Requests {
@@ -169,6 +190,13 @@ func (s *ContentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 		if err := rn.Validate(); err != nil {
 			return nil, err
 		}
+		if quotaErr != nil && missing[digest.NewKey(rn.GetDigest())] {
+			rsp.Responses = append(rsp.Responses, &repb.BatchUpdateBlobsResponse_Response{
+				Digest: rn.GetDigest(),
+				Status: gstatus.Convert(quotaErr).Proto(),
+			})
+			continue
+		}
 		uploadTracker := ht.TrackUpload(rn.GetDigest())
 		// defers are preetty cheap: https://tpaschalis.github.io/defer-internals/
 		// so doing 100-1000 or so in this loop is fine.
@@ -200,8 +228,8 @@ func (s *ContentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 			return nil, err
 		}
 		decompressedData := uploadRequest.GetData()
-		if uploadRequest.Compressor == repb.Compressor_ZSTD {
-			decompressedData, err = zstdDecompress(uploadRequest.GetData(), uploadRequest.GetDigest().GetSizeBytes())
+		if uploadRequest.Compressor != repb.Compressor_IDENTITY {
+			decompressedData, err = decompress(uploadRequest.Compressor, uploadRequest.GetData(), uploadRequest.GetDigest().GetSizeBytes())
 			if err != nil {
 				rsp.Responses = append(rsp.Responses, &repb.BatchUpdateBlobsResponse_Response{
 					Digest: rn.GetDigest(),
@@ -248,10 +276,37 @@ func (s *ContentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 			Digest: uploadDigest.GetDigest(),
 			Status: &statuspb.Status{Code: int32(codes.OK)},
 		})
+		if missing[digest.NewKey(uploadDigest.GetDigest())] {
+			if err := ht.RecordCASStored(uploadDigest.GetDigest()); err != nil {
+				log.CtxWarningf(ctx, "Failed to record stored CAS bytes: %s", err)
+			}
+		}
 	}
 	return rsp, nil
 }
 
+// findMissingForUpload returns the set of non-empty blobs in the request that
+// are not already in the cache.
+func (s *ContentAddressableStorageServer) findMissingForUpload(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (map[digest.Key]bool, error) {
+	rns := make([]*rspb.ResourceName, 0, len(req.GetRequests()))
+	for _, uploadRequest := range req.GetRequests() {
+		rn := digest.NewResourceName(uploadRequest.GetDigest(), req.GetInstanceName(), rspb.CacheType_CAS, req.GetDigestFunction())
+		if rn.IsEmpty() {
+			continue
+		}
+		rns = append(rns, rn.ToProto())
+	}
+	missingDigests, err := s.cache.FindMissing(ctx, rns)
+	if err != nil {
+		return nil, err
+	}
+	missing := make(map[digest.Key]bool, len(missingDigests))
+	for _, d := range missingDigests {
+		missing[digest.NewKey(d)] = true
+	}
+	return missing, nil
+}
+
 type downloadTrackerData struct {
 	bytesReadFromCache      int
 	bytesDownloadedToClient int
@@ -294,6 +349,19 @@ func (s *ContentAddressableStorageServer) BatchReadBlobs(ctx context.Context, re
 	rsp.Responses = make([]*repb.BatchReadBlobsResponse_Response, 0, len(req.Digests))
 	clientAcceptsZstd := remote_cache_config.ZstdTranscodingEnabled() && clientAcceptsCompressor(req.AcceptableCompressors, repb.Compressor_ZSTD)
 	readZstd := clientAcceptsZstd && s.cache.SupportsCompressor(repb.Compressor_ZSTD)
+	// Prefer zstd if the client accepts it, otherwise use the first other
+	// compressor accepted by the client that we can transcode to.
+	responseCompressor := repb.Compressor_IDENTITY
+	if clientAcceptsZstd {
+		responseCompressor = repb.Compressor_ZSTD
+	} else {
+		for _, c := range req.AcceptableCompressors {
+			if c != repb.Compressor_ZSTD && s.supportsCompressor(c) {
+				responseCompressor = c
+				break
+			}
+		}
+	}
 
 	requestedResources := make([]*digest.ResourceName, 0, len(req.GetDigests()))
 	for _, readDigest := range req.GetDigests() {
@@ -352,6 +420,15 @@ func (s *ContentAddressableStorageServer) BatchReadBlobs(ctx context.Context, re
 				blobRsp.Data = compression.CompressZstd(nil, blobRsp.Data)
 				blobRsp.Compressor = repb.Compressor_ZSTD
 				bytesToClient = len(blobRsp.Data)
+			} else if !clientAcceptsZstd && responseCompressor != repb.Compressor_IDENTITY {
+				compressed, err := compression.Compress(responseCompressor, nil, blobRsp.Data)
+				if err != nil {
+					log.CtxWarningf(ctx, "Failed to compress blob %s: %s", rn.GetDigest().GetHash(), err)
+				} else {
+					blobRsp.Data = compressed
+					blobRsp.Compressor = responseCompressor
+					bytesToClient = len(blobRsp.Data)
+				}
 			}
 		}
 
@@ -375,8 +452,7 @@ func (s *ContentAddressableStorageServer) BatchReadBlobs(ctx context.Context, re
 }
 
 func (s *ContentAddressableStorageServer) supportsCompressor(compressor repb.Compressor_Value) bool {
-	return compressor == repb.Compressor_IDENTITY ||
-		compressor == repb.Compressor_ZSTD && remote_cache_config.ZstdTranscodingEnabled()
+	return remote_cache_config.SupportsCompressor(compressor)
 }
 
 func clientAcceptsCompressor(acceptableCompressors []repb.Compressor_Value, compressor repb.Compressor_Value) bool {
@@ -392,11 +468,20 @@ func clientAcceptsCompressor(acceptableCompressors []repb.Compressor_Value, comp
 	return false
 }
 
-func zstdDecompress(data []byte, decompressedLength int64) ([]byte, error) {
-	buf := make([]byte, decompressedLength)
-	out, err := compression.DecompressZstd(buf, data)
+func decompress(compressor repb.Compressor_Value, data []byte, decompressedLength int64) ([]byte, error) {
+	var buf []byte
+	if compressor == repb.Compressor_ZSTD {
+		// zstd decompresses into a preallocated buffer.
+		buf = make([]byte, decompressedLength)
+	}
+	// Reject data that decompresses to more than the digest size, so that a
+	// small request can't make the server allocate an unbounded buffer.
+	out, err := compression.Decompress(compressor, buf, data, decompressedLength)
+	if status.IsInvalidArgumentError(err) {
+		return nil, err
+	}
 	if err != nil {
-		return nil, status.InternalErrorf("Failed to decompress zstd-compressed blob: %s", err)
+		return nil, status.InternalErrorf("Failed to decompress %s-compressed blob: %s", strings.ToLower(compressor.String()), err)
 	}
 	return out, nil
 }
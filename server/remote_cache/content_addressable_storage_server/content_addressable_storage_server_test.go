@@ -23,6 +23,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
 	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -72,6 +73,29 @@ func (e *evilCache) GetMulti(ctx context.Context, resources []*rspb.ResourceName
 	return rsp, err
 }
 
+// fakeQuotaManager records the sizes passed to AllowStorage, and rejects
+// them once more than limit bytes would be allowed in total.
+type fakeQuotaManager struct {
+	interfaces.QuotaManager
+	noQuota bool
+	limit   int64
+	used    int64
+	allowed []int64
+}
+
+func (f *fakeQuotaManager) HasStorageQuota(ctx context.Context) bool {
+	return !f.noQuota
+}
+
+func (f *fakeQuotaManager) AllowStorage(ctx context.Context, sizeBytes int64) error {
+	f.allowed = append(f.allowed, sizeBytes)
+	if f.limit > 0 && f.used+sizeBytes > f.limit {
+		return status.ResourceExhaustedErrorf("storage quota exceeded: %d of %d bytes used", f.used, f.limit)
+	}
+	f.used += sizeBytes
+	return nil
+}
+
 func TestBatchUpdateBlobs(t *testing.T) {
 	ctx := context.Background()
 	te := testenv.GetTestEnv(t)
@@ -101,6 +125,85 @@ func TestBatchUpdateBlobs(t *testing.T) {
 	}
 }
 
+func TestBatchUpdateBlobs_OnlyNewBlobsCountTowardsStorageQuota(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	qm := &fakeQuotaManager{}
+	te.SetQuotaManager(qm)
+	clientConn := runCASServer(ctx, te, t)
+	casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+	rn1, buf1 := testdigest.RandomCASResourceBuf(t, 100)
+	rn2, buf2 := testdigest.RandomCASResourceBuf(t, 200)
+	rsp, err := casClient.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+		Requests: []*repb.BatchUpdateBlobsRequest_Request{
+			{Digest: rn1.GetDigest(), Data: buf1},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), rsp.GetResponses()[0].GetStatus().GetCode())
+	require.Equal(t, []int64{100}, qm.allowed)
+
+	// Re-uploading the first blob shouldn't count towards the quota again.
+	qm.allowed = nil
+	rsp, err = casClient.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+		Requests: []*repb.BatchUpdateBlobsRequest_Request{
+			{Digest: rn1.GetDigest(), Data: buf1},
+			{Digest: rn2.GetDigest(), Data: buf2},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetResponses(), 2)
+	for _, r := range rsp.GetResponses() {
+		require.Equal(t, int32(gcodes.OK), r.GetStatus().GetCode())
+	}
+	require.Equal(t, []int64{200}, qm.allowed)
+}
+
+func TestBatchUpdateBlobs_ChecksBatchAgainstStorageQuota(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	qm := &fakeQuotaManager{limit: 250}
+	te.SetQuotaManager(qm)
+	clientConn := runCASServer(ctx, te, t)
+	casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+	// Each blob fits in the quota on its own, but the batch doesn't.
+	rn1, buf1 := testdigest.RandomCASResourceBuf(t, 100)
+	rn2, buf2 := testdigest.RandomCASResourceBuf(t, 200)
+	rsp, err := casClient.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+		Requests: []*repb.BatchUpdateBlobsRequest_Request{
+			{Digest: rn1.GetDigest(), Data: buf1},
+			{Digest: rn2.GetDigest(), Data: buf2},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetResponses(), 2)
+	for _, r := range rsp.GetResponses() {
+		require.Equal(t, int32(gcodes.ResourceExhausted), r.GetStatus().GetCode())
+	}
+	require.Equal(t, []int64{300}, qm.allowed)
+}
+
+func TestBatchUpdateBlobs_SkipsStorageQuotaForGroupsWithoutOne(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	qm := &fakeQuotaManager{noQuota: true}
+	te.SetQuotaManager(qm)
+	clientConn := runCASServer(ctx, te, t)
+	casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+	rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+	rsp, err := casClient.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+		Requests: []*repb.BatchUpdateBlobsRequest_Request{
+			{Digest: rn.GetDigest(), Data: buf},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), rsp.GetResponses()[0].GetStatus().GetCode())
+	require.Empty(t, qm.allowed)
+}
+
 func TestBatchUpdateAndReadCompressedBlobs(t *testing.T) {
 	ctx := context.Background()
 	te := testenv.GetTestEnv(t)
@@ -200,6 +303,77 @@ func TestBatchUpdateAndReadCompressedBlobs(t *testing.T) {
 	require.Equal(t, [][]byte{blob}, blobs)
 }
 
+func TestBatchUpdateAndReadTranscodedCompressors(t *testing.T) {
+	for _, compressor := range []repb.Compressor_Value{repb.Compressor_DEFLATE, repb.Compressor_BROTLI} {
+		t.Run(compressor.String(), func(t *testing.T) {
+			ctx := context.Background()
+			te := testenv.GetTestEnv(t)
+			flags.Set(t, "cache.deflate_transcoding_enabled", true)
+			flags.Set(t, "cache.brotli_transcoding_enabled", true)
+			clientConn := runCASServer(ctx, te, t)
+			casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+			blob := []byte("AAAAAAAAAAAAAAAAAAAAAAAAA")
+			compressedBlob, err := compression.Compress(compressor, nil, blob)
+			require.NoError(t, err)
+			d, err := digest.Compute(bytes.NewReader(blob), repb.DigestFunction_SHA256)
+			require.NoError(t, err)
+
+			batchUpdateResp, err := casClient.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+				Requests: []*repb.BatchUpdateBlobsRequest_Request{
+					{Digest: d, Data: compressedBlob, Compressor: compressor},
+				},
+			})
+			require.NoError(t, err)
+			require.Len(t, batchUpdateResp.Responses, 1)
+			require.Equal(t, int32(gcodes.OK), batchUpdateResp.Responses[0].Status.Code, batchUpdateResp.Responses[0].Status.Message)
+
+			// Read back, accepting only the compressor under test.
+			readResp, err := casClient.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+				Digests:               []*repb.Digest{d},
+				AcceptableCompressors: []repb.Compressor_Value{repb.Compressor_IDENTITY, compressor},
+			})
+			require.NoError(t, err)
+			require.Len(t, readResp.Responses, 1)
+			resp := readResp.Responses[0]
+			require.Equal(t, int32(gcodes.OK), resp.Status.Code)
+			require.Equal(t, compressor, resp.Compressor)
+			decompressed, err := compression.Decompress(compressor, nil, resp.Data, d.GetSizeBytes())
+			require.NoError(t, err)
+			require.Equal(t, blob, decompressed)
+		})
+	}
+}
+
+func TestBatchUpdateRejectsBlobsThatDecompressPastDigestSize(t *testing.T) {
+	for _, compressor := range []repb.Compressor_Value{repb.Compressor_ZSTD, repb.Compressor_DEFLATE, repb.Compressor_BROTLI} {
+		t.Run(compressor.String(), func(t *testing.T) {
+			ctx := context.Background()
+			te := testenv.GetTestEnv(t)
+			flags.Set(t, "cache.deflate_transcoding_enabled", true)
+			flags.Set(t, "cache.brotli_transcoding_enabled", true)
+			clientConn := runCASServer(ctx, te, t)
+			casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+			// A small digest whose compressed payload expands to 1MB.
+			blob := []byte("AAAAAAAAAAAAAAAAAAAAAAAAA")
+			d, err := digest.Compute(bytes.NewReader(blob), repb.DigestFunction_SHA256)
+			require.NoError(t, err)
+			bomb, err := compression.Compress(compressor, nil, bytes.Repeat([]byte{'A'}, 1<<20))
+			require.NoError(t, err)
+
+			rsp, err := casClient.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+				Requests: []*repb.BatchUpdateBlobsRequest_Request{
+					{Digest: d, Data: bomb, Compressor: compressor},
+				},
+			})
+			require.NoError(t, err)
+			require.Len(t, rsp.Responses, 1)
+			require.Equal(t, int32(gcodes.InvalidArgument), rsp.Responses[0].Status.Code, rsp.Responses[0].Status.Message)
+		})
+	}
+}
+
 func TestBatchUpdateRejectsCompressedBlobsIfCompressionDisabled(t *testing.T) {
 	ctx := context.Background()
 	te := testenv.GetTestEnv(t)
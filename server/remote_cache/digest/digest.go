@@ -62,6 +62,18 @@ func init() {
 			digestType: repb.DigestFunction_BLAKE3,
 			sizeBytes:  32,
 		},
+		{
+			digestType: repb.DigestFunction_SHA384,
+			sizeBytes:  sha512.Size384,
+		},
+		{
+			digestType: repb.DigestFunction_SHA512,
+			sizeBytes:  sha512.Size,
+		},
+		{
+			digestType: repb.DigestFunction_VSO,
+			sizeBytes:  vsoSize,
+		},
 	}
 
 	hashMatchers := make([]string, 0)
@@ -74,16 +86,16 @@ func init() {
 	// Cache keys must be:
 	//  - lower case
 	//  - ascii
-	//  - a sha256 sum
+	//  - a hash of one of the supported digest functions
 	hashKeyRegex = regexp.MustCompile(fmt.Sprintf("^(%s)$", joinedMatchers))
 
 	// Matches:
 	// - "blobs/469db13020c60f8bdf9c89aa4e9a449914db23139b53a24d064f967a51057868/39120"
 	// - "blobs/ac/469db13020c60f8bdf9c89aa4e9a449914db23139b53a24d064f967a51057868/39120"
 	// - "uploads/2042a8f9-eade-4271-ae58-f5f6f5a32555/blobs/8afb02ca7aace3ae5cd8748ac589e2e33022b1a4bfd22d5d234c5887e270fe9c/17997850"
-	uploadRegex = regexp.MustCompile(fmt.Sprintf(`^(?:(?:(?P<instance_name>.*)/)?uploads/(?P<uuid>[a-f0-9-]{36})/)?(?P<blob_type>blobs|compressed-blobs/zstd)/(?:(?P<digest_function>blake3)/)?(?P<hash>%s)/(?P<size>\d+)`, joinedMatchers))
-	downloadRegex = regexp.MustCompile(fmt.Sprintf(`^(?:(?P<instance_name>.*)/)?(?P<blob_type>blobs|compressed-blobs/zstd)/(?:(?P<digest_function>blake3)/)?(?P<hash>%s)/(?P<size>\d+)`, joinedMatchers))
-	actionCacheRegex = regexp.MustCompile(fmt.Sprintf(`^(?:(?P<instance_name>.*)/)?(?P<blob_type>blobs|compressed-blobs/zstd)/ac/(?P<hash>%s)/(?P<size>\d+)`, joinedMatchers))
+	uploadRegex = regexp.MustCompile(fmt.Sprintf(`^(?:(?:(?P<instance_name>.*)/)?uploads/(?P<uuid>[a-f0-9-]{36})/)?(?P<blob_type>blobs|compressed-blobs/(?:zstd|deflate|brotli))/(?:(?P<digest_function>blake3)/)?(?P<hash>%s)/(?P<size>\d+)`, joinedMatchers))
+	downloadRegex = regexp.MustCompile(fmt.Sprintf(`^(?:(?P<instance_name>.*)/)?(?P<blob_type>blobs|compressed-blobs/(?:zstd|deflate|brotli))/(?:(?P<digest_function>blake3)/)?(?P<hash>%s)/(?P<size>\d+)`, joinedMatchers))
+	actionCacheRegex = regexp.MustCompile(fmt.Sprintf(`^(?:(?P<instance_name>.*)/)?(?P<blob_type>blobs|compressed-blobs/(?:zstd|deflate|brotli))/ac/(?P<hash>%s)/(?P<size>\d+)`, joinedMatchers))
 }
 
 func SupportedDigestFunctions() []repb.DigestFunction_Value {
@@ -162,6 +174,8 @@ func (r *ResourceName) IsEmpty() bool {
 		return r.rn.GetDigest().GetHash() == "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e"
 	case repb.DigestFunction_BLAKE3:
 		return r.rn.GetDigest().GetHash() == "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"
+	case repb.DigestFunction_VSO:
+		return r.rn.GetDigest().GetHash() == "1e57cf2792a900d06c1cdfb3c453f35bc86f72788aa9724c96c929d1cc6b456a00"
 	default:
 		return false
 	}
@@ -303,8 +317,14 @@ func HashForDigestType(digestType repb.DigestFunction_Value) (hash.Hash, error)
 		return sha1.New(), nil
 	case repb.DigestFunction_SHA256:
 		return sha256.New(), nil
+	case repb.DigestFunction_SHA384:
+		return sha512.New384(), nil
+	case repb.DigestFunction_SHA512:
+		return sha512.New(), nil
 	case repb.DigestFunction_BLAKE3:
 		return blake3.New(), nil
+	case repb.DigestFunction_VSO:
+		return newVSOHash(), nil
 	case repb.DigestFunction_UNKNOWN:
 		// TODO(tylerw): make this a warning when clients support this.
 		return sha256.New(), nil
@@ -325,6 +345,8 @@ func InferOldStyleDigestFunctionInDesperation(d *repb.Digest) repb.DigestFunctio
 		return repb.DigestFunction_SHA384
 	case sha512.Size * 2:
 		return repb.DigestFunction_SHA512
+	case vsoSize * 2:
+		return repb.DigestFunction_VSO
 	default:
 		return repb.DigestFunction_UNKNOWN
 	}
@@ -342,6 +364,8 @@ func isOldStyleDigestFunction(digestFunction repb.DigestFunction_Value) bool {
 		return true
 	case repb.DigestFunction_SHA512:
 		return true
+	case repb.DigestFunction_VSO:
+		return true
 	default:
 		return false
 	}
@@ -414,11 +438,13 @@ func parseResourceName(resourceName string, matcher *regexp.Regexp, cacheType rs
 	blobTypeStr, sizeOK := result["blob_type"]
 	if !sizeOK {
 		// Should never happen since the regex would not match otherwise.
-		return nil, status.InvalidArgumentError(`Unparsable resource name: "/blobs" or "/compressed-blobs/zstd" missing or out of place`)
+		return nil, status.InvalidArgumentError(`Unparsable resource name: "/blobs" or "/compressed-blobs/<compressor>" missing or out of place`)
 	}
 	compressor := repb.Compressor_IDENTITY
-	if blobTypeStr == "compressed-blobs/zstd" {
-		compressor = repb.Compressor_ZSTD
+	if c, ok := strings.CutPrefix(blobTypeStr, "compressed-blobs/"); ok {
+		// The regex only matches known compressor names, which are the
+		// lowercased enum names.
+		compressor = repb.Compressor_Value(repb.Compressor_Value_value[strings.ToUpper(c)])
 	}
 	d := &repb.Digest{Hash: hash, SizeBytes: sizeBytes}
 
@@ -459,10 +485,10 @@ func IsActionCacheResourceName(url string) bool {
 }
 
 func blobTypeSegment(compressor repb.Compressor_Value) string {
-	if compressor == repb.Compressor_ZSTD {
-		return "compressed-blobs/zstd"
+	if compressor == repb.Compressor_IDENTITY {
+		return "blobs"
 	}
-	return "blobs"
+	return "compressed-blobs/" + strings.ToLower(compressor.String())
 }
 
 func IsCacheDebuggingEnabled(ctx context.Context) bool {
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
@@ -58,6 +59,11 @@ func TestParseResourceName(t *testing.T) {
 			matcher:      downloadRegex,
 			wantParsed:   newZstdResourceName(&repb.Digest{Hash: "072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d", SizeBytes: 1234}, "my_instance_name"),
 		},
+		{ // download, resource with deflate compression
+			resourceName: "/compressed-blobs/deflate/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/1234",
+			matcher:      downloadRegex,
+			wantParsed:   newCompressedResourceName(&repb.Digest{Hash: "072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d", SizeBytes: 1234}, "", repb.Compressor_DEFLATE),
+		},
 		{ // download, resource with digest only
 			resourceName: "/blobs/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/1234",
 			matcher:      downloadRegex,
@@ -73,6 +79,26 @@ func TestParseResourceName(t *testing.T) {
 			matcher:      uploadRegex,
 			wantParsed:   newZstdResourceName(&repb.Digest{Hash: "072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d", SizeBytes: 1234}, "instance_name"),
 		},
+		{ // upload, UUID, instance name, and brotli compression
+			resourceName: "instance_name/uploads/2148e1f1-aacc-41eb-a31c-22b6da7c7ac1/compressed-blobs/brotli/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/1234",
+			matcher:      uploadRegex,
+			wantParsed:   newCompressedResourceName(&repb.Digest{Hash: "072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d", SizeBytes: 1234}, "instance_name", repb.Compressor_BROTLI),
+		},
+		{ // download, sha512 digest
+			resourceName: "/blobs/cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e/1234",
+			matcher:      downloadRegex,
+			wantParsed:   NewResourceName(&repb.Digest{Hash: "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e", SizeBytes: 1234}, "", rspb.CacheType_CAS, repb.DigestFunction_SHA512),
+		},
+		{ // upload, sha384 digest and instance name
+			resourceName: "instance_name/uploads/2148e1f1-aacc-41eb-a31c-22b6da7c7ac1/blobs/38b060a751ac96384cd9327eb1b1e36a21fdb71114be07434c0cc7bf63f6e1da274edebfe76f65fbd51ad2f14898b95b/1234",
+			matcher:      uploadRegex,
+			wantParsed:   NewResourceName(&repb.Digest{Hash: "38b060a751ac96384cd9327eb1b1e36a21fdb71114be07434c0cc7bf63f6e1da274edebfe76f65fbd51ad2f14898b95b", SizeBytes: 1234}, "instance_name", rspb.CacheType_CAS, repb.DigestFunction_SHA384),
+		},
+		{ // download, vso digest with zstd compression
+			resourceName: "/compressed-blobs/zstd/1e57cf2792a900d06c1cdfb3c453f35bc86f72788aa9724c96c929d1cc6b456a00/1234",
+			matcher:      downloadRegex,
+			wantParsed:   newCompressedResourceName(&repb.Digest{Hash: "1e57cf2792a900d06c1cdfb3c453f35bc86f72788aa9724c96c929d1cc6b456a00", SizeBytes: 1234}, "", repb.Compressor_ZSTD),
+		},
 		{ // action
 			resourceName: "instance_name/blobs/ac/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/1234",
 			matcher:      actionCacheRegex,
@@ -94,7 +120,8 @@ func TestParseResourceName(t *testing.T) {
 			gotParsed.GetDigest().GetHash() != tc.wantParsed.GetDigest().GetHash() ||
 			gotParsed.GetDigest().GetSizeBytes() != tc.wantParsed.GetDigest().GetSizeBytes() ||
 			gotParsed.GetInstanceName() != tc.wantParsed.GetInstanceName() ||
-			gotParsed.GetCompressor() != tc.wantParsed.GetCompressor()) {
+			gotParsed.GetCompressor() != tc.wantParsed.GetCompressor() ||
+			gotParsed.GetDigestFunction() != tc.wantParsed.GetDigestFunction()) {
 			t.Errorf("parseResourceName(%q): got %+v; want %+v", tc.resourceName, gotParsed, tc.wantParsed)
 		}
 	}
@@ -111,6 +138,117 @@ func newZstdResourceName(d *repb.Digest, instanceName string) *ResourceName {
 	return r
 }
 
+func newCompressedResourceName(d *repb.Digest, instanceName string, compressor repb.Compressor_Value) *ResourceName {
+	r := NewResourceName(d, instanceName, rspb.CacheType_CAS, repb.DigestFunction_UNKNOWN)
+	r.SetCompressor(compressor)
+	return r
+}
+
+func TestCompute(t *testing.T) {
+	for _, tc := range []struct {
+		digestFunction repb.DigestFunction_Value
+		data           string
+		wantHash       string
+	}{
+		{repb.DigestFunction_SHA1, "abc", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{repb.DigestFunction_SHA256, "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{repb.DigestFunction_SHA384, "abc", "cb00753f45a35e8bb5a03d699ac65007272c32ab0eded1631a8b605a43ff5bed8086072ba1e7cc2358baeca134c825a7"},
+		{repb.DigestFunction_SHA512, "abc", "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+	} {
+		d, err := Compute(bytes.NewReader([]byte(tc.data)), tc.digestFunction)
+		require.NoError(t, err)
+		assert.Equal(t, tc.wantHash, d.GetHash(), "%s", tc.digestFunction)
+		assert.Equal(t, int64(len(tc.data)), d.GetSizeBytes())
+		assert.Equal(t, tc.digestFunction, InferOldStyleDigestFunctionInDesperation(d))
+	}
+}
+
+func TestEmptyDigests(t *testing.T) {
+	for _, df := range SupportedDigestFunctions() {
+		d, err := Compute(bytes.NewReader(nil), df)
+		require.NoError(t, err)
+		rn := NewResourceName(d, "", rspb.CacheType_CAS, df)
+		assert.True(t, rn.IsEmpty(), "%s digest %q should be empty", df, d.GetHash())
+		assert.NoError(t, rn.Validate())
+	}
+}
+
+func TestVSOHash(t *testing.T) {
+	const blockSize = vsoPageSize * vsoPagesPerBlock
+	for _, size := range []int{1, vsoPageSize - 1, vsoPageSize, vsoPageSize + 1, blockSize, blockSize + 1, 3 * blockSize} {
+		buf := make([]byte, size)
+		_, err := rand.Read(buf)
+		require.NoError(t, err)
+
+		d, err := Compute(bytes.NewReader(buf), repb.DigestFunction_VSO)
+		require.NoError(t, err)
+		require.Len(t, d.GetHash(), vsoSize*2)
+		assert.True(t, strings.HasSuffix(d.GetHash(), "00"), "VSO hash should end with the algorithm ID")
+		assert.Equal(t, repb.DigestFunction_VSO, InferOldStyleDigestFunctionInDesperation(d))
+
+		// Writing in uneven chunks should produce the same hash as writing
+		// all at once, and Sum should not modify the hash state.
+		h := newVSOHash()
+		for i := 0; i < size; i += 1000 {
+			h.Write(buf[i:min(i+1000, size)])
+		}
+		assert.Equal(t, d.GetHash(), fmt.Sprintf("%x", h.Sum(nil)), "size %d", size)
+		assert.Equal(t, d.GetHash(), fmt.Sprintf("%x", h.Sum(nil)), "size %d", size)
+	}
+}
+
+func TestVSOHash_KnownAnswers(t *testing.T) {
+	const blockSize = vsoPageSize * vsoPagesPerBlock
+	for _, tc := range []struct {
+		size int
+		hash string
+	}{
+		// The empty hash matches BuildXL's VsoHash for empty content.
+		{0, "1e57cf2792a900d06c1cdfb3c453f35bc86f72788aa9724c96c929d1cc6b456a00"},
+		{1, "3da32150b5e69b54e7ad1765d9573bc5e6e05d3b6529556c1b4a436a76a511f400"},
+		{vsoPageSize - 1, "36b0e3a0cd6a5f2e467ca026cd2f50eda6d644eb48c5ae63250cdc40b0d731fd00"},
+		{vsoPageSize, "92ae678bec003dc87ca6a3349da12d35bb32f7093049be9340d625c583d458a000"},
+		{vsoPageSize + 1, "e21c77ff8abb108c5ada888b2bf269e863baa5ffae583300dbe3c8d23a5a3f8d00"},
+		{blockSize - 1, "2ee5b851c2d7201560b79acca776b32db068f325127122dcc831a39a95c8b3ed00"},
+		{blockSize, "242d8a0dc0e7845a28028a752dd0ee4e3bd6412d6e59041bd6739f5f0c2418a300"},
+		{blockSize + 1, "ffa55367ee29bda1760693fc12bad5a769897e4f55ad6f263b60f2216d72159400"},
+		{2 * blockSize, "beeedeee3a955ab9cd37625ec17ab6535e28a566284acb9f6d9d69b3b4dbd38000"},
+		{2*blockSize + 1, "62c87dbdccd38ed9808d01f007d3950ef573cf6247ce9011f65672fe608a870700"},
+	} {
+		buf := make([]byte, tc.size)
+		for i := range buf {
+			buf[i] = byte(i % 251)
+		}
+		d, err := Compute(bytes.NewReader(buf), repb.DigestFunction_VSO)
+		require.NoError(t, err)
+		assert.Equal(t, tc.hash, d.GetHash(), "size %d", tc.size)
+	}
+}
+
+func TestResourceNameStrings_OldStyleDigestFunctions(t *testing.T) {
+	for _, df := range []repb.DigestFunction_Value{repb.DigestFunction_SHA384, repb.DigestFunction_SHA512, repb.DigestFunction_VSO} {
+		d, err := Compute(bytes.NewReader([]byte("hello world")), df)
+		require.NoError(t, err)
+		rn := NewResourceName(d, "instance", rspb.CacheType_CAS, df)
+
+		// The digest function must be omitted from the resource name and
+		// inferred from the hash length.
+		s, err := rn.DownloadString()
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("instance/blobs/%s/%d", d.GetHash(), d.GetSizeBytes()), s)
+		parsed, err := ParseDownloadResourceName(s)
+		require.NoError(t, err)
+		assert.Equal(t, df, parsed.GetDigestFunction())
+
+		s, err = rn.UploadString()
+		require.NoError(t, err)
+		parsed, err = ParseUploadResourceName(s)
+		require.NoError(t, err)
+		assert.Equal(t, df, parsed.GetDigestFunction())
+		assert.Equal(t, d.GetHash(), parsed.GetDigest().GetHash())
+	}
+}
+
 func TestElementsMatch(t *testing.T) {
 	d1 := &repb.Digest{Hash: "1234", SizeBytes: 100}
 	d2 := &repb.Digest{Hash: "1111", SizeBytes: 10}
@@ -0,0 +1,130 @@
+package digest
+
+import (
+	"crypto/sha256"
+	"hash"
+)
+
+// VSO-Hash is the paged SHA256 digest function used by Azure DevOps and
+// BuildXL. See
+// https://github.com/microsoft/BuildXL/blob/master/Documentation/Specs/PagedHash.md
+//
+// Content is split into 64KiB pages, which are each hashed with SHA256. Page
+// hashes are grouped into 2MiB blocks, and each block hash is the SHA256 of
+// its concatenated page hashes. Block hashes are then folded into a rolling
+// SHA256 identifier, seeded with vsoRollingIDSeed, and the final identifier has
+// a single algorithm ID byte appended to it.
+const (
+	vsoPageSize      = 64 * 1024
+	vsoPagesPerBlock = 32
+
+	// vsoAlgorithmID is appended to the rolling hash to form the final
+	// 33-byte VSO hash.
+	vsoAlgorithmID = 0x00
+
+	// vsoSize is the size of a VSO hash in bytes.
+	vsoSize = sha256.Size + 1
+)
+
+// vsoRollingIDSeed is the initial value of the rolling identifier. Note that
+// the seed itself is used, not its hash.
+const vsoRollingIDSeed = "VSO Content Identifier Seed"
+
+type vsoHash struct {
+	// page holds the bytes of the current, incomplete page.
+	page []byte
+	// pageHashes holds the concatenated hashes of the completed pages in the
+	// current block.
+	pageHashes []byte
+	// pendingBlock is the hash of the most recently completed block. It is
+	// only folded into the rolling ID once more data is written, since the
+	// last block is hashed differently than the others.
+	pendingBlock *[sha256.Size]byte
+	rollingID    []byte
+}
+
+func newVSOHash() hash.Hash {
+	h := &vsoHash{}
+	h.Reset()
+	return h
+}
+
+func vsoRoll(rollingID []byte, blockHash [sha256.Size]byte, final bool) []byte {
+	buf := make([]byte, 0, len(rollingID)+sha256.Size+1)
+	buf = append(buf, rollingID...)
+	buf = append(buf, blockHash[:]...)
+	if final {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	sum := sha256.Sum256(buf)
+	return sum[:]
+}
+
+func (h *vsoHash) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if h.pendingBlock != nil {
+			h.rollingID = vsoRoll(h.rollingID, *h.pendingBlock, false)
+			h.pendingBlock = nil
+		}
+		take := min(len(p), vsoPageSize-len(h.page))
+		h.page = append(h.page, p[:take]...)
+		p = p[take:]
+		if len(h.page) < vsoPageSize {
+			continue
+		}
+		pageHash := sha256.Sum256(h.page)
+		h.pageHashes = append(h.pageHashes, pageHash[:]...)
+		h.page = h.page[:0]
+		if len(h.pageHashes) == vsoPagesPerBlock*sha256.Size {
+			blockHash := sha256.Sum256(h.pageHashes)
+			h.pendingBlock = &blockHash
+			h.pageHashes = h.pageHashes[:0]
+		}
+	}
+	return n, nil
+}
+
+func (h *vsoHash) Sum(b []byte) []byte {
+	rollingID := h.rollingID
+	pageHashes := h.pageHashes
+	if len(h.page) > 0 {
+		pageHash := sha256.Sum256(h.page)
+		pageHashes = append(pageHashes[:len(pageHashes):len(pageHashes)], pageHash[:]...)
+	}
+	switch {
+	case len(pageHashes) > 0:
+		if h.pendingBlock != nil {
+			rollingID = vsoRoll(rollingID, *h.pendingBlock, false)
+		}
+		rollingID = vsoRoll(rollingID, sha256.Sum256(pageHashes), true)
+	case h.pendingBlock != nil:
+		rollingID = vsoRoll(rollingID, *h.pendingBlock, true)
+	default:
+		// Empty content is hashed as a single block with no pages.
+		rollingID = vsoRoll(rollingID, sha256.Sum256(nil), true)
+	}
+	b = append(b, rollingID...)
+	return append(b, vsoAlgorithmID)
+}
+
+func (h *vsoHash) Reset() {
+	if h.page == nil {
+		h.page = make([]byte, 0, vsoPageSize)
+		h.pageHashes = make([]byte, 0, vsoPagesPerBlock*sha256.Size)
+	}
+	h.page = h.page[:0]
+	h.pageHashes = h.pageHashes[:0]
+	h.pendingBlock = nil
+	h.rollingID = []byte(vsoRollingIDSeed)
+}
+
+func (h *vsoHash) Size() int {
+	return vsoSize
+}
+
+func (h *vsoHash) BlockSize() int {
+	return vsoPageSize
+}
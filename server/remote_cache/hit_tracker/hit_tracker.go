@@ -533,6 +533,19 @@ func (h *HitTracker) TrackUpload(d *repb.Digest) *transferTimer {
 	}
 }
 
+// RecordCASStored records that a new blob with the given digest was written
+// to the CAS, counting it towards the group's stored bytes.
+func (h *HitTracker) RecordCASStored(d *repb.Digest) error {
+	if h.usage == nil || h.actionCache {
+		return nil
+	}
+	labels, err := usageutil.Labels(h.ctx)
+	if err != nil {
+		return status.WrapError(err, "get usage labels")
+	}
+	return h.usage.Increment(h.ctx, labels, &tables.UsageCounts{CASStoredSizeBytes: d.GetSizeBytes()})
+}
+
 func (h *HitTracker) recordCacheUsage(ctx context.Context, d *repb.Digest, actionCounter counterType) error {
 	if h.usage == nil {
 		return nil
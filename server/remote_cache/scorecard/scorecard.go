@@ -277,6 +277,18 @@ func sortResults(results []*capb.ScoreCard_Result, opts *sortOpts) {
 	})
 }
 
+// Delete deletes the invocation cache scorecard from the configured
+// blobstore.
+func Delete(ctx context.Context, env environment.Env, invocationID string, invocationAttempt uint64) error {
+	blobStore := env.GetBlobstore()
+	for _, name := range []string{blobName(invocationID, invocationAttempt), blobNameDeprecated(invocationID)} {
+		if err := blobStore.DeleteBlob(ctx, name); err != nil && !status.IsNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 func blobName(invocationID string, invocationAttempt uint64) string {
 	// WARNING: Things will break if this is changed, because we use this name
 	// to lookup data from historical invocations.
@@ -0,0 +1,146 @@
+package retention
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/janitor"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/role"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	rtpb "github.com/buildbuddy-io/buildbuddy/proto/retention"
+)
+
+const (
+	// The max number of rules in a group's retention policy.
+	maxRules = 50
+)
+
+func checkAccess(ctx context.Context, env environment.Env, groupID string) error {
+	if !janitor.RetentionPoliciesEnabled() {
+		return status.UnimplementedError("Retention policies are not enabled")
+	}
+	if groupID == "" {
+		return status.InvalidArgumentError("A group ID is required")
+	}
+	u, err := perms.AuthenticatedUser(ctx, env)
+	if err != nil {
+		return err
+	}
+	return authutil.AuthorizeGroupRole(u, groupID, role.Admin)
+}
+
+// GetRetentionPolicy returns the retention policy of the selected group.
+func GetRetentionPolicy(ctx context.Context, env environment.Env, req *rtpb.GetRetentionPolicyRequest) (*rtpb.GetRetentionPolicyResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := checkAccess(ctx, env, groupID); err != nil {
+		return nil, err
+	}
+
+	dbh := env.GetDBHandle()
+	rows, err := dbh.RawWithOptions(ctx, db.Opts().WithQueryName("get_retention_rules"), `
+		SELECT * FROM "RetentionRules" WHERE group_id = ? ORDER BY position`, groupID).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policy := &rtpb.RetentionPolicy{}
+	for rows.Next() {
+		r := &tables.RetentionRule{}
+		if err := dbh.DB(ctx).ScanRows(rows, r); err != nil {
+			return nil, err
+		}
+		policy.Rule = append(policy.Rule, &rtpb.RetentionRule{
+			Role:          r.Role,
+			BranchPattern: r.BranchPattern,
+			Tag:           r.Tag,
+			Status:        rtpb.RetentionRule_Status(r.Status),
+			Ttl:           durationpb.New(time.Duration(r.TTLUsec) * time.Microsecond),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &rtpb.GetRetentionPolicyResponse{
+		Policy:               policy,
+		DefaultInvocationTtl: durationpb.New(janitor.InvocationTTL()),
+		DefaultExecutionTtl:  durationpb.New(janitor.ExecutionTTL()),
+		MaxTtl:               durationpb.New(janitor.MaxRetentionRuleTTL()),
+	}, nil
+}
+
+func validateRule(rule *rtpb.RetentionRule) error {
+	if _, ok := rtpb.RetentionRule_Status_name[int32(rule.GetStatus())]; !ok {
+		return status.InvalidArgumentErrorf("invalid status %d", rule.GetStatus())
+	}
+	if ttl := rule.GetTtl(); ttl != nil {
+		if err := ttl.CheckValid(); err != nil {
+			return status.InvalidArgumentErrorf("invalid TTL: %s", err)
+		}
+		if ttl.AsDuration() < 0 {
+			return status.InvalidArgumentError("TTL must not be negative")
+		}
+		if maxTTL := janitor.MaxRetentionRuleTTL(); maxTTL != 0 && ttl.AsDuration() > maxTTL {
+			return status.InvalidArgumentErrorf("TTL must not be longer than %s", maxTTL)
+		}
+	}
+	if strings.Contains(rule.GetTag(), ",") {
+		return status.InvalidArgumentError("tag must not contain a comma")
+	}
+	return nil
+}
+
+// UpdateRetentionPolicy replaces the retention policy of the selected group.
+func UpdateRetentionPolicy(ctx context.Context, env environment.Env, req *rtpb.UpdateRetentionPolicyRequest) (*rtpb.UpdateRetentionPolicyResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := checkAccess(ctx, env, groupID); err != nil {
+		return nil, err
+	}
+	rules := req.GetPolicy().GetRule()
+	if len(rules) > maxRules {
+		return nil, status.InvalidArgumentErrorf("retention policies can have at most %d rules", maxRules)
+	}
+	for i, rule := range rules {
+		if err := validateRule(rule); err != nil {
+			return nil, status.WrapErrorf(err, "rule %d", i)
+		}
+	}
+
+	err := env.GetDBHandle().TransactionWithOptions(ctx, db.Opts().WithQueryName("update_retention_rules"), func(tx *db.DB) error {
+		if err := tx.Exec(`DELETE FROM "RetentionRules" WHERE group_id = ?`, groupID).Error; err != nil {
+			return err
+		}
+		for i, rule := range rules {
+			id, err := tables.PrimaryKeyForTable("RetentionRules")
+			if err != nil {
+				return err
+			}
+			r := &tables.RetentionRule{
+				RetentionRuleID: id,
+				GroupID:         groupID,
+				Position:        int32(i),
+				Role:            rule.GetRole(),
+				BranchPattern:   rule.GetBranchPattern(),
+				Tag:             rule.GetTag(),
+				Status:          int32(rule.GetStatus()),
+				TTLUsec:         rule.GetTtl().AsDuration().Microseconds(),
+			}
+			if err := tx.Create(r).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rtpb.UpdateRetentionPolicyResponse{}, nil
+}
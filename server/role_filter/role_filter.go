@@ -85,6 +85,8 @@ var (
 		"GetStatDrilldown",
 		"GetSuggestion",
 		"SearchExecution",
+		"SearchLogs",
+		"GetFlakyTargets",
 		// Workflow configuration and history (read-only).
 		"GetWorkflows",
 		"GetRepos",
@@ -143,11 +145,15 @@ var (
 		"GetExecutionNodes",
 		// BuildBuddy usage data
 		"GetUsage",
+		"GetUsageReport",
 		// Encryption.
 		"GetEncryptionConfig",
 		"SetEncryptionConfig",
 		// Audit logs.
 		"GetAuditLogs",
+		// Retention policies.
+		"GetRetentionPolicy",
+		"UpdateRetentionPolicy",
 		// Repo management
 		"CreateRepo",
 	}
@@ -164,6 +170,8 @@ var (
 		"RemoveNamespace",
 		"ModifyNamespace",
 		"ApplyBucket",
+		"GetStorageQuota",
+		"SetStorageQuota",
 
 		// Impersonation
 		"CreateImpersonationApiKey",
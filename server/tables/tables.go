@@ -364,6 +364,12 @@ type APIKey struct {
 	Impersonation bool `gorm:"not null;default:0"`
 	// If set, the API key is not considered to be valid after this time.
 	ExpiryUsec int64 `gorm:"not null;default:0"`
+	// When the warning that the key is about to expire was sent, or 0 if no
+	// warning was sent yet.
+	ExpiryWarningSentUsec int64 `gorm:"not null;default:0"`
+	// Comma-separated IP ranges, in CIDR notation, that the key can be used
+	// from. If empty, the key can be used from any IP address.
+	AllowedIPRanges string `gorm:"not null;default:''"`
 }
 
 func (k *APIKey) TableName() string {
@@ -619,6 +625,11 @@ type UsageCounts struct {
 	TotalUploadSizeBytes       int64 `gorm:"not null;default:0"`
 	TotalCachedActionExecUsec  int64 `gorm:"not null;default:0"`
 	CPUNanos                   int64 `gorm:"not null;default:0"`
+
+	// CASStoredSizeBytes is the total digest size of new blobs written to
+	// the CAS, excluding blobs that already existed and failed writes. It is
+	// only recorded when storage quotas are enabled.
+	CASStoredSizeBytes int64 `gorm:"not null;default:0"`
 }
 
 type UsageLabels struct {
@@ -695,6 +706,24 @@ func (*QuotaGroup) TableName() string {
 	return "QuotaGroups"
 }
 
+// StorageQuota holds the byte-based storage limits for a group. A limit of
+// zero is not enforced.
+type StorageQuota struct {
+	Model
+	GroupID string `gorm:"primarykey"`
+
+	// The maximum number of bytes the group may upload to the cache per day.
+	MaxUploadBytesPerDay int64 `gorm:"not null;default:0"`
+
+	// The maximum number of CAS bytes the group may have retained in the
+	// cache.
+	MaxRetainedCASBytes int64 `gorm:"not null;default:0"`
+}
+
+func (*StorageQuota) TableName() string {
+	return "StorageQuotas"
+}
+
 type EncryptionKey struct {
 	Model
 	EncryptionKeyID string `gorm:"primaryKey"`
@@ -740,6 +769,69 @@ func (*IPRule) TableName() string {
 	return "IPRules"
 }
 
+// RetentionRule is a rule in a group's retention policy. The first of the
+// group's rules that matches an invocation determines how long the invocation
+// is kept.
+type RetentionRule struct {
+	Model
+	RetentionRuleID string `gorm:"primaryKey"`
+	GroupID         string `gorm:"not null;index:retention_rule_group_id_idx"`
+
+	// The position of the rule in the group's policy. Rules are evaluated in
+	// ascending order of position.
+	Position int32 `gorm:"not null;default:0"`
+
+	// Match criteria. Empty criteria match all invocations.
+	Role          string
+	BranchPattern string
+	Tag           string
+	// A retention.RetentionRule_Status value.
+	Status int32 `gorm:"not null;default:0"`
+
+	// How long matching invocations are kept. Zero means forever.
+	TTLUsec int64 `gorm:"not null;default:0"`
+}
+
+func (*RetentionRule) TableName() string {
+	return "RetentionRules"
+}
+
+// WorkflowScheduler records the last minute whose workflow schedule triggers
+// were evaluated, so that each minute is evaluated by only one app.
+type WorkflowScheduler struct {
+	Model
+	SchedulerID string `gorm:"primaryKey"`
+
+	// The start of the last minute that was evaluated.
+	LastEvaluatedUsec int64 `gorm:"not null;default:0"`
+}
+
+func (*WorkflowScheduler) TableName() string {
+	return "WorkflowSchedulers"
+}
+
+// AuditLogExportCursor tracks how far the audit log entries in the OLAP DB
+// have been delivered to an audit log export sink.
+type AuditLogExportCursor struct {
+	Model
+	// The name of the sink: "syslog", "webhook" or "blobstore".
+	Sink string `gorm:"primaryKey"`
+
+	// The event time and ID of the last entry that was delivered to the
+	// sink. Entries are delivered in (event time, ID) order.
+	EventTimeUsec int64 `gorm:"not null;default:0"`
+	AuditLogID    string
+
+	// The app that is delivering entries to the sink, and when its claim on
+	// the sink expires.
+	LeaseOwner         string
+	LeaseExpiresAtUsec int64 `gorm:"not null;default:0"`
+}
+
+func (*AuditLogExportCursor) TableName() string {
+	return "AuditLogExportCursors"
+}
+
 type PostAutoMigrateLogic func() error
 
 // Manual migration called before auto-migration.
@@ -1216,6 +1308,7 @@ func RegisterTables() {
 	// Keep these sorted by two-letter prefix (and when adding new tables,
 	// use a unique prefix if possible):
 	registerTable("AK", &APIKey{})
+	registerTable("AX", &AuditLogExportCursor{})
 	registerTable("CA", &CacheEntry{})
 	registerTable("CL", &CacheLog{})
 	registerTable("EK", &EncryptionKey{})
@@ -1229,8 +1322,10 @@ func RegisterTables() {
 	registerTable("QB", &QuotaBucket{})
 	registerTable("QG", &QuotaGroup{})
 	registerTable("RE", &GitRepository{})
+	registerTable("RR", &RetentionRule{})
 	registerTable("SE", &Session{})
 	registerTable("SK", &Secret{})
+	registerTable("SQ", &StorageQuota{})
 	registerTable("TA", &Target{})
 	registerTable("TL", &TelemetryLog{})
 	registerTable("TO", &Token{})
@@ -1239,4 +1334,5 @@ func RegisterTables() {
 	registerTable("UG", &UserGroup{})
 	registerTable("US", &User{})
 	registerTable("WF", &Workflow{})
+	registerTable("WS", &WorkflowScheduler{})
 }
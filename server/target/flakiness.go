@@ -0,0 +1,198 @@
+package target
+
+import (
+	"context"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clickhouse"
+	"github.com/buildbuddy-io/buildbuddy/server/util/paging"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
+
+	cmpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
+	pgpb "github.com/buildbuddy-io/buildbuddy/proto/pagination"
+	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
+)
+
+const (
+	// The time window used for computing flakiness if the request doesn't
+	// specify a start time.
+	defaultFlakinessWindow = 7 * 24 * time.Hour
+
+	// The max number of flaky targets returned per page.
+	flakyTargetsPageSize = 50
+)
+
+// GetFlakyTargets returns the test targets in a repo that flaked in the
+// requested time window, ordered by the fraction of their runs that were
+// flaky.
+//
+// A run is flaky if Bazel reported it as FLAKY, which means that it failed
+// and then passed when retried in the same invocation, or if it failed at a
+// commit where the same target also passed in another invocation. If the
+// request doesn't specify an end time, the window ends at the clock's current
+// time.
+func GetFlakyTargets(ctx context.Context, env environment.Env, clock timeutil.Clock, req *trpb.GetFlakyTargetsRequest) (*trpb.GetFlakyTargetsResponse, error) {
+	if env.GetOLAPDBHandle() == nil {
+		return nil, status.UnimplementedError("Flaky target detection requires an OLAP database")
+	}
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	repo, err := getRepoURL(&trpb.GetTargetHistoryRequest{Query: &trpb.TargetQuery{RepoUrl: req.GetRepoUrl()}})
+	if err != nil {
+		return nil, err
+	}
+	if repo == "" {
+		return nil, status.InvalidArgumentError("expected non empty repo_url")
+	}
+	page, err := paging.DecodeOffsetLimit(req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+	if page.Limit <= 0 || page.Limit > flakyTargetsPageSize {
+		page.Limit = flakyTargetsPageSize
+	}
+
+	endTimeUsec := req.GetEndTimeUsec()
+	if endTimeUsec == 0 {
+		endTimeUsec = clock.Now().UnixMicro()
+	}
+	startTimeUsec := req.GetStartTimeUsec()
+	if startTimeUsec == 0 {
+		startTimeUsec = endTimeUsec - defaultFlakinessWindow.Microseconds()
+	}
+	if startTimeUsec >= endTimeUsec {
+		return nil, status.InvalidArgumentError("start_time_usec must be before end_time_usec")
+	}
+
+	passed := int32(build_event_stream.TestStatus_PASSED)
+	flaky := int32(build_event_stream.TestStatus_FLAKY)
+	failed := []int32{int32(build_event_stream.TestStatus_FAILED), int32(build_event_stream.TestStatus_TIMEOUT)}
+	anyFailed := []int32{flaky, failed[0], failed[1]}
+
+	//  Build the query:
+	//  SELECT * FROM (
+	//    SELECT label, [per-target run counts] FROM (
+	//      SELECT label, commit_sha, [per-commit run counts]
+	//      FROM "TestTargetStatuses"
+	//      WHERE group_id = '[group_id]' AND repo_url = '[repo_url]'
+	//      AND invocation_start_time_usec >= [start] AND ... < [end]
+	//      GROUP BY label, commit_sha)
+	//    GROUP BY label)
+	//  WHERE flakiness_score > 0 AND total_runs >= [min_runs]
+	//  ORDER BY flakiness_score DESC, label ASC
+	//
+	// Runs with an empty commit SHA are never compared against each other,
+	// since they're not known to be running the same code.
+	commitQuery := query_builder.NewQueryWithArgs(`
+		SELECT label, commit_sha,
+		any(rule_type) AS commit_rule_type,
+		any(target_type) AS commit_target_type,
+		any(test_size) AS commit_test_size,
+		count(*) AS commit_runs,
+		countIf(status = ?) AS commit_flaky_runs,
+		countIf(status = ?) AS commit_passed_runs,
+		countIf(status IN ?) AS commit_failed_runs,
+		(commit_sha != '' AND commit_passed_runs > 0 AND commit_failed_runs > 0) AS is_flaky_commit,
+		argMaxIf(invocation_uuid, invocation_start_time_usec, status IN ?) AS commit_last_failed_invocation_uuid,
+		maxIf(invocation_start_time_usec, status IN ?) AS commit_last_failed_invocation_start_time_usec
+		FROM "TestTargetStatuses"`, []interface{}{flaky, passed, failed, anyFailed, anyFailed})
+	commitQuery.AddWhereClause("group_id = ?", groupID)
+	commitQuery.AddWhereClause("repo_url = ?", repo)
+	commitQuery.AddWhereClause("invocation_start_time_usec >= ?", startTimeUsec)
+	commitQuery.AddWhereClause("invocation_start_time_usec < ?", endTimeUsec)
+	if req.GetRole() != "" {
+		commitQuery.AddWhereClause("role = ?", req.GetRole())
+	}
+	commitQuery.SetGroupBy("label, commit_sha")
+
+	q := query_builder.NewQuery(`
+		SELECT label,
+		any(commit_rule_type) AS rule_type,
+		any(commit_target_type) AS target_type,
+		any(commit_test_size) AS test_size,
+		sum(commit_runs) AS total_runs,
+		sum(commit_flaky_runs) AS flaky_runs,
+		sumIf(commit_failed_runs, is_flaky_commit) AS inconsistent_failed_runs,
+		countIf(is_flaky_commit) AS flaky_commits,
+		(flaky_runs + inconsistent_failed_runs) / total_runs AS flakiness_score,
+		argMaxIf(commit_last_failed_invocation_uuid, commit_last_failed_invocation_start_time_usec, commit_flaky_runs > 0 OR is_flaky_commit) AS last_flaky_invocation_uuid,
+		maxIf(commit_last_failed_invocation_start_time_usec, commit_flaky_runs > 0 OR is_flaky_commit) AS last_flaky_invocation_start_time_usec`)
+	q.SetFromClause(commitQuery)
+	q.SetGroupBy("label")
+	// The query builder doesn't support HAVING clauses, so filter the
+	// aggregated rows in an outer query instead.
+	outerQuery := query_builder.NewQuery(`SELECT *`)
+	outerQuery.SetFromClause(q)
+	outerQuery.AddWhereClause("flakiness_score > 0")
+	if req.GetMinRuns() > 0 {
+		outerQuery.AddWhereClause("total_runs >= ?", req.GetMinRuns())
+	}
+	outerQuery.SetOrderBy("flakiness_score DESC, label", true /*=ascending*/)
+	outerQuery.SetLimit(page.Limit)
+	outerQuery.SetOffset(page.Offset)
+
+	qStr, qArgs := outerQuery.Build()
+	db := env.GetOLAPDBHandle().RawWithOptions(ctx, clickhouse.Opts().WithQueryName("get_flaky_targets"), qStr, qArgs...)
+	rows, err := db.Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rsp := &trpb.GetFlakyTargetsResponse{}
+	for rows.Next() {
+		row := struct {
+			Label                            string
+			RuleType                         string
+			TargetType                       int32
+			TestSize                         int32
+			TotalRuns                        int64
+			FlakyRuns                        int64
+			InconsistentFailedRuns           int64
+			FlakyCommits                     int64
+			FlakinessScore                   float64
+			LastFlakyInvocationUUID          string
+			LastFlakyInvocationStartTimeUsec int64
+		}{}
+		if err := db.ScanRows(rows, &row); err != nil {
+			return nil, err
+		}
+		ft := &trpb.FlakyTarget{
+			Metadata: &trpb.TargetMetadata{
+				Label:      row.Label,
+				RuleType:   row.RuleType,
+				TargetType: cmpb.TargetType(row.TargetType),
+				TestSize:   cmpb.TestSize(row.TestSize),
+			},
+			TotalRuns:                        row.TotalRuns,
+			FlakyRuns:                        row.FlakyRuns,
+			InconsistentFailedRuns:           row.InconsistentFailedRuns,
+			FlakyCommits:                     row.FlakyCommits,
+			FlakinessScore:                   row.FlakinessScore,
+			LastFlakyInvocationCreatedAtUsec: row.LastFlakyInvocationStartTimeUsec,
+		}
+		if iid, err := uuid.Base64StringToString(row.LastFlakyInvocationUUID); err == nil {
+			ft.LastFlakyInvocationId = iid
+		}
+		rsp.FlakyTargets = append(rsp.FlakyTargets, ft)
+	}
+	if int64(len(rsp.FlakyTargets)) == page.Limit {
+		tok, err := paging.EncodeOffsetLimit(&pgpb.OffsetLimit{
+			Offset: page.Offset + page.Limit,
+			Limit:  page.Limit,
+		})
+		if err != nil {
+			return nil, err
+		}
+		rsp.NextPageToken = tok
+	}
+	return rsp, nil
+}
@@ -0,0 +1,223 @@
+package target_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/target"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testclock"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clickhouse/schema"
+	"github.com/buildbuddy-io/buildbuddy/server/util/paging"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
+	"github.com/stretchr/testify/require"
+
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	pgpb "github.com/buildbuddy-io/buildbuddy/proto/pagination"
+	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
+)
+
+var windowStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type flakinessEnv struct {
+	te   *testenv.TestEnv
+	ctx  context.Context
+	repo string
+	rows []*schema.TestTargetStatus
+}
+
+func newFlakinessEnv(t *testing.T) *flakinessEnv {
+	te := testenv.GetTestEnv(t)
+	ta := testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2"))
+	te.SetAuthenticator(ta)
+	ctx, err := ta.WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	// Use a unique repo so that statuses written by other tests sharing the
+	// same ClickHouse server don't affect the results.
+	repo := "https://github.com/acme/repo-" + strings.ReplaceAll(uuid.New(), "-", "")
+	return &flakinessEnv{te: te, ctx: ctx, repo: repo}
+}
+
+// add records a run of the given test target, started the given duration
+// after the start of the time window, and returns the run's invocation ID.
+func (e *flakinessEnv) add(groupID, label, commitSHA string, s bespb.TestStatus, offset time.Duration) string {
+	iid := uuid.New()
+	e.rows = append(e.rows, &schema.TestTargetStatus{
+		GroupID:                 groupID,
+		RepoURL:                 e.repo,
+		CommitSHA:               commitSHA,
+		Label:                   label,
+		InvocationUUID:          strings.ReplaceAll(iid, "-", ""),
+		RuleType:                "go_test",
+		TargetType:              1,
+		TestSize:                1,
+		Status:                  int32(s),
+		InvocationStartTimeUsec: windowStart.Add(offset).UnixMicro(),
+		Role:                    "CI",
+	})
+	return iid
+}
+
+func (e *flakinessEnv) flush(t *testing.T) {
+	err := e.te.GetOLAPDBHandle().FlushTestTargetStatuses(context.Background(), e.rows)
+	require.NoError(t, err)
+	e.rows = nil
+}
+
+func (e *flakinessEnv) get(t *testing.T, req *trpb.GetFlakyTargetsRequest) *trpb.GetFlakyTargetsResponse {
+	req.RequestContext = testauth.RequestContext("US1", "GR1")
+	req.RepoUrl = e.repo
+	req.StartTimeUsec = windowStart.UnixMicro()
+	req.EndTimeUsec = windowStart.Add(24 * time.Hour).UnixMicro()
+	rsp, err := target.GetFlakyTargets(e.ctx, e.te, timeutil.NewClock(), req)
+	require.NoError(t, err)
+	return rsp
+}
+
+func labels(rsp *trpb.GetFlakyTargetsResponse) []string {
+	var out []string
+	for _, ft := range rsp.GetFlakyTargets() {
+		out = append(out, ft.GetMetadata().GetLabel())
+	}
+	return out
+}
+
+func TestGetFlakyTargets(t *testing.T) {
+	e := newFlakinessEnv(t)
+
+	// Reported FLAKY by Bazel once in five runs.
+	lastFlaky := e.add("GR1", "//a:flaky_status", "c1", bespb.TestStatus_FLAKY, 1*time.Hour)
+	for i := 0; i < 4; i++ {
+		e.add("GR1", "//a:flaky_status", "c1", bespb.TestStatus_PASSED, 2*time.Hour)
+	}
+	// Runs outside of the time window are ignored.
+	e.add("GR1", "//a:flaky_status", "c1", bespb.TestStatus_FLAKY, -1*time.Hour)
+	e.add("GR1", "//a:flaky_status", "c1", bespb.TestStatus_FLAKY, 25*time.Hour)
+
+	// Passed and failed at c1, but consistently failed at c2.
+	e.add("GR1", "//b:per_commit", "c1", bespb.TestStatus_PASSED, 1*time.Hour)
+	lastInconsistent := e.add("GR1", "//b:per_commit", "c1", bespb.TestStatus_FAILED, 2*time.Hour)
+	e.add("GR1", "//b:per_commit", "c2", bespb.TestStatus_FAILED, 3*time.Hour)
+	e.add("GR1", "//b:per_commit", "c2", bespb.TestStatus_TIMEOUT, 4*time.Hour)
+
+	// Runs without a commit SHA aren't known to be running the same code, so
+	// they're never compared against each other.
+	e.add("GR1", "//c:empty_sha", "", bespb.TestStatus_PASSED, 1*time.Hour)
+	e.add("GR1", "//c:empty_sha", "", bespb.TestStatus_FAILED, 2*time.Hour)
+
+	// Consistent failures aren't flaky.
+	e.add("GR1", "//d:consistent", "c1", bespb.TestStatus_FAILED, 1*time.Hour)
+	e.add("GR1", "//d:consistent", "c1", bespb.TestStatus_FAILED, 2*time.Hour)
+
+	// Very flaky, but only run twice.
+	e.add("GR1", "//e:few_runs", "c3", bespb.TestStatus_PASSED, 1*time.Hour)
+	e.add("GR1", "//e:few_runs", "c3", bespb.TestStatus_TIMEOUT, 2*time.Hour)
+
+	// Other groups' runs aren't visible.
+	e.add("GR2", "//f:other_group", "c1", bespb.TestStatus_FLAKY, 1*time.Hour)
+	e.flush(t)
+
+	rsp := e.get(t, &trpb.GetFlakyTargetsRequest{})
+	require.Equal(t, []string{"//e:few_runs", "//b:per_commit", "//a:flaky_status"}, labels(rsp))
+	require.Empty(t, rsp.GetNextPageToken())
+
+	fewRuns := rsp.GetFlakyTargets()[0]
+	require.Equal(t, int64(2), fewRuns.GetTotalRuns())
+	require.Equal(t, int64(1), fewRuns.GetInconsistentFailedRuns())
+	require.Equal(t, 0.5, fewRuns.GetFlakinessScore())
+
+	perCommit := rsp.GetFlakyTargets()[1]
+	require.Equal(t, int64(4), perCommit.GetTotalRuns())
+	require.Equal(t, int64(0), perCommit.GetFlakyRuns())
+	require.Equal(t, int64(1), perCommit.GetInconsistentFailedRuns())
+	require.Equal(t, int64(1), perCommit.GetFlakyCommits())
+	require.Equal(t, 0.25, perCommit.GetFlakinessScore())
+	require.Equal(t, lastInconsistent, perCommit.GetLastFlakyInvocationId())
+	require.Equal(t, windowStart.Add(2*time.Hour).UnixMicro(), perCommit.GetLastFlakyInvocationCreatedAtUsec())
+
+	flakyStatus := rsp.GetFlakyTargets()[2]
+	require.Equal(t, "go_test", flakyStatus.GetMetadata().GetRuleType())
+	require.Equal(t, int64(5), flakyStatus.GetTotalRuns())
+	require.Equal(t, int64(1), flakyStatus.GetFlakyRuns())
+	require.Equal(t, int64(0), flakyStatus.GetInconsistentFailedRuns())
+	require.Equal(t, int64(0), flakyStatus.GetFlakyCommits())
+	require.Equal(t, 0.2, flakyStatus.GetFlakinessScore())
+	require.Equal(t, lastFlaky, flakyStatus.GetLastFlakyInvocationId())
+
+	// Targets with fewer than min_runs runs are excluded.
+	rsp = e.get(t, &trpb.GetFlakyTargetsRequest{MinRuns: 3})
+	require.Equal(t, []string{"//b:per_commit", "//a:flaky_status"}, labels(rsp))
+
+	// Filtering by a role that no runs have excludes everything.
+	rsp = e.get(t, &trpb.GetFlakyTargetsRequest{Role: "presubmit"})
+	require.Empty(t, rsp.GetFlakyTargets())
+}
+
+func TestGetFlakyTargets_DefaultWindow(t *testing.T) {
+	e := newFlakinessEnv(t)
+	// Without a start or end time, the window is the week before now.
+	clock := testclock.StartingAt(windowStart.Add(8 * 24 * time.Hour))
+	e.add("GR1", "//a:in_window", "c1", bespb.TestStatus_FLAKY, 2*24*time.Hour)
+	e.add("GR1", "//a:in_window", "c1", bespb.TestStatus_PASSED, 3*24*time.Hour)
+	e.add("GR1", "//b:before_window", "c1", bespb.TestStatus_FLAKY, 12*time.Hour)
+	e.add("GR1", "//b:before_window", "c1", bespb.TestStatus_PASSED, 12*time.Hour)
+	e.add("GR1", "//c:after_window", "c1", bespb.TestStatus_FLAKY, 9*24*time.Hour)
+	e.add("GR1", "//c:after_window", "c1", bespb.TestStatus_PASSED, 9*24*time.Hour)
+	e.flush(t)
+
+	get := func() []string {
+		rsp, err := target.GetFlakyTargets(e.ctx, e.te, clock, &trpb.GetFlakyTargetsRequest{
+			RequestContext: testauth.RequestContext("US1", "GR1"),
+			RepoUrl:        e.repo,
+		})
+		require.NoError(t, err)
+		return labels(rsp)
+	}
+	require.Equal(t, []string{"//a:in_window"}, get())
+
+	// The window moves with the clock.
+	clock.Set(windowStart.Add(10 * 24 * time.Hour))
+	require.Equal(t, []string{"//c:after_window"}, get())
+}
+
+func TestGetFlakyTargets_Paging(t *testing.T) {
+	e := newFlakinessEnv(t)
+	for _, label := range []string{"//a:a", "//b:b", "//c:c"} {
+		e.add("GR1", label, "c1", bespb.TestStatus_FLAKY, 1*time.Hour)
+		e.add("GR1", label, "c1", bespb.TestStatus_PASSED, 2*time.Hour)
+	}
+	e.flush(t)
+
+	tok, err := paging.EncodeOffsetLimit(&pgpb.OffsetLimit{Offset: 0, Limit: 2})
+	require.NoError(t, err)
+	rsp := e.get(t, &trpb.GetFlakyTargetsRequest{PageToken: tok})
+	// Targets with the same score are ordered by label.
+	require.Equal(t, []string{"//a:a", "//b:b"}, labels(rsp))
+	require.NotEmpty(t, rsp.GetNextPageToken())
+
+	rsp = e.get(t, &trpb.GetFlakyTargetsRequest{PageToken: rsp.GetNextPageToken()})
+	require.Equal(t, []string{"//c:c"}, labels(rsp))
+	require.Empty(t, rsp.GetNextPageToken())
+
+	_, err = target.GetFlakyTargets(e.ctx, e.te, timeutil.NewClock(), &trpb.GetFlakyTargetsRequest{
+		RequestContext: testauth.RequestContext("US1", "GR1"),
+		RepoUrl:        e.repo,
+		PageToken:      "not-a-token",
+	})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument; got: %v", err)
+}
+
+func TestGetFlakyTargets_RequiresOLAPDB(t *testing.T) {
+	e := newFlakinessEnv(t)
+	e.te.SetOLAPDBHandle(nil)
+	_, err := target.GetFlakyTargets(e.ctx, e.te, timeutil.NewClock(), &trpb.GetFlakyTargetsRequest{
+		RequestContext: testauth.RequestContext("US1", "GR1"),
+		RepoUrl:        e.repo,
+	})
+	require.True(t, status.IsUnimplementedError(err), "expected Unimplemented; got: %v", err)
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
@@ -12,9 +13,11 @@ import (
 )
 
 type FakeEntry struct {
-	Resource *alpb.ResourceID
-	Action   alpb.Action
-	Request  proto.Message
+	// Set for entries logged with LogForPrincipal.
+	Principal *interfaces.AuditLogPrincipal
+	Resource  *alpb.ResourceID
+	Action    alpb.Action
+	Request   proto.Message
 }
 
 type FakeAuditLog struct {
@@ -35,12 +38,18 @@ func New(t *testing.T) *FakeAuditLog {
 	return &FakeAuditLog{t: t, payloadTypes: payloadTypes}
 }
 
-func (f *FakeAuditLog) Log(ctx context.Context, resource *alpb.ResourceID, action alpb.Action, req proto.Message) {
+func (f *FakeAuditLog) checkRequest(req proto.Message) {
+	if req == nil {
+		return
+	}
 	_, ok := f.payloadTypes[req.ProtoReflect().Descriptor()]
 	if !ok {
 		require.FailNowf(f.t, "request type missing from Entry ResourceRequest proto", "missing type: %s", req.ProtoReflect().Descriptor().FullName())
-		return
 	}
+}
+
+func (f *FakeAuditLog) Log(ctx context.Context, resource *alpb.ResourceID, action alpb.Action, req proto.Message) {
+	f.checkRequest(req)
 	f.entries = append(f.entries, &FakeEntry{
 		Resource: resource,
 		Action:   action,
@@ -48,6 +57,16 @@ func (f *FakeAuditLog) Log(ctx context.Context, resource *alpb.ResourceID, actio
 	})
 }
 
+func (f *FakeAuditLog) LogForPrincipal(ctx context.Context, principal *interfaces.AuditLogPrincipal, resource *alpb.ResourceID, action alpb.Action, req proto.Message) {
+	f.checkRequest(req)
+	f.entries = append(f.entries, &FakeEntry{
+		Principal: principal,
+		Resource:  resource,
+		Action:    action,
+		Request:   req,
+	})
+}
+
 func (f *FakeAuditLog) GetLogs(ctx context.Context, req *alpb.GetAuditLogsRequest) (*alpb.GetAuditLogsResponse, error) {
 	return nil, status.UnimplementedError("not implemented")
 }
@@ -66,6 +66,10 @@ func (h *Handle) FlushTestTargetStatuses(ctx context.Context, entries []*schema.
 	return errors.New("Not implemented")
 }
 
+func (h *Handle) FlushLogLines(ctx context.Context, entries []*schema.LogLine) error {
+	return errors.New("Not implemented")
+}
+
 func (h *Handle) GetExecutionIDsByInvID(t *testing.T, invID string) []string {
 	v, ok := h.executionIDsByInvID.Load(invID)
 	require.True(t, ok, "invocation ID %q is not found in OLAP DB", invID)
@@ -25,6 +25,10 @@ var (
 
 const (
 	projectionCommits = "projection_commits"
+
+	// N-gram bloom filter index used to speed up substring searches over build
+	// log lines.
+	logLineNgramIndex = "line_ngram_index"
 )
 
 // Making a new table? Please make sure you:
@@ -47,6 +51,7 @@ func getAllTables() []Table {
 		&Execution{},
 		&TestTargetStatus{},
 		&AuditLog{},
+		&LogLine{},
 	}
 	return tbls
 }
@@ -296,7 +301,8 @@ type AuditLog struct {
 	AuthUserID    string
 	AuthUserEmail string
 
-	ClientIP string
+	ClientIP  string
+	UserAgent string
 
 	ResourceID   string
 	ResourceName string
@@ -323,6 +329,36 @@ func (i *AuditLog) TableOptions() string {
 	return fmt.Sprintf("ENGINE=%s ORDER BY (group_id, event_time_usec, audit_log_id)", getEngine())
 }
 
+// LogLine is a line of an invocation's build log, indexed for build log
+// search.
+type LogLine struct {
+	GroupID        string
+	EventTimeUsec  int64
+	InvocationUUID string
+	// The index of the chunk containing the line, and the line's position
+	// within the chunk.
+	ChunkIndex uint16
+	LineNumber uint32
+
+	Line string
+}
+
+func (l *LogLine) ExcludedFields() []string {
+	return []string{}
+}
+
+func (l *LogLine) AdditionalFields() []string {
+	return []string{}
+}
+
+func (l *LogLine) TableName() string {
+	return "LogLines"
+}
+
+func (l *LogLine) TableOptions() string {
+	return fmt.Sprintf("ENGINE=%s ORDER BY (group_id, event_time_usec, invocation_uuid, chunk_index, line_number)", getEngine())
+}
+
 // hasProjection checks whether a projection exist in the clickhouse
 // schema.
 // gorm-clickhouse doesn't support migration projection.
@@ -418,6 +454,11 @@ func RunMigrations(gdb *gorm.DB) error {
 	if err != nil {
 		return status.InternalErrorf("failed to add projection %q: %s", projectionCommits, err)
 	}
+	// gorm-clickhouse doesn't support data skipping indexes either.
+	indexStmt := fmt.Sprintf("ALTER TABLE %s ADD INDEX IF NOT EXISTS %s line TYPE ngrambf_v1(4, 1024, 2, 0) GRANULARITY 1", (&LogLine{}).TableName(), logLineNgramIndex)
+	if err := gdb.Exec(indexStmt).Error; err != nil {
+		return status.InternalErrorf("failed to add index %q: %s", logLineNgramIndex, err)
+	}
 	return nil
 }
 
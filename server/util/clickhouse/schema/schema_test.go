@@ -45,6 +45,11 @@ func TestSchemaInSync(t *testing.T) {
 			// Not in primary DB.
 			primaryDBTable: nil,
 		},
+		{
+			clickhouseTable: &LogLine{},
+			// Not in primary DB.
+			primaryDBTable: nil,
+		},
 	}
 
 	assert.Equal(t, len(getAllTables()), len(tests), "All clickhouse tables should be present in the tests")
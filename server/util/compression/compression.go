@@ -7,10 +7,14 @@ import (
 	"runtime"
 	"sync"
 
+	"github.com/andybalholm/brotli"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/prometheus"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
 
 var (
@@ -85,8 +89,9 @@ func NewZstdDecompressor(writer io.Writer) (io.WriteCloser, error) {
 				log.Errorf("Failed to return zstd decoder to pool: %s", err.Error())
 			}
 		}()
-		defer pr.Close()
 		n, err := decoder.WriteTo(writer)
+		// If decompression failed, unblock any pending writes.
+		pr.CloseWithError(err)
 		metrics.BytesDecompressed.With(prometheus.Labels{metrics.CompressionType: "zstd"}).Add(float64(n))
 		d.done <- err
 		close(d.done)
@@ -120,6 +125,10 @@ func (d *zstdDecompressor) Close() error {
 type wrappedReader struct {
 	pr          *io.PipeReader
 	inputReader io.ReadCloser
+	// done, if set, is closed once the goroutine that writes to the pipe has
+	// exited. Close waits for it, so that buffers passed by the caller can
+	// safely be reused once Close returns.
+	done chan struct{}
 }
 
 func (r *wrappedReader) Read(p []byte) (int, error) {
@@ -128,7 +137,11 @@ func (r *wrappedReader) Read(p []byte) (int, error) {
 
 func (r *wrappedReader) Close() error {
 	defer r.inputReader.Close()
-	return r.pr.Close()
+	err := r.pr.Close()
+	if r.done != nil {
+		<-r.done
+	}
+	return err
 }
 
 // NewZstdCompressingReader returns a reader that reads chunks from the given
@@ -152,7 +165,9 @@ func (r *wrappedReader) Close() error {
 // at least a few hundred bytes.
 func NewZstdCompressingReader(reader io.ReadCloser, readBuf []byte, compressBuf []byte) (io.ReadCloser, error) {
 	pr, pw := io.Pipe()
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		for {
 			n, err := reader.Read(readBuf)
 			if n > 0 {
@@ -171,6 +186,7 @@ func NewZstdCompressingReader(reader io.ReadCloser, readBuf []byte, compressBuf
 	return &wrappedReader{
 		pr:          pr,
 		inputReader: reader,
+		done:        done,
 	}, nil
 }
 
@@ -272,13 +288,282 @@ func CompressFlate(data []byte, level int) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-func DecompressFlate(data []byte) ([]byte, error) {
+// DecompressFlate decompresses DEFLATE-compressed data, returning an error if
+// the decompressed data is larger than maxSize bytes.
+func DecompressFlate(data []byte, maxSize int64) ([]byte, error) {
 	dataReader := bytes.NewReader(data)
 	rc := flate.NewReader(dataReader)
+	return readAllLimited(rc, maxSize)
+}
+
+// CompressBrotli compresses data using brotli compression at the default
+// level.
+func CompressBrotli(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := brotli.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// DecompressBrotli decompresses brotli-compressed data, returning an error if
+// the decompressed data is larger than maxSize bytes.
+func DecompressBrotli(data []byte, maxSize int64) ([]byte, error) {
+	return readAllLimited(brotli.NewReader(bytes.NewReader(data)), maxSize)
+}
 
-	buf, err := io.ReadAll(rc)
+// readAllLimited reads all of r, returning an error as soon as more than
+// maxSize bytes are read, so that small inputs can't decompress to
+// arbitrarily large outputs.
+func readAllLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	buf, err := io.ReadAll(io.LimitReader(r, maxSize+1))
 	if err != nil {
 		return nil, err
 	}
+	if int64(len(buf)) > maxSize {
+		return nil, status.InvalidArgumentErrorf("decompressed data exceeds the expected size of %d bytes", maxSize)
+	}
 	return buf, nil
 }
+
+// limitedWriter passes writes through to w, returning an error as soon as
+// more than maxSize bytes have been written in total.
+type limitedWriter struct {
+	w       io.Writer
+	n       int64
+	maxSize int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.n+int64(len(p)) > l.maxSize {
+		return 0, status.InvalidArgumentErrorf("decompressed data exceeds the expected size of %d bytes", l.maxSize)
+	}
+	n, err := l.w.Write(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// Compress compresses a chunk of data using the given compressor. For zstd,
+// the compressed data is written into dst, which is reallocated if it is not
+// big enough.
+func Compress(compressor repb.Compressor_Value, dst []byte, src []byte) ([]byte, error) {
+	var out []byte
+	var err error
+	switch compressor {
+	case repb.Compressor_IDENTITY:
+		return src, nil
+	case repb.Compressor_ZSTD:
+		return CompressZstd(dst, src), nil
+	case repb.Compressor_DEFLATE:
+		out, err = CompressFlate(src, flate.DefaultCompression)
+	case repb.Compressor_BROTLI:
+		out, err = CompressBrotli(src)
+	default:
+		return nil, status.UnimplementedErrorf("unsupported compressor %s", compressor)
+	}
+	if err != nil {
+		return nil, err
+	}
+	metrics.BytesCompressed.With(prometheus.Labels{metrics.CompressionType: compressionType(compressor)}).Add(float64(len(src)))
+	return out, nil
+}
+
+// Decompress decompresses a full chunk of data that was compressed using the
+// given compressor, returning an error if the decompressed data is larger than
+// maxSize bytes. For zstd, the decompressed data is written into dst, which is
+// reallocated if it is not big enough.
+func Decompress(compressor repb.Compressor_Value, dst []byte, src []byte, maxSize int64) ([]byte, error) {
+	var out []byte
+	var err error
+	switch compressor {
+	case repb.Compressor_IDENTITY:
+		return src, nil
+	case repb.Compressor_ZSTD:
+		out, err := DecompressZstd(dst, src)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(out)) > maxSize {
+			return nil, status.InvalidArgumentErrorf("decompressed data exceeds the expected size of %d bytes", maxSize)
+		}
+		return out, nil
+	case repb.Compressor_DEFLATE:
+		out, err = DecompressFlate(src, maxSize)
+	case repb.Compressor_BROTLI:
+		out, err = DecompressBrotli(src, maxSize)
+	default:
+		return nil, status.UnimplementedErrorf("unsupported compressor %s", compressor)
+	}
+	if err != nil {
+		return nil, err
+	}
+	metrics.BytesDecompressed.With(prometheus.Labels{metrics.CompressionType: compressionType(compressor)}).Add(float64(len(out)))
+	return out, nil
+}
+
+// compressionType returns the compression type metric label for the given
+// compressor.
+func compressionType(compressor repb.Compressor_Value) string {
+	switch compressor {
+	case repb.Compressor_DEFLATE:
+		return "deflate"
+	case repb.Compressor_BROTLI:
+		return "brotli"
+	default:
+		return "zstd"
+	}
+}
+
+// newStreamCompressor returns a WriteCloser that compresses data written to it
+// using the given compressor, and writes the compressed data to w. Zstd is not
+// supported here; see NewZstdCompressingReader.
+func newStreamCompressor(compressor repb.Compressor_Value, w io.Writer) (io.WriteCloser, error) {
+	switch compressor {
+	case repb.Compressor_DEFLATE:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	case repb.Compressor_BROTLI:
+		return brotli.NewWriter(w), nil
+	default:
+		return nil, status.UnimplementedErrorf("unsupported streaming compressor %s", compressor)
+	}
+}
+
+// newStreamDecompressor returns a reader that decompresses data read from r
+// using the given compressor. Zstd is not supported here; see
+// NewZstdDecompressingReader.
+func newStreamDecompressor(compressor repb.Compressor_Value, r io.Reader) (io.Reader, error) {
+	switch compressor {
+	case repb.Compressor_DEFLATE:
+		return flate.NewReader(r), nil
+	case repb.Compressor_BROTLI:
+		return brotli.NewReader(r), nil
+	default:
+		return nil, status.UnimplementedErrorf("unsupported streaming compressor %s", compressor)
+	}
+}
+
+// NewCompressingReader returns a reader that reads chunks from the given
+// reader into the read buffer, and makes the data available on the output
+// reader compressed with the given compressor.
+//
+// For zstd, this is equivalent to NewZstdCompressingReader. Other compressors
+// produce a single compressed stream, so the compression buffer is unused.
+func NewCompressingReader(compressor repb.Compressor_Value, reader io.ReadCloser, readBuf []byte, compressBuf []byte) (io.ReadCloser, error) {
+	if compressor == repb.Compressor_ZSTD {
+		return NewZstdCompressingReader(reader, readBuf, compressBuf)
+	}
+	pr, pw := io.Pipe()
+	cw, err := newStreamCompressor(compressor, pw)
+	if err != nil {
+		return nil, err
+	}
+	label := prometheus.Labels{metrics.CompressionType: compressionType(compressor)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			n, err := reader.Read(readBuf)
+			if n > 0 {
+				metrics.BytesCompressed.With(label).Add(float64(n))
+				if _, err := cw.Write(readBuf[:n]); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			if err == io.EOF {
+				// Flush the remaining compressed bytes.
+				pw.CloseWithError(cw.Close())
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return &wrappedReader{
+		pr:          pr,
+		inputReader: reader,
+		done:        done,
+	}, nil
+}
+
+// NewDecompressingReader reads data compressed with the given compressor from
+// the input reader and makes the decompressed data available on the output
+// reader.
+func NewDecompressingReader(compressor repb.Compressor_Value, reader io.ReadCloser) (io.ReadCloser, error) {
+	if compressor == repb.Compressor_ZSTD {
+		return NewZstdDecompressingReader(reader)
+	}
+	dr, err := newStreamDecompressor(compressor, reader)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		n, err := io.Copy(pw, dr)
+		pw.CloseWithError(err)
+		metrics.BytesDecompressed.With(prometheus.Labels{metrics.CompressionType: compressionType(compressor)}).Add(float64(n))
+	}()
+	return &wrappedReader{
+		pr:          pr,
+		inputReader: reader,
+	}, nil
+}
+
+type streamDecompressor struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// NewDecompressor returns a WriteCloser that accepts bytes compressed with
+// the given compressor, and streams the decompressed bytes to the given
+// writer. Writes and Close fail with InvalidArgument once the decompressed
+// data exceeds maxSize bytes.
+//
+// For zstd, this is equivalent to NewZstdDecompressor with a size limit.
+func NewDecompressor(compressor repb.Compressor_Value, writer io.Writer, maxSize int64) (io.WriteCloser, error) {
+	writer = &limitedWriter{w: writer, maxSize: maxSize}
+	if compressor == repb.Compressor_ZSTD {
+		return NewZstdDecompressor(writer)
+	}
+	pr, pw := io.Pipe()
+	dr, err := newStreamDecompressor(compressor, pr)
+	if err != nil {
+		return nil, err
+	}
+	d := &streamDecompressor{
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+	go func() {
+		n, err := io.Copy(writer, dr)
+		// If decompression failed, unblock any pending writes.
+		pr.CloseWithError(err)
+		metrics.BytesDecompressed.With(prometheus.Labels{metrics.CompressionType: compressionType(compressor)}).Add(float64(n))
+		d.done <- err
+		close(d.done)
+	}()
+	return d, nil
+}
+
+func (d *streamDecompressor) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+func (d *streamDecompressor) Close() error {
+	var lastErr error
+	if err := d.pw.Close(); err != nil {
+		lastErr = err
+	}
+	// Wait for the remaining bytes to be decompressed by the goroutine.
+	err, ok := <-d.done
+	if ok && err != nil {
+		lastErr = err
+	}
+	return lastErr
+}
@@ -1,11 +1,15 @@
 package compression
 
 import (
+	"bytes"
 	"io"
 	"strings"
 	"testing"
 
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
 
 func Test_NewZstdDecompressingReader(t *testing.T) {
@@ -19,3 +23,128 @@ func Test_NewZstdDecompressingReader(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, blob, string(b))
 }
+
+func TestCompressDecompress(t *testing.T) {
+	blob := []byte(strings.Repeat("AAAAAAAAAAAAA", 100))
+	for _, compressor := range []repb.Compressor_Value{
+		repb.Compressor_IDENTITY,
+		repb.Compressor_ZSTD,
+		repb.Compressor_DEFLATE,
+		repb.Compressor_BROTLI,
+	} {
+		compressed, err := Compress(compressor, nil, blob)
+		require.NoError(t, err, compressor.String())
+		decompressed, err := Decompress(compressor, nil, compressed, int64(len(blob)))
+		require.NoError(t, err, compressor.String())
+		require.Equal(t, blob, decompressed, compressor.String())
+	}
+}
+
+func TestStreamingCompressDecompress(t *testing.T) {
+	blob := []byte(strings.Repeat("AAAAAAAAAAAAA", 10000))
+	for _, compressor := range []repb.Compressor_Value{
+		repb.Compressor_ZSTD,
+		repb.Compressor_DEFLATE,
+		repb.Compressor_BROTLI,
+	} {
+		readBuf := make([]byte, 1024)
+		compressBuf := make([]byte, 1024)
+		cr, err := NewCompressingReader(compressor, io.NopCloser(bytes.NewReader(blob)), readBuf, compressBuf)
+		require.NoError(t, err, compressor.String())
+		compressed, err := io.ReadAll(cr)
+		require.NoError(t, err, compressor.String())
+
+		// Decompress using a reader.
+		dr, err := NewDecompressingReader(compressor, io.NopCloser(bytes.NewReader(compressed)))
+		require.NoError(t, err, compressor.String())
+		decompressed, err := io.ReadAll(dr)
+		require.NoError(t, err, compressor.String())
+		require.Equal(t, blob, decompressed, compressor.String())
+
+		// Decompress using a writer, in small chunks.
+		var out bytes.Buffer
+		dw, err := NewDecompressor(compressor, &out, int64(len(blob)))
+		require.NoError(t, err, compressor.String())
+		for len(compressed) > 0 {
+			n := min(len(compressed), 100)
+			_, err := dw.Write(compressed[:n])
+			require.NoError(t, err, compressor.String())
+			compressed = compressed[n:]
+		}
+		require.NoError(t, dw.Close(), compressor.String())
+		require.Equal(t, blob, out.Bytes(), compressor.String())
+	}
+}
+
+func TestNewDecompressor_CorruptInput(t *testing.T) {
+	var out bytes.Buffer
+	dw, err := NewDecompressor(repb.Compressor_DEFLATE, &out, 1<<20)
+	require.NoError(t, err)
+	dw.Write([]byte("\xff\xff\xff\xffnot deflate data"))
+	require.Error(t, dw.Close())
+}
+
+func TestDecompress_ExceedsMaxSize(t *testing.T) {
+	blob := bytes.Repeat([]byte{0}, 1<<20)
+	for _, compressor := range []repb.Compressor_Value{
+		repb.Compressor_ZSTD,
+		repb.Compressor_DEFLATE,
+		repb.Compressor_BROTLI,
+	} {
+		compressed, err := Compress(compressor, nil, blob)
+		require.NoError(t, err, compressor.String())
+
+		_, err = Decompress(compressor, nil, compressed, int64(len(blob)-1))
+		require.True(t, status.IsInvalidArgumentError(err), "%s: %v", compressor, err)
+
+		decompressed, err := Decompress(compressor, nil, compressed, int64(len(blob)))
+		require.NoError(t, err, compressor.String())
+		require.Equal(t, blob, decompressed, compressor.String())
+	}
+}
+
+func TestNewDecompressor_ExceedsMaxSize(t *testing.T) {
+	blob := bytes.Repeat([]byte{0}, 1<<20)
+	for _, compressor := range []repb.Compressor_Value{
+		repb.Compressor_ZSTD,
+		repb.Compressor_DEFLATE,
+		repb.Compressor_BROTLI,
+	} {
+		compressed, err := Compress(compressor, nil, blob)
+		require.NoError(t, err, compressor.String())
+
+		var out bytes.Buffer
+		dw, err := NewDecompressor(compressor, &out, 1000)
+		require.NoError(t, err, compressor.String())
+		// The write may or may not fail depending on how much is buffered by
+		// the decompressor, but Close must.
+		dw.Write(compressed)
+		err = dw.Close()
+		require.True(t, status.IsInvalidArgumentError(err), "%s: %v", compressor, err)
+		require.LessOrEqual(t, out.Len(), 1000, compressor.String())
+	}
+}
+
+func TestCompressingReader_CloseWaitsForCompression(t *testing.T) {
+	for _, compressor := range []repb.Compressor_Value{
+		repb.Compressor_ZSTD,
+		repb.Compressor_DEFLATE,
+		repb.Compressor_BROTLI,
+	} {
+		readBuf := make([]byte, 16)
+		compressBuf := make([]byte, 16)
+		input := io.NopCloser(strings.NewReader(strings.Repeat("A", 1000)))
+		r, err := NewCompressingReader(compressor, input, readBuf, compressBuf)
+		require.NoError(t, err, compressor.String())
+		_, err = r.Read(make([]byte, 1))
+		require.NoError(t, err, compressor.String())
+		require.NoError(t, r.Close(), compressor.String())
+
+		// Once Close returns, the caller owns the buffers again; writing to
+		// them must not race with the compression goroutine.
+		for i := range readBuf {
+			readBuf[i] = 0
+			compressBuf[i] = 0
+		}
+	}
+}
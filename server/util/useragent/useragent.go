@@ -0,0 +1,23 @@
+package useragent
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const ContextKey = "userAgent"
+
+// Get returns the user agent of the client that sent the request, or "" if
+// it is not known.
+func Get(ctx context.Context) string {
+	if v, ok := ctx.Value(ContextKey).(string); ok {
+		return v
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get("user-agent"); len(vals) > 0 {
+			return vals[0]
+		}
+	}
+	return ""
+}